@@ -45,6 +45,11 @@ var (
 	portableS3KeyPrefix          string
 	portableS3ULPartSize         int
 	portableS3ULConcurrency      int
+	portableS3SSEType            string
+	portableS3SSEKMSKeyID        string
+	portableS3SSECustomerKey     string
+	portableS3ACL                string
+	portableS3ForcePathStyle     bool
 	portableGCSBucket            string
 	portableGCSCredentialsFile   string
 	portableGCSAutoCredentials   int
@@ -73,6 +78,22 @@ var (
 	portableSFTPPrivateKeyPath   string
 	portableSFTPFingerprints     []string
 	portableSFTPPrefix           string
+	portableWebDAVEndpoint       string
+	portableWebDAVUsername       string
+	portableWebDAVPassword       string
+	portableWebDAVSkipTLSVerify  bool
+	portableWebDAVCAPath         string
+	portableWebDAVPrefix         string
+	portableFTPEndpoint          string
+	portableFTPUsername          string
+	portableFTPPassword          string
+	portableFTPTLSMode           int
+	portableFTPSkipTLSVerify     bool
+	portableFTPDisableEPSV       bool
+	portableFTPActiveMode        bool
+	portableFTPPrefix            string
+	portableMemoryMaxSize        int64
+	portableOverlayLowerPath     string
 	portableCmd                  = &cobra.Command{
 		Use:   "portable",
 		Short: "Serve a single directory",
@@ -92,6 +113,9 @@ Please take a look at the usage below to customize the serving parameters`,
 					portableDir = os.TempDir()
 				}
 			}
+			if portableOverlayLowerPath != "" && !filepath.IsAbs(portableOverlayLowerPath) {
+				portableOverlayLowerPath, _ = filepath.Abs(portableOverlayLowerPath)
+			}
 			permissions := make(map[string][]string)
 			permissions["/"] = portablePermissions
 			portableGCSCredentials := ""
@@ -113,6 +137,15 @@ Please take a look at the usage below to customize the serving parameters`,
 				}
 				portableSFTPPrivateKey = contents
 			}
+			portableWebDAVCACertificate := ""
+			if fsProvider == dataprovider.WebDAVFilesystemProvider && portableWebDAVCAPath != "" {
+				contents, err := getFileContents(portableWebDAVCAPath)
+				if err != nil {
+					fmt.Printf("Unable to get WebDAV CA certificate: %v\n", err)
+					os.Exit(1)
+				}
+				portableWebDAVCACertificate = contents
+			}
 			if portableFTPDPort >= 0 && len(portableFTPSCert) > 0 && len(portableFTPSKey) > 0 {
 				_, err := common.NewCertManager(portableFTPSCert, portableFTPSKey, filepath.Clean(defaultConfigDir),
 					"FTP portable")
@@ -161,6 +194,11 @@ Please take a look at the usage below to customize the serving parameters`,
 							KeyPrefix:         portableS3KeyPrefix,
 							UploadPartSize:    int64(portableS3ULPartSize),
 							UploadConcurrency: portableS3ULConcurrency,
+							SSEType:           portableS3SSEType,
+							SSEKMSKeyID:       portableS3SSEKMSKeyID,
+							SSECustomerKey:    kms.NewPlainSecret(portableS3SSECustomerKey),
+							ACL:               portableS3ACL,
+							ForcePathStyle:    portableS3ForcePathStyle,
 						},
 						GCSConfig: vfs.GCSFsConfig{
 							Bucket:               portableGCSBucket,
@@ -192,6 +230,30 @@ Please take a look at the usage below to customize the serving parameters`,
 							Fingerprints: portableSFTPFingerprints,
 							Prefix:       portableSFTPPrefix,
 						},
+						WebDAVConfig: vfs.WebDAVFsConfig{
+							Endpoint:      portableWebDAVEndpoint,
+							Username:      portableWebDAVUsername,
+							Password:      kms.NewPlainSecret(portableWebDAVPassword),
+							SkipTLSVerify: portableWebDAVSkipTLSVerify,
+							CACertificate: portableWebDAVCACertificate,
+							Prefix:        portableWebDAVPrefix,
+						},
+						FTPConfig: vfs.FTPFsConfig{
+							Endpoint:      portableFTPEndpoint,
+							Username:      portableFTPUsername,
+							Password:      kms.NewPlainSecret(portableFTPPassword),
+							TLSMode:       portableFTPTLSMode,
+							SkipTLSVerify: portableFTPSkipTLSVerify,
+							DisableEPSV:   portableFTPDisableEPSV,
+							ActiveMode:    portableFTPActiveMode,
+							Prefix:        portableFTPPrefix,
+						},
+						MemoryConfig: vfs.MemoryFsConfig{
+							MaxSize: portableMemoryMaxSize,
+						},
+						OverlayConfig: vfs.OverlayFsConfig{
+							LowerPath: portableOverlayLowerPath,
+						},
 					},
 					Filters: dataprovider.UserFilters{
 						FilePatterns: parsePatternsFilesFilters(),
@@ -261,7 +323,10 @@ inside the advertised TXT record`)
 2 => Google Cloud Storage
 3 => Azure Blob Storage
 4 => Encrypted local filesystem
-5 => SFTP`)
+5 => SFTP
+6 => WebDAV
+7 => FTP
+8 => In memory`)
 	portableCmd.Flags().StringVar(&portableS3Bucket, "s3-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableS3Region, "s3-region", "", "")
 	portableCmd.Flags().StringVar(&portableS3AccessKey, "s3-access-key", "", "")
@@ -275,6 +340,17 @@ prefix and its contents`)
 (MB)`)
 	portableCmd.Flags().IntVar(&portableS3ULConcurrency, "s3-upload-concurrency", 2, `How many parts are uploaded in
 parallel`)
+	portableCmd.Flags().StringVar(&portableS3SSEType, "s3-sse-type", "", `Server-side encryption: "sse-s3",
+"sse-kms" or "sse-c". Empty means no
+server-side encryption`)
+	portableCmd.Flags().StringVar(&portableS3SSEKMSKeyID, "s3-sse-kms-key-id", "", `The KMS key ID for "sse-kms". Empty
+means the AWS managed key`)
+	portableCmd.Flags().StringVar(&portableS3SSECustomerKey, "s3-sse-customer-key", "", `The 32 bytes key for "sse-c", raw or
+base64 encoded`)
+	portableCmd.Flags().StringVar(&portableS3ACL, "s3-acl", "", `Canned ACL for the uploaded objects,
+for example "bucket-owner-full-control"`)
+	portableCmd.Flags().BoolVar(&portableS3ForcePathStyle, "s3-force-path-style", false, `Use path-style addressing, required
+by most S3 compatible object storages`)
 	portableCmd.Flags().StringVar(&portableGCSBucket, "gcs-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableGCSStorageClass, "gcs-storage-class", "", "")
 	portableCmd.Flags().StringVar(&portableGCSKeyPrefix, "gcs-key-prefix", "", `Allows to restrict access to the
@@ -318,6 +394,44 @@ key for SFTP provider`)
 	portableCmd.Flags().StringVar(&portableSFTPPrefix, "sftp-prefix", "", `SFTP prefix allows restrict all
 operations to a given path within the
 remote SFTP server`)
+	portableCmd.Flags().StringVar(&portableWebDAVEndpoint, "webdav-endpoint", "", `WebDAV endpoint as URL for WebDAV
+provider, for example
+https://dav.example.com/dav`)
+	portableCmd.Flags().StringVar(&portableWebDAVUsername, "webdav-username", "", `WebDAV user for WebDAV provider`)
+	portableCmd.Flags().StringVar(&portableWebDAVPassword, "webdav-password", "", `WebDAV password for WebDAV provider`)
+	portableCmd.Flags().BoolVar(&portableWebDAVSkipTLSVerify, "webdav-skip-tls-verify", false, `Disable the server certificate
+verification for WebDAV provider.
+This is a security risk`)
+	portableCmd.Flags().StringVar(&portableWebDAVCAPath, "webdav-ca-path", "", `Path to a PEM encoded CA certificate
+to verify the server certificate
+for WebDAV provider`)
+	portableCmd.Flags().StringVar(&portableWebDAVPrefix, "webdav-prefix", "", `WebDAV prefix allows restrict all
+operations to a given path within the
+remote WebDAV server`)
+	portableCmd.Flags().StringVar(&portableFTPEndpoint, "ftp-endpoint", "", `FTP endpoint as host:port for FTP
+provider`)
+	portableCmd.Flags().StringVar(&portableFTPUsername, "ftp-username", "", `FTP user for FTP provider`)
+	portableCmd.Flags().StringVar(&portableFTPPassword, "ftp-password", "", `FTP password for FTP provider`)
+	portableCmd.Flags().IntVar(&portableFTPTLSMode, "ftp-tls-mode", 0, `TLS mode for FTP provider:
+0 => plain FTP
+1 => explicit TLS
+2 => implicit TLS`)
+	portableCmd.Flags().BoolVar(&portableFTPSkipTLSVerify, "ftp-skip-tls-verify", false, `Disable the server certificate
+verification for FTP provider.
+This is a security risk`)
+	portableCmd.Flags().BoolVar(&portableFTPDisableEPSV, "ftp-disable-epsv", false, `Use PASV instead of EPSV for data
+connections for FTP provider`)
+	portableCmd.Flags().BoolVar(&portableFTPActiveMode, "ftp-active-mode", false, `Use the active mode for data
+connections for FTP provider`)
+	portableCmd.Flags().StringVar(&portableFTPPrefix, "ftp-prefix", "", `FTP prefix allows restrict all
+operations to a given path within the
+remote FTP server`)
+	portableCmd.Flags().Int64Var(&portableMemoryMaxSize, "memory-max-size", 0, `Maximum size, as bytes, of the data
+stored in memory for the in memory
+provider. 0 means no limit`)
+	portableCmd.Flags().StringVar(&portableOverlayLowerPath, "overlay-lower-path", "", `Local directory to show read-only
+below the served storage. Changes
+are written to the served storage`)
 	rootCmd.AddCommand(portableCmd)
 }
 
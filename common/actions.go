@@ -28,7 +28,7 @@ var (
 
 // ProtocolActions defines the action to execute on file operations and SSH commands
 type ProtocolActions struct {
-	// Valid values are download, upload, pre-delete, delete, rename, ssh_cmd. Empty slice to disable
+	// Valid values are download, upload, pre-delete, delete, trash, purge, rename, ssh_cmd. Empty slice to disable
 	ExecuteOn []string `json:"execute_on" mapstructure:"execute_on"`
 	// Absolute path to an external program or an HTTP URL
 	Hook string `json:"hook" mapstructure:"hook"`
@@ -57,17 +57,19 @@ type ActionHandler interface {
 
 // ActionNotification defines a notification for a Protocol Action.
 type ActionNotification struct {
-	Action     string `json:"action"`
-	Username   string `json:"username"`
-	Path       string `json:"path"`
-	TargetPath string `json:"target_path,omitempty"`
-	SSHCmd     string `json:"ssh_cmd,omitempty"`
-	FileSize   int64  `json:"file_size,omitempty"`
-	FsProvider int    `json:"fs_provider"`
-	Bucket     string `json:"bucket,omitempty"`
-	Endpoint   string `json:"endpoint,omitempty"`
-	Status     int    `json:"status"`
-	Protocol   string `json:"protocol"`
+	Action     string            `json:"action"`
+	Username   string            `json:"username"`
+	Path       string            `json:"path"`
+	TargetPath string            `json:"target_path,omitempty"`
+	SSHCmd     string            `json:"ssh_cmd,omitempty"`
+	FileSize   int64             `json:"file_size,omitempty"`
+	FsProvider int               `json:"fs_provider"`
+	Bucket     string            `json:"bucket,omitempty"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	Status     int               `json:"status"`
+	Protocol   string            `json:"protocol"`
+	MimeType   string            `json:"mime_type,omitempty"`
+	Checksums  map[string]string `json:"checksums,omitempty"`
 }
 
 func newActionNotification(
@@ -189,7 +191,7 @@ func (h defaultActionHandler) handleCommand(notification ActionNotification) err
 }
 
 func notificationAsEnvVars(notification ActionNotification) []string {
-	return []string{
+	envVars := []string{
 		fmt.Sprintf("SFTPGO_ACTION=%v", notification.Action),
 		fmt.Sprintf("SFTPGO_ACTION_USERNAME=%v", notification.Username),
 		fmt.Sprintf("SFTPGO_ACTION_PATH=%v", notification.Path),
@@ -201,5 +203,10 @@ func notificationAsEnvVars(notification ActionNotification) []string {
 		fmt.Sprintf("SFTPGO_ACTION_ENDPOINT=%v", notification.Endpoint),
 		fmt.Sprintf("SFTPGO_ACTION_STATUS=%v", notification.Status),
 		fmt.Sprintf("SFTPGO_ACTION_PROTOCOL=%v", notification.Protocol),
+		fmt.Sprintf("SFTPGO_ACTION_MIME_TYPE=%v", notification.MimeType),
 	}
+	for algo, checksum := range notification.Checksums {
+		envVars = append(envVars, fmt.Sprintf("SFTPGO_ACTION_CHECKSUM_%v=%v", strings.ToUpper(algo), checksum))
+	}
+	return envVars
 }
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// supported checksum algorithms
+const (
+	ChecksumCRC32  = "crc32"
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA384 = "sha384"
+	ChecksumSHA512 = "sha512"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumCRC32:  func() hash.Hash { return crc32.NewIEEE() },
+	ChecksumMD5:    md5.New,
+	ChecksumSHA1:   sha1.New,
+	ChecksumSHA256: sha256.New,
+	ChecksumSHA384: sha512.New384,
+	ChecksumSHA512: sha512.New,
+}
+
+// NewChecksumHasher returns a new hash for the given algorithm
+func NewChecksumHasher(algo string) (hash.Hash, error) {
+	if newFn, ok := checksumAlgorithms[strings.ToLower(algo)]; ok {
+		return newFn(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %#v", algo)
+}
+
+func validateUploadChecksums(algos []string) ([]string, error) {
+	var result []string
+	for _, algo := range algos {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if _, ok := checksumAlgorithms[algo]; !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm %#v", algo)
+		}
+		found := false
+		for _, a := range result {
+			if a == algo {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, algo)
+		}
+	}
+	return result, nil
+}
+
+// maximum size for the data received out of order, and kept in memory until
+// the missing data arrives, while computing the upload checksums. SFTP clients
+// send many write requests in parallel and they can be processed out of order
+const maxChecksumsPendingSize = 8 * 1024 * 1024
+
+// uploadChecksums computes the configured checksums while receiving an upload.
+// The checksums are valid only if the whole file is written once, starting
+// from the first byte and without gaps
+type uploadChecksums struct {
+	hashers     map[string]hash.Hash
+	written     int64
+	pending     map[int64][]byte
+	pendingSize int
+	valid       bool
+}
+
+func newUploadChecksums(algos []string) *uploadChecksums {
+	if len(algos) == 0 {
+		return nil
+	}
+	c := &uploadChecksums{
+		hashers: make(map[string]hash.Hash),
+		pending: make(map[int64][]byte),
+		valid:   true,
+	}
+	for _, algo := range algos {
+		c.hashers[algo] = checksumAlgorithms[algo]()
+	}
+	return c
+}
+
+func (c *uploadChecksums) write(data []byte, offset int64) {
+	if !c.valid || len(data) == 0 {
+		return
+	}
+	if offset < c.written {
+		// the data was already hashed, the file is written more than once
+		c.invalidate()
+		return
+	}
+	if offset > c.written {
+		if _, ok := c.pending[offset]; ok || c.pendingSize+len(data) > maxChecksumsPendingSize {
+			c.invalidate()
+			return
+		}
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		c.pending[offset] = buf
+		c.pendingSize += len(buf)
+		return
+	}
+	c.hash(data)
+	for {
+		buf, ok := c.pending[c.written]
+		if !ok {
+			return
+		}
+		delete(c.pending, c.written)
+		c.pendingSize -= len(buf)
+		c.hash(buf)
+	}
+}
+
+func (c *uploadChecksums) hash(data []byte) {
+	for _, h := range c.hashers {
+		h.Write(data) //nolint:errcheck
+	}
+	c.written += int64(len(data))
+}
+
+func (c *uploadChecksums) invalidate() {
+	c.valid = false
+	c.hashers = nil
+	c.pending = nil
+	c.pendingSize = 0
+}
+
+// getChecksums returns the computed checksums, the keys are the algorithm names
+// and the values the hex encoded digests, or nil if they are not valid
+func (c *uploadChecksums) getChecksums(size int64) map[string]string {
+	if !c.valid || len(c.pending) > 0 || c.written != size {
+		return nil
+	}
+	result := make(map[string]string)
+	for algo, h := range c.hashers {
+		result[algo] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return result
+}
+
+// GetFileChecksum returns the hex encoded checksum for the file at fsPath using
+// the given algorithm. The checksum stored while uploading the file is returned,
+// if available, otherwise the checksum is computed reading the file
+func (c *BaseConnection) GetFileChecksum(fsPath, algo string) (string, error) {
+	hasher, err := NewChecksumHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	if checksum, _, ok := vfs.GetStoredChecksum(c.Fs, fsPath, algo); ok {
+		c.Log(logger.LevelDebug, "returning the stored %v checksum for %#v", algo, fsPath)
+		return checksum, nil
+	}
+	return c.computeChecksum(hasher, fsPath, 0, -1)
+}
+
+// GetFileRangeChecksum returns the hex encoded checksum for the bytes between
+// startOffset and endOffset of the file at fsPath using the given algorithm.
+// The stored checksum is returned if the range covers the whole file
+func (c *BaseConnection) GetFileRangeChecksum(fsPath, algo string, startOffset, endOffset int64) (string, error) {
+	hasher, err := NewChecksumHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	if startOffset == 0 {
+		if checksum, size, ok := vfs.GetStoredChecksum(c.Fs, fsPath, algo); ok && endOffset >= size {
+			c.Log(logger.LevelDebug, "returning the stored %v checksum for %#v", algo, fsPath)
+			return checksum, nil
+		}
+	}
+	return c.computeChecksum(hasher, fsPath, startOffset, endOffset)
+}
+
+// computeChecksum reads the file at fsPath, starting from startOffset, and
+// returns its checksum. A negative endOffset means up to the end of the file
+func (c *BaseConnection) computeChecksum(hasher hash.Hash, fsPath string, startOffset, endOffset int64) (string, error) {
+	f, r, cancelFn, err := c.Fs.Open(fsPath, startOffset)
+	if err != nil {
+		return "", err
+	}
+	if cancelFn == nil {
+		cancelFn = func() {}
+	}
+	defer cancelFn()
+
+	var reader io.ReadCloser
+	if f != nil {
+		reader = f
+		if startOffset > 0 {
+			if _, err = f.Seek(startOffset, io.SeekStart); err != nil {
+				f.Close()
+				return "", err
+			}
+		}
+	} else {
+		reader = r
+	}
+	defer reader.Close()
+
+	if endOffset >= 0 {
+		_, err = io.CopyN(hasher, reader, endOffset-startOffset)
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		_, err = io.Copy(hasher, reader)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
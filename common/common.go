@@ -23,6 +23,7 @@ import (
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 // constants
@@ -34,6 +35,7 @@ const (
 	rmdirLogSender           = "Rmdir"
 	mkdirLogSender           = "Mkdir"
 	symlinkLogSender         = "Symlink"
+	linkLogSender            = "Link"
 	removeLogSender          = "Remove"
 	chownLogSender           = "Chown"
 	chmodLogSender           = "Chmod"
@@ -44,6 +46,8 @@ const (
 	operationDelete          = "delete"
 	operationPreDelete       = "pre-delete"
 	operationRename          = "rename"
+	operationTrash           = "trash"
+	operationPurge           = "purge"
 	operationSSHCmd          = "ssh_cmd"
 	chtimesFormat            = "2006-01-02T15:04:05" // YYYY-MM-DDTHH:MM:SS
 	idleTimeoutCheckInterval = 3 * time.Minute
@@ -70,6 +74,8 @@ const (
 	ProtocolSSH    = "SSH"
 	ProtocolFTP    = "FTP"
 	ProtocolWebDAV = "DAV"
+	// ProtocolHTTP is used for the actions triggered using the REST API
+	ProtocolHTTP = "HTTP"
 )
 
 // Upload modes
@@ -108,7 +114,15 @@ var (
 
 // Initialize sets the common configuration
 func Initialize(c Configuration) error {
+	uploadChecksums, err := validateUploadChecksums(c.UploadChecksums)
+	if err != nil {
+		return fmt.Errorf("upload checksums: %v", err)
+	}
+	if c.QuarantinePath != "" && !filepath.IsAbs(c.QuarantinePath) {
+		return fmt.Errorf("invalid quarantine path %#v, it must be an absolute path", c.QuarantinePath)
+	}
 	Config = c
+	Config.UploadChecksums = uploadChecksums
 	Config.idleLoginTimeout = 2 * time.Minute
 	Config.idleTimeoutAsDuration = time.Duration(Config.IdleTimeout) * time.Minute
 	if Config.IdleTimeout > 0 {
@@ -123,6 +137,36 @@ func Initialize(c Configuration) error {
 		logger.Info(logSender, "", "defender initialized with config %+v", c.DefenderConfig)
 		Config.defender = defender
 	}
+	if err := vfs.InitializeReadCache(c.ReadCache); err != nil {
+		return fmt.Errorf("read cache initialization error: %v", err)
+	}
+	stopPartialUploadsTicker()
+	if err := vfs.InitializeResumableUploads(c.ResumableUploads); err != nil {
+		return fmt.Errorf("resumable uploads initialization error: %v", err)
+	}
+	if c.ResumableUploads.IsEnabled() {
+		startPartialUploadsTicker(partialUploadsCheckInterval)
+	}
+	if err := vfs.InitializeVersioning(c.VersionsPath); err != nil {
+		return err
+	}
+	if err := vfs.InitializeTrash(c.TrashPath); err != nil {
+		return err
+	}
+	if err := vfs.InitializeSFTPFsPool(c.SFTPFsPool); err != nil {
+		return fmt.Errorf("SFTP connections pool initialization error: %v", err)
+	}
+	startTrashExpirationTicker(trashExpirationCheckInterval)
+	stopTieringTicker()
+	if err := vfs.InitializeTiering(c.Tiering); err != nil {
+		return fmt.Errorf("storage tiering initialization error: %v", err)
+	}
+	if c.Tiering.IsEnabled() && c.Tiering.CheckInterval > 0 {
+		startTieringTicker(time.Duration(c.Tiering.CheckInterval) * time.Minute)
+	}
+	if err := InitializeReplication(c.Replication); err != nil {
+		return fmt.Errorf("replication initialization error: %v", err)
+	}
 	return nil
 }
 
@@ -318,7 +362,34 @@ type Configuration struct {
 	// Maximum number of concurrent client connections. 0 means unlimited
 	MaxTotalConnections int `json:"max_total_connections" mapstructure:"max_total_connections"`
 	// Defender configuration
-	DefenderConfig        DefenderConfig `json:"defender" mapstructure:"defender"`
+	DefenderConfig DefenderConfig `json:"defender" mapstructure:"defender"`
+	// Local read cache for remote filesystems
+	ReadCache vfs.ReadCacheConfig `json:"read_cache" mapstructure:"read_cache"`
+	// Resumable uploads for S3 and Azure Blob storage
+	ResumableUploads vfs.ResumableUploadsConfig `json:"resumable_uploads" mapstructure:"resumable_uploads"`
+	// Sharing of the SSH connections to the SFTP storage backends
+	SFTPFsPool vfs.SFTPFsPoolConfig `json:"sftpfs_pool" mapstructure:"sftpfs_pool"`
+	// Target for the storage tiering from the local disk
+	Tiering vfs.TieringConfig `json:"tiering" mapstructure:"tiering"`
+	// Secondary storage for the asynchronous replication of the users changes
+	Replication vfs.ReplicationConfig `json:"replication" mapstructure:"replication"`
+	// Active checks for the data provider, the KMS and the storage backends used for the readiness
+	HealthChecks HealthChecksConfig `json:"health_checks" mapstructure:"health_checks"`
+	// Absolute path to a local directory where the uploads denied by the content type filters
+	// are moved, inside a sub directory for each user. Leave empty to remove the denied uploads
+	QuarantinePath string `json:"quarantine_path" mapstructure:"quarantine_path"`
+	// Absolute path to the directory where the previous versions of the files are stored, inside
+	// a sub directory for each user. For the storage backends other than the local filesystem
+	// the path is inside the same bucket, container or remote server. Required to enable versioning
+	VersionsPath string `json:"versions_path" mapstructure:"versions_path"`
+	// Absolute path to the directory where the deleted items are stored, inside a sub directory
+	// for each user. For the storage backends other than the local filesystem the path is
+	// inside the same bucket, container or remote server. Required to enable the trash
+	TrashPath string `json:"trash_path" mapstructure:"trash_path"`
+	// Checksums to compute while uploading files. Supported algorithms: crc32, md5, sha1, sha256, sha384, sha512.
+	// The checksums are stored, if the storage backend supports this, and used to reply to the
+	// hash commands without reading the files again. They are also included in upload notifications
+	UploadChecksums       []string `json:"upload_checksums" mapstructure:"upload_checksums"`
 	idleTimeoutAsDuration time.Duration
 	idleLoginTimeout      time.Duration
 	defender              Defender
@@ -1,11 +1,15 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -279,6 +283,52 @@ func TestDefenderIntegration(t *testing.T) {
 	Config = configCopy
 }
 
+func TestResumableUploadsIntegration(t *testing.T) {
+	configCopy := Config
+
+	stateDir := filepath.Join(os.TempDir(), "resumable_uploads")
+	Config.ResumableUploads = vfs.ResumableUploadsConfig{
+		StatePath: "relative",
+		MaxAge:    1,
+	}
+	err := Initialize(Config)
+	assert.Error(t, err)
+	Config.ResumableUploads.StatePath = stateDir
+	Config.ResumableUploads.MaxAge = 0
+	err = Initialize(Config)
+	assert.Error(t, err)
+	Config.ResumableUploads.MaxAge = 1
+
+	err = os.MkdirAll(stateDir, os.ModePerm)
+	assert.NoError(t, err)
+	h := sha256.Sum256([]byte("s3|endpoint|bucket|/file.dat"))
+	stateFile := filepath.Join(stateDir, hex.EncodeToString(h[:])+".json")
+	err = ioutil.WriteFile(stateFile, []byte(`{"namespace":"s3|endpoint|bucket","key":"file.dat","owner":"missing user",`+
+		`"upload_id":"id","parts":[{"number":1,"etag":"etag","size":5242880}],"updated_at":1}`), os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(stateDir, "invalid.json"), []byte(`{`), os.ModePerm)
+	assert.NoError(t, err)
+
+	err = Initialize(Config)
+	assert.NoError(t, err)
+	stale := vfs.GetStalePartialUploads()
+	if assert.Len(t, stale, 1) {
+		assert.Equal(t, "file.dat", stale[0].Key)
+		assert.Equal(t, "missing user", stale[0].Owner)
+	}
+	abortStalePartialUploads()
+	assert.Len(t, vfs.GetStalePartialUploads(), 0)
+	assert.NoFileExists(t, stateFile)
+
+	Config = configCopy
+	err = Initialize(Config)
+	assert.NoError(t, err)
+	assert.Len(t, vfs.GetStalePartialUploads(), 0)
+
+	err = os.RemoveAll(stateDir)
+	assert.NoError(t, err)
+}
+
 func TestMaxConnections(t *testing.T) {
 	oldValue := Config.MaxTotalConnections
 	Config.MaxTotalConnections = 1
@@ -207,17 +207,22 @@ func (c *BaseConnection) truncateOpenHandle(fsPath string, size int64) (int64, e
 	return 0, errNoTransfer
 }
 
-// ListDir reads the directory named by fsPath and returns a list of directory entries
-func (c *BaseConnection) ListDir(fsPath, virtualPath string) ([]os.FileInfo, error) {
+// ListDir opens the directory named by fsPath and returns a lister to read
+// its entries page by page
+func (c *BaseConnection) ListDir(fsPath, virtualPath string) (*DirListerAt, error) {
 	if !c.User.HasPerm(dataprovider.PermListItems, virtualPath) {
 		return nil, c.GetPermissionDeniedError()
 	}
-	files, err := c.Fs.ReadDir(fsPath)
+	if !c.User.IsDirListingAllowed(virtualPath) {
+		c.Log(logger.LevelInfo, "listing for directory %#v is denied by the patterns filters", virtualPath)
+		return nil, c.GetPermissionDeniedError()
+	}
+	lister, err := c.Fs.OpenDir(fsPath)
 	if err != nil {
 		c.Log(logger.LevelWarn, "error listing directory: %+v", err)
 		return nil, c.GetFsError(err)
 	}
-	return c.User.AddVirtualDirs(files, virtualPath), nil
+	return newDirListerAt(c, virtualPath, lister), nil
 }
 
 // CreateDir creates a new directory at the specified fsPath
@@ -234,6 +239,7 @@ func (c *BaseConnection) CreateDir(fsPath, virtualPath string) error {
 		return c.GetFsError(err)
 	}
 	vfs.SetPathPermissions(c.Fs, fsPath, c.User.GetUID(), c.User.GetGID())
+	AddReplicationJob(c.User.Username, dataprovider.ReplicationActionUpload, virtualPath, "")
 
 	logger.CommandLog(mkdirLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1)
 	return nil
@@ -248,7 +254,7 @@ func (c *BaseConnection) IsRemoveFileAllowed(fsPath, virtualPath string) error {
 		c.Log(logger.LevelDebug, "removing file %#v is not allowed", fsPath)
 		return c.GetPermissionDeniedError()
 	}
-	return nil
+	return c.CheckRetentionLock(fsPath, virtualPath, nil)
 }
 
 // RemoveFile removes a file at the specified fsPath
@@ -256,11 +262,19 @@ func (c *BaseConnection) RemoveFile(fsPath, virtualPath string, info os.FileInfo
 	if err := c.IsRemoveFileAllowed(fsPath, virtualPath); err != nil {
 		return err
 	}
-	size := info.Size()
+	size := vfs.GetQuotaSize(info)
+	// read-only lower layer files are not included in the quota
+	isOverlayLowerFile := vfs.IsOverlayLowerFile(c.Fs, fsPath)
+	isTrashed := false
 	action := newActionNotification(&c.User, operationPreDelete, fsPath, "", "", c.protocol, size, nil)
 	actionErr := actionHandler.Handle(action)
 	if actionErr == nil {
 		c.Log(logger.LevelDebug, "remove for path %#v handled by pre-delete action", fsPath)
+	} else if c.IsTrashEnabledFor(virtualPath) {
+		if err := c.moveToTrash(fsPath); err != nil {
+			return err
+		}
+		isTrashed = true
 	} else {
 		if err := c.Fs.Remove(fsPath, false); err != nil {
 			c.Log(logger.LevelWarn, "failed to remove a file/symlink %#v: %+v", fsPath, err)
@@ -269,7 +283,8 @@ func (c *BaseConnection) RemoveFile(fsPath, virtualPath string, info os.FileInfo
 	}
 
 	logger.CommandLog(removeLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1)
-	if info.Mode()&os.ModeSymlink == 0 {
+	AddReplicationJob(c.User.Username, dataprovider.ReplicationActionDelete, virtualPath, "")
+	if info.Mode()&os.ModeSymlink == 0 && !isOverlayLowerFile {
 		vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
 		if err == nil {
 			dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, -1, -size, false) //nolint:errcheck
@@ -281,7 +296,11 @@ func (c *BaseConnection) RemoveFile(fsPath, virtualPath string, info os.FileInfo
 		}
 	}
 	if actionErr != nil {
-		action := newActionNotification(&c.User, operationDelete, fsPath, "", "", c.protocol, size, nil)
+		operation := operationDelete
+		if isTrashed {
+			operation = operationTrash
+		}
+		action := newActionNotification(&c.User, operation, fsPath, "", "", c.protocol, size, nil)
 		go actionHandler.Handle(action) // nolint:errcheck
 	}
 	return nil
@@ -332,12 +351,70 @@ func (c *BaseConnection) RemoveDir(fsPath, virtualPath string) error {
 		return c.GetGenericError(nil)
 	}
 
-	if err := c.Fs.Remove(fsPath, true); err != nil {
+	if c.IsTrashEnabledFor(virtualPath) {
+		// the directory must be empty, as for a real removal
+		contents, err := c.Fs.ReadDir(fsPath)
+		if err != nil {
+			c.Log(logger.LevelWarn, "failed to remove directory %#v: %+v", fsPath, err)
+			return c.GetFsError(err)
+		}
+		if len(contents) > 0 {
+			c.Log(logger.LevelDebug, "cannot remove directory %#v, it is not empty", fsPath)
+			return c.GetGenericError(nil)
+		}
+		if err := c.MoveToTrash(fsPath, virtualPath, 0); err != nil {
+			return err
+		}
+	} else if err := c.Fs.Remove(fsPath, true); err != nil {
 		c.Log(logger.LevelWarn, "failed to remove directory %#v: %+v", fsPath, err)
 		return c.GetFsError(err)
 	}
 
 	logger.CommandLog(rmdirLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1)
+	AddReplicationJob(c.User.Username, dataprovider.ReplicationActionDelete, virtualPath, "")
+	return nil
+}
+
+// IsTrashEnabledFor returns true if the items deleted from the specified
+// virtual path are moved to the trash. The trash is not available for the
+// virtual folders
+func (c *BaseConnection) IsTrashEnabledFor(virtualPath string) bool {
+	if _, ok := vfs.GetTrashFs(c.Fs); !ok {
+		return false
+	}
+	if _, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath)); err == nil {
+		return false
+	}
+	return true
+}
+
+// MoveToTrash moves the file or directory at the specified fsPath to the trash.
+// The caller must check the permissions and update the quota
+func (c *BaseConnection) MoveToTrash(fsPath, virtualPath string, size int64) error {
+	if err := c.moveToTrash(fsPath); err != nil {
+		return err
+	}
+	action := newActionNotification(&c.User, operationTrash, fsPath, "", "", c.protocol, size, nil)
+	go actionHandler.Handle(action) // nolint:errcheck
+	return nil
+}
+
+func (c *BaseConnection) moveToTrash(fsPath string) error {
+	trashFs, ok := vfs.GetTrashFs(c.Fs)
+	if !ok {
+		return c.GetOpUnsupportedError()
+	}
+	item, err := trashFs.MoveToTrash(fsPath)
+	if err != nil {
+		c.Log(logger.LevelWarn, "failed to move %#v to the trash: %+v", fsPath, err)
+		return c.GetFsError(err)
+	}
+	c.Log(logger.LevelDebug, "path %#v moved to the trash, item id %#v", fsPath, item.ID)
+	removed, err := trashFs.ApplyQuota()
+	if err != nil {
+		c.Log(logger.LevelWarn, "unable to apply the trash quota: %v", err)
+	}
+	NotifyTrashPurge(&c.User, trashFs, removed, c.protocol)
 	return nil
 }
 
@@ -358,6 +435,16 @@ func (c *BaseConnection) Rename(fsSourcePath, fsTargetPath, virtualSourcePath, v
 	if !c.isRenamePermitted(fsSourcePath, virtualSourcePath, virtualTargetPath, srcInfo) {
 		return c.GetPermissionDeniedError()
 	}
+	if err := c.CheckRetentionLock(fsSourcePath, virtualSourcePath, srcInfo); err != nil {
+		return err
+	}
+	if err := c.CheckRetentionTarget(virtualSourcePath, virtualTargetPath, srcInfo.IsDir()); err != nil {
+		return err
+	}
+	// read-only lower layer files are not included in the quota, once renamed they
+	// are copied to the upper layer
+	isOverlayLowerSource := vfs.IsOverlayLowerFile(c.Fs, fsSourcePath)
+	isOverlayLowerTarget := vfs.IsOverlayLowerFile(c.Fs, fsTargetPath)
 	initialSize := int64(-1)
 	if dstInfo, err := c.Fs.Lstat(fsTargetPath); err == nil {
 		if dstInfo.IsDir() {
@@ -366,14 +453,17 @@ func (c *BaseConnection) Rename(fsSourcePath, fsTargetPath, virtualSourcePath, v
 			return c.GetOpUnsupportedError()
 		}
 		// we are overwriting an existing file/symlink
-		if dstInfo.Mode().IsRegular() {
-			initialSize = dstInfo.Size()
+		if dstInfo.Mode().IsRegular() && !isOverlayLowerTarget {
+			initialSize = vfs.GetQuotaSize(dstInfo)
 		}
 		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualTargetPath)) {
 			c.Log(logger.LevelDebug, "renaming is not allowed, %#v -> %#v. Target exists but the user "+
 				"has no overwrite permission", virtualSourcePath, virtualTargetPath)
 			return c.GetPermissionDeniedError()
 		}
+		if err := c.CheckRetentionLock(fsTargetPath, virtualTargetPath, dstInfo); err != nil {
+			return err
+		}
 	}
 	if srcInfo.IsDir() {
 		if c.User.HasVirtualFoldersInside(virtualSourcePath) {
@@ -390,15 +480,23 @@ func (c *BaseConnection) Rename(fsSourcePath, fsTargetPath, virtualSourcePath, v
 		c.Log(logger.LevelInfo, "denying cross rename due to space limit")
 		return c.GetGenericError(ErrQuotaExceeded)
 	}
+	if isOverlayLowerSource && !c.HasSpace(initialSize == -1, virtualTargetPath).HasSpace {
+		c.Log(logger.LevelInfo, "denying rename from the overlay lower layer due to space limit")
+		return c.GetGenericError(ErrQuotaExceeded)
+	}
 	if err := c.Fs.Rename(fsSourcePath, fsTargetPath); err != nil {
 		c.Log(logger.LevelWarn, "failed to rename %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
 		return c.GetFsError(err)
 	}
 	if dataprovider.GetQuotaTracking() > 0 {
 		c.updateQuotaAfterRename(virtualSourcePath, virtualTargetPath, fsTargetPath, initialSize) //nolint:errcheck
+		if isOverlayLowerSource {
+			c.updateQuotaAfterCopyUp(fsTargetPath)
+		}
 	}
 	logger.CommandLog(renameLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1,
 		"", "", "", -1)
+	AddReplicationJob(c.User.Username, dataprovider.ReplicationActionRename, virtualSourcePath, virtualTargetPath)
 	action := newActionNotification(&c.User, operationRename, fsSourcePath, fsTargetPath, "", c.protocol, 0, nil)
 	// the returned error is used in test cases only, we already log the error inside action.execute
 	go actionHandler.Handle(action) // nolint:errcheck
@@ -431,6 +529,9 @@ func (c *BaseConnection) CreateSymlink(fsSourcePath, fsTargetPath, virtualSource
 		c.Log(logger.LevelWarn, "symlinking to a directory mapped as virtual folder is not allowed: %#v", fsTargetPath)
 		return c.GetPermissionDeniedError()
 	}
+	if err := c.checkLinkRetention(virtualSourcePath, virtualTargetPath, false); err != nil {
+		return err
+	}
 	if err := c.Fs.Symlink(fsSourcePath, fsTargetPath); err != nil {
 		c.Log(logger.LevelWarn, "failed to create symlink %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
 		return c.GetFsError(err)
@@ -439,6 +540,57 @@ func (c *BaseConnection) CreateSymlink(fsSourcePath, fsTargetPath, virtualSource
 	return nil
 }
 
+// CreateHardlink creates fsTargetPath as a hard link to the fsSourcePath file.
+// Hard links are supported for local filesystems only, they count as new files
+// for quota purposes
+func (c *BaseConnection) CreateHardlink(fsSourcePath, fsTargetPath, virtualSourcePath, virtualTargetPath string) error {
+	if !vfs.IsHardlinkSupported(c.Fs) {
+		return c.GetOpUnsupportedError()
+	}
+	if !c.User.HasPerms([]string{dataprovider.PermCreateSymlinks, dataprovider.PermUpload}, path.Dir(virtualTargetPath)) {
+		return c.GetPermissionDeniedError()
+	}
+	if !c.User.IsFileAllowed(virtualSourcePath) || !c.User.IsFileAllowed(virtualTargetPath) {
+		c.Log(logger.LevelDebug, "hard link not allowed for file %#v -> %#v", virtualSourcePath, virtualTargetPath)
+		return c.GetPermissionDeniedError()
+	}
+	if c.isCrossFoldersRequest(virtualSourcePath, virtualTargetPath) {
+		c.Log(logger.LevelWarn, "cross folder hard link is not supported, src: %v dst: %v", virtualSourcePath, virtualTargetPath)
+		return c.GetOpUnsupportedError()
+	}
+	if err := c.checkLinkRetention(virtualSourcePath, virtualTargetPath, true); err != nil {
+		return err
+	}
+	info, err := c.Fs.Lstat(fsSourcePath)
+	if err != nil {
+		return c.GetFsError(err)
+	}
+	if !info.Mode().IsRegular() {
+		c.Log(logger.LevelDebug, "hard link source %#v is not a regular file", virtualSourcePath)
+		return c.GetOpUnsupportedError()
+	}
+	quotaResult := c.HasSpace(true, virtualTargetPath)
+	if !quotaResult.HasSpace || (quotaResult.QuotaSize > 0 && quotaResult.GetRemainingSize() < info.Size()) {
+		return c.GetGenericError(ErrQuotaExceeded)
+	}
+	if err := vfs.Link(c.Fs, fsSourcePath, fsTargetPath); err != nil {
+		c.Log(logger.LevelWarn, "failed to create hard link %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
+		return c.GetFsError(err)
+	}
+	logger.CommandLog(linkLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1)
+	size := vfs.GetQuotaSize(info)
+	vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualTargetPath))
+	if err == nil {
+		dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, 1, size, false) //nolint:errcheck
+		if vfolder.IsIncludedInUserQuota() {
+			dataprovider.UpdateUserQuota(c.User, 1, size, false) //nolint:errcheck
+		}
+	} else {
+		dataprovider.UpdateUserQuota(c.User, 1, size, false) //nolint:errcheck
+	}
+	return nil
+}
+
 func (c *BaseConnection) getPathForSetStatPerms(fsPath, virtualPath string) string {
 	pathForPerms := virtualPath
 	if fi, err := c.Fs.Lstat(fsPath); err == nil {
@@ -459,7 +611,7 @@ func (c *BaseConnection) DoStat(fsPath string, mode int) (os.FileInfo, error) {
 		info, err = c.Fs.Stat(c.getRealFsPath(fsPath))
 	}
 	if err == nil && vfs.IsCryptOsFs(c.Fs) {
-		info = c.Fs.(*vfs.CryptFs).ConvertFileInfo(info)
+		info = vfs.ConvertCryptFileInfo(info)
 	}
 	return info, err
 }
@@ -528,7 +680,21 @@ func (c *BaseConnection) handleChtimes(fsPath, pathForPerms string, attributes *
 
 // SetStat set StatAttributes for the specified fsPath
 func (c *BaseConnection) SetStat(fsPath, virtualPath string, attributes *StatAttributes) error {
+	// read-only lower layer files are copied to the upper layer before changing
+	// their attributes, from now on they are included in the quota
+	isOverlayLowerFile := vfs.IsOverlayLowerFile(c.Fs, fsPath)
+	err := c.setStat(fsPath, virtualPath, attributes)
+	if err == nil && isOverlayLowerFile && !vfs.IsOverlayLowerFile(c.Fs, fsPath) {
+		c.updateQuotaAfterCopyUp(fsPath)
+	}
+	return err
+}
+
+func (c *BaseConnection) setStat(fsPath, virtualPath string, attributes *StatAttributes) error {
 	pathForPerms := c.getPathForSetStatPerms(fsPath, virtualPath)
+	if err := c.checkSetStatRetentionLock(fsPath, virtualPath, attributes); err != nil {
+		return err
+	}
 
 	if attributes.Flags&StatAttrPerms != 0 {
 		return c.handleChmod(fsPath, pathForPerms, attributes)
@@ -552,6 +718,7 @@ func (c *BaseConnection) SetStat(fsPath, virtualPath string, attributes *StatAtt
 			return c.GetFsError(err)
 		}
 		logger.CommandLog(truncateLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", attributes.Size)
+		AddReplicationJob(c.User.Username, dataprovider.ReplicationActionUpload, virtualPath, "")
 	}
 
 	return nil
@@ -573,7 +740,11 @@ func (c *BaseConnection) truncateFile(fsPath, virtualPath string, size int64) er
 		initialSize = info.Size()
 		err = c.Fs.Truncate(fsPath, size)
 	}
-	if err == nil && vfs.IsLocalOrSFTPFs(c.Fs) {
+	if err == nil && vfs.IsRandomAccessFs(c.Fs) {
+		if vfs.IsCryptOsFs(c.Fs) {
+			// the quota is based on the encrypted size
+			size = vfs.GetEncryptedSize(size)
+		}
 		sizeDiff := initialSize - size
 		vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
 		if err == nil {
@@ -701,7 +872,7 @@ func (c *BaseConnection) hasSpaceForCrossRename(quotaResult vfs.QuotaCheckResult
 	var sizeDiff int64
 	var filesDiff int
 	if fi.Mode().IsRegular() {
-		sizeDiff = fi.Size()
+		sizeDiff = vfs.GetQuotaSize(fi)
 		filesDiff = 1
 		if initialSize != -1 {
 			sizeDiff -= initialSize
@@ -897,6 +1068,18 @@ func (c *BaseConnection) updateQuotaMoveToVFolder(dstFolder vfs.VirtualFolder, i
 	}
 }
 
+// updateQuotaAfterCopyUp adds to the quota a file copied from the read-only lower
+// layer to the upper layer of an overlay filesystem.
+// Virtual folders are not supported together with an overlay
+func (c *BaseConnection) updateQuotaAfterCopyUp(fsPath string) {
+	info, err := c.Fs.Stat(fsPath)
+	if err != nil {
+		c.Log(logger.LevelWarn, "failed to update quota after copy up, file %#v stat error: %+v", fsPath, err)
+		return
+	}
+	dataprovider.UpdateUserQuota(c.User, 1, vfs.GetQuotaSize(info), false) //nolint:errcheck
+}
+
 func (c *BaseConnection) updateQuotaAfterRename(virtualSourcePath, virtualTargetPath, targetPath string, initialSize int64) error {
 	// we don't allow to overwrite an existing directory so targetPath can be:
 	// - a new file, a symlink is as a new file here
@@ -925,7 +1108,7 @@ func (c *BaseConnection) updateQuotaAfterRename(virtualSourcePath, virtualTarget
 				return err
 			}
 		} else {
-			filesSize = fi.Size()
+			filesSize = vfs.GetQuotaSize(fi)
 		}
 	} else {
 		c.Log(logger.LevelWarn, "failed to update quota after rename, file %#v stat error: %+v", targetPath, err)
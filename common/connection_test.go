@@ -1,6 +1,8 @@
 package common
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -46,6 +48,25 @@ func newMockOsFs(hasVirtualFolders bool, connectionID, rootDir string) vfs.Fs {
 	}
 }
 
+// mockObjectLockFs records the native object locks
+type mockObjectLockFs struct {
+	vfs.Fs
+	removedLegalHolds []string
+}
+
+func (fs *mockObjectLockFs) IsObjectLockEnabled() bool {
+	return true
+}
+
+func (fs *mockObjectLockFs) SetObjectLock(name string, retainUntil time.Time, legalHold bool) error {
+	return nil
+}
+
+func (fs *mockObjectLockFs) RemoveObjectLegalHold(name string, info os.FileInfo) error {
+	fs.removedLegalHolds = append(fs.removedLegalHolds, name)
+	return nil
+}
+
 func TestListDir(t *testing.T) {
 	user := dataprovider.User{
 		Username: userTestUsername,
@@ -70,8 +91,10 @@ func TestListDir(t *testing.T) {
 		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
 	}
 	c.User.Permissions["/"] = []string{dataprovider.PermAny}
-	files, err := c.ListDir(user.GetHomeDir(), "/")
+	lister, err := c.ListDir(user.GetHomeDir(), "/")
 	if assert.NoError(t, err) {
+		files, err := vfs.ReadAllDir(lister)
+		assert.NoError(t, err)
 		vdirFound := false
 		for _, f := range files {
 			if f.Name() == "vdir" {
@@ -88,6 +111,83 @@ func TestListDir(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestListDirPages(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/",
+			HiddenPatterns: []string{"*.hidden"},
+		},
+	}
+	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: filepath.Join(os.TempDir(), "mapped"),
+		},
+		VirtualPath: "/vdir",
+	})
+	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: filepath.Join(os.TempDir(), "mapped1"),
+		},
+		VirtualPath: "/file5",
+	})
+	err := os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	assert.NoError(t, err)
+	numFiles := 10
+	for i := 0; i < numFiles; i++ {
+		err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), fmt.Sprintf("file%v", i)), []byte("data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "file.hidden"), []byte("data"), os.ModePerm)
+	assert.NoError(t, err)
+	fs, err := user.GetFilesystem("")
+	assert.NoError(t, err)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	lister, err := c.ListDir(user.GetHomeDir(), "/")
+	require.NoError(t, err)
+	entries := make(map[string]os.FileInfo)
+	page := make([]os.FileInfo, 3)
+	offset := int64(0)
+	for {
+		n, err := lister.ListAt(page, offset)
+		offset += int64(n)
+		assert.LessOrEqual(t, n, len(page))
+		for _, info := range page[:n] {
+			_, ok := entries[info.Name()]
+			assert.False(t, ok, "duplicated entry %#v", info.Name())
+			entries[info.Name()] = info
+		}
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Greater(t, n, 0)
+	}
+	assert.Len(t, entries, numFiles+1)
+	assert.NotContains(t, entries, "file.hidden")
+	// non sequential reads are not supported
+	_, err = lister.ListAt(page, 0)
+	assert.Equal(t, sftp.ErrSSHFxOpUnsupported, err)
+	if assert.Contains(t, entries, "vdir") {
+		assert.True(t, entries["vdir"].IsDir())
+	}
+	if assert.Contains(t, entries, "file5") {
+		assert.True(t, entries["file5"].IsDir())
+	}
+	files, err := lister.Next(10)
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, files, 0)
+	assert.NoError(t, lister.Close())
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestCreateDir(t *testing.T) {
 	user := dataprovider.User{
 		Username: userTestUsername,
@@ -257,6 +357,118 @@ func TestRemoveDir(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRemoveToTrash(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+		Password: userTestPwd,
+	}
+	mappedPath := filepath.Join(os.TempDir(), "vdir")
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/vdir",
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	user.FsConfig.TrashConfig = vfs.TrashConfig{
+		Enabled:   true,
+		Retention: 1,
+	}
+	err := dataprovider.AddUser(&user)
+	assert.Error(t, err, "the trash path is not configured")
+	trashPath := filepath.Join(os.TempDir(), "trash")
+	err = vfs.InitializeTrash(trashPath)
+	require.NoError(t, err)
+	defer func() {
+		err := vfs.InitializeTrash("")
+		assert.NoError(t, err)
+	}()
+	err = dataprovider.AddUser(&user)
+	assert.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "dir", "sub"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.Mkdir(mappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	fs, err := user.GetFilesystem("")
+	assert.NoError(t, err)
+	trashFs, ok := fs.(*vfs.TrashFs)
+	require.True(t, ok)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	assert.True(t, c.IsTrashEnabledFor("/dir/file"))
+	assert.False(t, c.IsTrashEnabledFor("/vdir/file"))
+
+	testFile := filepath.Join(user.GetHomeDir(), "dir", "file")
+	err = ioutil.WriteFile(testFile, []byte("test data"), os.ModePerm)
+	assert.NoError(t, err)
+	info, err := os.Stat(testFile)
+	assert.NoError(t, err)
+	err = c.RemoveFile(testFile, "/dir/file", info)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, testFile)
+	vdirFile := filepath.Join(mappedPath, "file")
+	err = ioutil.WriteFile(vdirFile, []byte("test data"), os.ModePerm)
+	assert.NoError(t, err)
+	info, err = os.Stat(vdirFile)
+	assert.NoError(t, err)
+	err = c.RemoveFile(vdirFile, "/vdir/file", info)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, vdirFile)
+	// a directory must be empty to be removed
+	err = c.RemoveDir(filepath.Join(user.GetHomeDir(), "dir"), "/dir")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetGenericError(nil).Error())
+	}
+	err = c.RemoveDir(filepath.Join(user.GetHomeDir(), "dir", "sub"), "/dir/sub")
+	assert.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(user.GetHomeDir(), "dir", "sub"))
+	contents, err := fs.ReadDir(user.GetHomeDir())
+	if assert.NoError(t, err) && assert.Len(t, contents, 1) {
+		assert.Equal(t, "dir", contents[0].Name())
+	}
+	items, err := trashFs.ListTrash()
+	assert.NoError(t, err)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, "/dir/sub", items[0].Path)
+		assert.True(t, items[0].IsDir)
+		assert.Equal(t, "/dir/file", items[1].Path)
+		assert.False(t, items[1].IsDir)
+		assert.Equal(t, int64(9), items[1].Size)
+	}
+	// add an expired item
+	trashRoot := filepath.Join(trashPath, user.Username)
+	expiredItem := filepath.Join(trashRoot, "old", "20200101T000000.000000000Z")
+	err = os.MkdirAll(filepath.Dir(expiredItem), os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(expiredItem, []byte("old data"), os.ModePerm)
+	assert.NoError(t, err)
+	items, err = trashFs.ListTrash()
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	expireTrashItems()
+	assert.NoFileExists(t, expiredItem)
+	assert.NoDirExists(t, filepath.Dir(expiredItem))
+	items, err = trashFs.ListTrash()
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+
+	err = dataprovider.DeleteUser(user.Username)
+	assert.NoError(t, err)
+	err = dataprovider.DeleteFolder(mappedPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(trashPath)
+	assert.NoError(t, err)
+}
+
 func TestRename(t *testing.T) {
 	user := dataprovider.User{
 		Username:  userTestUsername,
@@ -437,6 +649,245 @@ func TestCreateSymlink(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRetentionLock(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/archive",
+			Days: 1,
+		},
+		{
+			Path:      "/hold",
+			LegalHold: true,
+		},
+	}
+	for _, dir := range []string{"archive", "hold", "free"} {
+		err := os.MkdirAll(filepath.Join(user.GetHomeDir(), dir), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	lockedFile := filepath.Join(user.GetHomeDir(), "archive", "locked")
+	expiredFile := filepath.Join(user.GetHomeDir(), "archive", "expired")
+	holdFile := filepath.Join(user.GetHomeDir(), "hold", "file")
+	freeFile := filepath.Join(user.GetHomeDir(), "free", "file")
+	for _, name := range []string{lockedFile, expiredFile, holdFile, freeFile} {
+		err := ioutil.WriteFile(name, []byte("test data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	oldTime := time.Now().Add(-48 * time.Hour)
+	err := os.Chtimes(expiredFile, oldTime, oldTime)
+	assert.NoError(t, err)
+	err = os.Chtimes(holdFile, oldTime, oldTime)
+	assert.NoError(t, err)
+
+	fs, err := user.GetFilesystem("")
+	assert.NoError(t, err)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	assert.NoError(t, c.CheckRetentionLock(freeFile, "/free/file", nil))
+	assert.NoError(t, c.CheckRetentionLock(filepath.Join(user.GetHomeDir(), "archive", "missing"), "/archive/missing", nil))
+	err = c.CheckRetentionLock(lockedFile, "/archive/locked", nil)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	info, err := os.Stat(lockedFile)
+	assert.NoError(t, err)
+	err = c.RemoveFile(lockedFile, "/archive/locked", info)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	info, err = os.Stat(holdFile)
+	assert.NoError(t, err)
+	err = c.RemoveFile(holdFile, "/hold/file", info)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	err = c.Rename(lockedFile, filepath.Join(user.GetHomeDir(), "free", "renamed"), "/archive/locked", "/free/renamed")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	// overwrite a locked file
+	err = c.Rename(freeFile, lockedFile, "/free/file", "/archive/locked")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	// rename a directory with locked files inside
+	err = c.Rename(filepath.Join(user.GetHomeDir(), "archive"), filepath.Join(user.GetHomeDir(), "archive1"),
+		"/archive", "/archive1")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	err = c.SetStat(lockedFile, "/archive/locked", &StatAttributes{
+		Flags: StatAttrTimes,
+		Atime: oldTime,
+		Mtime: oldTime,
+	})
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	err = c.SetStat(lockedFile, "/archive/locked", &StatAttributes{
+		Flags: StatAttrSize,
+		Size:  0,
+	})
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	err = c.SetStat(filepath.Join(user.GetHomeDir(), "archive"), "/archive", &StatAttributes{
+		Flags: StatAttrPerms,
+		Mode:  os.ModePerm,
+	})
+	assert.NoError(t, err)
+	err = c.CreateSymlink(lockedFile, filepath.Join(user.GetHomeDir(), "free", "link"), "/archive/locked", "/free/link")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	// the retention for this file is expired
+	info, err = os.Stat(expiredFile)
+	assert.NoError(t, err)
+	err = c.RemoveFile(expiredFile, "/archive/expired", info)
+	assert.NoError(t, err)
+	err = c.Rename(freeFile, filepath.Join(user.GetHomeDir(), "free", "renamed"), "/free/file", "/free/renamed")
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestRetentionLockRemoveLegalHold(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path:      "/hold",
+			LegalHold: true,
+		},
+		{
+			Path: "/released",
+			Days: 1,
+		},
+	}
+	for _, dir := range []string{"hold", "released", "free"} {
+		err := os.MkdirAll(filepath.Join(user.GetHomeDir(), dir), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	holdFile := filepath.Join(user.GetHomeDir(), "hold", "file")
+	// the legal hold was removed from this retention filter and the retention is expired
+	releasedFile := filepath.Join(user.GetHomeDir(), "released", "file")
+	freeFile := filepath.Join(user.GetHomeDir(), "free", "file")
+	for _, name := range []string{holdFile, releasedFile, freeFile} {
+		err := ioutil.WriteFile(name, []byte("test data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	oldTime := time.Now().Add(-48 * time.Hour)
+	err := os.Chtimes(releasedFile, oldTime, oldTime)
+	assert.NoError(t, err)
+
+	fs := &mockObjectLockFs{
+		Fs: vfs.NewOsFs("", user.GetHomeDir(), nil),
+	}
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	err = c.CheckRetentionLock(holdFile, "/hold/file", nil)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	assert.Len(t, fs.removedLegalHolds, 0)
+	err = c.CheckRetentionLock(releasedFile, "/released/file", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{releasedFile}, fs.removedLegalHolds)
+	// the legal holds set by SFTPGo are removed also if the files have no
+	// retention filter, it could have been removed
+	err = c.CheckRetentionLock(freeFile, "/free/file", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{releasedFile, freeFile}, fs.removedLegalHolds)
+	// the legal holds are never removed for the files inside directories
+	fs.removedLegalHolds = nil
+	err = c.CheckRetentionLock(user.GetHomeDir(), "/", nil)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	assert.Len(t, fs.removedLegalHolds, 0)
+	err = c.CheckRetentionLock(filepath.Join(user.GetHomeDir(), "released"), "/released", nil)
+	assert.NoError(t, err)
+	assert.Len(t, fs.removedLegalHolds, 0)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestRetentionTarget(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/archive",
+			Days: 1,
+		},
+		{
+			Path:      "/archive/hold",
+			LegalHold: true,
+		},
+	}
+	for _, dir := range []string{"archive/sub", "free/dir"} {
+		err := os.MkdirAll(filepath.Join(user.GetHomeDir(), dir), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	freeFile := filepath.Join(user.GetHomeDir(), "free", "file")
+	expiredFile := filepath.Join(user.GetHomeDir(), "archive", "expired")
+	for _, name := range []string{freeFile, expiredFile} {
+		err := ioutil.WriteFile(name, []byte("test data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	// a file with a modification time in the past cannot be moved inside a
+	// retention protected directory, it would not be locked
+	oldTime := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{freeFile, expiredFile} {
+		err := os.Chtimes(name, oldTime, oldTime)
+		assert.NoError(t, err)
+	}
+
+	fs, err := user.GetFilesystem("")
+	assert.NoError(t, err)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	err = c.Rename(freeFile, filepath.Join(user.GetHomeDir(), "archive", "file"), "/free/file", "/archive/file")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	err = c.Rename(filepath.Join(user.GetHomeDir(), "free", "dir"), filepath.Join(user.GetHomeDir(), "archive", "dir"),
+		"/free/dir", "/archive/dir")
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, c.GetPermissionDeniedError().Error())
+	}
+	// moving files protected by the same retention filter is allowed
+	err = c.Rename(expiredFile, filepath.Join(user.GetHomeDir(), "archive", "sub", "expired"), "/archive/expired",
+		"/archive/sub/expired")
+	assert.NoError(t, err)
+	// a different retention filter protects the target
+	assert.Error(t, c.CheckRetentionTarget("/archive/file", "/archive/hold/file", false))
+	assert.Error(t, c.CheckRetentionTarget("/archive/dir", "/archive/hold/dir", true))
+	// the directories containing other retention filters cannot be moved inside
+	// retention protected directories
+	assert.Error(t, c.CheckRetentionTarget("/archive", "/archive/sub/archive", true))
+	assert.Error(t, c.CheckRetentionTarget("/archive/sub", "/archive", true))
+	assert.NoError(t, c.CheckRetentionTarget("/archive", "/free/archive", true))
+	assert.NoError(t, c.CheckRetentionTarget("/archive/sub", "/archive/dir", true))
+	assert.NoError(t, c.CheckRetentionTarget("/archive/file", "/free/file", false))
+	assert.NoError(t, c.CheckRetentionTarget("/free/file", "/file", false))
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestDoStat(t *testing.T) {
 	testFile := filepath.Join(os.TempDir(), "afile.txt")
 	fs := vfs.NewOsFs("123", os.TempDir(), nil)
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// DirListerAt returns the contents of a directory page by page. The virtual
+// folders are merged with the entries returned by the filesystem and the
+// hidden patterns are applied to each page
+type DirListerAt struct {
+	sync.Mutex
+	conn        *BaseConnection
+	virtualPath string
+	lister      vfs.DirLister
+	isComplete  bool
+	// number of entries returned by ListAt
+	offset int64
+}
+
+func newDirListerAt(conn *BaseConnection, virtualPath string, lister vfs.DirLister) *DirListerAt {
+	return &DirListerAt{
+		conn:        conn,
+		virtualPath: virtualPath,
+		lister:      vfs.NewMergedDirLister(lister, conn.User.GetVirtualDirs(virtualPath)),
+	}
+}
+
+// Next returns up to limit directory entries and io.EOF, together with the
+// last entries, when the listing is complete
+func (l *DirListerAt) Next(limit int) ([]os.FileInfo, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.next(limit)
+}
+
+func (l *DirListerAt) next(limit int) ([]os.FileInfo, error) {
+	if l.isComplete {
+		return nil, io.EOF
+	}
+	files, err := l.lister.Next(limit)
+	if err != nil {
+		l.isComplete = true
+		l.lister.Close()
+		if err != io.EOF {
+			l.conn.Log(logger.LevelWarn, "error listing directory %#v: %+v", l.virtualPath, err)
+			return nil, l.conn.GetFsError(err)
+		}
+	}
+	return l.conn.User.FilterListDir(files, l.virtualPath), err
+}
+
+// ListAt implements the sftp.ListerAt interface. The entries are read
+// sequentially, pkg/sftp always requests the entries following the ones
+// already returned, any other offset is rejected. An empty page is never
+// returned unless the listing is complete
+func (l *DirListerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if offset != l.offset {
+		l.conn.Log(logger.LevelWarn, "unsupported offset %v listing directory %#v, expected: %v", offset,
+			l.virtualPath, l.offset)
+		return 0, l.conn.GetOpUnsupportedError()
+	}
+	if len(f) == 0 {
+		return 0, nil
+	}
+	for {
+		files, err := l.next(len(f))
+		n := copy(f, files)
+		l.offset += int64(n)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close releases the resources associated to the lister
+func (l *DirListerAt) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.isComplete = true
+	return l.lister.Close()
+}
@@ -0,0 +1,448 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// supported health checks
+const (
+	HealthCheckDataProvider = "data_provider"
+	HealthCheckKMS          = "kms"
+	HealthCheckLocal        = "local"
+	HealthCheckS3           = "s3"
+	HealthCheckGCS          = "gcs"
+	HealthCheckAzureBlob    = "azblob"
+	HealthCheckSFTP         = "sftp"
+	HealthCheckWebDAV       = "webdav"
+	HealthCheckFTP          = "ftp"
+)
+
+const (
+	healthCheckUsersPageSize  = 100
+	healthCheckDefaultTimeout = 10 * time.Second
+	healthCheckMinCacheTime   = 10 * time.Second
+	healthCheckKMSPayload     = "sftpgo health check"
+	healthCheckTempPrefix     = ".sftpgo-healthcheck."
+)
+
+// the storage backends sampled from the users
+var userHealthChecks = []string{HealthCheckLocal, HealthCheckS3, HealthCheckGCS, HealthCheckAzureBlob,
+	HealthCheckSFTP, HealthCheckWebDAV, HealthCheckFTP}
+
+var healthChecks = struct {
+	sync.Mutex
+	status    HealthStatus
+	lastCheck time.Time
+	// not nil while the checks are executing, it is closed when they complete
+	refreshDone chan struct{}
+}{}
+
+// HealthChecksConfig defines the active checks for the data provider, the
+// KMS and the storage backends used to report the readiness
+type HealthChecksConfig struct {
+	// Number of seconds the results are cached, the checks are executed again,
+	// in the background, on the first request after this time. Values lower
+	// than 10 are set to 10
+	CacheTime int `json:"cache_time" mapstructure:"cache_time"`
+	// Timeout, in seconds, for each check
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+	// Maximum number of local paths, buckets, containers and SFTP, WebDAV and
+	// FTP endpoints, sampled from the users and the virtual folders, to check
+	// for each storage backend. 0 means that only the data provider and the
+	// KMS are checked
+	MaxSamples int `json:"max_samples" mapstructure:"max_samples"`
+}
+
+func (c *HealthChecksConfig) getCacheTime() time.Duration {
+	cacheTime := time.Duration(c.CacheTime) * time.Second
+	if cacheTime < healthCheckMinCacheTime {
+		return healthCheckMinCacheTime
+	}
+	return cacheTime
+}
+
+func (c *HealthChecksConfig) getTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return healthCheckDefaultTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// HealthCheck defines the result of a single check
+type HealthCheck struct {
+	// check type: data_provider, kms, local, s3, gcs, azblob, sftp, webdav, ftp
+	Check string `json:"check"`
+	// checked path, bucket, container, endpoint or provider
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// check duration as milliseconds
+	Latency int64 `json:"latency"`
+}
+
+// HealthStatus defines the results of the health checks
+type HealthStatus struct {
+	// true if all the checks succeeded, false until the first checks complete
+	Ready bool `json:"ready"`
+	// checks execution time as unix timestamp in milliseconds, 0 until the
+	// first checks complete
+	CheckedAt int64         `json:"checked_at"`
+	Checks    []HealthCheck `json:"checks"`
+}
+
+type healthCheckTarget struct {
+	check  string
+	target string
+	path   string
+	user   *dataprovider.User
+}
+
+// GetHealthStatus returns the cached results of the health checks without
+// waiting for the checks. If the cached results are expired the checks are
+// executed again in the background and the previous results are returned
+// until they complete
+func GetHealthStatus() HealthStatus {
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+
+	if time.Since(healthChecks.lastCheck) >= Config.HealthChecks.getCacheTime() {
+		startHealthChecksLocked()
+	}
+	return healthChecks.status
+}
+
+// UpdateHealthStatus executes the health checks, ignoring the cached results,
+// and returns the updated results. The checks already in progress, if any,
+// are awaited before starting the new ones
+func UpdateHealthStatus() HealthStatus {
+	healthChecks.Lock()
+	for healthChecks.refreshDone != nil {
+		done := healthChecks.refreshDone
+		healthChecks.Unlock()
+		<-done
+		healthChecks.Lock()
+	}
+	done := startHealthChecksLocked()
+	healthChecks.Unlock()
+	<-done
+
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+
+	return healthChecks.status
+}
+
+// startHealthChecksLocked starts the health checks in the background, if
+// they are not already in progress, and returns a channel closed when they
+// complete. It must be called with the healthChecks lock held
+func startHealthChecksLocked() chan struct{} {
+	if healthChecks.refreshDone != nil {
+		return healthChecks.refreshDone
+	}
+	done := make(chan struct{})
+	healthChecks.refreshDone = done
+	go func() {
+		status := runHealthChecks()
+
+		healthChecks.Lock()
+		healthChecks.status = status
+		healthChecks.lastCheck = time.Now()
+		healthChecks.refreshDone = nil
+		healthChecks.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func runHealthChecks() HealthStatus {
+	targets := []healthCheckTarget{
+		{check: HealthCheckDataProvider, target: dataprovider.GetProviderStatus().Driver},
+		{check: HealthCheckKMS},
+	}
+	if Config.HealthChecks.MaxSamples > 0 {
+		targets = append(targets, getHealthCheckTargets(Config.HealthChecks.MaxSamples)...)
+	}
+	status := HealthStatus{
+		Ready:  true,
+		Checks: make([]HealthCheck, len(targets)),
+	}
+	timeout := Config.HealthChecks.getTimeout()
+	var wg sync.WaitGroup
+	for idx := range targets {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			status.Checks[idx] = runHealthCheck(&targets[idx], timeout)
+		}(idx)
+	}
+	wg.Wait()
+
+	metrics.ResetHealthChecks()
+	for _, check := range status.Checks {
+		var err error
+		if !check.Healthy {
+			status.Ready = false
+			err = errors.New(check.Error)
+			logger.Warn(logSender, "", "health check %v failed for target %#v: %v", check.Check, check.Target,
+				check.Error)
+		}
+		metrics.UpdateHealthCheck(check.Check, check.Target, err, time.Duration(check.Latency)*time.Millisecond)
+	}
+	metrics.UpdateReadiness(status.Ready)
+	status.CheckedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	return status
+}
+
+// runHealthCheck executes the check for the given target, a check that does
+// not complete within the timeout is reported as failed
+func runHealthCheck(target *healthCheckTarget, timeout time.Duration) HealthCheck {
+	result := HealthCheck{
+		Check:  target.check,
+		Target: target.target,
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- target.execute()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+		// the KMS check sets the target after encrypting
+		result.Target = target.target
+	case <-time.After(timeout):
+		err = fmt.Errorf("timeout after %v", timeout)
+	}
+	result.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Healthy = true
+	}
+	return result
+}
+
+func (t *healthCheckTarget) execute() error {
+	switch t.check {
+	case HealthCheckDataProvider:
+		status := dataprovider.GetProviderStatus()
+		if !status.IsActive {
+			return errors.New(status.Error)
+		}
+		return nil
+	case HealthCheckKMS:
+		return t.checkKMSRoundTrip()
+	case HealthCheckLocal:
+		return checkLocalPathWritable(t.path)
+	default:
+		fs, err := t.user.GetProviderFilesystem("healthcheck_" + xid.New().String())
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+
+		return vfs.CheckStorageReachability(fs)
+	}
+}
+
+// checkKMSRoundTrip encrypts and decrypts a secret using the configured KMS,
+// the target is set to the secret status after the encryption
+func (t *healthCheckTarget) checkKMSRoundTrip() error {
+	secret := kms.NewPlainSecret(healthCheckKMSPayload)
+	secret.SetAdditionalData("healthcheck")
+	if err := secret.Encrypt(); err != nil {
+		return fmt.Errorf("unable to encrypt: %v", err)
+	}
+	t.target = secret.GetStatus()
+	if err := secret.Decrypt(); err != nil {
+		return fmt.Errorf("unable to decrypt: %v", err)
+	}
+	if secret.GetPayload() != healthCheckKMSPayload {
+		return errors.New("the decrypted payload does not match")
+	}
+	return nil
+}
+
+// checkLocalPathWritable creates and removes a temporary file inside the
+// given directory. The home directories are created on the first login, so
+// the nearest existing parent is checked for the missing ones
+func checkLocalPathWritable(dirPath string) error {
+	for {
+		info, err := os.Stat(dirPath)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%#v is not a directory", dirPath)
+			}
+			break
+		}
+		parent := filepath.Dir(dirPath)
+		if !os.IsNotExist(err) || parent == dirPath {
+			return err
+		}
+		dirPath = parent
+	}
+	f, err := ioutil.TempFile(dirPath, healthCheckTempPrefix)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if errRemove := os.Remove(f.Name()); err == nil {
+		err = errRemove
+	}
+	return err
+}
+
+// getHealthCheckTargets samples the local paths and the remote storage
+// backends to check from the users and the virtual folders. The users and
+// the folders are not listed anymore once the samples are enough
+func getHealthCheckTargets(maxSamples int) []healthCheckTarget {
+	var targets []healthCheckTarget
+	samples := make(map[string]int)
+	seen := make(map[string]bool)
+	isFull := func(checks ...string) bool {
+		for _, check := range checks {
+			if samples[check] < maxSamples {
+				return false
+			}
+		}
+		return true
+	}
+	addTarget := func(target healthCheckTarget, key string) {
+		if samples[target.check] >= maxSamples || seen[target.check+"\x00"+key] {
+			return
+		}
+		samples[target.check]++
+		seen[target.check+"\x00"+key] = true
+		targets = append(targets, target)
+	}
+
+	for offset := 0; ; offset += healthCheckUsersPageSize {
+		users, err := dataprovider.GetUsers(healthCheckUsersPageSize, offset, dataprovider.OrderASC)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get the users to sample the health check targets: %v", err)
+			break
+		}
+		for idx := range users {
+			if target, key, ok := getUserHealthCheckTarget(&users[idx]); ok {
+				addTarget(target, key)
+			}
+		}
+		if len(users) < healthCheckUsersPageSize || isFull(userHealthChecks...) {
+			break
+		}
+	}
+	for offset := 0; !isFull(HealthCheckLocal); offset += healthCheckUsersPageSize {
+		folders, err := dataprovider.GetFolders(healthCheckUsersPageSize, offset, dataprovider.OrderASC, "")
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get the folders to sample the health check targets: %v", err)
+			break
+		}
+		for _, folder := range folders {
+			addTarget(healthCheckTarget{
+				check:  HealthCheckLocal,
+				target: folder.MappedPath,
+				path:   folder.MappedPath,
+			}, folder.MappedPath)
+		}
+		if len(folders) < healthCheckUsersPageSize {
+			break
+		}
+	}
+	return targets
+}
+
+// getUserHealthCheckTarget returns the target to check for the storage
+// backend of the given user and the key used to avoid duplicate checks.
+// The key includes the credentials identifiers, the target does not include
+// any secret
+func getUserHealthCheckTarget(user *dataprovider.User) (healthCheckTarget, string, bool) {
+	target := healthCheckTarget{
+		user: user,
+	}
+	var key string
+	switch user.FsConfig.Provider {
+	case dataprovider.LocalFilesystemProvider, dataprovider.CryptedFilesystemProvider:
+		target.check = HealthCheckLocal
+		target.target = user.GetHomeDir()
+		target.path = user.GetHomeDir()
+		key = target.path
+	case dataprovider.S3FilesystemProvider:
+		config := user.FsConfig.S3Config
+		target.check = HealthCheckS3
+		target.target = config.Bucket
+		if config.Endpoint != "" {
+			target.target = fmt.Sprintf("%v/%v", config.Endpoint, config.Bucket)
+		}
+		key = fmt.Sprintf("%v|%v|%v", target.target, config.Region, config.AccessKey)
+	case dataprovider.GCSFilesystemProvider:
+		config := user.FsConfig.GCSConfig
+		target.check = HealthCheckGCS
+		target.target = config.Bucket
+		key = fmt.Sprintf("%v|%v", config.Bucket, user.Username)
+		if config.AutomaticCredentials > 0 {
+			key = config.Bucket
+		}
+	case dataprovider.AzureBlobFilesystemProvider:
+		config := user.FsConfig.AzBlobConfig
+		target.check = HealthCheckAzureBlob
+		if config.SASURL != "" {
+			// the query string contains the signature
+			u, err := url.Parse(config.SASURL)
+			if err != nil {
+				return target, key, false
+			}
+			u.RawQuery = ""
+			target.target = u.String()
+		} else {
+			target.target = fmt.Sprintf("%v/%v", config.AccountName, config.Container)
+			if config.Endpoint != "" {
+				target.target = fmt.Sprintf("%v/%v", config.Endpoint, target.target)
+			}
+		}
+		key = target.target
+	case dataprovider.SFTPFilesystemProvider:
+		config := user.FsConfig.SFTPConfig
+		target.check = HealthCheckSFTP
+		target.target = fmt.Sprintf("%v@%v", config.Username, config.Endpoint)
+		key = fmt.Sprintf("%v|%v", target.target, config.Prefix)
+	case dataprovider.WebDAVFilesystemProvider:
+		config := user.FsConfig.WebDAVConfig
+		target.check = HealthCheckWebDAV
+		// the endpoint could contain credentials
+		u, err := url.Parse(config.Endpoint)
+		if err != nil {
+			return target, key, false
+		}
+		u.User = nil
+		u.RawQuery = ""
+		target.target = fmt.Sprintf("%v@%v", config.Username, u.String())
+		key = fmt.Sprintf("%v|%v", target.target, config.Prefix)
+	case dataprovider.FTPFilesystemProvider:
+		config := user.FsConfig.FTPConfig
+		target.check = HealthCheckFTP
+		target.target = fmt.Sprintf("%v@%v", config.Username, config.Endpoint)
+		key = fmt.Sprintf("%v|%v", target.target, config.Prefix)
+	default:
+		// the memory filesystem has no storage to check
+		return target, key, false
+	}
+	return target, key, true
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const partialUploadsCheckInterval = 30 * time.Minute
+
+var (
+	partialUploadsTicker     *time.Ticker
+	partialUploadsTickerDone chan bool
+)
+
+func startPartialUploadsTicker(duration time.Duration) {
+	stopPartialUploadsTicker()
+	partialUploadsTicker = time.NewTicker(duration)
+	partialUploadsTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-partialUploadsTickerDone:
+				return
+			case <-partialUploadsTicker.C:
+				abortStalePartialUploads()
+			}
+		}
+	}()
+}
+
+func stopPartialUploadsTicker() {
+	if partialUploadsTicker != nil {
+		partialUploadsTicker.Stop()
+		partialUploadsTickerDone <- true
+		partialUploadsTicker = nil
+	}
+}
+
+// abortStalePartialUploads aborts the interrupted uploads not resumed within the
+// configured max age. The uploads for users with active sessions are skipped, they
+// will be checked again later
+func abortStalePartialUploads() {
+	for _, upload := range vfs.GetStalePartialUploads() {
+		if upload.Owner != "" && Connections.GetActiveSessions(upload.Owner) > 0 {
+			continue
+		}
+		abortStalePartialUpload(upload)
+	}
+}
+
+// abortStalePartialUpload aborts the given upload using the owner's storage
+// configuration. On error the upload is kept, it will be checked again later,
+// if the owner does not exist anymore the state is removed since the upload
+// cannot be aborted
+func abortStalePartialUpload(upload vfs.PartialUpload) {
+	logger.Debug(logSender, "", "aborting stale interrupted upload for key %#v, namespace %#v, owner %#v",
+		upload.Key, upload.Namespace, upload.Owner)
+	if upload.Owner == "" {
+		logger.Warn(logSender, "", "unable to abort stale upload %#v, namespace %#v: no owner, removing its state",
+			upload.Key, upload.Namespace)
+		vfs.RemovePartialUpload(upload)
+		return
+	}
+	user, err := dataprovider.UserExists(upload.Owner)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			logger.Warn(logSender, "", "unable to abort stale upload %#v, namespace %#v: owner %#v not found, "+
+				"removing its state", upload.Key, upload.Namespace, upload.Owner)
+			vfs.RemovePartialUpload(upload)
+			return
+		}
+		logger.Warn(logSender, "", "unable to abort stale upload %#v, cannot get owner %#v: %v",
+			upload.Key, upload.Owner, err)
+		return
+	}
+	if err := vfs.AbortStalePartialUpload(upload, user.GetHomeDir(), user.FsConfig.S3Config); err != nil {
+		logger.Warn(logSender, "", "unable to abort stale upload %#v, namespace %#v, owner %#v: %v",
+			upload.Key, upload.Namespace, upload.Owner, err)
+	}
+}
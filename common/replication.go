@@ -0,0 +1,401 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	replicationCheckInterval = 2 * time.Second
+	replicationJobsBatchSize = 100
+	replicationUsersPageSize = 100
+)
+
+// ErrReplicationDisabled defines the error for a replication request when no
+// replication target is configured
+var ErrReplicationDisabled = errors.New("replication is not enabled")
+
+var (
+	replicationConfig     vfs.ReplicationConfig
+	replicationTicker     *time.Ticker
+	replicationTickerDone chan bool
+	// used to process the new jobs without waiting for the next tick
+	replicationWakeUp  = make(chan bool, 1)
+	activeReplications = struct {
+		sync.Mutex
+		users map[string]bool
+	}{
+		users: make(map[string]bool),
+	}
+)
+
+// ReplicationStatus defines the status of the replication queue
+type ReplicationStatus struct {
+	Enabled  bool   `json:"enabled"`
+	Provider string `json:"provider,omitempty"`
+	// users whose changes are being replicated
+	Active  []string `json:"active"`
+	Pending int      `json:"pending"`
+	Failed  int      `json:"failed"`
+	// creation time for the oldest pending change as unix timestamp in
+	// milliseconds, 0 if there are no pending changes
+	OldestPending int64 `json:"oldest_pending"`
+	// seconds elapsed since the oldest pending change
+	Lag int64 `json:"lag"`
+	// the jobs that reached the maximum number of attempts
+	FailedJobs []dataprovider.ReplicationJob `json:"failed_jobs"`
+}
+
+// InitializeReplication initializes the replication target and starts, or
+// stops, the background replication of the queued changes
+func InitializeReplication(c vfs.ReplicationConfig) error {
+	stopReplicationTicker()
+	if err := vfs.InitializeReplication(c); err != nil {
+		return err
+	}
+	replicationConfig = c
+	if vfs.IsReplicationEnabled() {
+		startReplicationTicker(replicationCheckInterval)
+	}
+	return nil
+}
+
+func startReplicationTicker(duration time.Duration) {
+	stopReplicationTicker()
+	replicationTicker = time.NewTicker(duration)
+	replicationTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-replicationTickerDone:
+				return
+			case <-replicationTicker.C:
+				processReplicationJobs()
+			case <-replicationWakeUp:
+				processReplicationJobs()
+			}
+		}
+	}()
+}
+
+func stopReplicationTicker() {
+	if replicationTicker != nil {
+		replicationTicker.Stop()
+		replicationTickerDone <- true
+		replicationTicker = nil
+	}
+}
+
+func wakeUpReplication() {
+	select {
+	case replicationWakeUp <- true:
+	default:
+	}
+}
+
+// AddReplicationJob queues a change to replicate, if the replication is enabled
+func AddReplicationJob(username, action, virtualPath, virtualTargetPath string) {
+	if !vfs.IsReplicationEnabled() {
+		return
+	}
+	if err := dataprovider.AddReplicationJob(username, action, virtualPath, virtualTargetPath); err != nil {
+		logger.Warn(logSender, "", "unable to queue the replication %v for user %#v, path %#v: %v",
+			action, username, virtualPath, err)
+		return
+	}
+	wakeUpReplication()
+}
+
+// ResyncReplication queues a full comparison between the storage and the
+// replica for the given user, or for all the users if username is empty
+func ResyncReplication(username string) error {
+	if !vfs.IsReplicationEnabled() {
+		return ErrReplicationDisabled
+	}
+	if username != "" {
+		if _, err := dataprovider.UserExists(username); err != nil {
+			return err
+		}
+		AddReplicationJob(username, dataprovider.ReplicationActionResync, "/", "")
+		return nil
+	}
+	for offset := 0; ; offset += replicationUsersPageSize {
+		users, err := dataprovider.GetUsers(replicationUsersPageSize, offset, dataprovider.OrderASC)
+		if err != nil {
+			return err
+		}
+		for idx := range users {
+			AddReplicationJob(users[idx].Username, dataprovider.ReplicationActionResync, "/", "")
+		}
+		if len(users) < replicationUsersPageSize {
+			return nil
+		}
+	}
+}
+
+// GetReplicationStatus returns the status of the replication queue including
+// the failed jobs in the specified range
+func GetReplicationStatus(limit, offset int) (ReplicationStatus, error) {
+	status := ReplicationStatus{
+		Enabled:    vfs.IsReplicationEnabled(),
+		Active:     getActiveReplications(),
+		FailedJobs: []dataprovider.ReplicationJob{},
+	}
+	if status.Enabled {
+		status.Provider = replicationConfig.Provider
+	}
+	summary, err := dataprovider.GetReplicationJobsSummary()
+	if err != nil {
+		return status, err
+	}
+	status.Pending = summary.Pending
+	status.Failed = summary.Failed
+	status.OldestPending = summary.OldestPending
+	if summary.OldestPending > 0 {
+		lag := time.Since(utils.GetTimeFromMsecSinceEpoch(summary.OldestPending))
+		if lag > 0 {
+			status.Lag = int64(lag / time.Second)
+		}
+	}
+	if summary.Failed > 0 {
+		status.FailedJobs, err = dataprovider.GetReplicationJobs("", dataprovider.ReplicationJobStatusFailed, limit, offset)
+	}
+	return status, err
+}
+
+// processReplicationJobs processes the due jobs. The jobs for the same user
+// are processed sequentially, different users are processed concurrently
+func processReplicationJobs() {
+	for {
+		jobs, err := dataprovider.GetDueReplicationJobs(replicationJobsBatchSize)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get the replication jobs: %v", err)
+			return
+		}
+		var usernames []string
+		userJobs := make(map[string][]dataprovider.ReplicationJob)
+		for _, job := range jobs {
+			if _, ok := userJobs[job.Username]; !ok {
+				usernames = append(usernames, job.Username)
+			}
+			userJobs[job.Username] = append(userJobs[job.Username], job)
+		}
+
+		var wg sync.WaitGroup
+		guard := make(chan bool, replicationConfig.Workers)
+		for _, username := range usernames {
+			wg.Add(1)
+			guard <- true
+			go func(username string, jobs []dataprovider.ReplicationJob) {
+				defer func() {
+					<-guard
+					wg.Done()
+				}()
+				processUserReplicationJobs(username, jobs)
+			}(username, userJobs[username])
+		}
+		wg.Wait()
+
+		if len(jobs) < replicationJobsBatchSize || !vfs.IsReplicationEnabled() {
+			return
+		}
+	}
+}
+
+func processUserReplicationJobs(username string, jobs []dataprovider.ReplicationJob) {
+	addActiveReplication(username)
+	defer removeActiveReplication(username)
+
+	user, err := dataprovider.UserExists(username)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			logger.Debug(logSender, "", "user %#v does not exist anymore, removing %v replication jobs",
+				username, len(jobs))
+			for idx := range jobs {
+				dataprovider.DeleteReplicationJob(&jobs[idx]) //nolint:errcheck
+			}
+			return
+		}
+		logger.Warn(logSender, "", "unable to get user %#v to replicate its changes: %v", username, err)
+		return
+	}
+	fs, err := user.GetFilesystem("replication_" + xid.New().String())
+	if err != nil {
+		for idx := range jobs {
+			setReplicationJobFailed(&jobs[idx], err)
+		}
+		return
+	}
+	defer fs.Close()
+
+	for idx := range jobs {
+		job := &jobs[idx]
+		// a job followed by an identical one can be skipped, the replica is
+		// compared with the current storage contents anyway
+		if idx < len(jobs)-1 && isSameReplicationJob(job, &jobs[idx+1]) {
+			dataprovider.DeleteReplicationJob(job) //nolint:errcheck
+			continue
+		}
+		if err := processReplicationJob(&user, fs, job); err != nil {
+			logger.Warn(logSender, "", "unable to replicate %v for user %#v, path %#v, attempt %v: %v",
+				job.Action, username, job.Path, job.Attempts+1, err)
+			setReplicationJobFailed(job, err)
+			// the target is probably unavailable, the remaining jobs will be
+			// processed on the next check
+			return
+		}
+		if err := dataprovider.DeleteReplicationJob(job); err != nil {
+			logger.Warn(logSender, "", "unable to remove the completed replication job %v: %v", job.ID, err)
+		}
+	}
+}
+
+func processReplicationJob(user *dataprovider.User, fs vfs.Fs, job *dataprovider.ReplicationJob) error {
+	switch job.Action {
+	case dataprovider.ReplicationActionUpload:
+		_, err := vfs.SyncReplica(fs, user.Username, job.Path, getReplicationExcludedPaths(user, job.Path), true)
+		return err
+	case dataprovider.ReplicationActionDelete:
+		_, err := vfs.SyncReplica(fs, user.Username, job.Path, getReplicationExcludedPaths(user, job.Path), false)
+		return err
+	case dataprovider.ReplicationActionRename:
+		return processReplicationRename(user, fs, job)
+	case dataprovider.ReplicationActionResync:
+		return processReplicationResync(user, fs, job)
+	default:
+		return errors.New("unsupported replication action")
+	}
+}
+
+// processReplicationRename renames the replica if it is up to date, this
+// avoids copying the renamed files again, otherwise the source and target
+// paths are compared with the storage
+func processReplicationRename(user *dataprovider.User, fs vfs.Fs, job *dataprovider.ReplicationJob) error {
+	if isOldestReplicationJob(job) {
+		if err := vfs.RenameReplica(user.Username, job.Path, job.TargetPath); err != nil {
+			logger.Debug(logSender, "", "unable to rename the replica %#v -> %#v for user %#v, it will be synced: %v",
+				job.Path, job.TargetPath, user.Username, err)
+		}
+	}
+	if _, err := vfs.SyncReplica(fs, user.Username, job.TargetPath, getReplicationExcludedPaths(user, job.TargetPath),
+		false); err != nil {
+		return err
+	}
+	_, err := vfs.SyncReplica(fs, user.Username, job.Path, getReplicationExcludedPaths(user, job.Path), false)
+	return err
+}
+
+// processReplicationResync compares the whole storage, including the virtual
+// folders, with the replica. The failed jobs are not needed anymore after a
+// successful resync
+func processReplicationResync(user *dataprovider.User, fs vfs.Fs, job *dataprovider.ReplicationJob) error {
+	result, err := vfs.SyncReplica(fs, user.Username, "/", getReplicationExcludedPaths(user, "/"), false)
+	if err != nil {
+		return err
+	}
+	for _, vfolder := range user.VirtualFolders {
+		folderResult, err := vfs.SyncReplica(fs, user.Username, vfolder.VirtualPath,
+			getReplicationExcludedPaths(user, vfolder.VirtualPath), false)
+		if err != nil {
+			return err
+		}
+		result.CopiedFiles += folderResult.CopiedFiles
+		result.CopiedSize += folderResult.CopiedSize
+		result.RemovedItems += folderResult.RemovedItems
+	}
+	logger.Debug(logSender, "", "replica resynced for user %#v, copied files: %v, size: %v, removed items: %v",
+		user.Username, result.CopiedFiles, result.CopiedSize, result.RemovedItems)
+
+	for {
+		failedJobs, err := dataprovider.GetReplicationJobs(user.Username, dataprovider.ReplicationJobStatusFailed,
+			replicationJobsBatchSize, 0)
+		if err != nil {
+			return nil
+		}
+		removed := 0
+		for idx := range failedJobs {
+			if failedJobs[idx].ID < job.ID {
+				if dataprovider.DeleteReplicationJob(&failedJobs[idx]) == nil {
+					removed++
+				}
+			}
+		}
+		if removed == 0 || len(failedJobs) < replicationJobsBatchSize {
+			return nil
+		}
+	}
+}
+
+func setReplicationJobFailed(job *dataprovider.ReplicationJob, err error) {
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= replicationConfig.MaxAttempts {
+		job.Status = dataprovider.ReplicationJobStatusFailed
+	} else {
+		job.NextAttempt = utils.GetTimeAsMsSinceEpoch(time.Now().Add(replicationConfig.GetRetryDelay(job.Attempts)))
+	}
+	if err := dataprovider.UpdateReplicationJob(job); err != nil {
+		logger.Warn(logSender, "", "unable to update the replication job %v: %v", job.ID, err)
+	}
+}
+
+// isOldestReplicationJob returns true if there are no previous jobs, pending
+// or failed, for the same user
+func isOldestReplicationJob(job *dataprovider.ReplicationJob) bool {
+	jobs, err := dataprovider.GetReplicationJobs(job.Username, 0, 1, 0)
+	if err != nil || len(jobs) == 0 {
+		return false
+	}
+	return jobs[0].ID == job.ID
+}
+
+// getReplicationExcludedPaths returns the virtual folders inside the given
+// virtual path, they are replicated separately
+func getReplicationExcludedPaths(user *dataprovider.User, virtualPath string) []string {
+	var result []string
+	for _, vfolder := range user.VirtualFolders {
+		if vfolder.VirtualPath != virtualPath && (virtualPath == "/" ||
+			strings.HasPrefix(vfolder.VirtualPath, virtualPath+"/")) {
+			result = append(result, vfolder.VirtualPath)
+		}
+	}
+	return result
+}
+
+func isSameReplicationJob(job, other *dataprovider.ReplicationJob) bool {
+	return job.Action == other.Action && job.Path == other.Path && job.TargetPath == other.TargetPath
+}
+
+func getActiveReplications() []string {
+	activeReplications.Lock()
+	defer activeReplications.Unlock()
+
+	result := make([]string, 0, len(activeReplications.users))
+	for username := range activeReplications.users {
+		result = append(result, username)
+	}
+	return result
+}
+
+func addActiveReplication(username string) {
+	activeReplications.Lock()
+	defer activeReplications.Unlock()
+
+	activeReplications.users[username] = true
+}
+
+func removeActiveReplication(username string) {
+	activeReplications.Lock()
+	defer activeReplications.Unlock()
+
+	delete(activeReplications.users, username)
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var errRetentionLocked = errors.New("the file is locked by a retention filter")
+
+// CheckRetentionLock returns an error if the file at the specified fsPath is
+// locked by a retention filter, for directories an error is returned if any
+// file inside them is locked. info can be nil, in this case a stat is done
+// only if a retention filter applies to the specified virtualPath or the
+// native object lock is enabled.
+// The locked files cannot be overwritten, truncated, renamed, removed or
+// have their attributes changed. If the native object lock is enabled, the
+// legal holds set by SFTPGo are removed from the files that are not locked
+// anymore, for example because the legal hold was removed from their
+// retention filter. The files inside directories are not released
+func (c *BaseConnection) CheckRetentionLock(fsPath, virtualPath string, info os.FileInfo) error {
+	isObjectLockEnabled := vfs.IsObjectLockEnabled(c.Fs)
+	if !isObjectLockEnabled && !c.User.HasRetentionFiltersFor(virtualPath) {
+		return nil
+	}
+	if info == nil {
+		var err error
+		info, err = c.Fs.Lstat(fsPath)
+		if err != nil {
+			if c.Fs.IsNotExist(err) {
+				return nil
+			}
+			return c.GetFsError(err)
+		}
+	}
+	if info.IsDir() {
+		return c.checkRetentionLockForDir(fsPath, virtualPath)
+	}
+	if c.isRetentionLocked(virtualPath, info) {
+		return c.GetPermissionDeniedError()
+	}
+	if isObjectLockEnabled && info.Mode().IsRegular() {
+		c.removeObjectLegalHold(fsPath, info)
+	}
+	return nil
+}
+
+func (c *BaseConnection) checkRetentionLockForDir(fsPath, virtualPath string) error {
+	if !c.User.HasRetentionFiltersFor(virtualPath) {
+		return nil
+	}
+	err := c.Fs.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if c.isRetentionLocked(c.Fs.GetRelativePath(walkedPath), info) {
+			return errRetentionLocked
+		}
+		return nil
+	})
+	if err == errRetentionLocked {
+		c.Log(logger.LevelInfo, "directory %#v contains files locked by a retention filter", virtualPath)
+		return c.GetPermissionDeniedError()
+	}
+	if err != nil {
+		c.Log(logger.LevelWarn, "unable to check the retention locks inside directory %#v: %v", virtualPath, err)
+		return c.GetFsError(err)
+	}
+	return nil
+}
+
+// removeObjectLegalHold removes the native legal hold set by SFTPGo for a
+// file that is not locked by a retention filter, the errors are only logged
+func (c *BaseConnection) removeObjectLegalHold(fsPath string, info os.FileInfo) {
+	if err := vfs.RemoveObjectLegalHold(c.Fs, fsPath, info); err != nil {
+		c.Log(logger.LevelWarn, "unable to remove the object legal hold for %#v: %v", fsPath, err)
+		return
+	}
+	c.Log(logger.LevelDebug, "object legal hold checked for %#v", fsPath)
+}
+
+// checkSetStatRetentionLock returns an error if the requested attributes
+// cannot be changed since the file is locked by a retention filter.
+// The attributes of the directories can always be changed
+func (c *BaseConnection) checkSetStatRetentionLock(fsPath, virtualPath string, attributes *StatAttributes) error {
+	if attributes.Flags&StatAttrSize == 0 && c.ignoreSetStat() {
+		return nil
+	}
+	if !c.User.HasRetentionFiltersFor(virtualPath) {
+		return nil
+	}
+	info, err := c.Fs.Lstat(c.getRealFsPath(fsPath))
+	if err != nil || info.IsDir() {
+		// stat errors are handled by the setstat methods
+		return nil
+	}
+	if c.isRetentionLocked(virtualPath, info) {
+		return c.GetPermissionDeniedError()
+	}
+	return nil
+}
+
+// checkLinkRetention returns an error if a link can make a file protected by
+// a retention filter modifiable using a different path
+func (c *BaseConnection) checkLinkRetention(virtualSourcePath, virtualTargetPath string, isHardlink bool) error {
+	if c.User.HasRetentionFiltersFor(virtualSourcePath) {
+		c.Log(logger.LevelInfo, "link source %#v is protected by a retention filter", virtualSourcePath)
+		return c.GetPermissionDeniedError()
+	}
+	if isHardlink && c.User.GetRetentionFilter(virtualTargetPath) != nil {
+		c.Log(logger.LevelInfo, "hard link target %#v is protected by a retention filter", virtualTargetPath)
+		return c.GetPermissionDeniedError()
+	}
+	return nil
+}
+
+// CheckRetentionTarget returns an error if a file or directory cannot be
+// renamed or copied to the given target. The retention periods start from the
+// modification time, that a user can change outside the retention filters,
+// so files can be moved to a path protected by a retention filter only from a
+// path protected by the same filter
+func (c *BaseConnection) CheckRetentionTarget(virtualSourcePath, virtualTargetPath string, isDir bool) error {
+	sourcePath, targetPath := virtualSourcePath, virtualTargetPath
+	if isDir {
+		if !c.User.HasRetentionFiltersFor(virtualTargetPath) {
+			return nil
+		}
+		if c.hasRetentionFiltersInside(virtualSourcePath) || c.hasRetentionFiltersInside(virtualTargetPath) {
+			c.Log(logger.LevelInfo, "unable to move the directory %#v to %#v: they contain retention filters",
+				virtualSourcePath, virtualTargetPath)
+			return c.GetPermissionDeniedError()
+		}
+		// compare the filters for the files inside the directories
+		sourcePath = path.Join(virtualSourcePath, "file")
+		targetPath = path.Join(virtualTargetPath, "file")
+	}
+	targetFilter := c.User.GetRetentionFilter(targetPath)
+	if targetFilter == nil {
+		return nil
+	}
+	sourceFilter := c.User.GetRetentionFilter(sourcePath)
+	if sourceFilter == nil || sourceFilter.Path != targetFilter.Path {
+		c.Log(logger.LevelInfo, "unable to move %#v to %#v: the target is protected by the retention filter for %#v",
+			virtualSourcePath, virtualTargetPath, targetFilter.Path)
+		return c.GetPermissionDeniedError()
+	}
+	return nil
+}
+
+// hasRetentionFiltersInside returns true if a retention filter is defined for
+// a directory inside the specified one
+func (c *BaseConnection) hasRetentionFiltersInside(virtualPath string) bool {
+	for _, f := range c.User.Filters.Retention {
+		if f.Path != virtualPath && (virtualPath == "/" || strings.HasPrefix(f.Path, virtualPath+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BaseConnection) isRetentionLocked(virtualPath string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	filter := c.User.GetRetentionFilter(virtualPath)
+	if filter == nil || !filter.IsLocked(info.ModTime()) {
+		return false
+	}
+	c.Log(logger.LevelInfo, "file %#v is locked by the retention filter for %#v, legal hold: %v, retain until: %v",
+		virtualPath, filter.Path, filter.LegalHold, filter.GetRetainUntil(info.ModTime()).Format(time.RFC3339))
+	return true
+}
+
+// setObjectLock natively locks the uploaded file, if a retention filter
+// applies and the filesystem supports this
+func (t *BaseTransfer) setObjectLock() {
+	if t.ErrTransfer != nil || !vfs.IsObjectLockEnabled(t.Fs) {
+		return
+	}
+	filter := t.Connection.User.GetRetentionFilter(t.requestPath)
+	if filter == nil {
+		return
+	}
+	var retainUntil time.Time
+	if filter.Days > 0 {
+		retainUntil = filter.GetRetainUntil(time.Now())
+	}
+	if err := vfs.SetObjectLock(t.Fs, t.fsPath, retainUntil, filter.LegalHold); err != nil {
+		t.Connection.Log(logger.LevelWarn, "unable to set the object lock for %#v: %v", t.fsPath, err)
+		return
+	}
+	t.Connection.Log(logger.LevelDebug, "object lock set for %#v, legal hold: %v, retain until: %v", t.fsPath,
+		filter.LegalHold, retainUntil)
+}
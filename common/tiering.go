@@ -0,0 +1,116 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const tieringUsersPageSize = 100
+
+// ErrTieringInProgress defines the error for a tiering policy that is already
+// being applied for a user
+var ErrTieringInProgress = errors.New("the tiering policy is already being applied for this user")
+
+var (
+	tieringTicker     *time.Ticker
+	tieringTickerDone chan bool
+	activeTierings    = struct {
+		sync.Mutex
+		users map[string]bool
+	}{
+		users: make(map[string]bool),
+	}
+)
+
+func startTieringTicker(duration time.Duration) {
+	stopTieringTicker()
+	tieringTicker = time.NewTicker(duration)
+	tieringTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-tieringTickerDone:
+				return
+			case <-tieringTicker.C:
+				applyTieringPolicies()
+			}
+		}
+	}()
+}
+
+func stopTieringTicker() {
+	if tieringTicker != nil {
+		tieringTicker.Stop()
+		tieringTickerDone <- true
+		tieringTicker = nil
+	}
+}
+
+// ApplyTieringPolicy evaluates the tiering policy for the given user and moves
+// the matching files to the tiering target. If dryRun is true nothing is moved
+func ApplyTieringPolicy(user *dataprovider.User, dryRun bool) (vfs.TieringReport, error) {
+	if !addActiveTiering(user.Username) {
+		return vfs.TieringReport{}, ErrTieringInProgress
+	}
+	defer removeActiveTiering(user.Username)
+
+	fs, err := user.GetTieredFilesystem("")
+	if err != nil {
+		return vfs.TieringReport{}, err
+	}
+	defer fs.Close()
+
+	if dryRun {
+		return fs.GetTieringReport()
+	}
+	report, err := fs.ApplyTieringPolicy()
+	logger.Debug(logSender, "", "tiering policy applied for user %#v, moved files: %v, errors: %v, err: %v",
+		user.Username, len(report.Candidates), report.Errors, err)
+	return report, err
+}
+
+// applyTieringPolicies applies the tiering policies for all the users with
+// the tiering enabled
+func applyTieringPolicies() {
+	for offset := 0; ; offset += tieringUsersPageSize {
+		users, err := dataprovider.GetUsers(tieringUsersPageSize, offset, dataprovider.OrderASC)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get the users to apply the tiering policies: %v", err)
+			return
+		}
+		for idx := range users {
+			if users[idx].FsConfig.TieringConfig.IsEnabled() {
+				if _, err := ApplyTieringPolicy(&users[idx], false); err != nil {
+					logger.Warn(logSender, "", "unable to apply the tiering policy for user %#v: %v",
+						users[idx].Username, err)
+				}
+			}
+		}
+		if len(users) < tieringUsersPageSize {
+			return
+		}
+	}
+}
+
+func addActiveTiering(username string) bool {
+	activeTierings.Lock()
+	defer activeTierings.Unlock()
+
+	if activeTierings.users[username] {
+		return false
+	}
+	activeTierings.users[username] = true
+	return true
+}
+
+func removeActiveTiering(username string) {
+	activeTierings.Lock()
+	defer activeTierings.Unlock()
+
+	delete(activeTierings.users, username)
+}
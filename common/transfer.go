@@ -1,8 +1,14 @@
 package common
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,11 +19,29 @@ import (
 	"github.com/drakkan/sftpgo/vfs"
 )
 
+const sniffLen = 512
+
 var (
 	// ErrTransferClosed defines the error returned for a closed transfer
 	ErrTransferClosed = errors.New("transfer already closed")
+	// ErrContentTypeDenied defines the error returned if the uploaded content type is not allowed
+	ErrContentTypeDenied = errors.New("the uploaded content type is not allowed")
 )
 
+// executable formats not recognized by http.DetectContentType
+var executableSignatures = []struct {
+	sig      []byte
+	mimeType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7FELF"), "application/x-executable"},
+	{[]byte("\xFE\xED\xFA\xCE"), "application/x-mach-binary"},
+	{[]byte("\xFE\xED\xFA\xCF"), "application/x-mach-binary"},
+	{[]byte("\xCE\xFA\xED\xFE"), "application/x-mach-binary"},
+	{[]byte("\xCF\xFA\xED\xFE"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
 // BaseTransfer contains protocols common transfer details for an upload or a download.
 type BaseTransfer struct { //nolint:maligned
 	ID             uint64
@@ -37,7 +61,11 @@ type BaseTransfer struct { //nolint:maligned
 	transferType   int
 	AbortTransfer  int32
 	sync.Mutex
-	ErrTransfer error
+	ErrTransfer     error
+	mimeTypesFilter *dataprovider.MimeTypesFilter
+	sniffBuffer     []byte
+	mimeType        string
+	checksums       *uploadChecksums
 }
 
 // NewBaseTransfer returns a new BaseTransfer and adds it to the given connection
@@ -61,6 +89,12 @@ func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPat
 		AbortTransfer:  0,
 		Fs:             fs,
 	}
+	if transferType == TransferUpload {
+		t.mimeTypesFilter = conn.User.GetMimeTypesFilter(requestPath)
+		if minWriteOffset == 0 {
+			t.checksums = newUploadChecksums(Config.UploadChecksums)
+		}
+	}
 
 	conn.AddTransfer(t)
 	return t
@@ -119,6 +153,41 @@ func (t *BaseTransfer) GetRealFsPath(fsPath string) string {
 	return ""
 }
 
+// SniffContent stores the first bytes of an upload, they are used to detect the
+// content type when the transfer ends. Nothing is stored if there is no content
+// type filter for the upload path. Data written at an offset not contiguous to
+// the already stored bytes is ignored.
+// The configured upload checksums are updated with the written data too
+func (t *BaseTransfer) SniffContent(data []byte, offset int64) {
+	if t.transferType != TransferUpload || len(data) == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	if t.checksums != nil {
+		t.checksums.write(data, offset)
+	}
+	if t.mimeTypesFilter == nil {
+		return
+	}
+	stored := int64(len(t.sniffBuffer))
+	if stored >= sniffLen || offset != stored {
+		return
+	}
+	toCopy := sniffLen - stored
+	if int64(len(data)) < toCopy {
+		toCopy = int64(len(data))
+	}
+	t.sniffBuffer = append(t.sniffBuffer, data[:toCopy]...)
+}
+
+// GetMimeType returns the content type detected for an upload.
+// It is empty until the transfer is closed
+func (t *BaseTransfer) GetMimeType() string {
+	return t.mimeType
+}
+
 // SetCancelFn sets the cancel function for the transfer
 func (t *BaseTransfer) SetCancelFn(cancelFn func()) {
 	t.cancelFn = cancelFn
@@ -133,9 +202,15 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 			err := t.File.Truncate(size)
 			if err == nil {
 				t.Lock()
+				if t.checksums != nil && size != t.checksums.written {
+					t.checksums.invalidate()
+				}
 				t.InitialSize = size
+				if vfs.IsCryptOsFs(t.Fs) {
+					t.InitialSize = vfs.GetEncryptedSize(size)
+				}
 				if t.MaxWriteSize > 0 {
-					sizeDiff := initialSize - size
+					sizeDiff := initialSize - t.InitialSize
 					t.MaxWriteSize += sizeDiff
 					metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
 					atomic.StoreInt64(&t.BytesReceived, 0)
@@ -148,6 +223,10 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 		}
 		if size == 0 && atomic.LoadInt64(&t.BytesSent) == 0 {
 			// for cloud providers the file is always truncated to zero, we don't support append/resume for uploads
+			if vfs.IsCryptOsFs(t.Fs) {
+				// a new encrypted file is not empty, it contains the header
+				return vfs.GetEncryptedSize(0), nil
+			}
 			return 0, nil
 		}
 		return 0, ErrOpUnsupported
@@ -177,13 +256,7 @@ func (t *BaseTransfer) getUploadFileSize() (int64, error) {
 	var fileSize int64
 	info, err := t.Fs.Stat(t.fsPath)
 	if err == nil {
-		fileSize = info.Size()
-	}
-	if vfs.IsCryptOsFs(t.Fs) && t.ErrTransfer != nil {
-		errDelete := t.Connection.Fs.Remove(t.fsPath, false)
-		if errDelete != nil {
-			t.Connection.Log(logger.LevelWarn, "error removing partial crypto file %#v: %v", t.fsPath, errDelete)
-		}
+		fileSize = vfs.GetQuotaSize(info)
 	}
 	return fileSize, err
 }
@@ -201,8 +274,17 @@ func (t *BaseTransfer) Close() error {
 	if t.isNewFile {
 		numFiles = 1
 	}
+	if t.transferType == TransferUpload && t.ErrTransfer == nil && !t.checkUploadedContent() {
+		t.ErrTransfer = ErrContentTypeDenied
+	}
 	metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
-	if t.ErrTransfer == ErrQuotaExceeded && t.File != nil {
+	if t.ErrTransfer == ErrContentTypeDenied {
+		if t.handleDeniedContent() {
+			numFiles--
+			atomic.StoreInt64(&t.BytesReceived, 0)
+			t.MinWriteOffset = 0
+		}
+	} else if t.ErrTransfer == ErrQuotaExceeded && t.File != nil {
 		// if quota is exceeded we try to remove the partial file for uploads to local filesystem
 		err = t.Connection.Fs.Remove(t.File.Name(), false)
 		if err == nil {
@@ -241,12 +323,18 @@ func (t *BaseTransfer) Close() error {
 			fileSize = statSize
 		}
 		t.Connection.Log(logger.LevelDebug, "uploaded file size %v", fileSize)
+		checksums := t.storeChecksums()
+		t.setObjectLock()
 		t.updateQuota(numFiles, fileSize)
 		logger.TransferLog(uploadLogSender, t.fsPath, elapsed, atomic.LoadInt64(&t.BytesReceived), t.Connection.User.Username,
 			t.Connection.ID, t.Connection.protocol)
 		action := newActionNotification(&t.Connection.User, operationUpload, t.fsPath, "", "", t.Connection.protocol,
 			fileSize, t.ErrTransfer)
+		action.MimeType = t.mimeType
+		action.Checksums = checksums
 		go actionHandler.Handle(action) //nolint:errcheck
+		// the replica must match the stored file even if the upload failed
+		AddReplicationJob(t.Connection.User.Username, dataprovider.ReplicationActionUpload, t.requestPath, "")
 	}
 	if t.ErrTransfer != nil {
 		t.Connection.Log(logger.LevelWarn, "transfer error: %v, path: %#v", t.ErrTransfer, t.fsPath)
@@ -257,9 +345,37 @@ func (t *BaseTransfer) Close() error {
 	return err
 }
 
+// storeChecksums returns the checksums computed for a successful upload and
+// stores them, if the filesystem supports this, so they can be used later
+// without reading the file again
+func (t *BaseTransfer) storeChecksums() map[string]string {
+	if t.checksums == nil || t.ErrTransfer != nil || t.MinWriteOffset > 0 {
+		return nil
+	}
+	size := atomic.LoadInt64(&t.BytesReceived)
+	t.Lock()
+	checksums := t.checksums.getChecksums(size)
+	t.Unlock()
+	if len(checksums) == 0 {
+		t.Connection.Log(logger.LevelDebug, "checksums not available for upload %#v, the file was not written sequentially",
+			t.fsPath)
+		return nil
+	}
+	if vfs.IsChecksumStoreSupported(t.Fs) {
+		err := vfs.SetChecksums(t.Fs, t.fsPath, size, checksums)
+		if err != nil {
+			t.Connection.Log(logger.LevelWarn, "unable to store checksums for %#v: %v", t.fsPath, err)
+		}
+	}
+	return checksums
+}
+
 func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
-	// S3 uploads are atomic, if there is an error nothing is uploaded
-	if t.File == nil && t.ErrTransfer != nil {
+	// S3 uploads are atomic, if there is an error nothing is uploaded unless the
+	// uploaded parts are kept to resume the upload.
+	// Uploads denied for their content type were completed and then removed or quarantined
+	if t.File == nil && t.ErrTransfer != nil && t.ErrTransfer != ErrContentTypeDenied &&
+		!vfs.HasPartialUpload(t.Fs, t.fsPath) {
 		return false
 	}
 	sizeDiff := fileSize - t.InitialSize
@@ -279,6 +395,139 @@ func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
 	return false
 }
 
+func (t *BaseTransfer) getUploadedFilePath() string {
+	if t.File != nil {
+		return t.File.Name()
+	}
+	return t.fsPath
+}
+
+// checkUploadedContent detects the content type for an upload and returns false
+// if it is not allowed by the content type filters defined for the user.
+// The content type is not detected if there is no filter for the upload path
+func (t *BaseTransfer) checkUploadedContent() bool {
+	if t.mimeTypesFilter == nil {
+		return true
+	}
+	data := t.sniffBuffer
+	isComplete := len(data) >= sniffLen || (t.MinWriteOffset == 0 && int64(len(data)) == atomic.LoadInt64(&t.BytesReceived))
+	if !isComplete {
+		// the sniffed data does not cover the beginning of the file, for example
+		// this happens for resumed uploads, we need to read it from the storage
+		head, err := t.readUploadedContentHead()
+		if err != nil {
+			t.Connection.Log(logger.LevelWarn, "unable to detect the content type for %#v: %v", t.fsPath, err)
+			return false
+		}
+		data = head
+	}
+	t.mimeType = detectMimeType(data)
+	if t.mimeTypesFilter.IsAllowed(t.mimeType) {
+		return true
+	}
+	t.Connection.Log(logger.LevelInfo, "upload denied for %#v, content type %#v is not allowed", t.requestPath, t.mimeType)
+	return false
+}
+
+func (t *BaseTransfer) readUploadedContentHead() ([]byte, error) {
+	file, reader, cancelFn, err := t.Fs.Open(t.getUploadedFilePath(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var r io.ReadCloser = reader
+	if file != nil {
+		r = file
+	}
+	defer r.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// handleDeniedContent moves an upload denied for its content type to the quarantine
+// directory, if configured, otherwise the uploaded file is removed.
+// It returns true if the file was removed from the user storage
+func (t *BaseTransfer) handleDeniedContent() bool {
+	uploadedPath := t.getUploadedFilePath()
+	if Config.QuarantinePath != "" {
+		quarantinePath, err := t.moveToQuarantine(uploadedPath)
+		if err == nil {
+			t.Connection.Log(logger.LevelInfo, "file %#v with denied content type moved to quarantine: %#v",
+				uploadedPath, quarantinePath)
+			return true
+		}
+		t.Connection.Log(logger.LevelWarn, "unable to move file %#v to quarantine, it will be removed: %v",
+			uploadedPath, err)
+	}
+	err := t.Fs.Remove(uploadedPath, false)
+	t.Connection.Log(logger.LevelWarn, "file %#v with denied content type removed, deletion error: %v", uploadedPath, err)
+	return err == nil
+}
+
+// moveToQuarantine moves the uploaded file inside the quarantine directory for
+// the user, outside any user home, so it cannot be downloaded again.
+// Files stored on local filesystems are renamed, if possible, the others are
+// copied and then removed from the user storage
+func (t *BaseTransfer) moveToQuarantine(uploadedPath string) (string, error) {
+	quarantineDir := filepath.Join(Config.QuarantinePath, t.Connection.User.Username)
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return "", err
+	}
+	quarantinePath := filepath.Join(quarantineDir, fmt.Sprintf("%v_%v", time.Now().Format("20060102T150405.000000"),
+		path.Base(t.requestPath)))
+	if vfs.IsLocalOsFs(t.Fs) {
+		if err := os.Rename(uploadedPath, quarantinePath); err == nil {
+			return quarantinePath, nil
+		}
+	}
+	if err := t.copyToQuarantine(uploadedPath, quarantinePath); err != nil {
+		os.Remove(quarantinePath) //nolint:errcheck
+		return "", err
+	}
+	return quarantinePath, t.Fs.Remove(uploadedPath, false)
+}
+
+func (t *BaseTransfer) copyToQuarantine(uploadedPath, quarantinePath string) error {
+	file, reader, cancelFn, err := t.Fs.Open(uploadedPath, 0)
+	if err != nil {
+		return err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var r io.ReadCloser = reader
+	if file != nil {
+		r = file
+	}
+	defer r.Close()
+
+	dst, err := os.OpenFile(quarantinePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+func detectMimeType(data []byte) string {
+	for _, s := range executableSignatures {
+		if bytes.HasPrefix(data, s.sig) {
+			return s.mimeType
+		}
+	}
+	return http.DetectContentType(data)
+}
+
 // HandleThrottle manage bandwidth throttling
 func (t *BaseTransfer) HandleThrottle() {
 	var wantedBandwidth int64
@@ -1,7 +1,9 @@
 package common
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -254,7 +256,7 @@ func TestTransferErrors(t *testing.T) {
 	assert.Len(t, conn.GetTransfers(), 0)
 }
 
-func TestRemovePartialCryptoFile(t *testing.T) {
+func TestKeepPartialCryptoFile(t *testing.T) {
 	testFile := filepath.Join(os.TempDir(), "transfer_test_file")
 	fs, err := vfs.NewCryptFs("id", os.TempDir(), vfs.CryptFsConfig{Passphrase: kms.NewPlainSecret("secret")})
 	require.NoError(t, err)
@@ -272,5 +274,217 @@ func TestRemovePartialCryptoFile(t *testing.T) {
 	size, err := transfer.getUploadFileSize()
 	assert.NoError(t, err)
 	assert.Equal(t, int64(9), size)
+	// interrupted uploads are valid encrypted files and can be resumed
+	assert.FileExists(t, testFile)
+	err = os.Remove(testFile)
+	assert.NoError(t, err)
+}
+
+func TestUploadContentTypeFilter(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "mime_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	u := dataprovider.User{
+		Username: "user",
+		HomeDir:  homeDir,
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Filters.MimeTypes = []dataprovider.MimeTypesFilter{
+		{
+			Path:             "/",
+			AllowedMimeTypes: []string{"application/pdf", "text/*"},
+		},
+	}
+	fs := vfs.NewOsFs("", homeDir, nil)
+	conn := NewBaseConnection(fs.ConnectionID(), ProtocolSFTP, u, fs)
+	exeContent := append([]byte("MZ"), make([]byte, 1024)...)
+	testFile := filepath.Join(homeDir, "file.pdf")
+	file, err := os.Create(testFile)
+	require.NoError(t, err)
+	_, err = file.Write(exeContent)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(file, conn, nil, testFile, "/file.pdf", TransferUpload, 0, 0, 0, true, fs)
+	transfer.SniffContent(exeContent[:100], 0)
+	// not contiguous, must be ignored
+	transfer.SniffContent(exeContent[200:300], 200)
+	transfer.SniffContent(exeContent[100:], 100)
+	assert.Len(t, transfer.sniffBuffer, sniffLen)
+	transfer.BytesReceived = int64(len(exeContent))
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.EqualError(t, err, ErrContentTypeDenied.Error())
+	assert.Equal(t, "application/x-msdownload", transfer.GetMimeType())
 	assert.NoFileExists(t, testFile)
+	// now test quarantine and a resumed upload, the sniffed data does not include the file head
+	quarantinePath := filepath.Join(os.TempDir(), "mime_quarantine")
+	c := Config
+	c.QuarantinePath = "relative"
+	err = Initialize(c)
+	assert.Error(t, err)
+	Config.QuarantinePath = quarantinePath
+	defer func() {
+		Config.QuarantinePath = ""
+	}()
+	err = ioutil.WriteFile(testFile, exeContent, os.ModePerm)
+	assert.NoError(t, err)
+	file, err = os.OpenFile(testFile, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, testFile, "/file.pdf", TransferUpload, 512, 512, 0, false, fs)
+	transfer.SniffContent(exeContent[512:], 512)
+	assert.Len(t, transfer.sniffBuffer, 0)
+	transfer.BytesReceived = int64(len(exeContent) - 512)
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.EqualError(t, err, ErrContentTypeDenied.Error())
+	assert.NoFileExists(t, testFile)
+	files, err := ioutil.ReadDir(filepath.Join(quarantinePath, u.Username))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, int64(len(exeContent)), files[0].Size())
+	}
+	files, err = ioutil.ReadDir(homeDir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 0)
+	// an allowed content type
+	pdfContent := []byte("%PDF-1.4 test content")
+	file, err = os.Create(testFile)
+	require.NoError(t, err)
+	_, err = file.Write(pdfContent)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, testFile, "/file.pdf", TransferUpload, 0, 0, 0, true, fs)
+	transfer.SniffContent(pdfContent, 0)
+	transfer.BytesReceived = int64(len(pdfContent))
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "application/pdf", transfer.GetMimeType())
+	assert.FileExists(t, testFile)
+	// no filter for the upload path, the content is not sniffed
+	conn.User.Filters.MimeTypes[0].Path = "/sub"
+	file, err = os.Create(testFile)
+	require.NoError(t, err)
+	_, err = file.Write(exeContent)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, testFile, "/file.pdf", TransferUpload, 0, 0, 0, false, fs)
+	transfer.SniffContent(exeContent, 0)
+	assert.Len(t, transfer.sniffBuffer, 0)
+	transfer.BytesReceived = int64(len(exeContent))
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Empty(t, transfer.GetMimeType())
+	assert.FileExists(t, testFile)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+	err = os.RemoveAll(quarantinePath)
+	assert.NoError(t, err)
+}
+
+func TestUploadChecksums(t *testing.T) {
+	algos, err := validateUploadChecksums([]string{"SHA256", " md5", "sha256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ChecksumSHA256, ChecksumMD5}, algos)
+	_, err = validateUploadChecksums([]string{"sha3"})
+	assert.Error(t, err)
+	assert.Nil(t, newUploadChecksums(nil))
+
+	content := make([]byte, 1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	expected := fmt.Sprintf("%x", sha256.Sum256(content))
+	c := newUploadChecksums([]string{ChecksumSHA256})
+	// out of order writes are hashed when the missing data arrives
+	c.write(content[512:], 512)
+	c.write(content[:256], 0)
+	assert.Nil(t, c.getChecksums(int64(len(content))))
+	c.write(content[256:512], 256)
+	checksums := c.getChecksums(int64(len(content)))
+	if assert.Len(t, checksums, 1) {
+		assert.Equal(t, expected, checksums[ChecksumSHA256])
+	}
+	// data written twice invalidates the checksums
+	c = newUploadChecksums([]string{ChecksumSHA256})
+	c.write(content, 0)
+	c.write(content[:10], 0)
+	assert.Nil(t, c.getChecksums(int64(len(content))))
+	// too much pending data
+	c = newUploadChecksums([]string{ChecksumSHA256})
+	c.write(make([]byte, maxChecksumsPendingSize+1), 1)
+	c.write(content[:1], 0)
+	assert.Nil(t, c.getChecksums(maxChecksumsPendingSize+2))
+}
+
+func TestTransferStoreChecksums(t *testing.T) {
+	oldChecksums := Config.UploadChecksums
+	Config.UploadChecksums = []string{ChecksumSHA256}
+	defer func() {
+		Config.UploadChecksums = oldChecksums
+	}()
+
+	homeDir := filepath.Join(os.TempDir(), "checksums_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	u := dataprovider.User{
+		Username: "user",
+		HomeDir:  homeDir,
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	fs := vfs.NewOsFs("", homeDir, nil)
+	conn := NewBaseConnection(fs.ConnectionID(), ProtocolSFTP, u, fs)
+	content := []byte("checksum test content")
+	expected := fmt.Sprintf("%x", sha256.Sum256(content))
+	testFile := filepath.Join(homeDir, "file.txt")
+	file, err := os.Create(testFile)
+	require.NoError(t, err)
+	_, err = file.Write(content)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(file, conn, nil, testFile, "/file.txt", TransferUpload, 0, 0, 0, true, fs)
+	transfer.SniffContent(content, 0)
+	transfer.BytesReceived = int64(len(content))
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+
+	checksum, size, ok := vfs.GetStoredChecksum(fs, testFile, ChecksumSHA256)
+	if ok {
+		assert.Equal(t, expected, checksum)
+		assert.Equal(t, int64(len(content)), size)
+	} else {
+		t.Log("checksums not stored, extended attributes are probably not supported")
+	}
+	checksum, err = conn.GetFileChecksum(testFile, ChecksumSHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+	checksum, err = conn.GetFileRangeChecksum(testFile, ChecksumSHA256, 0, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content[:8])), checksum)
+	checksum, err = conn.GetFileRangeChecksum(testFile, ChecksumSHA256, 8, int64(len(content)))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content[8:])), checksum)
+	_, err = conn.GetFileChecksum(testFile, "sha3")
+	assert.Error(t, err)
+	// a modified file must not use the stored checksum
+	err = ioutil.WriteFile(testFile, []byte("modified"), os.ModePerm)
+	assert.NoError(t, err)
+	_, _, ok = vfs.GetStoredChecksum(fs, testFile, ChecksumSHA256)
+	assert.False(t, ok)
+	checksum, err = conn.GetFileChecksum(testFile, ChecksumSHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("modified"))), checksum)
+	// a resumed upload has no checksums
+	transfer = NewBaseTransfer(nil, conn, nil, testFile, "/file.txt", TransferUpload, 8, 8, 0, false, fs)
+	assert.Nil(t, transfer.checksums)
+	assert.Nil(t, transfer.storeChecksums())
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
 }
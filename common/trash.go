@@ -0,0 +1,104 @@
+package common
+
+import (
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	trashExpirationCheckInterval = 1 * time.Hour
+	trashExpirationUsersPageSize = 100
+)
+
+var (
+	trashExpirationTicker     *time.Ticker
+	trashExpirationTickerDone chan bool
+)
+
+func startTrashExpirationTicker(duration time.Duration) {
+	stopTrashExpirationTicker()
+	trashExpirationTicker = time.NewTicker(duration)
+	trashExpirationTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-trashExpirationTickerDone:
+				return
+			case <-trashExpirationTicker.C:
+				expireTrashItems()
+			}
+		}
+	}()
+}
+
+func stopTrashExpirationTicker() {
+	if trashExpirationTicker != nil {
+		trashExpirationTicker.Stop()
+		trashExpirationTickerDone <- true
+		trashExpirationTicker = nil
+	}
+}
+
+// NotifyTrashPurge executes the defined actions for the trash items
+// permanently removed for the specified user
+func NotifyTrashPurge(user *dataprovider.User, fs *vfs.TrashFs, items []vfs.TrashItem, protocol string) {
+	for _, item := range items {
+		fsPath, err := fs.ResolvePath(item.Path)
+		if err != nil {
+			fsPath = item.Path
+		}
+		action := newActionNotification(user, operationPurge, fsPath, "", "", protocol, item.Size, nil)
+		go actionHandler.Handle(action) // nolint:errcheck
+	}
+}
+
+// expireTrashItems permanently removes the expired trash items for all the
+// users with the trash enabled
+func expireTrashItems() {
+	for offset := 0; ; offset += trashExpirationUsersPageSize {
+		users, err := dataprovider.GetUsers(trashExpirationUsersPageSize, offset, dataprovider.OrderASC)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get the users to expire the trash items: %v", err)
+			return
+		}
+		for idx := range users {
+			if users[idx].FsConfig.TrashConfig.IsEnabled() {
+				expireUserTrashItems(&users[idx])
+			}
+		}
+		if len(users) < trashExpirationUsersPageSize {
+			return
+		}
+	}
+}
+
+func expireUserTrashItems(user *dataprovider.User) {
+	fs, err := user.GetTrashFilesystem("")
+	if err != nil {
+		logger.Warn(logSender, "", "unable to expire the trash items, cannot get the filesystem for user %#v: %v",
+			user.Username, err)
+		return
+	}
+	defer fs.Close()
+
+	items, err := fs.ExpireTrash()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to expire the trash items for user %#v: %v", user.Username, err)
+	}
+	if len(items) > 0 {
+		logger.Debug(logSender, "", "%v expired trash items removed for user %#v", len(items), user.Username)
+		NotifyTrashPurge(user, fs, items, "")
+	}
+	items, err = fs.ApplyQuota()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to apply the trash quota for user %#v: %v", user.Username, err)
+	}
+	if len(items) > 0 {
+		logger.Debug(logSender, "", "%v trash items removed to apply the trash quota for user %#v", len(items),
+			user.Username)
+		NotifyTrashPurge(user, fs, items, "")
+	}
+}
@@ -2,13 +2,16 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 
 	"github.com/drakkan/sftpgo/common"
@@ -22,6 +25,7 @@ import (
 	"github.com/drakkan/sftpgo/telemetry"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/version"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/drakkan/sftpgo/webdavd"
 )
 
@@ -114,6 +118,59 @@ func Init() {
 				SafeListFile:     "",
 				BlockListFile:    "",
 			},
+			ReadCache: vfs.ReadCacheConfig{
+				Path:             "",
+				MaxSize:          0,
+				MaxFileSize:      0,
+				EnabledByDefault: false,
+			},
+			ResumableUploads: vfs.ResumableUploadsConfig{
+				StatePath: "",
+				MaxAge:    24,
+			},
+			SFTPFsPool: vfs.SFTPFsPoolConfig{
+				MaxConnectionsPerEndpoint: 0,
+				MaxSessionsPerConnection:  1,
+				KeepaliveInterval:         30,
+				IdleTimeout:               0,
+			},
+			Tiering: vfs.TieringConfig{
+				Provider:       "",
+				CheckInterval:  60,
+				LocalPath:      "",
+				Bucket:         "",
+				Region:         "",
+				AccessKey:      "",
+				AccessSecret:   kms.NewEmptySecret(),
+				Endpoint:       "",
+				StorageClass:   "",
+				KeyPrefix:      "",
+				ForcePathStyle: false,
+			},
+			Replication: vfs.ReplicationConfig{
+				Provider:       "",
+				Workers:        4,
+				MaxAttempts:    10,
+				RetryDelay:     30,
+				LocalPath:      "",
+				Bucket:         "",
+				Region:         "",
+				AccessKey:      "",
+				AccessSecret:   kms.NewEmptySecret(),
+				Endpoint:       "",
+				StorageClass:   "",
+				KeyPrefix:      "",
+				ForcePathStyle: false,
+			},
+			HealthChecks: common.HealthChecksConfig{
+				CacheTime:  30,
+				Timeout:    10,
+				MaxSamples: 5,
+			},
+			QuarantinePath:  "",
+			VersionsPath:    "",
+			TrashPath:       "",
+			UploadChecksums: []string{},
 		},
 		SFTPD: sftpd.Configuration{
 			Banner:                  defaultSFTPDBanner,
@@ -385,7 +442,11 @@ func LoadConfig(configDir, configFile string) error {
 			logger.WarnToConsole("error loading configuration file: %v", err)
 		}
 	}
-	err = viper.Unmarshal(&globalConf)
+	err = viper.Unmarshal(&globalConf, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		stringMapToSecretHookFunc(),
+	)))
 	if err != nil {
 		logger.Warn(logSender, "", "error parsing configuration file: %v", err)
 		logger.WarnToConsole("error parsing configuration file: %v", err)
@@ -562,6 +623,40 @@ func checkHTTPDBindingCompatibility() {
 	globalConf.HTTPDConfig.Bindings = append(globalConf.HTTPDConfig.Bindings, binding)
 }
 
+// setViperSecretDefaults sets the defaults for the fields of a secret, so the
+// secret can be configured using environment variables too, for example
+// SFTPGO_COMMON__TIERING__ACCESS_SECRET__STATUS and
+// SFTPGO_COMMON__TIERING__ACCESS_SECRET__PAYLOAD
+func setViperSecretDefaults(key string, secret *kms.Secret) {
+	viper.SetDefault(key+".status", secret.GetStatus())
+	viper.SetDefault(key+".payload", secret.GetPayload())
+	viper.SetDefault(key+".key", secret.GetKey())
+	viper.SetDefault(key+".additional_data", secret.GetAdditionalData())
+	viper.SetDefault(key+".mode", secret.GetMode())
+}
+
+// stringMapToSecretHookFunc returns a decode hook that converts the secrets
+// read from the configuration to kms.Secret using their JSON representation,
+// so they are validated and the secret provider is set
+func stringMapToSecretHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.Map || (t != reflect.TypeOf(kms.Secret{}) && t != reflect.TypeOf(&kms.Secret{})) {
+			return data, nil
+		}
+		// viper returns the nested maps as map[string]interface{} and they
+		// are JSON encoded as is
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		secret := kms.NewEmptySecret()
+		if err := json.Unmarshal(encoded, secret); err != nil {
+			return nil, fmt.Errorf("invalid secret: %v", err)
+		}
+		return secret, nil
+	}
+}
+
 func loadBindingsFromEnv() {
 	checkSFTPDBindingsCompatibility()
 	checkFTPDBindingCompatibility()
@@ -774,6 +869,47 @@ func setViperDefaults() {
 	viper.SetDefault("common.defender.entries_hard_limit", globalConf.Common.DefenderConfig.EntriesHardLimit)
 	viper.SetDefault("common.defender.safelist_file", globalConf.Common.DefenderConfig.SafeListFile)
 	viper.SetDefault("common.defender.blocklist_file", globalConf.Common.DefenderConfig.BlockListFile)
+	viper.SetDefault("common.read_cache.path", globalConf.Common.ReadCache.Path)
+	viper.SetDefault("common.read_cache.max_size", globalConf.Common.ReadCache.MaxSize)
+	viper.SetDefault("common.read_cache.max_file_size", globalConf.Common.ReadCache.MaxFileSize)
+	viper.SetDefault("common.read_cache.enabled_by_default", globalConf.Common.ReadCache.EnabledByDefault)
+	viper.SetDefault("common.resumable_uploads.state_path", globalConf.Common.ResumableUploads.StatePath)
+	viper.SetDefault("common.resumable_uploads.max_age", globalConf.Common.ResumableUploads.MaxAge)
+	viper.SetDefault("common.sftpfs_pool.max_connections_per_endpoint", globalConf.Common.SFTPFsPool.MaxConnectionsPerEndpoint)
+	viper.SetDefault("common.sftpfs_pool.max_sessions_per_connection", globalConf.Common.SFTPFsPool.MaxSessionsPerConnection)
+	viper.SetDefault("common.sftpfs_pool.keepalive_interval", globalConf.Common.SFTPFsPool.KeepaliveInterval)
+	viper.SetDefault("common.sftpfs_pool.idle_timeout", globalConf.Common.SFTPFsPool.IdleTimeout)
+	viper.SetDefault("common.tiering.provider", globalConf.Common.Tiering.Provider)
+	viper.SetDefault("common.tiering.check_interval", globalConf.Common.Tiering.CheckInterval)
+	viper.SetDefault("common.tiering.local_path", globalConf.Common.Tiering.LocalPath)
+	viper.SetDefault("common.tiering.bucket", globalConf.Common.Tiering.Bucket)
+	viper.SetDefault("common.tiering.region", globalConf.Common.Tiering.Region)
+	viper.SetDefault("common.tiering.access_key", globalConf.Common.Tiering.AccessKey)
+	setViperSecretDefaults("common.tiering.access_secret", globalConf.Common.Tiering.AccessSecret)
+	viper.SetDefault("common.tiering.endpoint", globalConf.Common.Tiering.Endpoint)
+	viper.SetDefault("common.tiering.storage_class", globalConf.Common.Tiering.StorageClass)
+	viper.SetDefault("common.tiering.key_prefix", globalConf.Common.Tiering.KeyPrefix)
+	viper.SetDefault("common.tiering.force_path_style", globalConf.Common.Tiering.ForcePathStyle)
+	viper.SetDefault("common.replication.provider", globalConf.Common.Replication.Provider)
+	viper.SetDefault("common.replication.workers", globalConf.Common.Replication.Workers)
+	viper.SetDefault("common.replication.max_attempts", globalConf.Common.Replication.MaxAttempts)
+	viper.SetDefault("common.replication.retry_delay", globalConf.Common.Replication.RetryDelay)
+	viper.SetDefault("common.replication.local_path", globalConf.Common.Replication.LocalPath)
+	viper.SetDefault("common.replication.bucket", globalConf.Common.Replication.Bucket)
+	viper.SetDefault("common.replication.region", globalConf.Common.Replication.Region)
+	viper.SetDefault("common.replication.access_key", globalConf.Common.Replication.AccessKey)
+	setViperSecretDefaults("common.replication.access_secret", globalConf.Common.Replication.AccessSecret)
+	viper.SetDefault("common.replication.endpoint", globalConf.Common.Replication.Endpoint)
+	viper.SetDefault("common.replication.storage_class", globalConf.Common.Replication.StorageClass)
+	viper.SetDefault("common.replication.key_prefix", globalConf.Common.Replication.KeyPrefix)
+	viper.SetDefault("common.replication.force_path_style", globalConf.Common.Replication.ForcePathStyle)
+	viper.SetDefault("common.health_checks.cache_time", globalConf.Common.HealthChecks.CacheTime)
+	viper.SetDefault("common.health_checks.timeout", globalConf.Common.HealthChecks.Timeout)
+	viper.SetDefault("common.health_checks.max_samples", globalConf.Common.HealthChecks.MaxSamples)
+	viper.SetDefault("common.quarantine_path", globalConf.Common.QuarantinePath)
+	viper.SetDefault("common.versions_path", globalConf.Common.VersionsPath)
+	viper.SetDefault("common.trash_path", globalConf.Common.TrashPath)
+	viper.SetDefault("common.upload_checksums", globalConf.Common.UploadChecksums)
 	viper.SetDefault("sftpd.max_auth_tries", globalConf.SFTPD.MaxAuthTries)
 	viper.SetDefault("sftpd.banner", globalConf.SFTPD.Banner)
 	viper.SetDefault("sftpd.host_keys", globalConf.SFTPD.HostKeys)
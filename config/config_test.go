@@ -18,6 +18,7 @@ import (
 	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpclient"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/webdavd"
@@ -765,3 +766,51 @@ func TestConfigFromEnv(t *testing.T) {
 	assert.Equal(t, "local", kmsConfig.Secrets.URL)
 	assert.Equal(t, "path", kmsConfig.Secrets.MasterKeyPath)
 }
+
+func TestStorageTargetSecrets(t *testing.T) {
+	reset()
+
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	err := config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	commonConf := config.GetCommonConfig()
+	assert.True(t, commonConf.Tiering.AccessSecret.IsEmpty())
+	assert.True(t, commonConf.Replication.AccessSecret.IsEmpty())
+	commonConf.Tiering.AccessSecret = kms.NewPlainSecret("tiering secret")
+	c := make(map[string]common.Configuration)
+	c["common"] = commonConf
+	jsonConf, err := json.Marshal(c)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(configFilePath, jsonConf, os.ModePerm)
+	assert.NoError(t, err)
+	os.Setenv("SFTPGO_COMMON__REPLICATION__ACCESS_SECRET__STATUS", "Plain")
+	os.Setenv("SFTPGO_COMMON__REPLICATION__ACCESS_SECRET__PAYLOAD", "replication secret")
+	t.Cleanup(func() {
+		os.Unsetenv("SFTPGO_COMMON__REPLICATION__ACCESS_SECRET__STATUS")
+		os.Unsetenv("SFTPGO_COMMON__REPLICATION__ACCESS_SECRET__PAYLOAD")
+	})
+	err = config.LoadConfig(configDir, confName)
+	assert.NoError(t, err)
+	commonConf = config.GetCommonConfig()
+	assert.True(t, commonConf.Tiering.AccessSecret.IsPlain())
+	assert.Equal(t, "tiering secret", commonConf.Tiering.AccessSecret.GetPayload())
+	assert.True(t, commonConf.Replication.AccessSecret.IsPlain())
+	assert.Equal(t, "replication secret", commonConf.Replication.AccessSecret.GetPayload())
+	// a plain string is not accepted
+	err = ioutil.WriteFile(configFilePath, []byte(`{"common":{"tiering":{"access_secret":"secret"}}}`), os.ModePerm)
+	assert.NoError(t, err)
+	reset()
+	err = config.LoadConfig(configDir, confName)
+	assert.Error(t, err)
+	// an invalid status is not accepted
+	err = ioutil.WriteFile(configFilePath, []byte(`{"common":{"tiering":{"access_secret":{"status":"invalid"}}}}`),
+		os.ModePerm)
+	assert.NoError(t, err)
+	reset()
+	err = config.LoadConfig(configDir, confName)
+	assert.Error(t, err)
+	err = os.Remove(configFilePath)
+	assert.NoError(t, err)
+}
@@ -3,6 +3,7 @@
 package dataprovider
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,10 +25,11 @@ const (
 var (
 	usersBucket = []byte("users")
 	//usersIDIdxBucket = []byte("users_id_idx")
-	foldersBucket   = []byte("folders")
-	adminsBucket    = []byte("admins")
-	dbVersionBucket = []byte("db_version")
-	dbVersionKey    = []byte("version")
+	foldersBucket         = []byte("folders")
+	adminsBucket          = []byte("admins")
+	replicationJobsBucket = []byte("replication_jobs")
+	dbVersionBucket       = []byte("db_version")
+	dbVersionKey          = []byte("version")
 )
 
 // BoltProvider auth provider for bolt key/value store
@@ -83,6 +85,14 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating admins bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(replicationJobsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating replication jobs bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -794,6 +804,162 @@ func (p *BoltProvider) getUsedFolderQuota(mappedPath string) (int, int64, error)
 	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
 }
 
+func (p *BoltProvider) addReplicationJob(job *ReplicationJob) error {
+	err := job.validate()
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = int64(id)
+		buf, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(getBoltReplicationJobKey(job.ID), buf)
+	})
+}
+
+func (p *BoltProvider) updateReplicationJob(job *ReplicationJob) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		key := getBoltReplicationJobKey(job.ID)
+		j := bucket.Get(key)
+		if j == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("replication job %v does not exist", job.ID)}
+		}
+		var oldJob ReplicationJob
+		err = json.Unmarshal(j, &oldJob)
+		if err != nil {
+			return err
+		}
+		oldJob.Status = job.Status
+		oldJob.Attempts = job.Attempts
+		oldJob.NextAttempt = job.NextAttempt
+		oldJob.LastError = job.LastError
+		oldJob.UpdatedAt = job.UpdatedAt
+		buf, err := json.Marshal(oldJob)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, buf)
+	})
+}
+
+func (p *BoltProvider) deleteReplicationJob(job *ReplicationJob) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Delete(getBoltReplicationJobKey(job.ID))
+	})
+}
+
+func (p *BoltProvider) getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	jobs := make([]ReplicationJob, 0, limit)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		if limit <= 0 {
+			return nil
+		}
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		itNum := 0
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var job ReplicationJob
+			err = json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			if !isReplicationJobMatching(&job, username, status) {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			jobs = append(jobs, job)
+			if len(jobs) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func (p *BoltProvider) getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error) {
+	jobs := make([]ReplicationJob, 0, limit)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		if limit <= 0 {
+			return nil
+		}
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var job ReplicationJob
+			err = json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			if job.Status != ReplicationJobStatusPending || job.NextAttempt > now {
+				continue
+			}
+			jobs = append(jobs, job)
+			if len(jobs) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func (p *BoltProvider) getReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	var summary ReplicationJobsSummary
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getReplicationJobsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var job ReplicationJob
+			err = json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			switch job.Status {
+			case ReplicationJobStatusPending:
+				summary.Pending++
+				if summary.OldestPending == 0 || job.CreatedAt < summary.OldestPending {
+					summary.OldestPending = job.CreatedAt
+				}
+			case ReplicationJobStatusFailed:
+				summary.Failed++
+			}
+		}
+		return nil
+	})
+	return summary, err
+}
+
 func (p *BoltProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -1033,6 +1199,23 @@ func getAdminBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	return bucket, err
 }
 
+func getReplicationJobsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(replicationJobsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find replication jobs bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+// getBoltReplicationJobKey returns the key for the given job ID, the big
+// endian encoding keeps the jobs sorted by ID
+func getBoltReplicationJobKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
 func getUsersBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 	bucket := tx.Bucket(usersBucket)
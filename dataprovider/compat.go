@@ -305,6 +305,8 @@ func convertFsConfigFromV4(compatFs compatFilesystemV4, username string) (Filesy
 			StorageClass:      compatFs.S3Config.StorageClass,
 			UploadPartSize:    compatFs.S3Config.UploadPartSize,
 			UploadConcurrency: compatFs.S3Config.UploadConcurrency,
+			// path-style addressing was implied by a custom endpoint
+			ForcePathStyle: compatFs.S3Config.Endpoint != "",
 		}
 		if compatFs.S3Config.AccessSecret != "" {
 			secret, err := kms.GetSecretFromCompatString(compatFs.S3Config.AccessSecret)
@@ -124,6 +124,7 @@ var (
 	sqlTableFolders         = "folders"
 	sqlTableFoldersMapping  = "folders_mapping"
 	sqlTableAdmins          = "admins"
+	sqlTableReplicationJobs = "replication_jobs"
 	sqlTableSchemaVersion   = "schema_version"
 	argon2Params            *argon2id.Params
 	lastLoginMinDelay       = 10 * time.Minute
@@ -395,6 +396,12 @@ type Provider interface {
 	getAdmins(limit int, offset int, order string) ([]Admin, error)
 	dumpAdmins() ([]Admin, error)
 	validateAdminAndPass(username, password, ip string) (Admin, error)
+	addReplicationJob(job *ReplicationJob) error
+	updateReplicationJob(job *ReplicationJob) error
+	deleteReplicationJob(job *ReplicationJob) error
+	getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error)
+	getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error)
+	getReplicationJobsSummary() (ReplicationJobsSummary, error)
 	checkAvailability() error
 	close() error
 	reloadConfig() error
@@ -498,9 +505,11 @@ func validateSQLTablesPrefix() error {
 		sqlTableFolders = config.SQLTablesPrefix + sqlTableFolders
 		sqlTableFoldersMapping = config.SQLTablesPrefix + sqlTableFoldersMapping
 		sqlTableAdmins = config.SQLTablesPrefix + sqlTableAdmins
+		sqlTableReplicationJobs = config.SQLTablesPrefix + sqlTableReplicationJobs
 		sqlTableSchemaVersion = config.SQLTablesPrefix + sqlTableSchemaVersion
-		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v admins %#v schema version %#v",
-			sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping, sqlTableAdmins, sqlTableSchemaVersion)
+		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v admins %#v "+
+			"replication jobs %#v schema version %#v", sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping,
+			sqlTableAdmins, sqlTableReplicationJobs, sqlTableSchemaVersion)
 	}
 	return nil
 }
@@ -736,11 +745,40 @@ func DeleteUser(username string) error {
 	err = provider.deleteUser(&user)
 	if err == nil {
 		RemoveCachedWebDAVUser(user.Username)
+		removeUserVersionsAndTrash(&user)
+		if user.FsConfig.Provider == MemoryFilesystemProvider {
+			// the in memory files are discarded together with the user
+			vfs.RemoveMemoryFsData(user.GetHomeDir())
+		}
 		go executeAction(operationDelete, user)
 	}
 	return err
 }
 
+// removeUserVersionsAndTrash removes the versions and the trash items of a
+// deleted user. They are stored outside the user's home dir, inside
+// directories named after the username, so a new user with the same name
+// must not find them. The errors are only logged
+func removeUserVersionsAndTrash(user *User) {
+	if !vfs.IsVersioningAvailable() && !vfs.IsTrashAvailable() {
+		return
+	}
+	fs, err := user.getProviderFilesystem("")
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get the filesystem to remove the versions and trash for the deleted user %#v: %v",
+			user.Username, err)
+		return
+	}
+	defer fs.Close()
+
+	if err := vfs.RemoveUserVersions(fs, user.Username); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove the versions for the deleted user %#v: %v", user.Username, err)
+	}
+	if err := vfs.RemoveUserTrash(fs, user.Username); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove the trash for the deleted user %#v: %v", user.Username, err)
+	}
+}
+
 // ReloadConfig reloads provider configuration.
 // Currently only implemented for memory provider, allows to reload the users
 // from the configured file, if defined
@@ -884,7 +922,8 @@ func buildUserHomeDir(user *User) {
 	if user.HomeDir == "" {
 		if config.UsersBaseDir != "" {
 			user.HomeDir = filepath.Join(config.UsersBaseDir, user.Username)
-		} else if user.FsConfig.Provider == SFTPFilesystemProvider {
+		} else if user.FsConfig.Provider == SFTPFilesystemProvider || user.FsConfig.Provider == WebDAVFilesystemProvider ||
+			user.FsConfig.Provider == FTPFilesystemProvider || user.FsConfig.Provider == MemoryFilesystemProvider {
 			user.HomeDir = filepath.Join(os.TempDir(), user.Username)
 		}
 	}
@@ -939,7 +978,7 @@ func validateFolderQuotaLimits(folder vfs.VirtualFolder) error {
 }
 
 func validateUserVirtualFolders(user *User) error {
-	if len(user.VirtualFolders) == 0 || user.FsConfig.Provider != LocalFilesystemProvider {
+	if len(user.VirtualFolders) == 0 || !user.FsConfig.IsVirtualFoldersSupported() {
 		user.VirtualFolders = []vfs.VirtualFolder{}
 		return nil
 	}
@@ -1059,12 +1098,13 @@ func validateFiltersPatternExtensions(user *User) error {
 		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
 			return &ValidationError{err: fmt.Sprintf("duplicate file patterns filter for path %#v", f.Path)}
 		}
-		if len(f.AllowedPatterns) == 0 && len(f.DeniedPatterns) == 0 {
+		if len(f.AllowedPatterns) == 0 && len(f.DeniedPatterns) == 0 && len(f.HiddenPatterns) == 0 && !f.DenyListing {
 			return &ValidationError{err: fmt.Sprintf("empty file patterns filter for path %#v", f.Path)}
 		}
 		f.Path = cleanedPath
 		allowed := make([]string, 0, len(f.AllowedPatterns))
 		denied := make([]string, 0, len(f.DeniedPatterns))
+		hidden := make([]string, 0, len(f.HiddenPatterns))
 		for _, pattern := range f.AllowedPatterns {
 			_, err := path.Match(pattern, "abc")
 			if err != nil {
@@ -1079,8 +1119,16 @@ func validateFiltersPatternExtensions(user *User) error {
 			}
 			denied = append(denied, strings.ToLower(pattern))
 		}
+		for _, pattern := range f.HiddenPatterns {
+			_, err := path.Match(pattern, "abc")
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+			}
+			hidden = append(hidden, strings.ToLower(pattern))
+		}
 		f.AllowedPatterns = allowed
 		f.DeniedPatterns = denied
+		f.HiddenPatterns = hidden
 		filters = append(filters, f)
 		filteredPaths = append(filteredPaths, cleanedPath)
 	}
@@ -1124,10 +1172,97 @@ func validateFiltersFileExtensions(user *User) error {
 	return nil
 }
 
+func validateFiltersMimeTypes(user *User) error {
+	if len(user.Filters.MimeTypes) == 0 {
+		user.Filters.MimeTypes = []MimeTypesFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []MimeTypesFilter
+	for _, f := range user.Filters.MimeTypes {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{err: fmt.Sprintf("invalid path %#v for mime types filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{err: fmt.Sprintf("duplicate mime types filter for path %#v", f.Path)}
+		}
+		if len(f.AllowedMimeTypes) == 0 && len(f.DeniedMimeTypes) == 0 {
+			return &ValidationError{err: fmt.Sprintf("empty mime types filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		allowed := make([]string, 0, len(f.AllowedMimeTypes))
+		denied := make([]string, 0, len(f.DeniedMimeTypes))
+		for _, mimeType := range f.AllowedMimeTypes {
+			if err := validateMimeTypeFilter(mimeType); err != nil {
+				return err
+			}
+			allowed = append(allowed, strings.ToLower(mimeType))
+		}
+		for _, mimeType := range f.DeniedMimeTypes {
+			if err := validateMimeTypeFilter(mimeType); err != nil {
+				return err
+			}
+			denied = append(denied, strings.ToLower(mimeType))
+		}
+		f.AllowedMimeTypes = allowed
+		f.DeniedMimeTypes = denied
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.MimeTypes = filters
+	return nil
+}
+
+func validateMimeTypeFilter(mimeType string) error {
+	if !strings.Contains(mimeType, "/") {
+		return &ValidationError{err: fmt.Sprintf("invalid mime type filter %#v", mimeType)}
+	}
+	if _, err := path.Match(mimeType, "abc/def"); err != nil {
+		return &ValidationError{err: fmt.Sprintf("invalid mime type filter %#v", mimeType)}
+	}
+	return nil
+}
+
+func validateFiltersRetention(user *User) error {
+	if len(user.Filters.Retention) == 0 {
+		user.Filters.Retention = []RetentionFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []RetentionFilter
+	for _, f := range user.Filters.Retention {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{err: fmt.Sprintf("invalid path %#v for retention filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{err: fmt.Sprintf("duplicate retention filter for path %#v", f.Path)}
+		}
+		if f.Days < 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid retention days %v for path %#v", f.Days, f.Path)}
+		}
+		if f.Days == 0 && !f.LegalHold {
+			return &ValidationError{err: fmt.Sprintf("empty retention filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.Retention = filters
+	return nil
+}
+
 func validateFileFilters(user *User) error {
 	if err := validateFiltersFileExtensions(user); err != nil {
 		return err
 	}
+	if err := validateFiltersMimeTypes(user); err != nil {
+		return err
+	}
+	if err := validateFiltersRetention(user); err != nil {
+		return err
+	}
 	return validateFiltersPatternExtensions(user)
 }
 
@@ -1226,18 +1361,22 @@ func validateFilesystemConfig(user *User) error {
 		}
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
-		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
-		return nil
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
 	} else if user.FsConfig.Provider == GCSFilesystemProvider {
 		if err := user.FsConfig.GCSConfig.Validate(user.getGCSCredentialsFilePath()); err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate GCS config: %v", err)}
 		}
 		user.FsConfig.S3Config = vfs.S3FsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
-		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
-		return nil
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
 	} else if user.FsConfig.Provider == AzureBlobFilesystemProvider {
 		if err := user.FsConfig.AzBlobConfig.Validate(); err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
@@ -1247,9 +1386,11 @@ func validateFilesystemConfig(user *User) error {
 		}
 		user.FsConfig.S3Config = vfs.S3FsConfig{}
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
-		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
-		return nil
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
 	} else if user.FsConfig.Provider == CryptedFilesystemProvider {
 		if err := user.FsConfig.CryptConfig.Validate(); err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate Crypt fs config: %v", err)}
@@ -1261,6 +1402,9 @@ func validateFilesystemConfig(user *User) error {
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
 		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
 		return nil
 	} else if user.FsConfig.Provider == SFTPFilesystemProvider {
 		if err := user.FsConfig.SFTPConfig.Validate(); err != nil {
@@ -1272,7 +1416,49 @@ func validateFilesystemConfig(user *User) error {
 		user.FsConfig.S3Config = vfs.S3FsConfig{}
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
+	} else if user.FsConfig.Provider == WebDAVFilesystemProvider {
+		if err := user.FsConfig.WebDAVConfig.Validate(); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate WebDAV fs config: %v", err)}
+		}
+		if err := user.FsConfig.WebDAVConfig.EncryptCredentials(user.Username); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt WebDAV fs credentials: %v", err)}
+		}
+		user.FsConfig.S3Config = vfs.S3FsConfig{}
+		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
+	} else if user.FsConfig.Provider == FTPFilesystemProvider {
+		if err := user.FsConfig.FTPConfig.Validate(); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate FTP fs config: %v", err)}
+		}
+		if err := user.FsConfig.FTPConfig.EncryptCredentials(user.Username); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt FTP fs credentials: %v", err)}
+		}
+		user.FsConfig.S3Config = vfs.S3FsConfig{}
+		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+		return validateEncryptionLayer(user)
+	} else if user.FsConfig.Provider == MemoryFilesystemProvider {
+		if err := user.FsConfig.MemoryConfig.Validate(); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate memory fs config: %v", err)}
+		}
+		user.FsConfig.S3Config = vfs.S3FsConfig{}
+		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
 		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+		user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
 		return nil
 	}
 	user.FsConfig.Provider = LocalFilesystemProvider
@@ -1281,6 +1467,115 @@ func validateFilesystemConfig(user *User) error {
 	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
 	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+	user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+	user.FsConfig.MemoryConfig = vfs.MemoryFsConfig{}
+	return nil
+}
+
+// validateEncryptionLayer validates the passphrase used to encrypt client-side
+// the files stored on a remote filesystem, the encryption is disabled if no
+// passphrase is set
+func validateEncryptionLayer(user *User) error {
+	if !user.FsConfig.CryptConfig.IsEnabled() {
+		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		return nil
+	}
+	if err := user.FsConfig.CryptConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate encryption config: %v", err)}
+	}
+	if err := user.FsConfig.CryptConfig.EncryptCredentials(user.Username); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt encryption passphrase: %v", err)}
+	}
+	return nil
+}
+
+func validateOverlayConfig(user *User) error {
+	if err := user.FsConfig.OverlayConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate overlay config: %v", err)}
+	}
+	if !user.FsConfig.OverlayConfig.IsEnabled() {
+		return nil
+	}
+	if len(user.VirtualFolders) > 0 {
+		return &ValidationError{err: "virtual folders are not supported together with an overlay lower path"}
+	}
+	if user.FsConfig.Provider == LocalFilesystemProvider || user.FsConfig.Provider == CryptedFilesystemProvider {
+		if isMappedDirOverlapped(user.GetHomeDir(), user.FsConfig.OverlayConfig.LowerPath) {
+			return &ValidationError{err: fmt.Sprintf("overlay lower path %#v overlaps with home dir %#v",
+				user.FsConfig.OverlayConfig.LowerPath, user.GetHomeDir())}
+		}
+	}
+	return nil
+}
+
+func validateCacheConfig(user *User) error {
+	if err := user.FsConfig.CacheConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate read cache config: %v", err)}
+	}
+	if user.FsConfig.Provider == LocalFilesystemProvider || user.FsConfig.Provider == CryptedFilesystemProvider ||
+		user.FsConfig.Provider == MemoryFilesystemProvider {
+		user.FsConfig.CacheConfig = vfs.CacheFsConfig{}
+	}
+	return nil
+}
+
+func validateCompressionConfig(user *User) error {
+	if err := user.FsConfig.CompressionConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate compression config: %v", err)}
+	}
+	if !user.FsConfig.CompressionConfig.IsEnabled() {
+		user.FsConfig.CompressionConfig = vfs.CompressionFsConfig{}
+		return nil
+	}
+	if user.FsConfig.Provider == CryptedFilesystemProvider {
+		return &ValidationError{err: "compression is not supported for the encrypted local filesystem"}
+	}
+	return nil
+}
+
+func validateVersioningConfig(user *User) error {
+	if err := user.FsConfig.VersioningConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate versioning config: %v", err)}
+	}
+	if !user.FsConfig.VersioningConfig.IsEnabled() {
+		user.FsConfig.VersioningConfig = vfs.VersioningConfig{}
+		return nil
+	}
+	if !vfs.IsVersioningAvailable() {
+		return &ValidationError{err: "versioning is not available, the versions path is not configured"}
+	}
+	return nil
+}
+
+func validateTieringConfig(user *User) error {
+	if err := user.FsConfig.TieringConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate tiering config: %v", err)}
+	}
+	if !user.FsConfig.TieringConfig.IsEnabled() {
+		user.FsConfig.TieringConfig = vfs.TieringFsConfig{}
+		return nil
+	}
+	if user.FsConfig.Provider != LocalFilesystemProvider {
+		return &ValidationError{err: "tiering is supported for the local filesystem only"}
+	}
+	return nil
+}
+
+func validateTrashConfig(user *User) error {
+	if err := user.FsConfig.TrashConfig.Validate(); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate trash config: %v", err)}
+	}
+	if !user.FsConfig.TrashConfig.IsEnabled() {
+		user.FsConfig.TrashConfig = vfs.TrashConfig{}
+		return nil
+	}
+	if !vfs.IsTrashAvailable() {
+		return &ValidationError{err: "the trash is not available, the trash path is not configured"}
+	}
+	if user.FsConfig.OverlayConfig.IsEnabled() {
+		return &ValidationError{err: "the trash is not supported if an overlay lower directory is defined"}
+	}
 	return nil
 }
 
@@ -1338,6 +1633,24 @@ func validateUser(user *User) error {
 	if err := validateUserVirtualFolders(user); err != nil {
 		return err
 	}
+	if err := validateOverlayConfig(user); err != nil {
+		return err
+	}
+	if err := validateCacheConfig(user); err != nil {
+		return err
+	}
+	if err := validateCompressionConfig(user); err != nil {
+		return err
+	}
+	if err := validateVersioningConfig(user); err != nil {
+		return err
+	}
+	if err := validateTrashConfig(user); err != nil {
+		return err
+	}
+	if err := validateTieringConfig(user); err != nil {
+		return err
+	}
 	if user.Status < 0 || user.Status > 1 {
 		return &ValidationError{err: fmt.Sprintf("invalid user status: %v", user.Status)}
 	}
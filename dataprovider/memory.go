@@ -36,6 +36,10 @@ type memoryProviderHandle struct {
 	admins map[string]Admin
 	// slice with ordered admins
 	adminsUsernames []string
+	// replication jobs ordered by ID
+	replicationJobs []ReplicationJob
+	// ID for the last added replication job
+	lastReplicationJobID int64
 }
 
 // MemoryProvider auth provider for a memory store
@@ -61,6 +65,7 @@ func initializeMemoryProvider(basePath string) {
 			vfoldersPaths:   []string{},
 			admins:          make(map[string]Admin),
 			adminsUsernames: []string{},
+			replicationJobs: []ReplicationJob{},
 			configFile:      configFile,
 		},
 	}
@@ -725,6 +730,140 @@ func (p *MemoryProvider) getNextFolderID() int64 {
 	return nextID
 }
 
+func (p *MemoryProvider) addReplicationJob(job *ReplicationJob) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := job.validate()
+	if err != nil {
+		return err
+	}
+	p.dbHandle.lastReplicationJobID++
+	job.ID = p.dbHandle.lastReplicationJobID
+	p.dbHandle.replicationJobs = append(p.dbHandle.replicationJobs, *job)
+	return nil
+}
+
+func (p *MemoryProvider) updateReplicationJob(job *ReplicationJob) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	idx := p.getReplicationJobIndex(job.ID)
+	if idx < 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("replication job %v does not exist", job.ID)}
+	}
+	j := &p.dbHandle.replicationJobs[idx]
+	j.Status = job.Status
+	j.Attempts = job.Attempts
+	j.NextAttempt = job.NextAttempt
+	j.LastError = job.LastError
+	j.UpdatedAt = job.UpdatedAt
+	return nil
+}
+
+func (p *MemoryProvider) deleteReplicationJob(job *ReplicationJob) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if idx := p.getReplicationJobIndex(job.ID); idx >= 0 {
+		p.dbHandle.replicationJobs = append(p.dbHandle.replicationJobs[:idx], p.dbHandle.replicationJobs[idx+1:]...)
+	}
+	return nil
+}
+
+func (p *MemoryProvider) getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	jobs := make([]ReplicationJob, 0, limit)
+
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+
+	if p.dbHandle.isClosed {
+		return jobs, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return jobs, nil
+	}
+	itNum := 0
+	for idx := range p.dbHandle.replicationJobs {
+		job := &p.dbHandle.replicationJobs[idx]
+		if !isReplicationJobMatching(job, username, status) {
+			continue
+		}
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		jobs = append(jobs, *job)
+		if len(jobs) >= limit {
+			break
+		}
+	}
+	return jobs, nil
+}
+
+func (p *MemoryProvider) getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error) {
+	jobs := make([]ReplicationJob, 0, limit)
+
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+
+	if p.dbHandle.isClosed {
+		return jobs, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return jobs, nil
+	}
+	for _, job := range p.dbHandle.replicationJobs {
+		if job.Status != ReplicationJobStatusPending || job.NextAttempt > now {
+			continue
+		}
+		jobs = append(jobs, job)
+		if len(jobs) >= limit {
+			break
+		}
+	}
+	return jobs, nil
+}
+
+func (p *MemoryProvider) getReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	var summary ReplicationJobsSummary
+
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+
+	if p.dbHandle.isClosed {
+		return summary, errMemoryProviderClosed
+	}
+	for _, job := range p.dbHandle.replicationJobs {
+		switch job.Status {
+		case ReplicationJobStatusPending:
+			summary.Pending++
+			if summary.OldestPending == 0 || job.CreatedAt < summary.OldestPending {
+				summary.OldestPending = job.CreatedAt
+			}
+		case ReplicationJobStatusFailed:
+			summary.Failed++
+		}
+	}
+	return summary, nil
+}
+
+func (p *MemoryProvider) getReplicationJobIndex(id int64) int {
+	idx := sort.Search(len(p.dbHandle.replicationJobs), func(i int) bool {
+		return p.dbHandle.replicationJobs[i].ID >= id
+	})
+	if idx < len(p.dbHandle.replicationJobs) && p.dbHandle.replicationJobs[idx].ID == id {
+		return idx
+	}
+	return -1
+}
+
 func (p *MemoryProvider) getNextAdminID() int64 {
 	nextID := int64(1)
 	for _, a := range p.dbHandle.admins {
@@ -44,6 +44,13 @@ const (
 		"`password` varchar(255) NOT NULL, `email` varchar(255) NULL, `status` integer NOT NULL, `permissions` longtext NOT NULL, " +
 		"`filters` longtext NULL, `additional_info` longtext NULL);"
 	mysqlV7DownSQL = "DROP TABLE `{{admins}}` CASCADE;"
+	mysqlV8SQL     = "CREATE TABLE `{{replication_jobs}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`username` varchar(255) NOT NULL, `action` varchar(32) NOT NULL, `path` longtext NOT NULL, `target_path` longtext NULL, " +
+		"`status` integer NOT NULL, `attempts` integer NOT NULL, `next_attempt` bigint NOT NULL, `last_error` longtext NULL, " +
+		"`created_at` bigint NOT NULL, `updated_at` bigint NOT NULL);" +
+		"CREATE INDEX `replication_jobs_status_next_attempt_idx` ON `{{replication_jobs}}` (`status`, `next_attempt`);" +
+		"CREATE INDEX `replication_jobs_username_idx` ON `{{replication_jobs}}` (`username`);"
+	mysqlV8DownSQL = "DROP TABLE `{{replication_jobs}}` CASCADE;"
 )
 
 // MySQLProvider auth provider for MySQL/MariaDB database
@@ -197,6 +204,30 @@ func (p *MySQLProvider) validateAdminAndPass(username, password, ip string) (Adm
 	return sqlCommonValidateAdminAndPass(username, password, ip, p.dbHandle)
 }
 
+func (p *MySQLProvider) addReplicationJob(job *ReplicationJob) error {
+	return sqlCommonAddReplicationJob(job, p.dbHandle)
+}
+
+func (p *MySQLProvider) updateReplicationJob(job *ReplicationJob) error {
+	return sqlCommonUpdateReplicationJob(job, p.dbHandle)
+}
+
+func (p *MySQLProvider) deleteReplicationJob(job *ReplicationJob) error {
+	return sqlCommonDeleteReplicationJob(job, p.dbHandle)
+}
+
+func (p *MySQLProvider) getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	return sqlCommonGetReplicationJobs(username, status, limit, offset, p.dbHandle)
+}
+
+func (p *MySQLProvider) getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error) {
+	return sqlCommonGetDueReplicationJobs(limit, now, p.dbHandle)
+}
+
+func (p *MySQLProvider) getReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	return sqlCommonGetReplicationJobsSummary(p.dbHandle)
+}
+
 func (p *MySQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -256,6 +287,8 @@ func (p *MySQLProvider) migrateDatabase() error {
 		return updateMySQLDatabaseFromV5(p.dbHandle)
 	case 6:
 		return updateMySQLDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updateMySQLDatabaseFromV7(p.dbHandle)
 	default:
 		if dbVersion.Version > sqlDatabaseVersion {
 			providerLog(logger.LevelWarn, "database version %v is newer than the supported: %v", dbVersion.Version,
@@ -277,6 +310,20 @@ func (p *MySQLProvider) revertDatabase(targetVersion int) error {
 		return fmt.Errorf("current version match target version, nothing to do")
 	}
 	switch dbVersion.Version {
+	case 8:
+		err = downgradeMySQLDatabaseFrom8To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradeMySQLDatabaseFrom7To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradeMySQLDatabaseFrom6To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return downgradeMySQLDatabaseFrom5To4(p.dbHandle)
 	case 7:
 		err = downgradeMySQLDatabaseFrom7To6(p.dbHandle)
 		if err != nil {
@@ -341,7 +388,15 @@ func updateMySQLDatabaseFromV5(dbHandle *sql.DB) error {
 }
 
 func updateMySQLDatabaseFromV6(dbHandle *sql.DB) error {
-	return updateMySQLDatabaseFrom6To7(dbHandle)
+	err := updateMySQLDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV7(dbHandle)
+}
+
+func updateMySQLDatabaseFromV7(dbHandle *sql.DB) error {
+	return updateMySQLDatabaseFrom7To8(dbHandle)
 }
 
 func updateMySQLDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -380,6 +435,20 @@ func updateMySQLDatabaseFrom6To7(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
 }
 
+func updateMySQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(mysqlV8SQL, "{{replication_jobs}}", sqlTableReplicationJobs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func downgradeMySQLDatabaseFrom8To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 8 -> 7")
+	providerLog(logger.LevelInfo, "downgrading database version: 8 -> 7")
+	sql := strings.Replace(mysqlV8DownSQL, "{{replication_jobs}}", sqlTableReplicationJobs, 1)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
+}
+
 func downgradeMySQLDatabaseFrom7To6(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database version: 7 -> 6")
 	providerLog(logger.LevelInfo, "downgrading database version: 7 -> 6")
@@ -45,6 +45,14 @@ CREATE INDEX "folders_mapping_user_id_idx" ON "{{folders_mapping}}" ("user_id");
 "filters" text NULL, "additional_info" text NULL);
 `
 	pgsqlV7DownSQL = `DROP TABLE "{{admins}}" CASCADE;`
+	pgsqlV8SQL     = `CREATE TABLE "{{replication_jobs}}" ("id" serial NOT NULL PRIMARY KEY, "username" varchar(255) NOT NULL,
+"action" varchar(32) NOT NULL, "path" text NOT NULL, "target_path" text NULL, "status" integer NOT NULL,
+"attempts" integer NOT NULL, "next_attempt" bigint NOT NULL, "last_error" text NULL, "created_at" bigint NOT NULL,
+"updated_at" bigint NOT NULL);
+CREATE INDEX "replication_jobs_status_next_attempt_idx" ON "{{replication_jobs}}" ("status", "next_attempt");
+CREATE INDEX "replication_jobs_username_idx" ON "{{replication_jobs}}" ("username");
+`
+	pgsqlV8DownSQL = `DROP TABLE "{{replication_jobs}}" CASCADE;`
 )
 
 // PGSQLProvider auth provider for PostgreSQL database
@@ -199,6 +207,30 @@ func (p *PGSQLProvider) validateAdminAndPass(username, password, ip string) (Adm
 	return sqlCommonValidateAdminAndPass(username, password, ip, p.dbHandle)
 }
 
+func (p *PGSQLProvider) addReplicationJob(job *ReplicationJob) error {
+	return sqlCommonAddReplicationJob(job, p.dbHandle)
+}
+
+func (p *PGSQLProvider) updateReplicationJob(job *ReplicationJob) error {
+	return sqlCommonUpdateReplicationJob(job, p.dbHandle)
+}
+
+func (p *PGSQLProvider) deleteReplicationJob(job *ReplicationJob) error {
+	return sqlCommonDeleteReplicationJob(job, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	return sqlCommonGetReplicationJobs(username, status, limit, offset, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error) {
+	return sqlCommonGetDueReplicationJobs(limit, now, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	return sqlCommonGetReplicationJobsSummary(p.dbHandle)
+}
+
 func (p *PGSQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -258,6 +290,8 @@ func (p *PGSQLProvider) migrateDatabase() error {
 		return updatePGSQLDatabaseFromV5(p.dbHandle)
 	case 6:
 		return updatePGSQLDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updatePGSQLDatabaseFromV7(p.dbHandle)
 	default:
 		if dbVersion.Version > sqlDatabaseVersion {
 			providerLog(logger.LevelWarn, "database version %v is newer than the supported: %v", dbVersion.Version,
@@ -279,6 +313,20 @@ func (p *PGSQLProvider) revertDatabase(targetVersion int) error {
 		return fmt.Errorf("current version match target version, nothing to do")
 	}
 	switch dbVersion.Version {
+	case 8:
+		err = downgradePGSQLDatabaseFrom8To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradePGSQLDatabaseFrom7To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradePGSQLDatabaseFrom6To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return downgradePGSQLDatabaseFrom5To4(p.dbHandle)
 	case 7:
 		err = downgradePGSQLDatabaseFrom7To6(p.dbHandle)
 		if err != nil {
@@ -343,7 +391,15 @@ func updatePGSQLDatabaseFromV5(dbHandle *sql.DB) error {
 }
 
 func updatePGSQLDatabaseFromV6(dbHandle *sql.DB) error {
-	return updatePGSQLDatabaseFrom6To7(dbHandle)
+	err := updatePGSQLDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV7(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV7(dbHandle *sql.DB) error {
+	return updatePGSQLDatabaseFrom7To8(dbHandle)
 }
 
 func updatePGSQLDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -382,6 +438,20 @@ func updatePGSQLDatabaseFrom6To7(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
 }
 
+func updatePGSQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(pgsqlV8SQL, "{{replication_jobs}}", sqlTableReplicationJobs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func downgradePGSQLDatabaseFrom8To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 8 -> 7")
+	providerLog(logger.LevelInfo, "downgrading database version: 8 -> 7")
+	sql := strings.Replace(pgsqlV8DownSQL, "{{replication_jobs}}", sqlTableReplicationJobs, 1)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
+}
+
 func downgradePGSQLDatabaseFrom7To6(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database version: 7 -> 6")
 	providerLog(logger.LevelInfo, "downgrading database version: 7 -> 6")
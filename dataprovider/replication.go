@@ -0,0 +1,142 @@
+package dataprovider
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported replication actions
+const (
+	// the file or directory at Path was created or modified
+	ReplicationActionUpload = "upload"
+	// Path was renamed to TargetPath
+	ReplicationActionRename = "rename"
+	// Path was deleted
+	ReplicationActionDelete = "delete"
+	// the whole user's storage must be compared with the replica
+	ReplicationActionResync = "resync"
+)
+
+// Replication job status
+const (
+	// the job is waiting to be processed, for the first time or for a retry
+	ReplicationJobStatusPending = 1
+	// the maximum number of attempts was reached
+	ReplicationJobStatusFailed = 2
+)
+
+var validReplicationActions = []string{ReplicationActionUpload, ReplicationActionRename, ReplicationActionDelete,
+	ReplicationActionResync}
+
+// ReplicationJob defines a change to propagate to the replication target
+type ReplicationJob struct {
+	// Database unique identifier, the jobs are processed in ID order
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Action   string `json:"action"`
+	// virtual path for the changed file or directory
+	Path string `json:"path"`
+	// virtual target path for renames
+	TargetPath string `json:"target_path,omitempty"`
+	Status     int    `json:"status"`
+	Attempts   int    `json:"attempts"`
+	// next attempt as unix timestamp in milliseconds
+	NextAttempt int64 `json:"next_attempt"`
+	// error for the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// creation and last update time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func (j *ReplicationJob) validate() error {
+	if j.Username == "" {
+		return &ValidationError{err: "username is mandatory"}
+	}
+	if !utils.IsStringInSlice(j.Action, validReplicationActions) {
+		return &ValidationError{err: fmt.Sprintf("invalid replication action: %#v", j.Action)}
+	}
+	if j.Action == ReplicationActionResync {
+		j.Path = "/"
+	}
+	if !path.IsAbs(j.Path) {
+		return &ValidationError{err: fmt.Sprintf("invalid replication path: %#v", j.Path)}
+	}
+	j.Path = path.Clean(j.Path)
+	if j.Action == ReplicationActionRename {
+		if !path.IsAbs(j.TargetPath) {
+			return &ValidationError{err: fmt.Sprintf("invalid replication target path: %#v", j.TargetPath)}
+		}
+		j.TargetPath = path.Clean(j.TargetPath)
+	} else {
+		j.TargetPath = ""
+	}
+	if j.Status != ReplicationJobStatusPending && j.Status != ReplicationJobStatusFailed {
+		return &ValidationError{err: fmt.Sprintf("invalid replication job status: %v", j.Status)}
+	}
+	return nil
+}
+
+// ReplicationJobsSummary defines the number of queued replication jobs
+type ReplicationJobsSummary struct {
+	Pending int `json:"pending"`
+	Failed  int `json:"failed"`
+	// creation time for the oldest pending job as unix timestamp in
+	// milliseconds, 0 if there are no pending jobs
+	OldestPending int64 `json:"oldest_pending"`
+}
+
+// AddReplicationJob adds a new pending job to the replication queue
+func AddReplicationJob(username, action, virtualPath, virtualTargetPath string) error {
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	job := &ReplicationJob{
+		Username:    username,
+		Action:      action,
+		Path:        virtualPath,
+		TargetPath:  virtualTargetPath,
+		Status:      ReplicationJobStatusPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	return provider.addReplicationJob(job)
+}
+
+// UpdateReplicationJob updates the status, the attempts and the last error
+// for an existing replication job
+func UpdateReplicationJob(job *ReplicationJob) error {
+	job.UpdatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	return provider.updateReplicationJob(job)
+}
+
+// DeleteReplicationJob removes a replication job from the queue
+func DeleteReplicationJob(job *ReplicationJob) error {
+	return provider.deleteReplicationJob(job)
+}
+
+// GetReplicationJobs returns the replication jobs, in ID order, for the given
+// username and status. Empty username and 0 status mean any
+func GetReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	return provider.getReplicationJobs(username, status, limit, offset)
+}
+
+// GetDueReplicationJobs returns, in ID order, the pending jobs whose next
+// attempt time is already passed
+func GetDueReplicationJobs(limit int) ([]ReplicationJob, error) {
+	return provider.getDueReplicationJobs(limit, utils.GetTimeAsMsSinceEpoch(time.Now()))
+}
+
+// GetReplicationJobsSummary returns the number of pending and failed jobs
+func GetReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	return provider.getReplicationJobsSummary()
+}
+
+func isReplicationJobMatching(job *ReplicationJob, username string, status int) bool {
+	if username != "" && job.Username != username {
+		return false
+	}
+	return status == 0 || job.Status == status
+}
@@ -14,7 +14,7 @@ import (
 )
 
 const (
-	sqlDatabaseVersion     = 7
+	sqlDatabaseVersion     = 8
 	initialDBVersionSQL    = "INSERT INTO {{schema_version}} (version) VALUES (1);"
 	defaultSQLQueryTimeout = 10 * time.Second
 	longSQLQueryTimeout    = 60 * time.Second
@@ -193,6 +193,137 @@ func sqlCommonDumpAdmins(dbHandle sqlQuerier) ([]Admin, error) {
 	return admins, rows.Err()
 }
 
+func sqlCommonAddReplicationJob(job *ReplicationJob, dbHandle *sql.DB) error {
+	err := job.validate()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getAddReplicationJobQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, job.Username, job.Action, job.Path, job.TargetPath, job.Status, job.Attempts,
+		job.NextAttempt, job.LastError, job.CreatedAt, job.UpdatedAt)
+	return err
+}
+
+func sqlCommonUpdateReplicationJob(job *ReplicationJob, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateReplicationJobQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, job.Status, job.Attempts, job.NextAttempt, job.LastError, job.UpdatedAt, job.ID)
+	return err
+}
+
+func sqlCommonDeleteReplicationJob(job *ReplicationJob, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeleteReplicationJobQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, job.ID)
+	return err
+}
+
+func sqlCommonGetReplicationJobs(username string, status, limit, offset int, dbHandle sqlQuerier) ([]ReplicationJob, error) {
+	var args []interface{}
+	if username != "" {
+		args = append(args, username)
+	}
+	if status != 0 {
+		args = append(args, status)
+	}
+	args = append(args, limit, offset)
+	return sqlCommonQueryReplicationJobs(getReplicationJobsQuery(username, status), args, limit, dbHandle)
+}
+
+func sqlCommonGetDueReplicationJobs(limit int, now int64, dbHandle sqlQuerier) ([]ReplicationJob, error) {
+	return sqlCommonQueryReplicationJobs(getDueReplicationJobsQuery(),
+		[]interface{}{ReplicationJobStatusPending, now, limit}, limit, dbHandle)
+}
+
+func sqlCommonQueryReplicationJobs(q string, args []interface{}, limit int, dbHandle sqlQuerier) ([]ReplicationJob, error) {
+	jobs := make([]ReplicationJob, 0, limit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job, err := getReplicationJobFromDbRow(rows)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func sqlCommonGetReplicationJobsSummary(dbHandle sqlQuerier) (ReplicationJobsSummary, error) {
+	var summary ReplicationJobsSummary
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getReplicationJobsSummaryQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return summary, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return summary, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status, count int
+		var oldest int64
+		if err := rows.Scan(&status, &count, &oldest); err != nil {
+			return summary, err
+		}
+		switch status {
+		case ReplicationJobStatusPending:
+			summary.Pending = count
+			summary.OldestPending = oldest
+		case ReplicationJobStatusFailed:
+			summary.Failed = count
+		}
+	}
+
+	return summary, rows.Err()
+}
+
 func sqlCommonGetUserByUsername(username string, dbHandle sqlQuerier) (User, error) {
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
@@ -552,6 +683,24 @@ func getAdminFromDbRow(row sqlScanner) (Admin, error) {
 	return admin, err
 }
 
+func getReplicationJobFromDbRow(row sqlScanner) (ReplicationJob, error) {
+	var job ReplicationJob
+	var targetPath, lastError sql.NullString
+
+	err := row.Scan(&job.ID, &job.Username, &job.Action, &job.Path, &targetPath, &job.Status, &job.Attempts,
+		&job.NextAttempt, &lastError, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return job, err
+	}
+	if targetPath.Valid {
+		job.TargetPath = targetPath.String
+	}
+	if lastError.Valid {
+		job.LastError = lastError.String
+	}
+	return job, nil
+}
+
 func getUserFromDbRow(row sqlScanner) (User, error) {
 	var user User
 	var permissions sql.NullString
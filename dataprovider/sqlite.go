@@ -82,6 +82,13 @@ ALTER TABLE "new__users" RENAME TO "{{users}}";
 "password" varchar(255) NOT NULL, "email" varchar(255) NULL, "status" integer NOT NULL, "permissions" text NOT NULL, "filters" text NULL,
 "additional_info" text NULL);`
 	sqliteV7DownSQL = `DROP TABLE "{{admins}}";`
+	sqliteV8SQL     = `CREATE TABLE "{{replication_jobs}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"username" varchar(255) NOT NULL, "action" varchar(32) NOT NULL, "path" text NOT NULL, "target_path" text NULL,
+"status" integer NOT NULL, "attempts" integer NOT NULL, "next_attempt" bigint NOT NULL, "last_error" text NULL,
+"created_at" bigint NOT NULL, "updated_at" bigint NOT NULL);
+CREATE INDEX "replication_jobs_status_next_attempt_idx" ON "{{replication_jobs}}" ("status", "next_attempt");
+CREATE INDEX "replication_jobs_username_idx" ON "{{replication_jobs}}" ("username");`
+	sqliteV8DownSQL = `DROP TABLE "{{replication_jobs}}";`
 )
 
 // SQLiteProvider auth provider for SQLite database
@@ -227,6 +234,30 @@ func (p *SQLiteProvider) validateAdminAndPass(username, password, ip string) (Ad
 	return sqlCommonValidateAdminAndPass(username, password, ip, p.dbHandle)
 }
 
+func (p *SQLiteProvider) addReplicationJob(job *ReplicationJob) error {
+	return sqlCommonAddReplicationJob(job, p.dbHandle)
+}
+
+func (p *SQLiteProvider) updateReplicationJob(job *ReplicationJob) error {
+	return sqlCommonUpdateReplicationJob(job, p.dbHandle)
+}
+
+func (p *SQLiteProvider) deleteReplicationJob(job *ReplicationJob) error {
+	return sqlCommonDeleteReplicationJob(job, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getReplicationJobs(username string, status, limit, offset int) ([]ReplicationJob, error) {
+	return sqlCommonGetReplicationJobs(username, status, limit, offset, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getDueReplicationJobs(limit int, now int64) ([]ReplicationJob, error) {
+	return sqlCommonGetDueReplicationJobs(limit, now, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getReplicationJobsSummary() (ReplicationJobsSummary, error) {
+	return sqlCommonGetReplicationJobsSummary(p.dbHandle)
+}
+
 func (p *SQLiteProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -286,6 +317,8 @@ func (p *SQLiteProvider) migrateDatabase() error {
 		return updateSQLiteDatabaseFromV5(p.dbHandle)
 	case 6:
 		return updateSQLiteDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updateSQLiteDatabaseFromV7(p.dbHandle)
 	default:
 		if dbVersion.Version > sqlDatabaseVersion {
 			providerLog(logger.LevelWarn, "database version %v is newer than the supported: %v", dbVersion.Version,
@@ -307,6 +340,20 @@ func (p *SQLiteProvider) revertDatabase(targetVersion int) error {
 		return fmt.Errorf("current version match target version, nothing to do")
 	}
 	switch dbVersion.Version {
+	case 8:
+		err = downgradeSQLiteDatabaseFrom8To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradeSQLiteDatabaseFrom7To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = downgradeSQLiteDatabaseFrom6To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return downgradeSQLiteDatabaseFrom5To4(p.dbHandle)
 	case 7:
 		err = downgradeSQLiteDatabaseFrom7To6(p.dbHandle)
 		if err != nil {
@@ -371,7 +418,15 @@ func updateSQLiteDatabaseFromV5(dbHandle *sql.DB) error {
 }
 
 func updateSQLiteDatabaseFromV6(dbHandle *sql.DB) error {
-	return updateSQLiteDatabaseFrom6To7(dbHandle)
+	err := updateSQLiteDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV7(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV7(dbHandle *sql.DB) error {
+	return updateSQLiteDatabaseFrom7To8(dbHandle)
 }
 
 func updateSQLiteDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -410,6 +465,20 @@ func updateSQLiteDatabaseFrom6To7(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
 }
 
+func updateSQLiteDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(sqliteV8SQL, "{{replication_jobs}}", sqlTableReplicationJobs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func downgradeSQLiteDatabaseFrom8To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 8 -> 7")
+	providerLog(logger.LevelInfo, "downgrading database version: 8 -> 7")
+	sql := strings.Replace(sqliteV8DownSQL, "{{replication_jobs}}", sqlTableReplicationJobs, 1)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 7)
+}
+
 func downgradeSQLiteDatabaseFrom7To6(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database version: 7 -> 6")
 	providerLog(logger.LevelInfo, "downgrading database version: 7 -> 6")
@@ -11,8 +11,10 @@ import (
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
 		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem,additional_info"
-	selectFolderFields = "id,path,used_quota_size,used_quota_files,last_quota_update"
-	selectAdminFields  = "id,username,password,status,email,permissions,filters,additional_info"
+	selectFolderFields         = "id,path,used_quota_size,used_quota_files,last_quota_update"
+	selectAdminFields          = "id,username,password,status,email,permissions,filters,additional_info"
+	selectReplicationJobFields = "id,username,action,path,target_path,status,attempts,next_attempt,last_error," +
+		"created_at,updated_at"
 )
 
 func getSQLPlaceholders() []string {
@@ -56,6 +58,48 @@ func getDeleteAdminQuery() string {
 	return fmt.Sprintf(`DELETE FROM %v WHERE username = %v`, sqlTableAdmins, sqlPlaceholders[0])
 }
 
+func getAddReplicationJobQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (username,action,path,target_path,status,attempts,next_attempt,last_error,
+		created_at,updated_at) VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v)`, sqlTableReplicationJobs, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5],
+		sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9])
+}
+
+func getUpdateReplicationJobQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET status=%v,attempts=%v,next_attempt=%v,last_error=%v,updated_at=%v WHERE id = %v`,
+		sqlTableReplicationJobs, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getDeleteReplicationJobQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlTableReplicationJobs, sqlPlaceholders[0])
+}
+
+func getReplicationJobsQuery(username string, status int) string {
+	var conditions []string
+	if username != "" {
+		conditions = append(conditions, fmt.Sprintf("username = %v", sqlPlaceholders[len(conditions)]))
+	}
+	if status != 0 {
+		conditions = append(conditions, fmt.Sprintf("status = %v", sqlPlaceholders[len(conditions)]))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v %v ORDER BY id ASC LIMIT %v OFFSET %v`, selectReplicationJobFields,
+		sqlTableReplicationJobs, where, sqlPlaceholders[len(conditions)], sqlPlaceholders[len(conditions)+1])
+}
+
+func getDueReplicationJobsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE status = %v AND next_attempt <= %v ORDER BY id ASC LIMIT %v`,
+		selectReplicationJobFields, sqlTableReplicationJobs, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getReplicationJobsSummaryQuery() string {
+	return fmt.Sprintf(`SELECT status,COUNT(*),MIN(created_at) FROM %v GROUP BY status`, sqlTableReplicationJobs)
+}
+
 func getUserByUsernameQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v`, selectUserFields, sqlTableUsers, sqlPlaceholders[0])
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -104,7 +105,8 @@ type ExtensionsFilter struct {
 // PatternsFilter defines filters based on shell like patterns.
 // These restrictions do not apply to files listing for performance reasons, so
 // a denied file cannot be downloaded/overwritten/renamed but will still be
-// in the list of files.
+// in the list of files. Use hidden patterns to remove files from directory
+// listings.
 // System commands such as Git and rsync interacts with the filesystem directly
 // and they are not aware about these restrictions so they are not allowed
 // inside paths with extensions filters
@@ -120,6 +122,96 @@ type PatternsFilter struct {
 	// files with these, case insensitive, patterns are not allowed.
 	// Denied file patterns are evaluated before the allowed ones
 	DeniedPatterns []string `json:"denied_patterns,omitempty"`
+	// files with these, case insensitive, patterns are not included in
+	// directory listings but they can still be accessed using their exact name,
+	// if not denied by other restrictions
+	HiddenPatterns []string `json:"hidden_patterns,omitempty"`
+	// if true directory listings are denied while files can still be uploaded
+	// and accessed using their exact name. Useful for drop box like folders
+	DenyListing bool `json:"deny_listing,omitempty"`
+}
+
+// IsHidden returns true if the specified file name matches a hidden pattern
+func (p *PatternsFilter) IsHidden(name string) bool {
+	toMatch := strings.ToLower(name)
+	for _, hidden := range p.HiddenPatterns {
+		matched, err := path.Match(hidden, toMatch)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MimeTypesFilter defines filters based on the content type detected inspecting
+// the first bytes of the uploaded files, so they cannot be bypassed renaming a file.
+// The content type is checked when the upload ends, a disallowed file is removed
+// or moved to the quarantine directory, if configured.
+// Downloads and files listing are not affected
+type MimeTypesFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too.
+	// For example if filters are defined for the paths "/" and "/sub" then the
+	// filters for "/" are applied for any file outside the "/sub" directory
+	Path string `json:"path"`
+	// files with these, case insensitive, content types are allowed.
+	// Shell like patterns are supported, for example "image/*"
+	AllowedMimeTypes []string `json:"allowed_mime_types,omitempty"`
+	// files with these, case insensitive, content types are not allowed.
+	// Denied content types are evaluated before the allowed ones
+	DeniedMimeTypes []string `json:"denied_mime_types,omitempty"`
+}
+
+// IsAllowed returns true if the specified content type is allowed by this filter
+func (f *MimeTypesFilter) IsAllowed(mimeType string) bool {
+	toMatch := strings.ToLower(mimeType)
+	if idx := strings.Index(toMatch, ";"); idx >= 0 {
+		toMatch = strings.TrimSpace(toMatch[:idx])
+	}
+	for _, denied := range f.DeniedMimeTypes {
+		matched, err := path.Match(denied, toMatch)
+		if err != nil || matched {
+			return false
+		}
+	}
+	for _, allowed := range f.AllowedMimeTypes {
+		matched, err := path.Match(allowed, toMatch)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return len(f.AllowedMimeTypes) == 0
+}
+
+// RetentionFilter defines a retention lock for the files inside a virtual path.
+// The locked files cannot be overwritten, truncated, renamed, removed or have
+// their attributes changed
+type RetentionFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter applies
+	// to the sub directories too.
+	// For example if filters are defined for the paths "/" and "/sub" then the
+	// filters for "/" are applied for any file outside the "/sub" directory
+	Path string `json:"path"`
+	// Retention period in days. The files are locked until this period,
+	// starting from their last modification, expires
+	Days int `json:"days"`
+	// If true the files are locked, regardless of the retention period, until
+	// the legal hold is removed. It can only be changed using the REST API
+	LegalHold bool `json:"legal_hold,omitempty"`
+}
+
+// GetRetainUntil returns the time until a file with the specified
+// modification time is retained, the legal hold is not considered
+func (f *RetentionFilter) GetRetainUntil(modTime time.Time) time.Time {
+	return modTime.Add(time.Duration(f.Days) * 24 * time.Hour)
+}
+
+// IsLocked returns true if a file with the specified modification time is locked
+func (f *RetentionFilter) IsLocked(modTime time.Time) bool {
+	if f.LegalHold {
+		return true
+	}
+	return time.Now().Before(f.GetRetainUntil(modTime))
 }
 
 // UserFilters defines additional restrictions for a user
@@ -142,6 +234,10 @@ type UserFilters struct {
 	FileExtensions []ExtensionsFilter `json:"file_extensions,omitempty"`
 	// filter based on shell patterns
 	FilePatterns []PatternsFilter `json:"file_patterns,omitempty"`
+	// filters based on the detected content type of the uploaded files
+	MimeTypes []MimeTypesFilter `json:"mime_types,omitempty"`
+	// retention locks for the uploaded files
+	Retention []RetentionFilter `json:"retention,omitempty"`
 	// max size allowed for a single upload, 0 means unlimited
 	MaxUploadFileSize int64 `json:"max_upload_file_size,omitempty"`
 }
@@ -157,6 +253,9 @@ const (
 	AzureBlobFilesystemProvider                           // Azure Blob Storage
 	CryptedFilesystemProvider                             // Local encrypted
 	SFTPFilesystemProvider                                // SFTP
+	WebDAVFilesystemProvider                              // WebDAV
+	FTPFilesystemProvider                                 // FTP
+	MemoryFilesystemProvider                              // In memory
 )
 
 // Filesystem defines cloud storage filesystem details
@@ -167,6 +266,29 @@ type Filesystem struct {
 	AzBlobConfig vfs.AzBlobFsConfig `json:"azblobconfig,omitempty"`
 	CryptConfig  vfs.CryptFsConfig  `json:"cryptconfig,omitempty"`
 	SFTPConfig   vfs.SFTPFsConfig   `json:"sftpconfig,omitempty"`
+	WebDAVConfig vfs.WebDAVFsConfig `json:"webdavconfig,omitempty"`
+	FTPConfig    vfs.FTPFsConfig    `json:"ftpconfig,omitempty"`
+	MemoryConfig vfs.MemoryFsConfig `json:"memoryconfig,omitempty"`
+	// optional read-only local directory to use as lower layer, the
+	// filesystem defined by the provider will be the writable layer
+	OverlayConfig vfs.OverlayFsConfig `json:"overlayconfig,omitempty"`
+	// local read cache settings, they apply to remote filesystems only
+	CacheConfig vfs.CacheFsConfig `json:"cacheconfig,omitempty"`
+	// transparent compression settings
+	CompressionConfig vfs.CompressionFsConfig `json:"compressionconfig,omitempty"`
+	// settings to preserve the previous versions of the files
+	VersioningConfig vfs.VersioningConfig `json:"versioningconfig,omitempty"`
+	// settings to move the deleted files and directories to a trash
+	TrashConfig vfs.TrashConfig `json:"trashconfig,omitempty"`
+	// policy to move the files not recently modified to the tiering target,
+	// it applies to the local filesystem only
+	TieringConfig vfs.TieringFsConfig `json:"tieringconfig,omitempty"`
+}
+
+// IsVirtualFoldersSupported returns true if the virtual folders can be used
+// with the configured storage provider
+func (f *Filesystem) IsVirtualFoldersSupported() bool {
+	return f.Provider == LocalFilesystemProvider || f.Provider == MemoryFilesystemProvider
 }
 
 // User defines a SFTPGo user
@@ -225,19 +347,210 @@ type User struct {
 
 // GetFilesystem returns the filesystem for this user
 func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
+	fs, err := u.getStorageFilesystem(connectionID)
+	if err != nil {
+		return nil, err
+	}
+	if u.FsConfig.OverlayConfig.IsEnabled() {
+		fs = vfs.NewOverlayFs(connectionID, fs, u.FsConfig.OverlayConfig)
+	}
+	return fs, nil
+}
+
+// GetVersionedFilesystem returns the filesystem to use to manage the previous
+// versions of the user files
+func (u *User) GetVersionedFilesystem(connectionID string) (*vfs.VersionedFs, error) {
+	if !u.FsConfig.VersioningConfig.IsEnabled() {
+		return nil, fmt.Errorf("versioning is not enabled for user %#v", u.Username)
+	}
+	fs, err := u.getStorageFilesystem(connectionID)
+	if err != nil {
+		return nil, err
+	}
+	// the trash, if enabled, wraps the versioned filesystem
+	if trashFs, ok := fs.(*vfs.TrashFs); ok {
+		fs = trashFs.Fs
+	}
+	versionedFs, ok := fs.(*vfs.VersionedFs)
+	if !ok {
+		fs.Close()
+		return nil, fmt.Errorf("unexpected filesystem for user %#v", u.Username)
+	}
+	return versionedFs, nil
+}
+
+// GetTrashFilesystem returns the filesystem to use to manage the deleted items
+// for this user
+func (u *User) GetTrashFilesystem(connectionID string) (*vfs.TrashFs, error) {
+	if !u.FsConfig.TrashConfig.IsEnabled() {
+		return nil, fmt.Errorf("the trash is not enabled for user %#v", u.Username)
+	}
+	fs, err := u.getStorageFilesystem(connectionID)
+	if err != nil {
+		return nil, err
+	}
+	trashFs, ok := fs.(*vfs.TrashFs)
+	if !ok {
+		fs.Close()
+		return nil, fmt.Errorf("unexpected filesystem for user %#v", u.Username)
+	}
+	return trashFs, nil
+}
+
+// GetTieredFilesystem returns the filesystem to use to apply the tiering
+// policy for this user
+func (u *User) GetTieredFilesystem(connectionID string) (*vfs.TieredFs, error) {
+	if !u.FsConfig.TieringConfig.IsEnabled() {
+		return nil, fmt.Errorf("tiering is not enabled for user %#v", u.Username)
+	}
+	if !u.isTieringSupported() {
+		return nil, fmt.Errorf("tiering is not supported for user %#v", u.Username)
+	}
+	fs, err := u.getProviderFilesystem(connectionID)
+	if err != nil {
+		return nil, err
+	}
+	fs, err = vfs.NewTieredFs(fs, u.Username, u.FsConfig.TieringConfig)
+	if err != nil {
+		return nil, err
+	}
+	return fs.(*vfs.TieredFs), nil
+}
+
+// getStorageFilesystem returns the filesystem for this user without the overlay
+func (u *User) getStorageFilesystem(connectionID string) (vfs.Fs, error) {
+	fs, err := u.getProviderFilesystem(connectionID)
+	if err != nil {
+		return fs, err
+	}
+	if u.FsConfig.TieringConfig.IsEnabled() && u.isTieringSupported() {
+		fs, err = vfs.NewTieredFs(fs, u.Username, u.FsConfig.TieringConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.isReadCacheEnabled() {
+		fs = vfs.NewCachedFs(fs, u.getReadCacheNamespace())
+	}
+	if u.hasEncryptionLayer() {
+		fs, err = vfs.NewEncryptedFs(fs, u.GetHomeDir(), u.FsConfig.CryptConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the files must be compressed before encrypting them
+	if u.FsConfig.CompressionConfig.IsEnabled() {
+		fs, err = vfs.NewCompressedFs(fs, u.GetHomeDir(), u.FsConfig.CompressionConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.FsConfig.VersioningConfig.IsEnabled() {
+		versioningConfig := u.FsConfig.VersioningConfig
+		if versioningConfig.QuotaSize == 0 {
+			versioningConfig.QuotaSize = u.QuotaSize
+		}
+		fs, err = vfs.NewVersionedFs(fs, u.Username, versioningConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.FsConfig.TrashConfig.IsEnabled() {
+		trashConfig := u.FsConfig.TrashConfig
+		if trashConfig.QuotaSize == 0 {
+			trashConfig.QuotaSize = u.QuotaSize
+		}
+		fs, err = vfs.NewTrashFs(fs, u.Username, trashConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// isTieringSupported returns true if the tiering target is configured and
+// the files are stored on the local filesystem
+func (u *User) isTieringSupported() bool {
+	return u.FsConfig.Provider == LocalFilesystemProvider && vfs.IsTieringEnabled()
+}
+
+// hasEncryptionLayer returns true if the files stored on the remote
+// filesystem must be encrypted client-side
+func (u *User) hasEncryptionLayer() bool {
+	switch u.FsConfig.Provider {
+	case LocalFilesystemProvider, CryptedFilesystemProvider, MemoryFilesystemProvider:
+		return false
+	default:
+		return u.FsConfig.CryptConfig.IsEnabled()
+	}
+}
+
+func (u *User) isReadCacheEnabled() bool {
+	switch u.FsConfig.Provider {
+	case LocalFilesystemProvider, CryptedFilesystemProvider, MemoryFilesystemProvider:
+		return false
+	default:
+		return u.FsConfig.CacheConfig.IsEnabled()
+	}
+}
+
+// getReadCacheNamespace returns a string that identifies the remote storage,
+// users with the same namespace share the cached files
+func (u *User) getReadCacheNamespace() string {
 	switch u.FsConfig.Provider {
 	case S3FilesystemProvider:
-		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
+		return fmt.Sprintf("s3|%v|%v", u.FsConfig.S3Config.Endpoint, u.FsConfig.S3Config.Bucket)
+	case GCSFilesystemProvider:
+		return fmt.Sprintf("gcs|%v", u.FsConfig.GCSConfig.Bucket)
+	case AzureBlobFilesystemProvider:
+		if u.FsConfig.AzBlobConfig.SASURL != "" {
+			if sasURL, err := url.Parse(u.FsConfig.AzBlobConfig.SASURL); err == nil {
+				return fmt.Sprintf("azblob|%v|%v", sasURL.Host, sasURL.Path)
+			}
+		}
+		return fmt.Sprintf("azblob|%v|%v|%v", u.FsConfig.AzBlobConfig.Endpoint, u.FsConfig.AzBlobConfig.AccountName,
+			u.FsConfig.AzBlobConfig.Container)
+	case SFTPFilesystemProvider:
+		return fmt.Sprintf("sftp|%v|%v", u.FsConfig.SFTPConfig.Endpoint, u.FsConfig.SFTPConfig.Username)
+	case WebDAVFilesystemProvider:
+		return fmt.Sprintf("webdav|%v|%v", u.FsConfig.WebDAVConfig.Endpoint, u.FsConfig.WebDAVConfig.Username)
+	case FTPFilesystemProvider:
+		return fmt.Sprintf("ftp|%v|%v", u.FsConfig.FTPConfig.Endpoint, u.FsConfig.FTPConfig.Username)
+	default:
+		return u.Username
+	}
+}
+
+// GetProviderFilesystem returns the filesystem for the configured storage
+// backend, without the optional layers such as encryption or compression
+func (u *User) GetProviderFilesystem(connectionID string) (vfs.Fs, error) {
+	return u.getProviderFilesystem(connectionID)
+}
+
+func (u *User) getProviderFilesystem(connectionID string) (vfs.Fs, error) {
+	switch u.FsConfig.Provider {
+	case S3FilesystemProvider:
+		config := u.FsConfig.S3Config
+		config.Owner = u.Username
+		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), config)
 	case GCSFilesystemProvider:
 		config := u.FsConfig.GCSConfig
 		config.CredentialFile = u.getGCSCredentialsFilePath()
 		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
 	case AzureBlobFilesystemProvider:
-		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), u.FsConfig.AzBlobConfig)
+		config := u.FsConfig.AzBlobConfig
+		config.Owner = u.Username
+		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), config)
 	case CryptedFilesystemProvider:
 		return vfs.NewCryptFs(connectionID, u.GetHomeDir(), u.FsConfig.CryptConfig)
 	case SFTPFilesystemProvider:
 		return vfs.NewSFTPFs(connectionID, u.FsConfig.SFTPConfig)
+	case WebDAVFilesystemProvider:
+		return vfs.NewWebDAVFs(connectionID, u.GetHomeDir(), u.FsConfig.WebDAVConfig)
+	case FTPFilesystemProvider:
+		return vfs.NewFTPFs(connectionID, u.GetHomeDir(), u.FsConfig.FTPConfig)
+	case MemoryFilesystemProvider:
+		return vfs.NewMemoryFs(connectionID, u.GetHomeDir(), u.VirtualFolders, u.FsConfig.MemoryConfig)
 	default:
 		return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.VirtualFolders), nil
 	}
@@ -249,6 +562,7 @@ func (u *User) HideConfidentialData() {
 	switch u.FsConfig.Provider {
 	case S3FilesystemProvider:
 		u.FsConfig.S3Config.AccessSecret.Hide()
+		u.FsConfig.S3Config.SSECustomerKey.Hide()
 	case GCSFilesystemProvider:
 		u.FsConfig.GCSConfig.Credentials.Hide()
 	case AzureBlobFilesystemProvider:
@@ -258,15 +572,32 @@ func (u *User) HideConfidentialData() {
 	case SFTPFilesystemProvider:
 		u.FsConfig.SFTPConfig.Password.Hide()
 		u.FsConfig.SFTPConfig.PrivateKey.Hide()
+	case WebDAVFilesystemProvider:
+		u.FsConfig.WebDAVConfig.Password.Hide()
+	case FTPFilesystemProvider:
+		u.FsConfig.FTPConfig.Password.Hide()
+	}
+	if u.hasEncryptionLayer() {
+		u.FsConfig.CryptConfig.Passphrase.Hide()
 	}
 }
 
 // DecryptSecrets tries to decrypts kms secrets
 func (u *User) DecryptSecrets() error {
+	if u.hasEncryptionLayer() && u.FsConfig.CryptConfig.Passphrase.IsEncrypted() {
+		if err := u.FsConfig.CryptConfig.Passphrase.Decrypt(); err != nil {
+			return err
+		}
+	}
 	switch u.FsConfig.Provider {
 	case S3FilesystemProvider:
 		if u.FsConfig.S3Config.AccessSecret.IsEncrypted() {
-			return u.FsConfig.S3Config.AccessSecret.Decrypt()
+			if err := u.FsConfig.S3Config.AccessSecret.Decrypt(); err != nil {
+				return err
+			}
+		}
+		if u.FsConfig.S3Config.SSECustomerKey.IsEncrypted() {
+			return u.FsConfig.S3Config.SSECustomerKey.Decrypt()
 		}
 	case GCSFilesystemProvider:
 		if u.FsConfig.GCSConfig.Credentials.IsEncrypted() {
@@ -291,6 +622,14 @@ func (u *User) DecryptSecrets() error {
 				return err
 			}
 		}
+	case WebDAVFilesystemProvider:
+		if u.FsConfig.WebDAVConfig.Password.IsEncrypted() {
+			return u.FsConfig.WebDAVConfig.Password.Decrypt()
+		}
+	case FTPFilesystemProvider:
+		if u.FsConfig.FTPConfig.Password.IsEncrypted() {
+			return u.FsConfig.FTPConfig.Password.Decrypt()
+		}
 	}
 
 	return nil
@@ -326,7 +665,7 @@ func (u *User) GetPermissionsForPath(p string) []string {
 // If the path is not inside a virtual folder an error is returned
 func (u *User) GetVirtualFolderForPath(sftpPath string) (vfs.VirtualFolder, error) {
 	var folder vfs.VirtualFolder
-	if len(u.VirtualFolders) == 0 || u.FsConfig.Provider != LocalFilesystemProvider {
+	if len(u.VirtualFolders) == 0 || !u.FsConfig.IsVirtualFoldersSupported() {
 		return folder, errNoMatchingVirtualFolder
 	}
 	dirsForPath := utils.GetDirsForSFTPPath(sftpPath)
@@ -340,26 +679,32 @@ func (u *User) GetVirtualFolderForPath(sftpPath string) (vfs.VirtualFolder, erro
 	return folder, errNoMatchingVirtualFolder
 }
 
-// AddVirtualDirs adds virtual folders, if defined, to the given files list
-func (u *User) AddVirtualDirs(list []os.FileInfo, sftpPath string) []os.FileInfo {
-	if len(u.VirtualFolders) == 0 {
-		return list
-	}
+// GetVirtualDirs returns the virtual folders directly inside the given
+// virtual path as directory entries
+func (u *User) GetVirtualDirs(sftpPath string) []os.FileInfo {
+	var result []os.FileInfo
 	for _, v := range u.VirtualFolders {
 		if path.Dir(v.VirtualPath) == sftpPath {
-			fi := vfs.NewFileInfo(v.VirtualPath, true, 0, time.Now(), false)
-			found := false
-			for index, f := range list {
-				if f.Name() == fi.Name() {
-					list[index] = fi
-					found = true
-					break
-				}
-			}
-			if !found {
-				list = append(list, fi)
+			result = append(result, vfs.NewFileInfo(v.VirtualPath, true, 0, time.Now(), false))
+		}
+	}
+	return result
+}
+
+// AddVirtualDirs adds virtual folders, if defined, to the given files list
+func (u *User) AddVirtualDirs(list []os.FileInfo, sftpPath string) []os.FileInfo {
+	for _, fi := range u.GetVirtualDirs(sftpPath) {
+		found := false
+		for index, f := range list {
+			if f.Name() == fi.Name() {
+				list[index] = fi
+				found = true
+				break
 			}
 		}
+		if !found {
+			list = append(list, fi)
+		}
 	}
 	return list
 }
@@ -572,39 +917,114 @@ func (u *User) isFileExtensionAllowed(virtualPath string) bool {
 }
 
 func (u *User) isFilePatternAllowed(virtualPath string) bool {
-	if len(u.Filters.FilePatterns) == 0 {
+	filter := u.getPatternsFilter(path.Dir(virtualPath))
+	if filter == nil {
 		return true
 	}
-	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(virtualPath))
-	var filter PatternsFilter
-	for _, dir := range dirsForPath {
-		for _, f := range u.Filters.FilePatterns {
-			if f.Path == dir {
-				filter = f
-				break
+	toMatch := strings.ToLower(path.Base(virtualPath))
+	for _, denied := range filter.DeniedPatterns {
+		matched, err := path.Match(denied, toMatch)
+		if err != nil || matched {
+			return false
+		}
+	}
+	for _, allowed := range filter.AllowedPatterns {
+		matched, err := path.Match(allowed, toMatch)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return len(filter.AllowedPatterns) == 0
+}
+
+// getPatternsFilter returns the patterns filter to apply to the files inside
+// the specified virtual directory or nil if no filter is defined
+func (u *User) getPatternsFilter(virtualDirPath string) *PatternsFilter {
+	if len(u.Filters.FilePatterns) == 0 {
+		return nil
+	}
+	for _, dir := range utils.GetDirsForSFTPPath(virtualDirPath) {
+		for idx := range u.Filters.FilePatterns {
+			if u.Filters.FilePatterns[idx].Path == dir {
+				return &u.Filters.FilePatterns[idx]
 			}
 		}
-		if filter.Path != "" {
-			break
+	}
+	return nil
+}
+
+// IsDirListingAllowed returns false if the patterns filters deny the listing
+// for the specified virtual directory
+func (u *User) IsDirListingAllowed(virtualPath string) bool {
+	filter := u.getPatternsFilter(virtualPath)
+	return filter == nil || !filter.DenyListing
+}
+
+// FilterListDir removes the entries matching the hidden patterns from the
+// contents of the specified virtual directory
+func (u *User) FilterListDir(dirContents []os.FileInfo, virtualPath string) []os.FileInfo {
+	filter := u.getPatternsFilter(virtualPath)
+	if filter == nil || len(filter.HiddenPatterns) == 0 {
+		return dirContents
+	}
+	result := make([]os.FileInfo, 0, len(dirContents))
+	for _, fi := range dirContents {
+		if !filter.IsHidden(fi.Name()) {
+			result = append(result, fi)
 		}
 	}
-	if filter.Path != "" {
-		toMatch := strings.ToLower(path.Base(virtualPath))
-		for _, denied := range filter.DeniedPatterns {
-			matched, err := path.Match(denied, toMatch)
-			if err != nil || matched {
-				return false
+	return result
+}
+
+// GetMimeTypesFilter returns the content type filter to apply to the specified
+// virtual path or nil if no filter is defined
+func (u *User) GetMimeTypesFilter(virtualPath string) *MimeTypesFilter {
+	if len(u.Filters.MimeTypes) == 0 {
+		return nil
+	}
+	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(virtualPath))
+	for _, dir := range dirsForPath {
+		for idx := range u.Filters.MimeTypes {
+			if u.Filters.MimeTypes[idx].Path == dir {
+				return &u.Filters.MimeTypes[idx]
 			}
 		}
-		for _, allowed := range filter.AllowedPatterns {
-			matched, err := path.Match(allowed, toMatch)
-			if err == nil && matched {
-				return true
+	}
+	return nil
+}
+
+// GetRetentionFilter returns the retention filter to apply to the specified
+// virtual path or nil if no filter is defined
+func (u *User) GetRetentionFilter(virtualPath string) *RetentionFilter {
+	if len(u.Filters.Retention) == 0 {
+		return nil
+	}
+	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(virtualPath))
+	for _, dir := range dirsForPath {
+		for idx := range u.Filters.Retention {
+			if u.Filters.Retention[idx].Path == dir {
+				return &u.Filters.Retention[idx]
 			}
 		}
-		return len(filter.AllowedPatterns) == 0
 	}
-	return true
+	return nil
+}
+
+// HasRetentionFiltersFor returns true if a retention filter applies to the
+// specified virtual directory or to any directory inside it
+func (u *User) HasRetentionFiltersFor(virtualPath string) bool {
+	if len(u.Filters.Retention) == 0 {
+		return false
+	}
+	if u.GetRetentionFilter(path.Join(virtualPath, "file")) != nil {
+		return true
+	}
+	for _, f := range u.Filters.Retention {
+		if virtualPath == "/" || strings.HasPrefix(f.Path, virtualPath+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // IsLoginFromAddrAllowed returns true if the login is allowed from the specified remoteAddr.
@@ -769,6 +1189,12 @@ func (u *User) GetInfoString() string {
 		result += "Storage: Encrypted "
 	case SFTPFilesystemProvider:
 		result += "Storage: SFTP "
+	case WebDAVFilesystemProvider:
+		result += "Storage: WebDAV "
+	case FTPFilesystemProvider:
+		result += "Storage: FTP "
+	case MemoryFilesystemProvider:
+		result += "Storage: Memory "
 	}
 	if len(u.PublicKeys) > 0 {
 		result += fmt.Sprintf("Public keys: %v ", len(u.PublicKeys))
@@ -815,6 +1241,9 @@ func (u *User) SetEmptySecretsIfNil() {
 	if u.FsConfig.S3Config.AccessSecret == nil {
 		u.FsConfig.S3Config.AccessSecret = kms.NewEmptySecret()
 	}
+	if u.FsConfig.S3Config.SSECustomerKey == nil {
+		u.FsConfig.S3Config.SSECustomerKey = kms.NewEmptySecret()
+	}
 	if u.FsConfig.GCSConfig.Credentials == nil {
 		u.FsConfig.GCSConfig.Credentials = kms.NewEmptySecret()
 	}
@@ -830,6 +1259,12 @@ func (u *User) SetEmptySecretsIfNil() {
 	if u.FsConfig.SFTPConfig.PrivateKey == nil {
 		u.FsConfig.SFTPConfig.PrivateKey = kms.NewEmptySecret()
 	}
+	if u.FsConfig.WebDAVConfig.Password == nil {
+		u.FsConfig.WebDAVConfig.Password = kms.NewEmptySecret()
+	}
+	if u.FsConfig.FTPConfig.Password == nil {
+		u.FsConfig.FTPConfig.Password = kms.NewEmptySecret()
+	}
 }
 
 func (u *User) getACopy() User {
@@ -856,6 +1291,10 @@ func (u *User) getACopy() User {
 	copy(filters.FileExtensions, u.Filters.FileExtensions)
 	filters.FilePatterns = make([]PatternsFilter, len(u.Filters.FilePatterns))
 	copy(filters.FilePatterns, u.Filters.FilePatterns)
+	filters.MimeTypes = make([]MimeTypesFilter, len(u.Filters.MimeTypes))
+	copy(filters.MimeTypes, u.Filters.MimeTypes)
+	filters.Retention = make([]RetentionFilter, len(u.Filters.Retention))
+	copy(filters.Retention, u.Filters.Retention)
 	filters.DeniedProtocols = make([]string, len(u.Filters.DeniedProtocols))
 	copy(filters.DeniedProtocols, u.Filters.DeniedProtocols)
 	fsConfig := Filesystem{
@@ -870,6 +1309,14 @@ func (u *User) getACopy() User {
 			KeyPrefix:         u.FsConfig.S3Config.KeyPrefix,
 			UploadPartSize:    u.FsConfig.S3Config.UploadPartSize,
 			UploadConcurrency: u.FsConfig.S3Config.UploadConcurrency,
+			SSEType:           u.FsConfig.S3Config.SSEType,
+			SSEKMSKeyID:       u.FsConfig.S3Config.SSEKMSKeyID,
+			SSECustomerKey:    u.FsConfig.S3Config.SSECustomerKey.Clone(),
+			ACL:               u.FsConfig.S3Config.ACL,
+			ForcePathStyle:    u.FsConfig.S3Config.ForcePathStyle,
+			ListMetadata:      u.FsConfig.S3Config.ListMetadata,
+			EmulateSymlinks:   u.FsConfig.S3Config.EmulateSymlinks,
+			ObjectLockMode:    u.FsConfig.S3Config.ObjectLockMode,
 		},
 		GCSConfig: vfs.GCSFsConfig{
 			Bucket:               u.FsConfig.GCSConfig.Bucket,
@@ -877,6 +1324,7 @@ func (u *User) getACopy() User {
 			Credentials:          u.FsConfig.GCSConfig.Credentials.Clone(),
 			AutomaticCredentials: u.FsConfig.GCSConfig.AutomaticCredentials,
 			StorageClass:         u.FsConfig.GCSConfig.StorageClass,
+			EmulateSymlinks:      u.FsConfig.GCSConfig.EmulateSymlinks,
 			KeyPrefix:            u.FsConfig.GCSConfig.KeyPrefix,
 		},
 		AzBlobConfig: vfs.AzBlobFsConfig{
@@ -890,6 +1338,7 @@ func (u *User) getACopy() User {
 			UploadConcurrency: u.FsConfig.AzBlobConfig.UploadConcurrency,
 			UseEmulator:       u.FsConfig.AzBlobConfig.UseEmulator,
 			AccessTier:        u.FsConfig.AzBlobConfig.AccessTier,
+			EmulateSymlinks:   u.FsConfig.AzBlobConfig.EmulateSymlinks,
 		},
 		CryptConfig: vfs.CryptFsConfig{
 			Passphrase: u.FsConfig.CryptConfig.Passphrase.Clone(),
@@ -901,11 +1350,71 @@ func (u *User) getACopy() User {
 			PrivateKey: u.FsConfig.SFTPConfig.PrivateKey.Clone(),
 			Prefix:     u.FsConfig.SFTPConfig.Prefix,
 		},
+		WebDAVConfig: vfs.WebDAVFsConfig{
+			Endpoint:      u.FsConfig.WebDAVConfig.Endpoint,
+			Username:      u.FsConfig.WebDAVConfig.Username,
+			Password:      u.FsConfig.WebDAVConfig.Password.Clone(),
+			SkipTLSVerify: u.FsConfig.WebDAVConfig.SkipTLSVerify,
+			CACertificate: u.FsConfig.WebDAVConfig.CACertificate,
+			Prefix:        u.FsConfig.WebDAVConfig.Prefix,
+		},
+		FTPConfig: vfs.FTPFsConfig{
+			Endpoint:      u.FsConfig.FTPConfig.Endpoint,
+			Username:      u.FsConfig.FTPConfig.Username,
+			Password:      u.FsConfig.FTPConfig.Password.Clone(),
+			TLSMode:       u.FsConfig.FTPConfig.TLSMode,
+			SkipTLSVerify: u.FsConfig.FTPConfig.SkipTLSVerify,
+			DisableEPSV:   u.FsConfig.FTPConfig.DisableEPSV,
+			ActiveMode:    u.FsConfig.FTPConfig.ActiveMode,
+			Prefix:        u.FsConfig.FTPConfig.Prefix,
+		},
+		MemoryConfig: vfs.MemoryFsConfig{
+			MaxSize: u.FsConfig.MemoryConfig.MaxSize,
+		},
+		OverlayConfig: vfs.OverlayFsConfig{
+			LowerPath: u.FsConfig.OverlayConfig.LowerPath,
+		},
+		CacheConfig: vfs.CacheFsConfig{
+			Mode: u.FsConfig.CacheConfig.Mode,
+		},
+		CompressionConfig: vfs.CompressionFsConfig{
+			Algorithm: u.FsConfig.CompressionConfig.Algorithm,
+			Level:     u.FsConfig.CompressionConfig.Level,
+			QuotaMode: u.FsConfig.CompressionConfig.QuotaMode,
+		},
+		VersioningConfig: vfs.VersioningConfig{
+			Enabled:     u.FsConfig.VersioningConfig.Enabled,
+			MaxVersions: u.FsConfig.VersioningConfig.MaxVersions,
+			MaxAge:      u.FsConfig.VersioningConfig.MaxAge,
+			QuotaSize:   u.FsConfig.VersioningConfig.QuotaSize,
+		},
+		TrashConfig: vfs.TrashConfig{
+			Enabled:   u.FsConfig.TrashConfig.Enabled,
+			Retention: u.FsConfig.TrashConfig.Retention,
+			QuotaSize: u.FsConfig.TrashConfig.QuotaSize,
+		},
+		TieringConfig: vfs.TieringFsConfig{
+			Enabled: u.FsConfig.TieringConfig.Enabled,
+			MinAge:  u.FsConfig.TieringConfig.MinAge,
+			Recall:  u.FsConfig.TieringConfig.Recall,
+		},
 	}
 	if len(u.FsConfig.SFTPConfig.Fingerprints) > 0 {
 		fsConfig.SFTPConfig.Fingerprints = make([]string, len(u.FsConfig.SFTPConfig.Fingerprints))
 		copy(fsConfig.SFTPConfig.Fingerprints, u.FsConfig.SFTPConfig.Fingerprints)
 	}
+	if len(u.FsConfig.CompressionConfig.Paths) > 0 {
+		fsConfig.CompressionConfig.Paths = make([]string, len(u.FsConfig.CompressionConfig.Paths))
+		copy(fsConfig.CompressionConfig.Paths, u.FsConfig.CompressionConfig.Paths)
+	}
+	if len(u.FsConfig.VersioningConfig.Paths) > 0 {
+		fsConfig.VersioningConfig.Paths = make([]string, len(u.FsConfig.VersioningConfig.Paths))
+		copy(fsConfig.VersioningConfig.Paths, u.FsConfig.VersioningConfig.Paths)
+	}
+	if len(u.FsConfig.TieringConfig.Paths) > 0 {
+		fsConfig.TieringConfig.Paths = make([]string, len(u.FsConfig.TieringConfig.Paths))
+		copy(fsConfig.TieringConfig.Paths, u.FsConfig.TieringConfig.Paths)
+	}
 
 	return User{
 		ID:                u.ID,
@@ -164,21 +164,26 @@ func TestResumeCryptFs(t *testing.T) {
 		assert.NoError(t, err)
 		err = ftpUploadFile(testFilePath, testFileName, int64(len(data)), client, 0)
 		assert.NoError(t, err)
-		// upload resume is not supported
 		err = ftpUploadFile(testFilePath, testFileName, int64(len(data)+5), client, 5)
-		assert.Error(t, err)
+		assert.NoError(t, err)
 		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
-		err = ftpDownloadFile(testFileName, localDownloadPath, int64(4), client, 5)
+		err = ftpDownloadFile(testFileName, localDownloadPath, int64(len(data)+5), client, 0)
 		assert.NoError(t, err)
 		readed, err := ioutil.ReadFile(localDownloadPath)
 		assert.NoError(t, err)
-		assert.Equal(t, data[5:], readed)
-		err = ftpDownloadFile(testFileName, localDownloadPath, int64(8), client, 1)
+		assert.Equal(t, "test test data", string(readed))
+		err = ftpDownloadFile(testFileName, localDownloadPath, int64(len(data)), client, 5)
 		assert.NoError(t, err)
 		readed, err = ioutil.ReadFile(localDownloadPath)
 		assert.NoError(t, err)
-		assert.Equal(t, data[1:], readed)
-		err = ftpDownloadFile(testFileName, localDownloadPath, int64(0), client, 9)
+		assert.Equal(t, data, readed)
+		encryptedFileSize, err := getEncryptedFileSize(int64(len(data) + 5))
+		assert.NoError(t, err)
+		info, err := os.Stat(filepath.Join(user.GetHomeDir(), testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, encryptedFileSize, info.Size())
+		}
+		err = ftpDownloadFile(testFileName, localDownloadPath, int64(0), client, 14)
 		assert.NoError(t, err)
 		err = client.Delete(testFileName)
 		assert.NoError(t, err)
@@ -188,17 +193,18 @@ func TestResumeCryptFs(t *testing.T) {
 		srcFile, err := os.Open(testFilePath)
 		if assert.NoError(t, err) {
 			err = client.Append(testFileName, srcFile)
-			assert.Error(t, err)
+			assert.NoError(t, err)
 			err = srcFile.Close()
 			assert.NoError(t, err)
 			size, err := client.FileSize(testFileName)
 			assert.NoError(t, err)
-			assert.Equal(t, int64(len(data)), size)
-			err = ftpDownloadFile(testFileName, localDownloadPath, int64(len(data)), client, 0)
+			assert.Equal(t, int64(2*len(data)), size)
+			err = ftpDownloadFile(testFileName, localDownloadPath, int64(2*len(data)), client, 0)
 			assert.NoError(t, err)
 			readed, err = ioutil.ReadFile(localDownloadPath)
 			assert.NoError(t, err)
-			assert.Equal(t, data, readed)
+			expected := append(data, data...)
+			assert.Equal(t, expected, readed)
 		}
 		err = client.Quit()
 		assert.NoError(t, err)
@@ -1,12 +1,15 @@
 package ftpd_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net"
@@ -16,6 +19,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -304,8 +308,12 @@ func TestBasicFTPHandling(t *testing.T) {
 	u.QuotaSize = 6553600
 	sftpUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
+	u = getTestFTPFsUser()
+	u.QuotaSize = 6553600
+	ftpFsUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
 
-	for _, user := range []dataprovider.User{localUser, sftpUser} {
+	for _, user := range []dataprovider.User{localUser, sftpUser, ftpFsUser} {
 		client, err := getFTPClient(user, true)
 		if assert.NoError(t, err) {
 			if user.Username == defaultUsername {
@@ -387,6 +395,8 @@ func TestBasicFTPHandling(t *testing.T) {
 	}
 	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
 	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(ftpFsUser, http.StatusOK)
+	assert.NoError(t, err)
 	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.RemoveAll(localUser.GetHomeDir())
@@ -891,6 +901,209 @@ func TestResume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestResumeFTPFs(t *testing.T) {
+	localUser, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	u := getTestFTPFsUser()
+	u.QuotaSize = 6553600
+	u.FsConfig.FTPConfig.Prefix = "/ftpfs"
+	ftpFsUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getFTPClient(ftpFsUser, false)
+	if assert.NoError(t, err) {
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		data := []byte("test data")
+		err = ioutil.WriteFile(testFilePath, data, os.ModePerm)
+		assert.NoError(t, err)
+		remoteFilePath := filepath.Join(localUser.GetHomeDir(), "ftpfs", testFileName)
+		err = ftpUploadFile(testFilePath, testFileName, int64(len(data)), client, 0)
+		assert.NoError(t, err)
+		// resume is supported only from the size of the remote file
+		err = ftpUploadFile(testFilePath, testFileName, int64(len(data)+5), client, 5)
+		assert.Error(t, err)
+		err = ftpUploadFile(testFilePath, testFileName, int64(2*len(data)), client, uint64(len(data)))
+		assert.NoError(t, err)
+		readed, err := ioutil.ReadFile(remoteFilePath)
+		assert.NoError(t, err)
+		assert.Equal(t, "test datatest data", string(readed))
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = ftpDownloadFile(testFileName, localDownloadPath, int64(2*len(data)-5), client, 5)
+		assert.NoError(t, err)
+		readed, err = ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "datatest data", string(readed))
+		// append to the file
+		srcFile, err := os.Open(testFilePath)
+		if assert.NoError(t, err) {
+			err = client.Append(testFileName, srcFile)
+			assert.NoError(t, err)
+			err = srcFile.Close()
+			assert.NoError(t, err)
+			size, err := client.FileSize(testFileName)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3*len(data)), size)
+		}
+		user, _, err := httpdtest.GetUserByUsername(ftpFsUser.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(3*len(data)), user.UsedQuotaSize)
+		// overwrite the file
+		err = ftpUploadFile(testFilePath, testFileName, int64(len(data)), client, 0)
+		assert.NoError(t, err)
+		readed, err = ioutil.ReadFile(remoteFilePath)
+		assert.NoError(t, err)
+		assert.Equal(t, data, readed)
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(ftpFsUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestFTPFsActiveMode(t *testing.T) {
+	localUser, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	for _, tlsMode := range []int{vfs.FTPTLSModeDisabled, vfs.FTPTLSModeExplicit} {
+		u := getTestFTPFsUser()
+		u.FsConfig.FTPConfig.TLSMode = tlsMode
+		u.FsConfig.FTPConfig.ActiveMode = true
+		ftpFsUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+		assert.NoError(t, err)
+		assert.True(t, ftpFsUser.FsConfig.FTPConfig.ActiveMode)
+		client, err := getFTPClient(ftpFsUser, false)
+		if assert.NoError(t, err) {
+			testFilePath := filepath.Join(homeBasePath, testFileName)
+			testFileSize := int64(65535)
+			err = createTestFile(testFilePath, testFileSize)
+			assert.NoError(t, err)
+			err = checkBasicFTP(client)
+			assert.NoError(t, err)
+			err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+			assert.NoError(t, err)
+			remoteFilePath := filepath.Join(localUser.GetHomeDir(), testFileName)
+			info, err := os.Stat(remoteFilePath)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testFileSize, info.Size())
+			}
+			localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize, client, 0)
+			assert.NoError(t, err)
+			entries, err := client.List("/")
+			if assert.NoError(t, err) {
+				assert.Len(t, entries, 1)
+			}
+			// a transfer error does not break the next transfers
+			err = ftpDownloadFile("missing", localDownloadPath, testFileSize, client, 0)
+			assert.Error(t, err)
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize, client, 0)
+			assert.NoError(t, err)
+			err = client.Delete(testFileName)
+			assert.NoError(t, err)
+
+			err = client.Quit()
+			assert.NoError(t, err)
+			err = os.Remove(testFilePath)
+			assert.NoError(t, err)
+			err = os.Remove(localDownloadPath)
+			assert.NoError(t, err)
+		}
+		_, err = httpdtest.RemoveUser(ftpFsUser, http.StatusOK)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestEncryptedSFTPFs(t *testing.T) {
+	localUser, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	u := getTestSFTPUser()
+	u.QuotaSize = 6553600
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("encryption passphrase")
+	sftpUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, kms.SecretStatusSecretBox, sftpUser.FsConfig.CryptConfig.Passphrase.GetStatus())
+	client, err := getFTPClient(sftpUser, false)
+	if assert.NoError(t, err) {
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		// more than two encrypted packages
+		testFileSize := int64(150000)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+		assert.NoError(t, err)
+		// the file is stored encrypted on the remote filesystem
+		remoteFilePath := filepath.Join(localUser.GetHomeDir(), testFileName)
+		info, err := os.Stat(remoteFilePath)
+		if assert.NoError(t, err) {
+			assert.Greater(t, info.Size(), testFileSize)
+		}
+		size, err := client.FileSize(testFileName)
+		assert.NoError(t, err)
+		assert.Equal(t, testFileSize, size)
+		entries, err := client.List("/")
+		if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+			assert.Equal(t, uint64(testFileSize), entries[0].Size)
+		}
+		user, _, err := httpdtest.GetUserByUsername(sftpUser.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// upload resume is not supported
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize+100, client, 100)
+		assert.Error(t, err)
+
+		plaintext, err := ioutil.ReadFile(testFilePath)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		for _, offset := range []int64{0, 100, 65536, 70000, testFileSize - 1, testFileSize} {
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize-offset, client, uint64(offset))
+			assert.NoError(t, err, "offset %v", offset)
+			readed, err := ioutil.ReadFile(localDownloadPath)
+			assert.NoError(t, err)
+			assert.Equal(t, plaintext[offset:], readed, "offset %v", offset)
+		}
+		// a quota scan uses the plaintext sizes too
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(sftpUser.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 //nolint:dupl
 func TestDeniedLoginMethod(t *testing.T) {
 	u := getTestUser()
@@ -1874,6 +2087,19 @@ func TestHASH(t *testing.T) {
 			assert.Equal(t, ftp.StatusFile, code)
 			assert.Contains(t, response, hash)
 
+			content, err := ioutil.ReadFile(testFilePath)
+			assert.NoError(t, err)
+			rangeHash := sha256.Sum256(content[100:1000])
+			code, response, err = client.SendCustomCommand(fmt.Sprintf("XSHA256 %v 100 1000", testFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, ftp.StatusRequestedFileActionOK, code)
+			assert.Contains(t, response, hex.EncodeToString(rangeHash[:]))
+
+			code, response, err = client.SendCustomCommand(fmt.Sprintf("XCRC %v", testFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, ftp.StatusRequestedFileActionOK, code)
+			assert.Contains(t, response, fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)))
+
 			err = client.Quit()
 			assert.NoError(t, err)
 
@@ -1898,6 +2124,54 @@ func TestHASH(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestHASHStoredChecksum(t *testing.T) {
+	oldChecksums := common.Config.UploadChecksums
+	common.Config.UploadChecksums = []string{common.ChecksumSHA256}
+	defer func() {
+		common.Config.UploadChecksums = oldChecksums
+	}()
+
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getFTPClientImplicitTLS(user)
+	if assert.NoError(t, err) {
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(131072)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+		assert.NoError(t, err)
+
+		fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+		uploadedFilePath := filepath.Join(user.GetHomeDir(), testFileName)
+		if _, _, ok := vfs.GetStoredChecksum(fs, uploadedFilePath, common.ChecksumSHA256); ok {
+			fakeChecksum := strings.Repeat("b", 64)
+			err = vfs.SetChecksums(fs, uploadedFilePath, testFileSize, map[string]string{
+				common.ChecksumSHA256: fakeChecksum,
+			})
+			assert.NoError(t, err)
+			code, response, err := client.SendCustomCommand(fmt.Sprintf("HASH %v", testFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, ftp.StatusFile, code)
+			assert.Contains(t, response, fakeChecksum)
+			// a partial range is always computed reading the file
+			code, response, err = client.SendCustomCommand(fmt.Sprintf("XSHA256 %v 0 100", testFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, ftp.StatusRequestedFileActionOK, code)
+			assert.NotContains(t, response, fakeChecksum)
+		}
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestCombine(t *testing.T) {
 	u := getTestUser()
 	localUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
@@ -1948,6 +2222,160 @@ func TestCombine(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestBasicFTPHandlingCompressedFs(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.CompressionConfig.Algorithm = vfs.CompressionAlgoGzip
+	u.QuotaSize = 6553600
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getFTPClient(user, true)
+	if assert.NoError(t, err) {
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		// more than two compression frames
+		content := createCompressibleContent(2600000)
+		testFileSize := int64(len(content))
+		err = ioutil.WriteFile(testFilePath, content, os.ModePerm)
+		assert.NoError(t, err)
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+		assert.NoError(t, err)
+		// the stored file is a valid gzip file
+		storedContent, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		assert.NoError(t, err)
+		assert.Less(t, len(storedContent), len(content)/5)
+		gzReader, err := gzip.NewReader(bytes.NewReader(storedContent))
+		if assert.NoError(t, err) {
+			decompressed, err := ioutil.ReadAll(gzReader)
+			assert.NoError(t, err)
+			assert.Equal(t, content, decompressed)
+		}
+		list, err := client.List(".")
+		if assert.NoError(t, err) && assert.Len(t, list, 1) {
+			assert.Equal(t, testFileSize, int64(list[0].Size))
+		}
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		for _, offset := range []int64{0, 100, 1048576, 1500000, testFileSize - 1, testFileSize} {
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize-offset, client, uint64(offset))
+			assert.NoError(t, err, "offset %v", offset)
+			readed, err := ioutil.ReadFile(localDownloadPath)
+			assert.NoError(t, err)
+			assert.Equal(t, content[offset:], readed, "offset %v", offset)
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// resume and append are not supported
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize+100, client, 100)
+		assert.Error(t, err)
+		// overwrite the file with an empty one
+		err = ioutil.WriteFile(testFilePath, nil, os.ModePerm)
+		assert.NoError(t, err)
+		err = ftpUploadFile(testFilePath, testFileName, 0, client, 0)
+		assert.NoError(t, err)
+		err = ftpDownloadFile(testFileName, localDownloadPath, 0, client, 0)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		err = client.Delete(testFileName)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, user.UsedQuotaFiles)
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(common.Connections.GetStats()) == 0 }, 1*time.Second, 50*time.Millisecond)
+}
+
+func TestCompressedPathsAndPhysicalQuota(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.CompressionConfig.Algorithm = vfs.CompressionAlgoGzip
+	u.QuotaSize = 6553600
+	u.FsConfig.CompressionConfig.QuotaMode = vfs.CompressionQuotaPhysical
+	u.FsConfig.CompressionConfig.Paths = []string{"/compressed"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getFTPClient(user, false)
+	if assert.NoError(t, err) {
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		content := createCompressibleContent(500000)
+		testFileSize := int64(len(content))
+		err = ioutil.WriteFile(testFilePath, content, os.ModePerm)
+		assert.NoError(t, err)
+		err = client.MakeDir("compressed")
+		assert.NoError(t, err)
+		err = ftpUploadFile(testFilePath, path.Join("/compressed", testFileName), testFileSize, client, 0)
+		assert.NoError(t, err)
+		// files outside the configured paths are not compressed
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+		assert.NoError(t, err)
+		stored, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		assert.NoError(t, err)
+		assert.Equal(t, content, stored)
+		info, err := os.Stat(filepath.Join(user.GetHomeDir(), "compressed", testFileName))
+		assert.NoError(t, err)
+		compressedSize := info.Size()
+		assert.Less(t, compressedSize, testFileSize)
+		size, err := client.FileSize(path.Join("/compressed", testFileName))
+		assert.NoError(t, err)
+		assert.Equal(t, testFileSize, size)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		for _, p := range []string{testFileName, path.Join("/compressed", testFileName)} {
+			err = ftpDownloadFile(p, localDownloadPath, testFileSize-10, client, 10)
+			assert.NoError(t, err)
+			readed, err := ioutil.ReadFile(localDownloadPath)
+			assert.NoError(t, err)
+			assert.Equal(t, content[10:], readed)
+		}
+		// the quota is based on the stored sizes
+		expectedQuotaSize := testFileSize + compressedSize
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, expectedQuotaSize, user.UsedQuotaSize)
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, expectedQuotaSize, user.UsedQuotaSize)
+		err = client.Delete(path.Join("/compressed", testFileName))
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func checkBasicFTP(client *ftp.ServerConn) error {
 	_, err := client.CurrentDir()
 	if err != nil {
@@ -2110,6 +2538,18 @@ func getTestSFTPUser() dataprovider.User {
 	return u
 }
 
+func getTestFTPFsUser() dataprovider.User {
+	u := getTestUser()
+	u.Username = u.Username + "_ftpfs"
+	u.FsConfig.Provider = dataprovider.FTPFilesystemProvider
+	u.FsConfig.FTPConfig.Endpoint = ftpServerAddr
+	u.FsConfig.FTPConfig.Username = defaultUsername
+	u.FsConfig.FTPConfig.Password = kms.NewPlainSecret(defaultPassword)
+	u.FsConfig.FTPConfig.TLSMode = vfs.FTPTLSModeExplicit
+	u.FsConfig.FTPConfig.SkipTLSVerify = true
+	return u
+}
+
 func getExtAuthScriptContent(user dataprovider.User, nonJSONResponse bool, username string) []byte {
 	extAuthContent := []byte("#!/bin/sh\n\n")
 	extAuthContent = append(extAuthContent, []byte(fmt.Sprintf("if test \"$SFTPGO_AUTHD_USERNAME\" = \"%v\"; then\n", user.Username))...)
@@ -2166,3 +2606,11 @@ func createTestFile(path string, size int64) error {
 	}
 	return ioutil.WriteFile(path, content, os.ModePerm)
 }
+
+func createCompressibleContent(size int) []byte {
+	var buf bytes.Buffer
+	for idx := 0; buf.Len() < size; idx++ {
+		fmt.Fprintf(&buf, "%v;partner name %v;some,csv,data;%v\n", idx, idx%100, time.Unix(int64(idx), 0).UTC())
+	}
+	return buf.Bytes()[:size]
+}
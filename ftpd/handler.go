@@ -244,6 +244,48 @@ func (c *Connection) GetAvailableSpace(dirName string) (int64, error) {
 	return quotaResult.AllowedSize, nil
 }
 
+// ComputeHash implements ClientDriverExtensionHasher interface
+func (c *Connection) ComputeHash(name string, algo ftpserver.HASHAlgo, startOffset, endOffset int64) (string, error) {
+	c.UpdateLastActivity()
+
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(name)) {
+		return "", c.GetPermissionDeniedError()
+	}
+
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelWarn, "computing hash for file %#v is not allowed", name)
+		return "", c.GetPermissionDeniedError()
+	}
+
+	p, err := c.Fs.ResolvePath(name)
+	if err != nil {
+		return "", c.GetFsError(err)
+	}
+
+	var checksumAlgo string
+	switch algo {
+	case ftpserver.HASHAlgoCRC32:
+		checksumAlgo = common.ChecksumCRC32
+	case ftpserver.HASHAlgoMD5:
+		checksumAlgo = common.ChecksumMD5
+	case ftpserver.HASHAlgoSHA1:
+		checksumAlgo = common.ChecksumSHA1
+	case ftpserver.HASHAlgoSHA256:
+		checksumAlgo = common.ChecksumSHA256
+	case ftpserver.HASHAlgoSHA512:
+		checksumAlgo = common.ChecksumSHA512
+	default:
+		return "", errNotImplemented
+	}
+
+	checksum, err := c.GetFileRangeChecksum(p, checksumAlgo, startOffset, endOffset)
+	if err != nil {
+		c.Log(logger.LevelWarn, "unable to compute %v hash for file %#v: %v", checksumAlgo, p, err)
+		return "", c.GetFsError(err)
+	}
+	return checksum, nil
+}
+
 // AllocateSpace implements ClientDriverExtensionAllocate interface
 func (c *Connection) AllocateSpace(size int) error {
 	c.UpdateLastActivity()
@@ -310,7 +352,12 @@ func (c *Connection) ReadDir(name string) ([]os.FileInfo, error) {
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
-	return c.ListDir(p, name)
+	lister, err := c.ListDir(p, name)
+	if err != nil {
+		return nil, err
+	}
+	// ftpserverlib requires the whole directory contents
+	return vfs.ReadAllDir(lister)
 }
 
 // GetHandle implements ClientDriverExtentionFileTransfer
@@ -389,7 +436,20 @@ func (c *Connection) uploadFile(fsPath, ftpPath string, flags int) (ftpserver.Fi
 		return nil, c.GetPermissionDeniedError()
 	}
 
-	return c.handleFTPUploadToExistingFile(flags, fsPath, filePath, stat.Size(), ftpPath)
+	if err := c.CheckRetentionLock(fsPath, ftpPath, stat); err != nil {
+		return nil, err
+	}
+
+	if vfs.IsOverlayLowerFile(c.Fs, fsPath) {
+		// read-only lower layer files are not included in the quota, they are replaced
+		// uploading a new file to the upper layer so resume and append are not supported
+		if flags&os.O_TRUNC == 0 {
+			return nil, c.GetOpUnsupportedError()
+		}
+		return c.handleFTPUploadToNewFile(fsPath, filePath, ftpPath)
+	}
+
+	return c.handleFTPUploadToExistingFile(flags, fsPath, filePath, vfs.GetQuotaSize(stat), ftpPath)
 }
 
 func (c *Connection) handleFTPUploadToNewFile(resolvedPath, filePath, requestPath string) (ftpserver.FileTransfer, error) {
@@ -459,6 +519,12 @@ func (c *Connection) handleFTPUploadToExistingFile(flags int, resolvedPath, file
 		c.Log(logger.LevelDebug, "upload resume requested, file path: %#v initial size: %v", filePath, fileSize)
 		minWriteOffset = fileSize
 		initialSize = fileSize
+		if vfs.IsCryptOsFs(c.Fs) {
+			// the write offset is based on the plaintext size
+			if info, err := file.Stat(); err == nil {
+				minWriteOffset = info.Size()
+			}
+		}
 		if vfs.IsSFTPFs(c.Fs) {
 			// we need this since we don't allow resume with wrong offset, we should fix this in pkg/sftp
 			file.Seek(initialSize, io.SeekStart) //nolint:errcheck // for sftp seek cannot file, it simply set the offset
@@ -483,7 +549,7 @@ func (c *Connection) handleFTPUploadToExistingFile(flags int, resolvedPath, file
 
 	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, resolvedPath, requestPath,
 		common.TransferUpload, minWriteOffset, initialSize, maxWriteSize, false, c.Fs)
-	t := newTransfer(baseTransfer, w, nil, 0)
+	t := newTransfer(baseTransfer, w, nil, minWriteOffset)
 
 	return t, nil
 }
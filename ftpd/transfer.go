@@ -62,6 +62,7 @@ func (t *transfer) Write(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
 
 	n, err = t.writer.Write(p)
+	t.SniffContent(p[:n], t.MinWriteOffset+atomic.LoadInt64(&t.BytesReceived))
 	atomic.AddInt64(&t.BytesReceived, int64(n))
 
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
@@ -85,7 +86,9 @@ func (t *transfer) Seek(offset int64, whence int) (int64, error) {
 		}
 		return ret, err
 	}
-	if t.reader != nil && t.expectedOffset == offset && whence == io.SeekStart {
+	// for pipe based transfers we can only seek to the expected offset, a download from
+	// a given offset or an upload resumed by the underlying filesystem
+	if (t.reader != nil || t.writer != nil) && t.expectedOffset == offset && whence == io.SeekStart {
 		return offset, nil
 	}
 	t.TransferError(errors.New("seek is unsupported for this transfer"))
@@ -29,7 +29,7 @@ require (
 	github.com/miekg/dns v1.1.35 // indirect
 	github.com/minio/sha256-simd v0.1.1
 	github.com/minio/sio v0.2.1
-	github.com/mitchellh/mapstructure v1.4.1 // indirect
+	github.com/mitchellh/mapstructure v1.4.1
 	github.com/otiai10/copy v1.4.2
 	github.com/pelletier/go-toml v1.8.1 // indirect
 	github.com/pires/go-proxyproto v0.3.3
@@ -0,0 +1,164 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"path"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+type fileVersionsUsage struct {
+	UsedFiles int   `json:"used_files"`
+	UsedSize  int64 `json:"used_size"`
+}
+
+func getFileVersions(w http.ResponseWriter, r *http.Request) {
+	virtualPath := r.URL.Query().Get("path")
+	if virtualPath == "" {
+		sendAPIResponse(w, r, nil, "path is mandatory", http.StatusBadRequest)
+		return
+	}
+	_, fs, err := getUserVersionedFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	versions, err := fs.ListVersions(virtualPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	if versions == nil {
+		versions = []vfs.FileVersion{}
+	}
+	render.JSON(w, r, versions)
+}
+
+func getFileVersionsUsage(w http.ResponseWriter, r *http.Request) {
+	_, fs, err := getUserVersionedFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	numFiles, size, err := fs.GetVersionsUsage()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	render.JSON(w, r, fileVersionsUsage{
+		UsedFiles: numFiles,
+		UsedSize:  size,
+	})
+}
+
+func restoreFileVersion(w http.ResponseWriter, r *http.Request) {
+	virtualPath := r.URL.Query().Get("path")
+	versionID := r.URL.Query().Get("id")
+	if virtualPath == "" || versionID == "" {
+		sendAPIResponse(w, r, nil, "path and id are mandatory", http.StatusBadRequest)
+		return
+	}
+	user, fs, err := getUserVersionedFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	virtualPath = path.Clean("/" + virtualPath)
+	fsPath, err := fs.ResolvePath(virtualPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	numFiles := 1
+	var initialSize int64
+	if info, err := fs.Stat(fsPath); err == nil && info.Mode().IsRegular() {
+		numFiles = 0
+		initialSize = vfs.GetQuotaSize(info)
+	}
+	if err = fs.RestoreVersion(virtualPath, versionID); err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	info, err := fs.Stat(fsPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	updateRestoredFileQuota(user, virtualPath, numFiles, vfs.GetQuotaSize(info)-initialSize)
+	common.AddReplicationJob(user.Username, dataprovider.ReplicationActionUpload, virtualPath, "")
+	logger.Debug(logSender, "", "version %#v restored for path %#v, user %#v", versionID, virtualPath, user.Username)
+	sendAPIResponse(w, r, nil, "Version restored", http.StatusOK)
+}
+
+func purgeFileVersions(w http.ResponseWriter, r *http.Request) {
+	virtualPath := r.URL.Query().Get("path")
+	if virtualPath == "" {
+		sendAPIResponse(w, r, nil, "path is mandatory", http.StatusBadRequest)
+		return
+	}
+	_, fs, err := getUserVersionedFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	numVersions, err := fs.PurgeVersions(virtualPath, r.URL.Query().Get("id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getFileVersionsRespStatus(fs, err))
+		return
+	}
+	render.JSON(w, r, map[string]int{"removed": numVersions})
+}
+
+func getUserVersionedFs(username string) (dataprovider.User, *vfs.VersionedFs, error) {
+	user, err := dataprovider.UserExists(username)
+	if err != nil {
+		return user, nil, err
+	}
+	if !user.FsConfig.VersioningConfig.IsEnabled() {
+		return user, nil, dataprovider.NewValidationError("versioning is not enabled for this user")
+	}
+	fs, err := user.GetVersionedFilesystem("")
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the versioned filesystem for user %#v: %v", user.Username, err)
+	}
+	return user, fs, err
+}
+
+func getFileVersionsRespStatus(fs vfs.Fs, err error) int {
+	if errors.Is(err, vfs.ErrInvalidVersionID) {
+		return http.StatusBadRequest
+	}
+	if fs.IsNotExist(err) {
+		return http.StatusNotFound
+	}
+	if fs.IsPermission(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func updateRestoredFileQuota(user dataprovider.User, virtualPath string, numFiles int, sizeDiff int64) {
+	vfolder, err := user.GetVirtualFolderForPath(path.Dir(virtualPath))
+	if err == nil {
+		dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, numFiles, sizeDiff, false) //nolint:errcheck
+		if vfolder.IsIncludedInUserQuota() {
+			dataprovider.UpdateUserQuota(user, numFiles, sizeDiff, false) //nolint:errcheck
+		}
+	} else {
+		dataprovider.UpdateUserQuota(user, numFiles, sizeDiff, false) //nolint:errcheck
+	}
+}
@@ -0,0 +1,58 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+func getReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	limit := 100
+	offset := 0
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	status, err := common.GetReplicationStatus(limit, offset)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+func startReplicationResync(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if err := common.ResyncReplication(username); err != nil {
+		if errors.Is(err, common.ErrReplicationDisabled) {
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	logger.Debug(logSender, "", "replication resync queued, username: %#v", username)
+	sendAPIResponse(w, r, nil, "Resync started", http.StatusAccepted)
+}
@@ -0,0 +1,49 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+func getTieringReport(w http.ResponseWriter, r *http.Request) {
+	handleTieringPolicy(w, r, true)
+}
+
+func applyTieringPolicy(w http.ResponseWriter, r *http.Request) {
+	handleTieringPolicy(w, r, false)
+}
+
+func handleTieringPolicy(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	user, err := dataprovider.UserExists(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if !vfs.IsTieringEnabled() {
+		sendAPIResponse(w, r, nil, "storage tiering is not configured", http.StatusBadRequest)
+		return
+	}
+	if !user.FsConfig.TieringConfig.IsEnabled() {
+		sendAPIResponse(w, r, nil, "tiering is not enabled for this user", http.StatusBadRequest)
+		return
+	}
+	report, err := common.ApplyTieringPolicy(&user, dryRun)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to apply the tiering policy for user %#v, dry run: %v, error: %v",
+			user.Username, dryRun, err)
+		if errors.Is(err, common.ErrTieringInProgress) {
+			sendAPIResponse(w, r, err, "", http.StatusConflict)
+			return
+		}
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, report)
+}
@@ -0,0 +1,135 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+type trashUsage struct {
+	UsedFiles int   `json:"used_files"`
+	UsedSize  int64 `json:"used_size"`
+}
+
+func getTrashItems(w http.ResponseWriter, r *http.Request) {
+	_, fs, err := getUserTrashFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	items, err := fs.ListTrash()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(fs, err))
+		return
+	}
+	if items == nil {
+		items = []vfs.TrashItem{}
+	}
+	render.JSON(w, r, items)
+}
+
+func getTrashUsage(w http.ResponseWriter, r *http.Request) {
+	_, fs, err := getUserTrashFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	numFiles, size, err := fs.GetTrashUsage()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(fs, err))
+		return
+	}
+	render.JSON(w, r, trashUsage{
+		UsedFiles: numFiles,
+		UsedSize:  size,
+	})
+}
+
+func restoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	virtualPath := r.URL.Query().Get("path")
+	itemID := r.URL.Query().Get("id")
+	if virtualPath == "" || itemID == "" {
+		sendAPIResponse(w, r, nil, "path and id are mandatory", http.StatusBadRequest)
+		return
+	}
+	user, fs, err := getUserTrashFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	item, err := fs.RestoreTrashItem(virtualPath, itemID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(fs, err))
+		return
+	}
+	updateRestoredFileQuota(user, item.Path, item.Files, item.Size)
+	common.AddReplicationJob(user.Username, dataprovider.ReplicationActionUpload, item.Path, "")
+	logger.Debug(logSender, "", "trash item %#v restored to path %#v, user %#v", itemID, item.Path, user.Username)
+	sendAPIResponse(w, r, nil, "Item restored", http.StatusOK)
+}
+
+func purgeTrashItems(w http.ResponseWriter, r *http.Request) {
+	virtualPath := r.URL.Query().Get("path")
+	itemID := r.URL.Query().Get("id")
+	if itemID != "" && virtualPath == "" {
+		sendAPIResponse(w, r, nil, "path is mandatory if an id is specified", http.StatusBadRequest)
+		return
+	}
+	user, fs, err := getUserTrashFs(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	defer fs.Close()
+
+	items, err := fs.PurgeTrash(virtualPath, itemID)
+	common.NotifyTrashPurge(&user, fs, items, common.ProtocolHTTP)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(fs, err))
+		return
+	}
+	render.JSON(w, r, map[string]int{"removed": len(items)})
+}
+
+func getUserTrashFs(username string) (dataprovider.User, *vfs.TrashFs, error) {
+	user, err := dataprovider.UserExists(username)
+	if err != nil {
+		return user, nil, err
+	}
+	if !user.FsConfig.TrashConfig.IsEnabled() {
+		return user, nil, dataprovider.NewValidationError("the trash is not enabled for this user")
+	}
+	fs, err := user.GetTrashFilesystem("")
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the trash filesystem for user %#v: %v", user.Username, err)
+	}
+	return user, fs, err
+}
+
+func getTrashRespStatus(fs vfs.Fs, err error) int {
+	if errors.Is(err, vfs.ErrInvalidTrashItemID) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, vfs.ErrTrashRestoreTarget) {
+		return http.StatusConflict
+	}
+	if fs.IsNotExist(err) {
+		return http.StatusNotFound
+	}
+	if fs.IsPermission(err) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -91,6 +91,10 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 			sendAPIResponse(w, r, errors.New("invalid access_secret"), "", http.StatusBadRequest)
 			return
 		}
+		if user.FsConfig.S3Config.SSECustomerKey.IsRedacted() {
+			sendAPIResponse(w, r, errors.New("invalid sse_customer_key"), "", http.StatusBadRequest)
+			return
+		}
 	case dataprovider.GCSFilesystemProvider:
 		if user.FsConfig.GCSConfig.Credentials.IsRedacted() {
 			sendAPIResponse(w, r, errors.New("invalid credentials"), "", http.StatusBadRequest)
@@ -101,11 +105,6 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 			sendAPIResponse(w, r, errors.New("invalid account_key"), "", http.StatusBadRequest)
 			return
 		}
-	case dataprovider.CryptedFilesystemProvider:
-		if user.FsConfig.CryptConfig.Passphrase.IsRedacted() {
-			sendAPIResponse(w, r, errors.New("invalid passphrase"), "", http.StatusBadRequest)
-			return
-		}
 	case dataprovider.SFTPFilesystemProvider:
 		if user.FsConfig.SFTPConfig.Password.IsRedacted() {
 			sendAPIResponse(w, r, errors.New("invalid SFTP password"), "", http.StatusBadRequest)
@@ -115,6 +114,22 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 			sendAPIResponse(w, r, errors.New("invalid SFTP private key"), "", http.StatusBadRequest)
 			return
 		}
+	case dataprovider.WebDAVFilesystemProvider:
+		if user.FsConfig.WebDAVConfig.Password.IsRedacted() {
+			sendAPIResponse(w, r, errors.New("invalid WebDAV password"), "", http.StatusBadRequest)
+			return
+		}
+	case dataprovider.FTPFilesystemProvider:
+		if user.FsConfig.FTPConfig.Password.IsRedacted() {
+			sendAPIResponse(w, r, errors.New("invalid FTP password"), "", http.StatusBadRequest)
+			return
+		}
+	}
+	// the passphrase is used for the crypt filesystem and to encrypt the files
+	// stored on remote filesystems
+	if user.FsConfig.Provider != dataprovider.LocalFilesystemProvider && user.FsConfig.CryptConfig.Passphrase.IsRedacted() {
+		sendAPIResponse(w, r, errors.New("invalid passphrase"), "", http.StatusBadRequest)
+		return
 	}
 	err = dataprovider.AddUser(&user)
 	if err != nil {
@@ -146,11 +161,14 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	userID := user.ID
 	currentPermissions := user.Permissions
 	currentS3AccessSecret := user.FsConfig.S3Config.AccessSecret
+	currentS3SSECustomerKey := user.FsConfig.S3Config.SSECustomerKey
 	currentAzAccountKey := user.FsConfig.AzBlobConfig.AccountKey
 	currentGCSCredentials := user.FsConfig.GCSConfig.Credentials
 	currentCryptoPassphrase := user.FsConfig.CryptConfig.Passphrase
 	currentSFTPPassword := user.FsConfig.SFTPConfig.Password
 	currentSFTPKey := user.FsConfig.SFTPConfig.PrivateKey
+	currentWebDAVPassword := user.FsConfig.WebDAVConfig.Password
+	currentFTPPassword := user.FsConfig.FTPConfig.Password
 
 	user.Permissions = make(map[string][]string)
 	user.FsConfig.S3Config = vfs.S3FsConfig{}
@@ -158,6 +176,13 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{}
+	user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+	user.FsConfig.OverlayConfig = vfs.OverlayFsConfig{}
+	user.FsConfig.CacheConfig = vfs.CacheFsConfig{}
+	user.FsConfig.CompressionConfig = vfs.CompressionFsConfig{}
+	user.FsConfig.VersioningConfig = vfs.VersioningConfig{}
+	user.FsConfig.TrashConfig = vfs.TrashConfig{}
 	err = render.DecodeJSON(r.Body, &user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
@@ -170,8 +195,8 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if len(user.Permissions) == 0 {
 		user.Permissions = currentPermissions
 	}
-	updateEncryptedSecrets(&user, currentS3AccessSecret, currentAzAccountKey, currentGCSCredentials, currentCryptoPassphrase,
-		currentSFTPPassword, currentSFTPKey)
+	updateEncryptedSecrets(&user, currentS3AccessSecret, currentS3SSECustomerKey, currentAzAccountKey, currentGCSCredentials,
+		currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey, currentWebDAVPassword, currentFTPPassword)
 	err = dataprovider.UpdateUser(&user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -202,14 +227,18 @@ func disconnectUser(username string) {
 	}
 }
 
-func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, currentAzAccountKey,
-	currentGCSCredentials, currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey *kms.Secret) {
+func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, currentS3SSECustomerKey, currentAzAccountKey,
+	currentGCSCredentials, currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey, currentWebDAVPassword,
+	currentFTPPassword *kms.Secret) {
 	// we use the new access secret if plain or empty, otherwise the old value
 	switch user.FsConfig.Provider {
 	case dataprovider.S3FilesystemProvider:
 		if user.FsConfig.S3Config.AccessSecret.IsNotPlainAndNotEmpty() {
 			user.FsConfig.S3Config.AccessSecret = currentS3AccessSecret
 		}
+		if user.FsConfig.S3Config.SSECustomerKey.IsNotPlainAndNotEmpty() {
+			user.FsConfig.S3Config.SSECustomerKey = currentS3SSECustomerKey
+		}
 	case dataprovider.AzureBlobFilesystemProvider:
 		if user.FsConfig.AzBlobConfig.AccountKey.IsNotPlainAndNotEmpty() {
 			user.FsConfig.AzBlobConfig.AccountKey = currentAzAccountKey
@@ -218,10 +247,6 @@ func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, curr
 		if user.FsConfig.GCSConfig.Credentials.IsNotPlainAndNotEmpty() {
 			user.FsConfig.GCSConfig.Credentials = currentGCSCredentials
 		}
-	case dataprovider.CryptedFilesystemProvider:
-		if user.FsConfig.CryptConfig.Passphrase.IsNotPlainAndNotEmpty() {
-			user.FsConfig.CryptConfig.Passphrase = currentCryptoPassphrase
-		}
 	case dataprovider.SFTPFilesystemProvider:
 		if user.FsConfig.SFTPConfig.Password.IsNotPlainAndNotEmpty() {
 			user.FsConfig.SFTPConfig.Password = currentSFTPPassword
@@ -229,5 +254,18 @@ func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, curr
 		if user.FsConfig.SFTPConfig.PrivateKey.IsNotPlainAndNotEmpty() {
 			user.FsConfig.SFTPConfig.PrivateKey = currentSFTPKey
 		}
+	case dataprovider.WebDAVFilesystemProvider:
+		if user.FsConfig.WebDAVConfig.Password.IsNotPlainAndNotEmpty() {
+			user.FsConfig.WebDAVConfig.Password = currentWebDAVPassword
+		}
+	case dataprovider.FTPFilesystemProvider:
+		if user.FsConfig.FTPConfig.Password.IsNotPlainAndNotEmpty() {
+			user.FsConfig.FTPConfig.Password = currentFTPPassword
+		}
+	}
+	// the passphrase is used for the crypt filesystem and for the client-side
+	// encryption on remote filesystems
+	if user.FsConfig.CryptConfig.Passphrase.IsNotPlainAndNotEmpty() {
+		user.FsConfig.CryptConfig.Passphrase = currentCryptoPassphrase
 	}
 }
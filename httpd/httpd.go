@@ -42,7 +42,12 @@ const (
 	defenderScore             = "/api/v2/defender/score"
 	adminPath                 = "/api/v2/admins"
 	adminPwdPath              = "/api/v2/changepwd/admin"
+	fileVersionsPath          = "/api/v2/file-versions"
+	trashPath                 = "/api/v2/trash"
+	tieringPath               = "/api/v2/tiering"
+	replicationPath           = "/api/v2/replication"
 	healthzPath               = "/healthz"
+	readyzPath                = "/readyz"
 	webBasePath               = "/web"
 	webLoginPath              = "/web/login"
 	webLogoutPath             = "/web/logout"
@@ -56,6 +61,7 @@ const (
 	webAdminPath              = "/web/admin"
 	webScanVFolderPath        = "/web/folder-quota-scans"
 	webQuotaScanPath          = "/web/quota-scans"
+	webTrashPath              = "/web/trash"
 	webChangeAdminPwdPath     = "/web/changepwd/admin"
 	webStaticFilesPath        = "/static"
 	// MaxRestoreSize defines the max size for the loaddata input file
@@ -112,6 +118,7 @@ type ServicesStatus struct {
 	WebDAV       webdavd.ServiceStatus       `json:"webdav"`
 	DataProvider dataprovider.ProviderStatus `json:"data_provider"`
 	Defender     defenderStatus              `json:"defender"`
+	HealthChecks common.HealthStatus         `json:"health_checks"`
 }
 
 // Conf httpd daemon configuration
@@ -243,6 +250,7 @@ func getServicesStatus() ServicesStatus {
 		Defender: defenderStatus{
 			IsActive: common.Config.DefenderConfig.Enabled,
 		},
+		HealthChecks: common.GetHealthStatus(),
 	}
 	return status
 }
@@ -3,6 +3,7 @@ package httpd_test
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -62,6 +63,7 @@ const (
 	defenderUnban             = "/api/v2/defender/unban"
 	versionPath               = "/api/v2/version"
 	healthzPath               = "/healthz"
+	readyzPath                = "/readyz"
 	webBasePath               = "/web"
 	webLoginPath              = "/web/login"
 	webLogoutPath             = "/web/logout"
@@ -554,6 +556,67 @@ func TestAddUserInvalidFilters(t *testing.T) {
 	}
 	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/subdir",
+			HiddenPatterns: []string{"[a-"},
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.FilePatterns = nil
+	u.Filters.MimeTypes = []dataprovider.MimeTypesFilter{
+		{
+			Path:             "/subdir",
+			AllowedMimeTypes: []string{"application"},
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.MimeTypes = []dataprovider.MimeTypesFilter{
+		{
+			Path: "/subdir",
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.MimeTypes = nil
+	u.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "relative",
+			Days: 1,
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/subdir",
+			Days: -1,
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/subdir",
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/subdir",
+			Days: 1,
+		},
+		{
+			Path:      "/subdir/",
+			LegalHold: true,
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.Retention = nil
 	u.Filters.DeniedProtocols = []string{"invalid"}
 	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
@@ -595,6 +658,26 @@ func TestAddUserInvalidFsConfig(t *testing.T) {
 	u.FsConfig.S3Config.UploadConcurrency = -1
 	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
+	u.FsConfig.S3Config.UploadConcurrency = 0
+	u.FsConfig.S3Config.SSEType = "invalid"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.S3Config.SSEType = vfs.S3SSETypeCustomer
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.S3Config.SSECustomerKey = kms.NewPlainSecret("short key")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.S3Config.SSECustomerKey = kms.NewSecret(kms.SecretStatusRedacted, "12345678901234567890123456789012", "", "")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.S3Config.SSECustomerKey = kms.NewSecret(kms.SecretStatusSecretBox, "12345678901234567890123456789012", "", "")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.S3Config.SSEType = ""
+	u.FsConfig.S3Config.ACL = "invalid"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
 	u = getTestUser()
 	u.FsConfig.Provider = dataprovider.GCSFilesystemProvider
 	u.FsConfig.GCSConfig.Bucket = ""
@@ -663,6 +746,113 @@ func TestAddUserInvalidFsConfig(t *testing.T) {
 	u.FsConfig.SFTPConfig.PrivateKey = kms.NewSecret(kms.SecretStatusRedacted, "keyforpkey", "", "")
 	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.Provider = dataprovider.WebDAVFilesystemProvider
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.WebDAVConfig.Endpoint = "ftp://127.0.0.1/dav"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.WebDAVConfig.Endpoint = "http://127.0.0.1/dav"
+	u.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret("pwd")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.WebDAVConfig.Username = "user"
+	u.FsConfig.WebDAVConfig.Password = kms.NewSecret(kms.SecretStatusRedacted, "randompwd", "", "")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret("pwd")
+	u.FsConfig.WebDAVConfig.CACertificate = "invalid cert"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.Provider = dataprovider.FTPFilesystemProvider
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.FTPConfig.Endpoint = "127.0.0.1"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.FTPConfig.Endpoint = "127.0.0.1:21"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.FTPConfig.Username = "user"
+	u.FsConfig.FTPConfig.Password = kms.NewSecret(kms.SecretStatusRedacted, "randompwd", "", "")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.FTPConfig.Password = kms.NewPlainSecret("pwd")
+	u.FsConfig.FTPConfig.TLSMode = 3
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	u.FsConfig.MemoryConfig.MaxSize = -1
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.OverlayConfig.LowerPath = "relative/path"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.OverlayConfig.LowerPath = filepath.Join(u.HomeDir, "lower")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.OverlayConfig.LowerPath = filepath.Join(os.TempDir(), "lower")
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: filepath.Join(os.TempDir(), "mapped"),
+		},
+		VirtualPath: "/vdir",
+	})
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.CacheConfig.Mode = 3
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.FsConfig.CompressionConfig.Algorithm = "zip"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.CompressionConfig.Algorithm = vfs.CompressionAlgoGzip
+	u.FsConfig.CompressionConfig.Level = 10
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.CompressionConfig.Level = 6
+	u.FsConfig.CompressionConfig.QuotaMode = 2
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.CompressionConfig.QuotaMode = vfs.CompressionQuotaPhysical
+	u.FsConfig.CompressionConfig.Paths = []string{"relative"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.CompressionConfig.Paths = []string{"/logs"}
+	u.FsConfig.Provider = dataprovider.CryptedFilesystemProvider
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("crypt passphrase")
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+}
+
+func TestUserCompressionConfig(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.CompressionConfig.Algorithm = vfs.CompressionAlgoGzip
+	u.FsConfig.CompressionConfig.Level = 9
+	u.FsConfig.CompressionConfig.QuotaMode = vfs.CompressionQuotaPhysical
+	u.FsConfig.CompressionConfig.Paths = []string{"/logs", "/data"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/logs", "/data"}, user.FsConfig.CompressionConfig.Paths)
+	user.FsConfig.CompressionConfig.Level = 0
+	user.FsConfig.CompressionConfig.Paths = nil
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, user.FsConfig.CompressionConfig.Level)
+	assert.Len(t, user.FsConfig.CompressionConfig.Paths, 0)
+	// disabling the compression resets the other settings
+	user.FsConfig.CompressionConfig.Algorithm = ""
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.CompressionFsConfig{}, user.FsConfig.CompressionConfig)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
 }
 
 func TestAddUserInvalidVirtualFolders(t *testing.T) {
@@ -896,6 +1086,11 @@ func TestUpdateUser(t *testing.T) {
 		Path:            "/subdir",
 		AllowedPatterns: []string{"*.zip", "*.rar"},
 		DeniedPatterns:  []string{"*.jpg", "*.png"},
+		HiddenPatterns:  []string{".*"},
+	})
+	user.Filters.FilePatterns = append(user.Filters.FilePatterns, dataprovider.PatternsFilter{
+		Path:        "/dropbox",
+		DenyListing: true,
 	})
 	user.Filters.MaxUploadFileSize = 4096
 	user.UploadBandwidth = 1024
@@ -1202,6 +1397,39 @@ func TestUserS3Config(t *testing.T) {
 	assert.Equal(t, initialSecretPayload, user.FsConfig.S3Config.AccessSecret.GetPayload())
 	assert.Empty(t, user.FsConfig.S3Config.AccessSecret.GetAdditionalData())
 	assert.Empty(t, user.FsConfig.S3Config.AccessSecret.GetKey())
+	// server-side encryption with a customer key and ACL
+	user.FsConfig.S3Config.SSEType = vfs.S3SSETypeCustomer
+	user.FsConfig.S3Config.SSECustomerKey = kms.NewPlainSecret(base64.StdEncoding.EncodeToString(
+		[]byte("12345678901234567890123456789012")))
+	user.FsConfig.S3Config.ACL = "bucket-owner-full-control"
+	user.FsConfig.S3Config.ForcePathStyle = true
+	user.FsConfig.S3Config.ListMetadata = true
+	user.FsConfig.S3Config.EmulateSymlinks = true
+	user.FsConfig.S3Config.ObjectLockMode = "LOCKED"
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	user.FsConfig.S3Config.ObjectLockMode = vfs.S3ObjectLockModeCompliance
+	user, bb, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(bb))
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.S3Config.SSECustomerKey.GetStatus())
+	assert.NotEmpty(t, user.FsConfig.S3Config.SSECustomerKey.GetPayload())
+	sseCustomerKeyPayload := user.FsConfig.S3Config.SSECustomerKey.GetPayload()
+	// the encrypted key is preserved on update
+	user, bb, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(bb))
+	assert.Equal(t, sseCustomerKeyPayload, user.FsConfig.S3Config.SSECustomerKey.GetPayload())
+	user.FsConfig.S3Config.SSEType = vfs.S3SSETypeKMS
+	user.FsConfig.S3Config.SSEKMSKeyID = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	user.FsConfig.S3Config.SSECustomerKey = kms.NewEmptySecret()
+	user, bb, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(bb))
+	user.FsConfig.S3Config.SSEType = ""
+	user.FsConfig.S3Config.SSEKMSKeyID = ""
+	user.FsConfig.S3Config.ACL = ""
+	user.FsConfig.S3Config.ForcePathStyle = false
+	user.FsConfig.S3Config.ListMetadata = false
+	user.FsConfig.S3Config.EmulateSymlinks = false
+	user.FsConfig.S3Config.ObjectLockMode = ""
 	// test user without access key and access secret (shared config state)
 	user.FsConfig.Provider = dataprovider.S3FilesystemProvider
 	user.FsConfig.S3Config.Bucket = "testbucket"
@@ -1430,6 +1658,40 @@ func TestUserCryptFs(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUserRemoteFsEncryption(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = dataprovider.SFTPFilesystemProvider
+	u.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:2022"
+	u.FsConfig.SFTPConfig.Username = "sftp_user"
+	u.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("sftp_pwd")
+	u.FsConfig.CryptConfig.Passphrase = kms.NewSecret(kms.SecretStatusRedacted, "passphrase", "", "")
+	_, _, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("remote passphrase")
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	initialPayload := user.FsConfig.CryptConfig.Passphrase.GetPayload()
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.CryptConfig.Passphrase.GetStatus())
+	assert.NotEmpty(t, initialPayload)
+	assert.Empty(t, user.FsConfig.CryptConfig.Passphrase.GetAdditionalData())
+	assert.Empty(t, user.FsConfig.CryptConfig.Passphrase.GetKey())
+	// an encrypted passphrase sent back is ignored and the current one is kept
+	user.FsConfig.CryptConfig.Passphrase.SetKey("fake pass key")
+	user, bb, err := httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(bb))
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.CryptConfig.Passphrase.GetStatus())
+	assert.Equal(t, initialPayload, user.FsConfig.CryptConfig.Passphrase.GetPayload())
+	assert.Empty(t, user.FsConfig.CryptConfig.Passphrase.GetKey())
+	// an empty passphrase disables the encryption
+	user.FsConfig.CryptConfig.Passphrase = kms.NewEmptySecret()
+	user, bb, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(bb))
+	assert.True(t, user.FsConfig.CryptConfig.Passphrase.IsEmpty())
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
 func TestUserSFTPFs(t *testing.T) {
 	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
 	assert.NoError(t, err)
@@ -1505,6 +1767,95 @@ func TestUserSFTPFs(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUserWebDAVFs(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	user.FsConfig.Provider = dataprovider.WebDAVFilesystemProvider
+	user.FsConfig.WebDAVConfig.Endpoint = "http://127.0.0.1:8090/dav/"
+	user.FsConfig.WebDAVConfig.Username = "dav_user"
+	user.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret("dav_pwd")
+	user.FsConfig.WebDAVConfig.Prefix = "/remote/dir"
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	initialPwdPayload := user.FsConfig.WebDAVConfig.Password.GetPayload()
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.WebDAVConfig.Password.GetStatus())
+	assert.NotEmpty(t, initialPwdPayload)
+	assert.Empty(t, user.FsConfig.WebDAVConfig.Password.GetAdditionalData())
+	assert.Empty(t, user.FsConfig.WebDAVConfig.Password.GetKey())
+	// the password must be preserved if the secret is redacted
+	user.FsConfig.WebDAVConfig.Password.SetStatus(kms.SecretStatusSecretBox)
+	user.FsConfig.WebDAVConfig.Password.SetAdditionalData("adata")
+	user.FsConfig.WebDAVConfig.Password.SetKey("fake pwd key")
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.WebDAVConfig.Password.GetStatus())
+	assert.Equal(t, initialPwdPayload, user.FsConfig.WebDAVConfig.Password.GetPayload())
+	assert.Empty(t, user.FsConfig.WebDAVConfig.Password.GetAdditionalData())
+	assert.Empty(t, user.FsConfig.WebDAVConfig.Password.GetKey())
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
+func TestUserFTPFs(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	user.FsConfig.Provider = dataprovider.FTPFilesystemProvider
+	user.FsConfig.FTPConfig.Endpoint = "127.0.0.1:21"
+	user.FsConfig.FTPConfig.Username = "ftp_user"
+	user.FsConfig.FTPConfig.Password = kms.NewPlainSecret("ftp_pwd")
+	user.FsConfig.FTPConfig.TLSMode = vfs.FTPTLSModeExplicit
+	user.FsConfig.FTPConfig.DisableEPSV = true
+	user.FsConfig.FTPConfig.ActiveMode = true
+	user.FsConfig.FTPConfig.Prefix = "/remote/dir"
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	initialPwdPayload := user.FsConfig.FTPConfig.Password.GetPayload()
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.FTPConfig.Password.GetStatus())
+	assert.NotEmpty(t, initialPwdPayload)
+	assert.Empty(t, user.FsConfig.FTPConfig.Password.GetAdditionalData())
+	assert.Empty(t, user.FsConfig.FTPConfig.Password.GetKey())
+	// the password must be preserved if the secret is redacted
+	user.FsConfig.FTPConfig.Password.SetStatus(kms.SecretStatusSecretBox)
+	user.FsConfig.FTPConfig.Password.SetAdditionalData("adata")
+	user.FsConfig.FTPConfig.Password.SetKey("fake pwd key")
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.FTPConfig.Password.GetStatus())
+	assert.Equal(t, initialPwdPayload, user.FsConfig.FTPConfig.Password.GetPayload())
+	assert.Empty(t, user.FsConfig.FTPConfig.Password.GetAdditionalData())
+	assert.Empty(t, user.FsConfig.FTPConfig.Password.GetKey())
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
+func TestUserMemoryFs(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = dataprovider.FTPFilesystemProvider
+	u.FsConfig.FTPConfig.Endpoint = "127.0.0.1:21"
+	u.FsConfig.FTPConfig.Username = "ftp_user"
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	user.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	user.FsConfig.MemoryConfig.MaxSize = 1048576
+	// the FTP configuration is reset
+	user.FsConfig.FTPConfig = vfs.FTPFsConfig{}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1048576), user.FsConfig.MemoryConfig.MaxSize)
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Empty(t, user.FsConfig.FTPConfig.Endpoint)
+	assert.Equal(t, dataprovider.MemoryFilesystemProvider, user.FsConfig.Provider)
+	user.FsConfig.MemoryConfig.MaxSize = -1
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
 func TestUserHiddenFields(t *testing.T) {
 	err := dataprovider.Close()
 	assert.NoError(t, err)
@@ -2033,6 +2384,107 @@ func TestGetStatus(t *testing.T) {
 	assert.Error(t, err, "get provider status request must succeed, we requested to check a wrong status code")
 }
 
+func TestHealthChecksStatus(t *testing.T) {
+	healthChecksConfig := common.Config.HealthChecks
+	common.Config.HealthChecks.CacheTime = 60
+	common.Config.HealthChecks.MaxSamples = 5
+	defer func() {
+		common.Config.HealthChecks = healthChecksConfig
+	}()
+
+	healthStatus := common.UpdateHealthStatus()
+	assert.True(t, healthStatus.Ready)
+	assert.Greater(t, healthStatus.CheckedAt, int64(0))
+	// the status endpoint returns the cached results
+	status, _, err := httpdtest.GetStatus(http.StatusOK)
+	assert.NoError(t, err)
+	assert.True(t, status.HealthChecks.Ready)
+	assert.Equal(t, healthStatus.CheckedAt, status.HealthChecks.CheckedAt)
+	checks := make(map[string]common.HealthCheck)
+	for _, check := range status.HealthChecks.Checks {
+		assert.True(t, check.Healthy, "check %+v", check)
+		checks[check.Check] = check
+	}
+	assert.Contains(t, checks, common.HealthCheckDataProvider)
+	assert.Contains(t, checks, common.HealthCheckKMS)
+	assert.NotEmpty(t, checks[common.HealthCheckKMS].Target)
+	// unreachable SFTP and WebDAV endpoints and a home dir that is not a directory
+	u := getTestUser()
+	u.Username += "_sftp"
+	u.FsConfig.Provider = dataprovider.SFTPFilesystemProvider
+	u.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:1"
+	u.FsConfig.SFTPConfig.Username = "user"
+	u.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("pwd")
+	sftpUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.Username += "_webdav"
+	u.FsConfig.Provider = dataprovider.WebDAVFilesystemProvider
+	u.FsConfig.WebDAVConfig.Endpoint = "http://127.0.0.1:1/dav"
+	u.FsConfig.WebDAVConfig.Username = "user"
+	u.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret("pwd")
+	webDAVUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.Username += "_local"
+	u.HomeDir = filepath.Join(os.TempDir(), "home_file")
+	localUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(localUser.GetHomeDir(), []byte("content"), os.ModePerm)
+	assert.NoError(t, err)
+	// the cached results are not expired
+	status, _, err = httpdtest.GetStatus(http.StatusOK)
+	assert.NoError(t, err)
+	assert.True(t, status.HealthChecks.Ready)
+
+	healthStatus = common.UpdateHealthStatus()
+	assert.False(t, healthStatus.Ready)
+	status, _, err = httpdtest.GetStatus(http.StatusOK)
+	assert.NoError(t, err)
+	assert.False(t, status.HealthChecks.Ready)
+	failedChecks := make(map[string]common.HealthCheck)
+	for _, check := range status.HealthChecks.Checks {
+		if !check.Healthy {
+			assert.NotEmpty(t, check.Error)
+			failedChecks[check.Check] = check
+		}
+	}
+	if assert.Contains(t, failedChecks, common.HealthCheckSFTP) {
+		assert.Equal(t, "user@127.0.0.1:1", failedChecks[common.HealthCheckSFTP].Target)
+	}
+	if assert.Contains(t, failedChecks, common.HealthCheckWebDAV) {
+		assert.Equal(t, "user@http://127.0.0.1:1/dav", failedChecks[common.HealthCheckWebDAV].Target)
+	}
+	if assert.Contains(t, failedChecks, common.HealthCheckLocal) {
+		assert.Equal(t, localUser.GetHomeDir(), failedChecks[common.HealthCheckLocal].Target)
+	}
+	req, err := http.NewRequest(http.MethodGet, httpBaseURL+readyzPath, nil)
+	assert.NoError(t, err)
+	resp, err := httpclient.GetHTTPClient().Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		resp.Body.Close()
+	}
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(webDAVUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(localUser.GetHomeDir())
+	assert.NoError(t, err)
+	status, _, err = httpdtest.GetStatus(http.StatusOK)
+	assert.NoError(t, err)
+	assert.False(t, status.HealthChecks.Ready)
+	healthStatus = common.UpdateHealthStatus()
+	assert.True(t, healthStatus.Ready)
+	// only the data provider and the KMS are checked without samples
+	common.Config.HealthChecks.MaxSamples = 0
+	healthStatus = common.UpdateHealthStatus()
+	assert.True(t, healthStatus.Ready)
+	assert.Len(t, healthStatus.Checks, 2)
+}
+
 func TestGetConnections(t *testing.T) {
 	_, _, err := httpdtest.GetConnections(http.StatusOK)
 	assert.NoError(t, err)
@@ -3533,6 +3985,15 @@ func TestHealthCheck(t *testing.T) {
 	assert.Equal(t, "ok", rr.Body.String())
 }
 
+func TestReadinessCheck(t *testing.T) {
+	status := common.UpdateHealthStatus()
+	assert.True(t, status.Ready)
+	req, _ := http.NewRequest(http.MethodGet, readyzPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	assert.Equal(t, "ok", rr.Body.String())
+}
+
 func TestGetWebRootMock(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "/", nil)
 	rr := executeRequest(req)
@@ -3996,6 +4457,10 @@ func TestWebUserAddMock(t *testing.T) {
 	form.Set("denied_extensions", "/dir2::.webp,.webp\n/dir2::.tiff\n/dir1::.zip")
 	form.Set("allowed_patterns", "/dir2::*.jpg,*.png\n/dir1::*.png")
 	form.Set("denied_patterns", "/dir1::*.zip\n/dir3::*.rar\n/dir2::*.mkv")
+	form.Set("hidden_patterns", "/dir1::.*,*.TMP")
+	form.Set("deny_listing_dirs", "/dir4\n/dir3/")
+	form.Set("allowed_mime_types", "/dir1::image/*,application/pdf")
+	form.Set("denied_mime_types", "/::application/x-msdownload\n/dir1::image/gif")
 	form.Set("additional_info", user.AdditionalInfo)
 	b, contentType, _ := getMultipartFormData(form, "", "")
 	// test invalid url escape
@@ -4162,11 +4627,14 @@ func TestWebUserAddMock(t *testing.T) {
 			assert.True(t, utils.IsStringInSlice(".tiff", filter.DeniedExtensions))
 		}
 	}
-	assert.Len(t, newUser.Filters.FilePatterns, 3)
+	assert.Len(t, newUser.Filters.FilePatterns, 4)
 	for _, filter := range newUser.Filters.FilePatterns {
 		if filter.Path == "/dir1" {
 			assert.Len(t, filter.DeniedPatterns, 1)
 			assert.Len(t, filter.AllowedPatterns, 1)
+			assert.Len(t, filter.HiddenPatterns, 2)
+			assert.True(t, utils.IsStringInSlice("*.tmp", filter.HiddenPatterns))
+			assert.False(t, filter.DenyListing)
 			assert.True(t, utils.IsStringInSlice("*.png", filter.AllowedPatterns))
 			assert.True(t, utils.IsStringInSlice("*.zip", filter.DeniedPatterns))
 		}
@@ -4181,6 +4649,26 @@ func TestWebUserAddMock(t *testing.T) {
 			assert.Len(t, filter.DeniedPatterns, 1)
 			assert.Len(t, filter.AllowedPatterns, 0)
 			assert.True(t, utils.IsStringInSlice("*.rar", filter.DeniedPatterns))
+			assert.True(t, filter.DenyListing)
+		}
+		if filter.Path == "/dir4" {
+			assert.Len(t, filter.DeniedPatterns, 0)
+			assert.Len(t, filter.AllowedPatterns, 0)
+			assert.Len(t, filter.HiddenPatterns, 0)
+			assert.True(t, filter.DenyListing)
+		}
+	}
+	assert.Len(t, newUser.Filters.MimeTypes, 2)
+	for _, filter := range newUser.Filters.MimeTypes {
+		if filter.Path == "/" {
+			assert.Len(t, filter.DeniedMimeTypes, 1)
+			assert.Len(t, filter.AllowedMimeTypes, 0)
+		}
+		if filter.Path == "/dir1" {
+			assert.Len(t, filter.DeniedMimeTypes, 1)
+			assert.Len(t, filter.AllowedMimeTypes, 2)
+			assert.True(t, utils.IsStringInSlice("image/*", filter.AllowedMimeTypes))
+			assert.True(t, utils.IsStringInSlice("image/gif", filter.DeniedMimeTypes))
 		}
 	}
 	req, _ = http.NewRequest(http.MethodDelete, path.Join(userPath, newUser.Username), nil)
@@ -4276,6 +4764,91 @@ func TestWebUserUpdateMock(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, rr)
 }
 
+func TestWebUserRetention(t *testing.T) {
+	token, err := getJWTTokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
+	assert.NoError(t, err)
+	u := getTestUser()
+	u.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/archive",
+			Days: 30,
+		},
+		{
+			Path:      "/hold",
+			LegalHold: true,
+		},
+		{
+			Path:      "/both/",
+			Days:      10,
+			LegalHold: true,
+		},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	form := make(url.Values)
+	form.Set("username", user.Username)
+	form.Set("home_dir", user.HomeDir)
+	form.Set("uid", "0")
+	form.Set("gid", "0")
+	form.Set("max_sessions", "0")
+	form.Set("quota_size", "0")
+	form.Set("quota_files", "0")
+	form.Set("upload_bandwidth", "0")
+	form.Set("download_bandwidth", "0")
+	form.Set("permissions", "*")
+	form.Set("status", strconv.Itoa(user.Status))
+	form.Set("expiration_date", "")
+	form.Set("max_upload_file_size", "0")
+	form.Set("retention", "/archive::a")
+	b, contentType, _ := getMultipartFormData(form, "", "")
+	req, _ := http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
+	setJWTCookieForReq(req, token)
+	req.Header.Set("Content-Type", contentType)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	assert.Contains(t, rr.Body.String(), "invalid retention days")
+	// the legal holds cannot be changed from the web admin
+	form.Set("retention", " /archive :: 60 \n/both::20")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
+	setJWTCookieForReq(req, token)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr)
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	if assert.Len(t, user.Filters.Retention, 3) {
+		for _, f := range user.Filters.Retention {
+			switch f.Path {
+			case "/archive":
+				assert.Equal(t, 60, f.Days)
+				assert.False(t, f.LegalHold)
+			case "/both":
+				assert.Equal(t, 20, f.Days)
+				assert.True(t, f.LegalHold)
+			case "/hold":
+				assert.Equal(t, 0, f.Days)
+				assert.True(t, f.LegalHold)
+			default:
+				assert.Fail(t, "unexpected retention filter", "path: %v", f.Path)
+			}
+		}
+	}
+	// the legal holds can be removed using the REST API
+	user.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path: "/archive",
+			Days: 60,
+		},
+	}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Len(t, user.Filters.Retention, 1)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
 func TestRenderWebCloneUserMock(t *testing.T) {
 	token, err := getJWTTokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
 	assert.NoError(t, err)
@@ -4364,6 +4937,13 @@ func TestWebUserS3Mock(t *testing.T) {
 	form.Set("s3_storage_class", user.FsConfig.S3Config.StorageClass)
 	form.Set("s3_endpoint", user.FsConfig.S3Config.Endpoint)
 	form.Set("s3_key_prefix", user.FsConfig.S3Config.KeyPrefix)
+	form.Set("s3_sse_type", vfs.S3SSETypeCustomer)
+	form.Set("s3_sse_customer_key", "12345678901234567890123456789012")
+	form.Set("s3_acl", "bucket-owner-full-control")
+	form.Set("s3_force_path_style", "on")
+	form.Set("s3_list_metadata", "on")
+	form.Set("s3_emulate_symlinks", "on")
+	form.Set("s3_object_lock_mode", vfs.S3ObjectLockModeGovernance)
 	form.Set("allowed_extensions", "/dir1::.jpg,.png")
 	form.Set("denied_extensions", "/dir2::.zip")
 	form.Set("max_upload_file_size", "0")
@@ -4408,6 +4988,13 @@ func TestWebUserS3Mock(t *testing.T) {
 	assert.Equal(t, updateUser.FsConfig.S3Config.KeyPrefix, user.FsConfig.S3Config.KeyPrefix)
 	assert.Equal(t, updateUser.FsConfig.S3Config.UploadPartSize, user.FsConfig.S3Config.UploadPartSize)
 	assert.Equal(t, updateUser.FsConfig.S3Config.UploadConcurrency, user.FsConfig.S3Config.UploadConcurrency)
+	assert.Equal(t, vfs.S3SSETypeCustomer, updateUser.FsConfig.S3Config.SSEType)
+	assert.Equal(t, kms.SecretStatusSecretBox, updateUser.FsConfig.S3Config.SSECustomerKey.GetStatus())
+	assert.Equal(t, "bucket-owner-full-control", updateUser.FsConfig.S3Config.ACL)
+	assert.True(t, updateUser.FsConfig.S3Config.ForcePathStyle)
+	assert.True(t, updateUser.FsConfig.S3Config.ListMetadata)
+	assert.True(t, updateUser.FsConfig.S3Config.EmulateSymlinks)
+	assert.Equal(t, vfs.S3ObjectLockModeGovernance, updateUser.FsConfig.S3Config.ObjectLockMode)
 	assert.Equal(t, 2, len(updateUser.Filters.FileExtensions))
 	assert.Equal(t, kms.SecretStatusSecretBox, updateUser.FsConfig.S3Config.AccessSecret.GetStatus())
 	assert.NotEmpty(t, updateUser.FsConfig.S3Config.AccessSecret.GetPayload())
@@ -4415,6 +5002,7 @@ func TestWebUserS3Mock(t *testing.T) {
 	assert.Empty(t, updateUser.FsConfig.S3Config.AccessSecret.GetAdditionalData())
 	// now check that a redacted password is not saved
 	form.Set("s3_access_secret", "[**redacted**] ")
+	form.Set("s3_sse_customer_key", "[**redacted**]")
 	b, contentType, _ = getMultipartFormData(form, "", "")
 	req, _ = http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
 	setJWTCookieForReq(req, token)
@@ -4431,6 +5019,7 @@ func TestWebUserS3Mock(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, kms.SecretStatusSecretBox, lastUpdatedUser.FsConfig.S3Config.AccessSecret.GetStatus())
 	assert.Equal(t, updateUser.FsConfig.S3Config.AccessSecret.GetPayload(), lastUpdatedUser.FsConfig.S3Config.AccessSecret.GetPayload())
+	assert.Equal(t, updateUser.FsConfig.S3Config.SSECustomerKey.GetPayload(), lastUpdatedUser.FsConfig.S3Config.SSECustomerKey.GetPayload())
 	assert.Empty(t, lastUpdatedUser.FsConfig.S3Config.AccessSecret.GetKey())
 	assert.Empty(t, lastUpdatedUser.FsConfig.S3Config.AccessSecret.GetAdditionalData())
 	// now clear credentials
@@ -4496,6 +5085,7 @@ func TestWebUserGCSMock(t *testing.T) {
 	form.Set("gcs_bucket", user.FsConfig.GCSConfig.Bucket)
 	form.Set("gcs_storage_class", user.FsConfig.GCSConfig.StorageClass)
 	form.Set("gcs_key_prefix", user.FsConfig.GCSConfig.KeyPrefix)
+	form.Set("gcs_emulate_symlinks", "on")
 	form.Set("allowed_extensions", "/dir1::.jpg,.png")
 	form.Set("max_upload_file_size", "0")
 	b, contentType, _ := getMultipartFormData(form, "", "")
@@ -4530,6 +5120,7 @@ func TestWebUserGCSMock(t *testing.T) {
 	assert.Equal(t, user.FsConfig.GCSConfig.Bucket, updateUser.FsConfig.GCSConfig.Bucket)
 	assert.Equal(t, user.FsConfig.GCSConfig.StorageClass, updateUser.FsConfig.GCSConfig.StorageClass)
 	assert.Equal(t, user.FsConfig.GCSConfig.KeyPrefix, updateUser.FsConfig.GCSConfig.KeyPrefix)
+	assert.True(t, updateUser.FsConfig.GCSConfig.EmulateSymlinks)
 	assert.Equal(t, "/dir1", updateUser.Filters.FileExtensions[0].Path)
 	form.Set("gcs_auto_credentials", "on")
 	b, contentType, _ = getMultipartFormData(form, "", "")
@@ -4597,6 +5188,7 @@ func TestWebUserAzureBlobMock(t *testing.T) {
 	form.Set("az_endpoint", user.FsConfig.AzBlobConfig.Endpoint)
 	form.Set("az_key_prefix", user.FsConfig.AzBlobConfig.KeyPrefix)
 	form.Set("az_use_emulator", "checked")
+	form.Set("az_emulate_symlinks", "checked")
 	form.Set("allowed_extensions", "/dir1::.jpg,.png")
 	form.Set("denied_extensions", "/dir2::.zip")
 	form.Set("max_upload_file_size", "0")
@@ -4640,6 +5232,7 @@ func TestWebUserAzureBlobMock(t *testing.T) {
 	assert.Equal(t, updateUser.FsConfig.AzBlobConfig.KeyPrefix, user.FsConfig.AzBlobConfig.KeyPrefix)
 	assert.Equal(t, updateUser.FsConfig.AzBlobConfig.UploadPartSize, user.FsConfig.AzBlobConfig.UploadPartSize)
 	assert.Equal(t, updateUser.FsConfig.AzBlobConfig.UploadConcurrency, user.FsConfig.AzBlobConfig.UploadConcurrency)
+	assert.True(t, updateUser.FsConfig.AzBlobConfig.EmulateSymlinks)
 	assert.Equal(t, 2, len(updateUser.Filters.FileExtensions))
 	assert.Equal(t, kms.SecretStatusSecretBox, updateUser.FsConfig.AzBlobConfig.AccountKey.GetStatus())
 	assert.NotEmpty(t, updateUser.FsConfig.AzBlobConfig.AccountKey.GetPayload())
@@ -4756,6 +5349,67 @@ func TestWebUserCryptMock(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, rr)
 }
 
+func TestWebUserMemoryFsMock(t *testing.T) {
+	token, err := getJWTTokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
+	assert.NoError(t, err)
+	user := getTestUser()
+	userAsJSON := getUserAsJSON(t, user)
+	req, _ := http.NewRequest(http.MethodPost, userPath, bytes.NewBuffer(userAsJSON))
+	setJWTCookieForReq(req, token)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr)
+	form := make(url.Values)
+	form.Set("username", user.Username)
+	form.Set("home_dir", user.HomeDir)
+	form.Set("uid", "0")
+	form.Set("gid", "0")
+	form.Set("max_sessions", "0")
+	form.Set("quota_size", "0")
+	form.Set("quota_files", "0")
+	form.Set("upload_bandwidth", "0")
+	form.Set("download_bandwidth", "0")
+	form.Set("permissions", "*")
+	form.Set("status", strconv.Itoa(user.Status))
+	form.Set("expiration_date", "")
+	form.Set("fs_provider", "8")
+	form.Set("max_upload_file_size", "0")
+	form.Set("memory_max_size", "a")
+	// invalid max size
+	b, contentType, _ := getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
+	setJWTCookieForReq(req, token)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	form.Set("memory_max_size", "-1")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
+	setJWTCookieForReq(req, token)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	form.Set("memory_max_size", "2097152")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, path.Join(webUserPath, user.Username), &b)
+	setJWTCookieForReq(req, token)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr)
+	req, _ = http.NewRequest(http.MethodGet, path.Join(userPath, user.Username), nil)
+	setJWTCookieForReq(req, token)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	var updateUser dataprovider.User
+	err = render.DecodeJSON(rr.Body, &updateUser)
+	assert.NoError(t, err)
+	assert.Equal(t, dataprovider.MemoryFilesystemProvider, updateUser.FsConfig.Provider)
+	assert.Equal(t, int64(2097152), updateUser.FsConfig.MemoryConfig.MaxSize)
+	req, _ = http.NewRequest(http.MethodDelete, path.Join(userPath, user.Username), nil)
+	setJWTCookieForReq(req, token)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+}
+
 func TestWebUserSFTPFsMock(t *testing.T) {
 	token, err := getJWTTokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
 	assert.NoError(t, err)
@@ -247,6 +247,14 @@ func (s *httpdServer) initializeRouter() {
 		r.Get(healthzPath, func(w http.ResponseWriter, r *http.Request) {
 			render.PlainText(w, r, "ok")
 		})
+		r.Get(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+			if !common.GetHealthStatus().Ready {
+				render.Status(r, http.StatusServiceUnavailable)
+				render.PlainText(w, r, "not ready")
+				return
+			}
+			render.PlainText(w, r, "ok")
+		})
 	})
 
 	s.router.Group(func(router chi.Router) {
@@ -300,6 +308,23 @@ func (s *httpdServer) initializeRouter() {
 			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(folderPath, getFolders)
 			router.With(checkPerm(dataprovider.PermAdminAddUsers)).Post(folderPath, addFolder)
 			router.With(checkPerm(dataprovider.PermAdminDeleteUsers)).Delete(folderPath, deleteFolderByPath)
+			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(fileVersionsPath+"/{username}", getFileVersions)
+			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(fileVersionsPath+"/{username}/usage",
+				getFileVersionsUsage)
+			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Post(fileVersionsPath+"/{username}/restore",
+				restoreFileVersion)
+			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Delete(fileVersionsPath+"/{username}",
+				purgeFileVersions)
+			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(trashPath+"/{username}", getTrashItems)
+			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(trashPath+"/{username}/usage", getTrashUsage)
+			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Post(trashPath+"/{username}/restore",
+				restoreTrashItem)
+			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Delete(trashPath+"/{username}", purgeTrashItems)
+			router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(tieringPath+"/{username}", getTieringReport)
+			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Post(tieringPath+"/{username}", applyTieringPolicy)
+			router.With(checkPerm(dataprovider.PermAdminViewServerStatus)).Get(replicationPath, getReplicationStatus)
+			router.With(checkPerm(dataprovider.PermAdminManageSystem)).Post(replicationPath+"/resync",
+				startReplicationResync)
 			router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(dumpDataPath, dumpData)
 			router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(loadDataPath, loadData)
 			router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Put(updateUsedQuotaPath, updateUserQuotaUsage)
@@ -343,6 +368,8 @@ func (s *httpdServer) initializeRouter() {
 				router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Post(webUserPath+"/{username}", handleWebUpdateUserPost)
 				router.With(checkPerm(dataprovider.PermAdminViewConnections), s.refreshCookie).
 					Get(webConnectionsPath, handleWebGetConnections)
+				router.With(checkPerm(dataprovider.PermAdminViewUsers), s.refreshCookie).
+					Get(webTrashPath+"/{username}", handleWebGetTrash)
 				router.With(checkPerm(dataprovider.PermAdminViewUsers), s.refreshCookie).
 					Get(webFoldersPath, handleWebGetFolders)
 				router.With(checkPerm(dataprovider.PermAdminAddUsers), s.refreshCookie).
@@ -365,6 +392,9 @@ func (s *httpdServer) initializeRouter() {
 				router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Post(webScanVFolderPath, startVFolderQuotaScan)
 				router.With(checkPerm(dataprovider.PermAdminDeleteUsers)).Delete(webUserPath+"/{username}", deleteUser)
 				router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Post(webQuotaScanPath, startQuotaScan)
+				router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Post(webTrashPath+"/{username}/restore",
+					restoreTrashItem)
+				router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Delete(webTrashPath+"/{username}", purgeTrashItems)
 			})
 
 			router.Group(func(router chi.Router) {
@@ -32,6 +32,7 @@ const (
 	templateFolder       = "folder.html"
 	templateMessage      = "message.html"
 	templateStatus       = "status.html"
+	templateTrash        = "trash.html"
 	templateLogin        = "login.html"
 	templateChangePwd    = "changepwd.html"
 	pageUsersTitle       = "Users"
@@ -39,6 +40,7 @@ const (
 	pageConnectionsTitle = "Connections"
 	pageStatusTitle      = "Status"
 	pageFoldersTitle     = "Folders"
+	pageTrashTitle       = "Trash"
 	pageChangePwdTitle   = "Change password"
 	page400Title         = "Bad request"
 	page403Title         = "Forbidden"
@@ -70,6 +72,7 @@ type basePage struct {
 	ChangeAdminPwdURL  string
 	FolderQuotaScanURL string
 	StatusURL          string
+	TrashURL           string
 	UsersTitle         string
 	AdminsTitle        string
 	ConnectionsTitle   string
@@ -99,6 +102,12 @@ type connectionsPage struct {
 	Connections []common.ConnectionStatus
 }
 
+type trashPage struct {
+	basePage
+	Username string
+	Items    []vfs.TrashItem
+}
+
 type statusPage struct {
 	basePage
 	Status ServicesStatus
@@ -188,6 +197,10 @@ func loadTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateStatus),
 	}
+	trashPath := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateTrash),
+	}
 	loginPath := []string{
 		filepath.Join(templatesPath, templateLogin),
 	}
@@ -200,6 +213,7 @@ func loadTemplates(templatesPath string) {
 	foldersTmpl := utils.LoadTemplate(template.ParseFiles(foldersPath...))
 	folderTmpl := utils.LoadTemplate(template.ParseFiles(folderPath...))
 	statusTmpl := utils.LoadTemplate(template.ParseFiles(statusPath...))
+	trashTmpl := utils.LoadTemplate(template.ParseFiles(trashPath...))
 	loginTmpl := utils.LoadTemplate(template.ParseFiles(loginPath...))
 	changePwdTmpl := utils.LoadTemplate(template.ParseFiles(changePwdPaths...))
 
@@ -212,6 +226,7 @@ func loadTemplates(templatesPath string) {
 	templates[templateFolders] = foldersTmpl
 	templates[templateFolder] = folderTmpl
 	templates[templateStatus] = statusTmpl
+	templates[templateTrash] = trashTmpl
 	templates[templateLogin] = loginTmpl
 	templates[templateChangePwd] = changePwdTmpl
 }
@@ -231,6 +246,7 @@ func getBasePageData(title, currentURL string, r *http.Request) basePage {
 		QuotaScanURL:       webQuotaScanPath,
 		ConnectionsURL:     webConnectionsPath,
 		StatusURL:          webStatusPath,
+		TrashURL:           webTrashPath,
 		FolderQuotaScanURL: webScanVFolderPath,
 		UsersTitle:         pageUsersTitle,
 		AdminsTitle:        pageAdminsTitle,
@@ -448,25 +464,52 @@ func getListFromPostFields(value string) map[string][]string {
 	return result
 }
 
-func getFilePatternsFromPostField(valueAllowed, valuesDenied string) []dataprovider.PatternsFilter {
+func getFilePatternsFromPostField(valueAllowed, valuesDenied, valuesHidden, valueDenyListing string) []dataprovider.PatternsFilter {
 	var result []dataprovider.PatternsFilter
-	allowedPatterns := getListFromPostFields(valueAllowed)
-	deniedPatterns := getListFromPostFields(valuesDenied)
+	getFilter := func(dir string) *dataprovider.PatternsFilter {
+		for idx := range result {
+			if result[idx].Path == dir {
+				return &result[idx]
+			}
+		}
+		result = append(result, dataprovider.PatternsFilter{Path: dir})
+		return &result[len(result)-1]
+	}
+
+	for dir, patterns := range getListFromPostFields(valueAllowed) {
+		getFilter(dir).AllowedPatterns = patterns
+	}
+	for dir, patterns := range getListFromPostFields(valuesDenied) {
+		getFilter(dir).DeniedPatterns = patterns
+	}
+	for dir, patterns := range getListFromPostFields(valuesHidden) {
+		getFilter(dir).HiddenPatterns = patterns
+	}
+	for _, dir := range getSliceFromDelimitedValues(valueDenyListing, "\n") {
+		getFilter(path.Clean(dir)).DenyListing = true
+	}
+	return result
+}
+
+func getFileExtensionsFromPostField(valueAllowed, valuesDenied string) []dataprovider.ExtensionsFilter {
+	var result []dataprovider.ExtensionsFilter
+	allowedExtensions := getListFromPostFields(valueAllowed)
+	deniedExtensions := getListFromPostFields(valuesDenied)
 
-	for dirAllowed, allowPatterns := range allowedPatterns {
-		filter := dataprovider.PatternsFilter{
-			Path:            dirAllowed,
-			AllowedPatterns: allowPatterns,
+	for dirAllowed, allowedExts := range allowedExtensions {
+		filter := dataprovider.ExtensionsFilter{
+			Path:              dirAllowed,
+			AllowedExtensions: allowedExts,
 		}
-		for dirDenied, denPatterns := range deniedPatterns {
+		for dirDenied, deniedExts := range deniedExtensions {
 			if dirAllowed == dirDenied {
-				filter.DeniedPatterns = denPatterns
+				filter.DeniedExtensions = deniedExts
 				break
 			}
 		}
 		result = append(result, filter)
 	}
-	for dirDenied, denPatterns := range deniedPatterns {
+	for dirDenied, deniedExts := range deniedExtensions {
 		found := false
 		for _, res := range result {
 			if res.Path == dirDenied {
@@ -475,34 +518,34 @@ func getFilePatternsFromPostField(valueAllowed, valuesDenied string) []dataprovi
 			}
 		}
 		if !found {
-			result = append(result, dataprovider.PatternsFilter{
-				Path:           dirDenied,
-				DeniedPatterns: denPatterns,
+			result = append(result, dataprovider.ExtensionsFilter{
+				Path:             dirDenied,
+				DeniedExtensions: deniedExts,
 			})
 		}
 	}
 	return result
 }
 
-func getFileExtensionsFromPostField(valueAllowed, valuesDenied string) []dataprovider.ExtensionsFilter {
-	var result []dataprovider.ExtensionsFilter
-	allowedExtensions := getListFromPostFields(valueAllowed)
-	deniedExtensions := getListFromPostFields(valuesDenied)
+func getMimeTypesFromPostField(valueAllowed, valuesDenied string) []dataprovider.MimeTypesFilter {
+	var result []dataprovider.MimeTypesFilter
+	allowedMimeTypes := getListFromPostFields(valueAllowed)
+	deniedMimeTypes := getListFromPostFields(valuesDenied)
 
-	for dirAllowed, allowedExts := range allowedExtensions {
-		filter := dataprovider.ExtensionsFilter{
-			Path:              dirAllowed,
-			AllowedExtensions: allowedExts,
+	for dirAllowed, allowedTypes := range allowedMimeTypes {
+		filter := dataprovider.MimeTypesFilter{
+			Path:             dirAllowed,
+			AllowedMimeTypes: allowedTypes,
 		}
-		for dirDenied, deniedExts := range deniedExtensions {
+		for dirDenied, deniedTypes := range deniedMimeTypes {
 			if dirAllowed == dirDenied {
-				filter.DeniedExtensions = deniedExts
+				filter.DeniedMimeTypes = deniedTypes
 				break
 			}
 		}
 		result = append(result, filter)
 	}
-	for dirDenied, deniedExts := range deniedExtensions {
+	for dirDenied, deniedTypes := range deniedMimeTypes {
 		found := false
 		for _, res := range result {
 			if res.Path == dirDenied {
@@ -511,15 +554,61 @@ func getFileExtensionsFromPostField(valueAllowed, valuesDenied string) []datapro
 			}
 		}
 		if !found {
-			result = append(result, dataprovider.ExtensionsFilter{
-				Path:             dirDenied,
-				DeniedExtensions: deniedExts,
+			result = append(result, dataprovider.MimeTypesFilter{
+				Path:            dirDenied,
+				DeniedMimeTypes: deniedTypes,
 			})
 		}
 	}
 	return result
 }
 
+// getRetentionFromPostField parses the retention filters, one per line as
+// /dir::days. The legal holds can only be set using the REST API
+func getRetentionFromPostField(value string) ([]dataprovider.RetentionFilter, error) {
+	var result []dataprovider.RetentionFilter
+	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
+		if !strings.Contains(cleaned, "::") {
+			continue
+		}
+		dirDays := strings.Split(cleaned, "::")
+		days, err := strconv.Atoi(strings.TrimSpace(dirDays[1]))
+		if err != nil {
+			return result, fmt.Errorf("invalid retention days for %#v: %v", dirDays[0], err)
+		}
+		result = append(result, dataprovider.RetentionFilter{
+			Path: path.Clean(strings.TrimSpace(dirDays[0])),
+			Days: days,
+		})
+	}
+	return result, nil
+}
+
+// preserveLegalHolds copies the legal holds from the existing filters to the
+// filters parsed from the web form, they cannot be changed from the web UI
+func preserveLegalHolds(filters []dataprovider.RetentionFilter, existing []dataprovider.RetentionFilter) []dataprovider.RetentionFilter {
+	for _, f := range existing {
+		if !f.LegalHold {
+			continue
+		}
+		found := false
+		for idx := range filters {
+			if filters[idx].Path == f.Path {
+				filters[idx].LegalHold = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			filters = append(filters, dataprovider.RetentionFilter{
+				Path:      f.Path,
+				LegalHold: true,
+			})
+		}
+	}
+	return filters
+}
+
 func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	var filters dataprovider.UserFilters
 	filters.AllowedIP = getSliceFromDelimitedValues(r.Form.Get("allowed_ip"), ",")
@@ -527,7 +616,9 @@ func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	filters.DeniedLoginMethods = r.Form["ssh_login_methods"]
 	filters.DeniedProtocols = r.Form["denied_protocols"]
 	filters.FileExtensions = getFileExtensionsFromPostField(r.Form.Get("allowed_extensions"), r.Form.Get("denied_extensions"))
-	filters.FilePatterns = getFilePatternsFromPostField(r.Form.Get("allowed_patterns"), r.Form.Get("denied_patterns"))
+	filters.FilePatterns = getFilePatternsFromPostField(r.Form.Get("allowed_patterns"), r.Form.Get("denied_patterns"),
+		r.Form.Get("hidden_patterns"), r.Form.Get("deny_listing_dirs"))
+	filters.MimeTypes = getMimeTypesFromPostField(r.Form.Get("allowed_mime_types"), r.Form.Get("denied_mime_types"))
 	return filters
 }
 
@@ -552,6 +643,14 @@ func getS3Config(r *http.Request) (vfs.S3FsConfig, error) {
 	config.Endpoint = r.Form.Get("s3_endpoint")
 	config.StorageClass = r.Form.Get("s3_storage_class")
 	config.KeyPrefix = r.Form.Get("s3_key_prefix")
+	config.SSEType = r.Form.Get("s3_sse_type")
+	config.SSEKMSKeyID = r.Form.Get("s3_sse_kms_key_id")
+	config.SSECustomerKey = getSecretFromFormField(r, "s3_sse_customer_key")
+	config.ACL = r.Form.Get("s3_acl")
+	config.ForcePathStyle = len(r.Form.Get("s3_force_path_style")) > 0
+	config.ListMetadata = len(r.Form.Get("s3_list_metadata")) > 0
+	config.EmulateSymlinks = len(r.Form.Get("s3_emulate_symlinks")) > 0
+	config.ObjectLockMode = r.Form.Get("s3_object_lock_mode")
 	config.UploadPartSize, err = strconv.ParseInt(r.Form.Get("s3_upload_part_size"), 10, 64)
 	if err != nil {
 		return config, err
@@ -566,6 +665,7 @@ func getGCSConfig(r *http.Request) (vfs.GCSFsConfig, error) {
 
 	config.Bucket = r.Form.Get("gcs_bucket")
 	config.StorageClass = r.Form.Get("gcs_storage_class")
+	config.EmulateSymlinks = len(r.Form.Get("gcs_emulate_symlinks")) > 0
 	config.KeyPrefix = r.Form.Get("gcs_key_prefix")
 	autoCredentials := r.Form.Get("gcs_auto_credentials")
 	if autoCredentials != "" {
@@ -605,6 +705,41 @@ func getSFTPConfig(r *http.Request) vfs.SFTPFsConfig {
 	return config
 }
 
+func getWebDAVConfig(r *http.Request) vfs.WebDAVFsConfig {
+	config := vfs.WebDAVFsConfig{}
+	config.Endpoint = r.Form.Get("webdav_endpoint")
+	config.Username = r.Form.Get("webdav_username")
+	config.Password = getSecretFromFormField(r, "webdav_password")
+	config.SkipTLSVerify = len(r.Form.Get("webdav_skip_tls_verify")) > 0
+	config.CACertificate = strings.TrimSpace(r.Form.Get("webdav_ca_certificate"))
+	config.Prefix = r.Form.Get("webdav_prefix")
+	return config
+}
+
+func getFTPConfig(r *http.Request) (vfs.FTPFsConfig, error) {
+	var err error
+	config := vfs.FTPFsConfig{}
+	config.Endpoint = r.Form.Get("ftp_endpoint")
+	config.Username = r.Form.Get("ftp_username")
+	config.Password = getSecretFromFormField(r, "ftp_password")
+	config.TLSMode, err = strconv.Atoi(r.Form.Get("ftp_tls_mode"))
+	if err != nil {
+		return config, err
+	}
+	config.SkipTLSVerify = len(r.Form.Get("ftp_skip_tls_verify")) > 0
+	config.DisableEPSV = len(r.Form.Get("ftp_disable_epsv")) > 0
+	config.ActiveMode = len(r.Form.Get("ftp_active_mode")) > 0
+	config.Prefix = r.Form.Get("ftp_prefix")
+	return config, nil
+}
+
+func getMemoryConfig(r *http.Request) (vfs.MemoryFsConfig, error) {
+	var err error
+	config := vfs.MemoryFsConfig{}
+	config.MaxSize, err = strconv.ParseInt(r.Form.Get("memory_max_size"), 10, 64)
+	return config, err
+}
+
 func getAzureConfig(r *http.Request) (vfs.AzBlobFsConfig, error) {
 	var err error
 	config := vfs.AzBlobFsConfig{}
@@ -616,6 +751,7 @@ func getAzureConfig(r *http.Request) (vfs.AzBlobFsConfig, error) {
 	config.KeyPrefix = r.Form.Get("az_key_prefix")
 	config.AccessTier = r.Form.Get("az_access_tier")
 	config.UseEmulator = len(r.Form.Get("az_use_emulator")) > 0
+	config.EmulateSymlinks = len(r.Form.Get("az_emulate_symlinks")) > 0
 	config.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
 	if err != nil {
 		return config, err
@@ -624,6 +760,79 @@ func getAzureConfig(r *http.Request) (vfs.AzBlobFsConfig, error) {
 	return config, err
 }
 
+func getCompressionConfig(r *http.Request) (vfs.CompressionFsConfig, error) {
+	var err error
+	config := vfs.CompressionFsConfig{}
+	config.Algorithm = r.Form.Get("compression_algo")
+	if !config.IsEnabled() {
+		return config, nil
+	}
+	config.Level, err = strconv.Atoi(r.Form.Get("compression_level"))
+	if err != nil {
+		return config, err
+	}
+	config.QuotaMode, err = strconv.Atoi(r.Form.Get("compression_quota_mode"))
+	if err != nil {
+		return config, err
+	}
+	config.Paths = getSliceFromDelimitedValues(r.Form.Get("compression_paths"), "\n")
+	return config, nil
+}
+
+func getVersioningConfig(r *http.Request) (vfs.VersioningConfig, error) {
+	var err error
+	config := vfs.VersioningConfig{}
+	config.Enabled = len(r.Form.Get("versioning_enabled")) > 0
+	if !config.IsEnabled() {
+		return config, nil
+	}
+	config.MaxVersions, err = strconv.Atoi(r.Form.Get("versioning_max_versions"))
+	if err != nil {
+		return config, err
+	}
+	config.MaxAge, err = strconv.Atoi(r.Form.Get("versioning_max_age"))
+	if err != nil {
+		return config, err
+	}
+	config.QuotaSize, err = strconv.ParseInt(r.Form.Get("versioning_quota_size"), 10, 64)
+	if err != nil {
+		return config, err
+	}
+	config.Paths = getSliceFromDelimitedValues(r.Form.Get("versioning_paths"), "\n")
+	return config, nil
+}
+
+func getTrashConfig(r *http.Request) (vfs.TrashConfig, error) {
+	var err error
+	config := vfs.TrashConfig{}
+	config.Enabled = len(r.Form.Get("trash_enabled")) > 0
+	if !config.IsEnabled() {
+		return config, nil
+	}
+	config.Retention, err = strconv.Atoi(r.Form.Get("trash_retention"))
+	if err != nil {
+		return config, err
+	}
+	config.QuotaSize, err = strconv.ParseInt(r.Form.Get("trash_quota_size"), 10, 64)
+	return config, err
+}
+
+func getTieringConfig(r *http.Request) (vfs.TieringFsConfig, error) {
+	var err error
+	config := vfs.TieringFsConfig{}
+	config.Enabled = len(r.Form.Get("tiering_enabled")) > 0
+	if !config.IsEnabled() {
+		return config, nil
+	}
+	config.MinAge, err = strconv.Atoi(r.Form.Get("tiering_min_age"))
+	if err != nil {
+		return config, err
+	}
+	config.Recall = len(r.Form.Get("tiering_recall")) > 0
+	config.Paths = getSliceFromDelimitedValues(r.Form.Get("tiering_paths"), "\n")
+	return config, nil
+}
+
 func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, error) {
 	var fs dataprovider.Filesystem
 	provider, err := strconv.Atoi(r.Form.Get("fs_provider"))
@@ -631,6 +840,29 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		provider = int(dataprovider.LocalFilesystemProvider)
 	}
 	fs.Provider = dataprovider.FilesystemProvider(provider)
+	fs.OverlayConfig.LowerPath = r.Form.Get("overlay_lower_path")
+	readCacheMode, err := strconv.Atoi(r.Form.Get("read_cache_mode"))
+	if err == nil {
+		fs.CacheConfig.Mode = readCacheMode
+	}
+	fs.CompressionConfig, err = getCompressionConfig(r)
+	if err != nil {
+		return fs, err
+	}
+	fs.VersioningConfig, err = getVersioningConfig(r)
+	if err != nil {
+		return fs, err
+	}
+	fs.TrashConfig, err = getTrashConfig(r)
+	if err != nil {
+		return fs, err
+	}
+	fs.TieringConfig, err = getTieringConfig(r)
+	if err != nil {
+		return fs, err
+	}
+	// used for the crypt filesystem and, if set, to encrypt the files stored on remote filesystems
+	fs.CryptConfig.Passphrase = getSecretFromFormField(r, "crypt_passphrase")
 	switch fs.Provider {
 	case dataprovider.S3FilesystemProvider:
 		config, err := getS3Config(r)
@@ -650,10 +882,22 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 			return fs, err
 		}
 		fs.GCSConfig = config
-	case dataprovider.CryptedFilesystemProvider:
-		fs.CryptConfig.Passphrase = getSecretFromFormField(r, "crypt_passphrase")
 	case dataprovider.SFTPFilesystemProvider:
 		fs.SFTPConfig = getSFTPConfig(r)
+	case dataprovider.WebDAVFilesystemProvider:
+		fs.WebDAVConfig = getWebDAVConfig(r)
+	case dataprovider.FTPFilesystemProvider:
+		config, err := getFTPConfig(r)
+		if err != nil {
+			return fs, err
+		}
+		fs.FTPConfig = config
+	case dataprovider.MemoryFilesystemProvider:
+		config, err := getMemoryConfig(r)
+		if err != nil {
+			return fs, err
+		}
+		fs.MemoryConfig = config
 	}
 	return fs, nil
 }
@@ -751,6 +995,10 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 		FsConfig:          fsConfig,
 		AdditionalInfo:    r.Form.Get("additional_info"),
 	}
+	user.Filters.Retention, err = getRetentionFromPostField(r.Form.Get("retention"))
+	if err != nil {
+		return user, err
+	}
 	maxFileSize, err := strconv.ParseInt(r.Form.Get("max_upload_file_size"), 10, 64)
 	user.Filters.MaxUploadFileSize = maxFileSize
 	return user, err
@@ -998,13 +1246,15 @@ func handleWebUpdateUserPost(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedUser.ID = user.ID
 	updatedUser.Username = user.Username
+	updatedUser.Filters.Retention = preserveLegalHolds(updatedUser.Filters.Retention, user.Filters.Retention)
 	updatedUser.SetEmptySecretsIfNil()
 	if updatedUser.Password == "" {
 		updatedUser.Password = user.Password
 	}
-	updateEncryptedSecrets(&updatedUser, user.FsConfig.S3Config.AccessSecret, user.FsConfig.AzBlobConfig.AccountKey,
-		user.FsConfig.GCSConfig.Credentials, user.FsConfig.CryptConfig.Passphrase, user.FsConfig.SFTPConfig.Password,
-		user.FsConfig.SFTPConfig.PrivateKey)
+	updateEncryptedSecrets(&updatedUser, user.FsConfig.S3Config.AccessSecret, user.FsConfig.S3Config.SSECustomerKey,
+		user.FsConfig.AzBlobConfig.AccountKey, user.FsConfig.GCSConfig.Credentials, user.FsConfig.CryptConfig.Passphrase,
+		user.FsConfig.SFTPConfig.Password, user.FsConfig.SFTPConfig.PrivateKey, user.FsConfig.WebDAVConfig.Password,
+		user.FsConfig.FTPConfig.Password)
 
 	err = dataprovider.UpdateUser(&updatedUser)
 	if err == nil {
@@ -1034,6 +1284,34 @@ func handleWebGetConnections(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, templateConnections, data)
 }
 
+func handleWebGetTrash(w http.ResponseWriter, r *http.Request) {
+	username := getURLParam(r, "username")
+	_, fs, err := getUserTrashFs(username)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			renderNotFoundPage(w, r, err)
+		} else if _, ok := err.(*dataprovider.ValidationError); ok {
+			renderBadRequestPage(w, r, err)
+		} else {
+			renderInternalServerErrorPage(w, r, err)
+		}
+		return
+	}
+	defer fs.Close()
+
+	items, err := fs.ListTrash()
+	if err != nil {
+		renderInternalServerErrorPage(w, r, err)
+		return
+	}
+	data := trashPage{
+		basePage: getBasePageData(pageTrashTitle, fmt.Sprintf("%v/%v", webTrashPath, url.PathEscape(username)), r),
+		Username: username,
+		Items:    items,
+	}
+	renderTemplate(w, templateTrash, data)
+}
+
 func handleWebAddFolderGet(w http.ResponseWriter, r *http.Request) {
 	renderAddFolderPage(w, r, vfs.BaseVirtualFolder{}, "")
 }
@@ -45,6 +45,10 @@ const (
 	defenderScore             = "/api/v2/defender/score"
 	adminPath                 = "/api/v2/admins"
 	adminPwdPath              = "/api/v2/changepwd/admin"
+	fileVersionsPath          = "/api/v2/file-versions"
+	trashPath                 = "/api/v2/trash"
+	tieringPath               = "/api/v2/tiering"
+	replicationPath           = "/api/v2/replication"
 )
 
 const (
@@ -418,6 +422,231 @@ func UpdateQuotaUsage(user dataprovider.User, mode string, expectedStatusCode in
 	return body, checkResponse(resp.StatusCode, expectedStatusCode)
 }
 
+// GetFileVersions returns the stored versions for the given path and checks the received HTTP Status code against expectedStatusCode.
+func GetFileVersions(username, virtualPath string, expectedStatusCode int) ([]vfs.FileVersion, []byte, error) {
+	var versions []vfs.FileVersion
+	var body []byte
+	url, err := addPathAndIDQueryParams(buildURLRelativeToBase(fileVersionsPath, username), virtualPath, "")
+	if err != nil {
+		return versions, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return versions, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &versions)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return versions, body, err
+}
+
+// GetFileVersionsUsage returns the number and the size of the stored versions for the given user and checks the
+// received HTTP Status code against expectedStatusCode.
+func GetFileVersionsUsage(username string, expectedStatusCode int) (map[string]interface{}, []byte, error) {
+	var usage map[string]interface{}
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(fileVersionsPath, username, "usage"), nil, "",
+		getDefaultToken())
+	if err != nil {
+		return usage, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &usage)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return usage, body, err
+}
+
+// RestoreFileVersion restores the given version for the given path and checks the received HTTP Status code against
+// expectedStatusCode.
+func RestoreFileVersion(username, virtualPath, versionID string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := addPathAndIDQueryParams(buildURLRelativeToBase(fileVersionsPath, username, "restore"), virtualPath,
+		versionID)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// PurgeFileVersions removes the given version, or all the versions if versionID is empty, for the given path and
+// checks the received HTTP Status code against expectedStatusCode.
+func PurgeFileVersions(username, virtualPath, versionID string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := addPathAndIDQueryParams(buildURLRelativeToBase(fileVersionsPath, username), virtualPath, versionID)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodDelete, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetTrashItems returns the deleted items for the given user and checks the received HTTP Status code against
+// expectedStatusCode.
+func GetTrashItems(username string, expectedStatusCode int) ([]vfs.TrashItem, []byte, error) {
+	var items []vfs.TrashItem
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(trashPath, username), nil, "", getDefaultToken())
+	if err != nil {
+		return items, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &items)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return items, body, err
+}
+
+// GetTrashUsage returns the number and the size of the files inside the trash for the given user and checks the
+// received HTTP Status code against expectedStatusCode.
+func GetTrashUsage(username string, expectedStatusCode int) (map[string]interface{}, []byte, error) {
+	var usage map[string]interface{}
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(trashPath, username, "usage"), nil, "",
+		getDefaultToken())
+	if err != nil {
+		return usage, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &usage)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return usage, body, err
+}
+
+// RestoreTrashItem restores the given trash item to its original path and checks the received HTTP Status code
+// against expectedStatusCode.
+func RestoreTrashItem(username string, item vfs.TrashItem, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := addPathAndIDQueryParams(buildURLRelativeToBase(trashPath, username, "restore"), item.Path, item.ID)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// PurgeTrashItems permanently removes the trash item with the given id, all the items deleted from the given path
+// if itemID is empty or all the items if virtualPath is empty too, and checks the received HTTP Status code against
+// expectedStatusCode.
+func PurgeTrashItems(username, virtualPath, itemID string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := addPathAndIDQueryParams(buildURLRelativeToBase(trashPath, username), virtualPath, itemID)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodDelete, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetTieringReport returns the files that the tiering policy for the given user would move and checks the received
+// HTTP Status code against expectedStatusCode.
+func GetTieringReport(username string, expectedStatusCode int) (vfs.TieringReport, []byte, error) {
+	return sendTieringRequest(http.MethodGet, username, expectedStatusCode)
+}
+
+// ApplyTieringPolicy moves the files matching the tiering policy for the given user to the tiering target and
+// checks the received HTTP Status code against expectedStatusCode.
+func ApplyTieringPolicy(username string, expectedStatusCode int) (vfs.TieringReport, []byte, error) {
+	return sendTieringRequest(http.MethodPost, username, expectedStatusCode)
+}
+
+func sendTieringRequest(method, username string, expectedStatusCode int) (vfs.TieringReport, []byte, error) {
+	var report vfs.TieringReport
+	var body []byte
+	resp, err := sendHTTPRequest(method, buildURLRelativeToBase(tieringPath, username), nil, "", getDefaultToken())
+	if err != nil {
+		return report, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &report)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return report, body, err
+}
+
+// GetReplicationStatus returns the replication status, including the failed jobs in the specified range,
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetReplicationStatus(limit, offset int64, expectedStatusCode int) (common.ReplicationStatus, []byte, error) {
+	var status common.ReplicationStatus
+	var body []byte
+	url, err := addLimitAndOffsetQueryParams(buildURLRelativeToBase(replicationPath), limit, offset)
+	if err != nil {
+		return status, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// StartReplicationResync queues a replication resync for the given user, or for all the users if username is
+// empty, and checks the received HTTP Status code against expectedStatusCode.
+func StartReplicationResync(username string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(replicationPath, "resync"))
+	if err != nil {
+		return body, err
+	}
+	if username != "" {
+		q := url.Query()
+		q.Add("username", username)
+		url.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
 // GetConnections returns status and stats for active SFTP/SCP connections
 func GetConnections(expectedStatusCode int) ([]common.ConnectionStatus, []byte, error) {
 	var connections []common.ConnectionStatus
@@ -905,6 +1134,130 @@ func compareUserFsConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if err := compareSFTPFsConfig(expected, actual); err != nil {
 		return err
 	}
+	if err := compareWebDAVFsConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareFTPFsConfig(expected, actual); err != nil {
+		return err
+	}
+	if expected.FsConfig.MemoryConfig.MaxSize != actual.FsConfig.MemoryConfig.MaxSize {
+		return errors.New("memory fs max size mismatch")
+	}
+	if expected.FsConfig.OverlayConfig.LowerPath != actual.FsConfig.OverlayConfig.LowerPath {
+		return errors.New("overlay lower path mismatch")
+	}
+	if expected.FsConfig.CacheConfig.Mode != actual.FsConfig.CacheConfig.Mode {
+		return errors.New("read cache mode mismatch")
+	}
+	if err := compareCompressionConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareVersioningConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareTrashConfig(expected, actual); err != nil {
+		return err
+	}
+	return compareTieringConfig(expected, actual)
+}
+
+func compareTieringConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.TieringConfig.Enabled != actual.FsConfig.TieringConfig.Enabled {
+		return errors.New("tiering enabled mismatch")
+	}
+	if !expected.FsConfig.TieringConfig.IsEnabled() {
+		return nil
+	}
+	if expected.FsConfig.TieringConfig.MinAge != actual.FsConfig.TieringConfig.MinAge {
+		return errors.New("tiering min age mismatch")
+	}
+	if expected.FsConfig.TieringConfig.Recall != actual.FsConfig.TieringConfig.Recall {
+		return errors.New("tiering recall mismatch")
+	}
+	if len(expected.FsConfig.TieringConfig.Paths) != len(actual.FsConfig.TieringConfig.Paths) {
+		return errors.New("tiering paths mismatch")
+	}
+	for _, p := range expected.FsConfig.TieringConfig.Paths {
+		if !utils.IsStringInSlice(p, actual.FsConfig.TieringConfig.Paths) {
+			return errors.New("tiering paths content mismatch")
+		}
+	}
+	return nil
+}
+
+func compareTrashConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.TrashConfig.Enabled != actual.FsConfig.TrashConfig.Enabled {
+		return errors.New("trash enabled mismatch")
+	}
+	if expected.FsConfig.TrashConfig.IsEnabled() &&
+		expected.FsConfig.TrashConfig.Retention != actual.FsConfig.TrashConfig.Retention {
+		return errors.New("trash retention mismatch")
+	}
+	if expected.FsConfig.TrashConfig.IsEnabled() &&
+		expected.FsConfig.TrashConfig.QuotaSize != actual.FsConfig.TrashConfig.QuotaSize {
+		return errors.New("trash quota size mismatch")
+	}
+	return nil
+}
+
+func compareVersioningConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.VersioningConfig.Enabled != actual.FsConfig.VersioningConfig.Enabled {
+		return errors.New("versioning enabled mismatch")
+	}
+	if !expected.FsConfig.VersioningConfig.IsEnabled() {
+		// the other settings are reset if versioning is disabled
+		if actual.FsConfig.VersioningConfig.MaxVersions != 0 || actual.FsConfig.VersioningConfig.MaxAge != 0 ||
+			actual.FsConfig.VersioningConfig.QuotaSize != 0 || len(actual.FsConfig.VersioningConfig.Paths) > 0 {
+			return errors.New("versioning config not reset")
+		}
+		return nil
+	}
+	if expected.FsConfig.VersioningConfig.MaxVersions != actual.FsConfig.VersioningConfig.MaxVersions {
+		return errors.New("versioning max versions mismatch")
+	}
+	if expected.FsConfig.VersioningConfig.MaxAge != actual.FsConfig.VersioningConfig.MaxAge {
+		return errors.New("versioning max age mismatch")
+	}
+	if expected.FsConfig.VersioningConfig.QuotaSize != actual.FsConfig.VersioningConfig.QuotaSize {
+		return errors.New("versioning quota size mismatch")
+	}
+	if len(expected.FsConfig.VersioningConfig.Paths) != len(actual.FsConfig.VersioningConfig.Paths) {
+		return errors.New("versioning paths mismatch")
+	}
+	for _, p := range expected.FsConfig.VersioningConfig.Paths {
+		if !utils.IsStringInSlice(p, actual.FsConfig.VersioningConfig.Paths) {
+			return errors.New("versioning paths content mismatch")
+		}
+	}
+	return nil
+}
+
+func compareCompressionConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.CompressionConfig.Algorithm != actual.FsConfig.CompressionConfig.Algorithm {
+		return errors.New("compression algorithm mismatch")
+	}
+	if !expected.FsConfig.CompressionConfig.IsEnabled() {
+		// the other settings are reset if the compression is disabled
+		if actual.FsConfig.CompressionConfig.Level != 0 || actual.FsConfig.CompressionConfig.QuotaMode != 0 ||
+			len(actual.FsConfig.CompressionConfig.Paths) > 0 {
+			return errors.New("compression config not reset")
+		}
+		return nil
+	}
+	if expected.FsConfig.CompressionConfig.Level != actual.FsConfig.CompressionConfig.Level {
+		return errors.New("compression level mismatch")
+	}
+	if expected.FsConfig.CompressionConfig.QuotaMode != actual.FsConfig.CompressionConfig.QuotaMode {
+		return errors.New("compression quota mode mismatch")
+	}
+	if len(expected.FsConfig.CompressionConfig.Paths) != len(actual.FsConfig.CompressionConfig.Paths) {
+		return errors.New("compression paths mismatch")
+	}
+	for _, p := range expected.FsConfig.CompressionConfig.Paths {
+		if !utils.IsStringInSlice(p, actual.FsConfig.CompressionConfig.Paths) {
+			return errors.New("compression paths content mismatch")
+		}
+	}
 	return nil
 }
 
@@ -937,6 +1290,34 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 		expected.FsConfig.S3Config.KeyPrefix+"/" != actual.FsConfig.S3Config.KeyPrefix {
 		return errors.New("S3 key prefix mismatch")
 	}
+	return compareS3SecurityConfig(expected, actual)
+}
+
+func compareS3SecurityConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.S3Config.SSEType != actual.FsConfig.S3Config.SSEType {
+		return errors.New("S3 SSE type mismatch")
+	}
+	if expected.FsConfig.S3Config.SSEKMSKeyID != actual.FsConfig.S3Config.SSEKMSKeyID {
+		return errors.New("S3 SSE KMS key ID mismatch")
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.S3Config.SSECustomerKey, actual.FsConfig.S3Config.SSECustomerKey); err != nil {
+		return fmt.Errorf("S3 SSE customer key mismatch: %v", err)
+	}
+	if expected.FsConfig.S3Config.ACL != actual.FsConfig.S3Config.ACL {
+		return errors.New("S3 ACL mismatch")
+	}
+	if expected.FsConfig.S3Config.ForcePathStyle != actual.FsConfig.S3Config.ForcePathStyle {
+		return errors.New("S3 force path style mismatch")
+	}
+	if expected.FsConfig.S3Config.ListMetadata != actual.FsConfig.S3Config.ListMetadata {
+		return errors.New("S3 list metadata mismatch")
+	}
+	if expected.FsConfig.S3Config.EmulateSymlinks != actual.FsConfig.S3Config.EmulateSymlinks {
+		return errors.New("S3 emulate symlinks mismatch")
+	}
+	if expected.FsConfig.S3Config.ObjectLockMode != actual.FsConfig.S3Config.ObjectLockMode {
+		return errors.New("S3 object lock mode mismatch")
+	}
 	return nil
 }
 
@@ -947,6 +1328,9 @@ func compareGCSConfig(expected *dataprovider.User, actual *dataprovider.User) er
 	if expected.FsConfig.GCSConfig.StorageClass != actual.FsConfig.GCSConfig.StorageClass {
 		return errors.New("GCS storage class mismatch")
 	}
+	if expected.FsConfig.GCSConfig.EmulateSymlinks != actual.FsConfig.GCSConfig.EmulateSymlinks {
+		return errors.New("GCS emulate symlinks mismatch")
+	}
 	if expected.FsConfig.GCSConfig.KeyPrefix != actual.FsConfig.GCSConfig.KeyPrefix &&
 		expected.FsConfig.GCSConfig.KeyPrefix+"/" != actual.FsConfig.GCSConfig.KeyPrefix {
 		return errors.New("GCS key prefix mismatch")
@@ -986,6 +1370,60 @@ func compareSFTPFsConfig(expected *dataprovider.User, actual *dataprovider.User)
 	return nil
 }
 
+func compareWebDAVFsConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.WebDAVConfig.Endpoint != actual.FsConfig.WebDAVConfig.Endpoint {
+		return errors.New("WebDAVFs endpoint mismatch")
+	}
+	if expected.FsConfig.WebDAVConfig.Username != actual.FsConfig.WebDAVConfig.Username {
+		return errors.New("WebDAVFs username mismatch")
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.WebDAVConfig.Password, actual.FsConfig.WebDAVConfig.Password); err != nil {
+		return fmt.Errorf("WebDAVFs password mismatch: %v", err)
+	}
+	if expected.FsConfig.WebDAVConfig.SkipTLSVerify != actual.FsConfig.WebDAVConfig.SkipTLSVerify {
+		return errors.New("WebDAVFs skip TLS verify mismatch")
+	}
+	if expected.FsConfig.WebDAVConfig.CACertificate != actual.FsConfig.WebDAVConfig.CACertificate {
+		return errors.New("WebDAVFs CA certificate mismatch")
+	}
+	if expected.FsConfig.WebDAVConfig.Prefix != actual.FsConfig.WebDAVConfig.Prefix {
+		if expected.FsConfig.WebDAVConfig.Prefix != "" && actual.FsConfig.WebDAVConfig.Prefix != "/" {
+			return errors.New("WebDAVFs prefix mismatch")
+		}
+	}
+	return nil
+}
+
+func compareFTPFsConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.FTPConfig.Endpoint != actual.FsConfig.FTPConfig.Endpoint {
+		return errors.New("FTPFs endpoint mismatch")
+	}
+	if expected.FsConfig.FTPConfig.Username != actual.FsConfig.FTPConfig.Username {
+		return errors.New("FTPFs username mismatch")
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.FTPConfig.Password, actual.FsConfig.FTPConfig.Password); err != nil {
+		return fmt.Errorf("FTPFs password mismatch: %v", err)
+	}
+	if expected.FsConfig.FTPConfig.TLSMode != actual.FsConfig.FTPConfig.TLSMode {
+		return errors.New("FTPFs TLS mode mismatch")
+	}
+	if expected.FsConfig.FTPConfig.SkipTLSVerify != actual.FsConfig.FTPConfig.SkipTLSVerify {
+		return errors.New("FTPFs skip TLS verify mismatch")
+	}
+	if expected.FsConfig.FTPConfig.DisableEPSV != actual.FsConfig.FTPConfig.DisableEPSV {
+		return errors.New("FTPFs disable EPSV mismatch")
+	}
+	if expected.FsConfig.FTPConfig.ActiveMode != actual.FsConfig.FTPConfig.ActiveMode {
+		return errors.New("FTPFs active mode mismatch")
+	}
+	if expected.FsConfig.FTPConfig.Prefix != actual.FsConfig.FTPConfig.Prefix {
+		if expected.FsConfig.FTPConfig.Prefix != "" && actual.FsConfig.FTPConfig.Prefix != "/" {
+			return errors.New("FTPFs prefix mismatch")
+		}
+	}
+	return nil
+}
+
 func compareAzBlobConfig(expected *dataprovider.User, actual *dataprovider.User) error {
 	if expected.FsConfig.AzBlobConfig.Container != actual.FsConfig.AzBlobConfig.Container {
 		return errors.New("Azure Blob container mismatch")
@@ -1018,6 +1456,9 @@ func compareAzBlobConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if expected.FsConfig.AzBlobConfig.AccessTier != actual.FsConfig.AzBlobConfig.AccessTier {
 		return errors.New("Azure Blob access tier mismatch")
 	}
+	if expected.FsConfig.AzBlobConfig.EmulateSymlinks != actual.FsConfig.AzBlobConfig.EmulateSymlinks {
+		return errors.New("Azure Blob emulate symlinks mismatch")
+	}
 	return nil
 }
 
@@ -1101,6 +1542,12 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 	if err := compareUserFileExtensionsFilters(expected, actual); err != nil {
 		return err
 	}
+	if err := compareUserMimeTypesFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserRetentionFilters(expected, actual); err != nil {
+		return err
+	}
 	return compareUserFilePatternsFilters(expected, actual)
 }
 
@@ -1125,7 +1572,8 @@ func compareUserFilePatternsFilters(expected *dataprovider.User, actual *datapro
 		for _, f1 := range actual.Filters.FilePatterns {
 			if path.Clean(f.Path) == path.Clean(f1.Path) {
 				if !checkFilterMatch(f.AllowedPatterns, f1.AllowedPatterns) ||
-					!checkFilterMatch(f.DeniedPatterns, f1.DeniedPatterns) {
+					!checkFilterMatch(f.DeniedPatterns, f1.DeniedPatterns) ||
+					!checkFilterMatch(f.HiddenPatterns, f1.HiddenPatterns) || f.DenyListing != f1.DenyListing {
 					return errors.New("file patterns contents mismatch")
 				}
 				found = true
@@ -1138,6 +1586,49 @@ func compareUserFilePatternsFilters(expected *dataprovider.User, actual *datapro
 	return nil
 }
 
+func compareUserMimeTypesFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.MimeTypes) != len(actual.Filters.MimeTypes) {
+		return errors.New("mime types mismatch")
+	}
+	for _, f := range expected.Filters.MimeTypes {
+		found := false
+		for _, f1 := range actual.Filters.MimeTypes {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if !checkFilterMatch(f.AllowedMimeTypes, f1.AllowedMimeTypes) ||
+					!checkFilterMatch(f.DeniedMimeTypes, f1.DeniedMimeTypes) {
+					return errors.New("mime types contents mismatch")
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("mime types contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserRetentionFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.Retention) != len(actual.Filters.Retention) {
+		return errors.New("retention filters mismatch")
+	}
+	for _, f := range expected.Filters.Retention {
+		found := false
+		for _, f1 := range actual.Filters.Retention {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if f.Days != f1.Days || f.LegalHold != f1.LegalHold {
+					return errors.New("retention filters contents mismatch")
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("retention filters contents mismatch")
+		}
+	}
+	return nil
+}
+
 func compareUserFileExtensionsFilters(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(expected.Filters.FileExtensions) != len(actual.Filters.FileExtensions) {
 		return errors.New("file extensions mismatch")
@@ -1244,3 +1735,19 @@ func addDisconnectQueryParam(rawurl, disconnect string) (*url.URL, error) {
 	url.RawQuery = q.Encode()
 	return url, err
 }
+
+func addPathAndIDQueryParams(rawurl, virtualPath, id string) (*url.URL, error) {
+	url, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Query()
+	if virtualPath != "" {
+		q.Add("path", virtualPath)
+	}
+	if id != "" {
+		q.Add("id", id)
+	}
+	url.RawQuery = q.Encode()
+	return url, err
+}
@@ -4,6 +4,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/go-chi/chi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -521,6 +523,72 @@ var (
 		Name: "sftpgo_az_head_container_errors",
 		Help: "The total number of Azure head container errors",
 	})
+
+	// totalReadCacheHits is the metric that reports the total downloads served from the read cache
+	totalReadCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_read_cache_hits_total",
+		Help: "The total number of downloads served from the local read cache",
+	})
+
+	// totalReadCacheMisses is the metric that reports the total downloads not found in the read cache
+	totalReadCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_read_cache_misses_total",
+		Help: "The total number of downloads not found in the local read cache",
+	})
+
+	// readCacheSize is the metric that reports the size of the files stored in the read cache as bytes
+	readCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_read_cache_size",
+		Help: "The size of the files stored in the local read cache as bytes",
+	})
+
+	// sftpFsPoolConnections is the metric that reports the number of open SSH connections to the SFTP storage backends
+	sftpFsPoolConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_sftpfs_connections",
+		Help: "The number of open SSH connections to the SFTP storage backends",
+	})
+
+	// sftpFsPoolSessions is the metric that reports the number of SFTP sessions using the shared SSH connections
+	sftpFsPoolSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_sftpfs_sessions",
+		Help: "The number of SFTP sessions using the SSH connections to the SFTP storage backends",
+	})
+
+	// totalSFTPFsPoolDials is the metric that reports the total SSH connections established to the SFTP storage backends
+	totalSFTPFsPoolDials = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_sftpfs_dials_total",
+		Help: "The total number of SSH connections established to the SFTP storage backends",
+	})
+
+	// totalSFTPFsPoolDialErrors is the metric that reports the total failed SSH connections to the SFTP storage backends
+	totalSFTPFsPoolDialErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_sftpfs_dial_errors_total",
+		Help: "The total number of failed SSH connections to the SFTP storage backends",
+	})
+
+	// totalSFTPFsPoolReuses is the metric that reports the total SFTP sessions opened on an existing SSH connection
+	totalSFTPFsPoolReuses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_sftpfs_reused_connections_total",
+		Help: "The total number of SFTP sessions opened on an existing SSH connection to the SFTP storage backends",
+	})
+
+	// healthCheckStatus is the metric that reports the result of the last health check for each probed target
+	healthCheckStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_health_check_status",
+		Help: "Result of the last health check for each probed target, 1 means OK, 0 KO",
+	}, []string{"check", "target"})
+
+	// healthCheckLatency is the metric that reports the duration of the last health check for each probed target
+	healthCheckLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_health_check_latency_seconds",
+		Help: "Duration of the last health check for each probed target as seconds",
+	}, []string{"check", "target"})
+
+	// readiness is the metric that reports if all the health checks succeeded
+	readiness = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_readiness",
+		Help: "Readiness based on the last health checks, 1 means all the checks succeeded, 0 KO",
+	})
 )
 
 // AddMetricsEndpoint exposes metrics to the specified endpoint
@@ -837,3 +905,63 @@ func HTTPRequestServed(status int) {
 func UpdateActiveConnectionsSize(size int) {
 	activeConnections.Set(float64(size))
 }
+
+// ReadCacheAccessed updates the read cache hit/miss metrics
+func ReadCacheAccessed(hit bool) {
+	if hit {
+		totalReadCacheHits.Inc()
+	} else {
+		totalReadCacheMisses.Inc()
+	}
+}
+
+// UpdateReadCacheSize sets the metric for the read cache size
+func UpdateReadCacheSize(size int64) {
+	readCacheSize.Set(float64(size))
+}
+
+// UpdateSFTPFsPoolStats sets the metrics for the SSH connections to the SFTP storage backends
+func UpdateSFTPFsPoolStats(connections, sessions int) {
+	sftpFsPoolConnections.Set(float64(connections))
+	sftpFsPoolSessions.Set(float64(sessions))
+}
+
+// SFTPFsPoolDialCompleted updates the metrics after an SSH connection attempt to an SFTP storage backend
+func SFTPFsPoolDialCompleted(err error) {
+	if err == nil {
+		totalSFTPFsPoolDials.Inc()
+	} else {
+		totalSFTPFsPoolDialErrors.Inc()
+	}
+}
+
+// SFTPFsPoolConnectionReused increments the metric for the SSH connections reused
+func SFTPFsPoolConnectionReused() {
+	totalSFTPFsPoolReuses.Inc()
+}
+
+// ResetHealthChecks removes the metrics for the previous health checks, the
+// probed targets can change between two runs
+func ResetHealthChecks() {
+	healthCheckStatus.Reset()
+	healthCheckLatency.Reset()
+}
+
+// UpdateHealthCheck sets the metrics for a completed health check
+func UpdateHealthCheck(check, target string, err error, latency time.Duration) {
+	if err == nil {
+		healthCheckStatus.WithLabelValues(check, target).Set(1)
+	} else {
+		healthCheckStatus.WithLabelValues(check, target).Set(0)
+	}
+	healthCheckLatency.WithLabelValues(check, target).Set(latency.Seconds())
+}
+
+// UpdateReadiness sets the metric for the readiness
+func UpdateReadiness(ready bool) {
+	if ready {
+		readiness.Set(1)
+	} else {
+		readiness.Set(0)
+	}
+}
@@ -3,6 +3,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/go-chi/chi"
 
 	"github.com/drakkan/sftpgo/version"
@@ -69,3 +71,28 @@ func HTTPRequestServed(status int) {}
 
 // UpdateActiveConnectionsSize sets the metric for active connections
 func UpdateActiveConnectionsSize(size int) {}
+
+// ReadCacheAccessed updates the read cache hit/miss metrics
+func ReadCacheAccessed(hit bool) {}
+
+// UpdateReadCacheSize sets the metric for the read cache size
+func UpdateReadCacheSize(size int64) {}
+
+// UpdateSFTPFsPoolStats sets the metrics for the SSH connections to the SFTP storage backends
+func UpdateSFTPFsPoolStats(connections, sessions int) {}
+
+// SFTPFsPoolDialCompleted updates the metrics after an SSH connection attempt to an SFTP storage backend
+func SFTPFsPoolDialCompleted(err error) {}
+
+// SFTPFsPoolConnectionReused increments the metric for the SSH connections reused
+func SFTPFsPoolConnectionReused() {}
+
+// ResetHealthChecks removes the metrics for the previous health checks, the
+// probed targets can change between two runs
+func ResetHealthChecks() {}
+
+// UpdateHealthCheck sets the metrics for a completed health check
+func UpdateHealthCheck(check, target string, err error, latency time.Duration) {}
+
+// UpdateReadiness sets the metric for the readiness
+func UpdateReadiness(ready bool) {}
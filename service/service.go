@@ -81,19 +81,19 @@ func (s *Service) Start() error {
 		return errors.New(infoString)
 	}
 
-	err := common.Initialize(config.GetCommonConfig())
-	if err != nil {
-		logger.Error(logSender, "", "%v", err)
-		logger.ErrorToConsole("%v", err)
-		os.Exit(1)
-	}
 	kmsConfig := config.GetKMSConfig()
-	err = kmsConfig.Initialize()
+	err := kmsConfig.Initialize()
 	if err != nil {
 		logger.Error(logSender, "", "unable to initialize KMS: %v", err)
 		logger.ErrorToConsole("unable to initialize KMS: %v", err)
 		os.Exit(1)
 	}
+	err = common.Initialize(config.GetCommonConfig())
+	if err != nil {
+		logger.Error(logSender, "", "%v", err)
+		logger.ErrorToConsole("%v", err)
+		os.Exit(1)
+	}
 
 	providerConf := config.GetProviderConf()
 
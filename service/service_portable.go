@@ -266,6 +266,11 @@ func (s *Service) configurePortableSecrets() {
 		if payload != "" {
 			s.PortableUser.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret(payload)
 		}
+		payload = s.PortableUser.FsConfig.S3Config.SSECustomerKey.GetPayload()
+		s.PortableUser.FsConfig.S3Config.SSECustomerKey = kms.NewEmptySecret()
+		if payload != "" {
+			s.PortableUser.FsConfig.S3Config.SSECustomerKey = kms.NewPlainSecret(payload)
+		}
 	case dataprovider.GCSFilesystemProvider:
 		payload := s.PortableUser.FsConfig.GCSConfig.Credentials.GetPayload()
 		s.PortableUser.FsConfig.GCSConfig.Credentials = kms.NewEmptySecret()
@@ -295,5 +300,17 @@ func (s *Service) configurePortableSecrets() {
 		if payload != "" {
 			s.PortableUser.FsConfig.SFTPConfig.PrivateKey = kms.NewPlainSecret(payload)
 		}
+	case dataprovider.WebDAVFilesystemProvider:
+		payload := s.PortableUser.FsConfig.WebDAVConfig.Password.GetPayload()
+		s.PortableUser.FsConfig.WebDAVConfig.Password = kms.NewEmptySecret()
+		if payload != "" {
+			s.PortableUser.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret(payload)
+		}
+	case dataprovider.FTPFilesystemProvider:
+		payload := s.PortableUser.FsConfig.FTPConfig.Password.GetPayload()
+		s.PortableUser.FsConfig.FTPConfig.Password = kms.NewEmptySecret()
+		if payload != "" {
+			s.PortableUser.FsConfig.FTPConfig.Password = kms.NewPlainSecret(payload)
+		}
 	}
 }
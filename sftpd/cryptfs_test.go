@@ -3,6 +3,8 @@ package sftpd_test
 import (
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -13,6 +15,7 @@ import (
 	"github.com/minio/sio"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/httpdtest"
 	"github.com/drakkan/sftpgo/kms"
@@ -89,7 +92,6 @@ func TestBasicSFTPCryptoHandling(t *testing.T) {
 }
 
 func TestOpenReadWriteCryptoFs(t *testing.T) {
-	// read and write is not supported on crypto fs
 	usePubKey := false
 	u := getTestUserWithCryptFs(usePubKey)
 	u.QuotaSize = 6553600
@@ -105,13 +107,70 @@ func TestOpenReadWriteCryptoFs(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, len(testData), n)
 			buffer := make([]byte, 128)
-			_, err = sftpFile.ReadAt(buffer, 1)
-			if assert.Error(t, err) {
-				assert.Contains(t, err.Error(), "SSH_FX_OP_UNSUPPORTED")
+			n, err = sftpFile.ReadAt(buffer, 1)
+			assert.EqualError(t, err, io.EOF.Error())
+			assert.Equal(t, len(testData)-1, n)
+			assert.Equal(t, testData[1:], buffer[:n])
+			err = sftpFile.Close()
+			assert.NoError(t, err)
+		}
+		// modify an existing file spanning multiple encrypted packages
+		testFileSize := int64(200000)
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		expected, err := ioutil.ReadFile(testFilePath)
+		assert.NoError(t, err)
+		sftpFile, err = client.OpenFile(testFileName, os.O_RDWR)
+		if assert.NoError(t, err) {
+			testData := []byte("data written across the encrypted packages boundary")
+			for _, offset := range []int64{65530, 10, 131070, testFileSize - 5} {
+				n, err := sftpFile.WriteAt(testData, offset)
+				assert.NoError(t, err)
+				assert.Equal(t, len(testData), n)
+				end := offset + int64(len(testData))
+				if end > int64(len(expected)) {
+					expected = append(expected, make([]byte, end-int64(len(expected)))...)
+				}
+				copy(expected[offset:], testData)
 			}
+			buffer := make([]byte, 100)
+			n, err := sftpFile.ReadAt(buffer, 65500)
+			assert.NoError(t, err)
+			assert.Equal(t, expected[65500:65500+n], buffer[:n])
 			err = sftpFile.Close()
 			assert.NoError(t, err)
 		}
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(len(expected)), info.Size())
+		}
+		encryptedFileSize, err := getEncryptedFileSize(int64(len(expected)))
+		assert.NoError(t, err)
+		info, err = os.Stat(filepath.Join(user.HomeDir, testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, encryptedFileSize, info.Size())
+		}
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, int64(len(expected)), client)
+		assert.NoError(t, err)
+		downloaded, err := ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, downloaded)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, encryptedFileSize, user.UsedQuotaSize)
+		// no temporary file must be left
+		files, err := ioutil.ReadDir(user.HomeDir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
 	}
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
@@ -159,9 +218,9 @@ func TestEmptyFile(t *testing.T) {
 }
 
 func TestUploadResumeCryptFs(t *testing.T) {
-	// upload resume is not supported
 	usePubKey := true
 	u := getTestUserWithCryptFs(usePubKey)
+	u.QuotaFiles = 100
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
@@ -178,11 +237,77 @@ func TestUploadResumeCryptFs(t *testing.T) {
 		assert.NoError(t, err)
 		err = appendToTestFile(testFilePath, appendDataSize)
 		assert.NoError(t, err)
-		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
-		if assert.Error(t, err) {
-			assert.Contains(t, err.Error(), "SSH_FX_OP_UNSUPPORTED")
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+appendDataSize, false, client)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+appendDataSize, client)
+		assert.NoError(t, err)
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, initialHash, downloadedFileHash)
+		encryptedFileSize, err := getEncryptedFileSize(testFileSize + appendDataSize)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, encryptedFileSize, user.UsedQuotaSize)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestInterruptedUploadCryptFs(t *testing.T) {
+	usePubKey := true
+	u := getTestUserWithCryptFs(usePubKey)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(524288)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(testFilePath)
+	assert.NoError(t, err)
+	partialSize := int64(150000)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		f, err := client.Create(testFileName)
+		if assert.NoError(t, err) {
+			_, err = f.Write(content[:partialSize])
+			assert.NoError(t, err)
 		}
+		// close the connection without closing the file
+		client.Close()
+	}
+	assert.Eventually(t, func() bool { return len(common.Connections.GetStats()) == 0 }, 1*time.Second, 50*time.Millisecond)
+	// the received data is a valid encrypted file
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, partialSize, info.Size())
+		}
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		downloaded, err := ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, content, downloaded)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
 	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
@@ -332,9 +457,10 @@ func TestGetMimeTypeCryptFs(t *testing.T) {
 }
 
 func TestTruncate(t *testing.T) {
-	// truncate is not supported
 	usePubKey := true
-	user, _, err := httpdtest.AddUser(getTestUserWithCryptFs(usePubKey), http.StatusCreated)
+	u := getTestUserWithCryptFs(usePubKey)
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
 	client, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
@@ -348,8 +474,59 @@ func TestTruncate(t *testing.T) {
 		}
 		err = f.Close()
 		assert.NoError(t, err)
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(131072)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		content, err := ioutil.ReadFile(testFilePath)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// truncate by path
+		err = client.Truncate(testFileName, 70000)
+		assert.NoError(t, err)
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(70000), info.Size())
+		}
+		encryptedFileSize, err := getEncryptedFileSize(70000)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, encryptedFileSize, user.UsedQuotaSize)
+		// truncate using an open handle, the removed data must be read as zeros if the file grows
+		f, err = client.OpenFile(testFileName, os.O_RDWR)
+		if assert.NoError(t, err) {
+			err = f.Truncate(100)
+			assert.NoError(t, err)
+			err = f.Truncate(200)
+			assert.NoError(t, err)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		expected := append(content[:100:100], make([]byte, 100)...)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, 200, client)
+		assert.NoError(t, err)
+		downloaded, err := ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, downloaded)
+		encryptedFileSize, err = getEncryptedFileSize(200)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, encryptedFileSize, user.UsedQuotaSize)
 		err = client.Truncate(testFileName, 0)
-		assert.Error(t, err)
+		assert.NoError(t, err)
+		info, err = client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), info.Size())
+		}
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
 	}
 
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
@@ -0,0 +1,534 @@
+package sftpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// SFTP packet types and status codes, see draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketVersion       = 2
+	sftpPacketOpen          = 3
+	sftpPacketClose         = 4
+	sftpPacketOpendir       = 11
+	sftpPacketStatus        = 101
+	sftpPacketHandle        = 102
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+
+	sftpStatusOk            = 0
+	sftpStatusEOF           = 1
+	sftpStatusNoSuchFile    = 2
+	sftpStatusPermission    = 3
+	sftpStatusFailure       = 4
+	sftpStatusBadMessage    = 5
+	sftpStatusOpUnsupported = 8
+
+	sftpFlagRead   = 0x00000001
+	sftpFlagWrite  = 0x00000002
+	sftpFlagAppend = 0x00000004
+	sftpFlagCreat  = 0x00000008
+	sftpFlagTrunc  = 0x00000010
+)
+
+// limits reported for limits@openssh.com. pkg/sftp rejects the packets longer
+// than 256KB and it returns up to 32KB for each read request
+const (
+	sftpMaxPacketLength = 256 * 1024
+	sftpMaxReadLength   = 32 * 1024
+	sftpMaxWriteLength  = sftpMaxPacketLength - 1024
+	// check-file requests with a smaller, non zero, block size must be rejected
+	checkFileMinBlockSize = 256
+)
+
+var checkFileAlgorithms = []string{common.ChecksumMD5, common.ChecksumSHA1, common.ChecksumSHA256,
+	common.ChecksumSHA384, common.ChecksumSHA512}
+
+// extended requests handled by extensionsChannel and advertised, together
+// with the ones handled by pkg/sftp, in the version packet
+var handledSFTPExtensions = []struct {
+	name string
+	data string
+}{
+	{"statvfs@openssh.com", "2"},
+	{"limits@openssh.com", "1"},
+	{"check-file", strings.Join(checkFileAlgorithms, ",")},
+	{"copy-data", "1"},
+}
+
+var errInvalidSFTPPacket = errors.New("invalid SFTP packet")
+
+// openHandle defines a file or directory handle returned by pkg/sftp
+type openHandle struct {
+	virtualPath string
+	isDir       bool
+	pflags      uint32
+	transfer    *transfer
+	// extended requests in progress for this handle
+	inProgress sync.WaitGroup
+}
+
+// extensionsChannel wraps the channel used by the pkg/sftp request server and
+// handles the extended requests that pkg/sftp does not dispatch to the handlers.
+// The other packets are passed through, the open requests and the returned
+// handles are tracked so the extended requests can refer to them.
+// The extended requests that read or write file contents are executed in
+// their own goroutine so they don't block the other requests
+type extensionsChannel struct {
+	io.ReadWriteCloser
+	connection *Connection
+	// pass-through data not yet read by pkg/sftp
+	pending   []byte
+	writeLock sync.Mutex
+	sync.Mutex
+	// open and opendir requests waiting for a handle, by request id
+	openRequests map[uint32]*openHandle
+	handles      map[string]*openHandle
+	// ids of the open requests not yet processed by the pkg/sftp handlers,
+	// in the order they are received
+	pendingOpens []uint32
+}
+
+func newExtensionsChannel(channel io.ReadWriteCloser, connection *Connection) *extensionsChannel {
+	c := &extensionsChannel{
+		ReadWriteCloser: channel,
+		connection:      connection,
+		openRequests:    make(map[uint32]*openHandle),
+		handles:         make(map[string]*openHandle),
+	}
+	connection.extensions = c
+	return c
+}
+
+// Read returns the packets to handle to pkg/sftp, the supported extended
+// requests are handled here and they are never returned
+func (c *extensionsChannel) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		packet, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if !c.handlePacket(packet[4:]) {
+			c.pending = packet
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends the packets generated by pkg/sftp, they are always written
+// in a single call
+func (c *extensionsChannel) Write(p []byte) (int, error) {
+	if len(p) > 5 && binary.BigEndian.Uint32(p) == uint32(len(p)-4) {
+		switch p[4] {
+		case sftpPacketVersion:
+			return c.writeVersion(p)
+		case sftpPacketHandle, sftpPacketStatus:
+			c.trackHandle(p[4], p[5:])
+		}
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.ReadWriteCloser.Write(p)
+}
+
+func (c *extensionsChannel) readPacket() ([]byte, error) {
+	packet := make([]byte, 4)
+	if _, err := io.ReadFull(c.ReadWriteCloser, packet); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(packet)
+	if length == 0 || length > sftpMaxPacketLength {
+		// pkg/sftp will close the connection
+		return packet, nil
+	}
+	packet = append(packet, make([]byte, length)...)
+	if _, err := io.ReadFull(c.ReadWriteCloser, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (c *extensionsChannel) writePacket(data []byte) error {
+	packet := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)))
+	packet = append(packet, data...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.ReadWriteCloser.Write(packet)
+	return err
+}
+
+// writeVersion adds the extensions handled here to the version packet
+func (c *extensionsChannel) writeVersion(p []byte) (int, error) {
+	data := append([]byte{}, p[4:]...)
+	for _, ext := range handledSFTPExtensions {
+		data = marshalSFTPString(data, ext.name)
+		data = marshalSFTPString(data, ext.data)
+	}
+	if err := c.writePacket(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// handlePacket returns true if the packet is handled and it must not be
+// passed to pkg/sftp
+func (c *extensionsChannel) handlePacket(packet []byte) bool {
+	if len(packet) < 5 {
+		return false
+	}
+	packetType := packet[0]
+	id := binary.BigEndian.Uint32(packet[1:])
+	data := packet[5:]
+
+	switch packetType {
+	case sftpPacketOpen, sftpPacketOpendir:
+		if name, data, err := unmarshalSFTPString(data); err == nil {
+			// the open flags are not included in opendir requests
+			pflags, _, _ := unmarshalSFTPUint32(data)
+			h := &openHandle{
+				virtualPath: utils.CleanPath(name),
+				isDir:       packetType == sftpPacketOpendir,
+				pflags:      pflags,
+			}
+			c.Lock()
+			c.openRequests[id] = h
+			// pkg/sftp rejects the open requests without these flags before
+			// calling the handlers
+			if !h.isDir && pflags&(sftpFlagRead|sftpFlagWrite|sftpFlagAppend|sftpFlagCreat|sftpFlagTrunc) != 0 {
+				c.pendingOpens = append(c.pendingOpens, id)
+			}
+			c.Unlock()
+		}
+	case sftpPacketClose:
+		if handle, _, err := unmarshalSFTPString(data); err == nil {
+			c.Lock()
+			h, ok := c.handles[handle]
+			delete(c.handles, handle)
+			c.Unlock()
+			if ok {
+				// the transfer must not be closed while it is in use
+				h.inProgress.Wait()
+			}
+		}
+	case sftpPacketExtended:
+		name, data, err := unmarshalSFTPString(data)
+		if err != nil {
+			return false
+		}
+		switch name {
+		case "statvfs@openssh.com":
+			c.handleStatVFS(id, data)
+		case "limits@openssh.com":
+			c.handleLimits(id)
+		case "check-file-name", "check-file-handle":
+			c.handleCheckFile(id, data, name == "check-file-handle")
+		case "copy-data":
+			c.handleCopyData(id, data)
+		default:
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// trackHandle associates the handle returned by pkg/sftp to the open request
+// with the same id
+func (c *extensionsChannel) trackHandle(packetType byte, data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(data)
+
+	c.Lock()
+	defer c.Unlock()
+
+	h, ok := c.openRequests[id]
+	if !ok {
+		return
+	}
+	delete(c.openRequests, id)
+	// the open requests rejected before calling the handlers are still pending
+	for idx, pendingID := range c.pendingOpens {
+		if pendingID == id {
+			c.pendingOpens = append(c.pendingOpens[:idx], c.pendingOpens[idx+1:]...)
+			break
+		}
+	}
+	if packetType != sftpPacketHandle {
+		return
+	}
+	handle, _, err := unmarshalSFTPString(data[4:])
+	if err != nil {
+		return
+	}
+	c.handles[handle] = h
+}
+
+// setOpenedTransfer associates the transfer opened by a handler, nil if the
+// open failed, to the open request being processed. pkg/sftp processes the
+// open requests sequentially, in the order they are received, so the handler
+// call is for the first pending request for the same path. The previous
+// pending requests never reached the handlers
+func (c *extensionsChannel) setOpenedTransfer(requestPath string, t *transfer) {
+	virtualPath := utils.CleanPath(requestPath)
+
+	c.Lock()
+	defer c.Unlock()
+
+	for idx, id := range c.pendingOpens {
+		h, ok := c.openRequests[id]
+		if !ok || h.virtualPath != virtualPath {
+			continue
+		}
+		h.transfer = t
+		c.pendingOpens = c.pendingOpens[idx+1:]
+		return
+	}
+	if t != nil {
+		c.connection.Log(logger.LevelWarn, "no open request found for the transfer %#v", virtualPath)
+	}
+}
+
+// acquireHandles returns the open handles for the given names and it marks
+// them as in use, so they are not closed until releaseHandles is called.
+// The found handles must be released even if some names are not found
+func (c *extensionsChannel) acquireHandles(names ...string) ([]*openHandle, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	var handles []*openHandle
+	for _, name := range names {
+		h, ok := c.handles[name]
+		if !ok {
+			return handles, false
+		}
+		h.inProgress.Add(1)
+		handles = append(handles, h)
+	}
+	return handles, true
+}
+
+func (c *extensionsChannel) releaseHandles(handles []*openHandle) {
+	for _, h := range handles {
+		h.inProgress.Done()
+	}
+}
+
+func (c *extensionsChannel) handleStatVFS(id uint32, data []byte) {
+	name, _, err := unmarshalSFTPString(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	stat, err := c.connection.getStatVFS(utils.CleanPath(name))
+	if err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+	stat.ID = id
+	// the id is the first field of the struct and so it follows the packet type
+	var buf bytes.Buffer
+	buf.WriteByte(sftpPacketExtendedReply)
+	if err = binary.Write(&buf, binary.BigEndian, stat); err != nil {
+		c.sendStatus(id, err)
+		return
+	}
+	c.writePacket(buf.Bytes()) //nolint:errcheck
+}
+
+func (c *extensionsChannel) handleLimits(id uint32) {
+	reply := marshalSFTPUint32([]byte{sftpPacketExtendedReply}, id)
+	reply = marshalSFTPUint64(reply, sftpMaxPacketLength)
+	reply = marshalSFTPUint64(reply, sftpMaxReadLength)
+	reply = marshalSFTPUint64(reply, sftpMaxWriteLength)
+	// no limit for the open handles
+	reply = marshalSFTPUint64(reply, 0)
+	c.writePacket(reply) //nolint:errcheck
+}
+
+func (c *extensionsChannel) handleCheckFile(id uint32, data []byte, isHandle bool) {
+	name, data, err := unmarshalSFTPString(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	algos, data, err := unmarshalSFTPString(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	startOffset, data, err := unmarshalSFTPUint64(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	length, data, err := unmarshalSFTPUint64(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	blockSize, _, err := unmarshalSFTPUint32(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	virtualPath := utils.CleanPath(name)
+	var handles []*openHandle
+	if isHandle {
+		h, ok := c.acquireHandles(name)
+		if !ok || h[0].isDir {
+			c.releaseHandles(h)
+			c.sendStatus(id, fmt.Errorf("invalid file handle %#v", name))
+			return
+		}
+		virtualPath = h[0].virtualPath
+		handles = h
+	}
+	go func() {
+		defer c.releaseHandles(handles)
+
+		algo, hashes, err := c.connection.checkFile(virtualPath, strings.Split(algos, ","), int64(startOffset),
+			int64(length), int64(blockSize))
+		if err != nil {
+			c.sendStatus(id, err)
+			return
+		}
+		reply := marshalSFTPUint32([]byte{sftpPacketExtendedReply}, id)
+		reply = marshalSFTPString(reply, "check-file")
+		reply = marshalSFTPString(reply, algo)
+		reply = append(reply, hashes...)
+		c.writePacket(reply) //nolint:errcheck
+	}()
+}
+
+func (c *extensionsChannel) handleCopyData(id uint32, data []byte) {
+	readHandle, data, err := unmarshalSFTPString(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	readOffset, data, err := unmarshalSFTPUint64(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	readLength, data, err := unmarshalSFTPUint64(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	writeHandle, data, err := unmarshalSFTPString(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	writeOffset, _, err := unmarshalSFTPUint64(data)
+	if err != nil {
+		c.sendStatus(id, errInvalidSFTPPacket)
+		return
+	}
+	handles, ok := c.acquireHandles(readHandle, writeHandle)
+	if !ok || handles[0].transfer == nil || handles[1].transfer == nil {
+		c.releaseHandles(handles)
+		c.sendStatus(id, fmt.Errorf("invalid handles %#v, %#v", readHandle, writeHandle))
+		return
+	}
+	go func() {
+		defer c.releaseHandles(handles)
+
+		err := c.connection.copyData(handles[0], handles[1], int64(readOffset), int64(readLength), int64(writeOffset))
+		c.sendStatus(id, err)
+	}()
+}
+
+func (c *extensionsChannel) sendStatus(id uint32, err error) {
+	code := uint32(sftpStatusOk)
+	message := ""
+	if err != nil {
+		code = getSFTPStatusCode(err)
+		message = err.Error()
+	}
+	reply := marshalSFTPUint32([]byte{sftpPacketStatus}, id)
+	reply = marshalSFTPUint32(reply, code)
+	reply = marshalSFTPString(reply, message)
+	reply = marshalSFTPString(reply, "")
+	c.writePacket(reply) //nolint:errcheck
+}
+
+func getSFTPStatusCode(err error) uint32 {
+	switch err {
+	case io.EOF, sftp.ErrSSHFxEOF:
+		return sftpStatusEOF
+	case sftp.ErrSSHFxNoSuchFile:
+		return sftpStatusNoSuchFile
+	case sftp.ErrSSHFxPermissionDenied, common.ErrPermissionDenied:
+		return sftpStatusPermission
+	case sftp.ErrSSHFxBadMessage, errInvalidSFTPPacket:
+		return sftpStatusBadMessage
+	case sftp.ErrSSHFxOpUnsupported, common.ErrOpUnsupported:
+		return sftpStatusOpUnsupported
+	}
+	if os.IsNotExist(err) {
+		return sftpStatusNoSuchFile
+	}
+	if os.IsPermission(err) {
+		return sftpStatusPermission
+	}
+	return sftpStatusFailure
+}
+
+func marshalSFTPUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func marshalSFTPUint64(b []byte, v uint64) []byte {
+	return marshalSFTPUint32(marshalSFTPUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func marshalSFTPString(b []byte, v string) []byte {
+	return append(marshalSFTPUint32(b, uint32(len(v))), v...)
+}
+
+func unmarshalSFTPUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, errInvalidSFTPPacket
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func unmarshalSFTPUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, errInvalidSFTPPacket
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+func unmarshalSFTPString(b []byte) (string, []byte, error) {
+	n, b, err := unmarshalSFTPUint32(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(b)) < n {
+		return "", nil, errInvalidSFTPPacket
+	}
+	return string(b[:n]), b[n:], nil
+}
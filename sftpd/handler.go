@@ -1,10 +1,14 @@
 package sftpd
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -12,9 +16,19 @@ import (
 	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
+const (
+	statVFSBlockSize = 4096
+	// sizes reported if there are no quota limits and the available disk size
+	// is unknown, for example for cloud storage backends
+	statVFSUnlimitedSize  = 1 << 50
+	statVFSUnlimitedFiles = 1 << 32
+	statVFSMaxNameLength  = 255
+)
+
 // Connection details for an authenticated user
 type Connection struct {
 	*common.BaseConnection
@@ -24,6 +38,8 @@ type Connection struct {
 	RemoteAddr net.Addr
 	channel    io.ReadWriteCloser
 	command    string
+	// handles the SFTP extended requests, nil for SSH commands
+	extensions *extensionsChannel
 }
 
 // GetClientVersion returns the connected client's version
@@ -43,6 +59,15 @@ func (c *Connection) GetCommand() string {
 
 // Fileread creates a reader for a file on the system and returns the reader back.
 func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	t, err := c.handleFileread(request)
+	c.setOpenedTransfer(request.Filepath, t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (c *Connection) handleFileread(request *sftp.Request) (*transfer, error) {
 	c.UpdateLastActivity()
 
 	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
@@ -74,12 +99,19 @@ func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 
 // OpenFile implements OpenFileWriter interface
 func (c *Connection) OpenFile(request *sftp.Request) (sftp.WriterAtReaderAt, error) {
-	return c.handleFilewrite(request)
+	w, err := c.handleFilewrite(request)
+	c.setOpenedTransfer(request.Filepath, w)
+	return w, err
 }
 
 // Filewrite handles the write actions for a file on the system.
 func (c *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
-	return c.handleFilewrite(request)
+	w, err := c.handleFilewrite(request)
+	c.setOpenedTransfer(request.Filepath, w)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
 }
 
 func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReaderAt, error) {
@@ -101,8 +133,8 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 	}
 
 	var errForRead error
-	if !vfs.IsLocalOrSFTPFs(c.Fs) && request.Pflags().Read {
-		// read and write mode is only supported for local filesystem
+	if !vfs.IsRandomAccessFs(c.Fs) && request.Pflags().Read {
+		// read and write mode is only supported for local, encrypted local and SFTP filesystems
 		errForRead = sftp.ErrSSHFxOpUnsupported
 	}
 	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
@@ -117,7 +149,7 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
 		}
-		return c.handleSFTPUploadToNewFile(p, filePath, request.Filepath, errForRead)
+		return c.handleSFTPUploadToNewFile(request.Pflags(), p, filePath, request.Filepath, errForRead)
 	}
 
 	if statErr != nil {
@@ -135,7 +167,21 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, stat.Size(), request.Filepath, errForRead)
+	if err := c.CheckRetentionLock(p, request.Filepath, stat); err != nil {
+		return nil, err
+	}
+
+	if vfs.IsOverlayLowerFile(c.Fs, p) {
+		// read-only lower layer files are not included in the quota, they are replaced
+		// uploading a new file to the upper layer so resume is not supported
+		if request.Pflags().Append && !request.Pflags().Trunc {
+			return nil, sftp.ErrSSHFxOpUnsupported
+		}
+		return c.handleSFTPUploadToNewFile(request.Pflags(), p, filePath, request.Filepath, errForRead)
+	}
+
+	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, vfs.GetQuotaSize(stat), request.Filepath,
+		errForRead)
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
@@ -174,6 +220,10 @@ func (c *Connection) Filecmd(request *sftp.Request) error {
 		}
 	case "Remove":
 		return c.handleSFTPRemove(p, request)
+	case "Link":
+		if err = c.CreateHardlink(p, target, request.Filepath, request.Target); err != nil {
+			return err
+		}
 	default:
 		return sftp.ErrSSHFxOpUnsupported
 	}
@@ -192,11 +242,17 @@ func (c *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 	switch request.Method {
 	case "List":
-		files, err := c.ListDir(p, request.Filepath)
+		lister, err := c.ListDir(p, request.Filepath)
 		if err != nil {
 			return nil, err
 		}
-		return listerAt(files), nil
+		// pkg/sftp does not close the lister, the request context is canceled
+		// when the directory handle is closed or the session ends
+		go func() {
+			<-request.Context().Done()
+			lister.Close()
+		}()
+		return lister, nil
 	case "Stat":
 		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
@@ -253,6 +309,162 @@ func (c *Connection) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
 	return listerAt([]os.FileInfo{s}), nil
 }
 
+// getStatVFS returns the statvfs@openssh.com response for the given path.
+// The reported sizes are based on the quota limits, if any, and on the disk
+// space available to the filesystem, the max upload file size is not considered
+func (c *Connection) getStatVFS(virtualPath string) (*sftp.StatVFS, error) {
+	c.UpdateLastActivity()
+
+	if !c.User.HasPerm(dataprovider.PermListItems, virtualPath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := c.Fs.ResolvePath(virtualPath)
+	if err != nil {
+		return nil, c.GetFsError(err)
+	}
+	// we are assuming that the request path is a directory, the quota for the
+	// files inside it is checked
+	quotaResult := c.HasSpace(true, path.Join(virtualPath, "fakefile.txt"))
+	availableSize, err := c.Fs.GetAvailableDiskSize(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, "unable to get the available disk size for %#v: %v", p, err)
+		availableSize = -1
+	}
+	return getStatVFSFromQuotaResult(quotaResult, availableSize), nil
+}
+
+// checkFile returns the hashes for the check-file extension using the first
+// supported algorithm. A hash is returned for each block, a zero block size
+// means a single hash for the whole range and a zero length means up to the
+// end of the file
+func (c *Connection) checkFile(virtualPath string, algos []string, startOffset, length, blockSize int64) (string, []byte, error) {
+	c.UpdateLastActivity()
+
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(virtualPath)) {
+		return "", nil, sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.User.IsFileAllowed(virtualPath) {
+		c.Log(logger.LevelInfo, "hash not allowed for file %#v", virtualPath)
+		return "", nil, sftp.ErrSSHFxPermissionDenied
+	}
+	var algo string
+	for _, a := range algos {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if utils.IsStringInSlice(a, checkFileAlgorithms) {
+			algo = a
+			break
+		}
+	}
+	if algo == "" {
+		c.Log(logger.LevelDebug, "unsupported check-file algorithms: %v", algos)
+		return "", nil, sftp.ErrSSHFxOpUnsupported
+	}
+	if startOffset < 0 || length < 0 || (blockSize > 0 && blockSize < checkFileMinBlockSize) {
+		return "", nil, sftp.ErrSSHFxBadMessage
+	}
+	p, err := c.Fs.ResolvePath(virtualPath)
+	if err != nil {
+		return "", nil, c.GetFsError(err)
+	}
+	info, err := c.Fs.Stat(p)
+	if err != nil {
+		return "", nil, c.GetFsError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, sftp.ErrSSHFxOpUnsupported
+	}
+	endOffset := info.Size()
+	if length > 0 && startOffset+length < endOffset {
+		endOffset = startOffset + length
+	}
+	if startOffset > endOffset {
+		return "", nil, sftp.ErrSSHFxEOF
+	}
+	if blockSize == 0 {
+		blockSize = endOffset - startOffset
+	}
+	var hashes []byte
+	for offset := startOffset; ; {
+		end := offset + blockSize
+		if end > endOffset {
+			end = endOffset
+		}
+		checksum, err := c.GetFileRangeChecksum(p, algo, offset, end)
+		if err != nil {
+			c.Log(logger.LevelWarn, "unable to compute the %v checksum for %#v: %+v", algo, p, err)
+			return "", nil, c.GetFsError(err)
+		}
+		hash, err := hex.DecodeString(checksum)
+		if err != nil {
+			return "", nil, err
+		}
+		hashes = append(hashes, hash...)
+		if len(hashes) > sftpMaxWriteLength {
+			return "", nil, errors.New("too many blocks, the hashes do not fit in a packet")
+		}
+		offset = end
+		if offset >= endOffset {
+			break
+		}
+	}
+	return algo, hashes, nil
+}
+
+// copyData copies the data between two open files for the copy-data extension,
+// as if the data were read and written using the given handles. A zero length
+// means up to the end of the file
+func (c *Connection) copyData(src, dst *openHandle, readOffset, readLength, writeOffset int64) error {
+	c.UpdateLastActivity()
+
+	if src.pflags&sftpFlagRead == 0 {
+		return fmt.Errorf("the handle for %#v is not open for reading", src.virtualPath)
+	}
+	if dst.transfer.GetType() != common.TransferUpload {
+		return fmt.Errorf("the handle for %#v is not open for writing", dst.virtualPath)
+	}
+	if readOffset < 0 || readLength < 0 || writeOffset < 0 {
+		return sftp.ErrSSHFxBadMessage
+	}
+	if src.transfer == dst.transfer && (readLength == 0 ||
+		(writeOffset < readOffset+readLength && readOffset < writeOffset+readLength)) {
+		return errors.New("the read and write ranges overlap")
+	}
+	c.Log(logger.LevelDebug, "copy data from %#v, offset: %v length: %v, to %#v offset: %v", src.virtualPath,
+		readOffset, readLength, dst.virtualPath, writeOffset)
+	buf := make([]byte, 32768)
+	var copied int64
+	for readLength == 0 || copied < readLength {
+		toRead := int64(len(buf))
+		if readLength > 0 && readLength-copied < toRead {
+			toRead = readLength - copied
+		}
+		n, err := src.transfer.ReadAt(buf[:toRead], readOffset+copied)
+		if n > 0 {
+			if _, errWrite := dst.transfer.WriteAt(buf[:n], writeOffset+copied); errWrite != nil {
+				return c.GetFsError(errWrite)
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return c.GetFsError(err)
+		}
+	}
+	return nil
+}
+
+// setOpenedTransfer allows to find the transfer associated to a file handle
+// returned by pkg/sftp. It must be called once for each open handler call,
+// with a nil transfer if the open fails
+func (c *Connection) setOpenedTransfer(requestPath string, opened interface{}) {
+	if c.extensions != nil {
+		t, _ := opened.(*transfer)
+		c.extensions.setOpenedTransfer(requestPath, t)
+	}
+}
+
 func (c *Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
@@ -308,14 +520,20 @@ func (c *Connection) handleSFTPRemove(filePath string, request *sftp.Request) er
 	return c.RemoveFile(filePath, request.Filepath, fi)
 }
 
-func (c *Connection) handleSFTPUploadToNewFile(resolvedPath, filePath, requestPath string, errForRead error) (sftp.WriterAtReaderAt, error) {
+func (c *Connection) handleSFTPUploadToNewFile(pflags sftp.FileOpenFlags, resolvedPath, filePath, requestPath string,
+	errForRead error) (sftp.WriterAtReaderAt, error) {
 	quotaResult := c.HasSpace(true, requestPath)
 	if !quotaResult.HasSpace {
 		c.Log(logger.LevelInfo, "denying file write due to quota limits")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
-	file, w, cancelFn, err := c.Fs.Create(filePath, 0)
+	flag := 0
+	if pflags.Read && vfs.IsCryptOsFs(c.Fs) {
+		// encrypted files can be read while writing only if opened for random access
+		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	file, w, cancelFn, err := c.Fs.Create(filePath, flag)
 	if err != nil {
 		c.Log(logger.LevelWarn, "error creating file %#v: %+v", resolvedPath, err)
 		return nil, c.GetFsError(err)
@@ -365,6 +583,11 @@ func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, r
 		}
 	}
 
+	if !isResume && !vfs.IsRandomAccessFs(c.Fs) {
+		// random writes are not supported on pipe based filesystems, the file will be overwritten
+		osFlags |= os.O_TRUNC
+	}
+
 	file, w, cancelFn, err := c.Fs.Create(filePath, osFlags)
 	if err != nil {
 		c.Log(logger.LevelWarn, "error opening existing file, flags: %v, source: %#v, err: %+v", pflags, filePath, err)
@@ -376,8 +599,14 @@ func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, r
 		c.Log(logger.LevelDebug, "upload resume requested, file path %#v initial size: %v", filePath, fileSize)
 		minWriteOffset = fileSize
 		initialSize = fileSize
+		if vfs.IsCryptOsFs(c.Fs) {
+			// the write offset is based on the plaintext size
+			if info, err := file.Stat(); err == nil {
+				minWriteOffset = info.Size()
+			}
+		}
 	} else {
-		if vfs.IsLocalOrSFTPFs(c.Fs) && isTruncate {
+		if vfs.IsRandomAccessFs(c.Fs) && isTruncate {
 			vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(requestPath))
 			if err == nil {
 				dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, 0, -fileSize, false) //nolint:errcheck
@@ -428,3 +657,45 @@ func getOSOpenFlags(requestFlags sftp.FileOpenFlags) (flags int) {
 	}
 	return osFlags
 }
+
+// getStatVFSFromQuotaResult returns the statvfs response for the given quota
+// check result and available disk size, a negative available size means unknown
+func getStatVFSFromQuotaResult(quotaResult vfs.QuotaCheckResult, availableSize int64) *sftp.StatVFS {
+	totalSize := quotaResult.QuotaSize
+	freeSize := quotaResult.QuotaSize - quotaResult.UsedSize
+	if totalSize == 0 {
+		// no size limit
+		if availableSize >= 0 {
+			totalSize = quotaResult.UsedSize + availableSize
+			freeSize = availableSize
+		} else {
+			totalSize = statVFSUnlimitedSize
+			freeSize = totalSize - quotaResult.UsedSize
+		}
+	} else if availableSize >= 0 && availableSize < freeSize {
+		freeSize = availableSize
+	}
+	totalFiles := int64(quotaResult.QuotaFiles)
+	freeFiles := int64(quotaResult.QuotaFiles - quotaResult.UsedFiles)
+	if totalFiles == 0 {
+		totalFiles = statVFSUnlimitedFiles
+		freeFiles = totalFiles - int64(quotaResult.UsedFiles)
+	}
+	if !quotaResult.HasSpace || freeSize < 0 {
+		freeSize = 0
+	}
+	if !quotaResult.HasSpace || freeFiles < 0 {
+		freeFiles = 0
+	}
+	return &sftp.StatVFS{
+		Bsize:   statVFSBlockSize,
+		Frsize:  statVFSBlockSize,
+		Blocks:  uint64(totalSize) / statVFSBlockSize,
+		Bfree:   uint64(freeSize) / statVFSBlockSize,
+		Bavail:  uint64(freeSize) / statVFSBlockSize,
+		Files:   uint64(totalFiles),
+		Ffree:   uint64(freeFiles),
+		Favail:  uint64(freeFiles),
+		Namemax: statVFSMaxNameLength,
+	}
+}
@@ -2,6 +2,7 @@ package sftpd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -244,6 +245,29 @@ func TestUnsupportedListOP(t *testing.T) {
 	assert.EqualError(t, err, sftp.ErrSSHFxOpUnsupported.Error())
 }
 
+func TestListerClosedWithHandle(t *testing.T) {
+	user := dataprovider.User{
+		HomeDir: os.TempDir(),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	fs := vfs.NewOsFs("", os.TempDir(), nil)
+	conn := common.NewBaseConnection("", common.ProtocolSFTP, user, fs)
+	sftpConn := Connection{
+		BaseConnection: conn,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	request := sftp.NewRequest("List", "/").WithContext(ctx)
+	lister, err := sftpConn.Filelist(request)
+	require.NoError(t, err)
+	// the request context is canceled when the directory handle is closed
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, err := lister.ListAt(make([]os.FileInfo, 1), 0)
+		return err == io.EOF
+	}, 1*time.Second, 50*time.Millisecond)
+}
+
 func TestTransferCancelFn(t *testing.T) {
 	testfile := "testfile"
 	file, err := os.Create(testfile)
@@ -336,7 +360,7 @@ func TestUploadFiles(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		missingFile = "missing\\relative\\file.txt"
 	}
-	_, err = c.handleSFTPUploadToNewFile(".", missingFile, "/missing", nil)
+	_, err = c.handleSFTPUploadToNewFile(sftp.FileOpenFlags{}, ".", missingFile, "/missing", nil)
 	assert.Error(t, err, "upload new file in missing path must fail")
 
 	c.BaseConnection.Fs = newMockOsFs(nil, nil, false, "123", os.TempDir())
@@ -760,6 +784,10 @@ func TestSSHCommandsRemoteFs(t *testing.T) {
 	}
 	err = cmd.handeSFTPGoRemove()
 	assert.Error(t, err)
+	assert.True(t, vfs.IsServerSideCopySupported(fs))
+	assert.False(t, vfs.IsServerSideCopySupported(vfs.NewOsFs("", os.TempDir(), nil)))
+	_, _, err = vfs.CopyObjects(vfs.NewOsFs("", os.TempDir(), nil), "a", "b")
+	assert.EqualError(t, err, vfs.ErrVfsUnsupported.Error())
 }
 
 func TestGitVirtualFolders(t *testing.T) {
@@ -1934,3 +1962,31 @@ func newFakeListener(err error) net.Listener {
 		err:    err,
 	}
 }
+
+func TestStatVFSFromQuotaResult(t *testing.T) {
+	stat := getStatVFSFromQuotaResult(vfs.QuotaCheckResult{HasSpace: true}, -1)
+	assert.Equal(t, uint64(statVFSUnlimitedSize), stat.TotalSpace())
+	assert.Equal(t, uint64(statVFSUnlimitedSize), stat.FreeSpace())
+	assert.Equal(t, uint64(statVFSUnlimitedFiles), stat.Files)
+	stat = getStatVFSFromQuotaResult(vfs.QuotaCheckResult{HasSpace: true}, 8192)
+	assert.Equal(t, uint64(8192), stat.TotalSpace())
+	assert.Equal(t, uint64(8192), stat.FreeSpace())
+	// the available disk size is lower than the quota remaining size
+	stat = getStatVFSFromQuotaResult(vfs.QuotaCheckResult{
+		HasSpace:  true,
+		QuotaSize: 1048576,
+		UsedSize:  4096,
+	}, 8192)
+	assert.Equal(t, uint64(1048576), stat.TotalSpace())
+	assert.Equal(t, uint64(8192), stat.FreeSpace())
+	stat = getStatVFSFromQuotaResult(vfs.QuotaCheckResult{
+		HasSpace:   false,
+		QuotaSize:  1048576,
+		UsedSize:   4096,
+		QuotaFiles: 10,
+		UsedFiles:  10,
+	}, -1)
+	assert.Equal(t, uint64(0), stat.FreeSpace())
+	assert.Equal(t, uint64(0), stat.Ffree)
+	assert.Equal(t, uint64(10), stat.Files)
+}
@@ -289,6 +289,16 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return common.ErrPermissionDenied
 	}
 
+	if err := c.connection.CheckRetentionLock(p, uploadFilePath, stat); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
+	if vfs.IsOverlayLowerFile(c.connection.Fs, p) {
+		// read-only lower layer files are not included in the quota
+		return c.handleUploadFile(p, filePath, sizeToRead, true, 0, uploadFilePath)
+	}
+
 	if common.Config.IsAtomicUploadEnabled() && c.connection.Fs.IsAtomicUploadSupported() {
 		err = c.connection.Fs.Rename(p, filePath)
 		if err != nil {
@@ -299,7 +309,7 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		}
 	}
 
-	return c.handleUploadFile(p, filePath, sizeToRead, false, stat.Size(), uploadFilePath)
+	return c.handleUploadFile(p, filePath, sizeToRead, false, vfs.GetQuotaSize(stat), uploadFilePath)
 }
 
 func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileInfo) error {
@@ -406,7 +416,7 @@ func (c *scpCommand) sendDownloadFileData(filePath string, stat os.FileInfo, tra
 		}
 	}
 	if vfs.IsCryptOsFs(c.connection.Fs) {
-		stat = c.connection.Fs.(*vfs.CryptFs).ConvertFileInfo(stat)
+		stat = vfs.ConvertCryptFileInfo(stat)
 	}
 
 	fileSize := stat.Size()
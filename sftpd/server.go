@@ -33,7 +33,8 @@ const (
 )
 
 var (
-	sftpExtensions = []string{"posix-rename@openssh.com"}
+	// extensions handled by pkg/sftp, the ones handled by extensionsChannel are added to this list
+	sftpExtensions = []string{"posix-rename@openssh.com", "hardlink@openssh.com"}
 )
 
 // Binding defines the configuration for a network listener
@@ -490,7 +491,7 @@ func (c *Configuration) handleSftpConnection(channel ssh.Channel, connection *Co
 	handler := c.createHandler(connection)
 
 	// Create the server instance for the channel using the handler we created above.
-	server := sftp.NewRequestServer(channel, handler, sftp.WithRSAllocator())
+	server := sftp.NewRequestServer(newExtensionsChannel(channel, connection), handler, sftp.WithRSAllocator())
 
 	defer server.Close()
 	if err := server.Serve(); err == io.EOF {
@@ -8,7 +8,9 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -147,6 +149,9 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		logger.ErrorToConsole("error creating login banner: %v", err)
 	}
+	// set from the environment so the test cases that reload the configuration keep it
+	os.Setenv("SFTPGO_COMMON__VERSIONS_PATH", filepath.Join(os.TempDir(), "sftpgo_versions"))
+	os.Setenv("SFTPGO_COMMON__TRASH_PATH", filepath.Join(os.TempDir(), "sftpgo_trash"))
 	err = config.LoadConfig(configDir, "")
 	if err != nil {
 		logger.ErrorToConsole("error loading configuration: %v", err)
@@ -289,6 +294,10 @@ func TestMain(m *testing.M) {
 	os.Remove(postConnectPath)
 	os.Remove(keyIntAuthPath)
 	os.Remove(checkPwdPath)
+	os.RemoveAll(commonConf.VersionsPath)
+	os.RemoveAll(commonConf.TrashPath)
+	os.Unsetenv("SFTPGO_COMMON__VERSIONS_PATH")
+	os.Unsetenv("SFTPGO_COMMON__TRASH_PATH")
 	os.Exit(exitCode)
 }
 
@@ -516,6 +525,123 @@ func TestDefender(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestReadCache(t *testing.T) {
+	oldConfig := config.GetCommonConfig()
+
+	cachePath := filepath.Join(os.TempDir(), "readcache")
+	cfg := config.GetCommonConfig()
+	cfg.ReadCache.Path = "relative"
+	cfg.ReadCache.MaxSize = 1
+	err := common.Initialize(cfg)
+	assert.Error(t, err)
+	cfg.ReadCache.Path = cachePath
+	err = common.Initialize(cfg)
+	assert.NoError(t, err)
+
+	getCachedFiles := func() int {
+		files, err := ioutil.ReadDir(cachePath)
+		assert.NoError(t, err)
+		return len(files)
+	}
+
+	usePubKey := false
+	localUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	u := getTestSFTPUser(usePubKey)
+	u.FsConfig.CacheConfig.Mode = vfs.ReadCacheModeEnabled
+	sftpUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, getCachedFiles())
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 2*time.Second, 50*time.Millisecond)
+		// download again, the file is served from the cache
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, getCachedFiles())
+		// modify the file outside SFTPGo, the cached file must not be used
+		newContent := []byte("modified content")
+		err = ioutil.WriteFile(filepath.Join(localUser.GetHomeDir(), testFileName), newContent, os.ModePerm)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, int64(len(newContent)), client)
+		assert.NoError(t, err)
+		content, err := ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, content)
+		assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 2*time.Second, 50*time.Millisecond)
+		err = sftpDownloadFile(testFileName, localDownloadPath, int64(len(newContent)), client)
+		assert.NoError(t, err)
+		content, err = ioutil.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, content)
+		// uploads, renames and removals invalidate the cache
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, getCachedFiles())
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 2*time.Second, 50*time.Millisecond)
+		err = client.Rename(testFileName, testFileName+"_rename")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, getCachedFiles())
+		err = sftpDownloadFile(testFileName+"_rename", localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 2*time.Second, 50*time.Millisecond)
+		err = client.Remove(testFileName + "_rename")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, getCachedFiles())
+		// files bigger than the cache size are not cached
+		bigFileSize := int64(1048576 + 1)
+		err = createTestFile(testFilePath, bigFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, bigFileSize, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, bigFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, getCachedFiles())
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	// the cache is disabled by default
+	sftpUser.FsConfig.CacheConfig.Mode = vfs.ReadCacheModeDefault
+	_, _, err = httpdtest.UpdateUser(sftpUser, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, 1048576+1, client)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = common.Initialize(oldConfig)
+	assert.NoError(t, err)
+	err = os.RemoveAll(cachePath)
+	assert.NoError(t, err)
+}
+
 func TestOpenReadWrite(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -881,7 +1007,9 @@ func TestLink(t *testing.T) {
 		err = client.Symlink(testFileName, testFileName+".link")
 		assert.Error(t, err, "creating a symlink to an existing one must fail")
 		err = client.Link(testFileName, testFileName+".hlink")
-		assert.Error(t, err, "hard link is not supported and must fail")
+		assert.NoError(t, err)
+		err = client.Remove(testFileName + ".hlink")
+		assert.NoError(t, err)
 		err = client.Remove(testFileName + ".link")
 		assert.NoError(t, err)
 		err = client.Remove(testFileName)
@@ -1084,6 +1212,129 @@ func TestSFTPFsLoginWrongFingerprint(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSFTPFsConnectionsPool(t *testing.T) {
+	oldConfig := config.GetCommonConfig()
+
+	cfg := config.GetCommonConfig()
+	cfg.SFTPFsPool.MaxConnectionsPerEndpoint = 1
+	cfg.SFTPFsPool.MaxSessionsPerConnection = 2
+	cfg.SFTPFsPool.IdleTimeout = 0
+	err := common.Initialize(cfg)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return vfs.GetSFTPFsPoolStats().Connections == 0
+	}, 1*time.Second, 50*time.Millisecond)
+
+	usePubKey := true
+	localUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	sftpUser, _, err := httpdtest.AddUser(getTestSFTPUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	client1, err := getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client1.Close()
+		err = checkBasicSFTP(client1)
+		assert.NoError(t, err)
+	}
+	client2, err := getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		err = checkBasicSFTP(client2)
+		assert.NoError(t, err)
+	}
+	stats := vfs.GetSFTPFsPoolStats()
+	assert.Equal(t, 1, stats.Connections)
+	assert.Equal(t, 2, stats.Sessions)
+	// the only connection allowed to the endpoint has no free sessions
+	_, err = getSftpClient(sftpUser, usePubKey)
+	assert.Error(t, err)
+	err = client2.Close()
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return vfs.GetSFTPFsPoolStats().Sessions == 1
+	}, 1*time.Second, 50*time.Millisecond)
+	client3, err := getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		err = checkBasicSFTP(client3)
+		assert.NoError(t, err)
+		err = client3.Close()
+		assert.NoError(t, err)
+	}
+	err = client1.Close()
+	assert.NoError(t, err)
+	// the connection is closed when the last session ends
+	assert.Eventually(t, func() bool {
+		return vfs.GetSFTPFsPoolStats().Connections == 0
+	}, 1*time.Second, 50*time.Millisecond)
+
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+
+	cfg.SFTPFsPool.IdleTimeout = -1
+	err = common.Initialize(cfg)
+	assert.Error(t, err)
+	err = common.Initialize(oldConfig)
+	assert.NoError(t, err)
+}
+
+func TestSFTPFsReconnect(t *testing.T) {
+	usePubKey := true
+	localUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	sftpUser, _, err := httpdtest.AddUser(getTestSFTPUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// close the session used by the SFTP backend
+		closed := 0
+		for _, stat := range common.Connections.GetStats() {
+			if stat.Username == localUser.Username {
+				if common.Connections.Close(stat.ConnectionID) {
+					closed++
+				}
+			}
+		}
+		assert.Equal(t, 1, closed)
+		assert.Eventually(t, func() bool {
+			return common.Connections.GetActiveSessions(localUser.Username) == 0
+		}, 1*time.Second, 50*time.Millisecond)
+		// the requests that don't modify the files are retried using a new session
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		assert.Equal(t, 1, common.Connections.GetActiveSessions(localUser.Username))
+		// the new session is used for the next requests
+		err = client.Rename(testFileName, testFileName+"_renamed")
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName+"_renamed", localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, common.Connections.GetActiveSessions(localUser.Username))
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestChtimes(t *testing.T) {
 	usePubKey := false
 	localUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
@@ -2532,6 +2783,132 @@ func TestMaxSessions(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestOverlayFs(t *testing.T) {
+	usePubKey := false
+	lowerPath := filepath.Join(os.TempDir(), "overlay_lower")
+	err := os.MkdirAll(filepath.Join(lowerPath, "dir1", "sub"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(lowerPath, "dir2"), os.ModePerm)
+	assert.NoError(t, err)
+	lowerFileSize := int64(4096)
+	err = createTestFile(filepath.Join(lowerPath, testFileName), lowerFileSize)
+	assert.NoError(t, err)
+	err = createTestFile(filepath.Join(lowerPath, "dir1", "file1"), lowerFileSize)
+	assert.NoError(t, err)
+	err = createTestFile(filepath.Join(lowerPath, "dir2", "file2"), lowerFileSize)
+	assert.NoError(t, err)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.FsConfig.OverlayConfig.LowerPath = lowerPath
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		// the lower layer contents are visible and not included in the quota
+		contents, err := client.ReadDir("/")
+		assert.NoError(t, err)
+		assert.Len(t, contents, 3)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(path.Join("dir1", "file1"), localDownloadPath, lowerFileSize, client)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, user.UsedQuotaFiles)
+		assert.Equal(t, int64(0), user.UsedQuotaSize)
+		// overwriting a lower layer file is like uploading a new file
+		testFileSize := int64(65535)
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		info, err := os.Stat(filepath.Join(lowerPath, testFileName))
+		assert.NoError(t, err)
+		assert.Equal(t, lowerFileSize, info.Size())
+		// upload inside a directory that exists only in the lower layer
+		err = sftpUploadFile(testFilePath, path.Join("dir1", "sub", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		contents, err = client.ReadDir("dir1")
+		assert.NoError(t, err)
+		assert.Len(t, contents, 2)
+		// removing a lower layer file does not change the quota
+		err = client.Remove(path.Join("dir1", "file1"))
+		assert.NoError(t, err)
+		_, err = client.Stat(path.Join("dir1", "file1"))
+		assert.Error(t, err)
+		_, err = os.Stat(filepath.Join(lowerPath, "dir1", "file1"))
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize, user.UsedQuotaSize)
+		// whiteouts cannot be accessed or created
+		_, err = client.Stat(path.Join("dir1", ".wh.file1"))
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, ".wh.file", testFileSize, client)
+		assert.Error(t, err)
+		// a directory with lower layer contents cannot be renamed
+		err = client.Rename("dir2", "dir3")
+		assert.Error(t, err)
+		// renaming a lower layer file copies it to the upper layer
+		err = client.Rename(path.Join("dir2", "file2"), "file2")
+		assert.NoError(t, err)
+		_, err = client.Stat(path.Join("dir2", "file2"))
+		assert.Error(t, err)
+		info, err = client.Stat("file2")
+		if assert.NoError(t, err) {
+			assert.Equal(t, lowerFileSize, info.Size())
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize+lowerFileSize, user.UsedQuotaSize)
+		// the now empty lower layer directory can be removed and created again
+		err = client.RemoveDirectory("dir2")
+		assert.NoError(t, err)
+		_, err = client.Stat("dir2")
+		assert.Error(t, err)
+		err = client.Mkdir("dir2")
+		assert.NoError(t, err)
+		contents, err = client.ReadDir("dir2")
+		assert.NoError(t, err)
+		assert.Len(t, contents, 0)
+		// a non empty directory cannot be removed
+		err = client.RemoveDirectory("dir1")
+		assert.Error(t, err)
+		// quota scan must ignore whiteouts and lower layer files
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize+lowerFileSize, user.UsedQuotaSize)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(lowerPath)
+	assert.NoError(t, err)
+}
+
 func TestQuotaFileReplace(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -3012,13 +3389,22 @@ func TestPatternsFilters(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-//nolint:dupl
-func TestExtensionsFilters(t *testing.T) {
+func TestHiddenPatternsFilters(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/",
+			HiddenPatterns: []string{".*", "*.TMP"},
+		},
+		{
+			Path:        "/dropbox",
+			DenyListing: true,
+		},
+	}
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	testFileSize := int64(131072)
+	testFileSize := int64(65535)
 	testFilePath := filepath.Join(homeBasePath, testFileName)
 	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
 	client, err := getSftpClient(user, usePubKey)
@@ -3028,24 +3414,159 @@ func TestExtensionsFilters(t *testing.T) {
 		assert.NoError(t, err)
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName+".zip", testFileSize, client)
+		err = sftpUploadFile(testFilePath, ".hidden", testFileSize, client)
 		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName+".jpg", testFileSize, client)
+		err = sftpUploadFile(testFilePath, testFileName+".tmp", testFileSize, client)
 		assert.NoError(t, err)
-	}
-	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
-		{
-			Path:              "/",
-			AllowedExtensions: []string{".zIp", ".jPg"},
-			DeniedExtensions:  []string{},
-		},
-	}
-	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
-		{
-			Path:            "/",
-			AllowedPatterns: []string{"*.jPg", "*.zIp"},
-			DeniedPatterns:  []string{},
-		},
+		err = client.Mkdir(".hiddendir")
+		assert.NoError(t, err)
+		entries, err := client.ReadDir(".")
+		if assert.NoError(t, err) {
+			if assert.Len(t, entries, 1) {
+				assert.Equal(t, testFileName, entries[0].Name())
+			}
+		}
+		// hidden files can be accessed using their exact name
+		info, err := client.Stat(".hidden")
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		err = sftpDownloadFile(testFileName+".tmp", localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName+".tmp", testFileName+".dat")
+		assert.NoError(t, err)
+		_, err = client.ReadDir(".hiddendir")
+		assert.NoError(t, err)
+
+		err = client.Mkdir("dropbox")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("dropbox", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		_, err = client.ReadDir("dropbox")
+		assert.Error(t, err)
+		_, err = client.Stat(path.Join("dropbox", testFileName))
+		assert.NoError(t, err)
+		entries, err = client.ReadDir(".")
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 3)
+		}
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.Remove(localDownloadPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMimeTypesFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.Filters.MimeTypes = []dataprovider.MimeTypesFilter{
+		{
+			Path:             "/",
+			AllowedMimeTypes: []string{"text/*"},
+		},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(131072)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	textFilePath := filepath.Join(homeBasePath, "test.txt")
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(textFilePath, []byte("text content"), os.ModePerm)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName+".txt", testFileSize, client)
+		assert.Error(t, err)
+		_, err = client.Stat(testFileName + ".txt")
+		assert.Error(t, err)
+		err = sftpUploadFile(textFilePath, "test.txt", 12, client)
+		assert.NoError(t, err)
+	}
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.UsedQuotaFiles)
+	assert.Equal(t, int64(12), user.UsedQuotaSize)
+	quarantinePath := filepath.Join(os.TempDir(), "quarantine")
+	common.Config.QuarantinePath = quarantinePath
+	defer func() {
+		common.Config.QuarantinePath = ""
+	}()
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.Error(t, err)
+		_, err = client.Stat(testFileName)
+		assert.Error(t, err)
+		files, err := client.ReadDir("/")
+		if assert.NoError(t, err) {
+			assert.Len(t, files, 1)
+		}
+		files, err = ioutil.ReadDir(filepath.Join(quarantinePath, user.Username))
+		if assert.NoError(t, err) {
+			assert.Len(t, files, 1)
+		}
+	}
+	// the quarantined files are not included in the user quota
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.UsedQuotaFiles)
+	assert.Equal(t, int64(12), user.UsedQuotaSize)
+	err = os.RemoveAll(quarantinePath)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.Remove(textFilePath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+//nolint:dupl
+func TestExtensionsFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(131072)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName+".zip", testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName+".jpg", testFileSize, client)
+		assert.NoError(t, err)
+	}
+	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:              "/",
+			AllowedExtensions: []string{".zIp", ".jPg"},
+			DeniedExtensions:  []string{},
+		},
+	}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:            "/",
+			AllowedPatterns: []string{"*.jPg", "*.zIp"},
+			DeniedPatterns:  []string{},
+		},
 	}
 	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
 	assert.NoError(t, err)
@@ -5632,91 +6153,144 @@ func TestPermSymlink(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestPermChmod(t *testing.T) {
+func TestHardlink(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	u.QuotaFiles = 100
+	localUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	client, err := getSftpClient(user, usePubKey)
+	sftpUser, _, err := httpdtest.AddUser(getTestSFTPUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(localUser, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		assert.NoError(t, err)
-		err = client.Chmod(testFileName, os.ModePerm)
-		assert.Error(t, err, "chmod without permission should not succeed")
-		err = client.Remove(testFileName)
+		err = client.Link(testFileName, testFileName+".link")
 		assert.NoError(t, err)
-		err = os.Remove(testFilePath)
+		info, err := client.Stat(testFileName + ".link")
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		user, _, err := httpdtest.GetUserByUsername(localUser.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize, user.UsedQuotaSize)
+		// the target exists
+		err = client.Link(testFileName, testFileName+".link")
+		assert.Error(t, err)
+		err = client.Mkdir("adir")
 		assert.NoError(t, err)
+		err = client.Link("adir", "adir.link")
+		assert.Error(t, err)
 	}
-	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	// the sftp user uses the same home directory
+	client, err = getSftpClient(sftpUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Link(testFileName, testFileName+".link1")
+		assert.Error(t, err)
+	}
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload}
+	user, _, err := httpdtest.UpdateUser(u, http.StatusOK, "")
 	assert.NoError(t, err)
-	err = os.RemoveAll(user.GetHomeDir())
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Link(testFileName, testFileName+".link1")
+		assert.Error(t, err, "hard link without permission should not succeed")
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
 	assert.NoError(t, err)
 }
 
-//nolint:dupl
-func TestPermChown(t *testing.T) {
+func TestStatVFS(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChmod, dataprovider.PermChtimes}
+	u.QuotaSize = 1048576
+	u.QuotaFiles = 10
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65536)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
 	client, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		assert.NoError(t, err)
-		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
-		assert.Error(t, err, "chown without permission should not succeed")
-		err = client.Remove(testFileName)
-		assert.NoError(t, err)
-		err = os.Remove(testFilePath)
-		assert.NoError(t, err)
+		stat, err := client.StatVFS("/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(u.QuotaSize), stat.TotalSpace())
+			assert.Equal(t, uint64(u.QuotaSize-testFileSize), stat.FreeSpace())
+			assert.Equal(t, uint64(u.QuotaFiles), stat.Files)
+			assert.Equal(t, uint64(u.QuotaFiles-1), stat.Ffree)
+		}
+	}
+	user.QuotaSize = 0
+	user.QuotaFiles = 0
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		stat, err := client.StatVFS("/")
+		if assert.NoError(t, err) {
+			assert.Greater(t, stat.FreeSpace(), uint64(0))
+			assert.Greater(t, stat.Ffree, uint64(0))
+		}
+	}
+	user.Permissions["/"] = []string{dataprovider.PermUpload}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		_, err := client.StatVFS("/")
+		assert.Error(t, err)
 	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
 }
 
-//nolint:dupl
-func TestPermChtimes(t *testing.T) {
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChmod, dataprovider.PermChown}
-	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+func TestSFTPExtensionsVersion(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
 	assert.NoError(t, err)
-	client, err := getSftpClient(user, usePubKey)
+	client, err := getRawSFTPClient(user, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		assert.NoError(t, err)
-		err = client.Chtimes(testFileName, time.Now(), time.Now())
-		assert.Error(t, err, "chtimes without permission should not succeed")
-		err = client.Remove(testFileName)
-		assert.NoError(t, err)
-		err = os.Remove(testFilePath)
-		assert.NoError(t, err)
+		for _, ext := range []string{"posix-rename@openssh.com", "hardlink@openssh.com", "statvfs@openssh.com",
+			"limits@openssh.com", "check-file", "copy-data"} {
+			assert.Contains(t, client.extensions, ext)
+		}
+		assert.Equal(t, "md5,sha1,sha256,sha384,sha512", client.extensions["check-file"])
+		reply, err := client.extended("limits@openssh.com", nil)
+		if assert.NoError(t, err) {
+			if assert.Len(t, reply, 32) {
+				assert.Equal(t, uint64(256*1024), binary.BigEndian.Uint64(reply))
+				assert.Equal(t, uint64(32*1024), binary.BigEndian.Uint64(reply[8:]))
+				assert.Greater(t, binary.BigEndian.Uint64(reply[16:]), uint64(32*1024))
+				assert.Equal(t, uint64(0), binary.BigEndian.Uint64(reply[24:]))
+			}
+		}
+		_, err = client.extended("unknown@example.com", nil)
+		assert.Equal(t, uint32(8), getRawSFTPStatusCode(err))
 	}
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
@@ -5724,38 +6298,353 @@ func TestPermChtimes(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestSubDirsUploads(t *testing.T) {
+func TestCheckFileExtension(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermChtimes, dataprovider.PermDownload, dataprovider.PermOverwrite}
+	u.Permissions["/nolist"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	client, err := getSftpClient(user, usePubKey)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(testFilePath)
+	assert.NoError(t, err)
+	sftpClient, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
-		defer client.Close()
-		err = client.Mkdir("subdir")
-		assert.NoError(t, err)
-		testFileNameSub := "/subdir/test_file_dat"
-		testSubFile := filepath.Join(user.GetHomeDir(), "subdir", "file.dat")
-		testDir := "testdir"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
-		err = createTestFile(testSubFile, testFileSize)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileNameSub, testFileSize, client)
-		assert.True(t, os.IsPermission(err))
-		err = client.Symlink(testFileName, testFileNameSub+".link")
-		assert.True(t, os.IsPermission(err))
-		err = client.Symlink(testFileName, testFileName+".link")
+		defer sftpClient.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, sftpClient)
 		assert.NoError(t, err)
-		err = client.Rename(testFileName, testFileNameSub+".rename")
-		assert.True(t, os.IsPermission(err))
-		err = client.Rename(testFileName, testFileName+".rename")
+	}
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "nolist"), os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "nolist", testFileName), data, os.ModePerm)
+	assert.NoError(t, err)
+	client, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		// the first supported algorithm is used
+		reply, err := client.checkFileName("/"+testFileName, "sha224,sha256,md5", 0, 0, 0)
+		if assert.NoError(t, err) {
+			sum := sha256.Sum256(data)
+			assert.Equal(t, getRawSFTPCheckFileReply("sha256", sum[:]), reply)
+		}
+		// a hash for each block
+		reply, err = client.checkFileName("/"+testFileName, "sha512", 0, 0, 32768)
+		if assert.NoError(t, err) {
+			sum1 := sha512.Sum512(data[:32768])
+			sum2 := sha512.Sum512(data[32768:])
+			assert.Equal(t, getRawSFTPCheckFileReply("sha512", append(sum1[:], sum2[:]...)), reply)
+		}
+		reply, err = client.checkFileName("/"+testFileName, "sha256", 100, 1000, 0)
+		if assert.NoError(t, err) {
+			sum := sha256.Sum256(data[100:1100])
+			assert.Equal(t, getRawSFTPCheckFileReply("sha256", sum[:]), reply)
+		}
+		handle, err := client.open("/"+testFileName, 0x00000001)
+		if assert.NoError(t, err) {
+			reply, err = client.checkFileHandle(handle, "sha256", 0, 0, 0)
+			if assert.NoError(t, err) {
+				sum := sha256.Sum256(data)
+				assert.Equal(t, getRawSFTPCheckFileReply("sha256", sum[:]), reply)
+			}
+			err = client.close(handle)
+			assert.NoError(t, err)
+			_, err = client.checkFileHandle(handle, "sha256", 0, 0, 0)
+			assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		}
+		_, err = client.checkFileName("/"+testFileName, "sha224,crc32", 0, 0, 0)
+		assert.Equal(t, uint32(8), getRawSFTPStatusCode(err))
+		_, err = client.checkFileName("/"+testFileName, "sha256", 0, 0, 100)
+		assert.Equal(t, uint32(5), getRawSFTPStatusCode(err))
+		_, err = client.checkFileName("/"+testFileName, "sha256", uint64(testFileSize+1), 0, 0)
+		assert.Equal(t, uint32(1), getRawSFTPStatusCode(err))
+		_, err = client.checkFileName("/missing", "sha256", 0, 0, 0)
+		assert.Equal(t, uint32(2), getRawSFTPStatusCode(err))
+		_, err = client.checkFileName("/nolist/"+testFileName, "sha256", 0, 0, 0)
+		assert.Equal(t, uint32(3), getRawSFTPStatusCode(err))
+		_, err = client.checkFileName("/nolist", "sha256", 0, 0, 0)
+		assert.Equal(t, uint32(8), getRawSFTPStatusCode(err))
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestCopyDataExtension(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(testFilePath)
+	assert.NoError(t, err)
+	sftpClient, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer sftpClient.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, sftpClient)
+		assert.NoError(t, err)
+	}
+	client, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		srcHandle, err := client.open("/"+testFileName, 0x00000001)
+		assert.NoError(t, err)
+		// write, create and truncate
+		dstHandle, err := client.open("/copy", 0x00000002|0x00000008|0x00000010)
+		assert.NoError(t, err)
+		err = client.copyData(srcHandle, 0, 0, dstHandle, 0)
+		assert.NoError(t, err)
+		// a range is appended
+		err = client.copyData(srcHandle, 100, 1000, dstHandle, uint64(testFileSize))
+		assert.NoError(t, err)
+		// the write handle is not open for reading
+		err = client.copyData(dstHandle, 0, 0, srcHandle, 0)
+		assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		err = client.copyData("invalid", 0, 0, dstHandle, 0)
+		assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		err = client.close(srcHandle)
+		assert.NoError(t, err)
+		err = client.close(dstHandle)
+		assert.NoError(t, err)
+		err = client.copyData(srcHandle, 0, 0, dstHandle, 0)
+		assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		// the ranges overlap
+		rwHandle, err := client.open("/copy", 0x00000001|0x00000002)
+		if assert.NoError(t, err) {
+			err = client.copyData(rwHandle, 0, 2000, rwHandle, 1000)
+			assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+			err = client.close(rwHandle)
+			assert.NoError(t, err)
+		}
+	}
+	copied, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), "copy"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, append(append([]byte{}, data...), data[100:1100]...), copied)
+	}
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, user.UsedQuotaFiles)
+	assert.Equal(t, 2*testFileSize+1000, user.UsedQuotaSize)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestExtensionsInterleavedHandles(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	err = os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	assert.NoError(t, err)
+	data1 := []byte("content for the first file")
+	data2 := []byte("the second file has a different content")
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "file1"), data1, os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "file2"), data2, os.ModePerm)
+	assert.NoError(t, err)
+	client, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		openRequest := func(name string, pflags uint32) []byte {
+			request := appendRawSFTPString([]byte{3}, name)
+			request = appendRawSFTPUint32(request, pflags)
+			return appendRawSFTPUint32(request, 0)
+		}
+		// the responses are sent before reading them, the failed open and
+		// opendir requests are mixed with the successful ones
+		responses, err := client.sendRequests(
+			appendRawSFTPString([]byte{11}, "/"),
+			openRequest("/missing", 0x00000001),
+			openRequest("/file2", 0x00000001),
+			appendRawSFTPString([]byte{11}, "/missingdir"),
+			openRequest("/", 0x00000002|0x00000008),
+			openRequest("/file1", 0x00000001),
+			openRequest("/copy", 0x00000002|0x00000008|0x00000010),
+		)
+		assert.NoError(t, err)
+		var handles []string
+		for id := client.lastID - 6; id <= client.lastID; id++ {
+			packet := responses[id]
+			if assert.NotNil(t, packet) && packet[0] == 102 {
+				handle, _ := readRawSFTPString(packet[5:])
+				handles = append(handles, handle)
+			} else {
+				handles = append(handles, "")
+			}
+		}
+		for idx, isHandle := range []bool{true, false, true, false, false, true, true} {
+			assert.Equal(t, isHandle, handles[idx] != "", "request %v", idx)
+		}
+		dirHandle, file2Handle, file1Handle, copyHandle := handles[0], handles[2], handles[5], handles[6]
+
+		reply, err := client.checkFileHandle(file1Handle, "sha256", 0, 0, 0)
+		if assert.NoError(t, err) {
+			h := sha256.Sum256(data1)
+			assert.Equal(t, getRawSFTPCheckFileReply("sha256", h[:]), reply)
+		}
+		reply, err = client.checkFileHandle(file2Handle, "sha256", 0, 0, 0)
+		if assert.NoError(t, err) {
+			h := sha256.Sum256(data2)
+			assert.Equal(t, getRawSFTPCheckFileReply("sha256", h[:]), reply)
+		}
+		_, err = client.checkFileHandle(dirHandle, "sha256", 0, 0, 0)
+		assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		err = client.copyData(file1Handle, 0, 0, copyHandle, 0)
+		assert.NoError(t, err)
+		err = client.copyData(file2Handle, 0, 0, dirHandle, 0)
+		assert.Equal(t, uint32(4), getRawSFTPStatusCode(err))
+		for _, handle := range []string{dirHandle, file2Handle, file1Handle, copyHandle} {
+			err = client.close(handle)
+			assert.NoError(t, err)
+		}
+	}
+	copied, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), "copy"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, data1, copied)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestPermChmod(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Chmod(testFileName, os.ModePerm)
+		assert.Error(t, err, "chmod without permission should not succeed")
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+//nolint:dupl
+func TestPermChown(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChmod, dataprovider.PermChtimes}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
+		assert.Error(t, err, "chown without permission should not succeed")
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+//nolint:dupl
+func TestPermChtimes(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChmod, dataprovider.PermChown}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		assert.Error(t, err, "chtimes without permission should not succeed")
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSubDirsUploads(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermChtimes, dataprovider.PermDownload, dataprovider.PermOverwrite}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Mkdir("subdir")
+		assert.NoError(t, err)
+		testFileNameSub := "/subdir/test_file_dat"
+		testSubFile := filepath.Join(user.GetHomeDir(), "subdir", "file.dat")
+		testDir := "testdir"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = createTestFile(testSubFile, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileNameSub, testFileSize, client)
+		assert.True(t, os.IsPermission(err))
+		err = client.Symlink(testFileName, testFileNameSub+".link")
+		assert.True(t, os.IsPermission(err))
+		err = client.Symlink(testFileName, testFileName+".link")
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, testFileNameSub+".rename")
+		assert.True(t, os.IsPermission(err))
+		err = client.Rename(testFileName, testFileName+".rename")
 		assert.NoError(t, err)
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		assert.NoError(t, err)
@@ -6235,6 +7124,29 @@ func TestFilterFilePatterns(t *testing.T) {
 	assert.False(t, user.IsFileAllowed("/test/sub/sub/test.tar"))
 	assert.True(t, user.IsFileAllowed("/test/sub/test.gz"))
 	assert.False(t, user.IsFileAllowed("/test/test.zip"))
+
+	filters.FilePatterns = append(filters.FilePatterns, dataprovider.PatternsFilter{
+		Path:           "/hidden",
+		HiddenPatterns: []string{".*", "*.tmp"},
+		DenyListing:    true,
+	})
+	user.Filters = filters
+	assert.True(t, user.IsFileAllowed("/hidden/.file"))
+	assert.False(t, user.IsDirListingAllowed("/hidden"))
+	assert.False(t, user.IsDirListingAllowed("/hidden/sub"))
+	assert.True(t, user.IsDirListingAllowed("/test"))
+	assert.True(t, user.IsDirListingAllowed("/"))
+	contents := []os.FileInfo{
+		vfs.NewFileInfo(".file", false, 10, time.Now(), false),
+		vfs.NewFileInfo("file.TMP", false, 10, time.Now(), false),
+		vfs.NewFileInfo("file.txt", false, 10, time.Now(), false),
+		vfs.NewFileInfo(".dir", true, 0, time.Now(), false),
+	}
+	filtered := user.FilterListDir(contents, "/hidden/sub")
+	if assert.Len(t, filtered, 1) {
+		assert.Equal(t, "file.txt", filtered[0].Name())
+	}
+	assert.Len(t, user.FilterListDir(contents, "/test"), 4)
 }
 
 //nolint:dupl
@@ -6560,51 +7472,245 @@ func TestSSHFileHash(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestSSHCopy(t *testing.T) {
+func TestRetentionLock(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 100
-	mappedPath1 := filepath.Join(os.TempDir(), "vdir1")
-	vdirPath1 := "/vdir1/subdir"
-	mappedPath2 := filepath.Join(os.TempDir(), "vdir2")
-	vdirPath2 := "/vdir2/subdir"
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		BaseVirtualFolder: vfs.BaseVirtualFolder{
-			MappedPath: mappedPath1,
-		},
-		VirtualPath: vdirPath1,
-		QuotaFiles:  -1,
-		QuotaSize:   -1,
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		BaseVirtualFolder: vfs.BaseVirtualFolder{
-			MappedPath: mappedPath2,
-		},
-		VirtualPath: vdirPath2,
-		QuotaFiles:  100,
-		QuotaSize:   0,
-	})
-	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+	u.Filters.Retention = []dataprovider.RetentionFilter{
 		{
-			Path:             "/",
-			DeniedExtensions: []string{".denied"},
+			Path: "/archive",
+			Days: 1,
 		},
 	}
-	err := os.MkdirAll(mappedPath1, os.ModePerm)
-	assert.NoError(t, err)
-	err = os.MkdirAll(mappedPath2, os.ModePerm)
-	assert.NoError(t, err)
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	testDir := "adir"
-	testDir1 := "adir1"
 	client, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		testFileSize := int64(131072)
 		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileName1 := "test_file1.dat"
-		testFileSize1 := int64(65537)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("archive")
+		assert.NoError(t, err)
+		lockedFile := path.Join("archive", testFileName)
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// the uploaded file is locked
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
+		assert.Error(t, err)
+		err = client.Remove(lockedFile)
+		assert.Error(t, err)
+		err = client.Rename(lockedFile, testFileName+"1")
+		assert.Error(t, err)
+		err = client.Rename(testFileName, lockedFile)
+		assert.Error(t, err)
+		err = client.Rename("archive", "archive1")
+		assert.Error(t, err)
+		err = client.Truncate(lockedFile, 0)
+		assert.Error(t, err)
+		err = client.Chtimes(lockedFile, time.Now(), time.Now().Add(-48*time.Hour))
+		assert.Error(t, err)
+		err = client.Symlink(lockedFile, testFileName+".link")
+		assert.Error(t, err)
+		// a file with a modification time in the past cannot be moved or copied
+		// inside the retention protected directory
+		err = client.Chtimes(testFileName, time.Now(), time.Now().Add(-48*time.Hour))
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, path.Join("archive", testFileName+"1"))
+		assert.Error(t, err)
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, path.Join("archive", testFileName+"1")),
+			user, usePubKey)
+		assert.Error(t, err)
+		_, err = client.Stat(path.Join("archive", testFileName+"1"))
+		assert.Error(t, err)
+		_, err = runSSHCommand("sftpgo-remove archive", user, usePubKey)
+		assert.Error(t, err)
+		info, err := client.Stat(lockedFile)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		// the retention is expired
+		oldTime := time.Now().Add(-48 * time.Hour)
+		err = os.Chtimes(filepath.Join(user.GetHomeDir(), "archive", testFileName), oldTime, oldTime)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Remove(lockedFile)
+		assert.Error(t, err)
+		err = os.Chtimes(filepath.Join(user.GetHomeDir(), "archive", testFileName), oldTime, oldTime)
+		assert.NoError(t, err)
+		err = client.Remove(lockedFile)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	// a legal hold locks the files regardless of the retention period
+	user.Filters.Retention = []dataprovider.RetentionFilter{
+		{
+			Path:      "/",
+			LegalHold: true,
+		},
+	}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Remove(testFileName)
+		assert.Error(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSSHFileHashStoredChecksum(t *testing.T) {
+	oldChecksums := common.Config.UploadChecksums
+	common.Config.UploadChecksums = []string{common.ChecksumSHA256}
+	defer func() {
+		common.Config.UploadChecksums = oldChecksums
+	}()
+
+	usePubKey := true
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(524288)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+
+		fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+		uploadedFilePath := filepath.Join(user.GetHomeDir(), testFileName)
+		checksum, size, ok := vfs.GetStoredChecksum(fs, uploadedFilePath, common.ChecksumSHA256)
+		if ok {
+			assert.Equal(t, initialHash, checksum)
+			assert.Equal(t, testFileSize, size)
+			// the stored checksum must be returned without reading the file
+			fakeChecksum := strings.Repeat("a", 64)
+			err = vfs.SetChecksums(fs, uploadedFilePath, testFileSize, map[string]string{
+				common.ChecksumSHA256: fakeChecksum,
+			})
+			assert.NoError(t, err)
+			out, err := runSSHCommand("sha256sum "+testFileName, user, usePubKey)
+			if assert.NoError(t, err) {
+				assert.Contains(t, string(out), fakeChecksum)
+			}
+			rawClient, err := getRawSFTPClient(user, usePubKey)
+			if assert.NoError(t, err) {
+				fakeHash, err := hex.DecodeString(fakeChecksum)
+				assert.NoError(t, err)
+				reply, err := rawClient.checkFileName("/"+testFileName, "sha256", 0, 0, 0)
+				if assert.NoError(t, err) {
+					assert.Equal(t, getRawSFTPCheckFileReply("sha256", fakeHash), reply)
+				}
+				handle, err := rawClient.open("/"+testFileName, 0x00000001)
+				if assert.NoError(t, err) {
+					reply, err = rawClient.checkFileHandle(handle, "sha256", 0, uint64(testFileSize), 0)
+					if assert.NoError(t, err) {
+						assert.Equal(t, getRawSFTPCheckFileReply("sha256", fakeHash), reply)
+					}
+					err = rawClient.close(handle)
+					assert.NoError(t, err)
+				}
+				// a partial range is always computed reading the file
+				reply, err = rawClient.checkFileName("/"+testFileName, "sha256", 0, 0, 65536)
+				if assert.NoError(t, err) {
+					assert.Len(t, reply, len(getRawSFTPCheckFileReply("sha256", nil))+8*sha256.Size)
+					assert.NotContains(t, string(reply), string(fakeHash))
+				}
+				err = rawClient.Close()
+				assert.NoError(t, err)
+			}
+		}
+		// the file is modified, the stored checksum is not valid anymore
+		err = appendToTestFile(testFilePath, 1024)
+		assert.NoError(t, err)
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+1024, false, client)
+		assert.NoError(t, err)
+		_, _, ok = vfs.GetStoredChecksum(fs, uploadedFilePath, common.ChecksumSHA256)
+		assert.False(t, ok)
+		modifiedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		out, err := runSSHCommand("sha256sum "+testFileName, user, usePubKey)
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(out), modifiedHash)
+		}
+		rawClient, err := getRawSFTPClient(user, usePubKey)
+		if assert.NoError(t, err) {
+			reply, err := rawClient.checkFileName("/"+testFileName, "sha256", 0, 0, 0)
+			if assert.NoError(t, err) {
+				hash, err := hex.DecodeString(modifiedHash)
+				assert.NoError(t, err)
+				assert.Equal(t, getRawSFTPCheckFileReply("sha256", hash), reply)
+			}
+			err = rawClient.Close()
+			assert.NoError(t, err)
+		}
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSSHCopy(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	mappedPath1 := filepath.Join(os.TempDir(), "vdir1")
+	vdirPath1 := "/vdir1/subdir"
+	mappedPath2 := filepath.Join(os.TempDir(), "vdir2")
+	vdirPath2 := "/vdir2/subdir"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath1,
+		},
+		VirtualPath: vdirPath1,
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath2,
+		},
+		VirtualPath: vdirPath2,
+		QuotaFiles:  100,
+		QuotaSize:   0,
+	})
+	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:             "/",
+			DeniedExtensions: []string{".denied"},
+		},
+	}
+	err := os.MkdirAll(mappedPath1, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(mappedPath2, os.ModePerm)
+	assert.NoError(t, err)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testDir := "adir"
+	testDir1 := "adir1"
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFileSize := int64(131072)
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileName1 := "test_file1.dat"
+		testFileSize1 := int64(65537)
 		testFilePath1 := filepath.Join(homeBasePath, testFileName1)
 		err = createTestFile(testFilePath, testFileSize)
 		assert.NoError(t, err)
@@ -7188,106 +8294,1470 @@ func TestBasicGitCommands(t *testing.T) {
 	err = os.Chmod(aDir, os.ModePerm)
 	assert.NoError(t, err)
 
-	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(clonePath)
+	assert.NoError(t, err)
+}
+
+func TestGitQuotaVirtualFolders(t *testing.T) {
+	if len(gitPath) == 0 || len(sshPath) == 0 || runtime.GOOS == osWindows {
+		t.Skip("git and/or ssh command not found or OS is windows, unable to execute this test")
+	}
+	usePubKey := true
+	repoName := "testrepo"
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1
+	u.QuotaSize = 131072
+	mappedPath := filepath.Join(os.TempDir(), "repo")
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/" + repoName,
+		QuotaFiles:  0,
+		QuotaSize:   0,
+	})
+	err := os.MkdirAll(mappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		// we upload a file so the user is over quota
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, u.QuotaSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, u.QuotaSize, client)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+
+	clonePath := filepath.Join(homeBasePath, repoName)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(filepath.Join(homeBasePath, repoName))
+	assert.NoError(t, err)
+	out, err := initGitRepo(mappedPath)
+	assert.NoError(t, err, "unexpected error, out: %v", string(out))
+
+	out, err = cloneGitRepo(homeBasePath, "/"+repoName, user.Username)
+	assert.NoError(t, err, "unexpected error, out: %v", string(out))
+
+	out, err = addFileToGitRepo(clonePath, 128)
+	assert.NoError(t, err, "unexpected error, out: %v", string(out))
+
+	out, err = pushToGitRepo(clonePath)
+	assert.NoError(t, err, "unexpected error, out: %v", string(out))
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{MappedPath: mappedPath}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(clonePath)
+	assert.NoError(t, err)
+}
+
+func TestGitErrors(t *testing.T) {
+	if len(gitPath) == 0 || len(sshPath) == 0 || runtime.GOOS == osWindows {
+		t.Skip("git and/or ssh command not found or OS is windows, unable to execute this test")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	repoName := "testrepo"
+	clonePath := filepath.Join(homeBasePath, repoName)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(filepath.Join(homeBasePath, repoName))
+	assert.NoError(t, err)
+	out, err := cloneGitRepo(homeBasePath, "/"+repoName, user.Username)
+	assert.Error(t, err, "cloning a missing repo must fail, out: %v", string(out))
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(clonePath)
+	assert.NoError(t, err)
+}
+
+// Start SCP tests
+func TestVersionsOnOverwriteAndRemove(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.FsConfig.VersioningConfig.Enabled = true
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		contents := [][]byte{[]byte("first version"), []byte("second version content"), []byte("third")}
+		for _, content := range contents {
+			err = ioutil.WriteFile(testFilePath, content, os.ModePerm)
+			assert.NoError(t, err)
+			err = sftpUploadFile(testFilePath, testFileName, int64(len(content)), client)
+			assert.NoError(t, err)
+		}
+		versions, _, err := httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, int64(len(contents[1])), versions[0].Size)
+			assert.Equal(t, int64(len(contents[0])), versions[1].Size)
+			assert.Greater(t, versions[0].ID, versions[1].ID)
+		}
+		// the versions are not included in the quota and they are hidden
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(len(contents[2])), user.UsedQuotaSize)
+		entries, err := client.ReadDir("/")
+		if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+			assert.Equal(t, testFileName, entries[0].Name())
+		}
+		// the versions are stored outside the home dir
+		versionsDir := filepath.Join(common.Config.VersionsPath, user.Username, testFileName)
+		assert.DirExists(t, versionsDir)
+		homeContents, err := ioutil.ReadDir(user.GetHomeDir())
+		if assert.NoError(t, err) {
+			assert.Len(t, homeContents, 1)
+		}
+		usage, _, err := httpdtest.GetFileVersionsUsage(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(2), usage["used_files"])
+		assert.Equal(t, float64(len(contents[0])+len(contents[1])), usage["used_size"])
+		// remove the file, it will be moved inside the versions dir
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, user.UsedQuotaFiles)
+		assert.Equal(t, int64(0), user.UsedQuotaSize)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 3) {
+			// restore the oldest version
+			_, err = httpdtest.RestoreFileVersion(user.Username, testFileName, versions[2].ID, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		assert.NoError(t, err)
+		assert.Equal(t, contents[0], content)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(len(contents[0])), user.UsedQuotaSize)
+		// restoring over an existing file preserves it as a new version
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, int64(len(contents[2])), versions[0].Size)
+			_, err = httpdtest.RestoreFileVersion(user.Username, testFileName, versions[1].ID, http.StatusOK)
+			assert.NoError(t, err)
+			_, err = httpdtest.RestoreFileVersion(user.Username, testFileName, versions[1].ID, http.StatusNotFound)
+			assert.NoError(t, err)
+		}
+		content, err = ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		assert.NoError(t, err)
+		assert.Equal(t, contents[1], content)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(len(contents[1])), user.UsedQuotaSize)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			_, err = httpdtest.PurgeFileVersions(user.Username, testFileName, versions[0].ID, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+		_, err = httpdtest.PurgeFileVersions(user.Username, testFileName, "", http.StatusOK)
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 0)
+		// a quota scan must ignore the versions
+		err = client.Rename(testFileName, testFileName+"_1")
+		assert.NoError(t, err)
+		err = ioutil.WriteFile(testFilePath, contents[2], os.ModePerm)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, int64(len(contents[2])), client)
+		assert.NoError(t, err)
+		// overwrite the target file with a rename
+		err = client.Rename(testFileName, testFileName+"_1")
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName+"_1", http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			assert.Equal(t, int64(len(contents[1])), versions[0].Size)
+		}
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(len(contents[2])), user.UsedQuotaSize)
+		assert.DirExists(t, filepath.Join(common.Config.VersionsPath, user.Username))
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	// the versions are removed together with the user
+	assert.NoDirExists(t, filepath.Join(common.Config.VersionsPath, user.Username))
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestVersionsRetentionAndPaths(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.VersioningConfig.Enabled = true
+	u.FsConfig.VersioningConfig.MaxVersions = 2
+	u.FsConfig.VersioningConfig.MaxAge = 10
+	u.FsConfig.VersioningConfig.Paths = []string{"/versioned"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("versioned")
+		assert.NoError(t, err)
+		versionedPath := path.Join("/versioned", testFileName)
+		for i := 0; i < 4; i++ {
+			err = sftpUploadFile(testFilePath, versionedPath, testFileSize, client)
+			assert.NoError(t, err)
+			err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+			assert.NoError(t, err)
+		}
+		versions, _, err := httpdtest.GetFileVersions(user.Username, versionedPath, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 0)
+		// truncate creates a new version
+		err = client.Truncate(versionedPath, 100)
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, versionedPath, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, testFileSize, versions[0].Size)
+		}
+		info, err := client.Stat(versionedPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+		// versions older than max age are removed
+		versionsDir := filepath.Join(common.Config.VersionsPath, user.Username, "versioned", testFileName)
+		oldVersionID := time.Now().Add(-11 * 24 * time.Hour).UTC().Format("20060102T150405.000000000Z")
+		err = ioutil.WriteFile(filepath.Join(versionsDir, oldVersionID), []byte("old"), os.ModePerm)
+		assert.NoError(t, err)
+		_, err = httpdtest.RestoreFileVersion(user.Username, versionedPath, "invalid", http.StatusBadRequest)
+		assert.NoError(t, err)
+		_, err = httpdtest.PurgeFileVersions(user.Username, versionedPath, "../invalid", http.StatusBadRequest)
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, versionedPath, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+		assert.NoFileExists(t, filepath.Join(versionsDir, oldVersionID))
+		// removing the directory after removing the file is allowed, the versions are stored elsewhere
+		err = client.Remove(versionedPath)
+		assert.NoError(t, err)
+		err = client.RemoveDirectory("versioned")
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, versionedPath, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			// the missing parent directory is created
+			_, err = httpdtest.RestoreFileVersion(user.Username, versionedPath, versions[0].ID, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		info, err = client.Stat(versionedPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestVersionsCryptFs(t *testing.T) {
+	usePubKey := false
+	u := getTestUserWithCryptFs(usePubKey)
+	u.FsConfig.VersioningConfig.Enabled = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		err = createTestFile(testFilePath, 1000)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, 1000, client)
+		assert.NoError(t, err)
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(1000), info.Size())
+		}
+		versions, _, err := httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			_, err = httpdtest.RestoreFileVersion(user.Username, testFileName, versions[0].ID, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, initialHash, downloadedFileHash)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestVersionsInPlaceWritesAndQuota(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.VersioningConfig.Enabled = true
+	u.FsConfig.VersioningConfig.QuotaSize = 25
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = ioutil.WriteFile(testFilePath, []byte("0123456789"), os.ModePerm)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, 10, client)
+		assert.NoError(t, err)
+		// appending to a file preserves the previous content
+		f, err := client.OpenFile(testFileName, os.O_WRONLY|os.O_APPEND)
+		if assert.NoError(t, err) {
+			_, err = f.Seek(10, io.SeekStart)
+			assert.NoError(t, err)
+			_, err = f.Write([]byte("abcde"))
+			assert.NoError(t, err)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		versions, _, err := httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			assert.Equal(t, int64(10), versions[0].Size)
+		}
+		// atomic uploads are versioned too
+		oldUploadMode := common.Config.UploadMode
+		common.Config.UploadMode = common.UploadModeAtomic
+		err = sftpUploadFile(testFilePath, testFileName, 10, client)
+		assert.NoError(t, err)
+		common.Config.UploadMode = oldUploadMode
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, int64(15), versions[0].Size)
+			assert.Equal(t, int64(10), versions[1].Size)
+		}
+		// the oldest versions are removed to respect the versions quota
+		err = sftpUploadFile(testFilePath, testFileName, 10, client)
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, int64(10), versions[0].Size)
+			assert.Equal(t, int64(15), versions[1].Size)
+		}
+		// the versions bigger than the quota are not preserved
+		err = ioutil.WriteFile(testFilePath, make([]byte, 30), os.ModePerm)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName+"_big", 30, client)
+		assert.NoError(t, err)
+		err = client.Remove(testFileName + "_big")
+		assert.NoError(t, err)
+		versions, _, err = httpdtest.GetFileVersions(user.Username, testFileName+"_big", http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 0)
+		// the SSH commands would bypass versioning
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+"_copy"), user, usePubKey)
+		assert.Error(t, err)
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-remove %v", testFileName), user, usePubKey)
+		assert.Error(t, err)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestFileVersionsAPIErrors(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(false), http.StatusCreated)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetFileVersions(user.Username, "/file", http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetFileVersions(user.Username+"_missing", "/file", http.StatusNotFound)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetFileVersionsUsage(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+	user.FsConfig.VersioningConfig.Enabled = true
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetFileVersions(user.Username, "", http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.RestoreFileVersion(user.Username, "/file", "", http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.PurgeFileVersions(user.Username, "", "", http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.RestoreFileVersion(user.Username, "/file", "20210101T000000.000000000Z", http.StatusNotFound)
+	assert.NoError(t, err)
+	versions, _, err := httpdtest.GetFileVersions(user.Username, "/file", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+	usage, _, err := httpdtest.GetFileVersionsUsage(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), usage["used_files"])
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTrashRemoveAndRestore(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.TrashConfig.Enabled = true
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("dir")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Remove(path.Join("/dir", testFileName))
+		assert.NoError(t, err)
+		err = client.RemoveDirectory("dir")
+		assert.NoError(t, err)
+		// the trash is outside the home directory and not included in the quota
+		entries, err := client.ReadDir("/")
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 0)
+		}
+		assert.DirExists(t, filepath.Join(getTrashRoot(user), "dir"))
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, user.UsedQuotaFiles)
+		assert.Equal(t, int64(0), user.UsedQuotaSize)
+		usage, _, err := httpdtest.GetTrashUsage(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(1), usage["used_files"])
+		assert.Equal(t, float64(testFileSize), usage["used_size"])
+		items, _, err := httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, "/dir", items[0].Path)
+			assert.True(t, items[0].IsDir)
+			assert.Equal(t, path.Join("/dir", testFileName), items[1].Path)
+			assert.False(t, items[1].IsDir)
+			assert.Equal(t, testFileSize, items[1].Size)
+			// restoring the file creates the missing parent directory
+			_, err = httpdtest.RestoreTrashItem(user.Username, items[1], http.StatusOK)
+			assert.NoError(t, err)
+			_, err = httpdtest.RestoreTrashItem(user.Username, items[1], http.StatusNotFound)
+			assert.NoError(t, err)
+			// the restore target exists
+			_, err = httpdtest.RestoreTrashItem(user.Username, items[0], http.StatusConflict)
+			assert.NoError(t, err)
+		}
+		info, err := client.Stat(path.Join("/dir", testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// the same path can be deleted more than once
+		for i := 0; i < 2; i++ {
+			err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+			assert.NoError(t, err)
+			err = client.Remove(testFileName)
+			assert.NoError(t, err)
+		}
+		items, _, err = httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, items, 3)
+		_, err = httpdtest.PurgeTrashItems(user.Username, "/dir", "", http.StatusOK)
+		assert.NoError(t, err)
+		items, _, err = httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			_, err = httpdtest.PurgeTrashItems(user.Username, items[0].Path, items[0].ID, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		_, err = httpdtest.PurgeTrashItems(user.Username, "", "", http.StatusOK)
+		assert.NoError(t, err)
+		items, _, err = httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, items, 0)
+		assert.NoDirExists(t, filepath.Join(getTrashRoot(user), "dir"))
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// the trash is removed together with the user
+		err = client.Remove(path.Join("/dir", testFileName))
+		assert.NoError(t, err)
+		assert.DirExists(t, filepath.Join(getTrashRoot(user), "dir", testFileName))
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.NoDirExists(t, getTrashRoot(user))
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTrashQuota(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.TrashConfig.Enabled = true
+	u.QuotaSize = 100000
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(40000)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			fileName := fmt.Sprintf("file%v", i)
+			err = sftpUploadFile(testFilePath, fileName, testFileSize, client)
+			assert.NoError(t, err)
+			err = client.Remove(fileName)
+			assert.NoError(t, err)
+		}
+		// the trash quota defaults to the user quota, the oldest item is removed
+		items, _, err := httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, "/file2", items[0].Path)
+			assert.Equal(t, "/file1", items[1].Path)
+		}
+		// an item bigger than the trash quota is removed as soon as it is deleted
+		user.FsConfig.TrashConfig.QuotaSize = testFileSize - 1
+		user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+		assert.NoError(t, err)
+		client.Close()
+		client, err = getSftpClient(user, usePubKey)
+		if assert.NoError(t, err) {
+			err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+			assert.NoError(t, err)
+			err = client.Remove(testFileName)
+			assert.NoError(t, err)
+		}
+		items, _, err = httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, items, 0)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(getTrashRoot(user))
+	assert.NoError(t, err)
+}
+
+func TestTrashSSHRemoveAndQuotaScan(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.FsConfig.TrashConfig.Enabled = true
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(131072)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.MkdirAll(path.Join("/dir", "sub"))
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", "sub", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-remove %v", "/dir"), user, usePubKey)
+		assert.NoError(t, err)
+		_, err = client.Stat("/dir")
+		assert.Error(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// a quota scan must ignore the trash
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		items, _, err := httpdtest.GetTrashItems(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "/dir", items[0].Path)
+			assert.True(t, items[0].IsDir)
+			assert.Equal(t, 2, items[0].Files)
+			assert.Equal(t, 2*testFileSize, items[0].Size)
+			_, err = httpdtest.RestoreTrashItem(user.Username, items[0], http.StatusOK)
+			assert.NoError(t, err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), "dir", "sub", testFileName))
+		assert.NoError(t, err)
+		assert.Len(t, content, int(testFileSize))
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, 3*testFileSize, user.UsedQuotaSize)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(getTrashRoot(user))
+	assert.NoError(t, err)
+}
+
+func TestTrashAPIErrors(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(false), http.StatusCreated)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetTrashItems(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetTrashItems(user.Username+"_missing", http.StatusNotFound)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetTrashUsage(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+	user.FsConfig.TrashConfig.Enabled = true
+	user.FsConfig.TrashConfig.Retention = -1
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	user.FsConfig.TrashConfig.Retention = 10
+	user.FsConfig.TrashConfig.QuotaSize = -1
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	user.FsConfig.TrashConfig.QuotaSize = 1048576
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, user.FsConfig.TrashConfig.Retention)
+	assert.Equal(t, int64(1048576), user.FsConfig.TrashConfig.QuotaSize)
+	items, _, err := httpdtest.GetTrashItems(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, items, 0)
+	usage, _, err := httpdtest.GetTrashUsage(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), usage["used_files"])
+	_, err = httpdtest.RestoreTrashItem(user.Username, getTrashItem("/file", ""), http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.RestoreTrashItem(user.Username, getTrashItem("/file", "invalid"), http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.RestoreTrashItem(user.Username, getTrashItem("/file", "20210101T000000.000000000Z"),
+		http.StatusNotFound)
+	assert.NoError(t, err)
+	_, err = httpdtest.RestoreTrashItem(user.Username, getTrashItem("/", "20210101T000000.000000000Z"),
+		http.StatusForbidden)
+	assert.NoError(t, err)
+	_, err = httpdtest.PurgeTrashItems(user.Username, "", "20210101T000000.000000000Z", http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, err = httpdtest.PurgeTrashItems(user.Username, "/", "20210101T000000.000000000Z", http.StatusForbidden)
+	assert.NoError(t, err)
+	// the trash is not supported with an overlay lower directory
+	lowerPath := filepath.Join(os.TempDir(), "lower")
+	err = os.MkdirAll(lowerPath, os.ModePerm)
+	assert.NoError(t, err)
+	user.FsConfig.OverlayConfig.LowerPath = lowerPath
+	_, body, err := httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "the trash is not supported")
+	err = os.RemoveAll(lowerPath)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMemoryFsBasicHandling(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("dir")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(path.Join("/dir", testFileName), localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		downloadedHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedHash, downloadedHash)
+		// nothing is written to disk
+		assert.NoDirExists(t, user.GetHomeDir())
+		// resume
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Truncate(testFileName, testFileSize/2)
+		assert.NoError(t, err)
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
+		assert.NoError(t, err)
+		out, err := runSSHCommand(fmt.Sprintf("sha256sum %v", testFileName), user, usePubKey)
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(out), expectedHash)
+		}
+		// symlinks and renames
+		err = client.Symlink(testFileName, "link")
+		assert.NoError(t, err)
+		info, err := client.Lstat("link")
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+		}
+		info, err = client.Stat("link")
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		linkTarget, err := client.ReadLink("link")
+		if assert.NoError(t, err) {
+			assert.Equal(t, path.Join("/", testFileName), linkTarget)
+		}
+		err = client.Rename("dir", "renamed")
+		assert.NoError(t, err)
+		err = client.Chmod(path.Join("/renamed", testFileName), 0600)
+		assert.NoError(t, err)
+		info, err = client.Stat(path.Join("/renamed", testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+		out, err = runSSHCommand("sftpgo-copy /renamed /copied", user, usePubKey)
+		if assert.NoError(t, err, string(out)) {
+			assert.Equal(t, "OK\n", string(out))
+		}
+		entries, err := client.ReadDir("/copied")
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 1)
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, 3*testFileSize, user.UsedQuotaSize)
+		// system commands are not supported
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-remove %v", "/copied"), user, usePubKey)
+		assert.Error(t, err)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	// the data are removed with the user
+	user, _, err = httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		entries, err := client.ReadDir("/")
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 0)
+		}
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+}
+
+func TestMemoryFsMaxSize(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(65535)
+	mappedPath := filepath.Join(os.TempDir(), "memvdir")
+	vdirPath := "/vdir"
+	u := getTestUser(usePubKey)
+	u.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	u.FsConfig.MemoryConfig.MaxSize = testFileSize + 100
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath,
+		},
+		VirtualPath: vdirPath,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		stat, err := client.StatVFS("/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(u.FsConfig.MemoryConfig.MaxSize)/stat.Frsize, stat.Bfree)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		stat, err = client.StatVFS("/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(0), stat.Bfree)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		assert.Error(t, err)
+		err = client.Symlink(testFileName, "link")
+		assert.NoError(t, err)
+		// overwriting an existing file is allowed
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// virtual folders are not included
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName+"1"), testFileSize, client)
+		assert.NoError(t, err)
+		// the virtual folder is on the in memory storage too
+		assert.NoDirExists(t, mappedPath)
+		// moving a file from a virtual folder cannot exceed the limit
+		err = client.Rename(path.Join(vdirPath, testFileName+"1"), testFileName+"1")
+		assert.Error(t, err)
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+		err = client.Rename(path.Join(vdirPath, testFileName+"1"), testFileName+"1")
+		assert.NoError(t, err)
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	// the virtual folder contents are preserved
+	u.FsConfig.MemoryConfig.MaxSize = 0
+	user, _, err = httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		entries, err := client.ReadDir("/")
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 1)
+		}
+		entries, err = client.ReadDir(vdirPath)
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 1)
+		}
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{MappedPath: mappedPath}, http.StatusOK)
+	assert.NoError(t, err)
+	vfs.RemoveMemoryFsData(mappedPath)
+}
+
+func TestTieringPolicy(t *testing.T) {
+	tieringPath := filepath.Join(os.TempDir(), "tiering")
+	err := vfs.InitializeTiering(vfs.TieringConfig{
+		Provider:  vfs.TieringProviderLocal,
+		LocalPath: tieringPath,
+	})
+	assert.NoError(t, err)
+	defer func() {
+		err := vfs.InitializeTiering(vfs.TieringConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(tieringPath)
+		assert.NoError(t, err)
+	}()
+
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.FsConfig.TieringConfig = vfs.TieringFsConfig{
+		Enabled: true,
+		MinAge:  1,
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("dir")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// only the files older than the min age are moved
+		report, _, err := httpdtest.GetTieringReport(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, report.Candidates, 0)
+		oldTime := time.Now().Add(-48 * time.Hour)
+		localPath := filepath.Join(user.GetHomeDir(), "dir", testFileName)
+		err = os.Chtimes(localPath, oldTime, oldTime)
+		assert.NoError(t, err)
+		report, _, err = httpdtest.GetTieringReport(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		if assert.Len(t, report.Candidates, 1) {
+			assert.Equal(t, path.Join("/dir", testFileName), report.Candidates[0].Path)
+			assert.Equal(t, testFileSize, report.Candidates[0].Size)
+		}
+		assert.Equal(t, 0, report.TieredFiles)
+		report, _, err = httpdtest.ApplyTieringPolicy(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, report.Candidates, 1)
+		assert.Equal(t, 1, report.TieredFiles)
+		assert.Equal(t, testFileSize, report.TieredSize)
+		assert.Equal(t, 0, report.Errors)
+		// the local file is now an empty stub but its logical size is reported
+		localInfo, err := os.Stat(localPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), localInfo.Size())
+			assert.Equal(t, oldTime.Unix(), localInfo.ModTime().Unix())
+		}
+		info, err := client.Stat(path.Join("/dir", testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		entries, err := client.ReadDir("/dir")
+		if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+			assert.Equal(t, testFileSize, entries[0].Size())
+		}
+		report, _, err = httpdtest.GetTieringReport(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Len(t, report.Candidates, 0)
+		assert.Equal(t, 1, report.TieredFiles)
+		// downloads are served from the tiering target
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(path.Join("/dir", testFileName), localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		downloadedHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedHash, downloadedHash)
+		localInfo, err = os.Stat(localPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), localInfo.Size())
+		}
+		assert.Equal(t, 1, countTieredObjects(t, tieringPath))
+		// a quota scan includes the tiered files with their original size
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpdtest.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize, user.UsedQuotaSize)
+		// renaming a stub keeps the tiered object, overwriting it removes the object
+		err = client.Rename(path.Join("/dir", testFileName), path.Join("/dir", testFileName+"_1"))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, countTieredObjects(t, tieringPath))
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName+"_1"), testFileSize, client)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, countTieredObjects(t, tieringPath))
+		localInfo, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir", testFileName+"_1"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, localInfo.Size())
+		}
+		// removing a stub removes the tiered object too
+		err = os.Chtimes(localPath+"_1", oldTime, oldTime)
+		assert.NoError(t, err)
+		report, _, err = httpdtest.ApplyTieringPolicy(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.TieredFiles)
+		assert.Equal(t, 1, countTieredObjects(t, tieringPath))
+		err = client.Remove(path.Join("/dir", testFileName+"_1"))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, countTieredObjects(t, tieringPath))
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTieringRecall(t *testing.T) {
+	tieringPath := filepath.Join(os.TempDir(), "tiering")
+	err := vfs.InitializeTiering(vfs.TieringConfig{
+		Provider:  vfs.TieringProviderLocal,
+		LocalPath: tieringPath,
+	})
+	assert.NoError(t, err)
+	defer func() {
+		err := vfs.InitializeTiering(vfs.TieringConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(tieringPath)
+		assert.NoError(t, err)
+	}()
+
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.FsConfig.TieringConfig = vfs.TieringFsConfig{
+		Enabled: true,
+		MinAge:  1,
+		Recall:  true,
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(131072)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		localPath := filepath.Join(user.GetHomeDir(), testFileName)
+		oldTime := time.Now().Add(-48 * time.Hour)
+		err = os.Chtimes(localPath, oldTime, oldTime)
+		assert.NoError(t, err)
+		report, _, err := httpdtest.ApplyTieringPolicy(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.TieredFiles)
+		assert.Equal(t, 1, countTieredObjects(t, tieringPath))
+		// the first download recalls the file
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		downloadedHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedHash, downloadedHash)
+		assert.Eventually(t, func() bool {
+			info, err := os.Stat(localPath)
+			return err == nil && info.Size() == testFileSize
+		}, 1*time.Second, 50*time.Millisecond)
+		assert.Equal(t, 0, countTieredObjects(t, tieringPath))
+		localHash, err := computeHashForFile(sha256.New(), localPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedHash, localHash)
+		localInfo, err := os.Stat(localPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, oldTime.Unix(), localInfo.ModTime().Unix())
+		}
+
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTieringSSHCommands(t *testing.T) {
+	tieringPath := filepath.Join(os.TempDir(), "tiering")
+	err := vfs.InitializeTiering(vfs.TieringConfig{
+		Provider:  vfs.TieringProviderLocal,
+		LocalPath: tieringPath,
+	})
+	assert.NoError(t, err)
+	defer func() {
+		err := vfs.InitializeTiering(vfs.TieringConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(tieringPath)
+		assert.NoError(t, err)
+	}()
+
+	usePubKey := false
+	// the SSH commands are available for the users without a tiering policy
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(131)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		client.Close()
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+".copy"), user, usePubKey)
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(user.GetHomeDir(), testFileName+".copy"))
+		assert.NoError(t, err)
+	}
+	// they would handle the stubs for the users with a policy
+	user.FsConfig.TieringConfig = vfs.TieringFsConfig{
+		Enabled: true,
+		MinAge:  1,
+	}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+".copy1"), user, usePubKey)
+	assert.Error(t, err)
+	_, err = runSSHCommand(fmt.Sprintf("sftpgo-remove %v", testFileName), user, usePubKey)
+	assert.Error(t, err)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTieringAPIErrors(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(false), http.StatusCreated)
+	assert.NoError(t, err)
+	// tiering is not configured
+	_, _, err = httpdtest.GetTieringReport(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+
+	tieringPath := filepath.Join(os.TempDir(), "tiering")
+	err = vfs.InitializeTiering(vfs.TieringConfig{
+		Provider:  vfs.TieringProviderLocal,
+		LocalPath: tieringPath,
+	})
+	assert.NoError(t, err)
+	defer func() {
+		err := vfs.InitializeTiering(vfs.TieringConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(tieringPath)
+		assert.NoError(t, err)
+	}()
+	// tiering is not enabled for the user
+	_, _, err = httpdtest.GetTieringReport(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.ApplyTieringPolicy(user.Username, http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetTieringReport(user.Username+"_missing", http.StatusNotFound)
+	assert.NoError(t, err)
+
+	user.FsConfig.TieringConfig = vfs.TieringFsConfig{
+		Enabled: true,
+	}
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	user.FsConfig.TieringConfig.MinAge = 1
+	user.FsConfig.TieringConfig.Paths = []string{"relative"}
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	user.FsConfig.TieringConfig.Paths = []string{"/dir"}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	report, _, err := httpdtest.GetTieringReport(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, report.Candidates, 0)
+
+	// tiering is supported for the local filesystem only
+	user.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
 	assert.NoError(t, err)
 
-	err = os.RemoveAll(user.GetHomeDir())
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
-	err = os.RemoveAll(clonePath)
+	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
 }
 
-func TestGitQuotaVirtualFolders(t *testing.T) {
-	if len(gitPath) == 0 || len(sshPath) == 0 || runtime.GOOS == osWindows {
-		t.Skip("git and/or ssh command not found or OS is windows, unable to execute this test")
-	}
+func TestReplication(t *testing.T) {
+	replicationPath := filepath.Join(os.TempDir(), "replication")
+	err := common.InitializeReplication(getReplicationConfig(replicationPath))
+	assert.NoError(t, err)
+	defer func() {
+		err := common.InitializeReplication(vfs.ReplicationConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(replicationPath)
+		assert.NoError(t, err)
+	}()
+
 	usePubKey := true
-	repoName := "testrepo"
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1
-	u.QuotaSize = 131072
-	mappedPath := filepath.Join(os.TempDir(), "repo")
+	mappedPath := filepath.Join(os.TempDir(), "vdir")
+	vdirPath := "/vdir"
 	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
 		BaseVirtualFolder: vfs.BaseVirtualFolder{
 			MappedPath: mappedPath,
 		},
-		VirtualPath: "/" + repoName,
-		QuotaFiles:  0,
-		QuotaSize:   0,
+		VirtualPath: vdirPath,
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
 	})
-	err := os.MkdirAll(mappedPath, os.ModePerm)
+	err = os.MkdirAll(mappedPath, os.ModePerm)
 	assert.NoError(t, err)
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
+	replicaHome := filepath.Join(replicationPath, user.Username)
 	client, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
-		// we upload a file so the user is over quota
 		defer client.Close()
 		testFilePath := filepath.Join(homeBasePath, testFileName)
-		err = createTestFile(testFilePath, u.QuotaSize)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
 		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName, u.QuotaSize, client)
+		err = client.Mkdir("dir")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return isReplicaEqual(filepath.Join(replicaHome, "dir", testFileName), expectedHash) &&
+				isReplicaEqual(filepath.Join(replicaHome, "vdir", testFileName), expectedHash)
+		}, 5*time.Second, 100*time.Millisecond)
+		waitForReplicationQueue(t)
+		// rename and remove
+		err = client.Rename("dir", "dir1")
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(replicaHome, "dir"))
+			return os.IsNotExist(err) &&
+				isReplicaEqual(filepath.Join(replicaHome, "dir1", testFileName), expectedHash)
+		}, 5*time.Second, 100*time.Millisecond)
+		err = client.Remove(path.Join("/dir1", testFileName))
+		assert.NoError(t, err)
+		err = client.RemoveDirectory("/dir1")
 		assert.NoError(t, err)
+		err = client.Truncate(path.Join(vdirPath, testFileName), 100)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(replicaHome, "dir1"))
+			if !os.IsNotExist(err) {
+				return false
+			}
+			info, err := os.Stat(filepath.Join(replicaHome, "vdir", testFileName))
+			return err == nil && info.Size() == 100
+		}, 5*time.Second, 100*time.Millisecond)
+		waitForReplicationQueue(t)
+		// changes made outside SFTPGo are replicated by a resync
+		err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "external"), []byte("content"), os.ModePerm)
+		assert.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(replicaHome, "stale"), []byte("content"), os.ModePerm)
+		assert.NoError(t, err)
+		_, err = httpdtest.StartReplicationResync(user.Username, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(replicaHome, "stale"))
+			if !os.IsNotExist(err) {
+				return false
+			}
+			_, err = os.Stat(filepath.Join(replicaHome, "external"))
+			return err == nil
+		}, 5*time.Second, 100*time.Millisecond)
+		waitForReplicationQueue(t)
+		// the virtual folder is not removed by the resync for the home dir
+		_, err = os.Stat(filepath.Join(replicaHome, "vdir", testFileName))
+		assert.NoError(t, err)
+
 		err = os.Remove(testFilePath)
 		assert.NoError(t, err)
 	}
-
-	clonePath := filepath.Join(homeBasePath, repoName)
-	err = os.RemoveAll(user.GetHomeDir())
-	assert.NoError(t, err)
-	err = os.RemoveAll(filepath.Join(homeBasePath, repoName))
-	assert.NoError(t, err)
-	out, err := initGitRepo(mappedPath)
-	assert.NoError(t, err, "unexpected error, out: %v", string(out))
-
-	out, err = cloneGitRepo(homeBasePath, "/"+repoName, user.Username)
-	assert.NoError(t, err, "unexpected error, out: %v", string(out))
-
-	out, err = addFileToGitRepo(clonePath, 128)
-	assert.NoError(t, err, "unexpected error, out: %v", string(out))
-
-	out, err = pushToGitRepo(clonePath)
-	assert.NoError(t, err, "unexpected error, out: %v", string(out))
-
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
-
-	err = os.RemoveAll(user.GetHomeDir())
-	assert.NoError(t, err)
 	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{MappedPath: mappedPath}, http.StatusOK)
 	assert.NoError(t, err)
-	err = os.RemoveAll(mappedPath)
+	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
-	err = os.RemoveAll(clonePath)
+	err = os.RemoveAll(mappedPath)
 	assert.NoError(t, err)
 }
 
-func TestGitErrors(t *testing.T) {
-	if len(gitPath) == 0 || len(sshPath) == 0 || runtime.GOOS == osWindows {
-		t.Skip("git and/or ssh command not found or OS is windows, unable to execute this test")
-	}
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+func TestReplicationRetries(t *testing.T) {
+	replicationPath := filepath.Join(os.TempDir(), "replication")
+	config := getReplicationConfig(replicationPath)
+	config.MaxAttempts = 2
+	config.RetryDelay = 1
+	err := common.InitializeReplication(config)
 	assert.NoError(t, err)
-	repoName := "testrepo"
-	clonePath := filepath.Join(homeBasePath, repoName)
-	err = os.RemoveAll(user.GetHomeDir())
+	defer func() {
+		err := common.InitializeReplication(vfs.ReplicationConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(replicationPath)
+		assert.NoError(t, err)
+	}()
+
+	usePubKey := false
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
 	assert.NoError(t, err)
-	err = os.RemoveAll(filepath.Join(homeBasePath, repoName))
+	// a file with the same name as the user directory makes the replication fail
+	replicaHome := filepath.Join(replicationPath, user.Username)
+	err = ioutil.WriteFile(replicaHome, []byte("content"), os.ModePerm)
 	assert.NoError(t, err)
-	out, err := cloneGitRepo(homeBasePath, "/"+repoName, user.Username)
-	assert.Error(t, err, "cloning a missing repo must fail, out: %v", string(out))
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			status, _, err := httpdtest.GetReplicationStatus(0, 0, http.StatusOK)
+			return err == nil && status.Failed == 1
+		}, 10*time.Second, 100*time.Millisecond)
+		status, _, err := httpdtest.GetReplicationStatus(0, 0, http.StatusOK)
+		assert.NoError(t, err)
+		assert.True(t, status.Enabled)
+		assert.Equal(t, vfs.ReplicationProviderLocal, status.Provider)
+		assert.Equal(t, 0, status.Pending)
+		if assert.Len(t, status.FailedJobs, 1) {
+			job := status.FailedJobs[0]
+			assert.Equal(t, user.Username, job.Username)
+			assert.Equal(t, "/"+testFileName, job.Path)
+			assert.Equal(t, 2, job.Attempts)
+			assert.NotEmpty(t, job.LastError)
+		}
+		// a resync replicates the file and removes the failed job
+		err = os.Remove(replicaHome)
+		assert.NoError(t, err)
+		_, err = httpdtest.StartReplicationResync("", http.StatusAccepted)
+		assert.NoError(t, err)
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return isReplicaEqual(filepath.Join(replicaHome, testFileName), expectedHash)
+		}, 5*time.Second, 100*time.Millisecond)
+		waitForReplicationQueue(t)
 
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
-	err = os.RemoveAll(clonePath)
+}
+
+func TestReplicationAPIErrors(t *testing.T) {
+	status, _, err := httpdtest.GetReplicationStatus(0, 0, http.StatusOK)
 	assert.NoError(t, err)
+	assert.False(t, status.Enabled)
+	_, err = httpdtest.StartReplicationResync("", http.StatusBadRequest)
+	assert.NoError(t, err)
+
+	replicationPath := filepath.Join(os.TempDir(), "replication")
+	err = common.InitializeReplication(getReplicationConfig(replicationPath))
+	assert.NoError(t, err)
+	defer func() {
+		err := common.InitializeReplication(vfs.ReplicationConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(replicationPath)
+		assert.NoError(t, err)
+	}()
+
+	_, err = httpdtest.StartReplicationResync("missinguser", http.StatusNotFound)
+	assert.NoError(t, err)
+	config := getReplicationConfig("relative")
+	err = common.InitializeReplication(config)
+	assert.Error(t, err)
+	config = getReplicationConfig(replicationPath)
+	config.Workers = 0
+	err = common.InitializeReplication(config)
+	assert.Error(t, err)
 }
 
-// Start SCP tests
 func TestSCPBasicHandling(t *testing.T) {
 	if len(scpPath) == 0 {
 		t.Skip("scp command not found, unable to execute this test")
@@ -8137,6 +10607,17 @@ func getTestUser(usePubKey bool) dataprovider.User {
 	return user
 }
 
+func getTrashItem(virtualPath, itemID string) vfs.TrashItem {
+	return vfs.TrashItem{
+		ID:   itemID,
+		Path: virtualPath,
+	}
+}
+
+func getTrashRoot(user dataprovider.User) string {
+	return filepath.Join(common.Config.TrashPath, user.Username)
+}
+
 func getTestSFTPUser(usePubKey bool) dataprovider.User {
 	u := getTestUser(usePubKey)
 	u.Username = defaultSFTPUsername
@@ -8233,6 +10714,265 @@ func getSftpClient(user dataprovider.User, usePubKey bool) (*sftp.Client, error)
 	return getSftpClientWithAddr(user, usePubKey, sftpServerAddr)
 }
 
+// rawSFTPClient sends SFTP packets not supported by pkg/sftp
+type rawSFTPClient struct {
+	conn       *ssh.Client
+	session    *ssh.Session
+	stdin      io.WriteCloser
+	stdout     io.Reader
+	extensions map[string]string
+	lastID     uint32
+}
+
+type rawSFTPStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *rawSFTPStatusError) Error() string {
+	return fmt.Sprintf("SFTP status %v: %v", e.code, e.message)
+}
+
+func getRawSFTPStatusCode(err error) uint32 {
+	if e, ok := err.(*rawSFTPStatusError); ok {
+		return e.code
+	}
+	return math.MaxUint32
+}
+
+func getRawSFTPCheckFileReply(algo string, hashes []byte) []byte {
+	reply := appendRawSFTPString(nil, "check-file")
+	reply = appendRawSFTPString(reply, algo)
+	return append(reply, hashes...)
+}
+
+func getRawSFTPClient(user dataprovider.User, usePubKey bool) (*rawSFTPClient, error) {
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+	}
+	if usePubKey {
+		signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	} else {
+		config.Auth = []ssh.AuthMethod{ssh.Password(defaultPassword)}
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &rawSFTPClient{
+		conn:       conn,
+		extensions: make(map[string]string),
+	}
+	c.session, err = conn.NewSession()
+	if err == nil {
+		c.stdin, err = c.session.StdinPipe()
+	}
+	if err == nil {
+		c.stdout, err = c.session.StdoutPipe()
+	}
+	if err == nil {
+		err = c.session.RequestSubsystem("sftp")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// init packet, version 3
+	if err = c.send([]byte{1, 0, 0, 0, 3}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	packet, err := c.recv()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if packet[0] != 2 {
+		c.Close()
+		return nil, fmt.Errorf("unexpected packet type %v", packet[0])
+	}
+	data := packet[5:]
+	for len(data) > 0 {
+		var name, value string
+		name, data = readRawSFTPString(data)
+		value, data = readRawSFTPString(data)
+		c.extensions[name] = value
+	}
+	return c, nil
+}
+
+func (c *rawSFTPClient) Close() error {
+	c.session.Close()
+	return c.conn.Close()
+}
+
+func (c *rawSFTPClient) send(data []byte) error {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint32(packet, uint32(len(data)))
+	_, err := c.stdin.Write(append(packet, data...))
+	return err
+}
+
+func (c *rawSFTPClient) recv() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.stdout, header); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header))
+	_, err := io.ReadFull(c.stdout, packet)
+	return packet, err
+}
+
+// request sends a request and returns the response type and data, the
+// requests are sent and answered one at a time
+func (c *rawSFTPClient) request(packetType byte, data []byte) (byte, []byte, error) {
+	c.lastID++
+	packet := []byte{packetType}
+	packet = appendRawSFTPUint32(packet, c.lastID)
+	if err := c.send(append(packet, data...)); err != nil {
+		return 0, nil, err
+	}
+	packet, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(packet) < 5 || binary.BigEndian.Uint32(packet[1:]) != c.lastID {
+		return 0, nil, errors.New("unexpected response")
+	}
+	if packet[0] == 101 {
+		code := binary.BigEndian.Uint32(packet[5:])
+		if code == 0 {
+			return packet[0], nil, nil
+		}
+		message, _ := readRawSFTPString(packet[9:])
+		return packet[0], nil, &rawSFTPStatusError{code: code, message: message}
+	}
+	return packet[0], packet[5:], nil
+}
+
+// sendRequests sends the given requests without waiting for the responses
+// and returns the responses by request id
+func (c *rawSFTPClient) sendRequests(requests ...[]byte) (map[uint32][]byte, error) {
+	var ids []uint32
+	for _, r := range requests {
+		c.lastID++
+		packet := []byte{r[0]}
+		packet = appendRawSFTPUint32(packet, c.lastID)
+		if err := c.send(append(packet, r[1:]...)); err != nil {
+			return nil, err
+		}
+		ids = append(ids, c.lastID)
+	}
+	responses := make(map[uint32][]byte)
+	for range ids {
+		packet, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) < 5 {
+			return nil, errors.New("unexpected response")
+		}
+		responses[binary.BigEndian.Uint32(packet[1:])] = packet
+	}
+	if len(responses) != len(ids) {
+		return nil, errors.New("unexpected responses")
+	}
+	return responses, nil
+}
+
+func (c *rawSFTPClient) open(name string, pflags uint32) (string, error) {
+	data := appendRawSFTPString(nil, name)
+	data = appendRawSFTPUint32(data, pflags)
+	// empty attributes
+	data = appendRawSFTPUint32(data, 0)
+	packetType, reply, err := c.request(3, data)
+	if err != nil {
+		return "", err
+	}
+	if packetType != 102 {
+		return "", fmt.Errorf("unexpected packet type %v", packetType)
+	}
+	handle, _ := readRawSFTPString(reply)
+	return handle, nil
+}
+
+func (c *rawSFTPClient) close(handle string) error {
+	_, _, err := c.request(4, appendRawSFTPString(nil, handle))
+	return err
+}
+
+func (c *rawSFTPClient) extended(name string, data []byte) ([]byte, error) {
+	packetType, reply, err := c.request(200, append(appendRawSFTPString(nil, name), data...))
+	if err != nil {
+		return nil, err
+	}
+	if packetType != 201 {
+		return nil, fmt.Errorf("unexpected packet type %v", packetType)
+	}
+	return reply, nil
+}
+
+func (c *rawSFTPClient) checkFileName(name, algos string, startOffset, length uint64, blockSize uint32) ([]byte, error) {
+	return c.checkFile("check-file-name", name, algos, startOffset, length, blockSize)
+}
+
+func (c *rawSFTPClient) checkFileHandle(handle, algos string, startOffset, length uint64, blockSize uint32) ([]byte, error) {
+	return c.checkFile("check-file-handle", handle, algos, startOffset, length, blockSize)
+}
+
+func (c *rawSFTPClient) checkFile(extension, target, algos string, startOffset, length uint64, blockSize uint32) ([]byte, error) {
+	data := appendRawSFTPString(nil, target)
+	data = appendRawSFTPString(data, algos)
+	data = appendRawSFTPUint64(data, startOffset)
+	data = appendRawSFTPUint64(data, length)
+	data = appendRawSFTPUint32(data, blockSize)
+	return c.extended(extension, data)
+}
+
+func (c *rawSFTPClient) copyData(readHandle string, readOffset, readLength uint64, writeHandle string, writeOffset uint64) error {
+	data := appendRawSFTPString(nil, readHandle)
+	data = appendRawSFTPUint64(data, readOffset)
+	data = appendRawSFTPUint64(data, readLength)
+	data = appendRawSFTPString(data, writeHandle)
+	data = appendRawSFTPUint64(data, writeOffset)
+	_, _, err := c.request(200, append(appendRawSFTPString(nil, "copy-data"), data...))
+	return err
+}
+
+func appendRawSFTPUint32(b []byte, v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return append(b, buf...)
+}
+
+func appendRawSFTPUint64(b []byte, v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+func appendRawSFTPString(b []byte, v string) []byte {
+	return append(appendRawSFTPUint32(b, uint32(len(v))), v...)
+}
+
+func readRawSFTPString(b []byte) (string, []byte) {
+	if len(b) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil
+	}
+	return string(b[4 : 4+n]), b[4+n:]
+}
+
 func getKeyboardInteractiveSftpClient(user dataprovider.User, answers []string) (*sftp.Client, error) {
 	var sftpClient *sftp.Client
 	config := &ssh.ClientConfig{
@@ -8515,6 +11255,43 @@ func computeHashForFile(hasher hash.Hash, path string) (string, error) {
 	return hash, err
 }
 
+func countTieredObjects(t *testing.T, root string) int {
+	count := 0
+	err := filepath.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	return count
+}
+
+func getReplicationConfig(localPath string) vfs.ReplicationConfig {
+	return vfs.ReplicationConfig{
+		Provider:    vfs.ReplicationProviderLocal,
+		Workers:     2,
+		MaxAttempts: 3,
+		RetryDelay:  30,
+		LocalPath:   localPath,
+	}
+}
+
+func isReplicaEqual(replicaPath string, expectedHash string) bool {
+	hash, err := computeHashForFile(sha256.New(), replicaPath)
+	return err == nil && hash == expectedHash
+}
+
+func waitForReplicationQueue(t *testing.T) {
+	assert.Eventually(t, func() bool {
+		status, _, err := httpdtest.GetReplicationStatus(0, 0, http.StatusOK)
+		return err == nil && status.Pending == 0 && status.Failed == 0 && len(status.Active) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
 func waitForActiveTransfers(t *testing.T) {
 	assert.Eventually(t, func() bool {
 		for _, stat := range common.Connections.GetStats() {
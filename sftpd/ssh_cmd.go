@@ -120,7 +120,7 @@ func (c *sshCommand) handle() (err error) {
 }
 
 func (c *sshCommand) handeSFTPGoCopy() error {
-	if !vfs.IsLocalOsFs(c.connection.Fs) {
+	if !vfs.IsLocalOsFs(c.connection.Fs) && !vfs.IsServerSideCopySupported(c.connection.Fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
 	}
 	sshSourcePath, sshDestPath, err := c.getCopyPaths()
@@ -145,6 +145,9 @@ func (c *sshCommand) handeSFTPGoCopy() error {
 	if err := c.checkCopyPermissions(fsSourcePath, fsDestPath, sshSourcePath, sshDestPath, fi); err != nil {
 		return c.sendErrorResponse(err)
 	}
+	if err := c.connection.CheckRetentionTarget(sshSourcePath, sshDestPath, fi.IsDir()); err != nil {
+		return c.sendErrorResponse(err)
+	}
 	filesNum := 0
 	filesSize := int64(0)
 	if fi.IsDir() {
@@ -175,7 +178,20 @@ func (c *sshCommand) handeSFTPGoCopy() error {
 		return c.sendErrorResponse(err)
 	}
 	c.connection.Log(logger.LevelDebug, "start copy %#v -> %#v", fsSourcePath, fsDestPath)
+	if !vfs.IsLocalOsFs(c.connection.Fs) {
+		// the quota must be updated for the files copied before any error
+		filesNum, filesSize, err = vfs.CopyObjects(c.connection.Fs, fsSourcePath, fsDestPath)
+		c.updateQuota(sshDestPath, filesNum, filesSize)
+		common.AddReplicationJob(c.connection.User.Username, dataprovider.ReplicationActionUpload, sshDestPath, "")
+		if err != nil {
+			return c.sendErrorResponse(err)
+		}
+		c.connection.channel.Write([]byte("OK\n")) //nolint:errcheck
+		c.sendExitStatus(nil)
+		return nil
+	}
 	err = fscopy.Copy(fsSourcePath, fsDestPath)
+	common.AddReplicationJob(c.connection.User.Username, dataprovider.ReplicationActionUpload, sshDestPath, "")
 	if err != nil {
 		return c.sendErrorResponse(err)
 	}
@@ -186,13 +202,19 @@ func (c *sshCommand) handeSFTPGoCopy() error {
 }
 
 func (c *sshCommand) handeSFTPGoRemove() error {
-	if !vfs.IsLocalOsFs(c.connection.Fs) {
+	if !vfs.IsLocalStorage(c.connection.Fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
 	}
 	sshDestPath, err := c.getRemovePath()
 	if err != nil {
 		return c.sendErrorResponse(err)
 	}
+	// the items can be removed directly only if there are no layers, such as
+	// the versioning, that must handle the removal
+	isTrashEnabled := c.connection.IsTrashEnabledFor(sshDestPath)
+	if !isTrashEnabled && !vfs.IsLocalOsFs(c.connection.Fs) {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
 	if !c.connection.User.HasPerm(dataprovider.PermDelete, path.Dir(sshDestPath)) {
 		return c.sendErrorResponse(common.ErrPermissionDenied)
 	}
@@ -204,6 +226,9 @@ func (c *sshCommand) handeSFTPGoRemove() error {
 	if err != nil {
 		return c.sendErrorResponse(err)
 	}
+	if err := c.connection.CheckRetentionLock(fsDestPath, sshDestPath, fi); err != nil {
+		return c.sendErrorResponse(err)
+	}
 	filesNum := 0
 	filesSize := int64(0)
 	if fi.IsDir() {
@@ -235,11 +260,16 @@ func (c *sshCommand) handeSFTPGoRemove() error {
 		return c.sendErrorResponse(err)
 	}
 
-	err = os.RemoveAll(fsDestPath)
+	if isTrashEnabled {
+		err = c.connection.MoveToTrash(fsDestPath, sshDestPath, filesSize)
+	} else {
+		err = os.RemoveAll(fsDestPath)
+	}
 	if err != nil {
 		return c.sendErrorResponse(err)
 	}
 	c.updateQuota(sshDestPath, -filesNum, -filesSize)
+	common.AddReplicationJob(c.connection.User.Username, dataprovider.ReplicationActionDelete, sshDestPath, "")
 	c.connection.channel.Write([]byte("OK\n")) //nolint:errcheck
 	c.sendExitStatus(nil)
 	return nil
@@ -293,7 +323,7 @@ func (c *sshCommand) handleHashCommands() error {
 		if !c.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
 			return c.sendErrorResponse(common.ErrPermissionDenied)
 		}
-		hash, err := c.computeHashForFile(h, fsPath)
+		hash, err := c.connection.GetFileChecksum(fsPath, strings.TrimSuffix(c.command, "sum"))
 		if err != nil {
 			return c.sendErrorResponse(err)
 		}
@@ -420,6 +450,11 @@ func (c *sshCommand) isSystemCommandAllowed() error {
 			c.command, sshDestPath, c.connection.User.Username)
 		return errUnsupportedConfig
 	}
+	if c.connection.User.HasRetentionFiltersFor(sshDestPath) {
+		c.connection.Log(logger.LevelDebug, "command %#v is not allowed, path %#v has retention filters, user %#v",
+			c.command, sshDestPath, c.connection.User.Username)
+		return errUnsupportedConfig
+	}
 	for _, f := range c.connection.User.Filters.FileExtensions {
 		if f.Path == sshDestPath {
 			c.connection.Log(logger.LevelDebug,
@@ -733,26 +768,6 @@ func (c *sshCommand) sendExitStatus(err error) {
 	}
 }
 
-func (c *sshCommand) computeHashForFile(hasher hash.Hash, path string) (string, error) {
-	hash := ""
-	f, r, _, err := c.connection.Fs.Open(path, 0)
-	if err != nil {
-		return hash, err
-	}
-	var reader io.ReadCloser
-	if f != nil {
-		reader = f
-	} else {
-		reader = r
-	}
-	defer reader.Close()
-	_, err = io.Copy(hasher, reader)
-	if err == nil {
-		hash = fmt.Sprintf("%x", hasher.Sum(nil))
-	}
-	return hash, err
-}
-
 func parseCommandPayload(command string) (string, []string, error) {
 	parts, err := shlex.Split(command)
 	if err == nil && len(parts) == 0 {
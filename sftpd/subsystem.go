@@ -52,7 +52,7 @@ func ServeSubSystemConnection(user dataprovider.User, connectionID string, reade
 	common.Connections.Add(connection)
 	defer common.Connections.Remove(connection.GetID())
 
-	server := sftp.NewRequestServer(connection.channel, sftp.Handlers{
+	server := sftp.NewRequestServer(newExtensionsChannel(connection.channel, connection), sftp.Handlers{
 		FileGet:  connection,
 		FilePut:  connection,
 		FileCmd:  connection,
@@ -116,6 +116,7 @@ func (t *transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	}
 
 	n, err = t.writerAt.WriteAt(p, off)
+	t.SniffContent(p[:n], off)
 	atomic.AddInt64(&t.BytesReceived, int64(n))
 
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
@@ -22,6 +22,14 @@ func initializeRouter(enableProfiler bool) {
 		r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
 			render.PlainText(w, r, "ok")
 		})
+		r.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			if !common.GetHealthStatus().Ready {
+				render.Status(r, http.StatusServiceUnavailable)
+				render.PlainText(w, r, "not ready")
+				return
+			}
+			render.PlainText(w, r, "ok")
+		})
 	})
 
 	router.Group(func(router chi.Router) {
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -146,8 +147,20 @@ func (fs *AzureBlobFs) ConnectionID() string {
 	return fs.connectionID
 }
 
-// Stat returns a FileInfo describing the named file
+// Stat returns a FileInfo describing the named file.
+// The emulated symlinks, if enabled, are followed
 func (fs *AzureBlobFs) Stat(name string) (os.FileInfo, error) {
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return setFileInfoName(info, name), nil
+}
+
+func (fs *AzureBlobFs) lstat(name string) (os.FileInfo, error) {
 	if name == "" || name == "." {
 		if fs.svc != nil {
 			err := fs.checkIfBucketExists()
@@ -160,12 +173,17 @@ func (fs *AzureBlobFs) Stat(name string) (os.FileInfo, error) {
 	if fs.config.KeyPrefix == name+"/" {
 		return NewFileInfo(name, true, 0, time.Now(), false), nil
 	}
+	if upload := fs.getPartialUpload(name); upload != nil {
+		return upload.getFileInfo(name), nil
+	}
 
 	attrs, err := fs.headObject(name)
 	if err == nil {
 		isDir := (attrs.ContentType() == dirMimeType)
 		metrics.AZListObjectsCompleted(nil)
-		return NewFileInfo(name, isDir, attrs.ContentLength(), attrs.LastModified(), false), nil
+		info := newObjectFileInfo(name, isDir, attrs.ContentLength(), attrs.LastModified(), attrs.NewMetadata())
+		info.etag = string(attrs.ETag())
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return nil, err
@@ -181,13 +199,21 @@ func (fs *AzureBlobFs) Stat(name string) (os.FileInfo, error) {
 	return nil, errors.New("404 no such file or directory")
 }
 
-// Lstat returns a FileInfo describing the named file
+// Lstat returns a FileInfo describing the named file.
+// If the file is an emulated symlink the returned FileInfo describes the symlink
 func (fs *AzureBlobFs) Lstat(name string) (os.FileInfo, error) {
-	return fs.Stat(name)
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, false)
+	return info, err
 }
 
 // Open opens the named file for reading
 func (fs *AzureBlobFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if fs.config.EmulateSymlinks {
+		name = resolveObjectPath(fs, name)
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -221,11 +247,30 @@ func (fs *AzureBlobFs) Open(name string, offset int64) (File, *pipeat.PipeReader
 
 // Create creates or opens the named file for writing
 func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	var upload *partialUpload
+	if partialUploads != nil && flag != -1 {
+		upload = fs.getPartialUpload(name)
+		if flag != 0 && flag&os.O_TRUNC == 0 {
+			if upload == nil {
+				fsLog(fs, logger.LevelDebug, "unable to resume %#v, only interrupted uploads can be resumed", name)
+				return nil, nil, nil, ErrVfsUnsupported
+			}
+		} else if upload != nil {
+			// uncommitted blocks are discarded by the next commit or garbage collected by Azure
+			partialUploads.remove(upload.Namespace, upload.Key)
+			upload = nil
+		}
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	p := NewPipeWriter(w)
+	var offset int64
+	if upload != nil {
+		offset = upload.getSize()
+		p.offset = offset
+	}
 	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
 	ctx, cancelFn := context.WithCancel(context.Background())
 
@@ -252,10 +297,11 @@ func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(),
 		// if we shutdown Azurite while uploading it hangs, so we use our own wrapper for
 		// the low level functions
 		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blobBlockURL, uploadOptions)*/
-		err := fs.handleMultipartUpload(ctx, r, blobBlockURL, headers)
+		err := fs.handleMultipartUpload(ctx, r, name, blobBlockURL, headers, upload, flag == -1)
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
-		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, r.GetReadedBytes(), err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, offset: %v, readed bytes: %v, err: %v", name, offset,
+			r.GetReadedBytes(), err)
 		metrics.AZTransferCompleted(r.GetReadedBytes(), 0, err)
 	}()
 
@@ -263,15 +309,14 @@ func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(),
 }
 
 // Rename renames (moves) source to target.
-// We don't support renaming non empty directories since we should
-// rename all the contents too and this could take long time: think
-// about directories with thousands of files, for each file we should
-// execute a StartCopyFromURL call.
+// Non empty directories are renamed copying all the contents, using
+// StartCopyFromURL calls, and then removing the source blobs: this could
+// take long time for directories with thousands of files.
 func (fs *AzureBlobFs) Rename(source, target string) error {
 	if source == target {
 		return nil
 	}
-	fi, err := fs.Stat(source)
+	fi, err := fs.lstat(source)
 	if err != nil {
 		return err
 	}
@@ -281,12 +326,26 @@ func (fs *AzureBlobFs) Rename(source, target string) error {
 			return err
 		}
 		if hasContents {
-			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+			_, _, err = copyPrefix(fs, source, target, true, fs.copyObject)
+			return err
 		}
 	}
+	if err := fs.copyObject(source, target, fi.IsDir()); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// CopyObjects copies source, a file or a directory, to target using server-side copies
+func (fs *AzureBlobFs) CopyObjects(source, target string) (int, int64, error) {
+	return copyObjects(fs, source, target, fs.copyObject)
+}
+
+func (fs *AzureBlobFs) copyObject(source, target string, isDir bool) error {
 	dstBlobURL := fs.containerURL.NewBlobURL(target)
 	srcURL := fs.containerURL.NewBlobURL(source).URL()
 
+	// empty metadata means copy them, including the attributes set by the clients, from the source blob
 	md := azblob.Metadata{}
 	mac := azblob.ModifiedAccessConditions{}
 	bac := azblob.BlobAccessConditions{}
@@ -322,7 +381,7 @@ func (fs *AzureBlobFs) Rename(source, target string) error {
 		return err
 	}
 	metrics.AZCopyObjectCompleted(nil)
-	return fs.Remove(source, fi.IsDir())
+	return nil
 }
 
 // Remove removes the named file or (empty) directory.
@@ -342,6 +401,17 @@ func (fs *AzureBlobFs) Remove(name string, isDir bool) error {
 
 	_, err := blobBlockURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
 	metrics.AZDeleteObjectCompleted(err)
+	if !isDir {
+		if upload := fs.getPartialUpload(name); upload != nil {
+			// the blob does not exist until the upload is completed
+			if err != nil && fs.IsNotExist(err) {
+				err = nil
+			}
+			if err == nil {
+				partialUploads.remove(upload.Namespace, upload.Key)
+			}
+		}
+	}
 	return err
 }
 
@@ -358,29 +428,52 @@ func (fs *AzureBlobFs) Mkdir(name string) error {
 	return w.Close()
 }
 
-// Symlink creates source as a symbolic link to target.
-func (*AzureBlobFs) Symlink(source, target string) error {
-	return ErrVfsUnsupported
+// Symlink creates target as a symbolic link to source.
+// Symlinks are emulated, if enabled, using an empty blob
+// that stores the source path as metadata
+func (fs *AzureBlobFs) Symlink(source, target string) error {
+	if !fs.config.EmulateSymlinks {
+		return ErrVfsUnsupported
+	}
+	if err := checkSymlinkCreation(fs, target); err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	headers := azblob.BlobHTTPHeaders{
+		ContentType: symlinkMimeType,
+	}
+	_, err := fs.containerURL.NewBlockBlobURL(target).Upload(ctx, bytes.NewReader(nil), headers,
+		getSymlinkMetadata(fs.GetRelativePath(source)), azblob.BlobAccessConditions{}, azblob.AccessTierType(fs.config.AccessTier),
+		nil, azblob.ClientProvidedKeyOptions{})
+	return err
 }
 
 // Readlink returns the destination of the named symbolic link
-func (*AzureBlobFs) Readlink(name string) (string, error) {
-	return "", ErrVfsUnsupported
+func (fs *AzureBlobFs) Readlink(name string) (string, error) {
+	if !fs.config.EmulateSymlinks {
+		return "", ErrVfsUnsupported
+	}
+	return readObjectSymlink(fs, name)
 }
 
 // Chown changes the numeric uid and gid of the named file.
-func (*AzureBlobFs) Chown(name string, uid int, gid int) error {
-	return ErrVfsUnsupported
+// They are stored as blob metadata
+func (fs *AzureBlobFs) Chown(name string, uid int, gid int) error {
+	return fs.updateMetadata(name, withOwner(uid, gid))
 }
 
 // Chmod changes the mode of the named file to mode.
-func (*AzureBlobFs) Chmod(name string, mode os.FileMode) error {
-	return ErrVfsUnsupported
+// The permissions are stored as blob metadata
+func (fs *AzureBlobFs) Chmod(name string, mode os.FileMode) error {
+	return fs.updateMetadata(name, withMode(mode))
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (*AzureBlobFs) Chtimes(name string, atime, mtime time.Time) error {
-	return ErrVfsUnsupported
+// The modification time is stored as blob metadata, the access time is ignored
+func (fs *AzureBlobFs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.updateMetadata(name, withMtime(mtime))
 }
 
 // Truncate changes the size of the named file.
@@ -393,7 +486,15 @@ func (*AzureBlobFs) Truncate(name string, size int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	return readDirFromLister(fs.OpenDir(dirname))
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page, up to 5000 blobs, at a time
+func (fs *AzureBlobFs) OpenDir(dirname string) (DirLister, error) {
+	if fs.config.EmulateSymlinks {
+		dirname = resolveObjectPath(fs, dirname)
+	}
 	// dirname must be already cleaned
 	prefix := ""
 	if dirname != "" && dirname != "." {
@@ -404,26 +505,28 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	}
 
 	prefixes := make(map[string]bool)
+	marker := azblob.Marker{}
 
-	for marker := (azblob.Marker{}); marker.NotDone(); {
+	lister := newPagedDirLister(func() ([]os.FileInfo, bool, error) {
 		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 		defer cancelFn()
 
 		listBlob, err := fs.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
 			Details: azblob.BlobListingDetails{
 				Copy:             false,
-				Metadata:         false,
+				Metadata:         true,
 				Snapshots:        false,
 				UncommittedBlobs: false,
 				Deleted:          false,
 			},
 			Prefix: prefix,
 		})
+		metrics.AZListObjectsCompleted(err)
 		if err != nil {
-			metrics.AZListObjectsCompleted(err)
-			return nil, err
+			return nil, false, err
 		}
 		marker = listBlob.NextMarker
+		result := make([]os.FileInfo, 0, len(listBlob.Segment.BlobPrefixes)+len(listBlob.Segment.BlobItems))
 		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
 			// we don't support prefixes == "/" this will be sent if a key starts with "/"
 			if blobPrefix.Name == "/" {
@@ -454,18 +557,18 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 					prefixes[name] = true
 				}
 			}
-			result = append(result, NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified, false))
+			result = append(result, newObjectFileInfo(name, isDir, size, blobInfo.Properties.LastModified, blobInfo.Metadata))
 		}
-	}
-
-	metrics.AZListObjectsCompleted(nil)
-	return result, nil
+		return result, marker.NotDone(), nil
+	}, nil)
+	return newPartialUploadsDirLister(lister, fs.getNamespace(), dirname), nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
-// Upload Resume is not supported on Azure Blob
+// Upload Resume is supported on Azure Blob only for interrupted uploads and
+// only if the resumable uploads are enabled
 func (*AzureBlobFs) IsUploadResumeSupported() bool {
-	return false
+	return partialUploads != nil
 }
 
 // IsAtomicUploadSupported returns true if atomic upload is supported.
@@ -578,8 +681,8 @@ func (fs *AzureBlobFs) ScanRootDirContents() (int, int64, error) {
 
 // GetDirSize returns the number of files and the size for a folder
 // including any subfolders
-func (*AzureBlobFs) GetDirSize(dirname string) (int, int64, error) {
-	return 0, 0, ErrVfsUnsupported
+func (fs *AzureBlobFs) GetDirSize(dirname string) (int, int64, error) {
+	return getDirSizeFromObjects(fs, dirname)
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload.
@@ -687,6 +790,74 @@ func (fs *AzureBlobFs) headObject(name string) (*azblob.BlobGetPropertiesRespons
 	return response, err
 }
 
+func (fs *AzureBlobFs) getSymlinkTarget(name string) (string, bool, error) {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return "", false, err
+	}
+	target, ok := getSymlinkTargetFromMetadata(attrs.NewMetadata())
+	return target, ok, nil
+}
+
+// updateMetadata applies the given update to the metadata of the named blob.
+// Virtual directories, prefixes without a blob, get one
+func (fs *AzureBlobFs) updateMetadata(name string, update metadataUpdate) error {
+	var metadata map[string]string
+	attrs, err := fs.headObject(name)
+	if err == nil {
+		metadata = attrs.NewMetadata()
+	} else {
+		if !fs.IsNotExist(err) {
+			return err
+		}
+		hasContents, errContents := fs.hasContents(name)
+		if errContents != nil {
+			return errContents
+		}
+		if !hasContents {
+			return err
+		}
+		_, w, _, err := fs.Create(name, -1)
+		if err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err = fs.containerURL.NewBlobURL(name).SetMetadata(ctx, getUpdatedMetadata(metadata, update),
+		azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// SetChecksums stores the checksums for the named file as blob metadata
+func (fs *AzureBlobFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err = fs.containerURL.NewBlobURL(name).SetMetadata(ctx, getUpdatedMetadata(attrs.NewMetadata(), withChecksums(checksums)),
+		azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// GetChecksum returns the checksum stored as blob metadata for the named
+// file and the given algorithm
+func (fs *AzureBlobFs) GetChecksum(name, algo string) (string, int64, bool) {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return "", 0, false
+	}
+	checksum, ok := getChecksumFromMetadata(attrs.NewMetadata(), algo)
+	return checksum, attrs.ContentLength(), ok
+}
+
 // GetMimeType returns the content type
 func (fs *AzureBlobFs) GetMimeType(name string) (string, error) {
 	response, err := fs.headObject(name)
@@ -775,8 +946,12 @@ func (fs *AzureBlobFs) hasContents(name string) (bool, error) {
 	return result, err
 }
 
-func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Reader, blockBlobURL azblob.BlockBlobURL,
-	httpHeaders azblob.BlobHTTPHeaders) error {
+// handleMultipartUpload stages the data read from reader as blocks and commits them.
+// If the upload is interrupted and the resumable uploads are enabled, the staged
+// blocks are kept so the upload can be resumed later
+func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Reader, name string,
+	blockBlobURL azblob.BlockBlobURL, httpHeaders azblob.BlobHTTPHeaders, upload *partialUpload, isDir bool,
+) error {
 	partSize := fs.config.UploadPartSize
 	guard := make(chan struct{}, fs.config.UploadConcurrency)
 	blockCtxTimeout := time.Duration(fs.config.UploadPartSize/(1024*1024)) * time.Minute
@@ -787,17 +962,25 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 	finished := false
 	binaryBlockID := make([]byte, 8)
 	var blocks []string
+	if upload != nil {
+		for _, part := range upload.Parts {
+			blocks = append(blocks, part.ID)
+		}
+		binary.LittleEndian.PutUint64(binaryBlockID, uint64(len(upload.Parts)))
+	}
+	var stagedBlocks []partialUploadPart
+	var blocksMutex sync.Mutex
 	var wg sync.WaitGroup
 	var errOnce sync.Once
-	var poolError error
+	var poolError, readError error
 
 	poolCtx, poolCancel := context.WithCancel(ctx)
 	defer poolCancel()
 
-	for part := 0; !finished; part++ {
+	for part := len(blocks); !finished; part++ {
 		buf := pool.getBuffer()
 
-		n, err := fs.readFill(reader, buf)
+		n, err := readFill(reader, buf)
 		if err == io.EOF {
 			// read finished, if n > 0 we need to process the last data chunck
 			if n == 0 {
@@ -807,8 +990,8 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 			finished = true
 		} else if err != nil {
 			pool.releaseBuffer(buf)
-			pool.free()
-			return err
+			readError = err
+			break
 		}
 
 		fs.incrementBlockID(binaryBlockID)
@@ -823,7 +1006,7 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 		}
 
 		wg.Add(1)
-		go func(blockID string, buf []byte, bufSize int) {
+		go func(blockNumber int, blockID string, buf []byte, bufSize int) {
 			defer wg.Done()
 			bufferReader := bytes.NewReader(buf[:bufSize])
 			innerCtx, cancelFn := context.WithDeadline(poolCtx, time.Now().Add(blockCtxTimeout))
@@ -837,95 +1020,106 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 					fsLog(fs, logger.LevelDebug, "multipart upload error: %v", poolError)
 					poolCancel()
 				})
+			} else {
+				blocksMutex.Lock()
+				stagedBlocks = append(stagedBlocks, partialUploadPart{
+					Number: int64(blockNumber),
+					ID:     blockID,
+					Size:   int64(bufSize),
+				})
+				blocksMutex.Unlock()
 			}
 			pool.releaseBuffer(buf)
 			<-guard
-		}(blockID, buf, n)
+		}(part+1, blockID, buf, n)
 	}
 
 	wg.Wait()
 	close(guard)
 	pool.free()
 
-	if poolError != nil {
-		return poolError
+	err := readError
+	if err == nil {
+		err = poolError
 	}
-
-	_, err := blockBlobURL.CommitBlockList(ctx, blocks, httpHeaders, azblob.Metadata{}, azblob.BlobAccessConditions{},
-		azblob.AccessTierType(fs.config.AccessTier), nil, azblob.ClientProvidedKeyOptions{})
-	return err
-}
-
-// copied from rclone
-func (fs *AzureBlobFs) readFill(r io.Reader, buf []byte) (n int, err error) {
-	var nn int
-	for n < len(buf) && err == nil {
-		nn, err = r.Read(buf[n:])
-		n += nn
+	if err == nil && partialUploads != nil && !isDir {
+		// the transfer could be aborted after the reader was closed, never commit
+		// a partial upload in this case
+		err = ctx.Err()
+	}
+	if err == nil {
+		_, err = blockBlobURL.CommitBlockList(ctx, blocks, httpHeaders, azblob.Metadata{}, azblob.BlobAccessConditions{},
+			azblob.AccessTierType(fs.config.AccessTier), nil, azblob.ClientProvidedKeyOptions{})
+		if err == nil {
+			if upload != nil {
+				partialUploads.remove(upload.Namespace, upload.Key)
+			}
+			return nil
+		}
+	}
+	if partialUploads != nil && !isDir {
+		fs.savePartialUpload(name, upload, stagedBlocks)
 	}
-	return n, err
+	return err
 }
 
-// copied from rclone
-func (fs *AzureBlobFs) incrementBlockID(blockID []byte) {
-	for i, digit := range blockID {
-		newDigit := digit + 1
-		blockID[i] = newDigit
-		if newDigit >= digit {
-			// exit if no carry
-			break
+// savePartialUpload saves the blocks staged for an interrupted upload
+// so it can be resumed later
+func (fs *AzureBlobFs) savePartialUpload(name string, upload *partialUpload, stagedBlocks []partialUploadPart) {
+	if upload == nil {
+		upload = &partialUpload{
+			Namespace: fs.getNamespace(),
+			Key:       name,
+			Owner:     fs.config.Owner,
 		}
 	}
+	upload.setParts(append(upload.Parts, stagedBlocks...), 1)
+	if len(upload.Parts) == 0 {
+		partialUploads.remove(upload.Namespace, upload.Key)
+		return
+	}
+	if err := partialUploads.save(upload); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to save the state for the interrupted upload %#v: %v", name, err)
+		return
+	}
+	fsLog(fs, logger.LevelDebug, "upload for %#v interrupted, it can be resumed from offset %v", name, upload.getSize())
 }
 
-type bufferAllocator struct {
-	sync.Mutex
-	available  [][]byte
-	bufferSize int
-	finalized  bool
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *AzureBlobFs) HasPartialUpload(name string) bool {
+	return fs.getPartialUpload(name) != nil
 }
 
-func newBufferAllocator(size int) *bufferAllocator {
-	return &bufferAllocator{
-		bufferSize: size,
-		finalized:  false,
+// AbortPartialUpload removes the state for the interrupted upload for the given name, if any.
+// Azure does not allow to remove the uncommitted blocks, they are garbage collected after
+// one week
+func (fs *AzureBlobFs) AbortPartialUpload(name string) error {
+	if upload := fs.getPartialUpload(name); upload != nil {
+		partialUploads.remove(upload.Namespace, upload.Key)
 	}
+	return nil
 }
 
-func (b *bufferAllocator) getBuffer() []byte {
-	b.Lock()
-	defer b.Unlock()
-
-	if len(b.available) > 0 {
-		var result []byte
-
-		truncLength := len(b.available) - 1
-		result = b.available[truncLength]
-
-		b.available[truncLength] = nil
-		b.available = b.available[:truncLength]
-
-		return result
-	}
-
-	return make([]byte, b.bufferSize)
+func (fs *AzureBlobFs) getNamespace() string {
+	u := fs.containerURL.URL()
+	return fmt.Sprintf("%v%v%v", azBlobNamespacePrefix, u.Host, u.Path)
 }
 
-func (b *bufferAllocator) releaseBuffer(buf []byte) {
-	b.Lock()
-	defer b.Unlock()
-
-	if b.finalized || len(buf) != b.bufferSize {
-		return
+func (fs *AzureBlobFs) getPartialUpload(name string) *partialUpload {
+	if partialUploads == nil {
+		return nil
 	}
-
-	b.available = append(b.available, buf)
+	return partialUploads.get(fs.getNamespace(), name)
 }
 
-func (b *bufferAllocator) free() {
-	b.Lock()
-	defer b.Unlock()
-
-	b.available = nil
-	b.finalized = true
+// copied from rclone
+func (fs *AzureBlobFs) incrementBlockID(blockID []byte) {
+	for i, digit := range blockID {
+		newDigit := digit + 1
+		blockID[i] = newDigit
+		if newDigit >= digit {
+			// exit if no carry
+			break
+		}
+	}
 }
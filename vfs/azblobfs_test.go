@@ -0,0 +1,333 @@
+// +build !noazblob
+
+package vfs
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeAzAccount   = "account"
+	fakeAzContainer = "container"
+)
+
+func TestAzBlobChtimesFile(t *testing.T) {
+	server := newFakeAzBlobServer(t)
+	fs := server.getFs(t)
+	lastModified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	server.putBlob("dir/file", []byte("content"), "", lastModified, nil)
+
+	mtime := time.Date(2020, 1, 1, 10, 20, 30, 500, time.UTC)
+	err := fs.Chtimes("dir/file", time.Now(), mtime)
+	require.NoError(t, err)
+	info, err := fs.Stat("dir/file")
+	require.NoError(t, err)
+	// the modification time is stored with a second precision
+	assert.True(t, info.ModTime().Equal(mtime.Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, int64(7), info.Size())
+	assert.False(t, info.IsDir())
+	assert.Equal(t, []byte("content"), server.getBlob("dir/file").data)
+	// the metadata are always listed
+	files, err := fs.ReadDir("dir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+		assert.True(t, files[0].ModTime().Equal(mtime.Truncate(time.Second)), files[0].ModTime().String())
+	}
+	// the other attributes are preserved setting the modification time again
+	err = fs.Chmod("dir/file", 0600)
+	require.NoError(t, err)
+	err = fs.Chtimes("dir/file", time.Now(), mtime.Add(time.Hour))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir/file")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Hour).Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	err = fs.Chtimes("dir/missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+}
+
+func TestAzBlobChtimesDir(t *testing.T) {
+	server := newFakeAzBlobServer(t)
+	fs := server.getFs(t)
+	server.putBlob("vdir/file", []byte("data"), "", time.Now(), nil)
+	server.putBlob("dir", nil, dirMimeType, time.Now(), nil)
+
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	// a virtual directory, a prefix without a blob, gets one
+	assert.Nil(t, server.getBlob("vdir"))
+	err := fs.Chtimes("vdir", time.Now(), mtime)
+	require.NoError(t, err)
+	if blob := server.getBlob("vdir"); assert.NotNil(t, blob) {
+		assert.Equal(t, dirMimeType, blob.contentType)
+	}
+	info, err := fs.Stat("vdir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime), info.ModTime().String())
+	// the directory contents are not modified
+	files, err := fs.ReadDir("vdir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+	}
+	// an empty directory
+	err = fs.Chtimes("dir", time.Now(), mtime.Add(time.Minute))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Minute)), info.ModTime().String())
+	// the non empty directories are listed as blob prefixes, they have no
+	// attributes, the empty ones are listed as blobs
+	files, err = fs.ReadDir("")
+	require.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+		assert.Equal(t, "dir", files[0].Name())
+		assert.True(t, files[0].IsDir())
+		assert.True(t, files[0].ModTime().Equal(mtime.Add(time.Minute)), files[0].ModTime().String())
+		assert.Equal(t, "vdir", files[1].Name())
+		assert.True(t, files[1].IsDir())
+		assert.False(t, files[1].ModTime().Equal(mtime), files[1].ModTime().String())
+	}
+	// a missing directory is not created
+	err = fs.Chtimes("missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+	assert.Nil(t, server.getBlob("missing"))
+}
+
+// fakeAzBlob is a blob stored inside fakeAzBlobServer
+type fakeAzBlob struct {
+	data         []byte
+	contentType  string
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+// fakeAzBlobServer is a minimal in memory implementation of the Azure Blob
+// Storage API, for a single container accessed using a SAS URL, to test
+// AzureBlobFs without Azurite
+type fakeAzBlobServer struct {
+	sync.Mutex
+	server *httptest.Server
+	blobs  map[string]*fakeAzBlob
+}
+
+func newFakeAzBlobServer(t *testing.T) *fakeAzBlobServer {
+	s := &fakeAzBlobServer{
+		blobs: make(map[string]*fakeAzBlob),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeAzBlobServer) getFs(t *testing.T) *AzureBlobFs {
+	// the server listens on an IP address so the account name is the first path component
+	fs, err := NewAzBlobFs("", os.TempDir(), AzBlobFsConfig{
+		SASURL: s.server.URL + "/" + fakeAzAccount + "/" + fakeAzContainer + "?sig=signature",
+	})
+	require.NoError(t, err)
+	return fs.(*AzureBlobFs)
+}
+
+func (s *fakeAzBlobServer) putBlob(name string, data []byte, contentType string, lastModified time.Time,
+	metadata map[string]string,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.blobs[name] = &fakeAzBlob{
+		data:         data,
+		contentType:  contentType,
+		metadata:     metadata,
+		lastModified: lastModified.UTC().Truncate(time.Second),
+	}
+}
+
+func (s *fakeAzBlobServer) getBlob(name string) *fakeAzBlob {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.blobs[name]
+}
+
+func (s *fakeAzBlobServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	containerPath := "/" + fakeAzAccount + "/" + fakeAzContainer
+	query := r.URL.Query()
+	if r.URL.Path == containerPath {
+		if r.Method == http.MethodGet && query.Get("restype") == "container" && query.Get("comp") == "list" {
+			s.listBlobs(w, r)
+			return
+		}
+		s.sendError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, containerPath+"/") {
+		s.sendError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, containerPath+"/")
+	switch {
+	case r.Method == http.MethodHead:
+		blob, ok := s.blobs[name]
+		if !ok {
+			s.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		for k, v := range blob.metadata {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+		if blob.contentType != "" {
+			w.Header().Set("Content-Type", blob.contentType)
+		}
+		w.Header().Set("Last-Modified", blob.lastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+strconv.FormatInt(blob.lastModified.UnixNano(), 16)+`"`)
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && query.Get("comp") == "metadata":
+		blob, ok := s.blobs[name]
+		if !ok {
+			s.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		blob.metadata = getFakeAzMetadata(r.Header)
+		blob.lastModified = time.Now().UTC().Truncate(time.Second)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+			s.sendError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		// only the empty blobs used for the directories are supported
+		if len(blockList.Latest) > 0 {
+			s.sendError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		s.blobs[name] = &fakeAzBlob{
+			contentType:  r.Header.Get("x-ms-blob-content-type"),
+			metadata:     getFakeAzMetadata(r.Header),
+			lastModified: time.Now().UTC().Truncate(time.Second),
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		s.sendError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// listBlobs returns all the matching blobs in a single page
+func (s *fakeAzBlobServer) listBlobs(w http.ResponseWriter, r *http.Request) {
+	type blobMetadata struct {
+		Items string `xml:",innerxml"`
+	}
+	type blobProperties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		ContentType   string `xml:"Content-Type,omitempty"`
+		BlobType      string `xml:"BlobType"`
+	}
+	type blobItem struct {
+		Name       string         `xml:"Name"`
+		Properties blobProperties `xml:"Properties"`
+		Metadata   blobMetadata   `xml:"Metadata"`
+	}
+	type blobPrefix struct {
+		Name string `xml:"Name"`
+	}
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	result := struct {
+		XMLName       xml.Name     `xml:"EnumerationResults"`
+		ContainerName string       `xml:"ContainerName,attr"`
+		Prefix        string       `xml:"Prefix"`
+		Delimiter     string       `xml:"Delimiter,omitempty"`
+		Blobs         []blobItem   `xml:"Blobs>Blob"`
+		BlobPrefixes  []blobPrefix `xml:"Blobs>BlobPrefix"`
+		NextMarker    string       `xml:"NextMarker"`
+	}{
+		ContainerName: fakeAzContainer,
+		Prefix:        prefix,
+		Delimiter:     delimiter,
+	}
+	names := make([]string, 0, len(s.blobs))
+	for name := range s.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prefixes := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], delimiter); idx >= 0 {
+				p := name[:len(prefix)+idx+len(delimiter)]
+				if !prefixes[p] {
+					prefixes[p] = true
+					result.BlobPrefixes = append(result.BlobPrefixes, blobPrefix{Name: p})
+				}
+				continue
+			}
+		}
+		blob := s.blobs[name]
+		item := blobItem{
+			Name: name,
+			Properties: blobProperties{
+				LastModified:  blob.lastModified.Format(http.TimeFormat),
+				ContentLength: int64(len(blob.data)),
+				ContentType:   blob.contentType,
+				BlobType:      "BlockBlob",
+			},
+		}
+		var sb strings.Builder
+		for k, v := range blob.metadata {
+			sb.WriteString("<" + k + ">")
+			xml.EscapeText(&sb, []byte(v)) //nolint:errcheck
+			sb.WriteString("</" + k + ">")
+		}
+		item.Metadata.Items = sb.String()
+		result.Blobs = append(result.Blobs, item)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result) //nolint:errcheck
+}
+
+func (s *fakeAzBlobServer) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><Error><Code>` + code + `</Code><Message>` + //nolint:errcheck
+		http.StatusText(status) + `</Message></Error>`))
+}
+
+func getFakeAzMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") && len(v) > 0 {
+			metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(k), "x-ms-meta-"))] = v[0]
+		}
+	}
+	return metadata
+}
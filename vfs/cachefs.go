@@ -0,0 +1,512 @@
+package vfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+)
+
+const (
+	readCacheLogSender = "readcache"
+	// cachedFsName is the name prefix for the Fs implementation that caches
+	// the downloads
+	cachedFsName = "cachedfs"
+	// prefix for the files that are being downloaded and so are not yet part of the cache
+	readCacheTempPrefix = "fill-"
+)
+
+// supported read cache modes for CacheFsConfig
+const (
+	ReadCacheModeDefault = iota
+	ReadCacheModeEnabled
+	ReadCacheModeDisabled
+)
+
+var readCache *localReadCache
+
+// ReadCacheConfig defines the configuration for the local read cache shared
+// among the users with a remote filesystem
+type ReadCacheConfig struct {
+	// Absolute path to a local directory to use to store the cached files.
+	// Leave empty to disable the cache
+	Path string `json:"path" mapstructure:"path"`
+	// Maximum size for the cache as MB. When the limit is reached the least
+	// recently used files are removed. 0 means disabled
+	MaxSize int64 `json:"max_size" mapstructure:"max_size"`
+	// Files bigger than this size, as MB, are never cached. 0 means no limit
+	// other than the cache size
+	MaxFileSize int64 `json:"max_file_size" mapstructure:"max_file_size"`
+	// If enabled the cache is used for all the users with a remote filesystem
+	// that don't explicitly disable it
+	EnabledByDefault bool `json:"enabled_by_default" mapstructure:"enabled_by_default"`
+}
+
+// IsEnabled returns true if the read cache is configured
+func (c *ReadCacheConfig) IsEnabled() bool {
+	return c.Path != "" && c.MaxSize > 0
+}
+
+// InitializeReadCache initializes the local read cache using the given configuration.
+// Files left inside the cache directory from a previous run are removed
+func InitializeReadCache(c ReadCacheConfig) error {
+	readCache = nil
+	if !c.IsEnabled() {
+		return nil
+	}
+	if !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("invalid read cache path %#v, it must be an absolute path", c.Path)
+	}
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("invalid read cache max file size: %v", c.MaxFileSize)
+	}
+	cache := &localReadCache{
+		path:             filepath.Clean(c.Path),
+		maxSize:          c.MaxSize * 1048576,
+		maxFileSize:      c.MaxFileSize * 1048576,
+		enabledByDefault: c.EnabledByDefault,
+		entries:          make(map[string]*list.Element),
+		lru:              list.New(),
+		filling:          make(map[string]bool),
+	}
+	if err := os.MkdirAll(cache.path, 0700); err != nil {
+		return fmt.Errorf("unable to create read cache directory %#v: %v", cache.path, err)
+	}
+	cache.removeStaleFiles()
+	metrics.UpdateReadCacheSize(0)
+	logger.Info(readCacheLogSender, "", "read cache initialized, path: %#v, max size: %v, max file size: %v",
+		cache.path, cache.maxSize, cache.maxFileSize)
+	readCache = cache
+	return nil
+}
+
+// CacheFsConfig defines the read cache settings for a user
+type CacheFsConfig struct {
+	// 0 means the global default, 1 enabled, 2 disabled
+	Mode int `json:"mode,omitempty"`
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *CacheFsConfig) Validate() error {
+	if c.Mode < ReadCacheModeDefault || c.Mode > ReadCacheModeDisabled {
+		return fmt.Errorf("invalid read cache mode: %v", c.Mode)
+	}
+	return nil
+}
+
+// IsEnabled returns true if the read cache is configured and enabled for
+// this configuration
+func (c *CacheFsConfig) IsEnabled() bool {
+	if readCache == nil {
+		return false
+	}
+	switch c.Mode {
+	case ReadCacheModeEnabled:
+		return true
+	case ReadCacheModeDisabled:
+		return false
+	default:
+		return readCache.enabledByDefault
+	}
+}
+
+type readCacheEntry struct {
+	key     string
+	path    string
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// isValidFor returns true if the cached file matches the given remote file.
+// The entity tag, if available, is compared, the size and the modification
+// time are compared otherwise: the modification time stored as object
+// metadata can be set by the clients so it doesn't always change with the
+// content
+func (e *readCacheEntry) isValidFor(info os.FileInfo) bool {
+	if e.size != info.Size() {
+		return false
+	}
+	etag := getETag(info)
+	if e.etag != "" || etag != "" {
+		return e.etag == etag
+	}
+	return e.modTime.Equal(info.ModTime())
+}
+
+// localReadCache is a size bounded LRU cache for remote files stored inside
+// a local directory. Each entry is valid as long as the entity tag or, if
+// not available, the size and the modification time for the remote file do
+// not change
+type localReadCache struct {
+	sync.Mutex
+	path             string
+	maxSize          int64
+	maxFileSize      int64
+	enabledByDefault bool
+	size             int64
+	entries          map[string]*list.Element
+	lru              *list.List
+	// keys that are being downloaded, false means invalidated while downloading
+	filling map[string]bool
+}
+
+func (c *localReadCache) getFilePath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.path, hex.EncodeToString(h[:]))
+}
+
+func (c *localReadCache) isCacheFile(name string) bool {
+	if strings.HasPrefix(name, readCacheTempPrefix) {
+		return true
+	}
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// removeStaleFiles removes the files created by a previous run, we don't
+// touch files not created by the cache itself
+func (c *localReadCache) removeStaleFiles() {
+	files, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		logger.Warn(readCacheLogSender, "", "unable to list read cache directory %#v: %v", c.path, err)
+		return
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || !c.isCacheFile(info.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.path, info.Name())); err != nil {
+			logger.Warn(readCacheLogSender, "", "unable to remove stale read cache file %#v: %v", info.Name(), err)
+		}
+	}
+}
+
+// get returns the cached file for the given key opened for reading or nil if
+// there is no valid entry for the remote file described by info
+func (c *localReadCache) get(key string, info os.FileInfo) *os.File {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*readCacheEntry)
+	if !entry.isValidFor(info) {
+		c.removeElement(elem)
+		return nil
+	}
+	f, err := os.Open(entry.path)
+	if err != nil {
+		logger.Warn(readCacheLogSender, "", "unable to open cached file %#v: %v", entry.path, err)
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return f
+}
+
+// startFill returns true if the caller can download a file with the given key
+// and size to the cache. Only one download for the same key is allowed
+func (c *localReadCache) startFill(key string, size int64) bool {
+	if size > c.maxSize || (c.maxFileSize > 0 && size > c.maxFileSize) {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.filling[key]; ok {
+		return false
+	}
+	c.filling[key] = true
+	return true
+}
+
+func (c *localReadCache) endFill(key, tempPath string, size int64, info os.FileInfo, success bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	isValid := c.filling[key]
+	delete(c.filling, key)
+	if !success || !isValid {
+		if tempPath != "" {
+			if err := os.Remove(tempPath); err != nil {
+				logger.Warn(readCacheLogSender, "", "unable to remove temporary file %#v: %v", tempPath, err)
+			}
+		}
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	for c.size+size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+	entry := &readCacheEntry{
+		key:     key,
+		path:    c.getFilePath(key),
+		size:    size,
+		modTime: info.ModTime(),
+		etag:    getETag(info),
+	}
+	if err := os.Rename(tempPath, entry.path); err != nil {
+		logger.Warn(readCacheLogSender, "", "unable to rename %#v -> %#v: %v", tempPath, entry.path, err)
+		os.Remove(tempPath) //nolint:errcheck
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	metrics.UpdateReadCacheSize(c.size)
+}
+
+// invalidate removes the entry for the given key and the entries inside it,
+// if the key is a directory. Downloads in progress for these keys will not
+// be added to the cache
+func (c *localReadCache) invalidate(key string) {
+	prefix := key + "/"
+
+	c.Lock()
+	defer c.Unlock()
+
+	for k, elem := range c.entries {
+		if k == key || strings.HasPrefix(k, prefix) {
+			c.removeElement(elem)
+		}
+	}
+	for k := range c.filling {
+		if k == key || strings.HasPrefix(k, prefix) {
+			c.filling[k] = false
+		}
+	}
+}
+
+// removeElement must be called with the lock held
+func (c *localReadCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*readCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if err := os.Remove(entry.path); err != nil {
+		logger.Warn(readCacheLogSender, "", "unable to remove cached file %#v: %v", entry.path, err)
+	}
+	metrics.UpdateReadCacheSize(c.size)
+}
+
+// cacheFillWriter writes to the download pipe and to the cache file.
+// Errors writing to the cache file don't interrupt the download
+type cacheFillWriter struct {
+	pipe     *pipeat.PipeWriterAt
+	file     *os.File
+	errCache error
+}
+
+func (w *cacheFillWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	if n > 0 && w.errCache == nil {
+		_, w.errCache = w.file.Write(p[:n])
+	}
+	return n, err
+}
+
+// CachedFs is a Fs implementation that wraps a remote filesystem and stores
+// the downloaded files inside the local read cache. The cached files are
+// served as long as the entity tag or, if not available, the size and the
+// modification time reported by the wrapped filesystem do not change, the
+// stat is done using the user
+// credentials so the permissions are always checked by the remote storage.
+// Cached entries are invalidated on uploads, renames and removals.
+type CachedFs struct {
+	Fs
+	// identifies the remote storage, users accessing the same storage share the cached files
+	namespace string
+}
+
+// NewCachedFs returns a Fs that caches the downloads from the given filesystem.
+// The namespace must uniquely identify the remote storage
+func NewCachedFs(fs Fs, namespace string) Fs {
+	return &CachedFs{
+		Fs:        fs,
+		namespace: namespace,
+	}
+}
+
+// Name returns the name for the Fs implementation
+func (fs *CachedFs) Name() string {
+	return fmt.Sprintf("%v %v", cachedFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped remote filesystem
+func (fs *CachedFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+func (*CachedFs) isStorageLayer() {}
+
+func (*CachedFs) isTransparentLayer() {}
+
+func (fs *CachedFs) getKey(name string) string {
+	return fs.namespace + ":" + name
+}
+
+// Open opens the named file for reading
+func (fs *CachedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	cache := readCache
+	if cache == nil {
+		return fs.Fs.Open(name, offset)
+	}
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return fs.Fs.Open(name, offset)
+	}
+	key := fs.getKey(name)
+	if f := cache.get(key, info); f != nil {
+		metrics.ReadCacheAccessed(true)
+		fsLog(fs, logger.LevelDebug, "serving %#v from the read cache, offset: %v", name, offset)
+		return fs.openCached(cache, f, info.Size(), offset)
+	}
+	metrics.ReadCacheAccessed(false)
+	if offset > 0 || !cache.startFill(key, info.Size()) {
+		return fs.Fs.Open(name, offset)
+	}
+	return fs.openAndFill(cache, key, name, info)
+}
+
+func (fs *CachedFs) openCached(cache *localReadCache, f *os.File, size, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(cache.path)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	go func() {
+		defer f.Close()
+
+		_, err := io.Copy(w, io.NewSectionReader(f, offset, size-offset))
+		w.CloseWithError(err) //nolint:errcheck
+	}()
+	return nil, r, nil, nil
+}
+
+func (fs *CachedFs) openAndFill(cache *localReadCache, key, name string, info os.FileInfo) (File, *pipeat.PipeReaderAt, func(), error) {
+	tempFile, err := ioutil.TempFile(cache.path, readCacheTempPrefix)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to create read cache file: %v", err)
+		cache.endFill(key, "", 0, nil, false)
+		return fs.Fs.Open(name, 0)
+	}
+	file, reader, cancelFn, err := fs.Fs.Open(name, 0)
+	if err == nil && file == nil && reader == nil {
+		err = errors.New("unable to open the remote file")
+	}
+	if err != nil {
+		tempFile.Close()
+		cache.endFill(key, tempFile.Name(), 0, nil, false)
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(cache.path)
+	if err != nil {
+		tempFile.Close()
+		cache.endFill(key, tempFile.Name(), 0, nil, false)
+		return file, reader, cancelFn, nil
+	}
+	go func() {
+		var src io.ReadCloser = reader
+		if file != nil {
+			src = file
+		}
+		fillWriter := &cacheFillWriter{
+			pipe: w,
+			file: tempFile,
+		}
+		n, err := io.Copy(fillWriter, src)
+		src.Close()
+		w.CloseWithError(err) //nolint:errcheck
+		errClose := tempFile.Close()
+		success := err == nil && fillWriter.errCache == nil && errClose == nil && n == info.Size()
+		fsLog(fs, logger.LevelDebug, "read cache fill completed for %#v, size: %v, cached: %v, err: %v, cache err: %v",
+			name, n, success, err, fillWriter.errCache)
+		cache.endFill(key, tempFile.Name(), n, info, success)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs *CachedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	fs.invalidate(name)
+	return fs.Fs.Create(name, flag)
+}
+
+// Rename renames (moves) source to target
+func (fs *CachedFs) Rename(source, target string) error {
+	fs.invalidate(source)
+	fs.invalidate(target)
+	return fs.Fs.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory
+func (fs *CachedFs) Remove(name string, isDir bool) error {
+	fs.invalidate(name)
+	return fs.Fs.Remove(name, isDir)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs *CachedFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs.invalidate(name)
+	return fs.Fs.Chtimes(name, atime, mtime)
+}
+
+// Truncate changes the size of the named file
+func (fs *CachedFs) Truncate(name string, size int64) error {
+	fs.invalidate(name)
+	return fs.Fs.Truncate(name, size)
+}
+
+// CopyObjects copies source to target using server-side copies, if supported
+func (fs *CachedFs) CopyObjects(source, target string) (int, int64, error) {
+	fs.invalidate(target)
+	return CopyObjects(fs.Fs, source, target)
+}
+
+// SetChecksums stores the checksums for the named file, if supported
+func (fs *CachedFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	return SetChecksums(fs.Fs, name, size, checksums)
+}
+
+// GetChecksum returns the checksum stored for the named file, if any
+func (fs *CachedFs) GetChecksum(name, algo string) (string, int64, bool) {
+	return GetStoredChecksum(fs.Fs, name, algo)
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *CachedFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(fs.Fs, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func (fs *CachedFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(fs.Fs, name)
+}
+
+func (fs *CachedFs) invalidate(name string) {
+	if cache := readCache; cache != nil {
+		cache.invalidate(fs.getKey(name))
+	}
+}
@@ -0,0 +1,38 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCacheEntryValidation(t *testing.T) {
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	info := NewFileInfo("file", false, 100, modTime, false)
+	info.etag = "etag1"
+	entry := &readCacheEntry{
+		size:    100,
+		modTime: modTime,
+		etag:    "etag1",
+	}
+	assert.True(t, entry.isValidFor(info))
+	// the content changed but the client restored the modification time
+	info.etag = "etag2"
+	assert.False(t, entry.isValidFor(info))
+	// the modification time changed but the content is the same
+	info.etag = "etag1"
+	info.modTime = time.Now()
+	assert.True(t, entry.isValidFor(info))
+	info.sizeInBytes = 101
+	assert.False(t, entry.isValidFor(info))
+	// without an entity tag the size and the modification time are compared
+	info = NewFileInfo("file", false, 100, modTime, false)
+	entry.etag = ""
+	assert.True(t, entry.isValidFor(info))
+	info.modTime = time.Now()
+	assert.False(t, entry.isValidFor(info))
+	info.modTime = modTime
+	info.etag = "etag"
+	assert.False(t, entry.isValidFor(info))
+}
@@ -0,0 +1,68 @@
+package vfs
+
+import (
+	"strings"
+)
+
+// prefix for the metadata keys used to store the checksums of the uploaded
+// files on the object storage backends, for example "checksum_sha256".
+// Azure Blob storage requires metadata names that are valid C# identifiers,
+// so we cannot use dashes
+const metadataKeyChecksumPrefix = "checksum_"
+
+// checksumStore is implemented by the filesystems that can store the checksums
+// computed while uploading a file, so they can be returned later without
+// reading the file contents again
+type checksumStore interface {
+	SetChecksums(name string, size int64, checksums map[string]string) error
+	GetChecksum(name, algo string) (string, int64, bool)
+}
+
+// IsChecksumStoreSupported returns true if fs can store the checksums of the
+// uploaded files
+func IsChecksumStoreSupported(fs Fs) bool {
+	_, ok := fs.(checksumStore)
+	return ok
+}
+
+// SetChecksums stores the given checksums, the keys are the lowercase algorithm
+// names and the values the hex encoded digests, for the named file.
+// size is the file size the checksums refer to
+func SetChecksums(fs Fs, name string, size int64, checksums map[string]string) error {
+	if s, ok := fs.(checksumStore); ok {
+		return s.SetChecksums(name, size, checksums)
+	}
+	return ErrVfsUnsupported
+}
+
+// GetStoredChecksum returns the stored checksum for the named file and the given
+// algorithm and the size of the hashed contents. The last return value is false
+// if no checksum is stored or if the file was modified after storing it
+func GetStoredChecksum(fs Fs, name, algo string) (string, int64, bool) {
+	if s, ok := fs.(checksumStore); ok {
+		return s.GetChecksum(name, strings.ToLower(algo))
+	}
+	return "", 0, false
+}
+
+func getChecksumMetadataKey(algo string) string {
+	return metadataKeyChecksumPrefix + algo
+}
+
+func withChecksums(checksums map[string]string) metadataUpdate {
+	return func(metadata map[string]string) {
+		for algo, value := range checksums {
+			setMetadataValue(metadata, getChecksumMetadataKey(algo), value)
+		}
+	}
+}
+
+// getChecksumFromMetadata returns the checksum for the given algorithm stored
+// inside the object metadata, if any
+func getChecksumFromMetadata(metadata map[string]string, algo string) (string, bool) {
+	val, ok := getMetadataValue(metadata, getChecksumMetadataKey(algo))
+	if !ok || val == "" {
+		return "", false
+	}
+	return strings.ToLower(val), true
+}
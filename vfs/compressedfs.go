@@ -0,0 +1,608 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// compressedFsName is the name prefix for the Fs implementation that
+	// compresses the files stored on a wrapped filesystem
+	compressedFsName = "compressedfs"
+	// CompressionAlgoGzip defines the gzip compression algorithm
+	CompressionAlgoGzip = "gzip"
+	// each frame is an independent gzip member that includes this number of
+	// uncompressed bytes, so a read can start from the frame including the
+	// requested offset
+	compressionFrameSize int64 = 1048576
+	// maximum number of index entries stored inside a single index member
+	compressionIndexEntries = 16000
+	compressionVersion1     = 1
+	// 10 bytes gzip header + 2 bytes extra length + 4 bytes subfield header +
+	// 29 bytes payload + 2 bytes empty deflate block + 8 bytes gzip footer
+	compressionTrailerSize       int64 = 55
+	compressionTrailerPayloadLen       = 29
+)
+
+// supported quota modes for CompressionFsConfig
+const (
+	// the quota is based on the uncompressed sizes
+	CompressionQuotaLogical = iota
+	// the quota is based on the stored, compressed, sizes
+	CompressionQuotaPhysical
+)
+
+var (
+	errNotCompressed = errors.New("not a compressed file")
+	// gzip extra subfield identifiers for the index and the trailer members
+	compressionIndexID   = [2]byte{'S', 'I'}
+	compressionTrailerID = [2]byte{'S', 'T'}
+	// final fixed Huffman block with no data followed by the CRC-32 and the
+	// size of the empty contents
+	emptyMemberFooter = []byte{3, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+)
+
+// CompressionFsConfig defines the transparent compression settings for a user
+type CompressionFsConfig struct {
+	// compression algorithm, empty means disabled. Only gzip is supported for now
+	Algorithm string `json:"algorithm,omitempty"`
+	// compression level from 1 (best speed) to 9 (best compression), 0 means
+	// the default level
+	Level int `json:"level,omitempty"`
+	// the new files are compressed only if they are uploaded inside these
+	// virtual directories. Empty means the whole home directory
+	Paths []string `json:"paths,omitempty"`
+	// 0 means the quota is based on the uncompressed sizes,
+	// 1 on the stored sizes
+	QuotaMode int `json:"quota_mode,omitempty"`
+}
+
+// IsEnabled returns true if the compression is enabled
+func (c *CompressionFsConfig) IsEnabled() bool {
+	return c.Algorithm != ""
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *CompressionFsConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.Algorithm != CompressionAlgoGzip {
+		return fmt.Errorf("unsupported compression algorithm %#v", c.Algorithm)
+	}
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level: %v", c.Level)
+	}
+	if c.QuotaMode < CompressionQuotaLogical || c.QuotaMode > CompressionQuotaPhysical {
+		return fmt.Errorf("invalid compression quota mode: %v", c.QuotaMode)
+	}
+	paths, err := cleanVirtualPaths(c.Paths, "compression")
+	if err != nil {
+		return err
+	}
+	c.Paths = paths
+	return nil
+}
+
+// compressedFileInfo is the FileInfo for a compressed file, the embedded
+// FileInfo reports the stored size
+type compressedFileInfo struct {
+	os.FileInfo
+	size      int64
+	quotaSize int64
+}
+
+// Size returns the uncompressed size
+func (fi *compressedFileInfo) Size() int64 {
+	return fi.size
+}
+
+// QuotaSize returns the size to use to track the quota usage
+func (fi *compressedFileInfo) QuotaSize() int64 {
+	return fi.quotaSize
+}
+
+// compressionTrailer describes a compressed file, it is stored at the end of
+// the file
+type compressionTrailer struct {
+	frameSize   int64
+	size        int64
+	numFrames   int64
+	indexOffset int64
+}
+
+// CompressedFs is a Fs implementation that transparently compresses the files
+// stored on the wrapped filesystem. The files are stored as a sequence of gzip
+// members, one for each frame, followed by an index of the frames and a trailer,
+// so they can be decompressed using any gzip implementation and a read can start
+// from the frame that includes the requested offset.
+// The sizes reported by Stat, ReadDir and Walk are uncompressed sizes, files
+// not stored in the compressed format are read as they are
+type CompressedFs struct {
+	Fs
+	// local directory used for the pipes
+	localTempDir string
+	config       CompressionFsConfig
+}
+
+// NewCompressedFs returns a Fs that compresses the files stored on the given filesystem
+func NewCompressedFs(fs Fs, localTempDir string, config CompressionFsConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Level == 0 {
+		config.Level = gzip.DefaultCompression
+	}
+	return &CompressedFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		config:       config,
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *CompressedFs) Name() string {
+	return fmt.Sprintf("%v %v", compressedFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped filesystem
+func (fs *CompressedFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *CompressedFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.convertFileInfo(name, info), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *CompressedFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.convertFileInfo(name, info), nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *CompressedFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.Fs.ReadDir(dirname)
+	for idx, info := range list {
+		list[idx] = fs.convertFileInfo(fs.Fs.Join(dirname, info.Name()), info)
+	}
+	return list, err
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (fs *CompressedFs) OpenDir(dirname string) (DirLister, error) {
+	lister, err := fs.Fs.OpenDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newTransformDirLister(lister, func(list []os.FileInfo) []os.FileInfo {
+		for idx, info := range list {
+			list[idx] = fs.convertFileInfo(fs.Fs.Join(dirname, info.Name()), info)
+		}
+		return list
+	}), nil
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *CompressedFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.Fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if info != nil {
+			info = fs.convertFileInfo(walkedPath, info)
+		}
+		return walkFn(walkedPath, info, err)
+	})
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders. The size is based on the configured quota mode
+func (fs *CompressedFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	err := fs.Walk(dirname, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Mode().IsRegular() {
+			numFiles++
+			size += GetQuotaSize(info)
+		}
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size based on the configured quota mode
+func (fs *CompressedFs) ScanRootDirContents() (int, int64, error) {
+	rootPath, err := fs.Fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	return fs.GetDirSize(rootPath)
+}
+
+// Open opens the named file for reading. Only the frames that include the
+// requested offset and the following ones are read
+func (fs *CompressedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	trailer, err := fs.readTrailer(name, info)
+	if err == errNotCompressed {
+		return fs.Fs.Open(name, offset)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if offset >= trailer.size {
+		go func() {
+			w.CloseWithError(nil) //nolint:errcheck
+			fsLog(fs, logger.LevelDebug, "zero bytes download completed, path: %#v", name)
+		}()
+		return nil, r, nil, nil
+	}
+	frame := offset / trailer.frameSize
+	var frameOffset int64
+	if frame > 0 {
+		frameSizes, err := fs.readIndex(name, info.Size(), trailer)
+		if err != nil {
+			r.Close()
+			w.Close()
+			return nil, nil, nil, err
+		}
+		for _, frameSize := range frameSizes[:frame] {
+			frameOffset += frameSize
+		}
+	}
+	src, cancelFn, err := openInner(fs.Fs, name, frameOffset)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		defer src.Close()
+
+		var n int64
+		toSkip := offset - frame*trailer.frameSize
+		// the index and the trailer members have no contents
+		gzReader, err := gzip.NewReader(bufio.NewReader(src))
+		if err == nil {
+			_, err = io.CopyN(ioutil.Discard, gzReader, toSkip)
+		}
+		if err == nil {
+			n, err = io.Copy(w, gzReader)
+		}
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v offset: %v size: %v, err: %v", name, offset, n, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// Files outside the configured paths are stored uncompressed
+func (fs *CompressedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		fsLog(fs, logger.LevelDebug, "unable to resume %#v, resume is not supported for compressed files", name)
+		return nil, nil, nil, ErrVfsUnsupported
+	}
+	if !fs.isCompressionEnabledFor(name) {
+		return fs.Fs.Create(name, flag)
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	file, writer, cancelFn, err := fs.Fs.Create(name, flag)
+	if err == nil && file == nil && writer == nil {
+		err = fmt.Errorf("unable to create %#v", name)
+	}
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+
+	go func() {
+		var dst io.WriteCloser = writer
+		if file != nil {
+			dst = file
+		}
+		counter := &countingWriter{w: dst}
+		n, err := fs.compress(counter, r)
+		if err != nil && cancelFn != nil {
+			cancelFn()
+		}
+		errClose := dst.Close()
+		if err == nil {
+			err = errClose
+		}
+		if err != nil && file != nil {
+			// a file without the trailer would be read as uncompressed, remove it
+			if errRemove := fs.Fs.Remove(name, false); errRemove != nil {
+				fsLog(fs, logger.LevelWarn, "unable to remove the partial compressed file %#v: %v", name, errRemove)
+			}
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, compressed size: %v, err: %v",
+			name, n, counter.n, err)
+	}()
+
+	return nil, p, cancelFn, nil
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported for compressed files
+func (*CompressedFs) Truncate(name string, size int64) error {
+	return ErrVfsUnsupported
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported
+func (*CompressedFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported
+func (*CompressedFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// GetMimeType returns the content type detecting it from the uncompressed contents
+func (fs *CompressedFs) GetMimeType(name string) (string, error) {
+	file, r, cancelFn, err := fs.Open(name, 0)
+	if err != nil {
+		return "", err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	if file != nil {
+		// uncompressed file on a filesystem that returns a File
+		file.Close()
+		return fs.Fs.GetMimeType(name)
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, r, 512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf.Bytes()), nil
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *CompressedFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(fs.Fs, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func (fs *CompressedFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(fs.Fs, name)
+}
+
+func (fs *CompressedFs) isCompressionEnabledFor(name string) bool {
+	return isVirtualPathIncluded(fs.Fs.GetRelativePath(name), fs.config.Paths)
+}
+
+// convertFileInfo returns a FileInfo with the uncompressed size if name is
+// a compressed file
+func (fs *CompressedFs) convertFileInfo(name string, info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	trailer, err := fs.readTrailer(name, info)
+	if err != nil {
+		if err != errNotCompressed {
+			fsLog(fs, logger.LevelWarn, "unable to read the compression trailer for %#v: %v", name, err)
+		}
+		return info
+	}
+	quotaSize := trailer.size
+	if fs.config.QuotaMode == CompressionQuotaPhysical {
+		quotaSize = info.Size()
+	}
+	return &compressedFileInfo{
+		FileInfo:  info,
+		size:      trailer.size,
+		quotaSize: quotaSize,
+	}
+}
+
+// compress writes the data read from src to dst using the compressed format
+// and returns the number of uncompressed bytes
+func (fs *CompressedFs) compress(dst *countingWriter, src io.Reader) (int64, error) {
+	gzWriter, err := gzip.NewWriterLevel(dst, fs.config.Level)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, compressionFrameSize)
+	var frameSizes []int64
+	var size int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			start := dst.n
+			gzWriter.Reset(dst)
+			if _, err := gzWriter.Write(buf[:n]); err != nil {
+				return size, err
+			}
+			if err := gzWriter.Close(); err != nil {
+				return size, err
+			}
+			frameSizes = append(frameSizes, dst.n-start)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+	trailer := compressionTrailer{
+		frameSize:   compressionFrameSize,
+		size:        size,
+		numFrames:   int64(len(frameSizes)),
+		indexOffset: dst.n,
+	}
+	for len(frameSizes) > 0 {
+		entries := frameSizes
+		if len(entries) > compressionIndexEntries {
+			entries = entries[:compressionIndexEntries]
+		}
+		frameSizes = frameSizes[len(entries):]
+		payload := make([]byte, 4*len(entries))
+		for idx, frameSize := range entries {
+			binary.BigEndian.PutUint32(payload[4*idx:], uint32(frameSize))
+		}
+		if err := writeMetadataMember(dst, compressionIndexID, payload); err != nil {
+			return size, err
+		}
+	}
+	payload := make([]byte, compressionTrailerPayloadLen)
+	payload[0] = compressionVersion1
+	binary.BigEndian.PutUint32(payload[1:], uint32(trailer.frameSize))
+	binary.BigEndian.PutUint64(payload[5:], uint64(trailer.size))
+	binary.BigEndian.PutUint64(payload[13:], uint64(trailer.numFrames))
+	binary.BigEndian.PutUint64(payload[21:], uint64(trailer.indexOffset))
+	return size, writeMetadataMember(dst, compressionTrailerID, payload)
+}
+
+// readTrailer reads the trailer stored at the end of a compressed file.
+// errNotCompressed is returned if the file is not compressed
+func (fs *CompressedFs) readTrailer(name string, info os.FileInfo) (compressionTrailer, error) {
+	var trailer compressionTrailer
+	if info.Size() < compressionTrailerSize {
+		return trailer, errNotCompressed
+	}
+	src, cancelFn, err := openInner(fs.Fs, name, info.Size()-compressionTrailerSize)
+	if err != nil {
+		return trailer, err
+	}
+	defer closeInner(src, cancelFn)
+
+	buf := make([]byte, compressionTrailerSize)
+	if _, err = io.ReadFull(src, buf); err != nil {
+		return trailer, err
+	}
+	payload, _, err := parseMetadataMember(buf, compressionTrailerID)
+	if err != nil || len(payload) != compressionTrailerPayloadLen || payload[0] != compressionVersion1 {
+		return trailer, errNotCompressed
+	}
+	trailer.frameSize = int64(binary.BigEndian.Uint32(payload[1:]))
+	trailer.size = int64(binary.BigEndian.Uint64(payload[5:]))
+	trailer.numFrames = int64(binary.BigEndian.Uint64(payload[13:]))
+	trailer.indexOffset = int64(binary.BigEndian.Uint64(payload[21:]))
+	if trailer.frameSize <= 0 || trailer.size < 0 || trailer.indexOffset < 0 ||
+		trailer.indexOffset > info.Size()-compressionTrailerSize {
+		return trailer, errNotCompressed
+	}
+	return trailer, nil
+}
+
+// readIndex returns the compressed size of each frame
+func (fs *CompressedFs) readIndex(name string, size int64, trailer compressionTrailer) ([]int64, error) {
+	src, cancelFn, err := openInner(fs.Fs, name, trailer.indexOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInner(src, cancelFn)
+
+	buf := make([]byte, size-compressionTrailerSize-trailer.indexOffset)
+	if _, err = io.ReadFull(src, buf); err != nil {
+		return nil, err
+	}
+	frameSizes := make([]int64, 0, trailer.numFrames)
+	for len(buf) > 0 {
+		var payload []byte
+		payload, buf, err = parseMetadataMember(buf, compressionIndexID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression index for %#v: %w", name, err)
+		}
+		for idx := 0; idx+4 <= len(payload); idx += 4 {
+			frameSizes = append(frameSizes, int64(binary.BigEndian.Uint32(payload[idx:])))
+		}
+	}
+	if int64(len(frameSizes)) != trailer.numFrames {
+		return nil, fmt.Errorf("invalid compression index for %#v, frames: %v expected: %v", name,
+			len(frameSizes), trailer.numFrames)
+	}
+	return frameSizes, nil
+}
+
+// writeMetadataMember writes a gzip member with no contents that stores the
+// given payload inside an extra field
+func writeMetadataMember(w io.Writer, id [2]byte, payload []byte) error {
+	buf := make([]byte, 0, 26+len(payload))
+	// magic, deflate method, FEXTRA flag, zero modification time and extra flags, unknown OS
+	buf = append(buf, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255)
+	buf = append(buf, byte(len(payload)+4), byte((len(payload)+4)>>8))
+	buf = append(buf, id[0], id[1], byte(len(payload)), byte(len(payload)>>8))
+	buf = append(buf, payload...)
+	buf = append(buf, emptyMemberFooter...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// parseMetadataMember parses a gzip member written using writeMetadataMember
+// and returns its payload and the remaining data
+func parseMetadataMember(data []byte, id [2]byte) ([]byte, []byte, error) {
+	if len(data) < 16 || data[0] != 0x1f || data[1] != 0x8b || data[2] != 8 || data[3] != 4 {
+		return nil, nil, errNotCompressed
+	}
+	extraLen := int(binary.LittleEndian.Uint16(data[10:]))
+	payloadLen := int(binary.LittleEndian.Uint16(data[14:]))
+	if data[12] != id[0] || data[13] != id[1] || extraLen != payloadLen+4 || len(data) < 26+payloadLen {
+		return nil, nil, errNotCompressed
+	}
+	if !bytes.Equal(data[16+payloadLen:26+payloadLen], emptyMemberFooter) {
+		return nil, nil, errNotCompressed
+	}
+	return data[16 : 16+payloadLen], data[26+payloadLen:], nil
+}
+
+// countingWriter counts the bytes written to the wrapped writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
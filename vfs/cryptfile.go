@@ -0,0 +1,633 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/minio/sio"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// modified packages are kept in memory until more than this number of
+	// packages are modified, so the consecutive writes to the same package,
+	// for example the concurrent writes sent by SFTP clients, encrypt it once
+	cryptedFileMaxPendingPackages = 64
+	sioHeaderSize                 = 16
+	sioTagSize                    = 16
+	// the final flag is the most significant bit of the package nonce
+	sioFinalFlag byte = 0x80
+)
+
+var (
+	errCryptedFileClosed      = errors.New("file already closed")
+	errInvalidEncryptedPkg    = errors.New("invalid encrypted package")
+	errUnexpectedEncryptedPkg = errors.New("unexpected data after the final encrypted package")
+)
+
+// cryptedFile is a File implementation for encrypted local files that allows
+// random access reads and writes, truncation and append.
+//
+// The files use the DARE 2.0 package format, but an encrypted package cannot be
+// modified reusing its nonce: each modified package is encrypted again, in
+// place, using a new random nonce. The files written this way are marked using
+// the version11 header: their packages have different nonces, so they must be
+// decrypted using decryptPackages instead of sio. The packages are modified in
+// memory and written when too many packages are pending or on Close, so only
+// the modified packages are encrypted again
+type cryptedFile struct {
+	sync.Mutex
+	name     string
+	file     *os.File
+	header   encryptedFileHeader
+	ciphers  encryptedPackageCiphers
+	isAppend bool
+	// number of packages stored inside the file, they are all full packages
+	// except the last one if diskFinal is true
+	diskPackages int64
+	diskFinal    bool
+	// modified packages not yet written
+	pending map[int64][]byte
+	// last decrypted package, to avoid to decrypt it again for small reads
+	lastReadIdx  int64
+	lastReadData []byte
+	size         int64
+	offset       int64
+	closed       bool
+}
+
+func newCryptedFile(name string, flag int, masterKey []byte) (*cryptedFile, error) {
+	// the original flags are used to create or truncate the file as requested,
+	// the file is then opened for random access reads and writes
+	f, err := os.OpenFile(name, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	f, err = os.OpenFile(name, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	file := &cryptedFile{
+		name:        name,
+		file:        f,
+		isAppend:    flag&os.O_APPEND != 0,
+		pending:     make(map[int64][]byte),
+		lastReadIdx: -1,
+	}
+	if err = file.load(masterKey); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if file.isAppend {
+		file.offset = file.size
+	}
+	return file, nil
+}
+
+func (f *cryptedFile) load(masterKey []byte) error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	var key [32]byte
+	if info.Size() == 0 {
+		// a new or truncated file
+		f.header, key, err = newEncryptedFileHeader(masterKey)
+		if err != nil {
+			return err
+		}
+		f.header.version = version11
+		if err = f.header.Store(f.file); err != nil {
+			return err
+		}
+	} else {
+		if err = f.header.Load(f.file); err != nil {
+			return err
+		}
+		key, err = f.header.getKey(masterKey)
+		if err != nil {
+			return err
+		}
+	}
+	f.ciphers, err = newEncryptedPackageCiphers(key)
+	if err != nil {
+		return err
+	}
+	f.size = getDecryptedSize(info.Size())
+	f.diskPackages = getNumPackages(f.size)
+	f.diskFinal = f.diskPackages > 0
+	return nil
+}
+
+// Name returns the name of the file
+func (f *cryptedFile) Name() string {
+	return f.name
+}
+
+// Stat returns a FileInfo with the current plaintext size
+func (f *cryptedFile) Stat() (os.FileInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return info, err
+	}
+	return NewFileInfo(info.Name(), false, f.size, info.ModTime(), false), nil
+}
+
+// Read reads up to len(p) bytes from the current offset
+func (f *cryptedFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at byte offset off
+func (f *cryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.readAt(p, off)
+}
+
+// Write writes len(p) bytes at the current offset or at the end of the file
+// if it was opened in append mode
+func (f *cryptedFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.isAppend {
+		f.offset = f.size
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes starting at byte offset off
+func (f *cryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+// Seek sets the offset for the next Read or Write
+func (f *cryptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return 0, errCryptedFileClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid seek offset: %v", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the plaintext size of the file. If the file shrinks, the
+// packages after the new size are removed and the new last package is
+// encrypted again when the file is closed
+func (f *cryptedFile) Truncate(size int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return errCryptedFileClosed
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid truncate size: %v", size)
+	}
+	if size >= f.size {
+		// the new packages are written as zeros
+		f.size = size
+		return nil
+	}
+	lastIdx := int64(-1)
+	if size > 0 {
+		lastIdx = (size - 1) / sioPayloadSize
+		data, err := f.getPackage(lastIdx)
+		if err != nil {
+			return err
+		}
+		f.pending[lastIdx] = append(make([]byte, 0, sioPayloadSize), data[:size-lastIdx*sioPayloadSize]...)
+	}
+	for idx := range f.pending {
+		if idx > lastIdx {
+			delete(f.pending, idx)
+		}
+	}
+	f.lastReadIdx = -1
+	f.lastReadData = nil
+	f.size = size
+	// the packages before the new last one are full packages, the others are
+	// removed so the stale data is never read again if the file grows
+	if f.diskPackages > lastIdx && lastIdx >= 0 {
+		f.diskPackages = lastIdx
+		f.diskFinal = false
+	} else if lastIdx < 0 {
+		f.diskPackages = 0
+		f.diskFinal = false
+	}
+	return f.file.Truncate(headerV10Size + f.diskPackages*encryptedPackageSize)
+}
+
+// Close writes the modified packages and closes the file
+func (f *cryptedFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return errCryptedFileClosed
+	}
+	f.closed = true
+	err := f.finalize()
+	if errClose := f.file.Close(); err == nil {
+		err = errClose
+	}
+	f.pending = nil
+	f.lastReadData = nil
+	return err
+}
+
+// finalize writes the pending packages, the packages between the last stored
+// one and the new end of the file and the final package
+func (f *cryptedFile) finalize() error {
+	numPackages := getNumPackages(f.size)
+	if numPackages == 0 {
+		return f.file.Truncate(headerV10Size)
+	}
+	if err := f.writePendingPackages(0); err != nil {
+		return err
+	}
+	lastIdx := numPackages - 1
+	if err := f.fillPackages(lastIdx); err != nil {
+		return err
+	}
+	_, isPending := f.pending[lastIdx]
+	if isPending || f.diskPackages != numPackages || !f.diskFinal ||
+		f.getStoredSize() != f.size {
+		data, err := f.getPackage(lastIdx)
+		if err != nil {
+			return err
+		}
+		if err = f.writePackage(lastIdx, data, true); err != nil {
+			return err
+		}
+		delete(f.pending, lastIdx)
+		f.diskPackages = numPackages
+		f.diskFinal = true
+	}
+	return f.file.Truncate(GetEncryptedSize(f.size))
+}
+
+// getStoredSize returns the plaintext size for the packages stored inside the file
+func (f *cryptedFile) getStoredSize() int64 {
+	info, err := f.file.Stat()
+	if err != nil {
+		return -1
+	}
+	return getDecryptedSize(info.Size())
+}
+
+func (f *cryptedFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errCryptedFileClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("invalid read offset: %v", off)
+	}
+	n := 0
+	for n < len(p) && off < f.size {
+		idx := off / sioPayloadSize
+		data, err := f.getPackage(idx)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], data[off-idx*sioPayloadSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *cryptedFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errCryptedFileClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("invalid write offset: %v", off)
+	}
+	n := 0
+	for n < len(p) {
+		idx := off / sioPayloadSize
+		pkgOffset := off - idx*sioPayloadSize
+		data, ok := f.pending[idx]
+		if !ok {
+			var err error
+			data, err = f.getPackage(idx)
+			if err != nil {
+				return n, err
+			}
+			data = append(make([]byte, 0, sioPayloadSize), data...)
+		}
+		toWrite := len(p) - n
+		if int64(toWrite) > sioPayloadSize-pkgOffset {
+			toWrite = int(sioPayloadSize - pkgOffset)
+		}
+		if end := int(pkgOffset) + toWrite; end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[pkgOffset:], p[n:n+toWrite])
+		f.pending[idx] = data
+		if idx == f.lastReadIdx {
+			f.lastReadIdx = -1
+			f.lastReadData = nil
+		}
+		n += toWrite
+		off += int64(toWrite)
+		if off > f.size {
+			f.size = off
+		}
+	}
+	if len(f.pending) > cryptedFileMaxPendingPackages {
+		return n, f.writePendingPackages(cryptedFileMaxPendingPackages / 2)
+	}
+	return n, nil
+}
+
+// writePendingPackages writes the pending full packages, the lowest indexes
+// first, until no more than maxPending packages are pending. The last package
+// is written on Close only
+func (f *cryptedFile) writePendingPackages(maxPending int) error {
+	lastIdx := getNumPackages(f.size) - 1
+	indexes := make([]int64, 0, len(f.pending))
+	for idx := range f.pending {
+		if idx < lastIdx {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	for _, idx := range indexes {
+		if len(f.pending) <= maxPending {
+			break
+		}
+		if err := f.fillPackages(idx); err != nil {
+			return err
+		}
+		data, err := f.getPackage(idx)
+		if err != nil {
+			return err
+		}
+		if err = f.writePackage(idx, data, false); err != nil {
+			return err
+		}
+		delete(f.pending, idx)
+		if idx >= f.diskPackages {
+			f.diskPackages = idx + 1
+		}
+		if idx == f.diskPackages-1 {
+			f.diskFinal = false
+		}
+	}
+	return nil
+}
+
+// fillPackages writes the packages before idx that are not stored inside the
+// file as full packages. The last stored package, if it is the final one, is
+// written again as a full package
+func (f *cryptedFile) fillPackages(idx int64) error {
+	if idx < f.diskPackages {
+		return nil
+	}
+	start := f.diskPackages
+	if f.diskFinal {
+		start--
+	}
+	for current := start; current < idx; current++ {
+		data, err := f.getPackage(current)
+		if err != nil {
+			return err
+		}
+		if err = f.writePackage(current, data, false); err != nil {
+			return err
+		}
+		delete(f.pending, current)
+		f.diskPackages = current + 1
+		f.diskFinal = false
+	}
+	return nil
+}
+
+// writePackage encrypts the given plaintext using a new random nonce and
+// writes it, in place, as the package with the given index
+func (f *cryptedFile) writePackage(idx int64, data []byte, final bool) error {
+	if f.header.version != version11 {
+		// the packages will have different nonces, sio cannot decrypt the file anymore
+		f.header.version = version11
+		if _, err := f.file.WriteAt([]byte{version11}, 0); err != nil {
+			return err
+		}
+	}
+	pkg, err := sealEncryptedPackage(f.ciphers, uint32(idx), data, final)
+	if err != nil {
+		return err
+	}
+	if _, err = f.file.WriteAt(pkg, headerV10Size+idx*encryptedPackageSize); err != nil {
+		return err
+	}
+	if idx == f.lastReadIdx {
+		f.lastReadIdx = -1
+		f.lastReadData = nil
+	}
+	return nil
+}
+
+// getPackage returns the plaintext for the package with the given index.
+// The returned slice must not be modified
+func (f *cryptedFile) getPackage(idx int64) ([]byte, error) {
+	start := idx * sioPayloadSize
+	size := f.size - start
+	if size > sioPayloadSize {
+		size = sioPayloadSize
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+	if data, ok := f.pending[idx]; ok {
+		return fillPackage(data, size), nil
+	}
+	if idx >= f.diskPackages {
+		return make([]byte, size), nil
+	}
+	if idx == f.lastReadIdx {
+		return fillPackage(f.lastReadData, size), nil
+	}
+	buf := make([]byte, encryptedPackageSize)
+	n, err := f.file.ReadAt(buf, headerV10Size+idx*encryptedPackageSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data, _, err := openEncryptedPackage(f.ciphers, uint32(idx), buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	f.lastReadIdx = idx
+	f.lastReadData = data
+	return fillPackage(data, size), nil
+}
+
+// fillPackage returns data with the given size, zeros are added if needed
+func fillPackage(data []byte, size int64) []byte {
+	if int64(len(data)) >= size {
+		return data[:size]
+	}
+	result := make([]byte, size)
+	copy(result, data)
+	return result
+}
+
+func getNumPackages(size int64) int64 {
+	return (size + sioPayloadSize - 1) / sioPayloadSize
+}
+
+// encryptedPackageCiphers are the AEAD ciphers, indexed by cipher suite, used
+// to encrypt and decrypt the packages of a file
+type encryptedPackageCiphers [2]cipher.AEAD
+
+func newEncryptedPackageCiphers(key [32]byte) (encryptedPackageCiphers, error) {
+	var ciphers encryptedPackageCiphers
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return ciphers, err
+	}
+	ciphers[sio.AES_256_GCM], err = cipher.NewGCM(block)
+	if err != nil {
+		return ciphers, err
+	}
+	ciphers[sio.CHACHA20_POLY1305], err = chacha20poly1305.New(key[:])
+	return ciphers, err
+}
+
+// getEncryptedPackageNonce returns the nonce for the package with the given
+// sequence number and header nonce, as defined by DARE 2.0
+func getEncryptedPackageNonce(headerNonce []byte, seqNum uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, headerNonce)
+	binary.LittleEndian.PutUint32(nonce[8:], binary.LittleEndian.Uint32(nonce[8:])^seqNum)
+	return nonce
+}
+
+// sealEncryptedPackage encrypts the given plaintext as a DARE 2.0 package
+// with the given sequence number using a new random nonce
+func sealEncryptedPackage(ciphers encryptedPackageCiphers, seqNum uint32, data []byte, final bool) ([]byte, error) {
+	if len(data) == 0 || int64(len(data)) > sioPayloadSize || (!final && int64(len(data)) != sioPayloadSize) {
+		return nil, errInvalidEncryptedPkg
+	}
+	pkg := make([]byte, sioHeaderSize, sioHeaderSize+len(data)+sioTagSize)
+	pkg[0] = sio.Version20
+	pkg[1] = sio.AES_256_GCM
+	binary.LittleEndian.PutUint16(pkg[2:4], uint16(len(data)-1))
+	if _, err := io.ReadFull(rand.Reader, pkg[4:sioHeaderSize]); err != nil {
+		return nil, err
+	}
+	if final {
+		pkg[4] |= sioFinalFlag
+	} else {
+		pkg[4] &^= sioFinalFlag
+	}
+	nonce := getEncryptedPackageNonce(pkg[4:sioHeaderSize], seqNum)
+	return ciphers[sio.AES_256_GCM].Seal(pkg, nonce, data, pkg[:4]), nil
+}
+
+// openEncryptedPackage decrypts and authenticates the DARE 2.0 package at the
+// start of pkg with the given sequence number. It returns the plaintext and
+// true if it is the final package
+func openEncryptedPackage(ciphers encryptedPackageCiphers, seqNum uint32, pkg []byte) ([]byte, bool, error) {
+	if len(pkg) <= sioHeaderSize+sioTagSize || pkg[0] != sio.Version20 || pkg[1] > sio.CHACHA20_POLY1305 {
+		return nil, false, errInvalidEncryptedPkg
+	}
+	length := int(binary.LittleEndian.Uint16(pkg[2:4])) + 1
+	final := pkg[4]&sioFinalFlag != 0
+	if len(pkg) < sioHeaderSize+length+sioTagSize || (!final && int64(length) != sioPayloadSize) {
+		return nil, false, errInvalidEncryptedPkg
+	}
+	nonce := getEncryptedPackageNonce(pkg[4:sioHeaderSize], seqNum)
+	data, err := ciphers[pkg[1]].Open(nil, nonce, pkg[sioHeaderSize:sioHeaderSize+length+sioTagSize], pkg[:4])
+	if err != nil {
+		return nil, false, err
+	}
+	return data, final, nil
+}
+
+// decryptPackages decrypts the packages read from src, starting from the
+// given sequence number, and writes the plaintext to dst. Unlike sio, the
+// packages can have different nonces
+func decryptPackages(dst io.Writer, src io.Reader, key [32]byte, seqNum uint32) (int64, error) {
+	ciphers, err := newEncryptedPackageCiphers(key)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	buf := make([]byte, encryptedPackageSize)
+	for {
+		if _, err := io.ReadFull(src, buf[:sioHeaderSize]); err != nil {
+			if err == io.EOF && written == 0 {
+				// empty file
+				return 0, nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+		length := int(binary.LittleEndian.Uint16(buf[2:4])) + 1
+		pkgSize := sioHeaderSize + length + sioTagSize
+		if _, err := io.ReadFull(src, buf[sioHeaderSize:pkgSize]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+		data, final, err := openEncryptedPackage(ciphers, seqNum, buf[:pkgSize])
+		if err != nil {
+			return written, err
+		}
+		n, err := dst.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		seqNum++
+		if final {
+			if n, _ := src.Read(buf[:1]); n > 0 {
+				return written, errUnexpectedEncryptedPkg
+			}
+			return written, nil
+		}
+	}
+}
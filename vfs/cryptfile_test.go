@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/kms"
+)
+
+func TestCryptedFileRandomAccess(t *testing.T) {
+	fs, name := getCryptedFileTestFs(t)
+	expected := make([]byte, 3*sioPayloadSize+100)
+	_, err := rand.Read(expected)
+	require.NoError(t, err)
+	f, err := newCryptedFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.masterKey)
+	require.NoError(t, err)
+	_, err = f.Write(expected)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assertCryptedFileContents(t, fs, name, expected)
+	original, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	// modify the second package only
+	f, err = newCryptedFile(name, os.O_RDWR, fs.masterKey)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("modified"), sioPayloadSize+10)
+	require.NoError(t, err)
+	copy(expected[sioPayloadSize+10:], "modified")
+	buf := make([]byte, 8)
+	_, err = f.ReadAt(buf, sioPayloadSize+10)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("modified"), buf)
+	require.NoError(t, f.Close())
+	assertCryptedFileContents(t, fs, name, expected)
+	modified, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, len(original), len(modified))
+	assert.Equal(t, version11, modified[0])
+	for idx := int64(0); idx < 4; idx++ {
+		start := headerV10Size + idx*encryptedPackageSize
+		end := start + encryptedPackageSize
+		if end > int64(len(original)) {
+			end = int64(len(original))
+		}
+		if idx == 1 {
+			assert.NotEqual(t, original[start:end], modified[start:end])
+			// a new nonce is used for the modified package
+			assert.NotEqual(t, original[start+4:start+16], modified[start+4:start+16])
+		} else {
+			assert.Equal(t, original[start:end], modified[start:end], "package %v", idx)
+		}
+	}
+	// write beyond the end, the gap is filled with zeros
+	f, err = newCryptedFile(name, os.O_RDWR, fs.masterKey)
+	require.NoError(t, err)
+	offset := int64(5*sioPayloadSize + 7)
+	_, err = f.WriteAt([]byte("end"), offset)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	expected = append(expected, make([]byte, offset+3-int64(len(expected)))...)
+	copy(expected[offset:], "end")
+	assertCryptedFileContents(t, fs, name, expected)
+	// append
+	f, err = newCryptedFile(name, os.O_WRONLY|os.O_APPEND, fs.masterKey)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("appended"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	expected = append(expected, []byte("appended")...)
+	assertCryptedFileContents(t, fs, name, expected)
+}
+
+func TestCryptedFileTruncate(t *testing.T) {
+	fs, name := getCryptedFileTestFs(t)
+	expected := make([]byte, 2*sioPayloadSize+10)
+	_, err := rand.Read(expected)
+	require.NoError(t, err)
+	f, err := newCryptedFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.masterKey)
+	require.NoError(t, err)
+	_, err = f.Write(expected)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = fs.Truncate(name, sioPayloadSize+5)
+	require.NoError(t, err)
+	expected = expected[:sioPayloadSize+5]
+	assertCryptedFileContents(t, fs, name, expected)
+	// shrink and grow again, the removed data must not be visible
+	f, err = newCryptedFile(name, os.O_RDWR, fs.masterKey)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(10))
+	require.NoError(t, f.Truncate(sioPayloadSize+100))
+	_, err = f.WriteAt([]byte("data"), sioPayloadSize+50)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	expected = append(expected[:10], make([]byte, sioPayloadSize+90)...)
+	copy(expected[sioPayloadSize+50:], "data")
+	assertCryptedFileContents(t, fs, name, expected)
+
+	err = fs.Truncate(name, 0)
+	require.NoError(t, err)
+	assertCryptedFileContents(t, fs, name, nil)
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, headerV10Size, info.Size())
+}
+
+func TestDecryptPackages(t *testing.T) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	ciphers, err := newEncryptedPackageCiphers(key)
+	require.NoError(t, err)
+	full := make([]byte, sioPayloadSize)
+	pkg0, err := sealEncryptedPackage(ciphers, 0, full, false)
+	require.NoError(t, err)
+	pkg1, err := sealEncryptedPackage(ciphers, 1, []byte("last"), true)
+	require.NoError(t, err)
+	_, err = sealEncryptedPackage(ciphers, 0, []byte("short"), false)
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	n, err := decryptPackages(&buf, bytes.NewReader(append(append([]byte{}, pkg0...), pkg1...)), key, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, sioPayloadSize+4, n)
+	// starting from the second package
+	buf.Reset()
+	_, err = decryptPackages(&buf, bytes.NewReader(pkg1), key, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("last"), buf.Bytes())
+	// wrong sequence number
+	_, err = decryptPackages(ioutil.Discard, bytes.NewReader(pkg1), key, 0)
+	assert.Error(t, err)
+	// the final package is missing
+	_, err = decryptPackages(ioutil.Discard, bytes.NewReader(pkg0), key, 0)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	// data after the final package
+	_, err = decryptPackages(ioutil.Discard, bytes.NewReader(append(append([]byte{}, pkg1...), pkg1...)), key, 1)
+	assert.True(t, errors.Is(err, errUnexpectedEncryptedPkg))
+	// truncated package
+	_, err = decryptPackages(ioutil.Discard, bytes.NewReader(pkg1[:len(pkg1)-1]), key, 1)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	n, err = decryptPackages(ioutil.Discard, bytes.NewReader(nil), key, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func getCryptedFileTestFs(t *testing.T) (*CryptFs, string) {
+	rootDir := t.TempDir()
+	fs, err := NewCryptFs("", rootDir, CryptFsConfig{
+		Passphrase: kms.NewPlainSecret("test passphrase"),
+	})
+	require.NoError(t, err)
+	return fs.(*CryptFs), filepath.Join(rootDir, "file.dat")
+}
+
+func assertCryptedFileContents(t *testing.T, fs *CryptFs, name string, expected []byte) {
+	info, err := fs.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), fs.ConvertFileInfo(info).Size())
+	assert.Equal(t, GetEncryptedSize(int64(len(expected))), getEncryptedFileSizeOnDisk(t, name))
+	for _, offset := range []int64{0, sioPayloadSize + 3} {
+		if offset > int64(len(expected)) {
+			continue
+		}
+		_, r, _, err := fs.Open(name, offset)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		r.Close()
+		assert.True(t, bytes.Equal(expected[offset:], data), "offset %v", offset)
+	}
+	f, err := newCryptedFile(name, os.O_RDONLY, fs.masterKey)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+	assert.NoError(t, f.Close())
+}
+
+func getEncryptedFileSizeOnDisk(t *testing.T, name string) int64 {
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	return info.Size()
+}
@@ -18,8 +18,11 @@ import (
 
 const (
 	// cryptFsName is the name for the local Fs implementation with encryption support
-	cryptFsName         = "cryptfs"
-	version10     byte  = 0x10
+	cryptFsName      = "cryptfs"
+	version10   byte = 0x10
+	// the packages of a version11 file can have different nonces, they are
+	// written by cryptedFile modifying only some packages of a file
+	version11     byte  = 0x11
 	nonceV10Size  int   = 32
 	headerV10Size int64 = 33 // 1 (version byte) + 32 (nonce size)
 )
@@ -59,7 +62,7 @@ func (fs *CryptFs) Name() string {
 
 // Open opens the named file for reading
 func (fs *CryptFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
-	f, key, err := fs.getFileAndEncryptionKey(name)
+	f, header, key, err := fs.getFileAndEncryptionKey(name)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -82,56 +85,39 @@ func (fs *CryptFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt,
 			return
 		}
 		var n int64
-		var err error
-
-		if offset == 0 {
-			n, err = sio.Decrypt(w, f, fs.getSIOConfig(key))
-		} else {
-			var readerAt io.ReaderAt
-			var readed, written int
-			buf := make([]byte, 65536)
-			wrapper := &cryptedFileWrapper{
-				File: f,
-			}
-			readerAt, err = sio.DecryptReaderAt(wrapper, fs.getSIOConfig(key))
-			if err == nil {
-				finished := false
-				for !finished {
-					readed, err = readerAt.ReadAt(buf, offset)
-					if err != nil && err != io.EOF {
-						break
-					}
-					if err == io.EOF {
-						finished = true
-						err = nil
-					}
-					if readed > 0 {
-						written, err = w.Write(buf[:readed])
-						n += int64(written)
-						if err != nil {
-							if err == io.EOF {
-								err = io.ErrUnexpectedEOF
-							}
-							break
-						}
-						if readed != written {
-							err = io.ErrShortWrite
-							break
-						}
-					}
-				}
+		var dst io.Writer = w
+		// the packages before the one including the requested offset are skipped
+		sequenceNumber := offset / sioPayloadSize
+		toSkip := offset - sequenceNumber*sioPayloadSize
+		if toSkip > 0 {
+			dst = &skipWriter{
+				w:      w,
+				toSkip: toSkip,
 			}
 		}
+		_, err := f.Seek(headerV10Size+sequenceNumber*encryptedPackageSize, io.SeekStart)
+		if err == nil {
+			n, err = decryptEncrypted(dst, f, header, key, uint32(sequenceNumber))
+		}
 		w.CloseWithError(err) //nolint:errcheck
 		f.Close()
-		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n-toSkip, err)
 	}()
 
 	return nil, r, nil, nil
 }
 
-// Create creates or opens the named file for writing
+// Create creates or opens the named file for writing.
+// Files opened for reading and writing or without truncation, for example to
+// resume an upload, support random access and are written on Close
 func (fs *CryptFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if flag != 0 && (flag&os.O_TRUNC == 0 || flag&os.O_RDWR != 0) {
+		f, err := newCryptedFile(name, flag, fs.masterKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return f, nil, nil, nil
+	}
 	var err error
 	var f *os.File
 	if flag == 0 {
@@ -142,18 +128,7 @@ func (fs *CryptFs) Create(name string, flag int) (File, *PipeWriter, func(), err
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	header := encryptedFileHeader{
-		version: version10,
-		nonce:   make([]byte, 32),
-	}
-	_, err = io.ReadFull(rand.Reader, header.nonce)
-	if err != nil {
-		f.Close()
-		return nil, nil, nil, err
-	}
-	var key [32]byte
-	kdf := hkdf.New(sha256.New, fs.masterKey, header.nonce, nil)
-	_, err = io.ReadFull(kdf, key[:])
+	header, key, err := newEncryptedFileHeader(fs.masterKey)
 	if err != nil {
 		f.Close()
 		return nil, nil, nil, err
@@ -173,8 +148,19 @@ func (fs *CryptFs) Create(name string, flag int) (File, *PipeWriter, func(), err
 	p := NewPipeWriter(w)
 
 	go func() {
-		n, err := sio.Encrypt(f, r, fs.getSIOConfig(key))
-		f.Close()
+		var n int64
+		// the writer is always closed, so an interrupted upload is a valid
+		// encrypted file with the received data and it can be resumed
+		encWriter, err := sio.EncryptWriter(struct{ io.Writer }{f}, fs.getSIOConfig(key))
+		if err == nil {
+			n, err = io.Copy(encWriter, r)
+			if errClose := encWriter.Close(); err == nil {
+				err = errClose
+			}
+		}
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
@@ -183,9 +169,18 @@ func (fs *CryptFs) Create(name string, flag int) (File, *PipeWriter, func(), err
 	return nil, p, nil, nil
 }
 
-// Truncate changes the size of the named file
-func (*CryptFs) Truncate(name string, size int64) error {
-	return ErrVfsUnsupported
+// Truncate changes the size of the named file, only the new last package is
+// encrypted again
+func (fs *CryptFs) Truncate(name string, size int64) error {
+	f, err := newCryptedFile(name, os.O_RDWR, fs.masterKey)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 // ReadDir reads the directory named by dirname and returns
@@ -207,9 +202,24 @@ func (fs *CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	return result, nil
 }
 
-// IsUploadResumeSupported returns false sio does not support random access writes
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (fs *CryptFs) OpenDir(dirname string) (DirLister, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newTransformDirLister(newOsDirLister(f), func(list []os.FileInfo) []os.FileInfo {
+		for idx, info := range list {
+			list[idx] = fs.ConvertFileInfo(info)
+		}
+		return list
+	}), nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported
 func (*CryptFs) IsUploadResumeSupported() bool {
-	return false
+	return true
 }
 
 // IsAtomicUploadSupported returns true if atomic upload is supported
@@ -219,7 +229,7 @@ func (*CryptFs) IsAtomicUploadSupported() bool {
 
 // GetMimeType returns the content type
 func (fs *CryptFs) GetMimeType(name string) (string, error) {
-	f, key, err := fs.getFileAndEncryptionKey(name)
+	f, header, key, err := fs.getFileAndEncryptionKey(name)
 	if err != nil {
 		return "", err
 	}
@@ -236,7 +246,7 @@ func (fs *CryptFs) GetMimeType(name string) (string, error) {
 	}
 
 	decrypted := bytes.NewBuffer(nil)
-	_, err = sio.Decrypt(decrypted, bytes.NewBuffer(buf[:n]), fs.getSIOConfig(key))
+	_, err = decryptEncrypted(decrypted, bytes.NewBuffer(buf[:n]), header, key, 0)
 	if err != nil {
 		return "", err
 	}
@@ -248,50 +258,94 @@ func (fs *CryptFs) GetMimeType(name string) (string, error) {
 }
 
 func (fs *CryptFs) getSIOConfig(key [32]byte) sio.Config {
-	return sio.Config{
-		MinVersion: sio.Version20,
-		MaxVersion: sio.Version20,
-		Key:        key[:],
+	return getSIOConfig(key)
+}
+
+// GetEncryptedSize returns the size of an encrypted file with the given
+// plaintext size
+func GetEncryptedSize(size int64) int64 {
+	encryptedSize, err := sio.EncryptedSize(uint64(size))
+	if err != nil {
+		return size + headerV10Size
 	}
+	return int64(encryptedSize) + headerV10Size
 }
 
 // ConvertFileInfo returns a FileInfo with the decrypted size
 func (fs *CryptFs) ConvertFileInfo(info os.FileInfo) os.FileInfo {
-	if !info.Mode().IsRegular() {
-		return info
-	}
-	size := info.Size()
-	if size >= headerV10Size {
-		size -= headerV10Size
-		decryptedSize, err := sio.DecryptedSize(uint64(size))
-		if err == nil {
-			size = int64(decryptedSize)
-		}
-	} else {
-		size = 0
-	}
-	return NewFileInfo(info.Name(), info.IsDir(), size, info.ModTime(), false)
+	return convertEncryptedFileInfo(info)
+}
+
+// ConvertCryptFileInfo returns a FileInfo with the decrypted size for a file
+// stored on a crypt filesystem. Use it if the CryptFs can be wrapped by
+// another Fs implementation, for example to preserve the file versions
+func ConvertCryptFileInfo(info os.FileInfo) os.FileInfo {
+	return convertEncryptedFileInfo(info)
 }
 
-func (fs *CryptFs) getFileAndEncryptionKey(name string) (*os.File, [32]byte, error) {
+func (fs *CryptFs) getFileAndEncryptionKey(name string) (*os.File, encryptedFileHeader, [32]byte, error) {
 	var key [32]byte
+	header := encryptedFileHeader{}
 	f, err := os.Open(name)
 	if err != nil {
-		return nil, key, err
+		return nil, header, key, err
 	}
-	header := encryptedFileHeader{}
 	err = header.Load(f)
 	if err != nil {
 		f.Close()
-		return nil, key, err
+		return nil, header, key, err
 	}
-	kdf := hkdf.New(sha256.New, fs.masterKey, header.nonce, nil)
-	_, err = io.ReadFull(kdf, key[:])
+	key, err = header.getKey(fs.masterKey)
 	if err != nil {
 		f.Close()
-		return nil, key, err
+		return nil, header, key, err
+	}
+	return f, header, key, err
+}
+
+// decryptEncrypted decrypts the packages read from src, starting from the
+// given sequence number, for a file with the given header
+func decryptEncrypted(dst io.Writer, src io.Reader, header encryptedFileHeader, key [32]byte,
+	sequenceNumber uint32,
+) (int64, error) {
+	if header.version == version11 {
+		return decryptPackages(dst, src, key, sequenceNumber)
 	}
-	return f, key, err
+	config := getSIOConfig(key)
+	config.SequenceNumber = sequenceNumber
+	return sio.Decrypt(dst, src, config)
+}
+
+func getSIOConfig(key [32]byte) sio.Config {
+	return sio.Config{
+		MinVersion: sio.Version20,
+		MaxVersion: sio.Version20,
+		Key:        key[:],
+	}
+}
+
+// getDecryptedSize returns the plaintext size for an encrypted file with the given size
+func getDecryptedSize(size int64) int64 {
+	if size < headerV10Size {
+		return 0
+	}
+	decryptedSize, err := sio.DecryptedSize(uint64(size - headerV10Size))
+	if err != nil {
+		return size - headerV10Size
+	}
+	return int64(decryptedSize)
+}
+
+func convertEncryptedFileInfo(info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	if fi, ok := info.(FileInfo); ok {
+		// keep the attributes read from the object metadata
+		fi.sizeInBytes = getDecryptedSize(info.Size())
+		return fi
+	}
+	return NewFileInfo(info.Name(), info.IsDir(), getDecryptedSize(info.Size()), info.ModTime(), false)
 }
 
 func isZeroBytesDownload(f *os.File, offset int64) (bool, error) {
@@ -319,32 +373,46 @@ type encryptedFileHeader struct {
 	nonce   []byte
 }
 
-func (h *encryptedFileHeader) Store(f *os.File) error {
+// newEncryptedFileHeader returns a header with a random nonce and the
+// encryption key derived from the master key and the nonce
+func newEncryptedFileHeader(masterKey []byte) (encryptedFileHeader, [32]byte, error) {
+	var key [32]byte
+	header := encryptedFileHeader{
+		version: version10,
+		nonce:   make([]byte, nonceV10Size),
+	}
+	if _, err := io.ReadFull(rand.Reader, header.nonce); err != nil {
+		return header, key, err
+	}
+	key, err := header.getKey(masterKey)
+	return header, key, err
+}
+
+func (h *encryptedFileHeader) getKey(masterKey []byte) ([32]byte, error) {
+	var key [32]byte
+	kdf := hkdf.New(sha256.New, masterKey, h.nonce, nil)
+	_, err := io.ReadFull(kdf, key[:])
+	return key, err
+}
+
+func (h *encryptedFileHeader) Store(f io.Writer) error {
 	buf := make([]byte, 0, headerV10Size)
-	buf = append(buf, version10)
+	buf = append(buf, h.version)
 	buf = append(buf, h.nonce...)
 	_, err := f.Write(buf)
 	return err
 }
 
-func (h *encryptedFileHeader) Load(f *os.File) error {
+func (h *encryptedFileHeader) Load(f io.Reader) error {
 	header := make([]byte, 1+nonceV10Size)
 	_, err := io.ReadFull(f, header)
 	if err != nil {
 		return err
 	}
 	h.version = header[0]
-	if h.version == version10 {
+	if h.version == version10 || h.version == version11 {
 		h.nonce = header[1:]
 		return nil
 	}
 	return fmt.Errorf("unsupported encryption version: %v", h.version)
 }
-
-type cryptedFileWrapper struct {
-	*os.File
-}
-
-func (w *cryptedFileWrapper) ReadAt(p []byte, offset int64) (n int, err error) {
-	return w.File.ReadAt(p, offset+headerV10Size)
-}
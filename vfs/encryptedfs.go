@@ -0,0 +1,369 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/eikenb/pipeat"
+	"github.com/minio/sio"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// encryptedFsName is the name prefix for the Fs implementation that encrypts
+	// the files stored on a wrapped filesystem
+	encryptedFsName = "encryptedfs"
+	// size for an encrypted package: 16 bytes header + 64KB payload + 16 bytes tag
+	encryptedPackageSize int64 = 16 + sioPayloadSize + 16
+	sioPayloadSize       int64 = 65536
+)
+
+// EncryptedFs is a Fs implementation that encrypts and decrypts the files stored
+// on the wrapped filesystem. The same encryption format used for CryptFs is
+// used, so each file has its own key derived from the master key.
+// The sizes reported by Stat, ReadDir, Walk and GetDirSize are plaintext sizes
+type EncryptedFs struct {
+	Fs
+	// local directory used for the pipes
+	localTempDir string
+	masterKey    []byte
+}
+
+// NewEncryptedFs returns a Fs that encrypts the files stored on the given filesystem
+func NewEncryptedFs(fs Fs, localTempDir string, config CryptFsConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Passphrase.IsEncrypted() {
+		if err := config.Passphrase.Decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	return &EncryptedFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		masterKey:    []byte(config.Passphrase.GetPayload()),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *EncryptedFs) Name() string {
+	return fmt.Sprintf("%v %v", encryptedFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped filesystem
+func (fs *EncryptedFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *EncryptedFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return convertEncryptedFileInfo(info), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *EncryptedFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return convertEncryptedFileInfo(info), nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *EncryptedFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.Fs.ReadDir(dirname)
+	for idx, info := range list {
+		list[idx] = convertEncryptedFileInfo(info)
+	}
+	return list, err
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (fs *EncryptedFs) OpenDir(dirname string) (DirLister, error) {
+	lister, err := fs.Fs.OpenDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newTransformDirLister(lister, func(list []os.FileInfo) []os.FileInfo {
+		for idx, info := range list {
+			list[idx] = convertEncryptedFileInfo(info)
+		}
+		return list
+	}), nil
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *EncryptedFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.Fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if info != nil {
+			info = convertEncryptedFileInfo(info)
+		}
+		return walkFn(walkedPath, info, err)
+	})
+}
+
+// GetDirSize returns the number of files and the plaintext size for a folder
+// including any subfolders
+func (fs *EncryptedFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	err := fs.Walk(dirname, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Mode().IsRegular() {
+			numFiles++
+			size += info.Size()
+		}
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their plaintext size
+func (fs *EncryptedFs) ScanRootDirContents() (int, int64, error) {
+	rootPath, err := fs.Fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	return fs.GetDirSize(rootPath)
+}
+
+// Open opens the named file for reading. Only the encrypted packages that
+// include the requested offset and the following ones are downloaded
+func (fs *EncryptedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if offset >= info.Size() {
+		go func() {
+			w.CloseWithError(nil) //nolint:errcheck
+			fsLog(fs, logger.LevelDebug, "zero bytes download completed, path: %#v", name)
+		}()
+		return nil, r, nil, nil
+	}
+	sequenceNumber := offset / sioPayloadSize
+	src, header, key, cancelFn, err := fs.openEncrypted(name, sequenceNumber)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		defer src.Close()
+
+		var dst io.Writer = w
+		toSkip := offset - sequenceNumber*sioPayloadSize
+		if toSkip > 0 {
+			dst = &skipWriter{
+				w:      w,
+				toSkip: toSkip,
+			}
+		}
+		n, err := decryptEncrypted(dst, src, header, key, uint32(sequenceNumber))
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v offset: %v size: %v, err: %v", name, offset,
+			n-toSkip, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs *EncryptedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		fsLog(fs, logger.LevelDebug, "unable to resume %#v, resume is not supported for encrypted files", name)
+		return nil, nil, nil, ErrVfsUnsupported
+	}
+	header, key, err := newEncryptedFileHeader(fs.masterKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	file, writer, cancelFn, err := fs.Fs.Create(name, flag)
+	if err == nil && file == nil && writer == nil {
+		err = fmt.Errorf("unable to create %#v", name)
+	}
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+
+	go func() {
+		var dst io.WriteCloser = writer
+		if file != nil {
+			dst = file
+		}
+		var n int64
+		err := header.Store(dst)
+		if err == nil {
+			n, err = sio.Encrypt(dst, r, getSIOConfig(key))
+		}
+		if err != nil && cancelFn != nil {
+			cancelFn()
+		}
+		errClose := dst.Close()
+		if err == nil {
+			err = errClose
+		}
+		if err != nil && file != nil {
+			// a truncated file cannot be decrypted, remove it
+			if errRemove := fs.Fs.Remove(name, false); errRemove != nil {
+				fsLog(fs, logger.LevelWarn, "unable to remove the partial encrypted file %#v: %v", name, errRemove)
+			}
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, encrypted size: %v, err: %v",
+			name, r.GetReadedBytes(), n+headerV10Size, err)
+	}()
+
+	return nil, p, cancelFn, nil
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported for encrypted files
+func (*EncryptedFs) Truncate(name string, size int64) error {
+	return ErrVfsUnsupported
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported
+func (*EncryptedFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported
+func (*EncryptedFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// GetMimeType returns the content type detecting it from the decrypted contents
+func (fs *EncryptedFs) GetMimeType(name string) (string, error) {
+	_, r, cancelFn, err := fs.Open(name, 0)
+	if err != nil {
+		return "", err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, r, 512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf.Bytes()), nil
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *EncryptedFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(fs.Fs, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func (fs *EncryptedFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(fs.Fs, name)
+}
+
+// openEncrypted reads the header for the given file and returns a reader for
+// the encrypted packages starting from the given sequence number, the header
+// and the key to decrypt them
+func (fs *EncryptedFs) openEncrypted(name string, sequenceNumber int64) (io.ReadCloser, encryptedFileHeader, [32]byte,
+	func(), error,
+) {
+	var key [32]byte
+	header := encryptedFileHeader{}
+	src, cancelFn, err := openInner(fs.Fs, name, 0)
+	if err != nil {
+		return nil, header, key, nil, err
+	}
+	if err = header.Load(src); err == nil {
+		key, err = header.getKey(fs.masterKey)
+	}
+	if err != nil || sequenceNumber == 0 {
+		if err != nil {
+			closeInner(src, cancelFn)
+			return nil, header, key, nil, err
+		}
+		return src, header, key, cancelFn, nil
+	}
+	// the header is followed by the encrypted packages, we avoid to download
+	// the packages before the requested one
+	closeInner(src, cancelFn)
+	src, cancelFn, err = openInner(fs.Fs, name, headerV10Size+sequenceNumber*encryptedPackageSize)
+	return src, header, key, cancelFn, err
+}
+
+// openInner opens the named file on the given wrapped filesystem starting
+// from the given offset
+func openInner(fs Fs, name string, offset int64) (io.ReadCloser, func(), error) {
+	file, reader, cancelFn, err := fs.Open(name, offset)
+	if err == nil && file == nil && reader == nil {
+		err = fmt.Errorf("unable to open %#v", name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if file == nil {
+		return reader, cancelFn, nil
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			closeInner(file, cancelFn)
+			return nil, nil, err
+		}
+	}
+	return file, cancelFn, nil
+}
+
+func closeInner(src io.Closer, cancelFn func()) {
+	if cancelFn != nil {
+		cancelFn()
+	}
+	src.Close()
+}
+
+// skipWriter discards the first toSkip bytes and writes the others to the
+// wrapped writer
+type skipWriter struct {
+	w      io.Writer
+	toSkip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.toSkip >= int64(n) {
+		s.toSkip -= int64(n)
+		return n, nil
+	}
+	p = p[s.toSkip:]
+	s.toSkip = 0
+	written, err := s.w.Write(p)
+	return n - len(p) + written, err
+}
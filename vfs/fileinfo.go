@@ -12,6 +12,15 @@ type FileInfo struct {
 	sizeInBytes int64
 	modTime     time.Time
 	mode        os.FileMode
+	// owner stored as object metadata, -1 means not set
+	uid int
+	gid int
+	// target for the symlinks emulated on object storage
+	linkTarget string
+	// entity tag for the object storage, it changes if the object content changes
+	etag string
+	// object key stored as metadata when SFTPGo sets a native legal hold
+	legalHoldKey string
 }
 
 // NewFileInfo creates file info.
@@ -30,6 +39,8 @@ func NewFileInfo(name string, isDirectory bool, sizeInBytes int64, modTime time.
 		sizeInBytes: sizeInBytes,
 		modTime:     modTime,
 		mode:        mode,
+		uid:         -1,
+		gid:         -1,
 	}
 }
 
@@ -23,7 +23,15 @@ func init() {
 }
 
 func (fi FileInfo) getFileInfoSys() interface{} {
+	uid := defaultUID
+	gid := defaultGID
+	if fi.uid >= 0 {
+		uid = fi.uid
+	}
+	if fi.gid >= 0 {
+		gid = fi.gid
+	}
 	return &syscall.Stat_t{
-		Uid: uint32(defaultUID),
-		Gid: uint32(defaultGID)}
+		Uid: uint32(uid),
+		Gid: uint32(gid)}
 }
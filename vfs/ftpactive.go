@@ -0,0 +1,328 @@
+package vfs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+var errFTPDataConnClosed = errors.New("active mode data connection closed")
+
+// ftpActiveDialer opens the connections to the remote FTP server when the
+// active mode is enabled. The FTP client library only supports the passive
+// mode, so the control connection replaces the EPSV and PASV commands sent
+// by the library with EPRT and PORT commands and replies as if a passive mode
+// command succeeded. The data connection the library then dials is accepted
+// from a local listener when the remote server connects to it.
+// A dialer must be used for a single ftp.ServerConn: the first connection it
+// opens is the control connection, the following ones are data connections
+type ftpActiveDialer struct {
+	endpoint  string
+	tlsMode   int
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	control   *ftpActiveControlConn
+}
+
+func (d *ftpActiveDialer) dial(network, address string) (net.Conn, error) {
+	if d.control == nil {
+		conn, err := d.dialControlConn()
+		if err != nil {
+			return nil, err
+		}
+		d.control = conn
+		return conn, nil
+	}
+	listener, err := d.control.getDataListener()
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if d.tlsMode != FTPTLSModeDisabled {
+		tlsConfig = d.tlsConfig
+	}
+	return &ftpActiveDataConn{
+		listener:  listener,
+		remoteIP:  d.control.RemoteAddr().(*net.TCPAddr).IP,
+		tlsConfig: tlsConfig,
+		timeout:   d.timeout,
+	}, nil
+}
+
+func (d *ftpActiveDialer) dialControlConn() (*ftpActiveControlConn, error) {
+	dialer := &net.Dialer{Timeout: d.timeout}
+	if d.tlsMode == FTPTLSModeImplicit {
+		conn, err := tls.DialWithDialer(dialer, "tcp", d.endpoint, d.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return newFTPActiveControlConn(conn, nil), nil
+	}
+	conn, err := dialer.Dial("tcp", d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsMode == FTPTLSModeDisabled {
+		return newFTPActiveControlConn(conn, nil), nil
+	}
+	// the library would upgrade the connection below our wrapper, so the
+	// explicit TLS handshake is done here and the greeting is sent again
+	tlsConn, err := d.authTLS(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newFTPActiveControlConn(tlsConn, []byte(fmt.Sprintf("%d Ready\r\n", ftp.StatusReady))), nil
+}
+
+func (d *ftpActiveDialer) authTLS(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		return nil, err
+	}
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	if _, _, err := reader.ReadResponse(ftp.StatusReady); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("AUTH TLS\r\n")); err != nil {
+		return nil, err
+	}
+	if _, _, err := reader.ReadResponse(ftp.StatusAuthOK); err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// ftpActiveControlConn is the control connection used in active mode.
+// The library sends a command and then reads its reply, so the replies for
+// the replaced passive mode commands are returned by the next reads
+type ftpActiveControlConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// data to return before reading from the connection
+	pending  []byte
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+func newFTPActiveControlConn(conn net.Conn, pending []byte) *ftpActiveControlConn {
+	return &ftpActiveControlConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		pending: pending,
+	}
+}
+
+func (c *ftpActiveControlConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.reader.Read(p)
+}
+
+func (c *ftpActiveControlConn) Write(p []byte) (int, error) {
+	switch string(p) {
+	case "EPSV\r\n":
+		return len(p), c.openDataListener(true)
+	case "PASV\r\n":
+		return len(p), c.openDataListener(false)
+	default:
+		return c.Conn.Write(p)
+	}
+}
+
+func (c *ftpActiveControlConn) Close() error {
+	c.setDataListener(nil)
+	return c.Conn.Close()
+}
+
+// openDataListener starts listening for the next data connection and sends
+// its address to the remote server, the reply is converted to a reply for
+// the passive mode command sent by the library
+func (c *ftpActiveControlConn) openDataListener(isEPSV bool) error {
+	localAddr := c.LocalAddr().(*net.TCPAddr)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localAddr.IP})
+	if err != nil {
+		return err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	var cmd string
+	if ip := addr.IP.To4(); ip != nil {
+		cmd = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], addr.Port>>8, addr.Port&0xff)
+	} else {
+		cmd = fmt.Sprintf("EPRT |2|%v|%d|", addr.IP, addr.Port)
+	}
+	if _, err := c.Conn.Write([]byte(cmd + "\r\n")); err != nil {
+		listener.Close()
+		return err
+	}
+	code, msg, err := textproto.NewReader(c.reader).ReadResponse(ftp.StatusCommandOK)
+	if err != nil {
+		listener.Close()
+		if _, ok := err.(*textproto.Error); ok {
+			// the library will handle the server error as a passive mode error
+			c.pending = append(c.pending, fmt.Sprintf("%d %v\r\n", code, strings.ReplaceAll(msg, "\n", " "))...)
+			return nil
+		}
+		return err
+	}
+	c.setDataListener(listener)
+	// the library connects using the dialer and so the address is ignored
+	if isEPSV {
+		c.pending = append(c.pending, fmt.Sprintf("%d Entering Extended Passive Mode (|||%d|)\r\n",
+			ftp.StatusExtendedPassiveMode, addr.Port)...)
+	} else {
+		c.pending = append(c.pending, fmt.Sprintf("%d Entering Passive Mode (127,0,0,1,%d,%d)\r\n",
+			ftp.StatusPassiveMode, addr.Port>>8, addr.Port&0xff)...)
+	}
+	return nil
+}
+
+func (c *ftpActiveControlConn) setDataListener(listener net.Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	c.listener = listener
+}
+
+func (c *ftpActiveControlConn) getDataListener() (net.Listener, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	listener := c.listener
+	c.listener = nil
+	if listener == nil {
+		return nil, errors.New("no active mode data connection requested")
+	}
+	return listener, nil
+}
+
+// ftpActiveDataConn is a data connection accepted from the listener when it
+// is used for the first time: the remote server connects to the listener only
+// after receiving the transfer command. The connections from addresses other
+// than the remote server one are refused
+type ftpActiveDataConn struct {
+	listener  net.Listener
+	remoteIP  net.IP
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	once      sync.Once
+	mu        sync.Mutex
+	conn      net.Conn
+	err       error
+	closed    bool
+	deadline  time.Time
+}
+
+func (c *ftpActiveDataConn) getConn() (net.Conn, error) {
+	c.once.Do(func() {
+		conn, err := c.accept()
+		c.listener.Close()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if err == nil && c.closed {
+			conn.Close()
+			err = errFTPDataConnClosed
+		}
+		if err == nil && !c.deadline.IsZero() {
+			err = conn.SetDeadline(c.deadline)
+		}
+		c.conn, c.err = conn, err
+	})
+	return c.conn, c.err
+}
+
+func (c *ftpActiveDataConn) accept() (net.Conn, error) {
+	if err := c.listener.(*net.TCPListener).SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if conn.RemoteAddr().(*net.TCPAddr).IP.Equal(c.remoteIP) {
+			if c.tlsConfig != nil {
+				conn = tls.Client(conn, c.tlsConfig)
+			}
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func (c *ftpActiveDataConn) Read(p []byte) (int, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(p)
+}
+
+func (c *ftpActiveDataConn) Write(p []byte) (int, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(p)
+}
+
+func (c *ftpActiveDataConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	// stop waiting for the remote server, if accepting
+	return c.listener.Close()
+}
+
+func (c *ftpActiveDataConn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *ftpActiveDataConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.remoteIP}
+}
+
+func (c *ftpActiveDataConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *ftpActiveDataConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *ftpActiveDataConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
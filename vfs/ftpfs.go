@@ -0,0 +1,713 @@
+package vfs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/jlaffaye/ftp"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// ftpFsName is the name for the FTP Fs implementation
+	ftpFsName = "ftpfs"
+)
+
+// Supported TLS modes for FTPFs
+const (
+	// FTPTLSModeDisabled uses a plain text FTP connection
+	FTPTLSModeDisabled = iota
+	// FTPTLSModeExplicit upgrades the connection to TLS using the AUTH TLS command
+	FTPTLSModeExplicit
+	// FTPTLSModeImplicit uses a TLS connection from the start
+	FTPTLSModeImplicit
+)
+
+// FTPFsConfig defines the configuration for FTP based filesystem
+type FTPFsConfig struct {
+	// Endpoint is the address of the remote FTP server as host:port
+	Endpoint string      `json:"endpoint,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Password *kms.Secret `json:"password,omitempty"`
+	// TLSMode defines how to use TLS:
+	// 0 plain FTP, 1 explicit TLS (FTPES), 2 implicit TLS (FTPS)
+	TLSMode int `json:"tls_mode,omitempty"`
+	// SkipTLSVerify disables the verification of the server certificate.
+	// This is insecure and should be used for testing only
+	SkipTLSVerify bool `json:"skip_tls_verify,omitempty"`
+	// DisableEPSV forces the legacy PASV command for data connections.
+	// By default EPSV is tried first and PASV is used as fallback
+	DisableEPSV bool `json:"disable_epsv,omitempty"`
+	// ActiveMode opens the data connections in active mode: the remote server
+	// connects to a port opened on the local address of the control connection.
+	// DisableEPSV is ignored in active mode
+	ActiveMode bool `json:"active_mode,omitempty"`
+	// Prefix is the path prefix to strip from FTP resource paths.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (c *FTPFsConfig) setEmptyCredentialsIfNil() {
+	if c.Password == nil {
+		c.Password = kms.NewEmptySecret()
+	}
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *FTPFsConfig) Validate() error {
+	c.setEmptyCredentialsIfNil()
+	if c.Endpoint == "" {
+		return errors.New("endpoint cannot be empty")
+	}
+	host, _, err := net.SplitHostPort(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %#v, it must be in the form host:port: %v", c.Endpoint, err)
+	}
+	if host == "" {
+		return errors.New("invalid endpoint, the host cannot be empty")
+	}
+	if c.Username == "" {
+		return errors.New("username cannot be empty")
+	}
+	if c.Password.IsEncrypted() && !c.Password.IsValid() {
+		return errors.New("invalid encrypted password")
+	}
+	if !c.Password.IsEmpty() && !c.Password.IsValidInput() {
+		return errors.New("invalid password")
+	}
+	if c.TLSMode < FTPTLSModeDisabled || c.TLSMode > FTPTLSModeImplicit {
+		return fmt.Errorf("invalid TLS mode: %v", c.TLSMode)
+	}
+	if c.Prefix != "" {
+		c.Prefix = utils.CleanPath(c.Prefix)
+	} else {
+		c.Prefix = "/"
+	}
+	return nil
+}
+
+// EncryptCredentials encrypts the password if it is in plain text
+func (c *FTPFsConfig) EncryptCredentials(additionalData string) error {
+	if c.Password.IsPlain() {
+		c.Password.SetAdditionalData(additionalData)
+		if err := c.Password.Encrypt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FTPFs is a Fs implementation for FTP backends.
+// A control connection is kept open for metadata operations while
+// each upload or download uses a dedicated connection, so transfers
+// and directory listings can run concurrently
+type FTPFs struct {
+	sync.Mutex
+	connectionID string
+	// if any, this is the local directory used for temporary files
+	localTempDir string
+	config       *FTPFsConfig
+	conn         *ftp.ServerConn
+	ctxTimeout   time.Duration
+}
+
+// NewFTPFs returns an FTPFs object that allows to interact with a remote FTP server
+func NewFTPFs(connectionID, localTempDir string, config FTPFsConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if !config.Password.IsEmpty() && config.Password.IsEncrypted() {
+		if err := config.Password.Decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	fs := &FTPFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       &config,
+		ctxTimeout:   30 * time.Second,
+	}
+	conn, err := fs.dial()
+	if err != nil {
+		return fs, err
+	}
+	fs.conn = conn
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *FTPFs) Name() string {
+	return fmt.Sprintf("%v %#v", ftpFsName, fs.config.Endpoint)
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *FTPFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file.
+// FTP has no standard command to get the details for a single path,
+// so we search it inside the listing for the parent directory
+func (fs *FTPFs) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	if name == "/" {
+		return NewFileInfo(name, true, 0, time.Now(), false), nil
+	}
+	var result os.FileInfo
+	err := fs.withConnection(func(conn *ftp.ServerConn) error {
+		entries, err := conn.List(path.Dir(name))
+		if err != nil {
+			return err
+		}
+		baseName := path.Base(name)
+		for _, entry := range entries {
+			if entry.Name == baseName {
+				result = fs.getFileInfo(entry)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fs.getFTPError("stat", name, err)
+	}
+	if result == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return result, nil
+}
+
+// Lstat returns a FileInfo describing the named file.
+// Symbolic links are reported as they are listed by the remote server
+func (fs *FTPFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading
+func (fs *FTPFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	conn, err := fs.dial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		conn.Quit() //nolint:errcheck
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := fs.getTransferContext(conn)
+
+	go func() {
+		defer cancelFn()
+		n, err := fs.download(ctx, conn, name, offset, w)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// If flag is not zero and it does not contain os.O_TRUNC the upload
+// is resumed from the current size of the remote file
+func (fs *FTPFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	conn, err := fs.dial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var offset int64
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		offset, err = conn.FileSize(name)
+		if err != nil {
+			fsLog(fs, logger.LevelDebug, "unable to get the size for file %#v to resume, upload from the start: %v",
+				name, err)
+			offset = 0
+		}
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		conn.Quit() //nolint:errcheck
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	p.offset = offset
+	ctx, cancelFn := fs.getTransferContext(conn)
+
+	go func() {
+		defer cancelFn()
+		err := fs.upload(ctx, conn, name, offset, r)
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, offset: %v, readed bytes: %v, err: %v",
+			name, offset, r.GetReadedBytes(), err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+func (fs *FTPFs) Rename(source, target string) error {
+	if source == target {
+		return nil
+	}
+	err := fs.withConnection(func(conn *ftp.ServerConn) error {
+		return conn.Rename(source, target)
+	})
+	return fs.getFTPError("rename", source, err)
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *FTPFs) Remove(name string, isDir bool) error {
+	err := fs.withConnection(func(conn *ftp.ServerConn) error {
+		if isDir {
+			return conn.RemoveDir(name)
+		}
+		return conn.Delete(name)
+	})
+	return fs.getFTPError("remove", name, err)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *FTPFs) Mkdir(name string) error {
+	err := fs.withConnection(func(conn *ftp.ServerConn) error {
+		return conn.MakeDir(name)
+	})
+	return fs.getFTPError("mkdir", name, err)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (*FTPFs) Symlink(source, target string) error {
+	return ErrVfsUnsupported
+}
+
+// Readlink returns the destination of the named symbolic link
+func (*FTPFs) Readlink(name string) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (*FTPFs) Chown(name string, uid int, gid int) error {
+	return ErrVfsUnsupported
+}
+
+// Chmod changes the mode of the named file to mode.
+func (*FTPFs) Chmod(name string, mode os.FileMode) error {
+	return ErrVfsUnsupported
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (*FTPFs) Chtimes(name string, atime, mtime time.Time) error {
+	return ErrVfsUnsupported
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported, while truncating an opened
+// file is handled inside base transfer
+func (*FTPFs) Truncate(name string, size int64) error {
+	return ErrVfsUnsupported
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *FTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	err := fs.withConnection(func(conn *ftp.ServerConn) error {
+		entries, err := conn.List(dirname)
+		if err != nil {
+			return err
+		}
+		result = make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			result = append(result, fs.getFileInfo(entry))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fs.getFTPError("readdir", dirname, err)
+	}
+	return result, nil
+}
+
+// OpenDir returns a DirLister for the directory named by dirname,
+// a LIST command returns the whole directory, the entries are returned page by page from memory
+func (fs *FTPFs) OpenDir(dirname string) (DirLister, error) {
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newSliceDirLister(files), nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Resume is implemented using the REST command
+func (*FTPFs) IsUploadResumeSupported() bool {
+	return true
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Uploads are streamed to the remote server, atomicity depends on
+// the server implementation
+func (*FTPFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*FTPFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*FTPFs) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*FTPFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported
+}
+
+// CheckRootPath creates the local directory used for temporary files and
+// the remote prefix if they don't exist
+func (fs *FTPFs) CheckRootPath(username string, uid int, gid int) bool {
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	if !osFs.CheckRootPath(username, uid, gid) {
+		return false
+	}
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	_, err := fs.Stat(fs.config.Prefix)
+	if err == nil {
+		return true
+	}
+	if !fs.IsNotExist(err) {
+		fsLog(fs, logger.LevelWarn, "unable to check root path %#v: %v", fs.config.Prefix, err)
+		return false
+	}
+	dir := "/"
+	for _, elem := range strings.Split(strings.TrimPrefix(fs.config.Prefix, "/"), "/") {
+		dir = path.Join(dir, elem)
+		if _, err = fs.Stat(dir); err == nil {
+			continue
+		}
+		if err = fs.Mkdir(dir); err != nil {
+			fsLog(fs, logger.LevelWarn, "error creating root path %#v: %v", dir, err)
+			return false
+		}
+	}
+	return true
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size
+func (fs *FTPFs) ScanRootDirContents() (int, int64, error) {
+	return fs.GetDirSize(fs.config.Prefix)
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload
+func (*FTPFs) GetAtomicUploadPath(name string) string {
+	dir := path.Dir(name)
+	guid := xid.New().String()
+	return path.Join(dir, ".sftpgo-upload."+guid+"."+path.Base(name))
+}
+
+// GetRelativePath returns the path for a file relative to the FTP prefix if any.
+// This is the path as seen by SFTPGo users
+func (fs *FTPFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		return "/" + rel
+	}
+	if fs.config.Prefix != "/" {
+		if !strings.HasPrefix(rel, fs.config.Prefix) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
+	}
+	return rel
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *FTPFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return fs.walk(root, info, walkFn)
+}
+
+func (fs *FTPFs) walk(name string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(name, info, nil)
+	}
+	contents, err := fs.ReadDir(name)
+	if err := walkFn(name, info, err); err != nil || contents == nil {
+		return err
+	}
+	for _, fi := range contents {
+		err = fs.walk(path.Join(name, fi.Name()), fi, walkFn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins any number of path elements into a single path
+func (*FTPFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*FTPFs) HasVirtualFolders() bool {
+	return false
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual path
+func (fs *FTPFs) ResolvePath(virtualPath string) (string, error) {
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return fs.Join(fs.config.Prefix, virtualPath), nil
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *FTPFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, dirname)
+	if err == nil && isDir {
+		err = fs.Walk(dirname, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				size += info.Size()
+				numFiles++
+			}
+			return nil
+		})
+	}
+	return numFiles, size, err
+}
+
+// GetMimeType returns the content type
+func (fs *FTPFs) GetMimeType(name string) (string, error) {
+	conn, err := fs.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Quit() //nolint:errcheck
+
+	resp, err := conn.Retr(name)
+	if err != nil {
+		return "", fs.getFTPError("open", name, err)
+	}
+	var buf [512]byte
+	n, err := io.ReadFull(resp, buf[:])
+	// we don't read the whole file so the server could reply with an error
+	resp.Close() //nolint:errcheck
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Close closes the control connection
+func (fs *FTPFs) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.conn == nil {
+		return nil
+	}
+	err := fs.conn.Quit()
+	fs.conn = nil
+	return err
+}
+
+// GetAvailableDiskSize return the available size for the specified path
+func (*FTPFs) GetAvailableDiskSize(dirName string) (int64, error) {
+	return 0, errStorageSizeUnavailable
+}
+
+func (fs *FTPFs) download(ctx context.Context, conn *ftp.ServerConn, name string, offset int64, w io.Writer) (int64, error) {
+	resp, err := conn.RetrFrom(name, uint64(offset))
+	if err != nil {
+		return 0, fs.getFTPError("open", name, err)
+	}
+	n, err := io.Copy(w, resp)
+	closeErr := resp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+func (fs *FTPFs) upload(ctx context.Context, conn *ftp.ServerConn, name string, offset int64, r io.Reader) error {
+	err := conn.StorFrom(name, r, uint64(offset))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fs.getFTPError("create", name, err)
+}
+
+// getTransferContext returns a context for a transfer using the specified
+// dedicated connection. The connection is closed when the context is done
+func (*FTPFs) getTransferContext(conn *ftp.ServerConn) (context.Context, context.CancelFunc) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		<-ctx.Done()
+		conn.Quit() //nolint:errcheck
+	}()
+	return ctx, cancelFn
+}
+
+// withConnection executes fn using the control connection.
+// If the connection is broken, for example it was closed by the server
+// after an idle timeout, we reconnect and try again once
+func (fs *FTPFs) withConnection(fn func(conn *ftp.ServerConn) error) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if fs.conn == nil {
+			fs.conn, err = fs.dial()
+			if err != nil {
+				return err
+			}
+		}
+		err = fn(fs.conn)
+		if err == nil || !isFTPConnectionError(err) {
+			return err
+		}
+		fsLog(fs, logger.LevelDebug, "control connection error, reconnecting: %v", err)
+		fs.conn.Quit() //nolint:errcheck
+		fs.conn = nil
+	}
+	return err
+}
+
+func (fs *FTPFs) dial() (*ftp.ServerConn, error) {
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(fs.ctxTimeout),
+		ftp.DialWithDisabledEPSV(fs.config.DisableEPSV),
+	}
+	if fs.config.ActiveMode {
+		dialer := &ftpActiveDialer{
+			endpoint:  fs.config.Endpoint,
+			tlsMode:   fs.config.TLSMode,
+			tlsConfig: fs.getTLSConfig(),
+			timeout:   fs.ctxTimeout,
+		}
+		options = append(options, ftp.DialWithDialFunc(dialer.dial))
+		if fs.config.TLSMode != FTPTLSModeDisabled {
+			// the dialer handles the TLS connections, the TLS config is
+			// required to protect the data connections after the login
+			options = append(options, ftp.DialWithTLS(dialer.tlsConfig))
+		}
+	} else {
+		switch fs.config.TLSMode {
+		case FTPTLSModeExplicit:
+			options = append(options, ftp.DialWithExplicitTLS(fs.getTLSConfig()))
+		case FTPTLSModeImplicit:
+			options = append(options, ftp.DialWithTLS(fs.getTLSConfig()))
+		}
+	}
+	conn, err := ftp.Dial(fs.config.Endpoint, options...)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to connect to %#v: %v", fs.config.Endpoint, err)
+		return nil, err
+	}
+	if err := conn.Login(fs.config.Username, fs.config.Password.GetPayload()); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to login to %#v as %#v: %v", fs.config.Endpoint, fs.config.Username, err)
+		conn.Quit() //nolint:errcheck
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (fs *FTPFs) getTLSConfig() *tls.Config {
+	host, _, _ := net.SplitHostPort(fs.config.Endpoint)
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: fs.config.SkipTLSVerify, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+		// many FTPS servers require TLS session resumption for data connections
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+func (*FTPFs) getFileInfo(entry *ftp.Entry) os.FileInfo {
+	isDir := entry.Type == ftp.EntryTypeFolder
+	var size int64
+	if !isDir {
+		size = int64(entry.Size)
+	}
+	return NewFileInfo(entry.Name, isDir, size, entry.Time, false)
+}
+
+// getFTPError converts the errors returned by the remote server
+func (fs *FTPFs) getFTPError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "%v failed for path %#v, code: %v message: %v", op, name, protoErr.Code, protoErr.Msg)
+	switch protoErr.Code {
+	case ftp.StatusFileUnavailable:
+		// 550 is used for both missing files and denied access, we
+		// report a missing file only for read operations
+		if op != "stat" && op != "readdir" && op != "open" {
+			return err
+		}
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case ftp.StatusNotLoggedIn, ftp.StatusInvalidCredentials:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	default:
+		return err
+	}
+}
+
+func isFTPConnectionError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == ftp.StatusNotAvailable
+	}
+	var pathErr *os.PathError
+	return !errors.As(err, &pathErr)
+}
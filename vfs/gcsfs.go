@@ -28,8 +28,12 @@ import (
 	"github.com/drakkan/sftpgo/version"
 )
 
+const gcsListerPageSize = 1000
+
 var (
 	gcsDefaultFieldsSelection = []string{"Name", "Size", "Deleted", "Updated", "ContentType"}
+	// GCS returns the user metadata while listing, we need them for the attributes set by the clients
+	gcsListFieldsSelection = []string{"Name", "Size", "Deleted", "Updated", "ContentType", "Metadata"}
 )
 
 // GCSFs is a Fs implementation for Google Cloud Storage.
@@ -100,8 +104,20 @@ func (fs *GCSFs) ConnectionID() string {
 	return fs.connectionID
 }
 
-// Stat returns a FileInfo describing the named file
+// Stat returns a FileInfo describing the named file.
+// The emulated symlinks, if enabled, are followed
 func (fs *GCSFs) Stat(name string) (os.FileInfo, error) {
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return setFileInfoName(info, name), nil
+}
+
+func (fs *GCSFs) lstat(name string) (os.FileInfo, error) {
 	var result FileInfo
 	var err error
 	if name == "" || name == "." {
@@ -119,7 +135,9 @@ func (fs *GCSFs) Stat(name string) (os.FileInfo, error) {
 		objSize := attrs.Size
 		objectModTime := attrs.Updated
 		isDir := attrs.ContentType == dirMimeType || strings.HasSuffix(attrs.Name, "/")
-		return NewFileInfo(name, isDir, objSize, objectModTime, false), nil
+		info := newObjectFileInfo(name, isDir, objSize, objectModTime, attrs.Metadata)
+		info.etag = attrs.Etag
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return result, err
@@ -143,16 +161,24 @@ func (fs *GCSFs) getStatCompat(name string) (os.FileInfo, error) {
 	}
 	objSize := attrs.Size
 	objectModTime := attrs.Updated
-	return NewFileInfo(name, true, objSize, objectModTime, false), nil
+	return newObjectFileInfo(name, true, objSize, objectModTime, attrs.Metadata), nil
 }
 
-// Lstat returns a FileInfo describing the named file
+// Lstat returns a FileInfo describing the named file.
+// If the file is an emulated symlink the returned FileInfo describes the symlink
 func (fs *GCSFs) Lstat(name string) (os.FileInfo, error) {
-	return fs.Stat(name)
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, false)
+	return info, err
 }
 
 // Open opens the named file for reading
 func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if fs.config.EmulateSymlinks {
+		name = resolveObjectPath(fs, name)
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -222,15 +248,14 @@ func (fs *GCSFs) Create(name string, flag int) (File, *PipeWriter, func(), error
 }
 
 // Rename renames (moves) source to target.
-// We don't support renaming non empty directories since we should
-// rename all the contents too and this could take long time: think
-// about directories with thousands of files, for each file we should
-// execute a CopyObject call.
+// Non empty directories are renamed copying all the contents, using
+// server-side copies, and then removing the source objects: this could
+// take long time for directories with thousands of files.
 func (fs *GCSFs) Rename(source, target string) error {
 	if source == target {
 		return nil
 	}
-	fi, err := fs.Stat(source)
+	fi, err := fs.lstat(source)
 	if err != nil {
 		return err
 	}
@@ -240,19 +265,39 @@ func (fs *GCSFs) Rename(source, target string) error {
 			return err
 		}
 		if hasContents {
-			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+			_, _, err = copyPrefix(fs, source, target, true, fs.copyObject)
+			return err
 		}
 	}
+	if err := fs.copyObject(source, target, fi.IsDir()); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// CopyObjects copies source, a file or a directory, to target using server-side copies
+func (fs *GCSFs) CopyObjects(source, target string) (int, int64, error) {
+	return copyObjects(fs, source, target, fs.copyObject)
+}
+
+func (fs *GCSFs) copyObject(source, target string, isDir bool) error {
+	// the destination attributes replace the source ones, so the metadata,
+	// including the attributes set by the clients, must be copied explicitly
+	srcAttrs, err := fs.headObject(source)
+	if err != nil {
+		return err
+	}
 	src := fs.svc.Bucket(fs.config.Bucket).Object(source)
 	dst := fs.svc.Bucket(fs.config.Bucket).Object(target)
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	copier := dst.CopierFrom(src)
+	copier.Metadata = srcAttrs.Metadata
 	if fs.config.StorageClass != "" {
 		copier.StorageClass = fs.config.StorageClass
 	}
 	var contentType string
-	if fi.IsDir() {
+	if isDir {
 		contentType = dirMimeType
 	} else {
 		contentType = mime.TypeByExtension(path.Ext(source))
@@ -262,10 +307,7 @@ func (fs *GCSFs) Rename(source, target string) error {
 	}
 	_, err = copier.Run(ctx)
 	metrics.GCSCopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
@@ -305,29 +347,52 @@ func (fs *GCSFs) Mkdir(name string) error {
 	return w.Close()
 }
 
-// Symlink creates source as a symbolic link to target.
-func (*GCSFs) Symlink(source, target string) error {
-	return ErrVfsUnsupported
+// Symlink creates target as a symbolic link to source.
+// Symlinks are emulated, if enabled, using an empty object
+// that stores the source path as metadata
+func (fs *GCSFs) Symlink(source, target string) error {
+	if !fs.config.EmulateSymlinks {
+		return ErrVfsUnsupported
+	}
+	if err := checkSymlinkCreation(fs, target); err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	objectWriter := fs.svc.Bucket(fs.config.Bucket).Object(target).NewWriter(ctx)
+	objectWriter.ObjectAttrs.ContentType = symlinkMimeType
+	objectWriter.ObjectAttrs.Metadata = getSymlinkMetadata(fs.GetRelativePath(source))
+	if fs.config.StorageClass != "" {
+		objectWriter.ObjectAttrs.StorageClass = fs.config.StorageClass
+	}
+	return objectWriter.Close()
 }
 
 // Readlink returns the destination of the named symbolic link
-func (*GCSFs) Readlink(name string) (string, error) {
-	return "", ErrVfsUnsupported
+func (fs *GCSFs) Readlink(name string) (string, error) {
+	if !fs.config.EmulateSymlinks {
+		return "", ErrVfsUnsupported
+	}
+	return readObjectSymlink(fs, name)
 }
 
 // Chown changes the numeric uid and gid of the named file.
-func (*GCSFs) Chown(name string, uid int, gid int) error {
-	return ErrVfsUnsupported
+// They are stored as object metadata
+func (fs *GCSFs) Chown(name string, uid int, gid int) error {
+	return fs.updateMetadata(name, withOwner(uid, gid))
 }
 
 // Chmod changes the mode of the named file to mode.
-func (*GCSFs) Chmod(name string, mode os.FileMode) error {
-	return ErrVfsUnsupported
+// The permissions are stored as object metadata
+func (fs *GCSFs) Chmod(name string, mode os.FileMode) error {
+	return fs.updateMetadata(name, withMode(mode))
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (*GCSFs) Chtimes(name string, atime, mtime time.Time) error {
-	return ErrVfsUnsupported
+// The modification time is stored as object metadata, the access time is ignored
+func (fs *GCSFs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.updateMetadata(name, withMtime(mtime))
 }
 
 // Truncate changes the size of the named file.
@@ -340,65 +405,74 @@ func (*GCSFs) Truncate(name string, size int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	return readDirFromLister(fs.OpenDir(dirname))
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page, up to 1000 objects, at a time
+func (fs *GCSFs) OpenDir(dirname string) (DirLister, error) {
+	if fs.config.EmulateSymlinks {
+		dirname = resolveObjectPath(fs, dirname)
+	}
 	// dirname must be already cleaned
 	prefix := fs.getPrefix(dirname)
 
 	query := &storage.Query{Prefix: prefix, Delimiter: "/"}
-	err := query.SetAttrSelection(gcsDefaultFieldsSelection)
+	err := query.SetAttrSelection(gcsListFieldsSelection)
 	if err != nil {
 		return nil, err
 	}
 
 	prefixes := make(map[string]bool)
-	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
-	defer cancelFn()
+	pageToken := ""
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
-	it := bkt.Objects(ctx, query)
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+	return newPagedDirLister(func() ([]os.FileInfo, bool, error) {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		bkt := fs.svc.Bucket(fs.config.Bucket)
+		var objects []*storage.ObjectAttrs
+		nextPageToken, err := iterator.NewPager(bkt.Objects(ctx, query), gcsListerPageSize, pageToken).NextPage(&objects)
+		metrics.GCSListObjectsCompleted(err)
 		if err != nil {
-			metrics.GCSListObjectsCompleted(err)
-			return result, err
-		}
-		if attrs.Prefix != "" {
-			name, _ := fs.resolve(attrs.Prefix, prefix)
-			if name == "" {
-				continue
-			}
-			if _, ok := prefixes[name]; ok {
-				continue
-			}
-			result = append(result, NewFileInfo(name, true, 0, time.Now(), false))
-			prefixes[name] = true
-		} else {
-			name, isDir := fs.resolve(attrs.Name, prefix)
-			if name == "" {
-				continue
-			}
-			if !attrs.Deleted.IsZero() {
-				continue
-			}
-			if attrs.ContentType == dirMimeType {
-				isDir = true
-			}
-			if isDir {
-				// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
+			return nil, false, err
+		}
+		pageToken = nextPageToken
+		result := make([]os.FileInfo, 0, len(objects))
+		for _, attrs := range objects {
+			if attrs.Prefix != "" {
+				name, _ := fs.resolve(attrs.Prefix, prefix)
+				if name == "" {
+					continue
+				}
 				if _, ok := prefixes[name]; ok {
 					continue
 				}
+				result = append(result, NewFileInfo(name, true, 0, time.Now(), false))
 				prefixes[name] = true
+			} else {
+				name, isDir := fs.resolve(attrs.Name, prefix)
+				if name == "" {
+					continue
+				}
+				if !attrs.Deleted.IsZero() {
+					continue
+				}
+				if attrs.ContentType == dirMimeType {
+					isDir = true
+				}
+				if isDir {
+					// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
+					if _, ok := prefixes[name]; ok {
+						continue
+					}
+					prefixes[name] = true
+				}
+				result = append(result, newObjectFileInfo(name, isDir, attrs.Size, attrs.Updated, attrs.Metadata))
 			}
-			fi := NewFileInfo(name, isDir, attrs.Size, attrs.Updated, false)
-			result = append(result, fi)
 		}
-	}
-	metrics.GCSListObjectsCompleted(nil)
-	return result, nil
+		return result, pageToken != "", nil
+	}, nil), nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
@@ -499,8 +573,8 @@ func (fs *GCSFs) ScanRootDirContents() (int, int64, error) {
 
 // GetDirSize returns the number of files and the size for a folder
 // including any subfolders
-func (*GCSFs) GetDirSize(dirname string) (int, int64, error) {
-	return 0, 0, ErrVfsUnsupported
+func (fs *GCSFs) GetDirSize(dirname string) (int, int64, error) {
+	return getDirSizeFromObjects(fs, dirname)
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload.
@@ -681,6 +755,84 @@ func (fs *GCSFs) headObject(name string) (*storage.ObjectAttrs, error) {
 	return attrs, err
 }
 
+func (fs *GCSFs) getSymlinkTarget(name string) (string, bool, error) {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return "", false, err
+	}
+	target, ok := getSymlinkTargetFromMetadata(attrs.Metadata)
+	return target, ok, nil
+}
+
+// updateMetadata applies the given update to the metadata of the named object.
+// Virtual directories, prefixes without an object, get one
+func (fs *GCSFs) updateMetadata(name string, update metadataUpdate) error {
+	key := name
+	attrs, err := fs.headObject(key)
+	if fs.IsNotExist(err) {
+		key = name + "/"
+		attrs, err = fs.headObject(key)
+		if fs.IsNotExist(err) {
+			hasContents, errContents := fs.hasContents(name)
+			if errContents != nil {
+				return errContents
+			}
+			if !hasContents {
+				return err
+			}
+			key = name
+			if err = fs.createDirObject(name); err != nil {
+				return err
+			}
+			attrs = &storage.ObjectAttrs{}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err = fs.svc.Bucket(fs.config.Bucket).Object(key).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: getUpdatedMetadata(attrs.Metadata, update),
+	})
+	return err
+}
+
+func (fs *GCSFs) createDirObject(name string) error {
+	_, w, _, err := fs.Create(name, -1)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// SetChecksums stores the checksums for the named file as object metadata
+func (fs *GCSFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err = fs.svc.Bucket(fs.config.Bucket).Object(name).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: getUpdatedMetadata(attrs.Metadata, withChecksums(checksums)),
+	})
+	return err
+}
+
+// GetChecksum returns the checksum stored as object metadata for the named
+// file and the given algorithm
+func (fs *GCSFs) GetChecksum(name, algo string) (string, int64, bool) {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return "", 0, false
+	}
+	checksum, ok := getChecksumFromMetadata(attrs.Metadata, algo)
+	return checksum, attrs.Size, ok
+}
+
 // GetMimeType returns the content type
 func (fs *GCSFs) GetMimeType(name string) (string, error) {
 	attrs, err := fs.headObject(name)
@@ -0,0 +1,363 @@
+// +build !nogcs
+
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+const fakeGCSBucket = "bucket"
+
+func TestGCSChtimesFile(t *testing.T) {
+	server := newFakeGCSServer(t)
+	fs := server.getFs(t)
+	updated := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	server.putObject("dir/file", []byte("content"), "", updated, nil)
+
+	mtime := time.Date(2020, 1, 1, 10, 20, 30, 500, time.UTC)
+	err := fs.Chtimes("dir/file", time.Now(), mtime)
+	require.NoError(t, err)
+	info, err := fs.Stat("dir/file")
+	require.NoError(t, err)
+	// the modification time is stored with a second precision
+	assert.True(t, info.ModTime().Equal(mtime.Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, int64(7), info.Size())
+	assert.False(t, info.IsDir())
+	assert.Equal(t, []byte("content"), server.getObject("dir/file").data)
+	// the metadata are always listed
+	files, err := fs.ReadDir("dir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+		assert.True(t, files[0].ModTime().Equal(mtime.Truncate(time.Second)), files[0].ModTime().String())
+	}
+	// the other attributes are preserved setting the modification time again
+	err = fs.Chmod("dir/file", 0600)
+	require.NoError(t, err)
+	err = fs.Chtimes("dir/file", time.Now(), mtime.Add(time.Hour))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir/file")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Hour).Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	err = fs.Chtimes("dir/missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+}
+
+func TestGCSChtimesDir(t *testing.T) {
+	server := newFakeGCSServer(t)
+	fs := server.getFs(t)
+	server.putObject("vdir/file", []byte("data"), "", time.Now(), nil)
+	server.putObject("dir/", nil, "", time.Now(), nil)
+
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	// a virtual directory, a prefix without an object, gets one
+	assert.Nil(t, server.getObject("vdir"))
+	err := fs.Chtimes("vdir", time.Now(), mtime)
+	require.NoError(t, err)
+	if obj := server.getObject("vdir"); assert.NotNil(t, obj) {
+		assert.Equal(t, dirMimeType, obj.contentType)
+	}
+	info, err := fs.Stat("vdir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime), info.ModTime().String())
+	// the directory contents are not modified
+	files, err := fs.ReadDir("vdir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+	}
+	// a directory object with a trailing slash
+	err = fs.Chtimes("dir", time.Now(), mtime.Add(time.Minute))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Minute)), info.ModTime().String())
+	// the directory objects are listed before the prefixes, so the stored
+	// modification time is returned for the directories with an object
+	files, err = fs.ReadDir("/")
+	require.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+		assert.Equal(t, "dir", files[0].Name())
+		assert.True(t, files[0].IsDir())
+		assert.Equal(t, "vdir", files[1].Name())
+		assert.True(t, files[1].IsDir())
+		assert.True(t, files[1].ModTime().Equal(mtime), files[1].ModTime().String())
+	}
+	// a missing directory is not created
+	err = fs.Chtimes("missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+	assert.Nil(t, server.getObject("missing"))
+	assert.Nil(t, server.getObject("missing/"))
+}
+
+// fakeGCSObject is an object stored inside fakeGCSServer
+type fakeGCSObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	updated     time.Time
+	generation  int64
+}
+
+// fakeGCSServer is a minimal in memory implementation of the Cloud Storage
+// JSON API, for a single bucket, to test GCSFs without a real bucket
+type fakeGCSServer struct {
+	sync.Mutex
+	server     *httptest.Server
+	objects    map[string]*fakeGCSObject
+	generation int64
+}
+
+func newFakeGCSServer(t *testing.T) *fakeGCSServer {
+	s := &fakeGCSServer{
+		objects: make(map[string]*fakeGCSObject),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeGCSServer) getFs(t *testing.T) *GCSFs {
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(s.server.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return &GCSFs{
+		localTempDir:   os.TempDir(),
+		config:         &GCSFsConfig{Bucket: fakeGCSBucket},
+		svc:            client,
+		ctxTimeout:     30 * time.Second,
+		ctxLongTimeout: 30 * time.Second,
+	}
+}
+
+func (s *fakeGCSServer) putObject(name string, data []byte, contentType string, updated time.Time,
+	metadata map[string]string,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.generation++
+	s.objects[name] = &fakeGCSObject{
+		data:        data,
+		contentType: contentType,
+		metadata:    metadata,
+		updated:     updated.UTC().Truncate(time.Second),
+		generation:  s.generation,
+	}
+}
+
+func (s *fakeGCSServer) getObject(name string) *fakeGCSObject {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.objects[name]
+}
+
+func (s *fakeGCSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucketPath := "/storage/v1/b/" + fakeGCSBucket
+	objectsPath := bucketPath + "/o"
+	switch {
+	case r.URL.Path == "/upload"+objectsPath && r.Method == http.MethodPost:
+		s.insertObject(w, r)
+	case r.URL.Path == bucketPath && r.Method == http.MethodGet:
+		s.sendJSON(w, map[string]string{"kind": "storage#bucket", "name": fakeGCSBucket})
+	case r.URL.Path == objectsPath && r.Method == http.MethodGet:
+		s.listObjects(w, r)
+	case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+		switch r.Method {
+		case http.MethodGet:
+			s.Lock()
+			obj, ok := s.objects[name]
+			s.Unlock()
+			if !ok {
+				s.sendError(w, http.StatusNotFound)
+				return
+			}
+			s.sendJSON(w, s.getObjectResource(name, obj))
+		case http.MethodPatch:
+			s.patchObject(w, r, name)
+		case http.MethodDelete:
+			s.Lock()
+			_, ok := s.objects[name]
+			delete(s.objects, name)
+			s.Unlock()
+			if !ok {
+				s.sendError(w, http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			s.sendError(w, http.StatusMethodNotAllowed)
+		}
+	default:
+		s.sendError(w, http.StatusNotFound)
+	}
+}
+
+func (s *fakeGCSServer) insertObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		s.sendError(w, http.StatusNotImplemented)
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	var resource struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(part).Decode(&resource); err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	s.putObject(resource.Name, data, resource.ContentType, time.Now(), resource.Metadata)
+	s.sendJSON(w, s.getObjectResource(resource.Name, s.getObject(resource.Name)))
+}
+
+// patchObject merges the given metadata with the stored ones, a null value
+// removes the key, as the real API does
+func (s *fakeGCSServer) patchObject(w http.ResponseWriter, r *http.Request, name string) {
+	var resource struct {
+		Metadata map[string]*string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		s.sendError(w, http.StatusBadRequest)
+		return
+	}
+	s.Lock()
+	obj, ok := s.objects[name]
+	if ok {
+		if obj.metadata == nil {
+			obj.metadata = make(map[string]string)
+		}
+		for k, v := range resource.Metadata {
+			if v == nil {
+				delete(obj.metadata, k)
+			} else {
+				obj.metadata[k] = *v
+			}
+		}
+		obj.updated = time.Now().UTC().Truncate(time.Second)
+	}
+	s.Unlock()
+	if !ok {
+		s.sendError(w, http.StatusNotFound)
+		return
+	}
+	s.sendJSON(w, s.getObjectResource(name, obj))
+}
+
+// listObjects returns all the matching objects in a single page
+func (s *fakeGCSServer) listObjects(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	result := struct {
+		Kind     string                   `json:"kind"`
+		Items    []map[string]interface{} `json:"items,omitempty"`
+		Prefixes []string                 `json:"prefixes,omitempty"`
+	}{
+		Kind: "storage#objects",
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	names := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prefixes := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], delimiter); idx >= 0 {
+				p := name[:len(prefix)+idx+len(delimiter)]
+				if !prefixes[p] {
+					prefixes[p] = true
+					result.Prefixes = append(result.Prefixes, p)
+				}
+				continue
+			}
+		}
+		result.Items = append(result.Items, s.getObjectResource(name, s.objects[name]))
+	}
+	s.sendJSON(w, result)
+}
+
+func (s *fakeGCSServer) getObjectResource(name string, obj *fakeGCSObject) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      fakeGCSBucket,
+		"name":        name,
+		"size":        strconv.Itoa(len(obj.data)),
+		"contentType": obj.contentType,
+		"metadata":    obj.metadata,
+		"generation":  strconv.FormatInt(obj.generation, 10),
+		"updated":     obj.updated.Format(time.RFC3339),
+		"timeCreated": obj.updated.Format(time.RFC3339),
+	}
+}
+
+func (s *fakeGCSServer) sendJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+func (s *fakeGCSServer) sendError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": http.StatusText(status),
+		},
+	})
+}
@@ -0,0 +1,243 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	// ListerBatchSize defines the number of entries to request to a DirLister
+	// when the whole directory contents are needed
+	ListerBatchSize  = 1000
+	osListerPageSize = 1000
+)
+
+var errInvalidListerLimit = errors.New("invalid lister limit, it must be greater than zero")
+
+// DirLister defines an interface to read the contents of a directory page by
+// page, so huge directories can be listed without loading all the entries in
+// memory
+type DirLister interface {
+	// Next returns up to limit entries, limit must be greater than zero.
+	// Less than limit entries, or none at all, can be returned even if the
+	// listing is not complete. io.EOF is returned, together with the last
+	// entries if any, when the listing is complete
+	Next(limit int) ([]os.FileInfo, error)
+	// Close releases the resources associated to the lister, it is safe to
+	// call Close more than once
+	Close() error
+}
+
+// ReadAllDir reads all the remaining entries from the given lister and closes it
+func ReadAllDir(lister DirLister) ([]os.FileInfo, error) {
+	defer lister.Close()
+
+	var result []os.FileInfo
+	for {
+		files, err := lister.Next(ListerBatchSize)
+		result = append(result, files...)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readDirFromLister is an helper to implement ReadDir using OpenDir
+func readDirFromLister(lister DirLister, err error) ([]os.FileInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllDir(lister)
+}
+
+// pagedDirLister reads the directory entries one page at a time using the
+// given function, a new page is requested only if the already read entries
+// are not enough
+type pagedDirLister struct {
+	nextPage func() ([]os.FileInfo, bool, error)
+	onClose  func() error
+	entries  []os.FileInfo
+	hasMore  bool
+	closed   bool
+}
+
+// newPagedDirLister returns a DirLister that uses nextPage to read the entries.
+// nextPage returns the entries for a page and false if it was the last one.
+// onClose, if not nil, is called, only once, when the listing is complete or
+// on Close
+func newPagedDirLister(nextPage func() ([]os.FileInfo, bool, error), onClose func() error) *pagedDirLister {
+	return &pagedDirLister{
+		nextPage: nextPage,
+		onClose:  onClose,
+		hasMore:  true,
+	}
+}
+
+// newSliceDirLister returns a DirLister for the given entries, it is used by
+// the backends that are not able to read a directory one page at a time
+func newSliceDirLister(entries []os.FileInfo) *pagedDirLister {
+	return &pagedDirLister{
+		entries: entries,
+		closed:  true,
+	}
+}
+
+func (l *pagedDirLister) Next(limit int) ([]os.FileInfo, error) {
+	if limit <= 0 {
+		return nil, errInvalidListerLimit
+	}
+	for len(l.entries) < limit && l.hasMore {
+		page, hasMore, err := l.nextPage()
+		if err != nil {
+			l.entries = nil
+			l.hasMore = false
+			l.Close()
+			return nil, err
+		}
+		l.hasMore = hasMore
+		l.entries = append(l.entries, page...)
+	}
+	if len(l.entries) <= limit {
+		result := l.entries
+		l.entries = nil
+		if !l.hasMore {
+			l.Close()
+			return result, io.EOF
+		}
+		return result, nil
+	}
+	result := make([]os.FileInfo, limit)
+	copy(result, l.entries)
+	l.entries = l.entries[limit:]
+	return result, nil
+}
+
+func (l *pagedDirLister) Close() error {
+	l.hasMore = false
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.onClose != nil {
+		return l.onClose()
+	}
+	return nil
+}
+
+// newOsDirLister returns a DirLister for the given opened directory, the
+// directory is closed when the listing is complete
+func newOsDirLister(f *os.File) *pagedDirLister {
+	return newPagedDirLister(func() ([]os.FileInfo, bool, error) {
+		files, err := f.Readdir(osListerPageSize)
+		if err == io.EOF {
+			return files, false, nil
+		}
+		return files, err == nil, err
+	}, f.Close)
+}
+
+// transformDirLister applies the given function to each page returned by the
+// wrapped lister, the function can modify or filter the entries
+type transformDirLister struct {
+	DirLister
+	transform func([]os.FileInfo) []os.FileInfo
+}
+
+func newTransformDirLister(lister DirLister, transform func([]os.FileInfo) []os.FileInfo) *transformDirLister {
+	return &transformDirLister{
+		DirLister: lister,
+		transform: transform,
+	}
+}
+
+func (l *transformDirLister) Next(limit int) ([]os.FileInfo, error) {
+	files, err := l.DirLister.Next(limit)
+	if len(files) > 0 {
+		files = l.transform(files)
+	}
+	return files, err
+}
+
+// mergedDirLister adds the given entries to the ones returned by the wrapped
+// lister. An entry replaces the listed one with the same name, if any,
+// the entries not listed are returned at the end
+type mergedDirLister struct {
+	DirLister
+	names      []string
+	entries    map[string]os.FileInfo
+	keepDirs   bool
+	isComplete bool
+	pending    []os.FileInfo
+}
+
+// NewMergedDirLister returns a DirLister that adds the given entries, for
+// example the virtual folders, to the ones returned by lister.
+// The given entries replace the listed ones with the same name
+func NewMergedDirLister(lister DirLister, entries []os.FileInfo) DirLister {
+	return newMergedDirLister(lister, entries, false)
+}
+
+// newMergedDirLister returns a mergedDirLister. If keepDirs is true the listed
+// directories are not replaced and the entries with the same name are discarded
+func newMergedDirLister(lister DirLister, entries []os.FileInfo, keepDirs bool) DirLister {
+	if len(entries) == 0 {
+		return lister
+	}
+	l := &mergedDirLister{
+		DirLister: lister,
+		entries:   make(map[string]os.FileInfo),
+		keepDirs:  keepDirs,
+	}
+	for _, info := range entries {
+		if _, ok := l.entries[info.Name()]; !ok {
+			l.names = append(l.names, info.Name())
+		}
+		l.entries[info.Name()] = info
+	}
+	return l
+}
+
+func (l *mergedDirLister) Next(limit int) ([]os.FileInfo, error) {
+	if limit <= 0 {
+		return nil, errInvalidListerLimit
+	}
+	if l.isComplete {
+		return l.getPending(nil, limit)
+	}
+	files, err := l.DirLister.Next(limit)
+	for idx, info := range files {
+		if entry, ok := l.entries[info.Name()]; ok {
+			if !l.keepDirs || !info.IsDir() {
+				files[idx] = entry
+			}
+			delete(l.entries, info.Name())
+		}
+	}
+	if err != io.EOF {
+		return files, err
+	}
+	l.isComplete = true
+	for _, name := range l.names {
+		if entry, ok := l.entries[name]; ok {
+			l.pending = append(l.pending, entry)
+		}
+	}
+	return l.getPending(files, limit)
+}
+
+func (l *mergedDirLister) getPending(files []os.FileInfo, limit int) ([]os.FileInfo, error) {
+	n := limit - len(files)
+	if n > len(l.pending) {
+		n = len(l.pending)
+	}
+	files = append(files, l.pending[:n]...)
+	l.pending = l.pending[n:]
+	if len(l.pending) == 0 {
+		return files, io.EOF
+	}
+	return files, nil
+}
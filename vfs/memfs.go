@@ -0,0 +1,1158 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// memFsName is the name for the in memory Fs implementation
+	memFsName = "memfs"
+)
+
+// memStorage contains the files for all the in memory filesystems,
+// they are lost when the service restarts
+var memStorage = newMemStore()
+
+// MemoryFsConfig defines the configuration for the in memory filesystem
+type MemoryFsConfig struct {
+	// MaxSize is the maximum size, in bytes, allowed for the files stored
+	// inside the user home directory, the virtual folders are not included.
+	// 0 means no limit
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *MemoryFsConfig) Validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("invalid max_size: %v, it cannot be negative", c.MaxSize)
+	}
+	return nil
+}
+
+// MemoryFs is a Fs implementation that stores the files in RAM.
+// All the in memory filesystems share the same tree, the home directory and
+// the mapped paths for the virtual folders are absolute paths inside this
+// tree, so the same paths configured for the local filesystem can be used
+type MemoryFs struct {
+	connectionID   string
+	rootDir        string
+	virtualFolders []VirtualFolder
+	config         *MemoryFsConfig
+}
+
+// NewMemoryFs returns a MemoryFs object that allows to interact with files stored in memory
+func NewMemoryFs(connectionID, rootDir string, virtualFolders []VirtualFolder, config MemoryFsConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	folders := make([]VirtualFolder, 0, len(virtualFolders))
+	for _, v := range virtualFolders {
+		v.MappedPath = cleanMemFsPath(v.MappedPath)
+		folders = append(folders, v)
+	}
+	return &MemoryFs{
+		connectionID:   connectionID,
+		rootDir:        cleanMemFsPath(rootDir),
+		virtualFolders: folders,
+		config:         &config,
+	}, nil
+}
+
+// RemoveMemoryFsData removes the specified directory, and all its contents,
+// from the in memory storage
+func RemoveMemoryFsData(name string) {
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	node, err := memStorage.get(cleanMemFsPath(name))
+	if err == nil && node.parent != nil {
+		node.parent.detach(node)
+	}
+}
+
+// Name returns the name for the Fs implementation
+func (*MemoryFs) Name() string {
+	return memFsName
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs *MemoryFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *MemoryFs) Stat(name string) (os.FileInfo, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.stat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fs.getFileInfo(name, node), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *MemoryFs) Lstat(name string) (os.FileInfo, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.lstat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return fs.getFileInfo(name, node), nil
+}
+
+// Open opens the named file for reading
+func (*MemoryFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.stat(name)
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if node.isDir() {
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &memFile{name: name, node: node, readable: true}, nil, nil, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs *MemoryFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if flag == 0 {
+		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	p, err := memStorage.realPath(name)
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	node, err := memStorage.get(p)
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if node.isDir() {
+			return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_TRUNC != 0 {
+			node.truncate(0)
+		}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		parent, err := memStorage.getParent(p)
+		if err != nil {
+			return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		node = newMemNode(path.Base(p), 0644)
+		parent.addChild(node)
+	default:
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &memFile{
+		name:     name,
+		node:     node,
+		fs:       fs,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil, nil, nil
+}
+
+// Rename renames (moves) source to target
+func (fs *MemoryFs) Rename(source, target string) error {
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	sourcePath, err := memStorage.realParentPath(source)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	targetPath, err := memStorage.realParentPath(target)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	node, err := memStorage.get(sourcePath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	if sourcePath == targetPath {
+		return nil
+	}
+	if node.parent == nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EINVAL}
+	}
+	if node.isDir() && isMemFsSubPath(targetPath, sourcePath) {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EINVAL}
+	}
+	parent, err := memStorage.getParent(targetPath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	existing := parent.children[path.Base(targetPath)]
+	sizeDiff := node.size
+	if existing != nil {
+		if existing.isDir() {
+			if !node.isDir() {
+				return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EISDIR}
+			}
+			if len(existing.children) > 0 {
+				return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.ENOTEMPTY}
+			}
+		} else if node.isDir() {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.ENOTDIR}
+		}
+		sizeDiff -= existing.size
+	}
+	if !fs.isInsideRootDir(node) {
+		if err := fs.checkMaxSize(parent, sizeDiff); err != nil {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+		}
+	}
+	if existing != nil {
+		parent.detach(existing)
+	}
+	node.parent.detach(node)
+	node.name = path.Base(targetPath)
+	parent.addChild(node)
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (*MemoryFs) Remove(name string, isDir bool) error {
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	node, err := memStorage.lstat(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if node.parent == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EINVAL}
+	}
+	if node.isDir() && len(node.children) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	node.parent.detach(node)
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (*MemoryFs) Mkdir(name string) error {
+	return memStorage.createNode(name, newMemNode(path.Base(name), os.ModeDir|0755))
+}
+
+// Symlink creates source as a symbolic link to target.
+func (*MemoryFs) Symlink(source, target string) error {
+	node := newMemNode(path.Base(target), os.ModeSymlink|0777)
+	node.target = cleanMemFsPath(source)
+	return memStorage.createNode(target, node)
+}
+
+// Readlink returns the destination of the named symbolic link
+// as absolute virtual path
+func (fs *MemoryFs) Readlink(name string) (string, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.lstat(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if !node.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return fs.GetRelativePath(node.target), nil
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (*MemoryFs) Chown(name string, uid int, gid int) error {
+	return memStorage.updateNode("chown", name, func(node *memNode) error {
+		node.uid = uid
+		node.gid = gid
+		return nil
+	})
+}
+
+// Chmod changes the mode of the named file to mode
+func (*MemoryFs) Chmod(name string, mode os.FileMode) error {
+	return memStorage.updateNode("chmod", name, func(node *memNode) error {
+		node.mode = node.mode&^os.ModePerm | mode.Perm()
+		return nil
+	})
+}
+
+// Chtimes changes the access and modification times of the named file
+func (*MemoryFs) Chtimes(name string, atime, mtime time.Time) error {
+	return memStorage.updateNode("chtimes", name, func(node *memNode) error {
+		node.modTime = mtime
+		return nil
+	})
+}
+
+// Truncate changes the size of the named file
+func (fs *MemoryFs) Truncate(name string, size int64) error {
+	return memStorage.updateNode("truncate", name, func(node *memNode) error {
+		if node.isDir() {
+			return syscall.EISDIR
+		}
+		if size < 0 {
+			return syscall.EINVAL
+		}
+		if err := fs.checkMaxSize(node, size-node.size); err != nil {
+			return err
+		}
+		node.truncate(size)
+		return nil
+	})
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *MemoryFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.stat(dirname)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: err}
+	}
+	if !node.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	result := make([]os.FileInfo, 0, len(node.children))
+	for _, child := range node.children {
+		result = append(result, child.getFileInfo(child.name))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (fs *MemoryFs) OpenDir(dirname string) (DirLister, error) {
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newSliceDirLister(files), nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported
+func (*MemoryFs) IsUploadResumeSupported() bool {
+	return true
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported
+func (*MemoryFs) IsAtomicUploadSupported() bool {
+	return true
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*MemoryFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*MemoryFs) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*MemoryFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported
+}
+
+// CheckRootPath creates the root directory and the mapped paths for the
+// virtual folders if they don't exist
+func (fs *MemoryFs) CheckRootPath(username string, uid int, gid int) bool {
+	created, err := memStorage.mkdirAll(fs.rootDir)
+	if err != nil {
+		fsLog(fs, logger.LevelError, "unable to create root directory %#v for user %#v: %v", fs.rootDir, username, err)
+		return false
+	}
+	if created {
+		fsLog(fs, logger.LevelDebug, "root directory %#v for user %#v created", fs.rootDir, username)
+		SetPathPermissions(fs, fs.rootDir, uid, gid)
+	}
+	for _, v := range fs.virtualFolders {
+		for _, p := range []string{path.Join(fs.rootDir, v.VirtualPath), v.MappedPath} {
+			if _, err := memStorage.mkdirAll(p); err != nil {
+				fsLog(fs, logger.LevelError, "unable to create directory %#v for virtual folder %#v: %v",
+					p, v.VirtualPath, err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size
+func (fs *MemoryFs) ScanRootDirContents() (int, int64, error) {
+	numFiles, size, err := fs.GetDirSize(fs.rootDir)
+	for _, v := range fs.virtualFolders {
+		if !v.IsIncludedInUserQuota() {
+			continue
+		}
+		num, s, err := fs.GetDirSize(v.MappedPath)
+		if err != nil {
+			if fs.IsNotExist(err) {
+				fsLog(fs, logger.LevelWarn, "unable to scan contents for non-existent mapped path: %#v", v.MappedPath)
+				continue
+			}
+			return numFiles, size, err
+		}
+		numFiles += num
+		size += s
+	}
+	return numFiles, size, err
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *MemoryFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, dirname)
+	if err == nil && isDir {
+		err = fs.Walk(dirname, func(walkedPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info != nil && info.Mode().IsRegular() {
+				size += info.Size()
+				numFiles++
+			}
+			return err
+		})
+	}
+	return numFiles, size, err
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload
+func (*MemoryFs) GetAtomicUploadPath(name string) string {
+	dir := path.Dir(name)
+	guid := xid.New().String()
+	return path.Join(dir, ".sftpgo-upload."+guid+"."+path.Base(name))
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTP users
+func (fs *MemoryFs) GetRelativePath(name string) string {
+	name = cleanMemFsPath(name)
+	basePath := fs.rootDir
+	virtualPath := "/"
+	for _, v := range fs.virtualFolders {
+		if isMemFsSubPath(name, v.MappedPath) {
+			basePath = v.MappedPath
+			virtualPath = v.VirtualPath
+		}
+	}
+	if !isMemFsSubPath(name, basePath) {
+		return virtualPath
+	}
+	return path.Join(virtualPath, strings.TrimPrefix(name, basePath))
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root. The symlinks are not followed
+func (fs *MemoryFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = fs.walk(root, info, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (fs *MemoryFs) walk(name string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(name, info, nil)
+	}
+	files, err := fs.ReadDir(name)
+	err1 := walkFn(name, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, fi := range files {
+		err = fs.walk(path.Join(name, fi.Name()), fi, walkFn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins any number of path elements into a single path
+func (*MemoryFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path
+func (fs *MemoryFs) ResolvePath(sftpPath string) (string, error) {
+	basePath, p := fs.getFsPaths(sftpPath)
+
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	resolved, err := memStorage.realPath(p)
+	if err != nil {
+		return "", err
+	}
+	resolvedBase, err := memStorage.realPath(basePath)
+	if err != nil {
+		return "", err
+	}
+	if !isMemFsSubPath(resolved, resolvedBase) {
+		fsLog(fs, logger.LevelWarn, "Invalid path resolution, path %#v original path %#v resolved %#v is not inside %#v",
+			p, sftpPath, resolved, resolvedBase)
+		return "", fmt.Errorf("path %#v is not inside %#v", resolved, resolvedBase)
+	}
+	return p, nil
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*MemoryFs) HasVirtualFolders() bool {
+	return false
+}
+
+// GetMimeType returns the content type
+func (*MemoryFs) GetMimeType(name string) (string, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	node, err := memStorage.stat(name)
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if node.isDir() {
+		return dirMimeType, nil
+	}
+	data := node.data
+	if len(data) > 512 {
+		data = data[:512]
+	}
+	return http.DetectContentType(data), nil
+}
+
+// Close closes the fs
+func (*MemoryFs) Close() error {
+	return nil
+}
+
+// GetAvailableDiskSize return the available size for the specified path
+func (fs *MemoryFs) GetAvailableDiskSize(dirName string) (int64, error) {
+	if fs.config.MaxSize <= 0 {
+		return 0, errStorageSizeUnavailable
+	}
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	var used int64
+	if root, err := memStorage.get(fs.rootDir); err == nil {
+		used = root.size
+	}
+	if used >= fs.config.MaxSize {
+		return 0, nil
+	}
+	return fs.config.MaxSize - used, nil
+}
+
+// CopyObjects copies source, a file or a directory, to target
+func (fs *MemoryFs) CopyObjects(source, target string) (int, int64, error) {
+	return copyObjects(fs, source, target, fs.copyObject)
+}
+
+func (fs *MemoryFs) copyObject(source, target string, isDir bool) error {
+	if isDir {
+		_, err := memStorage.mkdirAll(target)
+		return err
+	}
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	node, err := memStorage.lstat(source)
+	if err != nil {
+		return &os.LinkError{Op: "copy", Old: source, New: target, Err: err}
+	}
+	targetPath, err := memStorage.realParentPath(target)
+	if err != nil {
+		return &os.LinkError{Op: "copy", Old: source, New: target, Err: err}
+	}
+	parent, _, err := memStorage.mkdirAllNoLock(path.Dir(targetPath))
+	if err != nil {
+		return &os.LinkError{Op: "copy", Old: source, New: target, Err: err}
+	}
+	sizeDiff := node.size
+	existing := parent.children[path.Base(targetPath)]
+	if existing != nil {
+		if existing.isDir() {
+			return &os.LinkError{Op: "copy", Old: source, New: target, Err: syscall.EISDIR}
+		}
+		sizeDiff -= existing.size
+	}
+	if err := fs.checkMaxSize(parent, sizeDiff); err != nil {
+		return &os.LinkError{Op: "copy", Old: source, New: target, Err: err}
+	}
+	if existing != nil {
+		parent.detach(existing)
+	}
+	parent.addChild(node.clone(path.Base(targetPath)))
+	return nil
+}
+
+// getFsPaths returns the base path and filesystem path for the given sftpPath.
+// base path is the root dir or matching the virtual folder dir for the sftpPath.
+// file path is the filesystem path matching the sftpPath
+func (fs *MemoryFs) getFsPaths(sftpPath string) (string, string) {
+	basePath := fs.rootDir
+	sftpPath = utils.CleanPath(sftpPath)
+	for _, val := range utils.GetDirsForSFTPPath(sftpPath) {
+		for _, v := range fs.virtualFolders {
+			if val == v.VirtualPath {
+				return v.MappedPath, path.Join(v.MappedPath, strings.TrimPrefix(sftpPath, v.VirtualPath))
+			}
+		}
+	}
+	return basePath, path.Join(basePath, sftpPath)
+}
+
+func (fs *MemoryFs) getFileInfo(name string, node *memNode) os.FileInfo {
+	for _, v := range fs.virtualFolders {
+		if v.MappedPath == name {
+			return NewFileInfo(v.VirtualPath, true, 0, node.modTime, false)
+		}
+	}
+	return node.getFileInfo(path.Base(name))
+}
+
+func (fs *MemoryFs) isInsideRootDir(node *memNode) bool {
+	root, err := memStorage.get(fs.rootDir)
+	if err != nil {
+		return false
+	}
+	return node.isInside(root)
+}
+
+// checkMaxSize returns an error if adding sizeDiff bytes inside the given
+// node exceeds the configured maximum size. The store lock must be held
+func (fs *MemoryFs) checkMaxSize(node *memNode, sizeDiff int64) error {
+	if fs.config.MaxSize <= 0 || sizeDiff <= 0 {
+		return nil
+	}
+	root, err := memStorage.get(fs.rootDir)
+	if err != nil || !node.isInside(root) {
+		return nil
+	}
+	if root.size+sizeDiff > fs.config.MaxSize {
+		fsLog(fs, logger.LevelDebug, "max size exceeded for root dir %#v, used: %v, requested: %v, max size: %v",
+			fs.rootDir, root.size, sizeDiff, fs.config.MaxSize)
+		return syscall.ENOSPC
+	}
+	return nil
+}
+
+// memNode is a file, a directory or a symlink stored in memory
+type memNode struct {
+	name     string
+	mode     os.FileMode
+	modTime  time.Time
+	uid      int
+	gid      int
+	data     []byte
+	target   string
+	parent   *memNode
+	children map[string]*memNode
+	// for files this is the size of the data, for directories this is the
+	// size of all the files inside them, subdirectories included
+	size int64
+}
+
+func newMemNode(name string, mode os.FileMode) *memNode {
+	node := &memNode{
+		name:    name,
+		mode:    mode,
+		modTime: time.Now(),
+		uid:     -1,
+		gid:     -1,
+	}
+	if node.isDir() {
+		node.children = make(map[string]*memNode)
+	}
+	return node
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+// isInside returns true if the node is the given directory or it is inside it
+func (n *memNode) isInside(dir *memNode) bool {
+	for p := n; p != nil; p = p.parent {
+		if p == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *memNode) getFileInfo(name string) FileInfo {
+	size := n.size
+	if n.isDir() {
+		size = 0
+	} else if n.isSymlink() {
+		size = int64(len(n.target))
+	}
+	return FileInfo{
+		name:        name,
+		sizeInBytes: size,
+		modTime:     n.modTime,
+		mode:        n.mode,
+		uid:         n.uid,
+		gid:         n.gid,
+	}
+}
+
+func (n *memNode) addSize(sizeDiff int64) {
+	for p := n; p != nil; p = p.parent {
+		p.size += sizeDiff
+	}
+}
+
+func (n *memNode) addChild(child *memNode) {
+	n.children[child.name] = child
+	child.parent = n
+	n.addSize(child.size)
+	n.modTime = time.Now()
+}
+
+func (n *memNode) detach(child *memNode) {
+	delete(n.children, child.name)
+	child.parent = nil
+	n.addSize(-child.size)
+	n.modTime = time.Now()
+}
+
+func (n *memNode) truncate(size int64) {
+	current := int64(len(n.data))
+	switch {
+	case size == 0:
+		n.data = nil
+	case size < current:
+		n.data = n.data[:size]
+	case size > current:
+		n.data = append(n.data, make([]byte, size-current)...)
+	}
+	n.addSize(size - current)
+	n.modTime = time.Now()
+}
+
+func (n *memNode) clone(name string) *memNode {
+	node := newMemNode(name, n.mode)
+	node.modTime = n.modTime
+	node.uid = n.uid
+	node.gid = n.gid
+	node.target = n.target
+	node.size = n.size
+	if len(n.data) > 0 {
+		node.data = make([]byte, len(n.data))
+		copy(node.data, n.data)
+	}
+	return node
+}
+
+// memStore is the tree containing the in memory files
+type memStore struct {
+	sync.RWMutex
+	root *memNode
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		root: newMemNode("/", os.ModeDir|0755),
+	}
+}
+
+// get returns the node with the given path, the symlinks are not followed.
+// The store lock must be held
+func (s *memStore) get(name string) (*memNode, error) {
+	node := s.root
+	for _, elem := range splitMemFsPath(name) {
+		if !node.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// getParent returns the parent directory for the given path.
+// The store lock must be held
+func (s *memStore) getParent(name string) (*memNode, error) {
+	parent, err := s.get(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	return parent, nil
+}
+
+// stat returns the node for the given path following the symlinks.
+// The store lock must be held
+func (s *memStore) stat(name string) (*memNode, error) {
+	p, err := s.realPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(p)
+}
+
+// lstat returns the node for the given path, the symlinks are followed for
+// the parent directories only. The store lock must be held
+func (s *memStore) lstat(name string) (*memNode, error) {
+	p, err := s.realParentPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(p)
+}
+
+// realPath returns the given path after following all the symlinks, the
+// missing path elements are added as they are. The store lock must be held
+func (s *memStore) realPath(name string) (string, error) {
+	elems := splitMemFsPath(name)
+	resolved := "/"
+	node := s.root
+	followed := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		var child *memNode
+		if node != nil && node.isDir() {
+			child = node.children[elem]
+		}
+		if child == nil || !child.isSymlink() {
+			resolved = path.Join(resolved, elem)
+			node = child
+			continue
+		}
+		followed++
+		if followed > maxSymlinksToFollow {
+			return "", errTooManySymlinks
+		}
+		elems = append(splitMemFsPath(child.target), elems...)
+		resolved = "/"
+		node = s.root
+	}
+	return resolved, nil
+}
+
+// realParentPath returns the given path after following the symlinks for the
+// parent directories. The store lock must be held
+func (s *memStore) realParentPath(name string) (string, error) {
+	name = cleanMemFsPath(name)
+	if name == "/" {
+		return name, nil
+	}
+	dir, err := s.realPath(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, path.Base(name)), nil
+}
+
+// createNode adds the given node, a directory or a symlink, with the specified path
+func (s *memStore) createNode(name string, node *memNode) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p, err := s.realParentPath(name)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	parent, err := s.getParent(p)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	if _, ok := parent.children[path.Base(p)]; ok {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	node.name = path.Base(p)
+	parent.addChild(node)
+	return nil
+}
+
+// updateNode calls fn for the node with the given path, following the symlinks
+func (s *memStore) updateNode(op, name string, fn func(node *memNode) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	node, err := s.stat(name)
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if err := fn(node); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// mkdirAll creates the given directory and any missing parent, it returns
+// true if the directory was created
+func (s *memStore) mkdirAll(name string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	_, created, err := s.mkdirAllNoLock(name)
+	return created, err
+}
+
+func (s *memStore) mkdirAllNoLock(name string) (*memNode, bool, error) {
+	p, err := s.realPath(name)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	node := s.root
+	created := false
+	for _, elem := range splitMemFsPath(p) {
+		child, ok := node.children[elem]
+		if !ok {
+			child = newMemNode(elem, os.ModeDir|0755)
+			node.addChild(child)
+			created = true
+		}
+		if !child.isDir() {
+			return nil, false, &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		node = child
+	}
+	return node, created, nil
+}
+
+// memFile implements the File interface for the files stored in memory
+type memFile struct {
+	sync.Mutex
+	name     string
+	node     *memNode
+	fs       *MemoryFs
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) checkOpen(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if write && !f.writable || !write && !f.readable {
+		return &os.PathError{Op: "access", Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.checkOpen(false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	n, err := f.writeAt(p, f.offset, f.append)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.writeAt(p, off, false)
+}
+
+func (f *memFile) writeAt(p []byte, off int64, isAppend bool) (int, error) {
+	if err := f.checkOpen(true); err != nil {
+		return 0, err
+	}
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	if isAppend {
+		off = int64(len(f.node.data))
+		f.offset = off
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	end := off + int64(len(p))
+	if current := int64(len(f.node.data)); end > current {
+		if err := f.fs.checkMaxSize(f.node, end-current); err != nil {
+			return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		f.node.truncate(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		memStorage.RLock()
+		offset += int64(len(f.node.data))
+		memStorage.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	memStorage.RLock()
+	defer memStorage.RUnlock()
+
+	return f.node.getFileInfo(path.Base(f.name)), nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.checkOpen(true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	memStorage.Lock()
+	defer memStorage.Unlock()
+
+	if err := f.fs.checkMaxSize(f.node, size-int64(len(f.node.data))); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	f.node.truncate(size)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// cleanMemFsPath returns the given path as absolute, slash separated, path
+func cleanMemFsPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func splitMemFsPath(name string) []string {
+	name = strings.TrimPrefix(cleanMemFsPath(name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// isMemFsSubPath returns true if name is dir or it is inside dir
+func isMemFsSubPath(name, dir string) bool {
+	if dir == "/" || name == dir {
+		return true
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
@@ -0,0 +1,342 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// maximum number of objects copied in parallel while copying or renaming a directory
+	serverSideCopyConcurrency = 10
+	// the copy progress is logged each time this number of objects is processed
+	serverSideCopyLogInterval = 500
+	// maximum number of objects inside a directory to copy or rename, the
+	// objects to process are kept in memory
+	serverSideCopyMaxObjects = 100000
+)
+
+var errTooManyObjects = errors.New("too many objects to copy")
+
+// objectCopier is implemented by the object storage filesystems that can copy
+// files and directories using server-side copy operations
+type objectCopier interface {
+	CopyObjects(source, target string) (int, int64, error)
+}
+
+// IsServerSideCopySupported returns true if fs can copy files and directories
+// using server-side copy operations
+func IsServerSideCopySupported(fs Fs) bool {
+	_, ok := fs.(objectCopier)
+	return ok
+}
+
+// CopyObjects copies source, a file or a directory, to target using server-side
+// copy operations. It returns the number of copied files and their size, they
+// are returned in case of error too so the quota can be updated for the files
+// copied before the error
+func CopyObjects(fs Fs, source, target string) (int, int64, error) {
+	if c, ok := fs.(objectCopier); ok {
+		return c.CopyObjects(source, target)
+	}
+	return 0, 0, ErrVfsUnsupported
+}
+
+type objectToCopy struct {
+	source string
+	target string
+	info   os.FileInfo
+}
+
+// copyObjectFn copies a single object using a server-side copy
+type copyObjectFn func(source, target string, isDir bool) error
+
+func copyObjects(fs Fs, source, target string, copyFn copyObjectFn) (int, int64, error) {
+	info, err := fs.Lstat(source)
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.IsDir() {
+		return copyPrefix(fs, source, target, false, copyFn)
+	}
+	if err := copyFn(source, target, false); err != nil {
+		return 0, 0, err
+	}
+	return 1, info.Size(), nil
+}
+
+// copyPrefix copies or, if removeSource is true, moves the source directory and
+// all its contents to target. Up to serverSideCopyConcurrency objects are copied
+// in parallel and the copy does not stop on the first error: the number and the
+// size of the copied files are returned together with an error reporting how
+// many objects were not processed.
+// A rename is done in two steps: all the objects are copied and the source
+// objects are removed only if every copy succeeded, otherwise the copied
+// objects are removed from target and the source directory is left untouched
+func copyPrefix(fs Fs, source, target string, removeSource bool, copyFn copyObjectFn) (int, int64, error) {
+	operation := "copy"
+	if removeSource {
+		operation = "rename"
+	}
+	if strings.HasPrefix(path.Clean("/"+target)+"/", path.Clean("/"+source)+"/") {
+		return 0, 0, fmt.Errorf("cannot %v the directory %#v inside itself", operation, source)
+	}
+	dirs, files, err := listObjectsToCopy(fs, source, target)
+	if err != nil {
+		return 0, 0, err
+	}
+	total := len(dirs) + len(files)
+	fsLog(fs, logger.LevelDebug, "%v %#v -> %#v started, objects to process: %v", operation, source, target, total)
+
+	if err := fs.Mkdir(target); err != nil {
+		return 0, 0, err
+	}
+	var numFiles, processed int
+	var size int64
+	// directories are copied before their contents
+	objects := append(dirs, files...)
+	copied := make([]bool, len(objects))
+	failed, firstErr := processObjects(fs, objects, func(idx int, obj objectToCopy) error {
+		if err := copyFn(obj.source, obj.target, obj.info.IsDir()); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to %v %#v -> %#v: %v", operation, obj.source, obj.target, err)
+			return err
+		}
+		copied[idx] = true
+		return nil
+	}, func() {
+		processed++
+		if processed%serverSideCopyLogInterval == 0 {
+			fsLog(fs, logger.LevelDebug, "%v %#v -> %#v in progress, processed objects: %v/%v",
+				operation, source, target, processed, total)
+		}
+	})
+	for idx, obj := range objects {
+		if copied[idx] && !obj.info.IsDir() {
+			numFiles++
+			size += obj.info.Size()
+		}
+	}
+	if failed > 0 {
+		fsLog(fs, logger.LevelDebug, "%v %#v -> %#v failed, processed objects: %v, errors: %v, copied files: %v, size: %v",
+			operation, source, target, processed, failed, numFiles, size)
+		if !removeSource {
+			return numFiles, size, fmt.Errorf("%v %#v -> %#v partially failed, %v of %v objects not processed, first error: %w",
+				operation, source, target, failed, total, firstErr)
+		}
+		return 0, 0, rollbackRename(fs, source, target, objects, copied, failed, firstErr)
+	}
+	if removeSource {
+		// the source objects are removed only after copying all of them, the
+		// deepest directories are removed after their contents
+		sourceObjects := make([]objectToCopy, 0, len(files))
+		for _, obj := range files {
+			sourceObjects = append(sourceObjects, objectToCopy{source: obj.source, target: obj.source, info: obj.info})
+		}
+		for _, obj := range dirs {
+			sourceObjects = append(sourceObjects, objectToCopy{source: obj.source, target: obj.source, info: obj.info})
+		}
+		sourceObjects = append(sourceObjects, objectToCopy{
+			source: source,
+			target: source,
+			info:   NewFileInfo(source, true, 0, time.Now(), false),
+		})
+		notRemoved, err := removeObjects(fs, sourceObjects)
+		if notRemoved > 0 {
+			fsLog(fs, logger.LevelWarn, "rename %#v -> %#v completed but %v source objects were not removed: %v",
+				source, target, notRemoved, err)
+			return numFiles, size, fmt.Errorf("rename %#v -> %#v completed but %v of %v source objects were not removed, first error: %w",
+				source, target, notRemoved, len(sourceObjects), err)
+		}
+	}
+	fsLog(fs, logger.LevelDebug, "%v %#v -> %#v completed, processed objects: %v, copied files: %v, size: %v",
+		operation, source, target, processed, numFiles, size)
+	return numFiles, size, nil
+}
+
+// rollbackRename removes from target the objects copied by a failed rename,
+// the source directory was not modified. It returns an error reporting the
+// failed copies and the copied objects that cannot be removed, if any
+func rollbackRename(fs Fs, source, target string, objects []objectToCopy, copied []bool, failed int, copyErr error) error {
+	toRemove := make([]objectToCopy, 0, len(objects)-failed+1)
+	for idx := len(objects) - 1; idx >= 0; idx-- {
+		if copied[idx] {
+			obj := objects[idx]
+			toRemove = append(toRemove, objectToCopy{source: obj.target, target: obj.target, info: obj.info})
+		}
+	}
+	toRemove = append(toRemove, objectToCopy{
+		source: target,
+		target: target,
+		info:   NewFileInfo(target, true, 0, time.Now(), false),
+	})
+	notRemoved, err := removeObjects(fs, toRemove)
+	if notRemoved > 0 {
+		fsLog(fs, logger.LevelWarn, "unable to rollback the failed rename %#v -> %#v, %v copied objects not removed: %v",
+			source, target, notRemoved, err)
+		return fmt.Errorf("rename %#v -> %#v failed, %v of %v objects not copied, first error: %w. "+
+			"Rollback failed, %v copied objects were not removed from the target directory",
+			source, target, failed, len(objects), copyErr, notRemoved)
+	}
+	fsLog(fs, logger.LevelDebug, "failed rename %#v -> %#v rolled back", source, target)
+	return fmt.Errorf("rename %#v -> %#v failed, %v of %v objects not copied, the copied objects were removed, first error: %w",
+		source, target, failed, len(objects), copyErr)
+}
+
+// removeObjects removes the given objects, the files are removed in parallel
+// and then the directories, the deepest first. It returns the number of
+// objects not removed and the first error
+func removeObjects(fs Fs, objects []objectToCopy) (int, error) {
+	var files, dirs []objectToCopy
+	for _, obj := range objects {
+		if obj.info.IsDir() {
+			dirs = append(dirs, obj)
+		} else {
+			files = append(files, obj)
+		}
+	}
+	failed, firstErr := processObjects(fs, files, func(_ int, obj objectToCopy) error {
+		if err := fs.Remove(obj.source, false); err != nil && !fs.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}, func() {})
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].source, "/") > strings.Count(dirs[j].source, "/")
+	})
+	for _, obj := range dirs {
+		// virtual directories have no object to remove
+		if err := fs.Remove(obj.source, true); err != nil && !fs.IsNotExist(err) {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return failed, firstErr
+}
+
+// processObjects calls processFn for each object, up to serverSideCopyConcurrency
+// objects are processed in parallel. onDone is called, serialized, after each
+// object is processed. It returns the number of failed objects and the first error
+func processObjects(fs Fs, objects []objectToCopy, processFn func(int, objectToCopy) error, onDone func()) (int, error) {
+	var failed int
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	guard := make(chan struct{}, serverSideCopyConcurrency)
+
+	for idx, obj := range objects {
+		guard <- struct{}{}
+		wg.Add(1)
+		go func(idx int, obj objectToCopy) {
+			defer func() {
+				<-guard
+				wg.Done()
+			}()
+
+			err := processFn(idx, obj)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			onDone()
+		}(idx, obj)
+	}
+	wg.Wait()
+	close(guard)
+
+	return failed, firstErr
+}
+
+// listObjectsToCopy returns the directories and the files inside source with
+// the matching target paths. The listing is kept in memory, so it fails if
+// source contains more than serverSideCopyMaxObjects objects
+func listObjectsToCopy(fs Fs, source, target string) ([]objectToCopy, []objectToCopy, error) {
+	var dirs, files []objectToCopy
+	prefix := getObjectsPrefix(source)
+	tooManyObjects := false
+	err := fs.Walk(source, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, ok := getObjectRelativePath(walkedPath, prefix)
+		if !ok {
+			return nil
+		}
+		if len(dirs)+len(files) >= serverSideCopyMaxObjects {
+			tooManyObjects = true
+			return errTooManyObjects
+		}
+		obj := objectToCopy{
+			source: walkedPath,
+			target: fs.Join(target, relPath),
+			info:   info,
+		}
+		// some providers use a trailing slash for directory objects
+		if strings.HasSuffix(relPath, "/") {
+			obj.target += "/"
+		}
+		if info.IsDir() {
+			dirs = append(dirs, obj)
+		} else {
+			files = append(files, obj)
+		}
+		return nil
+	})
+	// some providers stop the listing without returning the walk function error
+	if tooManyObjects {
+		return nil, nil, fmt.Errorf("%#v contains more than %v objects: %w", source, serverSideCopyMaxObjects,
+			errTooManyObjects)
+	}
+	return dirs, files, err
+}
+
+func getObjectsPrefix(dirname string) string {
+	prefix := strings.TrimPrefix(dirname, "/")
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// getObjectRelativePath returns the path relative to prefix for the given
+// walked object and false if the object is the prefix itself or it is outside
+func getObjectRelativePath(walkedPath, prefix string) (string, bool) {
+	name := strings.TrimPrefix(walkedPath, "/")
+	if !strings.HasPrefix(name, prefix) || name == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(name, prefix), true
+}
+
+// getDirSizeFromObjects returns the number of files and their size inside the
+// given directory listing all the objects with the directory prefix
+func getDirSizeFromObjects(fs Fs, dirname string) (int, int64, error) {
+	var numFiles int
+	var size int64
+	prefix := getObjectsPrefix(dirname)
+	err := fs.Walk(dirname, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := getObjectRelativePath(walkedPath, prefix); ok && !info.IsDir() {
+			numFiles++
+			size += info.Size()
+		}
+		return nil
+	})
+	return numFiles, size, err
+}
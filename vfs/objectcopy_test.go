@@ -0,0 +1,215 @@
+package vfs
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyObjects(t *testing.T) {
+	fs, rootDir := getObjectCopyTestFs(t)
+	source := path.Join(rootDir, "dir")
+	numFiles, size, err := CopyObjects(fs, source, path.Join(rootDir, "copy"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(10), size)
+	// the source is not modified
+	assertObjectCopyTestTree(t, fs, source)
+	assertObjectCopyTestTree(t, fs, path.Join(rootDir, "copy"))
+	// the sibling directory sharing the same prefix is not copied
+	_, err = fs.Stat(path.Join(rootDir, "copy", "dir1"))
+	assert.True(t, fs.IsNotExist(err))
+	// a single file
+	numFiles, size, err = CopyObjects(fs, path.Join(source, "f1"), path.Join(rootDir, "f1copy"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(1), size)
+	// a directory cannot be copied inside itself
+	_, _, err = CopyObjects(fs, source, path.Join(source, "sub"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "inside itself")
+	}
+	_, _, err = CopyObjects(fs, path.Join(rootDir, "missing"), path.Join(rootDir, "target"))
+	assert.True(t, fs.IsNotExist(err))
+
+	numFiles, size, err = getDirSizeFromObjects(fs, source)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(10), size)
+}
+
+func TestCopyPrefixPartialFailure(t *testing.T) {
+	fs, rootDir := getObjectCopyTestFs(t)
+	memFs := fs.(*MemoryFs)
+	errCopy := errors.New("copy error")
+	source := path.Join(rootDir, "dir")
+	target := path.Join(rootDir, "copy")
+	numFiles, size, err := copyPrefix(fs, source, target, false, func(src, dst string, isDir bool) error {
+		if path.Base(src) == "f3" {
+			return errCopy
+		}
+		return memFs.copyObject(src, dst, isDir)
+	})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, errCopy))
+		assert.Contains(t, err.Error(), "1 of 7 objects not processed")
+	}
+	// the copied files are reported and kept
+	assert.Equal(t, 3, numFiles)
+	assert.Equal(t, int64(7), size)
+	_, err = fs.Stat(path.Join(target, "sub", "nested", "f4"))
+	assert.NoError(t, err)
+	_, err = fs.Stat(path.Join(target, "sub", "f3"))
+	assert.True(t, fs.IsNotExist(err))
+	assertObjectCopyTestTree(t, fs, source)
+}
+
+func TestCopyPrefixRename(t *testing.T) {
+	fs, rootDir := getObjectCopyTestFs(t)
+	memFs := fs.(*MemoryFs)
+	source := path.Join(rootDir, "dir")
+	target := path.Join(rootDir, "renamed")
+	numFiles, size, err := copyPrefix(fs, source, target, true, memFs.copyObject)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(10), size)
+	assertObjectCopyTestTree(t, fs, target)
+	// the source objects are removed, the directories too
+	_, err = fs.Stat(source)
+	assert.True(t, fs.IsNotExist(err))
+	_, err = fs.Stat(path.Join(rootDir, "dir1", "f5"))
+	assert.NoError(t, err)
+}
+
+func TestCopyPrefixRenameRollback(t *testing.T) {
+	fs, rootDir := getObjectCopyTestFs(t)
+	memFs := fs.(*MemoryFs)
+	errCopy := errors.New("copy error")
+	source := path.Join(rootDir, "dir")
+	target := path.Join(rootDir, "renamed")
+	numFiles, size, err := copyPrefix(fs, source, target, true, func(src, dst string, isDir bool) error {
+		if path.Base(src) == "f4" {
+			return errCopy
+		}
+		return memFs.copyObject(src, dst, isDir)
+	})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, errCopy))
+		assert.Contains(t, err.Error(), "the copied objects were removed")
+	}
+	assert.Equal(t, 0, numFiles)
+	assert.Equal(t, int64(0), size)
+	// the copied objects are removed and the source is not modified
+	_, err = fs.Stat(target)
+	assert.True(t, fs.IsNotExist(err))
+	assertObjectCopyTestTree(t, fs, source)
+	// the target directory already exists
+	err = fs.Mkdir(target)
+	assert.NoError(t, err)
+	_, _, err = copyPrefix(fs, source, target, true, memFs.copyObject)
+	assert.Error(t, err)
+	assertObjectCopyTestTree(t, fs, source)
+}
+
+func TestCopyPrefixRenameSourceRemovalFailure(t *testing.T) {
+	fs, rootDir := getObjectCopyTestFs(t)
+	source := path.Join(rootDir, "dir")
+	target := path.Join(rootDir, "renamed")
+	errRemove := errors.New("remove error")
+	failingFs := &objectCopyRemoveErrorFs{
+		Fs:   fs,
+		name: path.Join(source, "sub", "f3"),
+		err:  errRemove,
+	}
+	numFiles, size, err := copyPrefix(failingFs, source, target, true, fs.(*MemoryFs).copyObject)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, errRemove))
+		assert.Contains(t, err.Error(), "completed but")
+	}
+	// the directory is renamed, the source objects not removed are reported
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(10), size)
+	assertObjectCopyTestTree(t, fs, target)
+	_, err = fs.Stat(path.Join(source, "sub", "f3"))
+	assert.NoError(t, err)
+	_, err = fs.Stat(path.Join(source, "f1"))
+	assert.True(t, fs.IsNotExist(err))
+}
+
+// objectCopyRemoveErrorFs is a Fs that fails to remove the specified file
+type objectCopyRemoveErrorFs struct {
+	Fs
+	name string
+	err  error
+}
+
+func (fs *objectCopyRemoveErrorFs) Remove(name string, isDir bool) error {
+	if name == fs.name {
+		return fs.err
+	}
+	if isDir && strings.HasPrefix(fs.name, name+"/") {
+		// a directory containing the file cannot be removed
+		return fs.err
+	}
+	return fs.Fs.Remove(name, isDir)
+}
+
+// getObjectCopyTestFs returns a MemoryFs with the following tree inside the
+// returned root directory:
+//
+// /dir/f1 (1 byte)
+// /dir/f2 (2 bytes)
+// /dir/sub/f3 (3 bytes)
+// /dir/sub/nested/f4 (4 bytes)
+// /dir/empty/
+// /dir1/f5 (5 bytes)
+func getObjectCopyTestFs(t *testing.T) (Fs, string) {
+	rootDir := path.Join("/objectcopytest", strings.ReplaceAll(t.Name(), "/", "_"))
+	fs, err := NewMemoryFs("", rootDir, nil, MemoryFsConfig{})
+	require.NoError(t, err)
+	_, err = memStorage.mkdirAll(rootDir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		memStorage.Lock()
+		defer memStorage.Unlock()
+
+		if node, err := memStorage.get(rootDir); err == nil {
+			node.parent.detach(node)
+		}
+	})
+	for _, dir := range []string{"dir", "dir/sub", "dir/sub/nested", "dir/empty", "dir1"} {
+		require.NoError(t, fs.Mkdir(path.Join(rootDir, dir)))
+	}
+	files := map[string]int{
+		"dir/f1":            1,
+		"dir/f2":            2,
+		"dir/sub/f3":        3,
+		"dir/sub/nested/f4": 4,
+		"dir1/f5":           5,
+	}
+	for name, size := range files {
+		f, _, _, err := fs.Create(path.Join(rootDir, name), 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(strings.Repeat("a", size)))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	return fs, rootDir
+}
+
+func assertObjectCopyTestTree(t *testing.T, fs Fs, dir string) {
+	for name, size := range map[string]int64{"f1": 1, "f2": 2, "sub/f3": 3, "sub/nested/f4": 4} {
+		info, err := fs.Stat(path.Join(dir, name))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, size, info.Size(), name)
+		}
+	}
+	info, err := fs.Stat(path.Join(dir, "empty"))
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+	}
+}
@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// metadataKeyLegalHold marks the objects with a native legal hold set by
+// SFTPGo. The value is the object key, so the marker copied to another
+// object, for example by a rename, is ignored
+const metadataKeyLegalHold = "sftpgo_legal_hold"
+
+// objectLocker is implemented by the filesystems that can natively lock the
+// stored files, so they cannot be modified or removed, also bypassing SFTPGo,
+// until the retention expires or while a legal hold is set
+type objectLocker interface {
+	IsObjectLockEnabled() bool
+	SetObjectLock(name string, retainUntil time.Time, legalHold bool) error
+	RemoveObjectLegalHold(name string, info os.FileInfo) error
+}
+
+// getObjectLocker returns the objectLocker below the layers wrapping fs, if
+// the object lock is enabled. The layers store the files with the names they
+// receive, so these names can be used for the wrapped filesystem as is
+func getObjectLocker(fs Fs) (objectLocker, bool) {
+	for {
+		if l, ok := fs.(objectLocker); ok {
+			return l, l.IsObjectLockEnabled()
+		}
+		layer, ok := fs.(fsLayer)
+		if !ok {
+			return nil, false
+		}
+		fs = layer.Unwrap()
+	}
+}
+
+// IsObjectLockEnabled returns true if fs, or the Fs wrapped by its layers,
+// can natively lock the stored files and this feature is enabled
+func IsObjectLockEnabled(fs Fs) bool {
+	_, ok := getObjectLocker(fs)
+	return ok
+}
+
+// SetObjectLock locks the named file until retainUntil, a zero time means no
+// retention period. If legalHold is true the file is locked until the legal
+// hold is removed
+func SetObjectLock(fs Fs, name string, retainUntil time.Time, legalHold bool) error {
+	if l, ok := getObjectLocker(fs); ok {
+		return l.SetObjectLock(name, retainUntil, legalHold)
+	}
+	return ErrVfsUnsupported
+}
+
+// RemoveObjectLegalHold removes the legal hold for the named file, info must
+// be returned by Stat or Lstat for this file. Only the legal holds set by
+// SFTPGo are removed, nothing is done for the other files. The retention
+// period cannot be removed
+func RemoveObjectLegalHold(fs Fs, name string, info os.FileInfo) error {
+	if l, ok := getObjectLocker(fs); ok {
+		return l.RemoveObjectLegalHold(name, info)
+	}
+	return ErrVfsUnsupported
+}
+
+func withLegalHoldMarker(key string) metadataUpdate {
+	return func(metadata map[string]string) {
+		setMetadataValue(metadata, metadataKeyLegalHold, strings.TrimPrefix(key, "/"))
+	}
+}
+
+// hasLegalHoldMarker returns true if info has the marker for a legal hold set
+// by SFTPGo for the object with the given key. The directory listings could
+// not include the marker
+func hasLegalHoldMarker(info os.FileInfo, key string) bool {
+	if compressedInfo, ok := info.(*compressedFileInfo); ok {
+		info = compressedInfo.FileInfo
+	}
+	fi, ok := info.(FileInfo)
+	return ok && fi.legalHoldKey != "" && fi.legalHoldKey == strings.TrimPrefix(key, "/")
+}
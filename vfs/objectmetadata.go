@@ -0,0 +1,142 @@
+package vfs
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadata keys used to store the file attributes set by the clients on the
+// object storage backends. The modification time is stored as seconds since
+// epoch, the same way as s3fs-fuse and rclone do, so the stored attributes
+// are understood by these tools too
+const (
+	metadataKeyMtime = "mtime"
+	metadataKeyMode  = "mode"
+	metadataKeyUID   = "uid"
+	metadataKeyGID   = "gid"
+)
+
+// getMetadataValue returns the value for the given key, the lookup is case
+// insensitive since some providers change the case of the metadata keys
+func getMetadataValue(metadata map[string]string, key string) (string, bool) {
+	if val, ok := metadata[key]; ok {
+		return val, true
+	}
+	for k, val := range metadata {
+		if strings.EqualFold(k, key) {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// setMetadataValue sets the given key removing any other key that differs
+// only for the case
+func setMetadataValue(metadata map[string]string, key, value string) {
+	for k := range metadata {
+		if k != key && strings.EqualFold(k, key) {
+			delete(metadata, k)
+		}
+	}
+	metadata[key] = value
+}
+
+// getMtimeFromMetadata returns the modification time stored inside the given
+// metadata, if any
+func getMtimeFromMetadata(metadata map[string]string) (time.Time, bool) {
+	val, ok := getMetadataValue(metadata, metadataKeyMtime)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseFloat(val, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), true
+}
+
+func getIntFromMetadata(metadata map[string]string, key string) (int, bool) {
+	val, ok := getMetadataValue(metadata, key)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// newObjectFileInfo returns a FileInfo for an object, the file attributes
+// stored as object metadata override the ones reported by the provider
+func newObjectFileInfo(name string, isDir bool, size int64, modTime time.Time, metadata map[string]string) FileInfo {
+	if mtime, ok := getMtimeFromMetadata(metadata); ok {
+		modTime = mtime
+	}
+	info := NewFileInfo(name, isDir, size, modTime, false)
+	if mode, ok := getIntFromMetadata(metadata, metadataKeyMode); ok {
+		info.mode = (info.mode &^ os.ModePerm) | (os.FileMode(mode) & os.ModePerm)
+	}
+	if uid, ok := getIntFromMetadata(metadata, metadataKeyUID); ok {
+		info.uid = uid
+	}
+	if gid, ok := getIntFromMetadata(metadata, metadataKeyGID); ok {
+		info.gid = gid
+	}
+	if key, ok := getMetadataValue(metadata, metadataKeyLegalHold); ok {
+		info.legalHoldKey = key
+	}
+	if !isDir {
+		if target, ok := getSymlinkTargetFromMetadata(metadata); ok {
+			info.mode = os.ModeSymlink | os.ModePerm
+			info.linkTarget = target
+		}
+	}
+	return info
+}
+
+// getETag returns the entity tag for the given object, if any
+func getETag(info os.FileInfo) string {
+	if fi, ok := info.(FileInfo); ok {
+		return fi.etag
+	}
+	return ""
+}
+
+// metadataUpdate defines the file attributes to store as object metadata
+type metadataUpdate func(metadata map[string]string)
+
+func withMtime(mtime time.Time) metadataUpdate {
+	return func(metadata map[string]string) {
+		setMetadataValue(metadata, metadataKeyMtime, strconv.FormatInt(mtime.Unix(), 10))
+	}
+}
+
+func withMode(mode os.FileMode) metadataUpdate {
+	return func(metadata map[string]string) {
+		setMetadataValue(metadata, metadataKeyMode, strconv.FormatUint(uint64(mode&os.ModePerm), 10))
+	}
+}
+
+func withOwner(uid, gid int) metadataUpdate {
+	return func(metadata map[string]string) {
+		if uid >= 0 {
+			setMetadataValue(metadata, metadataKeyUID, strconv.Itoa(uid))
+		}
+		if gid >= 0 {
+			setMetadataValue(metadata, metadataKeyGID, strconv.Itoa(gid))
+		}
+	}
+}
+
+// getUpdatedMetadata returns a copy of metadata with the given update applied
+func getUpdatedMetadata(metadata map[string]string, update metadataUpdate) map[string]string {
+	result := make(map[string]string)
+	for k, v := range metadata {
+		result[k] = v
+	}
+	update(result)
+	return result
+}
@@ -0,0 +1,179 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// metadata key used to store the target of the symlinks emulated on the
+	// object storage backends. The target is a virtual path, relative to the
+	// user root, and it is URL escaped since the metadata values must be ASCII
+	metadataKeySymlinkTarget = "symlink_target"
+	// content type for the objects used as symlinks
+	symlinkMimeType = "inode/symlink"
+	// maximum number of symlinks to follow while resolving a path
+	maxSymlinksToFollow = 20
+)
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// objectSymlinkFs is implemented by the object storage filesystems that can
+// emulate symlinks using marker objects
+type objectSymlinkFs interface {
+	Fs
+	// lstat returns a FileInfo describing the named object without following
+	// the emulated symlinks
+	lstat(name string) (os.FileInfo, error)
+	// getSymlinkTarget returns the target for the named object, the returned
+	// boolean is false if the object exists and it is not a symlink.
+	// Only the object with the given name is checked, so this is cheaper than lstat
+	getSymlinkTarget(name string) (string, bool, error)
+}
+
+func getSymlinkTargetFromMetadata(metadata map[string]string) (string, bool) {
+	val, ok := getMetadataValue(metadata, metadataKeySymlinkTarget)
+	if !ok || val == "" {
+		return "", false
+	}
+	target, err := url.PathUnescape(val)
+	if err != nil {
+		return "", false
+	}
+	// the target can never escape the user root
+	return path.Clean("/" + target), true
+}
+
+func getSymlinkMetadata(target string) map[string]string {
+	return map[string]string{
+		metadataKeySymlinkTarget: url.PathEscape(path.Clean("/" + target)),
+	}
+}
+
+// getFileInfoLinkTarget returns the target for a FileInfo describing an
+// emulated symlink
+func getFileInfoLinkTarget(info os.FileInfo) (string, bool) {
+	if fi, ok := info.(FileInfo); ok && fi.linkTarget != "" {
+		return fi.linkTarget, true
+	}
+	return "", false
+}
+
+// statObject returns a FileInfo describing the named object and the object
+// name after resolving the emulated symlinks. The symlinks in the parent
+// directories are always resolved, the last path element is followed only
+// if followLast is true. The parents are checked only if the object does
+// not exist, so resolving an existing path does not require additional requests
+func statObject(fs objectSymlinkFs, name string, followLast bool) (os.FileInfo, string, error) {
+	current := name
+	for followed := 0; followed <= maxSymlinksToFollow; followed++ {
+		info, err := fs.lstat(current)
+		if err == nil {
+			target, isLink := getFileInfoLinkTarget(info)
+			if !isLink || !followLast {
+				return info, current, nil
+			}
+			current, err = fs.ResolvePath(target)
+			if err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if !fs.IsNotExist(err) {
+			return nil, "", err
+		}
+		resolved, found, errParent := resolveParentSymlink(fs, current)
+		if errParent != nil {
+			return nil, "", errParent
+		}
+		if !found {
+			return nil, "", err
+		}
+		current = resolved
+	}
+	return nil, "", &os.PathError{Op: "stat", Path: name, Err: errTooManySymlinks}
+}
+
+// resolveParentSymlink replaces the first parent directory of the named object
+// that is an emulated symlink with its target
+func resolveParentSymlink(fs objectSymlinkFs, name string) (string, bool, error) {
+	virtualPath := fs.GetRelativePath(name)
+	dir := path.Dir(virtualPath)
+	if dir == "/" {
+		return name, false, nil
+	}
+	parent := ""
+	for _, elem := range strings.Split(strings.TrimPrefix(dir, "/"), "/") {
+		parent = path.Join("/", parent, elem)
+		p, err := fs.ResolvePath(parent)
+		if err != nil {
+			return "", false, err
+		}
+		target, isLink, err := fs.getSymlinkTarget(p)
+		if err != nil {
+			if fs.IsNotExist(err) {
+				continue
+			}
+			return "", false, err
+		}
+		if isLink {
+			resolved, err := fs.ResolvePath(path.Join(target, strings.TrimPrefix(virtualPath, parent)))
+			return resolved, true, err
+		}
+	}
+	return name, false, nil
+}
+
+// resolveObjectPath returns the object name to use to read the named file or
+// directory following the emulated symlinks. The given name is returned if
+// it cannot be resolved, the caller will return the appropriate error
+func resolveObjectPath(fs objectSymlinkFs, name string) string {
+	if fs.GetRelativePath(name) == "/" {
+		return name
+	}
+	_, resolved, err := statObject(fs, name, true)
+	if err != nil {
+		return name
+	}
+	return resolved
+}
+
+// readObjectSymlink returns the target, as virtual path, of the named
+// emulated symlink
+func readObjectSymlink(fs objectSymlinkFs, name string) (string, error) {
+	info, _, err := statObject(fs, name, false)
+	if err != nil {
+		return "", err
+	}
+	target, isLink := getFileInfoLinkTarget(info)
+	if !isLink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("not a symbolic link")}
+	}
+	return target, nil
+}
+
+// checkSymlinkCreation returns an error if the symlink name cannot be created
+func checkSymlinkCreation(fs objectSymlinkFs, name string) error {
+	_, err := fs.lstat(name)
+	if err == nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// setFileInfoName returns info with the given name, it is used to report the
+// followed symlinks with their name and the attributes of their target
+func setFileInfoName(info os.FileInfo, name string) os.FileInfo {
+	if fi, ok := info.(FileInfo); ok {
+		fi.name = path.Base(name)
+		return fi
+	}
+	return info
+}
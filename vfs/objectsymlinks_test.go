@@ -0,0 +1,205 @@
+// +build !nos3
+
+package vfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getSymlinksTestFs(t *testing.T) (*fakeS3Server, *S3Fs) {
+	server := newFakeS3Server(t)
+	fs := server.getFsWithConfig(t, S3FsConfig{
+		EmulateSymlinks: true,
+	})
+	server.putObject("dir/file", []byte("content"), time.Now(), nil)
+	server.putObject("dir/sub/file", []byte("sub content"), time.Now(), nil)
+	return server, fs
+}
+
+func createTestSymlink(t *testing.T, fs *S3Fs, target, name string) {
+	fsTarget, err := fs.ResolvePath(target)
+	require.NoError(t, err)
+	fsName, err := fs.ResolvePath(name)
+	require.NoError(t, err)
+	err = fs.Symlink(fsTarget, fsName)
+	require.NoError(t, err)
+}
+
+func readTestFile(fs *S3Fs, name string) ([]byte, error) {
+	_, r, cancelFn, err := fs.Open(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer cancelFn()
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestObjectSymlinkAbsoluteTarget(t *testing.T) {
+	server, fs := getSymlinksTestFs(t)
+	createTestSymlink(t, fs, "/dir/file", "/link")
+
+	obj := server.getObject("link")
+	require.NotNil(t, obj)
+	assert.Equal(t, symlinkMimeType, obj.contentType)
+	assert.Empty(t, obj.data)
+
+	info, err := fs.Lstat("/link")
+	require.NoError(t, err)
+	assert.Equal(t, "link", info.Name())
+	assert.Equal(t, int64(0), info.Size())
+	target, err := fs.Readlink("/link")
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/file", target)
+	// the symlink is followed and reported with its name
+	info, err = fs.Stat("/link")
+	require.NoError(t, err)
+	assert.Equal(t, "link", info.Name())
+	assert.Equal(t, int64(7), info.Size())
+	assert.False(t, info.IsDir())
+	data, err := readTestFile(fs, "/link")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), data)
+	// a link to a directory is followed to list it and to resolve the
+	// paths inside it
+	createTestSymlink(t, fs, "/dir", "/linkdir")
+	info, err = fs.Stat("/linkdir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	files, err := fs.ReadDir("/linkdir")
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	info, err = fs.Stat("/linkdir/sub/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	data, err = readTestFile(fs, "/linkdir/sub/file")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("sub content"), data)
+	// a dangling link
+	createTestSymlink(t, fs, "/missing", "/dangling")
+	_, err = fs.Lstat("/dangling")
+	assert.NoError(t, err)
+	_, err = fs.Stat("/dangling")
+	assert.True(t, fs.IsNotExist(err))
+	_, err = fs.Stat("/linkdir/missing")
+	assert.True(t, fs.IsNotExist(err))
+	// existing objects cannot be replaced
+	fsTarget, err := fs.ResolvePath("/dir/file")
+	require.NoError(t, err)
+	fsName, err := fs.ResolvePath("/link")
+	require.NoError(t, err)
+	err = fs.Symlink(fsTarget, fsName)
+	assert.True(t, os.IsExist(err))
+	// a regular file is not a symlink
+	_, err = fs.Readlink("/dir/file")
+	assert.Error(t, err)
+}
+
+func TestObjectSymlinkDotDotTarget(t *testing.T) {
+	server, fs := getSymlinksTestFs(t)
+	// the targets are relative to the user root and cannot escape it
+	createTestSymlink(t, fs, "/dir/sub/../file", "/link1")
+	target, err := fs.Readlink("/link1")
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/file", target)
+	data, err := readTestFile(fs, "/link1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), data)
+
+	createTestSymlink(t, fs, "../../dir/file", "/dir/sub/link2")
+	target, err = fs.Readlink("/dir/sub/link2")
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/file", target)
+	// the targets stored by other tools are cleaned the same way
+	server.putObject("link3", nil, time.Now(), getSymlinkMetadata("/dir"))
+	server.getObject("link3").metadata[metadataKeySymlinkTarget] = "..%2F..%2Fdir%2Fsub"
+	target, err = fs.Readlink("/link3")
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/sub", target)
+	info, err := fs.Stat("/link3/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	// ".." inside the followed path is resolved before following the links
+	info, err = fs.Stat("/link3/../dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size())
+}
+
+func TestObjectSymlinkChain(t *testing.T) {
+	_, fs := getSymlinksTestFs(t)
+	createTestSymlink(t, fs, "/dir/file", "/link1")
+	createTestSymlink(t, fs, "/link1", "/link2")
+	createTestSymlink(t, fs, "/link2", "/link3")
+
+	target, err := fs.Readlink("/link3")
+	require.NoError(t, err)
+	assert.Equal(t, "/link2", target)
+	info, err := fs.Stat("/link3")
+	require.NoError(t, err)
+	assert.Equal(t, "link3", info.Name())
+	assert.Equal(t, int64(7), info.Size())
+	data, err := readTestFile(fs, "/link3")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), data)
+	// chained links to directories, in the parent directories too
+	createTestSymlink(t, fs, "/dir", "/dirlink1")
+	createTestSymlink(t, fs, "/dirlink1/sub", "/dirlink2")
+	info, err = fs.Stat("/dirlink2/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	createTestSymlink(t, fs, "/dirlink2/file", "/dirlink1/sublink")
+	data, err = readTestFile(fs, "/dirlink1/sublink")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("sub content"), data)
+	// the links are not followed to create objects
+	_, err = fs.Stat("/dir/sublink")
+	assert.True(t, fs.IsNotExist(err))
+	// up to maxSymlinksToFollow links are followed
+	prev := "/dir/file"
+	for i := 0; i < maxSymlinksToFollow; i++ {
+		name := fmt.Sprintf("/chain%v", i)
+		createTestSymlink(t, fs, prev, name)
+		prev = name
+	}
+	_, err = fs.Stat(prev)
+	assert.NoError(t, err)
+	createTestSymlink(t, fs, prev, "/chaintoolong")
+	_, err = fs.Stat("/chaintoolong")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), errTooManySymlinks.Error())
+	}
+}
+
+func TestObjectSymlinkLoop(t *testing.T) {
+	_, fs := getSymlinksTestFs(t)
+	createTestSymlink(t, fs, "/self", "/self")
+	createTestSymlink(t, fs, "/loop2", "/loop1")
+	createTestSymlink(t, fs, "/loop1", "/loop2")
+	// a directory link pointing inside itself
+	createTestSymlink(t, fs, "/dirloop/sub", "/dirloop")
+
+	for _, name := range []string{"/self", "/loop1", "/loop2", "/dirloop", "/dirloop/file", "/loop1/file"} {
+		_, err := fs.Stat(name)
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), errTooManySymlinks.Error(), name)
+		}
+	}
+	// the links can be read without following them
+	info, err := fs.Lstat("/loop1")
+	require.NoError(t, err)
+	assert.Equal(t, "loop1", info.Name())
+	target, err := fs.Readlink("/loop1")
+	require.NoError(t, err)
+	assert.Equal(t, "/loop2", target)
+	// the root directory listing is not affected
+	files, err := fs.ReadDir("/")
+	require.NoError(t, err)
+	assert.Len(t, files, 5)
+}
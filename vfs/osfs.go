@@ -119,6 +119,11 @@ func (*OsFs) Symlink(source, target string) error {
 	return os.Symlink(source, target)
 }
 
+// Link creates newname as a hard link to the oldname file
+func (*OsFs) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
 // Readlink returns the destination of the named symbolic link
 // as absolute virtual path
 func (fs *OsFs) Readlink(name string) (string, error) {
@@ -164,6 +169,16 @@ func (*OsFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	return list, nil
 }
 
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (*OsFs) OpenDir(dirname string) (DirLister, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newOsDirLister(f), nil
+}
+
 // IsUploadResumeSupported returns true if upload resume is supported
 func (*OsFs) IsUploadResumeSupported() bool {
 	return true
@@ -317,7 +332,8 @@ func (fs *OsFs) GetDirSize(dirname string) (int, int64, error) {
 				return err
 			}
 			if info != nil && info.Mode().IsRegular() {
-				size += info.Size()
+				// the files moved to the tiering target are included with their original size
+				size += getTieredFileInfo(path, info).Size()
 				numFiles++
 			}
 			return err
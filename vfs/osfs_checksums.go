@@ -0,0 +1,67 @@
+// +build linux darwin freebsd netbsd
+
+package vfs
+
+import (
+	"encoding/json"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// extended attribute used to store the checksums of the uploaded files
+const checksumsXattrName = "user.sftpgo.checksums"
+
+// storedChecksums is the extended attribute content, the size and the
+// modification time of the file are stored too, the checksums are considered
+// valid only if they don't change
+type storedChecksums struct {
+	Size      int64             `json:"size"`
+	FileSize  int64             `json:"file_size"`
+	ModTime   int64             `json:"mtime"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+// SetChecksums stores the checksums for the named file as extended attribute
+func (*OsFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(storedChecksums{
+		Size:      size,
+		FileSize:  info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Checksums: checksums,
+	})
+	if err != nil {
+		return err
+	}
+	return unix.Setxattr(name, checksumsXattrName, data, 0)
+}
+
+// GetChecksum returns the checksum stored for the named file and the given
+// algorithm if the file was not modified after storing it
+func (*OsFs) GetChecksum(name, algo string) (string, int64, bool) {
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", 0, false
+	}
+	buf := make([]byte, 4096)
+	n, err := unix.Getxattr(name, checksumsXattrName, buf)
+	if err != nil {
+		return "", 0, false
+	}
+	var stored storedChecksums
+	if err := json.Unmarshal(buf[:n], &stored); err != nil {
+		return "", 0, false
+	}
+	if stored.FileSize != info.Size() || stored.ModTime != info.ModTime().UnixNano() {
+		return "", 0, false
+	}
+	checksum, ok := stored.Checksums[algo]
+	if !ok || checksum == "" {
+		return "", 0, false
+	}
+	return checksum, stored.Size, true
+}
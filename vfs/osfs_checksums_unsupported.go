@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package vfs
+
+// SetChecksums is not supported on this platform, extended attributes are not available
+func (*OsFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	return ErrVfsUnsupported
+}
+
+// GetChecksum is not supported on this platform, extended attributes are not available
+func (*OsFs) GetChecksum(name, algo string) (string, int64, bool) {
+	return "", 0, false
+}
@@ -0,0 +1,802 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// overlayFsName is the name for the overlay Fs implementation
+	overlayFsName = "overlayfs"
+	// a file named ".wh.<name>" inside the upper layer hides <name> from the lower layer
+	overlayWhiteoutPrefix = ".wh."
+	// a directory containing this file inside the upper layer hides all the lower layer contents
+	overlayOpaqueName = ".wh..wh..opq"
+)
+
+// OverlayFsConfig defines the configuration to use the user filesystem as the
+// writable upper layer on top of a read-only local directory
+type OverlayFsConfig struct {
+	// LowerPath is the absolute path of the local directory to use as read-only
+	// lower layer. Leave empty to disable the overlay
+	LowerPath string `json:"lower_path,omitempty"`
+}
+
+// IsEnabled returns true if an overlay is configured
+func (c *OverlayFsConfig) IsEnabled() bool {
+	return c.LowerPath != ""
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *OverlayFsConfig) Validate() error {
+	if c.LowerPath == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.LowerPath) {
+		return errors.New("lower_path must be an absolute path")
+	}
+	c.LowerPath = filepath.Clean(c.LowerPath)
+	return nil
+}
+
+// OverlayFs is a Fs implementation that merges a writable upper layer, that
+// can be any other Fs implementation, with a read-only local lower layer.
+// Files are copied to the upper layer before modifying them and removed lower
+// layer files are hidden using whiteout files stored inside the upper layer.
+// The paths handled by this Fs are the ones resolved by the upper layer.
+type OverlayFs struct {
+	connectionID string
+	upper        Fs
+	lower        Fs
+}
+
+// NewOverlayFs returns an OverlayFs object that allows to overlay the given
+// upper filesystem on top of the lower path defined inside the configuration
+func NewOverlayFs(connectionID string, upper Fs, config OverlayFsConfig) Fs {
+	return &OverlayFs{
+		connectionID: connectionID,
+		upper:        upper,
+		lower:        NewOsFs(connectionID, config.LowerPath, nil),
+	}
+}
+
+// Name returns the name for the Fs implementation
+func (*OverlayFs) Name() string {
+	return overlayFsName
+}
+
+// Unwrap returns the upper layer
+func (o *OverlayFs) Unwrap() Fs {
+	return o.upper
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (o *OverlayFs) ConnectionID() string {
+	return o.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (o *OverlayFs) Stat(name string) (os.FileInfo, error) {
+	return o.stat(name, "stat")
+}
+
+// Lstat returns a FileInfo describing the named file
+func (o *OverlayFs) Lstat(name string) (os.FileInfo, error) {
+	return o.stat(name, "lstat")
+}
+
+// Open opens the named file for reading
+func (o *OverlayFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if isOverlayMetadata(name) {
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	found, err := o.isInUpperLayer(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if found {
+		return o.upper.Open(name, offset)
+	}
+	lowerPath, err := o.getLowerPath(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return o.lower.Open(lowerPath, offset)
+}
+
+// Create creates or opens the named file for writing inside the upper layer.
+// If the file is opened without truncating it and it exists only inside the
+// lower layer it is copied to the upper one first
+func (o *OverlayFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if isOverlayMetadata(name) {
+		return nil, nil, nil, &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
+	}
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		if err := o.copyUp(name); err != nil && !o.IsNotExist(err) {
+			return nil, nil, nil, err
+		}
+	}
+	if err := o.prepareUpperPath(name); err != nil {
+		return nil, nil, nil, err
+	}
+	return o.upper.Create(name, flag)
+}
+
+// Rename renames (moves) source to target.
+// Directories with contents inside the lower layer cannot be renamed
+func (o *OverlayFs) Rename(source, target string) error {
+	if isOverlayMetadata(source) || isOverlayMetadata(target) {
+		return &os.PathError{Op: "rename", Path: source, Err: os.ErrPermission}
+	}
+	sourceLowerPath, errLower := o.getLowerPath(source)
+	isInLower := errLower == nil
+	info, err := o.upper.Lstat(source)
+	if err != nil && !o.upper.IsNotExist(err) {
+		return err
+	}
+	isInUpper := err == nil
+	if !isInUpper {
+		if !isInLower {
+			return errLower
+		}
+		info, err = o.lower.Lstat(sourceLowerPath)
+		if err != nil {
+			return err
+		}
+	}
+	if info.IsDir() && isInLower {
+		fsLog(o, logger.LevelDebug, "renaming directory %#v is not supported: it has contents inside the lower layer",
+			source)
+		return ErrVfsUnsupported
+	}
+	if !isInUpper && !info.Mode().IsRegular() {
+		return ErrVfsUnsupported
+	}
+	hasLowerTarget := o.hasLowerEntry(target)
+	if err = o.prepareUpperPath(target); err != nil {
+		return err
+	}
+	if isInUpper {
+		err = o.upper.Rename(source, target)
+	} else {
+		err = o.copyLowerFile(sourceLowerPath, target, info)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && hasLowerTarget {
+		if err = o.writeUpperFile(o.upper.Join(target, overlayOpaqueName)); err != nil {
+			return err
+		}
+	}
+	if isInLower {
+		return o.createWhiteout(source)
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+// Lower layer entries are hidden using a whiteout
+func (o *OverlayFs) Remove(name string, isDir bool) error {
+	if isOverlayMetadata(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	_, errLower := o.getLowerPath(name)
+	isInLower := errLower == nil
+	if isDir {
+		contents, err := o.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	isInUpper, err := o.isInUpperLayer(name)
+	if err != nil {
+		return err
+	}
+	if isInUpper {
+		if isDir {
+			if err := o.removeUpperMetadata(name); err != nil {
+				return err
+			}
+		}
+		if err := o.upper.Remove(name, isDir); err != nil {
+			return err
+		}
+	} else if !isInLower {
+		return errLower
+	}
+	if isInLower {
+		return o.createWhiteout(name)
+	}
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name inside the upper layer
+func (o *OverlayFs) Mkdir(name string) error {
+	if isOverlayMetadata(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+	}
+	if _, err := o.Lstat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	// the merged view does not contain name so a lower layer entry, if any, is hidden
+	hasLowerEntry := o.hasLowerEntry(name)
+	if err := o.prepareUpperPath(name); err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(name); err != nil {
+		return err
+	}
+	if hasLowerEntry {
+		return o.writeUpperFile(o.upper.Join(name, overlayOpaqueName))
+	}
+	return nil
+}
+
+// Symlink creates source as a symbolic link to target inside the upper layer
+func (o *OverlayFs) Symlink(source, target string) error {
+	if isOverlayMetadata(target) {
+		return &os.PathError{Op: "symlink", Path: target, Err: os.ErrPermission}
+	}
+	if err := o.prepareUpperPath(target); err != nil {
+		return err
+	}
+	return o.upper.Symlink(source, target)
+}
+
+// Readlink returns the destination of the named symbolic link
+func (o *OverlayFs) Readlink(name string) (string, error) {
+	isInUpper, err := o.isInUpperLayer(name)
+	if err != nil {
+		return "", err
+	}
+	if isInUpper {
+		return o.upper.Readlink(name)
+	}
+	lowerPath, err := o.getLowerPath(name)
+	if err != nil {
+		return "", err
+	}
+	return o.lower.Readlink(lowerPath)
+}
+
+// Chown changes the numeric uid and gid of the named file.
+// Lower layer files are copied to the upper layer first
+func (o *OverlayFs) Chown(name string, uid int, gid int) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode.
+// Lower layer files are copied to the upper layer first
+func (o *OverlayFs) Chmod(name string, mode os.FileMode) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+// Lower layer files are copied to the upper layer first
+func (o *OverlayFs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chtimes(name, atime, mtime)
+}
+
+// Truncate changes the size of the named file.
+// Lower layer files are copied to the upper layer first
+func (o *OverlayFs) Truncate(name string, size int64) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Truncate(name, size)
+}
+
+// ReadDir reads the directory named by dirname and returns the merged
+// contents of the upper and lower layers
+func (o *OverlayFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return readDirFromLister(o.OpenDir(dirname))
+}
+
+// OpenDir returns a DirLister for the merged contents of the upper and lower
+// layers. The upper layer is read at once, the lower layer one page at a time
+func (o *OverlayFs) OpenDir(dirname string) (DirLister, error) {
+	upperContents, err := o.upper.ReadDir(dirname)
+	if err != nil && !o.upper.IsNotExist(err) {
+		return nil, err
+	}
+	isInUpper := err == nil
+	errUpper := err
+	var result []os.FileInfo
+	names := make(map[string]bool)
+	whiteouts := make(map[string]bool)
+	isOpaque := false
+	for _, info := range upperContents {
+		name := info.Name()
+		if name == overlayOpaqueName {
+			isOpaque = true
+			continue
+		}
+		if strings.HasPrefix(name, overlayWhiteoutPrefix) {
+			whiteouts[strings.TrimPrefix(name, overlayWhiteoutPrefix)] = true
+			continue
+		}
+		names[name] = true
+		result = append(result, info)
+	}
+	if isOpaque {
+		return newSliceDirLister(result), nil
+	}
+	lowerPath, err := o.getLowerPath(dirname)
+	if err != nil {
+		if isInUpper {
+			return newSliceDirLister(result), nil
+		}
+		return nil, errUpper
+	}
+	lowerLister, err := o.lower.OpenDir(lowerPath)
+	if err != nil {
+		if isInUpper {
+			return newSliceDirLister(result), nil
+		}
+		return nil, err
+	}
+	isUpperListed := false
+	return newPagedDirLister(func() ([]os.FileInfo, bool, error) {
+		if !isUpperListed {
+			isUpperListed = true
+			return result, true, nil
+		}
+		files, err := lowerLister.Next(ListerBatchSize)
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		lowerContents := make([]os.FileInfo, 0, len(files))
+		for _, info := range files {
+			if names[info.Name()] || whiteouts[info.Name()] {
+				continue
+			}
+			lowerContents = append(lowerContents, info)
+		}
+		return lowerContents, err == nil, nil
+	}, lowerLister.Close), nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported by the upper layer
+func (o *OverlayFs) IsUploadResumeSupported() bool {
+	return o.upper.IsUploadResumeSupported()
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported by the upper layer
+func (o *OverlayFs) IsAtomicUploadSupported() bool {
+	return o.upper.IsAtomicUploadSupported()
+}
+
+// CheckRootPath creates the upper layer root directory if it does not exists
+// and checks that the lower layer root directory exists
+func (o *OverlayFs) CheckRootPath(username string, uid int, gid int) bool {
+	if !o.upper.CheckRootPath(username, uid, gid) {
+		return false
+	}
+	lowerRoot, err := o.lower.ResolvePath("/")
+	if err == nil {
+		_, err = o.lower.Stat(lowerRoot)
+	}
+	if err != nil {
+		fsLog(o, logger.LevelWarn, "unable to access the lower layer for user %#v: %v", username, err)
+		return false
+	}
+	return true
+}
+
+// ResolvePath returns the matching upper layer path for the specified virtual path
+func (o *OverlayFs) ResolvePath(virtualPath string) (string, error) {
+	return o.upper.ResolvePath(virtualPath)
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (o *OverlayFs) IsNotExist(err error) bool {
+	return o.upper.IsNotExist(err) || os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (o *OverlayFs) IsPermission(err error) bool {
+	return o.upper.IsPermission(err) || os.IsPermission(err)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (o *OverlayFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported || o.upper.IsNotSupported(err)
+}
+
+// ScanRootDirContents returns the number of files contained in the upper
+// layer and their size. Lower layer files are not included
+func (o *OverlayFs) ScanRootDirContents() (int, int64, error) {
+	numFiles, size, err := o.upper.ScanRootDirContents()
+	if err != nil {
+		return numFiles, size, err
+	}
+	root, err := o.upper.ResolvePath("/")
+	if err != nil {
+		return numFiles, size, err
+	}
+	metadataFiles, err := o.countUpperMetadata(root)
+	return numFiles - metadataFiles, size, err
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders. Only the upper layer is considered
+func (o *OverlayFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles, size, err := o.upper.GetDirSize(dirname)
+	if err != nil {
+		return numFiles, size, err
+	}
+	metadataFiles, err := o.countUpperMetadata(dirname)
+	return numFiles - metadataFiles, size, err
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload
+func (o *OverlayFs) GetAtomicUploadPath(name string) string {
+	if isOverlayMetadata(name) {
+		// the upload will fail, whiteouts cannot be created from the clients
+		return name
+	}
+	return o.upper.GetAtomicUploadPath(name)
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTPGo users
+func (o *OverlayFs) GetRelativePath(name string) string {
+	return o.upper.GetRelativePath(name)
+}
+
+// Walk walks the merged file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (o *OverlayFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := o.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return o.walk(root, info, walkFn)
+}
+
+// Join joins any number of path elements into a single path
+func (o *OverlayFs) Join(elem ...string) string {
+	return o.upper.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (o *OverlayFs) HasVirtualFolders() bool {
+	return o.upper.HasVirtualFolders()
+}
+
+// GetMimeType returns the content type
+func (o *OverlayFs) GetMimeType(name string) (string, error) {
+	isInUpper, err := o.isInUpperLayer(name)
+	if err != nil {
+		return "", err
+	}
+	if isInUpper {
+		return o.upper.GetMimeType(name)
+	}
+	lowerPath, err := o.getLowerPath(name)
+	if err != nil {
+		return "", err
+	}
+	return o.lower.GetMimeType(lowerPath)
+}
+
+// GetAvailableDiskSize return the available size for the specified path
+func (o *OverlayFs) GetAvailableDiskSize(dirName string) (int64, error) {
+	return o.upper.GetAvailableDiskSize(dirName)
+}
+
+// Close closes the fs
+func (o *OverlayFs) Close() error {
+	o.lower.Close() //nolint:errcheck // the local fs has nothing to close
+	return o.upper.Close()
+}
+
+// HasPartialUpload returns true if name is an interrupted upload, inside the
+// upper layer, that can be resumed
+func (o *OverlayFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(o.upper, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload, inside the upper layer,
+// for the given name, if any
+func (o *OverlayFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(o.upper, name)
+}
+
+// IsLowerOnlyFile returns true if name is a regular file that exists only
+// inside the read-only lower layer, such files are not included in the quota
+func (o *OverlayFs) IsLowerOnlyFile(name string) bool {
+	if isInUpper, err := o.isInUpperLayer(name); err != nil || isInUpper {
+		return false
+	}
+	lowerPath, err := o.getLowerPath(name)
+	if err != nil {
+		return false
+	}
+	info, err := o.lower.Lstat(lowerPath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (o *OverlayFs) stat(name, op string) (os.FileInfo, error) {
+	if isOverlayMetadata(name) {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	var info os.FileInfo
+	var err error
+	if op == "lstat" {
+		info, err = o.upper.Lstat(name)
+	} else {
+		info, err = o.upper.Stat(name)
+	}
+	if err == nil || !o.upper.IsNotExist(err) {
+		return info, err
+	}
+	lowerPath, errLower := o.getLowerPath(name)
+	if errLower != nil {
+		return nil, err
+	}
+	if op == "lstat" {
+		return o.lower.Lstat(lowerPath)
+	}
+	return o.lower.Stat(lowerPath)
+}
+
+func (o *OverlayFs) walk(name string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(name, info, nil)
+	}
+	contents, err := o.ReadDir(name)
+	if err := walkFn(name, info, err); err != nil || contents == nil {
+		return err
+	}
+	for _, fi := range contents {
+		err = o.walk(o.upper.Join(name, fi.Name()), fi, walkFn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFs) isInUpperLayer(name string) (bool, error) {
+	_, err := o.upper.Lstat(name)
+	if err == nil {
+		return true, nil
+	}
+	if o.upper.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// getLowerPath returns the lower layer path for the specified upper layer path.
+// An error is returned if the path does not exist inside the lower layer or if
+// it is hidden by a whiteout
+func (o *OverlayFs) getLowerPath(name string) (string, error) {
+	relPath := o.upper.GetRelativePath(name)
+	lowerPath, err := o.lower.ResolvePath(relPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err = o.lower.Lstat(lowerPath); err != nil {
+		return "", err
+	}
+	if o.isHidden(relPath) {
+		return "", &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return lowerPath, nil
+}
+
+// hasLowerEntry returns true if the lower layer has an entry for the specified
+// upper layer path, hidden or not
+func (o *OverlayFs) hasLowerEntry(name string) bool {
+	lowerPath, err := o.lower.ResolvePath(o.upper.GetRelativePath(name))
+	if err != nil {
+		return false
+	}
+	_, err = o.lower.Lstat(lowerPath)
+	return err == nil
+}
+
+// isHidden returns true if the specified relative path, or one of its parent
+// directories, has a whiteout or is inside an opaque directory
+func (o *OverlayFs) isHidden(relPath string) bool {
+	for p := relPath; p != "/" && p != "." && p != ""; p = path.Dir(p) {
+		if o.existsInUpper(path.Join(path.Dir(p), overlayWhiteoutPrefix+path.Base(p))) {
+			return true
+		}
+		if parent := path.Dir(p); parent != "/" && o.existsInUpper(path.Join(parent, overlayOpaqueName)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OverlayFs) existsInUpper(relPath string) bool {
+	p, err := o.upper.ResolvePath(relPath)
+	if err != nil {
+		return false
+	}
+	_, err = o.upper.Lstat(p)
+	return err == nil
+}
+
+// prepareUpperPath creates the missing parent directories inside the upper layer
+// and removes the whiteout, if any, for the specified upper layer path
+func (o *OverlayFs) prepareUpperPath(name string) error {
+	relPath := o.upper.GetRelativePath(name)
+	if err := o.createUpperDirs(path.Dir(relPath)); err != nil {
+		return err
+	}
+	whiteout, err := o.upper.ResolvePath(path.Join(path.Dir(relPath), overlayWhiteoutPrefix+path.Base(relPath)))
+	if err != nil {
+		return err
+	}
+	if _, err := o.upper.Lstat(whiteout); err == nil {
+		return o.upper.Remove(whiteout, false)
+	}
+	return nil
+}
+
+// createUpperDirs creates, inside the upper layer, the specified directory and its
+// parents if they exist inside the lower layer only
+func (o *OverlayFs) createUpperDirs(relPath string) error {
+	if relPath == "/" || relPath == "." || relPath == "" {
+		return nil
+	}
+	dirPath, err := o.upper.ResolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	isInUpper, err := o.isInUpperLayer(dirPath)
+	if err != nil || isInUpper {
+		return err
+	}
+	lowerPath, err := o.getLowerPath(dirPath)
+	if err != nil {
+		return err
+	}
+	info, err := o.lower.Stat(lowerPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dirPath, Err: syscall.ENOTDIR}
+	}
+	if err = o.createUpperDirs(path.Dir(relPath)); err != nil {
+		return err
+	}
+	fsLog(o, logger.LevelDebug, "copy up directory %#v", relPath)
+	return o.upper.Mkdir(dirPath)
+}
+
+// copyUp copies the specified file or directory from the lower layer to the upper
+// one, if it is not already there
+func (o *OverlayFs) copyUp(name string) error {
+	isInUpper, err := o.isInUpperLayer(name)
+	if err != nil || isInUpper {
+		return err
+	}
+	lowerPath, err := o.getLowerPath(name)
+	if err != nil {
+		return err
+	}
+	info, err := o.lower.Lstat(lowerPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.createUpperDirs(o.upper.GetRelativePath(name))
+	}
+	if !info.Mode().IsRegular() {
+		return ErrVfsUnsupported
+	}
+	if err = o.createUpperDirs(path.Dir(o.upper.GetRelativePath(name))); err != nil {
+		return err
+	}
+	return o.copyLowerFile(lowerPath, name, info)
+}
+
+func (o *OverlayFs) copyLowerFile(lowerPath, target string, info os.FileInfo) error {
+	fsLog(o, logger.LevelDebug, "copy up file %#v -> %#v", lowerPath, target)
+	src, _, _, err := o.lower.Open(lowerPath, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err = o.writeUpper(target, src); err != nil {
+		return err
+	}
+	// preserving the original mode and times is not supported by all the upper layers
+	if err = o.upper.Chmod(target, info.Mode()); err != nil && !o.upper.IsNotSupported(err) {
+		fsLog(o, logger.LevelDebug, "unable to preserve mode for copied up file %#v: %v", target, err)
+	}
+	if err = o.upper.Chtimes(target, info.ModTime(), info.ModTime()); err != nil && !o.upper.IsNotSupported(err) {
+		fsLog(o, logger.LevelDebug, "unable to preserve times for copied up file %#v: %v", target, err)
+	}
+	return nil
+}
+
+func (o *OverlayFs) writeUpper(name string, r io.Reader) error {
+	return writeToFs(o.upper, name, r)
+}
+
+func (o *OverlayFs) writeUpperFile(name string) error {
+	return o.writeUpper(name, strings.NewReader(""))
+}
+
+func (o *OverlayFs) createWhiteout(name string) error {
+	relPath := o.upper.GetRelativePath(name)
+	if err := o.createUpperDirs(path.Dir(relPath)); err != nil {
+		return err
+	}
+	whiteout, err := o.upper.ResolvePath(path.Join(path.Dir(relPath), overlayWhiteoutPrefix+path.Base(relPath)))
+	if err != nil {
+		return err
+	}
+	return o.writeUpperFile(whiteout)
+}
+
+// removeUpperMetadata removes the whiteouts and the opaque marker inside the
+// specified upper layer directory
+func (o *OverlayFs) removeUpperMetadata(dirname string) error {
+	contents, err := o.upper.ReadDir(dirname)
+	if err != nil {
+		return err
+	}
+	for _, info := range contents {
+		if strings.HasPrefix(info.Name(), overlayWhiteoutPrefix) {
+			if err := o.upper.Remove(o.upper.Join(dirname, info.Name()), false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFs) countUpperMetadata(dirname string) (int, error) {
+	numFiles := 0
+	err := o.upper.Walk(dirname, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info != nil && !info.IsDir() && strings.HasPrefix(filepath.Base(walkedPath), overlayWhiteoutPrefix) {
+			numFiles++
+		}
+		return nil
+	})
+	return numFiles, err
+}
+
+func isOverlayMetadata(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), overlayWhiteoutPrefix)
+}
@@ -0,0 +1,345 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	partialUploadsLogSender = "partialuploads"
+	s3NamespacePrefix       = "s3|"
+	azBlobNamespacePrefix   = "azblob|"
+)
+
+var partialUploads *partialUploadsStore
+
+// ResumableUploadsConfig defines the configuration to keep the interrupted
+// multipart uploads to S3 and Azure Blob storage so they can be resumed
+type ResumableUploadsConfig struct {
+	// Absolute path to a local directory to use to persist the state of the
+	// interrupted uploads. Leave empty to disable upload resume for S3 and
+	// Azure Blob storage
+	StatePath string `json:"state_path" mapstructure:"state_path"`
+	// Interrupted uploads not resumed within this number of hours are aborted
+	MaxAge int `json:"max_age" mapstructure:"max_age"`
+}
+
+// IsEnabled returns true if upload resume is configured
+func (c *ResumableUploadsConfig) IsEnabled() bool {
+	return c.StatePath != ""
+}
+
+// InitializeResumableUploads initializes the store for the interrupted
+// uploads and loads the uploads persisted by a previous run
+func InitializeResumableUploads(c ResumableUploadsConfig) error {
+	partialUploads = nil
+	if !c.IsEnabled() {
+		return nil
+	}
+	if !filepath.IsAbs(c.StatePath) {
+		return fmt.Errorf("invalid resumable uploads state path %#v, it must be an absolute path", c.StatePath)
+	}
+	if c.MaxAge <= 0 {
+		return fmt.Errorf("invalid resumable uploads max age: %v", c.MaxAge)
+	}
+	store := &partialUploadsStore{
+		path:    filepath.Clean(c.StatePath),
+		maxAge:  time.Duration(c.MaxAge) * time.Hour,
+		uploads: make(map[string]*partialUpload),
+	}
+	if err := os.MkdirAll(store.path, 0700); err != nil {
+		return fmt.Errorf("unable to create resumable uploads state directory %#v: %v", store.path, err)
+	}
+	if err := store.load(); err != nil {
+		return err
+	}
+	logger.Info(partialUploadsLogSender, "", "resumable uploads initialized, state path: %#v, max age: %v, loaded uploads: %v",
+		store.path, store.maxAge, len(store.uploads))
+	partialUploads = store
+	return nil
+}
+
+// PartialUpload defines an interrupted upload that can be resumed
+type PartialUpload struct {
+	// identifies the storage backend, for example the S3 endpoint and bucket
+	Namespace string
+	// the object key
+	Key string
+	// the user that started the upload
+	Owner string
+}
+
+type partialUploadPart struct {
+	// part or block number, starting from 1
+	Number int64 `json:"number"`
+	// block ID for Azure Blob storage
+	ID string `json:"id,omitempty"`
+	// ETag for S3
+	ETag string `json:"etag,omitempty"`
+	Size int64  `json:"size"`
+}
+
+type partialUpload struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Owner     string `json:"owner,omitempty"`
+	// multipart upload ID for S3
+	UploadID  string              `json:"upload_id,omitempty"`
+	Parts     []partialUploadPart `json:"parts"`
+	UpdatedAt int64               `json:"updated_at"`
+}
+
+func (u *partialUpload) getSize() int64 {
+	var size int64
+	for _, part := range u.Parts {
+		size += part.Size
+	}
+	return size
+}
+
+func (u *partialUpload) getFileInfo(name string) os.FileInfo {
+	return NewFileInfo(name, false, u.getSize(), utils.GetTimeFromMsecSinceEpoch(u.UpdatedAt), false)
+}
+
+// setParts sets the parts to keep to resume the upload: the contiguous parts,
+// starting from the first one, with at least the given size.
+// Any other part can only be uploaded again
+func (u *partialUpload) setParts(parts []partialUploadPart, minPartSize int64) {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	u.Parts = nil
+	for idx, part := range parts {
+		if part.Number != int64(idx+1) || part.Size < minPartSize {
+			break
+		}
+		u.Parts = append(u.Parts, part)
+	}
+}
+
+type partialUploadsStore struct {
+	sync.RWMutex
+	path    string
+	maxAge  time.Duration
+	uploads map[string]*partialUpload
+}
+
+func (s *partialUploadsStore) getID(namespace, key string) string {
+	return namespace + "|" + path.Clean("/"+key)
+}
+
+func (s *partialUploadsStore) getFilePath(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return filepath.Join(s.path, hex.EncodeToString(h[:])+".json")
+}
+
+func (s *partialUploadsStore) load() error {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to list resumable uploads state directory %#v: %v", s.path, err)
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.path, info.Name()))
+		if err != nil {
+			logger.Warn(partialUploadsLogSender, "", "unable to read resumable upload state %#v: %v", info.Name(), err)
+			continue
+		}
+		var upload partialUpload
+		if err := json.Unmarshal(data, &upload); err != nil || upload.Namespace == "" || upload.Key == "" {
+			logger.Warn(partialUploadsLogSender, "", "invalid resumable upload state %#v: %v", info.Name(), err)
+			continue
+		}
+		id := s.getID(upload.Namespace, upload.Key)
+		if s.getFilePath(id) != filepath.Join(s.path, info.Name()) {
+			logger.Warn(partialUploadsLogSender, "", "unexpected resumable upload state file name %#v, ignored", info.Name())
+			continue
+		}
+		s.uploads[id] = &upload
+	}
+	return nil
+}
+
+// get returns a copy of the interrupted upload for the given key, if any
+func (s *partialUploadsStore) get(namespace, key string) *partialUpload {
+	s.RLock()
+	defer s.RUnlock()
+
+	upload, ok := s.uploads[s.getID(namespace, key)]
+	if !ok {
+		return nil
+	}
+	result := *upload
+	result.Parts = make([]partialUploadPart, len(upload.Parts))
+	copy(result.Parts, upload.Parts)
+	return &result
+}
+
+// listDir returns the interrupted uploads inside the given directory
+func (s *partialUploadsStore) listDir(namespace, dirname string) []os.FileInfo {
+	var result []os.FileInfo
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, upload := range s.uploads {
+		if upload.Namespace == namespace && path.Dir("/"+upload.Key) == path.Clean("/"+dirname) {
+			result = append(result, upload.getFileInfo(path.Base(upload.Key)))
+		}
+	}
+	return result
+}
+
+func (s *partialUploadsStore) save(upload *partialUpload) error {
+	upload.UpdatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	id := s.getID(upload.Namespace, upload.Key)
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	filePath := s.getFilePath(id)
+	tempPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath) //nolint:errcheck
+		return err
+	}
+	s.uploads[id] = upload
+	return nil
+}
+
+func (s *partialUploadsStore) remove(namespace, key string) {
+	id := s.getID(namespace, key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.uploads[id]; !ok {
+		return
+	}
+	delete(s.uploads, id)
+	if err := os.Remove(s.getFilePath(id)); err != nil && !os.IsNotExist(err) {
+		logger.Warn(partialUploadsLogSender, "", "unable to remove resumable upload state for key %#v: %v", key, err)
+	}
+}
+
+func (s *partialUploadsStore) getStale() []PartialUpload {
+	var result []PartialUpload
+	limit := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-s.maxAge))
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, upload := range s.uploads {
+		if upload.UpdatedAt < limit {
+			result = append(result, PartialUpload{
+				Namespace: upload.Namespace,
+				Key:       upload.Key,
+				Owner:     upload.Owner,
+			})
+		}
+	}
+	return result
+}
+
+// GetStalePartialUploads returns the interrupted uploads not resumed within
+// the configured max age
+func GetStalePartialUploads() []PartialUpload {
+	if partialUploads == nil {
+		return nil
+	}
+	return partialUploads.getStale()
+}
+
+// RemovePartialUpload removes the state for the given interrupted upload
+func RemovePartialUpload(upload PartialUpload) {
+	if partialUploads == nil {
+		return
+	}
+	partialUploads.remove(upload.Namespace, upload.Key)
+}
+
+// AbortStalePartialUpload aborts the given interrupted upload, its state is
+// removed only if the abort succeeds. The S3 multipart uploads are aborted
+// using the endpoint and the bucket from the upload namespace and the other
+// settings, such as the credentials, from the given config, so they can be
+// aborted also if the owner's storage configuration changed after the upload
+// was interrupted. The Azure Blob storage uncommitted blocks cannot be
+// deleted, so only the state is removed for these uploads
+func AbortStalePartialUpload(upload PartialUpload, localTempDir string, s3Config S3FsConfig) error {
+	if partialUploads == nil {
+		return nil
+	}
+	if strings.HasPrefix(upload.Namespace, azBlobNamespacePrefix) {
+		partialUploads.remove(upload.Namespace, upload.Key)
+		return nil
+	}
+	endpoint, bucket, ok := parseS3Namespace(upload.Namespace)
+	if !ok {
+		return fmt.Errorf("unsupported namespace %#v", upload.Namespace)
+	}
+	s3Config.Endpoint = endpoint
+	s3Config.Bucket = bucket
+	fs, err := NewS3Fs("", localTempDir, s3Config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return fs.(*S3Fs).AbortPartialUpload(upload.Key)
+}
+
+// newPartialUploadsDirLister adds the interrupted uploads inside dirname to
+// the entries returned by the given lister, they replace the files with the
+// same name
+func newPartialUploadsDirLister(lister DirLister, namespace, dirname string) DirLister {
+	if partialUploads == nil {
+		return lister
+	}
+	return newMergedDirLister(lister, partialUploads.listDir(namespace, dirname), true)
+}
+
+// partialUploadsFs is implemented by the filesystems that keep the
+// interrupted uploads so they can be resumed
+type partialUploadsFs interface {
+	HasPartialUpload(name string) bool
+	AbortPartialUpload(name string) error
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can
+// be resumed and not a complete file
+func HasPartialUpload(fs Fs, name string) bool {
+	if pfs, ok := fs.(partialUploadsFs); ok {
+		return pfs.HasPartialUpload(name)
+	}
+	return false
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func AbortPartialUpload(fs Fs, name string) error {
+	if pfs, ok := fs.(partialUploadsFs); ok {
+		return pfs.AbortPartialUpload(name)
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const replicationLogSender = "replication"
+
+// supported replication targets
+const (
+	ReplicationProviderLocal = storageTargetLocal
+	ReplicationProviderS3    = storageTargetS3
+)
+
+var replicationTarget Fs
+
+// ReplicationConfig defines the secondary storage where the uploaded files are
+// asynchronously replicated. The files for each user are stored inside a
+// directory named as the user
+type ReplicationConfig struct {
+	// Replication target: "local" or "s3". Leave empty to disable the replication
+	Provider string `json:"provider" mapstructure:"provider"`
+	// Maximum number of users whose changes are replicated concurrently.
+	// The changes for the same user are always replicated in order
+	Workers int `json:"workers" mapstructure:"workers"`
+	// Maximum number of attempts for each change, the failed changes are
+	// reported using the REST API and they are retried on the next resync
+	MaxAttempts int `json:"max_attempts" mapstructure:"max_attempts"`
+	// Delay, in seconds, before the first retry. The delay doubles after each
+	// failed attempt, up to one hour
+	RetryDelay int `json:"retry_delay" mapstructure:"retry_delay"`
+	// Absolute path to the target directory for the local provider, for
+	// example a mounted network share
+	LocalPath string `json:"local_path" mapstructure:"local_path"`
+	// S3 settings for the s3 provider. The access secret can be plain or
+	// encrypted, leave both the access key and secret empty to use the
+	// default AWS credentials chain
+	Bucket         string      `json:"bucket" mapstructure:"bucket"`
+	Region         string      `json:"region" mapstructure:"region"`
+	AccessKey      string      `json:"access_key" mapstructure:"access_key"`
+	AccessSecret   *kms.Secret `json:"access_secret" mapstructure:"access_secret"`
+	Endpoint       string      `json:"endpoint" mapstructure:"endpoint"`
+	StorageClass   string      `json:"storage_class" mapstructure:"storage_class"`
+	KeyPrefix      string      `json:"key_prefix" mapstructure:"key_prefix"`
+	ForcePathStyle bool        `json:"force_path_style" mapstructure:"force_path_style"`
+}
+
+// IsEnabled returns true if a replication target is configured
+func (c *ReplicationConfig) IsEnabled() bool {
+	return c.Provider != ""
+}
+
+// GetRetryDelay returns the delay before the next attempt for a change that
+// failed the specified number of times
+func (c *ReplicationConfig) GetRetryDelay(attempts int) time.Duration {
+	delay := time.Duration(c.RetryDelay) * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+func (c *ReplicationConfig) validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("invalid replication workers: %v", c.Workers)
+	}
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("invalid replication max attempts: %v", c.MaxAttempts)
+	}
+	if c.RetryDelay < 1 {
+		return fmt.Errorf("invalid replication retry delay: %v", c.RetryDelay)
+	}
+	return nil
+}
+
+// InitializeReplication initializes the replication target using the given configuration
+func InitializeReplication(c ReplicationConfig) error {
+	replicationTarget = nil
+	if !c.IsEnabled() {
+		return nil
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	fs, err := newStorageTarget(c.Provider, c.LocalPath, S3FsConfig{
+		Bucket:         c.Bucket,
+		KeyPrefix:      c.KeyPrefix,
+		Region:         c.Region,
+		AccessKey:      c.AccessKey,
+		Endpoint:       c.Endpoint,
+		StorageClass:   c.StorageClass,
+		ForcePathStyle: c.ForcePathStyle,
+	}, c.AccessSecret)
+	if err != nil {
+		return fmt.Errorf("unable to initialize the replication target: %v", err)
+	}
+	logger.Info(replicationLogSender, "", "replication initialized, target: %v", fs.Name())
+	replicationTarget = fs
+	return nil
+}
+
+// IsReplicationEnabled returns true if a replication target is configured
+func IsReplicationEnabled() bool {
+	return replicationTarget != nil
+}
+
+// ReplicationResult reports the changes applied to the replication target
+type ReplicationResult struct {
+	// number and size of the files copied to the replication target
+	CopiedFiles int
+	CopiedSize  int64
+	// number of files and directories removed from the replication target
+	RemovedItems int
+}
+
+// SyncReplica makes the replica for the specified virtual path identical to
+// the path on the given filesystem: a file is copied, a directory is compared
+// recursively, a missing path is removed from the replica.
+// The files on the replica with the same size and a modification time not
+// before the source one are not copied again unless force is true.
+// The directories listed in excludedPaths are ignored, they are the virtual
+// folders inside virtualPath and they must be synced separately
+func SyncReplica(fs Fs, namespace, virtualPath string, excludedPaths []string, force bool) (ReplicationResult, error) {
+	var result ReplicationResult
+	if replicationTarget == nil {
+		return result, errors.New("replication is not configured")
+	}
+	virtualPath = path.Clean("/" + virtualPath)
+	fsPath, err := fs.ResolvePath(virtualPath)
+	if err != nil && !fs.IsNotExist(err) {
+		return result, err
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = fs.Lstat(fsPath)
+	}
+	if err != nil {
+		if !fs.IsNotExist(err) {
+			return result, err
+		}
+		result.RemovedItems, err = removeReplica(namespace, virtualPath, excludedPaths)
+		return result, err
+	}
+	if info.IsDir() {
+		return syncReplicaDir(fs, namespace, virtualPath, fsPath, excludedPaths, force)
+	}
+	if !info.Mode().IsRegular() || isReplicationExcluded(path.Base(virtualPath)) {
+		result.RemovedItems, err = removeReplica(namespace, virtualPath, nil)
+		return result, err
+	}
+	if replicaInfo, err := lstatReplica(namespace, virtualPath); err == nil {
+		if replicaInfo.IsDir() {
+			if result.RemovedItems, err = removeReplica(namespace, virtualPath, nil); err != nil {
+				return result, err
+			}
+		} else if !force && isReplicaUpToDate(info, replicaInfo) {
+			return result, nil
+		}
+	}
+	if err = copyToReplica(fs, fsPath, info, namespace, virtualPath); err != nil {
+		return result, err
+	}
+	result.CopiedFiles++
+	result.CopiedSize += info.Size()
+	return result, nil
+}
+
+// RenameReplica renames the replica for virtualSourcePath to virtualTargetPath.
+// The caller must ensure that the replica for the source path is up to date
+func RenameReplica(namespace, virtualSourcePath, virtualTargetPath string) error {
+	if replicationTarget == nil {
+		return errors.New("replication is not configured")
+	}
+	source, err := resolveReplicaPath(namespace, virtualSourcePath)
+	if err != nil {
+		return err
+	}
+	target, err := resolveReplicaPath(namespace, virtualTargetPath)
+	if err != nil {
+		return err
+	}
+	if _, err = replicationTarget.Lstat(source); err != nil {
+		return err
+	}
+	if err = createReplicaParentDirs(namespace, virtualTargetPath); err != nil {
+		return err
+	}
+	return replicationTarget.Rename(source, target)
+}
+
+func syncReplicaDir(fs Fs, namespace, virtualPath, fsPath string, excludedPaths []string, force bool) (ReplicationResult, error) {
+	var result ReplicationResult
+
+	if replicaInfo, err := lstatReplica(namespace, virtualPath); err == nil && !replicaInfo.IsDir() {
+		if result.RemovedItems, err = removeReplica(namespace, virtualPath, nil); err != nil {
+			return result, err
+		}
+	}
+	replicaItems, err := getReplicaItems(namespace, virtualPath)
+	if err != nil {
+		return result, err
+	}
+	if err = createReplicaDirs(namespace, virtualPath); err != nil {
+		return result, err
+	}
+	synced := make(map[string]bool)
+	err = fs.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if walkedPath != fsPath && fs.IsNotExist(err) {
+				// removed while walking
+				return nil
+			}
+			return err
+		}
+		if walkedPath == fsPath {
+			return nil
+		}
+		itemPath := fs.GetRelativePath(walkedPath)
+		if isReplicationExcluded(info.Name()) || !isVirtualPathIncluded(itemPath, []string{virtualPath}) ||
+			isVirtualPathExcluded(itemPath, excludedPaths) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		synced[itemPath] = true
+		replicaInfo, ok := replicaItems[itemPath]
+		if ok && replicaInfo.IsDir() != info.IsDir() {
+			// the type changed
+			removed, err := removeReplica(namespace, itemPath, nil)
+			result.RemovedItems += removed
+			if err != nil {
+				return err
+			}
+			ok = false
+		}
+		if info.IsDir() {
+			if !ok {
+				return createReplicaDirs(namespace, itemPath)
+			}
+			return nil
+		}
+		if ok && !force && isReplicaUpToDate(info, replicaInfo) {
+			return nil
+		}
+		if err := copyToReplica(fs, walkedPath, info, namespace, itemPath); err != nil {
+			return err
+		}
+		result.CopiedFiles++
+		result.CopiedSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	// remove the items no longer available, the deepest first
+	var removed []string
+	for itemPath := range replicaItems {
+		if synced[itemPath] || isVirtualPathExcluded(itemPath, excludedPaths) {
+			continue
+		}
+		removed = append(removed, itemPath)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, itemPath := range removed {
+		if err := removeReplicaItem(namespace, itemPath, replicaItems[itemPath].IsDir()); err != nil {
+			return result, err
+		}
+		result.RemovedItems++
+	}
+	return result, nil
+}
+
+// removeReplica removes the replica for the given virtual path, a directory
+// is removed recursively
+func removeReplica(namespace, virtualPath string, excludedPaths []string) (int, error) {
+	replicaPath, err := resolveReplicaPath(namespace, virtualPath)
+	if err != nil {
+		return 0, err
+	}
+	info, err := replicationTarget.Lstat(replicaPath)
+	if err != nil {
+		if replicationTarget.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !info.IsDir() {
+		return 1, removeReplicaItem(namespace, virtualPath, false)
+	}
+	replicaItems, err := getReplicaItems(namespace, virtualPath)
+	if err != nil {
+		return 0, err
+	}
+	items := make([]string, 0, len(replicaItems))
+	for itemPath := range replicaItems {
+		if !isVirtualPathExcluded(itemPath, excludedPaths) {
+			items = append(items, itemPath)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(items)))
+	removed := 0
+	for _, itemPath := range items {
+		if err := removeReplicaItem(namespace, itemPath, replicaItems[itemPath].IsDir()); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	if len(items) == len(replicaItems) {
+		if err := removeReplicaItem(namespace, virtualPath, true); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func removeReplicaItem(namespace, virtualPath string, isDir bool) error {
+	replicaPath, err := resolveReplicaPath(namespace, virtualPath)
+	if err != nil {
+		return err
+	}
+	err = replicationTarget.Remove(replicaPath, isDir)
+	if err != nil && replicationTarget.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// getReplicaItems returns the files and directories inside the replica for
+// the given virtual directory, the map key is the virtual path
+func getReplicaItems(namespace, virtualPath string) (map[string]os.FileInfo, error) {
+	items := make(map[string]os.FileInfo)
+	root, err := resolveReplicaPath(namespace, virtualPath)
+	if err != nil {
+		return items, err
+	}
+	namespacePath := path.Join("/", namespace)
+	err = replicationTarget.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if replicationTarget.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if walkedPath == root {
+			return nil
+		}
+		itemPath := strings.TrimPrefix(replicationTarget.GetRelativePath(walkedPath), namespacePath)
+		if itemPath == "" || !isVirtualPathIncluded(itemPath, []string{virtualPath}) || itemPath == virtualPath {
+			return nil
+		}
+		items[itemPath] = info
+		return nil
+	})
+	return items, err
+}
+
+func copyToReplica(fs Fs, fsPath string, info os.FileInfo, namespace, virtualPath string) error {
+	replicaPath, err := resolveReplicaPath(namespace, virtualPath)
+	if err != nil {
+		return err
+	}
+	if err = createReplicaParentDirs(namespace, virtualPath); err != nil {
+		return err
+	}
+	f, r, cancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return err
+	}
+	var src io.ReadCloser = r
+	if f != nil {
+		src = f
+	}
+	err = writeToFs(replicationTarget, replicaPath, src)
+	src.Close()
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if err == nil {
+		var replicaInfo os.FileInfo
+		replicaInfo, err = replicationTarget.Stat(replicaPath)
+		if err == nil && replicaInfo.Size() != info.Size() {
+			err = fmt.Errorf("size mismatch for the replica of %#v, expected: %v, actual: %v", virtualPath,
+				info.Size(), replicaInfo.Size())
+		}
+	}
+	if err != nil {
+		replicationTarget.Remove(replicaPath, false) //nolint:errcheck
+		return err
+	}
+	if IsLocalOsFs(replicationTarget) {
+		// the modification time is used to detect the changed files on resync
+		if err = replicationTarget.Chtimes(replicaPath, time.Now(), info.ModTime()); err != nil {
+			logger.Debug(replicationLogSender, "", "unable to set the modification time for %#v: %v", replicaPath, err)
+		}
+	}
+	return nil
+}
+
+func lstatReplica(namespace, virtualPath string) (os.FileInfo, error) {
+	replicaPath, err := resolveReplicaPath(namespace, virtualPath)
+	if err != nil {
+		return nil, err
+	}
+	return replicationTarget.Lstat(replicaPath)
+}
+
+// createReplicaParentDirs creates the missing parent directories for the
+// given virtual path on a local replication target
+func createReplicaParentDirs(namespace, virtualPath string) error {
+	return createReplicaDirs(namespace, path.Dir(virtualPath))
+}
+
+// createReplicaDirs creates the given virtual directory, and its missing
+// parents, on a local replication target. The directories are implicit on
+// object storage
+func createReplicaDirs(namespace, virtualPath string) error {
+	if !IsLocalOsFs(replicationTarget) {
+		return nil
+	}
+	return createMissingDirs(replicationTarget, path.Join("/", namespace, virtualPath))
+}
+
+func resolveReplicaPath(namespace, virtualPath string) (string, error) {
+	return replicationTarget.ResolvePath(path.Join("/", namespace, virtualPath))
+}
+
+func isReplicaUpToDate(info, replicaInfo os.FileInfo) bool {
+	return replicaInfo.Mode().IsRegular() && replicaInfo.Size() == info.Size() &&
+		!replicaInfo.ModTime().Before(info.ModTime().Truncate(time.Second))
+}
+
+// isReplicationExcluded returns true for the internal files and directories,
+// for example the trash, they are never replicated
+func isReplicationExcluded(name string) bool {
+	return strings.HasPrefix(name, internalNamePrefix)
+}
+
+func isVirtualPathExcluded(virtualPath string, excludedPaths []string) bool {
+	return len(excludedPaths) > 0 && isVirtualPathIncluded(virtualPath, excludedPaths)
+}
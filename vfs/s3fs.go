@@ -3,14 +3,18 @@
 package vfs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"mime"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,6 +31,13 @@ import (
 	"github.com/drakkan/sftpgo/version"
 )
 
+const (
+	// maximum number of parallel HEAD requests to read the metadata for the listed files
+	s3MetadataConcurrency = 10
+	// maximum size for an object copied using a single CopyObject request
+	s3MaxCopyObjectSize = 5 * 1024 * 1024 * 1024
+)
+
 // S3Fs is a Fs implementation for AWS S3 compatible object storages
 type S3Fs struct {
 	connectionID   string
@@ -35,6 +46,7 @@ type S3Fs struct {
 	svc            *s3.S3
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	sseCustomerKey string
 }
 
 func init() {
@@ -70,10 +82,23 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 		awsConfig.Credentials = credentials.NewStaticCredentials(fs.config.AccessKey, fs.config.AccessSecret.GetPayload(), "")
 	}
 
+	if fs.config.IsSSECustomerKeyRequired() {
+		if fs.config.SSECustomerKey.IsEncrypted() {
+			if err := fs.config.SSECustomerKey.Decrypt(); err != nil {
+				return fs, err
+			}
+		}
+		key, err := GetS3SSECustomerKey(fs.config.SSECustomerKey.GetPayload())
+		if err != nil {
+			return fs, err
+		}
+		fs.sseCustomerKey = key
+	}
+
 	if fs.config.Endpoint != "" {
 		awsConfig.Endpoint = aws.String(fs.config.Endpoint)
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
 	}
+	awsConfig.S3ForcePathStyle = aws.Bool(fs.config.ForcePathStyle)
 
 	if fs.config.UploadPartSize == 0 {
 		fs.config.UploadPartSize = s3manager.DefaultUploadPartSize
@@ -106,8 +131,20 @@ func (fs *S3Fs) ConnectionID() string {
 	return fs.connectionID
 }
 
-// Stat returns a FileInfo describing the named file
+// Stat returns a FileInfo describing the named file.
+// The emulated symlinks, if enabled, are followed
 func (fs *S3Fs) Stat(name string) (os.FileInfo, error) {
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return setFileInfoName(info, name), nil
+}
+
+func (fs *S3Fs) lstat(name string) (os.FileInfo, error) {
 	var result FileInfo
 	if name == "/" || name == "." {
 		err := fs.checkIfBucketExists()
@@ -119,12 +156,17 @@ func (fs *S3Fs) Stat(name string) (os.FileInfo, error) {
 	if "/"+fs.config.KeyPrefix == name+"/" {
 		return NewFileInfo(name, true, 0, time.Now(), false), nil
 	}
+	if upload := fs.getPartialUpload(name); upload != nil {
+		return upload.getFileInfo(name), nil
+	}
 	obj, err := fs.headObject(name)
 	if err == nil {
 		// a "dir" has a trailing "/" so we cannot have a directory here
 		objSize := *obj.ContentLength
 		objectModTime := *obj.LastModified
-		return NewFileInfo(name, false, objSize, objectModTime, false), nil
+		info := newObjectFileInfo(name, false, objSize, objectModTime, aws.StringValueMap(obj.Metadata))
+		info.etag = aws.StringValue(obj.ETag)
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return result, err
@@ -132,6 +174,10 @@ func (fs *S3Fs) Stat(name string) (os.FileInfo, error) {
 	// now check if this is a prefix (virtual directory)
 	hasContents, err := fs.hasContents(name)
 	if err == nil && hasContents {
+		// the directory object, if any, could have the attributes set by the client
+		if info, err := fs.getStatForDir(name); err == nil {
+			return info, nil
+		}
 		return NewFileInfo(name, true, 0, time.Now(), false), nil
 	} else if err != nil {
 		return nil, err
@@ -151,16 +197,24 @@ func (fs *S3Fs) getStatForDir(name string) (os.FileInfo, error) {
 	}
 	objSize := *obj.ContentLength
 	objectModTime := *obj.LastModified
-	return NewFileInfo(name, true, objSize, objectModTime, false), nil
+	return newObjectFileInfo(name, true, objSize, objectModTime, aws.StringValueMap(obj.Metadata)), nil
 }
 
-// Lstat returns a FileInfo describing the named file
+// Lstat returns a FileInfo describing the named file.
+// If the file is an emulated symlink the returned FileInfo describes the symlink
 func (fs *S3Fs) Lstat(name string) (os.FileInfo, error) {
-	return fs.Stat(name)
+	if !fs.config.EmulateSymlinks {
+		return fs.lstat(name)
+	}
+	info, _, err := statObject(fs, name, false)
+	return info, err
 }
 
 // Open opens the named file for reading
 func (fs *S3Fs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if fs.config.EmulateSymlinks {
+		name = resolveObjectPath(fs, name)
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -175,9 +229,11 @@ func (fs *S3Fs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fun
 	go func() {
 		defer cancelFn()
 		n, err := downloader.DownloadWithContext(ctx, w, &s3.GetObjectInput{
-			Bucket: aws.String(fs.config.Bucket),
-			Key:    aws.String(name),
-			Range:  streamRange,
+			Bucket:               aws.String(fs.config.Bucket),
+			Key:                  aws.String(name),
+			Range:                streamRange,
+			SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:       fs.getSSECustomerKey(),
 		})
 		w.CloseWithError(err) //nolint:errcheck
 		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
@@ -186,8 +242,13 @@ func (fs *S3Fs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fun
 	return nil, r, cancelFn, nil
 }
 
-// Create creates or opens the named file for writing
+// Create creates or opens the named file for writing.
+// If resumable uploads are enabled, flag is not zero and it does not contain
+// os.O_TRUNC, an interrupted upload is resumed
 func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if partialUploads != nil && flag != -1 {
+		return fs.createResumable(name, flag)
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -205,11 +266,16 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 			contentType = mime.TypeByExtension(path.Ext(name))
 		}
 		response, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket:       aws.String(fs.config.Bucket),
-			Key:          aws.String(key),
-			Body:         r,
-			StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
-			ContentType:  utils.NilIfEmpty(contentType),
+			Bucket:               aws.String(fs.config.Bucket),
+			Key:                  aws.String(key),
+			Body:                 r,
+			StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+			ContentType:          utils.NilIfEmpty(contentType),
+			ACL:                  utils.NilIfEmpty(fs.config.ACL),
+			ServerSideEncryption: fs.getServerSideEncryption(),
+			SSEKMSKeyId:          fs.getSSEKMSKeyID(),
+			SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:       fs.getSSECustomerKey(),
 		}, func(u *s3manager.Uploader) {
 			u.Concurrency = fs.config.UploadConcurrency
 			u.PartSize = fs.config.UploadPartSize
@@ -224,10 +290,9 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 }
 
 // Rename renames (moves) source to target.
-// We don't support renaming non empty directories since we should
-// rename all the contents too and this could take long time: think
-// about directories with thousands of files, for each file we should
-// execute a CopyObject call.
+// Non empty directories are renamed copying all the contents, using
+// CopyObject calls, and then removing the source objects: this could
+// take long time for directories with thousands of files.
 // TODO: rename does not work for files bigger than 5GB, implement
 // multipart copy or wait for this pull request to be merged:
 //
@@ -237,46 +302,63 @@ func (fs *S3Fs) Rename(source, target string) error {
 	if source == target {
 		return nil
 	}
-	fi, err := fs.Stat(source)
+	fi, err := fs.lstat(source)
 	if err != nil {
 		return err
 	}
-	copySource := fs.Join(fs.config.Bucket, source)
 	if fi.IsDir() {
 		hasContents, err := fs.hasContents(source)
 		if err != nil {
 			return err
 		}
 		if hasContents {
-			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+			_, _, err = copyPrefix(fs, source, target, true, fs.copyObject)
+			return err
 		}
+	}
+	if err := fs.copyObject(source, target, fi.IsDir()); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// CopyObjects copies source, a file or a directory, to target using server-side copies
+func (fs *S3Fs) CopyObjects(source, target string) (int, int64, error) {
+	return copyObjects(fs, source, target, fs.copyObject)
+}
+
+func (fs *S3Fs) copyObject(source, target string, isDir bool) error {
+	copySource := fs.Join(fs.config.Bucket, source)
+	var contentType string
+	if isDir {
 		if !strings.HasSuffix(copySource, "/") {
 			copySource += "/"
 		}
 		if !strings.HasSuffix(target, "/") {
 			target += "/"
 		}
-	}
-	var contentType string
-	if fi.IsDir() {
 		contentType = dirMimeType
 	} else {
 		contentType = mime.TypeByExtension(path.Ext(source))
 	}
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
-	_, err = fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
-		Bucket:       aws.String(fs.config.Bucket),
-		CopySource:   aws.String(url.PathEscape(copySource)),
-		Key:          aws.String(target),
-		StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
-		ContentType:  utils.NilIfEmpty(contentType),
+	_, err := fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String(fs.config.Bucket),
+		CopySource:                     aws.String(url.PathEscape(copySource)),
+		Key:                            aws.String(target),
+		StorageClass:                   utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:                    utils.NilIfEmpty(contentType),
+		ACL:                            utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption:           fs.getServerSideEncryption(),
+		SSEKMSKeyId:                    fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm:           fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 fs.getSSECustomerKey(),
+		CopySourceSSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       fs.getSSECustomerKey(),
 	})
 	metrics.S3CopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
@@ -300,6 +382,9 @@ func (fs *S3Fs) Remove(name string, isDir bool) error {
 		Key:    aws.String(name),
 	})
 	metrics.S3DeleteObjectCompleted(err)
+	if err == nil && !isDir {
+		err = fs.AbortPartialUpload(name)
+	}
 	return err
 }
 
@@ -319,29 +404,58 @@ func (fs *S3Fs) Mkdir(name string) error {
 	return w.Close()
 }
 
-// Symlink creates source as a symbolic link to target.
-func (*S3Fs) Symlink(source, target string) error {
-	return ErrVfsUnsupported
+// Symlink creates target as a symbolic link to source.
+// Symlinks are emulated, if enabled, using an empty object
+// that stores the source path as metadata
+func (fs *S3Fs) Symlink(source, target string) error {
+	if !fs.config.EmulateSymlinks {
+		return ErrVfsUnsupported
+	}
+	if err := checkSymlinkCreation(fs, target); err != nil {
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err := fs.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(target),
+		Body:                 bytes.NewReader(nil),
+		Metadata:             aws.StringMap(getSymlinkMetadata(fs.GetRelativePath(source))),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          aws.String(symlinkMimeType),
+		ACL:                  utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption: fs.getServerSideEncryption(),
+		SSEKMSKeyId:          fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
+	})
+	return err
 }
 
 // Readlink returns the destination of the named symbolic link
-func (*S3Fs) Readlink(name string) (string, error) {
-	return "", ErrVfsUnsupported
+func (fs *S3Fs) Readlink(name string) (string, error) {
+	if !fs.config.EmulateSymlinks {
+		return "", ErrVfsUnsupported
+	}
+	return readObjectSymlink(fs, name)
 }
 
 // Chown changes the numeric uid and gid of the named file.
-func (*S3Fs) Chown(name string, uid int, gid int) error {
-	return ErrVfsUnsupported
+// They are stored as object metadata
+func (fs *S3Fs) Chown(name string, uid int, gid int) error {
+	return fs.updateMetadata(name, withOwner(uid, gid))
 }
 
 // Chmod changes the mode of the named file to mode.
-func (*S3Fs) Chmod(name string, mode os.FileMode) error {
-	return ErrVfsUnsupported
+// The permissions are stored as object metadata
+func (fs *S3Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.updateMetadata(name, withMode(mode))
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (*S3Fs) Chtimes(name string, atime, mtime time.Time) error {
-	return ErrVfsUnsupported
+// The modification time is stored as object metadata, the access time is ignored
+func (fs *S3Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.updateMetadata(name, withMtime(mtime))
 }
 
 // Truncate changes the size of the named file.
@@ -354,7 +468,15 @@ func (*S3Fs) Truncate(name string, size int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	return readDirFromLister(fs.OpenDir(dirname))
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page, up to 1000 objects, at a time
+func (fs *S3Fs) OpenDir(dirname string) (DirLister, error) {
+	if fs.config.EmulateSymlinks {
+		dirname = resolveObjectPath(fs, dirname)
+	}
 	// dirname must be already cleaned
 	prefix := ""
 	if dirname != "/" && dirname != "." {
@@ -365,14 +487,23 @@ func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	}
 
 	prefixes := make(map[string]bool)
+	var continuationToken *string
 
-	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
-	defer cancelFn()
-	err := fs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(fs.config.Bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
-	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+	lister := newPagedDirLister(func() ([]os.FileInfo, bool, error) {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		page, err := fs.svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(fs.config.Bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: continuationToken,
+		})
+		metrics.S3ListObjectsCompleted(err)
+		if err != nil {
+			return nil, false, err
+		}
+		result := make([]os.FileInfo, 0, len(page.CommonPrefixes)+len(page.Contents))
 		for _, p := range page.CommonPrefixes {
 			// prefixes have a trailing slash
 			name, _ := fs.resolve(p.Prefix, prefix)
@@ -400,16 +531,20 @@ func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 			}
 			result = append(result, NewFileInfo(name, (isDir && objectSize == 0), objectSize, objectModTime, false))
 		}
-		return true
-	})
-	metrics.S3ListObjectsCompleted(err)
-	return result, err
+		continuationToken = page.NextContinuationToken
+		if fs.config.ListMetadata {
+			fs.setListedFilesMetadata(prefix, result)
+		}
+		return result, aws.BoolValue(page.IsTruncated), nil
+	}, nil)
+	return newPartialUploadsDirLister(lister, fs.getNamespace(), dirname), nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
-// SFTP Resume is not supported on S3
+// Resume is supported for interrupted multipart uploads if resumable
+// uploads are enabled
 func (*S3Fs) IsUploadResumeSupported() bool {
-	return false
+	return partialUploads != nil
 }
 
 // IsAtomicUploadSupported returns true if atomic upload is supported.
@@ -495,8 +630,8 @@ func (fs *S3Fs) ScanRootDirContents() (int, int64, error) {
 
 // GetDirSize returns the number of files and the size for a folder
 // including any subfolders
-func (*S3Fs) GetDirSize(dirname string) (int, int64, error) {
-	return 0, 0, ErrVfsUnsupported
+func (fs *S3Fs) GetDirSize(dirname string) (int, int64, error) {
+	return getDirSizeFromObjects(fs, dirname)
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload.
@@ -635,17 +770,263 @@ func (fs *S3Fs) hasContents(name string) (bool, error) {
 	return false, nil
 }
 
+func (fs *S3Fs) getServerSideEncryption() *string {
+	switch fs.config.SSEType {
+	case S3SSETypeS3:
+		return aws.String(s3.ServerSideEncryptionAes256)
+	case S3SSETypeKMS:
+		return aws.String(s3.ServerSideEncryptionAwsKms)
+	default:
+		return nil
+	}
+}
+
+func (fs *S3Fs) getSSEKMSKeyID() *string {
+	if fs.config.SSEType == S3SSETypeKMS {
+		return utils.NilIfEmpty(fs.config.SSEKMSKeyID)
+	}
+	return nil
+}
+
+// getSSECustomerAlgorithm returns the algorithm for SSE-C, the SDK computes
+// the key MD5 and encodes the key itself
+func (fs *S3Fs) getSSECustomerAlgorithm() *string {
+	if fs.sseCustomerKey == "" {
+		return nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256)
+}
+
+func (fs *S3Fs) getSSECustomerKey() *string {
+	return utils.NilIfEmpty(fs.sseCustomerKey)
+}
+
 func (fs *S3Fs) headObject(name string) (*s3.HeadObjectOutput, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	obj, err := fs.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(fs.config.Bucket),
-		Key:    aws.String(name),
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(name),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
 	})
 	metrics.S3HeadObjectCompleted(err)
 	return obj, err
 }
 
+func (fs *S3Fs) getSymlinkTarget(name string) (string, bool, error) {
+	obj, err := fs.headObject(name)
+	if err != nil {
+		return "", false, err
+	}
+	target, ok := getSymlinkTargetFromMetadata(aws.StringValueMap(obj.Metadata))
+	return target, ok, nil
+}
+
+// setListedFilesMetadata replaces the listed files with the ones built using
+// the attributes stored as object metadata. The objects are read in parallel,
+// on error the listed file is left unchanged
+func (fs *S3Fs) setListedFilesMetadata(prefix string, files []os.FileInfo) {
+	var wg sync.WaitGroup
+	guard := make(chan struct{}, s3MetadataConcurrency)
+
+	for idx, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		guard <- struct{}{}
+		wg.Add(1)
+		go func(idx int, info os.FileInfo) {
+			defer func() {
+				<-guard
+				wg.Done()
+			}()
+
+			obj, err := fs.headObject(prefix + info.Name())
+			if err != nil {
+				fsLog(fs, logger.LevelDebug, "unable to read the metadata for the listed file %#v: %v", prefix+info.Name(), err)
+				return
+			}
+			files[idx] = newObjectFileInfo(info.Name(), false, info.Size(), info.ModTime(), aws.StringValueMap(obj.Metadata))
+		}(idx, info)
+	}
+	wg.Wait()
+	close(guard)
+}
+
+// updateMetadata applies the given update to the metadata of the named object.
+// S3 metadata cannot be modified, so the object is copied over itself replacing
+// the metadata. Directories without an object, a trailing slash key, get one
+func (fs *S3Fs) updateMetadata(name string, update metadataUpdate) error {
+	key := name
+	obj, err := fs.headObject(key)
+	if fs.IsNotExist(err) {
+		key = name + "/"
+		obj, err = fs.headObject(key)
+		if fs.IsNotExist(err) {
+			return fs.createDirWithMetadata(name, key, update)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return fs.replaceMetadata(key, obj, update)
+}
+
+// replaceMetadata copies the given object over itself replacing its metadata
+func (fs *S3Fs) replaceMetadata(key string, obj *s3.HeadObjectOutput, update metadataUpdate) error {
+	storageClass := utils.NilIfEmpty(fs.config.StorageClass)
+	if obj.StorageClass != nil {
+		storageClass = obj.StorageClass
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	// the key is not joined to the bucket, a directory key must keep its trailing slash
+	_, err := fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String(fs.config.Bucket),
+		CopySource:                     aws.String(url.PathEscape(fs.config.Bucket + "/" + strings.TrimPrefix(key, "/"))),
+		Key:                            aws.String(key),
+		MetadataDirective:              aws.String(s3.MetadataDirectiveReplace),
+		Metadata:                       aws.StringMap(getUpdatedMetadata(aws.StringValueMap(obj.Metadata), update)),
+		ContentType:                    obj.ContentType,
+		ContentEncoding:                obj.ContentEncoding,
+		ContentDisposition:             obj.ContentDisposition,
+		ContentLanguage:                obj.ContentLanguage,
+		CacheControl:                   obj.CacheControl,
+		StorageClass:                   storageClass,
+		ACL:                            utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption:           fs.getServerSideEncryption(),
+		SSEKMSKeyId:                    fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm:           fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 fs.getSSECustomerKey(),
+		CopySourceSSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       fs.getSSECustomerKey(),
+	})
+	metrics.S3CopyObjectCompleted(err)
+	return err
+}
+
+// createDirWithMetadata creates the object for a virtual directory, a prefix
+// with some contents, so it can store the given attributes
+func (fs *S3Fs) createDirWithMetadata(name, key string, update metadataUpdate) error {
+	hasContents, err := fs.hasContents(name)
+	if err != nil {
+		return err
+	}
+	if !hasContents {
+		return awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("%#v does not exist", name), nil)
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err = fs.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(nil),
+		Metadata:             aws.StringMap(getUpdatedMetadata(nil, update)),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          aws.String(dirMimeType),
+		ACL:                  utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption: fs.getServerSideEncryption(),
+		SSEKMSKeyId:          fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
+	})
+	return err
+}
+
+// SetChecksums stores the checksums for the named file as object metadata.
+// Objects bigger than 5GB cannot be copied with a single request and so they
+// are not updated
+func (fs *S3Fs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	obj, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(obj.ContentLength) > s3MaxCopyObjectSize {
+		return fmt.Errorf("unable to store checksums for %#v: the object is too big", name)
+	}
+	return fs.replaceMetadata(name, obj, withChecksums(checksums))
+}
+
+// GetChecksum returns the checksum stored as object metadata for the named
+// file and the given algorithm
+func (fs *S3Fs) GetChecksum(name, algo string) (string, int64, bool) {
+	obj, err := fs.headObject(name)
+	if err != nil {
+		return "", 0, false
+	}
+	checksum, ok := getChecksumFromMetadata(aws.StringValueMap(obj.Metadata), algo)
+	return checksum, aws.Int64Value(obj.ContentLength), ok
+}
+
+// IsObjectLockEnabled returns true if an object lock mode is configured
+func (fs *S3Fs) IsObjectLockEnabled() bool {
+	return fs.config.ObjectLockMode != ""
+}
+
+// SetObjectLock sets the retention and the legal hold for the named object
+// using the configured object lock mode. The objects with a legal hold are
+// marked, before locking them, so SFTPGo never removes the legal holds set
+// by others
+func (fs *S3Fs) SetObjectLock(name string, retainUntil time.Time, legalHold bool) error {
+	if legalHold {
+		obj, err := fs.headObject(name)
+		if err != nil {
+			return err
+		}
+		// the object is copied over itself to add the marker, the copy is locked
+		if err = fs.replaceMetadata(name, obj, withLegalHoldMarker(name)); err != nil {
+			return err
+		}
+	}
+	if !retainUntil.IsZero() {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		_, err := fs.svc.PutObjectRetentionWithContext(ctx, &s3.PutObjectRetentionInput{
+			Bucket: aws.String(fs.config.Bucket),
+			Key:    aws.String(name),
+			Retention: &s3.ObjectLockRetention{
+				Mode:            aws.String(fs.config.ObjectLockMode),
+				RetainUntilDate: aws.Time(retainUntil.UTC()),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if legalHold {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		return fs.putObjectLegalHold(ctx, name, s3.ObjectLockLegalHoldStatusOn)
+	}
+	return nil
+}
+
+// RemoveObjectLegalHold removes the legal hold for the named object if info
+// has the marker added by SFTPGo when it set the legal hold
+func (fs *S3Fs) RemoveObjectLegalHold(name string, info os.FileInfo) error {
+	if !hasLegalHoldMarker(info, name) {
+		return nil
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	return fs.putObjectLegalHold(ctx, name, s3.ObjectLockLegalHoldStatusOff)
+}
+
+func (fs *S3Fs) putObjectLegalHold(ctx context.Context, name, status string) error {
+	_, err := fs.svc.PutObjectLegalHoldWithContext(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Key:    aws.String(name),
+		LegalHold: &s3.ObjectLockLegalHold{
+			Status: aws.String(status),
+		},
+	})
+	return err
+}
+
 // GetMimeType returns the content type
 func (fs *S3Fs) GetMimeType(name string) (string, error) {
 	obj, err := fs.headObject(name)
@@ -664,3 +1045,293 @@ func (*S3Fs) Close() error {
 func (*S3Fs) GetAvailableDiskSize(dirName string) (int64, error) {
 	return 0, errStorageSizeUnavailable
 }
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *S3Fs) HasPartialUpload(name string) bool {
+	return fs.getPartialUpload(name) != nil
+}
+
+// AbortPartialUpload aborts the interrupted multipart upload for the given name, if any
+func (fs *S3Fs) AbortPartialUpload(name string) error {
+	upload := fs.getPartialUpload(name)
+	if upload == nil {
+		return nil
+	}
+	return fs.abortMultipartUpload(upload)
+}
+
+func (fs *S3Fs) getNamespace() string {
+	return fmt.Sprintf("%v%v|%v", s3NamespacePrefix, fs.config.Endpoint, fs.config.Bucket)
+}
+
+// parseS3Namespace returns the endpoint and the bucket for the given namespace
+func parseS3Namespace(namespace string) (string, string, bool) {
+	if !strings.HasPrefix(namespace, s3NamespacePrefix) {
+		return "", "", false
+	}
+	namespace = strings.TrimPrefix(namespace, s3NamespacePrefix)
+	idx := strings.LastIndex(namespace, "|")
+	if idx < 0 {
+		return "", "", false
+	}
+	return namespace[:idx], namespace[idx+1:], true
+}
+
+func (fs *S3Fs) getPartialUpload(name string) *partialUpload {
+	if partialUploads == nil {
+		return nil
+	}
+	return partialUploads.get(fs.getNamespace(), name)
+}
+
+func (fs *S3Fs) createResumable(name string, flag int) (File, *PipeWriter, func(), error) {
+	upload := fs.getPartialUpload(name)
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		if upload == nil {
+			fsLog(fs, logger.LevelDebug, "unable to resume %#v, only interrupted uploads can be resumed", name)
+			return nil, nil, nil, ErrVfsUnsupported
+		}
+	} else if upload != nil {
+		if err := fs.abortMultipartUpload(upload); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to abort the interrupted upload for %#v: %v", name, err)
+		}
+		upload = nil
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	var offset int64
+	if upload != nil {
+		offset = upload.getSize()
+		p.offset = offset
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+
+		err := fs.handleResumableUpload(ctx, r, name, upload)
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, offset: %v, readed bytes: %v, err: %v",
+			name, offset, r.GetReadedBytes(), err)
+		metrics.S3TransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+// handleResumableUpload uploads the data read from reader using a multipart
+// upload. If the upload is interrupted the uploaded parts are kept so the
+// upload can be resumed later. Files smaller than a part are uploaded using
+// a single request
+func (fs *S3Fs) handleResumableUpload(ctx context.Context, reader io.Reader, name string, upload *partialUpload) error {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	partSize := fs.config.UploadPartSize
+	guard := make(chan struct{}, fs.config.UploadConcurrency)
+	partCtxTimeout := time.Duration(partSize/(1024*1024)) * time.Minute
+
+	pool := newBufferAllocator(int(partSize))
+	finished := false
+	var partNumber int64
+	if upload != nil {
+		partNumber = int64(len(upload.Parts))
+	}
+	var parts []partialUploadPart
+	var partsMutex sync.Mutex
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var poolError, readError error
+
+	poolCtx, poolCancel := context.WithCancel(ctx)
+	defer poolCancel()
+
+	for !finished {
+		buf := pool.getBuffer()
+
+		n, err := readFill(reader, buf)
+		if err == io.EOF {
+			finished = true
+			if n == 0 && upload != nil {
+				pool.releaseBuffer(buf)
+				break
+			}
+		} else if err != nil {
+			pool.releaseBuffer(buf)
+			readError = err
+			break
+		}
+		if upload == nil {
+			if finished {
+				// the whole file fits in a single part
+				err = ctx.Err()
+				if err == nil {
+					err = fs.putObject(ctx, name, contentType, buf[:n])
+				}
+				pool.releaseBuffer(buf)
+				pool.free()
+				return err
+			}
+			upload, err = fs.createMultipartUpload(ctx, name, contentType)
+			if err != nil {
+				pool.releaseBuffer(buf)
+				pool.free()
+				return err
+			}
+		}
+		partNumber++
+
+		guard <- struct{}{}
+		if poolError != nil {
+			fsLog(fs, logger.LevelDebug, "pool error, upload for part %v not started", partNumber)
+			pool.releaseBuffer(buf)
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int64, buf []byte, bufSize int) {
+			defer wg.Done()
+			innerCtx, cancelFn := context.WithDeadline(poolCtx, time.Now().Add(partCtxTimeout))
+			defer cancelFn()
+
+			resp, err := fs.svc.UploadPartWithContext(innerCtx, &s3.UploadPartInput{
+				Bucket:               aws.String(fs.config.Bucket),
+				Key:                  aws.String(name),
+				UploadId:             aws.String(upload.UploadID),
+				PartNumber:           aws.Int64(partNumber),
+				Body:                 bytes.NewReader(buf[:bufSize]),
+				SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+				SSECustomerKey:       fs.getSSECustomerKey(),
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					poolError = err
+					fsLog(fs, logger.LevelDebug, "multipart upload error: %v", poolError)
+					poolCancel()
+				})
+			} else {
+				partsMutex.Lock()
+				parts = append(parts, partialUploadPart{
+					Number: partNumber,
+					ETag:   aws.StringValue(resp.ETag),
+					Size:   int64(bufSize),
+				})
+				partsMutex.Unlock()
+			}
+			pool.releaseBuffer(buf)
+			<-guard
+		}(partNumber, buf, n)
+	}
+
+	wg.Wait()
+	close(guard)
+	pool.free()
+
+	parts = append(upload.Parts, parts...)
+	err := readError
+	if err == nil {
+		err = poolError
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = fs.completeMultipartUpload(ctx, upload, parts)
+		if err == nil {
+			partialUploads.remove(upload.Namespace, upload.Key)
+			return nil
+		}
+	}
+	// the upload was interrupted, keep the uploaded parts so it can be resumed
+	upload.setParts(parts, s3manager.MinUploadPartSize)
+	if len(upload.Parts) == 0 {
+		if errAbort := fs.abortMultipartUpload(upload); errAbort != nil {
+			fsLog(fs, logger.LevelWarn, "unable to abort multipart upload for %#v: %v", name, errAbort)
+		}
+		return err
+	}
+	if errSave := partialUploads.save(upload); errSave != nil {
+		fsLog(fs, logger.LevelWarn, "unable to save the state for the interrupted upload %#v: %v", name, errSave)
+	} else {
+		fsLog(fs, logger.LevelDebug, "upload for %#v interrupted, it can be resumed from offset %v", name, upload.getSize())
+	}
+	return err
+}
+
+func (fs *S3Fs) putObject(ctx context.Context, name, contentType string, data []byte) error {
+	_, err := fs.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(name),
+		Body:                 bytes.NewReader(data),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          utils.NilIfEmpty(contentType),
+		ACL:                  utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption: fs.getServerSideEncryption(),
+		SSEKMSKeyId:          fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
+	})
+	return err
+}
+
+func (fs *S3Fs) createMultipartUpload(ctx context.Context, name, contentType string) (*partialUpload, error) {
+	resp, err := fs.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(name),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          utils.NilIfEmpty(contentType),
+		ACL:                  utils.NilIfEmpty(fs.config.ACL),
+		ServerSideEncryption: fs.getServerSideEncryption(),
+		SSEKMSKeyId:          fs.getSSEKMSKeyID(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &partialUpload{
+		Namespace: fs.getNamespace(),
+		Key:       name,
+		Owner:     fs.config.Owner,
+		UploadID:  aws.StringValue(resp.UploadId),
+	}, nil
+}
+
+func (fs *S3Fs) completeMultipartUpload(ctx context.Context, upload *partialUpload, parts []partialUploadPart) error {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	completedParts := make([]*s3.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedParts = append(completedParts, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+	_, err := fs.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(fs.config.Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	return err
+}
+
+func (fs *S3Fs) abortMultipartUpload(upload *partialUpload) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err := fs.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(fs.config.Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadID),
+	})
+	if err == nil || fs.IsNotExist(err) {
+		partialUploads.remove(upload.Namespace, upload.Key)
+		return nil
+	}
+	return err
+}
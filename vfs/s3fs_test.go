@@ -0,0 +1,581 @@
+// +build !nos3
+
+package vfs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/kms"
+)
+
+const fakeS3Bucket = "bucket"
+
+func TestS3ChtimesFile(t *testing.T) {
+	server := newFakeS3Server(t)
+	fs := server.getFs(t, false)
+	lastModified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	server.putObject("dir/file", []byte("content"), lastModified, nil)
+
+	mtime := time.Date(2020, 1, 1, 10, 20, 30, 500, time.UTC)
+	err := fs.Chtimes("dir/file", time.Now(), mtime)
+	require.NoError(t, err)
+	info, err := fs.Stat("dir/file")
+	require.NoError(t, err)
+	// the modification time is stored with a second precision
+	assert.True(t, info.ModTime().Equal(mtime.Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, int64(7), info.Size())
+	assert.False(t, info.IsDir())
+	// the object is copied over itself, the contents are preserved
+	assert.Equal(t, []byte("content"), server.getObject("dir/file").data)
+	// the metadata are not returned listing the objects, the last modified
+	// time is listed and it is updated copying the object over itself
+	files, err := fs.ReadDir("dir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+		assert.False(t, files[0].ModTime().Equal(mtime.Truncate(time.Second)), files[0].ModTime().String())
+		assert.True(t, files[0].ModTime().After(lastModified), files[0].ModTime().String())
+	}
+	// the stored modification time is listed if the metadata are read
+	fs = server.getFs(t, true)
+	files, err = fs.ReadDir("dir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.True(t, files[0].ModTime().Equal(mtime.Truncate(time.Second)), files[0].ModTime().String())
+	}
+	// the other attributes are preserved setting the modification time again
+	err = fs.Chmod("dir/file", 0600)
+	require.NoError(t, err)
+	err = fs.Chtimes("dir/file", time.Now(), mtime.Add(time.Hour))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir/file")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Hour).Truncate(time.Second)), info.ModTime().String())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	// the stored modification time is preserved by renames
+	err = fs.Rename("dir/file", "dir/renamed")
+	require.NoError(t, err)
+	info, err = fs.Stat("dir/renamed")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Hour).Truncate(time.Second)), info.ModTime().String())
+
+	err = fs.Chtimes("dir/missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+}
+
+func TestS3ChtimesDir(t *testing.T) {
+	server := newFakeS3Server(t)
+	fs := server.getFs(t, true)
+	server.putObject("vdir/file", []byte("data"), time.Now(), nil)
+	server.putObject("dir/", nil, time.Now(), nil)
+
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	// a virtual directory, a prefix without an object, gets one
+	assert.Nil(t, server.getObject("vdir/"))
+	err := fs.Chtimes("vdir", time.Now(), mtime)
+	require.NoError(t, err)
+	assert.NotNil(t, server.getObject("vdir/"))
+	info, err := fs.Stat("vdir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime), info.ModTime().String())
+	// the directory contents are not modified
+	files, err := fs.ReadDir("vdir")
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file", files[0].Name())
+	}
+	// an empty directory
+	err = fs.Chtimes("dir", time.Now(), mtime.Add(time.Minute))
+	require.NoError(t, err)
+	info, err = fs.Stat("dir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime.Add(time.Minute)), info.ModTime().String())
+	// the listed directories are common prefixes, they have no attributes
+	files, err = fs.ReadDir("/")
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, info := range files {
+		assert.True(t, info.IsDir(), info.Name())
+		assert.False(t, info.ModTime().Equal(mtime), info.Name())
+	}
+	// a missing directory is not created
+	err = fs.Chtimes("missing", time.Now(), mtime)
+	assert.True(t, fs.IsNotExist(err))
+	assert.Nil(t, server.getObject("missing/"))
+}
+
+func TestS3ObjectLock(t *testing.T) {
+	server := newFakeS3Server(t)
+	server.putObject("dir/file", []byte("content"), time.Now(), nil)
+	fs := server.getFsWithConfig(t, S3FsConfig{
+		ObjectLockMode: S3ObjectLockModeCompliance,
+	})
+	// the object lock is set using the names received by the layers
+	compressedFs, err := NewCompressedFs(fs, os.TempDir(), CompressionFsConfig{
+		Algorithm: CompressionAlgoGzip,
+	})
+	require.NoError(t, err)
+	layeredFs := NewCachedFs(compressedFs, "namespace")
+	assert.True(t, IsObjectLockEnabled(layeredFs))
+	name, err := layeredFs.ResolvePath("/dir/file")
+	require.NoError(t, err)
+	retainUntil := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	err = SetObjectLock(layeredFs, name, retainUntil, true)
+	require.NoError(t, err)
+	obj := server.getObject("dir/file")
+	assert.Equal(t, S3ObjectLockModeCompliance, obj.retentionMode)
+	assert.True(t, obj.retainUntil.Equal(retainUntil), obj.retainUntil.String())
+	assert.Equal(t, "ON", obj.legalHold)
+	val, ok := getMetadataValue(obj.metadata, metadataKeyLegalHold)
+	assert.True(t, ok)
+	assert.Equal(t, "dir/file", val)
+	// a copy of the marker for another object is ignored
+	info, err := layeredFs.Lstat(name)
+	require.NoError(t, err)
+	err = RemoveObjectLegalHold(layeredFs, "/dir/other", info)
+	require.NoError(t, err)
+	assert.Equal(t, "ON", obj.legalHold)
+	// the retention is not changed removing the legal hold
+	err = RemoveObjectLegalHold(layeredFs, name, info)
+	require.NoError(t, err)
+	assert.Equal(t, "OFF", obj.legalHold)
+	assert.Equal(t, S3ObjectLockModeCompliance, obj.retentionMode)
+	// the legal holds set outside SFTPGo are not removed
+	server.putObject("file2", []byte("content"), time.Now(), nil)
+	obj = server.getObject("file2")
+	obj.legalHold = "ON"
+	info, err = fs.Lstat("/file2")
+	require.NoError(t, err)
+	err = RemoveObjectLegalHold(fs, "/file2", info)
+	require.NoError(t, err)
+	assert.Equal(t, "ON", obj.legalHold)
+	// no legal hold
+	server.putObject("file1", []byte("content"), time.Now(), nil)
+	err = SetObjectLock(fs, "/file1", retainUntil, false)
+	require.NoError(t, err)
+	obj = server.getObject("file1")
+	assert.Equal(t, S3ObjectLockModeCompliance, obj.retentionMode)
+	assert.Empty(t, obj.legalHold)
+
+	fs = server.getFs(t, false)
+	assert.False(t, IsObjectLockEnabled(NewCachedFs(fs, "namespace")))
+	err = SetObjectLock(NewCachedFs(fs, "namespace"), "/file1", retainUntil, true)
+	assert.Equal(t, ErrVfsUnsupported, err)
+	err = RemoveObjectLegalHold(fs, "/file1", info)
+	assert.Equal(t, ErrVfsUnsupported, err)
+	assert.False(t, IsObjectLockEnabled(NewOsFs("", os.TempDir(), nil)))
+}
+
+func TestS3AbortStalePartialUpload(t *testing.T) {
+	server := newFakeS3Server(t)
+	stateDir := filepath.Join(os.TempDir(), "partial_uploads_state")
+	err := InitializeResumableUploads(ResumableUploadsConfig{
+		StatePath: stateDir,
+		MaxAge:    1,
+	})
+	require.NoError(t, err)
+	defer func() {
+		err := InitializeResumableUploads(ResumableUploadsConfig{})
+		assert.NoError(t, err)
+		err = os.RemoveAll(stateDir)
+		assert.NoError(t, err)
+	}()
+
+	uploads := []*partialUpload{
+		{
+			Namespace: s3NamespacePrefix + server.server.URL + "|" + fakeS3Bucket,
+			Key:       "/dir/file",
+			Owner:     "user",
+			UploadID:  "upload_id",
+		},
+		{
+			Namespace: azBlobNamespacePrefix + "account.blob.core.windows.net/container",
+			Key:       "/file",
+			Owner:     "user",
+		},
+		{
+			Namespace: "unknown|namespace",
+			Key:       "/file",
+			Owner:     "user",
+		},
+	}
+	for _, upload := range uploads {
+		err = partialUploads.save(upload)
+		require.NoError(t, err)
+	}
+	// the endpoint and the bucket are read from the upload namespace
+	config := S3FsConfig{
+		Bucket:         "another_bucket",
+		Endpoint:       "http://127.0.0.1:1",
+		Region:         "us-east-1",
+		AccessKey:      "access_key",
+		AccessSecret:   kms.NewPlainSecret("access_secret"),
+		ForcePathStyle: true,
+	}
+	for _, upload := range uploads {
+		err = AbortStalePartialUpload(PartialUpload{
+			Namespace: upload.Namespace,
+			Key:       upload.Key,
+			Owner:     upload.Owner,
+		}, os.TempDir(), config)
+		if upload.Namespace == "unknown|namespace" {
+			assert.Error(t, err)
+			assert.NotNil(t, partialUploads.get(upload.Namespace, upload.Key))
+		} else {
+			assert.NoError(t, err)
+			assert.Nil(t, partialUploads.get(upload.Namespace, upload.Key))
+		}
+	}
+	endpoint, bucket, ok := parseS3Namespace(s3NamespacePrefix + "http://host:9000|bucket")
+	assert.True(t, ok)
+	assert.Equal(t, "http://host:9000", endpoint)
+	assert.Equal(t, "bucket", bucket)
+	_, _, ok = parseS3Namespace(s3NamespacePrefix + "endpoint")
+	assert.False(t, ok)
+}
+
+// fakeS3Object is an object stored inside fakeS3Server
+type fakeS3Object struct {
+	data          []byte
+	contentType   string
+	metadata      map[string]string
+	lastModified  time.Time
+	retentionMode string
+	retainUntil   time.Time
+	legalHold     string
+}
+
+func (o *fakeS3Object) getETag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeS3Server is a minimal in memory implementation of the S3 API, for a
+// single bucket with path style requests, to test S3Fs without a real S3
+// compatible storage
+type fakeS3Server struct {
+	sync.Mutex
+	server  *httptest.Server
+	objects map[string]*fakeS3Object
+}
+
+func newFakeS3Server(t *testing.T) *fakeS3Server {
+	s := &fakeS3Server{
+		objects: make(map[string]*fakeS3Object),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeS3Server) getFs(t *testing.T, listMetadata bool) *S3Fs {
+	return s.getFsWithConfig(t, S3FsConfig{
+		ListMetadata: listMetadata,
+	})
+}
+
+func (s *fakeS3Server) getFsWithConfig(t *testing.T, config S3FsConfig) *S3Fs {
+	config.Bucket = fakeS3Bucket
+	config.Region = "us-east-1"
+	config.AccessKey = "access_key"
+	config.AccessSecret = kms.NewPlainSecret("access_secret")
+	config.Endpoint = s.server.URL
+	config.ForcePathStyle = true
+	fs, err := NewS3Fs("", os.TempDir(), config)
+	require.NoError(t, err)
+	return fs.(*S3Fs)
+}
+
+func (s *fakeS3Server) putObject(key string, data []byte, lastModified time.Time, metadata map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.objects[key] = &fakeS3Object{
+		data:         data,
+		metadata:     metadata,
+		lastModified: lastModified.UTC().Truncate(time.Second),
+	}
+}
+
+func (s *fakeS3Server) getObject(key string) *fakeS3Object {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.objects[key]
+}
+
+func (s *fakeS3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	bucketPrefix := "/" + fakeS3Bucket
+	if r.URL.Path != bucketPrefix && !strings.HasPrefix(r.URL.Path, bucketPrefix+"/") {
+		s.sendError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPrefix), "/")
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			s.listObjects(w, r)
+		default:
+			s.sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		obj, ok := s.objects[key]
+		if !ok {
+			s.sendError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.setObjectHeaders(w, obj)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		s.sendObjectData(w, r, obj)
+	case http.MethodPut:
+		query := r.URL.Query()
+		if _, ok := query["retention"]; ok {
+			s.putObjectLock(w, r, key, false)
+			return
+		}
+		if _, ok := query["legal-hold"]; ok {
+			s.putObjectLock(w, r, key, true)
+			return
+		}
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			s.copyObject(w, r, key, copySource)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.sendError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		obj := &fakeS3Object{
+			data:         data,
+			contentType:  r.Header.Get("Content-Type"),
+			metadata:     getFakeS3Metadata(r.Header),
+			lastModified: time.Now().UTC().Truncate(time.Second),
+		}
+		s.objects[key] = obj
+		w.Header().Set("ETag", obj.getETag())
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// putObjectLock sets the retention or the legal hold for an existing object
+func (s *fakeS3Server) putObjectLock(w http.ResponseWriter, r *http.Request, key string, isLegalHold bool) {
+	obj, ok := s.objects[key]
+	if !ok {
+		s.sendError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	var lock struct {
+		Mode            string
+		RetainUntilDate time.Time
+		Status          string
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&lock); err != nil {
+		s.sendError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	if isLegalHold {
+		obj.legalHold = lock.Status
+	} else {
+		obj.retentionMode = lock.Mode
+		obj.retainUntil = lock.RetainUntilDate
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeS3Server) copyObject(w http.ResponseWriter, r *http.Request, key, copySource string) {
+	source, err := url.PathUnescape(copySource)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), fakeS3Bucket+"/")
+	src, ok := s.objects[source]
+	if !ok {
+		s.sendError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	obj := &fakeS3Object{
+		data:         src.data,
+		contentType:  src.contentType,
+		metadata:     src.metadata,
+		lastModified: time.Now().UTC().Truncate(time.Second),
+	}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		obj.contentType = r.Header.Get("Content-Type")
+		obj.metadata = getFakeS3Metadata(r.Header)
+	}
+	s.objects[key] = obj
+	s.sendXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{
+		LastModified: obj.lastModified.Format(time.RFC3339),
+		ETag:         obj.getETag(),
+	})
+}
+
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	result := struct {
+		XMLName        xml.Name       `xml:"ListBucketResult"`
+		Name           string         `xml:"Name"`
+		Prefix         string         `xml:"Prefix"`
+		Delimiter      string         `xml:"Delimiter,omitempty"`
+		KeyCount       int            `xml:"KeyCount"`
+		IsTruncated    bool           `xml:"IsTruncated"`
+		Contents       []content      `xml:"Contents"`
+		CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+	}{
+		Name:      fakeS3Bucket,
+		Prefix:    r.URL.Query().Get("prefix"),
+		Delimiter: r.URL.Query().Get("delimiter"),
+	}
+	maxKeys := 1000
+	if val := r.URL.Query().Get("max-keys"); val != "" {
+		maxKeys, _ = strconv.Atoi(val)
+	}
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	prefixes := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, result.Prefix) {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if result.Delimiter != "" {
+			if idx := strings.Index(key[len(result.Prefix):], result.Delimiter); idx >= 0 {
+				p := key[:len(result.Prefix)+idx+len(result.Delimiter)]
+				if !prefixes[p] {
+					prefixes[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+					result.KeyCount++
+				}
+				continue
+			}
+		}
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.lastModified.Format(time.RFC3339),
+			ETag:         obj.getETag(),
+			Size:         int64(len(obj.data)),
+		})
+		result.KeyCount++
+	}
+	s.sendXML(w, result)
+}
+
+func (s *fakeS3Server) setObjectHeaders(w http.ResponseWriter, obj *fakeS3Object) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	w.Header().Set("ETag", obj.getETag())
+	if obj.contentType != "" {
+		w.Header().Set("Content-Type", obj.contentType)
+	}
+	for k, v := range obj.metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+}
+
+func (s *fakeS3Server) sendObjectData(w http.ResponseWriter, r *http.Request, obj *fakeS3Object) {
+	data := obj.data
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.WriteHeader(http.StatusOK)
+		w.Write(data) //nolint:errcheck
+		return
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil ||
+		start >= int64(len(data)) || start > end {
+		s.sendError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= int64(len(data)) {
+		end = int64(len(data)) - 1
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data[start : end+1]) //nolint:errcheck
+}
+
+func (s *fakeS3Server) sendXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data) //nolint:errcheck
+}
+
+func (s *fakeS3Server) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
+
+// getFakeS3Metadata returns the user metadata sent inside the request headers
+func getFakeS3Metadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			metadata[strings.ToLower(k[len("x-amz-meta-"):])] = header.Get(k)
+		}
+	}
+	return metadata
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path"
@@ -16,12 +15,10 @@ import (
 	"github.com/eikenb/pipeat"
 	"github.com/pkg/sftp"
 	"github.com/rs/xid"
-	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
-	"github.com/drakkan/sftpgo/version"
 )
 
 const (
@@ -103,9 +100,10 @@ type SFTPFs struct {
 	sync.Mutex
 	connectionID string
 	config       *SFTPFsConfig
-	sshClient    *ssh.Client
+	conn         *sftpFsConn
 	sftpClient   *sftp.Client
-	err          chan error
+	// closed when the current SFTP session ends
+	sessionDone chan struct{}
 }
 
 // NewSFTPFs returns an SFTPFa object that allows to interact with an SFTP server
@@ -126,7 +124,6 @@ func NewSFTPFs(connectionID string, config SFTPFsConfig) (Fs, error) {
 	sftpFs := &SFTPFs{
 		connectionID: connectionID,
 		config:       &config,
-		err:          make(chan error, 1),
 	}
 	err := sftpFs.createConnection()
 	return sftpFs, err
@@ -144,123 +141,139 @@ func (fs *SFTPFs) ConnectionID() string {
 
 // Stat returns a FileInfo describing the named file
 func (fs *SFTPFs) Stat(name string) (os.FileInfo, error) {
-	if err := fs.checkConnection(); err != nil {
-		return nil, err
-	}
-	return fs.sftpClient.Stat(name)
+	var info os.FileInfo
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(name)
+		return err
+	})
+	return info, err
 }
 
 // Lstat returns a FileInfo describing the named file
 func (fs *SFTPFs) Lstat(name string) (os.FileInfo, error) {
-	if err := fs.checkConnection(); err != nil {
-		return nil, err
-	}
-	return fs.sftpClient.Lstat(name)
+	var info os.FileInfo
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		var err error
+		info, err = client.Lstat(name)
+		return err
+	})
+	return info, err
 }
 
 // Open opens the named file for reading
 func (fs *SFTPFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
-	if err := fs.checkConnection(); err != nil {
-		return nil, nil, nil, err
-	}
-	f, err := fs.sftpClient.Open(name)
+	var f File
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		var err error
+		f, err = client.Open(name)
+		return err
+	})
 	return f, nil, nil, err
 }
 
 // Create creates or opens the named file for writing
 func (fs *SFTPFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
-	err := fs.checkConnection()
-	if err != nil {
-		return nil, nil, nil, err
-	}
 	var f File
-	if flag == 0 {
-		f, err = fs.sftpClient.Create(name)
-	} else {
-		f, err = fs.sftpClient.OpenFile(name, flag)
-	}
+	err := fs.withSession(false, func(client *sftp.Client) error {
+		var err error
+		if flag == 0 {
+			f, err = client.Create(name)
+		} else {
+			f, err = client.OpenFile(name, flag)
+		}
+		return err
+	})
 	return f, nil, nil, err
 }
 
 // Rename renames (moves) source to target.
 func (fs *SFTPFs) Rename(source, target string) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Rename(source, target)
+	return fs.withSession(false, func(client *sftp.Client) error {
+		return client.Rename(source, target)
+	})
 }
 
 // Remove removes the named file or (empty) directory.
 func (fs *SFTPFs) Remove(name string, isDir bool) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Remove(name)
+	return fs.withSession(false, func(client *sftp.Client) error {
+		return client.Remove(name)
+	})
 }
 
 // Mkdir creates a new directory with the specified name and default permissions
 func (fs *SFTPFs) Mkdir(name string) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Mkdir(name)
+	return fs.withSession(false, func(client *sftp.Client) error {
+		return client.Mkdir(name)
+	})
 }
 
 // Symlink creates source as a symbolic link to target.
 func (fs *SFTPFs) Symlink(source, target string) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Symlink(source, target)
+	return fs.withSession(false, func(client *sftp.Client) error {
+		return client.Symlink(source, target)
+	})
 }
 
 // Readlink returns the destination of the named symbolic link
 func (fs *SFTPFs) Readlink(name string) (string, error) {
-	if err := fs.checkConnection(); err != nil {
-		return "", err
-	}
-	return fs.sftpClient.ReadLink(name)
+	var target string
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		var err error
+		target, err = client.ReadLink(name)
+		return err
+	})
+	return target, err
 }
 
 // Chown changes the numeric uid and gid of the named file.
 func (fs *SFTPFs) Chown(name string, uid int, gid int) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Chown(name, uid, gid)
+	return fs.withSession(true, func(client *sftp.Client) error {
+		return client.Chown(name, uid, gid)
+	})
 }
 
 // Chmod changes the mode of the named file to mode.
 func (fs *SFTPFs) Chmod(name string, mode os.FileMode) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Chmod(name, mode)
+	return fs.withSession(true, func(client *sftp.Client) error {
+		return client.Chmod(name, mode)
+	})
 }
 
 // Chtimes changes the access and modification times of the named file.
 func (fs *SFTPFs) Chtimes(name string, atime, mtime time.Time) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Chtimes(name, atime, mtime)
+	return fs.withSession(true, func(client *sftp.Client) error {
+		return client.Chtimes(name, atime, mtime)
+	})
 }
 
 // Truncate changes the size of the named file.
 func (fs *SFTPFs) Truncate(name string, size int64) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	return fs.sftpClient.Truncate(name, size)
+	return fs.withSession(true, func(client *sftp.Client) error {
+		return client.Truncate(name, size)
+	})
 }
 
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	if err := fs.checkConnection(); err != nil {
+	var files []os.FileInfo
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		var err error
+		files, err = client.ReadDir(dirname)
+		return err
+	})
+	return files, err
+}
+
+// OpenDir returns a DirLister for the directory named by dirname,
+// the SFTP client reads the whole directory, the entries are returned page by page from memory
+func (fs *SFTPFs) OpenDir(dirname string) (DirLister, error) {
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
 		return nil, err
 	}
-	return fs.sftpClient.ReadDir(dirname)
+	return newSliceDirLister(files), nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
@@ -333,21 +346,21 @@ func (fs *SFTPFs) GetRelativePath(name string) string {
 // Walk walks the file tree rooted at root, calling walkFn for each file or
 // directory in the tree, including root
 func (fs *SFTPFs) Walk(root string, walkFn filepath.WalkFunc) error {
-	if err := fs.checkConnection(); err != nil {
-		return err
-	}
-	walker := fs.sftpClient.Walk(root)
-	for walker.Step() {
-		err := walker.Err()
-		if err != nil {
-			return err
-		}
-		err = walkFn(walker.Path(), walker.Stat(), err)
-		if err != nil {
-			return err
+	// walkFn could be called again for the same files, so we don't retry
+	return fs.withSession(false, func(client *sftp.Client) error {
+		walker := client.Walk(root)
+		for walker.Step() {
+			err := walker.Err()
+			if err != nil {
+				return err
+			}
+			err = walkFn(walker.Path(), walker.Stat(), err)
+			if err != nil {
+				return err
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // Join joins any number of path elements into a single path
@@ -369,9 +382,6 @@ func (fs *SFTPFs) ResolvePath(virtualPath string) (string, error) {
 	if fs.config.Prefix != "/" && fsPath != "/" {
 		// we need to check if this path is a symlink outside the given prefix
 		// or a file/dir inside a dir symlinked outside the prefix
-		if err := fs.checkConnection(); err != nil {
-			return "", err
-		}
 		var validatedPath string
 		var err error
 		validatedPath, err = fs.getRealPath(fsPath)
@@ -405,12 +415,12 @@ func (fs *SFTPFs) ResolvePath(virtualPath string) (string, error) {
 
 // getRealPath returns the real remote path trying to resolve symbolic links if any
 func (fs *SFTPFs) getRealPath(name string) (string, error) {
-	info, err := fs.sftpClient.Lstat(name)
+	info, err := fs.Lstat(name)
 	if err != nil {
 		return name, err
 	}
 	if info.Mode()&os.ModeSymlink != 0 {
-		return fs.sftpClient.ReadLink(name)
+		return fs.Readlink(name)
 	}
 	return name, err
 }
@@ -435,63 +445,63 @@ func (fs *SFTPFs) isSubDir(name string) error {
 func (fs *SFTPFs) GetDirSize(dirname string) (int, int64, error) {
 	numFiles := 0
 	size := int64(0)
-	if err := fs.checkConnection(); err != nil {
+	isDir, err := IsDirectory(fs, dirname)
+	if err != nil || !isDir {
 		return numFiles, size, err
 	}
-	isDir, err := IsDirectory(fs, dirname)
-	if err == nil && isDir {
-		walker := fs.sftpClient.Walk(dirname)
+	err = fs.withSession(true, func(client *sftp.Client) error {
+		numFiles = 0
+		size = 0
+		walker := client.Walk(dirname)
 		for walker.Step() {
 			err := walker.Err()
 			if err != nil {
-				return numFiles, size, err
+				return err
 			}
 			if walker.Stat().Mode().IsRegular() {
 				size += walker.Stat().Size()
 				numFiles++
 			}
 		}
-	}
+		return nil
+	})
 	return numFiles, size, err
 }
 
 // GetMimeType returns the content type
 func (fs *SFTPFs) GetMimeType(name string) (string, error) {
-	if err := fs.checkConnection(); err != nil {
-		return "", err
-	}
-	f, err := fs.sftpClient.OpenFile(name, os.O_RDONLY)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	var buf [512]byte
-	n, err := io.ReadFull(f, buf[:])
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return "", err
-	}
-	ctype := http.DetectContentType(buf[:n])
-	// Rewind file.
-	_, err = f.Seek(0, io.SeekStart)
+	var ctype string
+	err := fs.withSession(true, func(client *sftp.Client) error {
+		f, err := client.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var buf [512]byte
+		n, err := io.ReadFull(f, buf[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		ctype = http.DetectContentType(buf[:n])
+		// Rewind file.
+		_, err = f.Seek(0, io.SeekStart)
+		return err
+	})
 	return ctype, err
 }
 
-// Close the connection
+// Close the SFTP session and releases the shared SSH connection
 func (fs *SFTPFs) Close() error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	var sftpErr, sshErr error
+	var err error
 	if fs.sftpClient != nil {
-		sftpErr = fs.sftpClient.Close()
-	}
-	if fs.sshClient != nil {
-		sshErr = fs.sshClient.Close()
+		err = fs.sftpClient.Close()
+		fs.sftpClient = nil
 	}
-	if sftpErr != nil {
-		return sftpErr
-	}
-	return sshErr
+	fs.releaseConnection()
+	return err
 }
 
 // GetAvailableDiskSize return the available size for the specified path
@@ -499,81 +509,100 @@ func (*SFTPFs) GetAvailableDiskSize(dirName string) (int64, error) {
 	return 0, errStorageSizeUnavailable
 }
 
-func (fs *SFTPFs) checkConnection() error {
-	err := fs.closed()
-	if err == nil {
-		return nil
+// withSession calls fn with the client for the current SFTP session, a new
+// session is opened if the current one is closed. If retry is true and fn
+// fails since the session was lost, for example because the shared SSH
+// connection was closed, fn is called once more using a new session.
+// Only the requests that can be sent twice without side effects, for example
+// the ones that don't modify the remote files, must be retried: a lost
+// request could have been executed by the remote server
+func (fs *SFTPFs) withSession(retry bool, fn func(client *sftp.Client) error) error {
+	client, err := fs.getClient(nil)
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !retry || !isSFTPFsSessionError(err) {
+		return err
 	}
-	return fs.createConnection()
+	fsLog(fs, logger.LevelDebug, "SFTP session lost, retrying the request using a new session: %v", err)
+	client, errSession := fs.getClient(client)
+	if errSession != nil {
+		fsLog(fs, logger.LevelWarn, "unable to open a new SFTP session: %v", errSession)
+		return err
+	}
+	return fn(client)
 }
 
-func (fs *SFTPFs) createConnection() error {
+// getClient returns the client for the current SFTP session. A new session is
+// opened if the current session is closed or if it uses the given failed
+// client, unless another request already replaced it
+func (fs *SFTPFs) getClient(failed *sftp.Client) (*sftp.Client, error) {
 	fs.Lock()
 	defer fs.Unlock()
 
-	var err error
-	clientConfig := &ssh.ClientConfig{
-		User: fs.config.Username,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			if len(fs.config.Fingerprints) > 0 {
-				fp := ssh.FingerprintSHA256(key)
-				for _, provided := range fs.config.Fingerprints {
-					if provided == fp {
-						return nil
-					}
-				}
-				return fmt.Errorf("Invalid fingerprint %#v", fp)
-			}
-			fsLog(fs, logger.LevelWarn, "login without host key validation, please provide at least a fingerprint!")
-			return nil
-		},
-		ClientVersion: fmt.Sprintf("SSH-2.0-SFTPGo_%v", version.Get().Version),
-	}
-	if fs.config.PrivateKey.GetPayload() != "" {
-		signer, err := ssh.ParsePrivateKey([]byte(fs.config.PrivateKey.GetPayload()))
-		if err != nil {
-			fs.err <- err
-			return err
+	if fs.sftpClient != nil && fs.sftpClient != failed {
+		select {
+		case <-fs.sessionDone:
+		default:
+			return fs.sftpClient, nil
 		}
-		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
 	}
-	if fs.config.Password.GetPayload() != "" {
-		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(fs.config.Password.GetPayload()))
+	if err := fs.createConnectionLocked(); err != nil {
+		return nil, err
 	}
-	fs.sshClient, err = ssh.Dial("tcp", fs.config.Endpoint, clientConfig)
-	if err != nil {
-		fs.err <- err
-		return err
+	return fs.sftpClient, nil
+}
+
+func (fs *SFTPFs) createConnection() error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	return fs.createConnectionLocked()
+}
+
+// createConnectionLocked opens a new SFTP session using a shared SSH connection,
+// the previous session, if any, is closed. The fs lock must be held
+func (fs *SFTPFs) createConnectionLocked() error {
+	if fs.sftpClient != nil {
+		fs.sftpClient.Close()
+		fs.sftpClient = nil
 	}
-	fs.sftpClient, err = sftp.NewClient(fs.sshClient)
+	fs.releaseConnection()
+	conn, sftpClient, err := sftpFsConnPool.getSession(fs)
 	if err != nil {
-		fs.sshClient.Close()
-		fs.err <- err
 		return err
 	}
-	go fs.wait()
+	fs.conn = conn
+	fs.sftpClient = sftpClient
+	fs.sessionDone = make(chan struct{})
+	go fs.wait(sftpClient, fs.sessionDone)
 	return nil
 }
 
-func (fs *SFTPFs) wait() {
+// releaseConnection releases the shared SSH connection, if any.
+// The fs lock must be held
+func (fs *SFTPFs) releaseConnection() {
+	if fs.conn != nil {
+		sftpFsConnPool.release(fs.conn)
+		fs.conn = nil
+	}
+}
+
+func (fs *SFTPFs) wait(sftpClient *sftp.Client, done chan struct{}) {
 	// we wait on the sftp client otherwise if the channel is closed but not the connection
 	// we don't detect the event.
-	fs.err <- fs.sftpClient.Wait()
-	fsLog(fs, logger.LevelDebug, "sftp channel closed")
-
-	fs.Lock()
-	defer fs.Unlock()
-
-	if fs.sshClient != nil {
-		fs.sshClient.Close()
-	}
+	err := sftpClient.Wait()
+	close(done)
+	fsLog(fs, logger.LevelDebug, "sftp channel closed: %v", err)
 }
 
-func (fs *SFTPFs) closed() error {
-	select {
-	case err := <-fs.err:
-		return err
-	default:
-		return nil
+// isSFTPFsSessionError returns true if err is not a status returned by the
+// remote server, so the request failed since the SFTP session was lost
+func isSFTPFsSessionError(err error) bool {
+	if err == nil || os.IsNotExist(err) || os.IsPermission(err) {
+		return false
 	}
+	var statusErr *sftp.StatusError
+	return !errors.As(err, &statusErr)
 }
@@ -0,0 +1,432 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/version"
+)
+
+const (
+	sftpFsPoolLogSender       = "sftpfspool"
+	sftpFsKeepaliveRequest    = "keepalive@openssh.com"
+	sftpFsMinKeepaliveTimeout = 15 * time.Second
+)
+
+var (
+	errSFTPFsPoolLimitReached = errors.New("the maximum number of connections to the SFTP endpoint has been reached")
+	sftpFsConnPool            = newSFTPFsPool(SFTPFsPoolConfig{})
+)
+
+// SFTPFsPoolConfig defines how the SSH connections to the remote SFTP servers
+// used as storage backends are shared between the SFTPGo connections.
+// The connections are shared only if they use the same endpoint and credentials
+type SFTPFsPoolConfig struct {
+	// Maximum number of SSH connections to the same endpoint, regardless of the
+	// credentials. 0 means unlimited
+	MaxConnectionsPerEndpoint int `json:"max_connections_per_endpoint" mapstructure:"max_connections_per_endpoint"`
+	// Maximum number of SFTP sessions opened on each SSH connection. Each SFTPGo
+	// connection uses its own SFTP session. 0 or 1 means that the SSH connections
+	// are not shared
+	MaxSessionsPerConnection int `json:"max_sessions_per_connection" mapstructure:"max_sessions_per_connection"`
+	// Interval, as seconds, between the keepalive requests sent on each SSH
+	// connection. A connection that does not reply is closed. 0 disables keepalives
+	KeepaliveInterval int `json:"keepalive_interval" mapstructure:"keepalive_interval"`
+	// SSH connections without SFTP sessions are closed after this number of seconds.
+	// 0 means that they are closed as soon as the last session ends
+	IdleTimeout int `json:"idle_timeout" mapstructure:"idle_timeout"`
+}
+
+// InitializeSFTPFsPool sets the configuration for the SSH connections to the
+// SFTP storage backends. The open connections without sessions are closed, the
+// other ones are closed when their last session ends if the new configuration
+// requires this
+func InitializeSFTPFsPool(c SFTPFsPoolConfig) error {
+	if c.MaxConnectionsPerEndpoint < 0 {
+		return fmt.Errorf("invalid max connections per endpoint: %v", c.MaxConnectionsPerEndpoint)
+	}
+	if c.MaxSessionsPerConnection < 0 {
+		return fmt.Errorf("invalid max sessions per connection: %v", c.MaxSessionsPerConnection)
+	}
+	if c.KeepaliveInterval < 0 {
+		return fmt.Errorf("invalid keepalive interval: %v", c.KeepaliveInterval)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout: %v", c.IdleTimeout)
+	}
+	sftpFsConnPool.setConfig(c)
+	logger.Debug(sftpFsPoolLogSender, "", "SFTP connections pool initialized with config %+v", c)
+	return nil
+}
+
+// SFTPFsPoolStats defines the usage statistics for the SSH connections to the
+// SFTP storage backends
+type SFTPFsPoolStats struct {
+	Connections int `json:"connections"`
+	Sessions    int `json:"sessions"`
+}
+
+// GetSFTPFsPoolStats returns the number of open SSH connections to the SFTP
+// storage backends and the number of SFTP sessions using them
+func GetSFTPFsPoolStats() SFTPFsPoolStats {
+	return sftpFsConnPool.getStats()
+}
+
+// sftpFsConn is an SSH connection shared between SFTP sessions
+// that use the same endpoint and credentials
+type sftpFsConn struct {
+	key       string
+	endpoint  string
+	sshClient *ssh.Client
+	// ready is closed when the connection is established or dialErr is set
+	ready    chan struct{}
+	dialErr  error
+	sessions int
+	lastUsed time.Time
+	isClosed bool
+	// noNewSessions is set if the remote server refused to open a new session
+	noNewSessions bool
+	done          chan struct{}
+}
+
+func (c *sftpFsConn) dial(fs *SFTPFs) error {
+	clientConfig := &ssh.ClientConfig{
+		User: fs.config.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if len(fs.config.Fingerprints) > 0 {
+				fp := ssh.FingerprintSHA256(key)
+				for _, provided := range fs.config.Fingerprints {
+					if provided == fp {
+						return nil
+					}
+				}
+				return fmt.Errorf("Invalid fingerprint %#v", fp)
+			}
+			fsLog(fs, logger.LevelWarn, "login without host key validation, please provide at least a fingerprint!")
+			return nil
+		},
+		ClientVersion: fmt.Sprintf("SSH-2.0-SFTPGo_%v", version.Get().Version),
+	}
+	if fs.config.PrivateKey.GetPayload() != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(fs.config.PrivateKey.GetPayload()))
+		if err != nil {
+			return err
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if fs.config.Password.GetPayload() != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(fs.config.Password.GetPayload()))
+	}
+	sshClient, err := ssh.Dial("tcp", fs.config.Endpoint, clientConfig)
+	if err != nil {
+		return err
+	}
+	c.sshClient = sshClient
+	return nil
+}
+
+// sendKeepalive returns an error if the remote server does not reply to a
+// keepalive request within the given timeout
+func (c *sftpFsConn) sendKeepalive(timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.sshClient.SendRequest(sftpFsKeepaliveRequest, true, nil)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return errors.New("keepalive timeout")
+	}
+}
+
+type sftpFsPool struct {
+	sync.Mutex
+	config SFTPFsPoolConfig
+	// connections grouped by endpoint
+	conns map[string][]*sftpFsConn
+}
+
+func newSFTPFsPool(config SFTPFsPoolConfig) *sftpFsPool {
+	return &sftpFsPool{
+		config: config,
+		conns:  make(map[string][]*sftpFsConn),
+	}
+}
+
+func (p *sftpFsPool) setConfig(config SFTPFsPoolConfig) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.config = config
+	var idleConns []*sftpFsConn
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			if c.sessions == 0 {
+				idleConns = append(idleConns, c)
+			}
+		}
+	}
+	for _, c := range idleConns {
+		p.closeLocked(c)
+	}
+	p.updateMetricsLocked()
+}
+
+func (p *sftpFsPool) getStats() SFTPFsPoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.getStatsLocked()
+}
+
+func (p *sftpFsPool) getStatsLocked() SFTPFsPoolStats {
+	stats := SFTPFsPoolStats{}
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			stats.Connections++
+			stats.Sessions += c.sessions
+		}
+	}
+	return stats
+}
+
+func (p *sftpFsPool) updateMetricsLocked() {
+	stats := p.getStatsLocked()
+	metrics.UpdateSFTPFsPoolStats(stats.Connections, stats.Sessions)
+}
+
+// getSession returns a new SFTP session opened on a shared SSH connection.
+// A new SSH connection is established if there are no reusable connections
+func (p *sftpFsPool) getSession(fs *SFTPFs) (*sftpFsConn, *sftp.Client, error) {
+	conn, reused, err := p.acquire(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	sftpClient, err := sftp.NewClient(conn.sshClient)
+	if err != nil {
+		// the remote server could limit the sessions per connection, the
+		// other sessions are still usable but no new session is opened
+		p.setNoNewSessions(conn)
+		p.release(conn)
+		if !reused {
+			// wait will remove the connection from the pool
+			conn.sshClient.Close()
+			return nil, nil, err
+		}
+		fsLog(fs, logger.LevelDebug, "unable to open a new session on a shared SSH connection, retrying: %v", err)
+		return p.getSession(fs)
+	}
+	return conn, sftpClient, nil
+}
+
+// acquire returns an SSH connection for the given filesystem and a boolean
+// indicating if it is an existing connection
+func (p *sftpFsPool) acquire(fs *SFTPFs) (*sftpFsConn, bool, error) {
+	key := getSFTPFsPoolKey(fs.config)
+	endpoint := fs.config.Endpoint
+
+	p.Lock()
+	conn := p.getReusableConnLocked(endpoint, key)
+	if conn != nil {
+		conn.sessions++
+		p.updateMetricsLocked()
+		p.Unlock()
+		<-conn.ready
+		if conn.dialErr != nil {
+			p.release(conn)
+			return nil, false, conn.dialErr
+		}
+		metrics.SFTPFsPoolConnectionReused()
+		fsLog(fs, logger.LevelDebug, "reusing SSH connection to %#v", endpoint)
+		return conn, true, nil
+	}
+	if p.config.MaxConnectionsPerEndpoint > 0 && len(p.conns[endpoint]) >= p.config.MaxConnectionsPerEndpoint {
+		p.Unlock()
+		fsLog(fs, logger.LevelWarn, "unable to connect to %#v: %v", endpoint, errSFTPFsPoolLimitReached)
+		return nil, false, errSFTPFsPoolLimitReached
+	}
+	conn = &sftpFsConn{
+		key:      key,
+		endpoint: endpoint,
+		ready:    make(chan struct{}),
+		sessions: 1,
+		done:     make(chan struct{}),
+	}
+	p.conns[endpoint] = append(p.conns[endpoint], conn)
+	p.updateMetricsLocked()
+	p.Unlock()
+
+	err := conn.dial(fs)
+	metrics.SFTPFsPoolDialCompleted(err)
+	if err != nil {
+		conn.dialErr = err
+		close(conn.ready)
+		p.remove(conn)
+		return nil, false, err
+	}
+	close(conn.ready)
+	fsLog(fs, logger.LevelDebug, "new SSH connection to %#v established", endpoint)
+	go p.wait(conn)
+	go p.monitor(conn)
+	return conn, false, nil
+}
+
+// getReusableConnLocked returns the least loaded connection for the given key
+// with free sessions, if any. The pool lock must be held
+func (p *sftpFsPool) getReusableConnLocked(endpoint, key string) *sftpFsConn {
+	if p.config.MaxSessionsPerConnection <= 1 {
+		return nil
+	}
+	var result *sftpFsConn
+	for _, c := range p.conns[endpoint] {
+		if c.key != key || c.isClosed || c.noNewSessions || c.dialErr != nil ||
+			c.sessions >= p.config.MaxSessionsPerConnection {
+			continue
+		}
+		if result == nil || c.sessions < result.sessions {
+			result = c
+		}
+	}
+	return result
+}
+
+func (p *sftpFsPool) setNoNewSessions(conn *sftpFsConn) {
+	p.Lock()
+	defer p.Unlock()
+
+	conn.noNewSessions = true
+}
+
+// release must be called when an SFTP session is closed
+func (p *sftpFsPool) release(conn *sftpFsConn) {
+	p.Lock()
+	defer p.Unlock()
+
+	conn.sessions--
+	conn.lastUsed = time.Now()
+	if conn.sessions == 0 && p.config.IdleTimeout == 0 {
+		p.closeLocked(conn)
+	}
+	p.updateMetricsLocked()
+}
+
+func (p *sftpFsPool) remove(conn *sftpFsConn) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.removeLocked(conn)
+	p.updateMetricsLocked()
+}
+
+func (p *sftpFsPool) removeLocked(conn *sftpFsConn) {
+	conns := p.conns[conn.endpoint]
+	for idx, c := range conns {
+		if c == conn {
+			conns = append(conns[:idx], conns[idx+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.conns, conn.endpoint)
+	} else {
+		p.conns[conn.endpoint] = conns
+	}
+}
+
+func (p *sftpFsPool) closeLocked(conn *sftpFsConn) {
+	p.removeLocked(conn)
+	if !conn.isClosed {
+		conn.isClosed = true
+		close(conn.done)
+		if conn.sshClient != nil {
+			conn.sshClient.Close()
+		}
+	}
+}
+
+// wait removes the connection from the pool when it is closed, the existing
+// SFTP sessions will fail and the next requests will use a new connection
+func (p *sftpFsPool) wait(conn *sftpFsConn) {
+	err := conn.sshClient.Wait()
+	logger.Debug(sftpFsPoolLogSender, "", "SSH connection to %#v closed: %v", conn.endpoint, err)
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.closeLocked(conn)
+	p.updateMetricsLocked()
+}
+
+// monitor sends the keepalive requests and closes the idle connection
+func (p *sftpFsPool) monitor(conn *sftpFsConn) {
+	p.Lock()
+	keepaliveInterval := time.Duration(p.config.KeepaliveInterval) * time.Second
+	idleTimeout := time.Duration(p.config.IdleTimeout) * time.Second
+	p.Unlock()
+
+	checkInterval := keepaliveInterval
+	if checkInterval == 0 || (idleTimeout > 0 && idleTimeout < checkInterval) {
+		checkInterval = idleTimeout
+	}
+	if checkInterval == 0 {
+		return
+	}
+	keepaliveTimeout := keepaliveInterval
+	if keepaliveTimeout < sftpFsMinKeepaliveTimeout {
+		keepaliveTimeout = sftpFsMinKeepaliveTimeout
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	lastKeepalive := time.Now()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			p.Lock()
+			if conn.sessions == 0 && idleTimeout > 0 && time.Since(conn.lastUsed) >= idleTimeout {
+				logger.Debug(sftpFsPoolLogSender, "", "closing idle SSH connection to %#v", conn.endpoint)
+				p.closeLocked(conn)
+				p.updateMetricsLocked()
+				p.Unlock()
+				return
+			}
+			p.Unlock()
+			if keepaliveInterval > 0 && time.Since(lastKeepalive) >= keepaliveInterval {
+				lastKeepalive = time.Now()
+				if err := conn.sendKeepalive(keepaliveTimeout); err != nil {
+					logger.Warn(sftpFsPoolLogSender, "", "keepalive error for the SSH connection to %#v, closing: %v",
+						conn.endpoint, err)
+					// wait will remove the connection from the pool
+					conn.sshClient.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// getSFTPFsPoolKey returns the key that identifies the connections that can be
+// shared, the credentials are hashed so they are not stored in plain text twice
+func getSFTPFsPoolKey(config *SFTPFsConfig) string {
+	h := sha256.New()
+	for _, val := range []string{config.Endpoint, config.Username, config.Password.GetPayload(),
+		config.PrivateKey.GetPayload(), strings.Join(config.Fingerprints, ",")} {
+		h.Write([]byte(val)) //nolint:errcheck
+		h.Write([]byte{0})   //nolint:errcheck
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
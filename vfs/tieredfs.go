@@ -0,0 +1,871 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	tieringLogSender = "tiering"
+	// tieredFsName is the name prefix for the Fs implementation that moves
+	// the files to the tiering target
+	tieredFsName = "tieredfs"
+	// name prefix for the temporary files created while moving a file to the
+	// tiering target or recalling it. The files and directories whose name
+	// starts with internalNamePrefix, for example the versions, are never moved
+	tieringTempPrefix  = ".sftpgo-tiering."
+	internalNamePrefix = ".sftpgo-"
+)
+
+// supported tiering targets
+const (
+	TieringProviderLocal = storageTargetLocal
+	TieringProviderS3    = storageTargetS3
+)
+
+var (
+	tieringTarget         Fs
+	tieringLocks          = newTieringPathLocks()
+	errTieringDisabled    = errors.New("the tiering policy is not enabled")
+	errTieringFileChanged = errors.New("the file was modified while moving it to the tiering target")
+)
+
+// TieringConfig defines the target for the storage tiering. The files are
+// moved from the local disk to this target based on the users policies
+type TieringConfig struct {
+	// Tiering target: "local" or "s3". Leave empty to disable the tiering
+	Provider string `json:"provider" mapstructure:"provider"`
+	// Interval, in minutes, to apply the users tiering policies.
+	// 0 means that the files are moved only on demand using the REST API
+	CheckInterval int `json:"check_interval" mapstructure:"check_interval"`
+	// Absolute path to the target directory for the local provider, for
+	// example a mounted network share
+	LocalPath string `json:"local_path" mapstructure:"local_path"`
+	// S3 settings for the s3 provider. The access secret can be plain or
+	// encrypted, leave both the access key and secret empty to use the
+	// default AWS credentials chain
+	Bucket         string      `json:"bucket" mapstructure:"bucket"`
+	Region         string      `json:"region" mapstructure:"region"`
+	AccessKey      string      `json:"access_key" mapstructure:"access_key"`
+	AccessSecret   *kms.Secret `json:"access_secret" mapstructure:"access_secret"`
+	Endpoint       string      `json:"endpoint" mapstructure:"endpoint"`
+	StorageClass   string      `json:"storage_class" mapstructure:"storage_class"`
+	KeyPrefix      string      `json:"key_prefix" mapstructure:"key_prefix"`
+	ForcePathStyle bool        `json:"force_path_style" mapstructure:"force_path_style"`
+}
+
+// IsEnabled returns true if a tiering target is configured
+func (c *TieringConfig) IsEnabled() bool {
+	return c.Provider != ""
+}
+
+// InitializeTiering initializes the tiering target using the given configuration
+func InitializeTiering(c TieringConfig) error {
+	tieringTarget = nil
+	if !c.IsEnabled() {
+		return nil
+	}
+	if !isTieringSupported() {
+		return errors.New("storage tiering is not supported on this platform")
+	}
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("invalid tiering check interval: %v", c.CheckInterval)
+	}
+	fs, err := newStorageTarget(c.Provider, c.LocalPath, S3FsConfig{
+		Bucket:         c.Bucket,
+		KeyPrefix:      c.KeyPrefix,
+		Region:         c.Region,
+		AccessKey:      c.AccessKey,
+		Endpoint:       c.Endpoint,
+		StorageClass:   c.StorageClass,
+		ForcePathStyle: c.ForcePathStyle,
+	}, c.AccessSecret)
+	if err != nil {
+		return fmt.Errorf("unable to initialize the tiering target: %v", err)
+	}
+	logger.Info(tieringLogSender, "", "storage tiering initialized, target: %v", fs.Name())
+	tieringTarget = fs
+	return nil
+}
+
+// IsTieringEnabled returns true if a tiering target is configured
+func IsTieringEnabled() bool {
+	return tieringTarget != nil
+}
+
+// TieringFsConfig defines the tiering policy for a user
+type TieringFsConfig struct {
+	// set to true to move the files not recently modified to the tiering target
+	Enabled bool `json:"enabled,omitempty"`
+	// files not modified for the specified number of days are moved
+	MinAge int `json:"min_age,omitempty"`
+	// the policy applies only to the files inside these virtual directories.
+	// Empty means the whole home directory. The virtual folders are included
+	// only if their path, or one of their sub directories, is specified here
+	Paths []string `json:"paths,omitempty"`
+	// if true the moved files are recalled to the local disk the first time
+	// they are read, otherwise they are streamed from the tiering target
+	Recall bool `json:"recall,omitempty"`
+}
+
+// IsEnabled returns true if the tiering policy is enabled
+func (c *TieringFsConfig) IsEnabled() bool {
+	return c.Enabled
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *TieringFsConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.MinAge < 1 {
+		return fmt.Errorf("invalid tiering min age: %v", c.MinAge)
+	}
+	paths, err := cleanVirtualPaths(c.Paths, "tiering")
+	if err != nil {
+		return err
+	}
+	c.Paths = paths
+	return nil
+}
+
+// TieringItem describes a file matching a tiering policy
+type TieringItem struct {
+	// virtual path for the file
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// last modification time as unix timestamp in milliseconds
+	LastModified int64 `json:"last_modified"`
+}
+
+// TieringReport is the result of a tiering policy evaluation
+type TieringReport struct {
+	// files to move for a dry run, moved files otherwise
+	Candidates []TieringItem `json:"candidates"`
+	// number and size of the files stored on the tiering target
+	TieredFiles int   `json:"tiered_files"`
+	TieredSize  int64 `json:"tiered_size"`
+	// number of files that could not be moved
+	Errors int `json:"errors"`
+}
+
+// tieringStub is stored, as extended attribute, inside the empty local file
+// that replaces a file moved to the tiering target
+type tieringStub struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// tieredFileInfo reports the size of the file stored on the tiering target
+type tieredFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *tieredFileInfo) Size() int64 {
+	return fi.size
+}
+
+// getTieringStub returns the stub for the named file if it was moved to the
+// tiering target. Only empty regular files can be stubs
+func getTieringStub(name string, info os.FileInfo) (tieringStub, bool) {
+	if info == nil || !info.Mode().IsRegular() || info.Size() != 0 {
+		return tieringStub{}, false
+	}
+	stub, err := readTieringStub(name)
+	if err != nil || stub.Key == "" {
+		return tieringStub{}, false
+	}
+	return stub, true
+}
+
+// getTieredFileInfo returns a FileInfo reporting the original size if the
+// named file was moved to the tiering target
+func getTieredFileInfo(name string, info os.FileInfo) os.FileInfo {
+	if stub, ok := getTieringStub(name, info); ok {
+		return &tieredFileInfo{
+			FileInfo: info,
+			size:     stub.Size,
+		}
+	}
+	return info
+}
+
+// TieredFs is a Fs implementation that allows to move the files not recently
+// modified from the local disk to the tiering target. A moved file is replaced
+// by an empty stub file and it is still listed with its original size, so the
+// quota is not affected, and it is streamed from the tiering target, or
+// recalled to the local disk, when it is read
+type TieredFs struct {
+	Fs
+	namespace string
+	config    TieringFsConfig
+}
+
+// NewTieredFs returns a Fs that allows to move the files stored on the given
+// local filesystem to the tiering target. The moved files are stored inside
+// the given namespace
+func NewTieredFs(fs Fs, namespace string, config TieringFsConfig) (Fs, error) {
+	if !IsLocalOsFs(fs) {
+		return nil, errors.New("storage tiering is supported for the local filesystem only")
+	}
+	if !IsTieringEnabled() {
+		return nil, errors.New("storage tiering is not configured")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &TieredFs{
+		Fs:        fs,
+		namespace: namespace,
+		config:    config,
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *TieredFs) Name() string {
+	return fmt.Sprintf("%v %v", tieredFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped local filesystem
+func (fs *TieredFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *TieredFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return getTieredFileInfo(name, info), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *TieredFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return getTieredFileInfo(name, info), nil
+}
+
+// Open opens the named file for reading. The files moved to the tiering
+// target are streamed from it and, if configured, recalled to the local disk
+func (fs *TieredFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	stub, ok := fs.getStub(name, true)
+	if !ok {
+		return fs.Fs.Open(name, offset)
+	}
+	src, err := openTieringObject(stub.Key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(filepath.Dir(name))
+	if err != nil {
+		src.Close()
+		return nil, nil, nil, err
+	}
+	recall := fs.config.Recall && tieringLocks.tryLock(name)
+
+	go func() {
+		dst := &tieringPipeWriter{
+			w:            w,
+			skip:         offset,
+			ignoreErrors: recall,
+		}
+		var err error
+		if recall {
+			err = fs.recallFrom(name, stub, src, dst)
+			tieringLocks.unlock(name)
+		} else {
+			_, err = io.Copy(dst, src)
+		}
+		src.Close()
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "tiered file %#v read, recall: %v, error: %v", name, recall, err)
+	}()
+
+	return nil, r, nil, nil
+}
+
+// Create creates or opens the named file for writing. The files moved to the
+// tiering target are recalled before they are opened without truncation
+func (fs *TieredFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	stub, ok := fs.getStub(name, true)
+	if !ok {
+		return fs.Fs.Create(name, flag)
+	}
+	if flag == 0 || flag&os.O_TRUNC != 0 {
+		f, w, cancelFn, err := fs.Fs.Create(name, flag)
+		if err == nil {
+			fs.removeStub(name, stub)
+		}
+		return f, w, cancelFn, err
+	}
+	if err := fs.recall(name); err != nil {
+		return nil, nil, nil, err
+	}
+	return fs.Fs.Create(name, flag)
+}
+
+// Rename renames (moves) source to target. If target is a file moved to the
+// tiering target it is removed from there too
+func (fs *TieredFs) Rename(source, target string) error {
+	stub, ok := fs.getStub(target, false)
+	if err := fs.Fs.Rename(source, target); err != nil {
+		return err
+	}
+	if ok && source != target {
+		deleteTieringObject(stub.Key)
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory. The files moved to the
+// tiering target are removed from there too
+func (fs *TieredFs) Remove(name string, isDir bool) error {
+	if isDir {
+		return fs.Fs.Remove(name, isDir)
+	}
+	stub, ok := fs.getStub(name, false)
+	if err := fs.Fs.Remove(name, isDir); err != nil {
+		return err
+	}
+	if ok {
+		deleteTieringObject(stub.Key)
+	}
+	return nil
+}
+
+// Truncate changes the size of the named file. The files moved to the tiering
+// target are recalled before they are truncated to a size greater than 0
+func (fs *TieredFs) Truncate(name string, size int64) error {
+	stub, ok := fs.getStub(name, true)
+	if !ok {
+		return fs.Fs.Truncate(name, size)
+	}
+	if size == 0 {
+		fs.removeStub(name, stub)
+		return nil
+	}
+	if err := fs.recall(name); err != nil {
+		return err
+	}
+	return fs.Fs.Truncate(name, size)
+}
+
+// Link creates newname as a hard link to the oldname file. The files moved
+// to the tiering target are recalled before linking them
+func (fs *TieredFs) Link(oldname, newname string) error {
+	linker, ok := fs.Fs.(hardlinker)
+	if !ok {
+		return ErrVfsUnsupported
+	}
+	if _, ok := fs.getStub(oldname, false); ok {
+		if err := fs.recall(oldname); err != nil {
+			return err
+		}
+	}
+	return linker.Link(oldname, newname)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries
+func (fs *TieredFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	contents, err := fs.Fs.ReadDir(dirname)
+	if err != nil {
+		return contents, err
+	}
+	return getTieredFileInfos(dirname, contents), nil
+}
+
+// OpenDir returns a DirLister to read the directory named by dirname
+// one page at a time
+func (fs *TieredFs) OpenDir(dirname string) (DirLister, error) {
+	lister, err := fs.Fs.OpenDir(dirname)
+	if err != nil {
+		return lister, err
+	}
+	return newTransformDirLister(lister, func(list []os.FileInfo) []os.FileInfo {
+		return getTieredFileInfos(dirname, list)
+	}), nil
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *TieredFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.Fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err == nil {
+			info = getTieredFileInfo(walkedPath, info)
+		}
+		return walkFn(walkedPath, info, err)
+	})
+}
+
+// SetChecksums stores the checksums for the named file, if supported
+func (fs *TieredFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	return SetChecksums(fs.Fs, name, size, checksums)
+}
+
+// GetChecksum returns the checksum stored for the named file, if any
+func (fs *TieredFs) GetChecksum(name, algo string) (string, int64, bool) {
+	return GetStoredChecksum(fs.Fs, name, algo)
+}
+
+// IsTieredFile returns true if the named file was moved to the tiering target
+func (fs *TieredFs) IsTieredFile(name string) bool {
+	_, ok := fs.getStub(name, true)
+	return ok
+}
+
+// GetTieringReport returns the files that the tiering policy would move and
+// the usage of the tiering target. Nothing is moved
+func (fs *TieredFs) GetTieringReport() (TieringReport, error) {
+	return fs.applyPolicy(true)
+}
+
+// ApplyTieringPolicy moves the files matching the tiering policy to the
+// tiering target
+func (fs *TieredFs) ApplyTieringPolicy() (TieringReport, error) {
+	return fs.applyPolicy(false)
+}
+
+func (fs *TieredFs) applyPolicy(dryRun bool) (TieringReport, error) {
+	report := TieringReport{
+		Candidates: []TieringItem{},
+	}
+	if !fs.config.IsEnabled() {
+		return report, errTieringDisabled
+	}
+	minModTime := time.Now().Add(-time.Duration(fs.config.MinAge) * 24 * time.Hour)
+	for _, virtualPath := range fs.getPolicyPaths() {
+		root, err := fs.Fs.ResolvePath(virtualPath)
+		if err != nil {
+			if fs.IsNotExist(err) {
+				// the home dir is created on first login
+				continue
+			}
+			return report, err
+		}
+		err = fs.Fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if walkedPath != root && fs.IsNotExist(err) {
+					// removed while walking
+					return nil
+				}
+				return err
+			}
+			if walkedPath != root && strings.HasPrefix(info.Name(), internalNamePrefix) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if stub, ok := getTieringStub(walkedPath, info); ok {
+				report.TieredFiles++
+				report.TieredSize += stub.Size
+				return nil
+			}
+			if info.Size() == 0 || info.ModTime().After(minModTime) {
+				return nil
+			}
+			item := TieringItem{
+				Path:         fs.Fs.GetRelativePath(walkedPath),
+				Size:         info.Size(),
+				LastModified: utils.GetTimeAsMsSinceEpoch(info.ModTime()),
+			}
+			if !dryRun {
+				if err := fs.tierFile(walkedPath, info); err != nil {
+					fsLog(fs, logger.LevelWarn, "unable to move file %#v to the tiering target: %v", walkedPath, err)
+					report.Errors++
+					return nil
+				}
+				report.TieredFiles++
+				report.TieredSize += item.Size
+			}
+			report.Candidates = append(report.Candidates, item)
+			return nil
+		})
+		if err != nil {
+			if fs.IsNotExist(err) {
+				continue
+			}
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// getPolicyPaths returns the virtual paths to walk, the paths included in
+// another one are removed
+func (fs *TieredFs) getPolicyPaths() []string {
+	if len(fs.config.Paths) == 0 {
+		return []string{"/"}
+	}
+	var result []string
+	for _, p := range fs.config.Paths {
+		var others []string
+		for _, other := range fs.config.Paths {
+			if other != p {
+				others = append(others, other)
+			}
+		}
+		if len(others) == 0 || !isVirtualPathIncluded(p, others) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// tierFile moves the named file to the tiering target and replaces it with a stub
+func (fs *TieredFs) tierFile(name string, info os.FileInfo) error {
+	tieringLocks.lock(name)
+	defer tieringLocks.unlock(name)
+
+	key := path.Join("/", fs.namespace, fs.Fs.GetRelativePath(name)) + "." + xid.New().String()
+	if err := writeTieringObject(key, name, info.Size()); err != nil {
+		return err
+	}
+	tempPath := filepath.Join(filepath.Dir(name), tieringTempPrefix+xid.New().String())
+	err := createTieringStub(tempPath, info, tieringStub{
+		Key:  key,
+		Size: info.Size(),
+	})
+	if err == nil {
+		// the file could be modified while uploading it
+		var current os.FileInfo
+		current, err = os.Lstat(name)
+		if err == nil && (!current.Mode().IsRegular() || current.Size() != info.Size() ||
+			!current.ModTime().Equal(info.ModTime())) {
+			err = errTieringFileChanged
+		}
+		if err == nil {
+			err = os.Rename(tempPath, name)
+		}
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		deleteTieringObject(key)
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "file %#v moved to the tiering target, key: %#v, size: %v", name, key, info.Size())
+	return nil
+}
+
+// recall moves the named file back from the tiering target to the local disk
+func (fs *TieredFs) recall(name string) error {
+	tieringLocks.lock(name)
+	defer tieringLocks.unlock(name)
+
+	// the file could be already recalled
+	stub, ok := fs.getStub(name, true)
+	if !ok {
+		return nil
+	}
+	src, err := openTieringObject(stub.Key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return fs.recallFrom(name, stub, src, nil)
+}
+
+// recallFrom replaces the stub for the named file with the contents read from
+// src, they are written to w too if not nil
+func (fs *TieredFs) recallFrom(name string, stub tieringStub, src io.Reader, w io.Writer) error {
+	tempPath := filepath.Join(filepath.Dir(name), tieringTempPrefix+xid.New().String())
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	var dst io.Writer = f
+	if w != nil {
+		dst = io.MultiWriter(f, w)
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != stub.Size {
+		err = fmt.Errorf("size mismatch for the tiered file %#v, expected: %v, actual: %v", name, stub.Size, n)
+	}
+	if err == nil {
+		err = replaceTieringStub(name, tempPath, stub)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	deleteTieringObject(stub.Key)
+	fsLog(fs, logger.LevelDebug, "file %#v recalled from the tiering target, size: %v", name, n)
+	return nil
+}
+
+// removeStub makes the named file a regular file and removes the
+// associated object from the tiering target
+func (fs *TieredFs) removeStub(name string, stub tieringStub) {
+	if err := removeTieringStub(name); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove the tiering stub for %#v: %v", name, err)
+		return
+	}
+	deleteTieringObject(stub.Key)
+}
+
+func (fs *TieredFs) getStub(name string, followSymlinks bool) (tieringStub, bool) {
+	var info os.FileInfo
+	var err error
+	if followSymlinks {
+		info, err = os.Stat(name)
+	} else {
+		info, err = os.Lstat(name)
+	}
+	if err != nil {
+		return tieringStub{}, false
+	}
+	return getTieringStub(name, info)
+}
+
+// IsTieredFs returns true if fs is a tiered local filesystem.
+// The storage layers, such as the trash and the versioning, are inspected
+func IsTieredFs(fs Fs) bool {
+	_, ok := getStorageFs(fs).(*TieredFs)
+	return ok
+}
+
+// IsTieredFile returns true if the named file was moved to the tiering target.
+// The storage layers, such as the trash and the versioning, are inspected
+func IsTieredFile(fs Fs, name string) bool {
+	if tieredFs, ok := getStorageFs(fs).(*TieredFs); ok {
+		return tieredFs.IsTieredFile(name)
+	}
+	return false
+}
+
+func getTieredFileInfos(dirname string, list []os.FileInfo) []os.FileInfo {
+	for idx, info := range list {
+		list[idx] = getTieredFileInfo(filepath.Join(dirname, info.Name()), info)
+	}
+	return list
+}
+
+// createTieringStub creates a stub with the permissions, the owner and the
+// modification time of the original file
+func createTieringStub(name string, info os.FileInfo, stub tieringStub) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := writeTieringStub(name, stub); err != nil {
+		return err
+	}
+	return copyTieringAttributes(name, info)
+}
+
+// replaceTieringStub renames tempPath to name if name is still the given stub
+func replaceTieringStub(name, tempPath string, stub tieringStub) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	current, ok := getTieringStub(name, info)
+	if !ok || current.Key != stub.Key {
+		return errTieringFileChanged
+	}
+	if err := copyTieringAttributes(tempPath, info); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, name)
+}
+
+func copyTieringAttributes(name string, info os.FileInfo) error {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	copyTieringOwner(name, info)
+	return os.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// writeTieringObject uploads the named local file to the tiering target
+func writeTieringObject(key, name string, size int64) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	target, err := tieringTarget.ResolvePath(key)
+	if err != nil {
+		return err
+	}
+	if IsLocalOsFs(tieringTarget) {
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+	}
+	f, w, cancelFn, err := tieringTarget.Create(target, 0)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		_, err = io.Copy(f, src)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		_, err = io.Copy(w, src)
+		if err != nil && cancelFn != nil {
+			cancelFn()
+		}
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = tieringTarget.Stat(target)
+		if err == nil && info.Size() != size {
+			err = fmt.Errorf("size mismatch for the tiering object %#v, expected: %v, actual: %v",
+				key, size, info.Size())
+		}
+	}
+	if err != nil {
+		tieringTarget.Remove(target, false) //nolint:errcheck
+	}
+	return err
+}
+
+// openTieringObject returns a reader for the given object on the tiering target
+func openTieringObject(key string) (io.ReadCloser, error) {
+	if tieringTarget == nil {
+		return nil, errors.New("storage tiering is not configured")
+	}
+	target, err := tieringTarget.ResolvePath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, r, _, err := tieringTarget.Open(target, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		return f, nil
+	}
+	return r, nil
+}
+
+// deleteTieringObject removes the given object from the tiering target,
+// errors are only logged
+func deleteTieringObject(key string) {
+	if tieringTarget == nil {
+		return
+	}
+	target, err := tieringTarget.ResolvePath(key)
+	if err == nil {
+		err = tieringTarget.Remove(target, false)
+	}
+	if err != nil {
+		logger.Warn(tieringLogSender, "", "unable to remove the object %#v from the tiering target: %v", key, err)
+	}
+}
+
+// tieringPipeWriter writes to the wrapped writer the data after the first skip bytes
+type tieringPipeWriter struct {
+	w    io.Writer
+	skip int64
+	// if true the write errors are ignored, a recall must be completed
+	// even if the reader is closed
+	ignoreErrors bool
+	failed       bool
+}
+
+func (w *tieringPipeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.failed {
+		return n, nil
+	}
+	if w.skip > 0 {
+		if int64(n) <= w.skip {
+			w.skip -= int64(n)
+			return n, nil
+		}
+		p = p[w.skip:]
+		w.skip = 0
+	}
+	if _, err := w.w.Write(p); err != nil {
+		if !w.ignoreErrors {
+			return 0, err
+		}
+		w.failed = true
+	}
+	return n, nil
+}
+
+// tieringPathLocks serializes the tiering operations for the same path
+type tieringPathLocks struct {
+	sync.Mutex
+	paths map[string]chan struct{}
+}
+
+func newTieringPathLocks() *tieringPathLocks {
+	return &tieringPathLocks{
+		paths: make(map[string]chan struct{}),
+	}
+}
+
+func (l *tieringPathLocks) tryLock(name string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.paths[name]; ok {
+		return false
+	}
+	l.paths[name] = make(chan struct{})
+	return true
+}
+
+func (l *tieringPathLocks) lock(name string) {
+	for {
+		l.Lock()
+		ch, ok := l.paths[name]
+		if !ok {
+			l.paths[name] = make(chan struct{})
+			l.Unlock()
+			return
+		}
+		l.Unlock()
+		<-ch
+	}
+}
+
+func (l *tieringPathLocks) unlock(name string) {
+	l.Lock()
+	ch, ok := l.paths[name]
+	delete(l.paths, name)
+	l.Unlock()
+
+	if ok {
+		close(ch)
+	}
+}
@@ -0,0 +1,49 @@
+// +build linux darwin freebsd netbsd
+
+package vfs
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// extended attribute used to store the tiering stub inside the empty local file
+const tieringXattrName = "user.sftpgo.tiering"
+
+func isTieringSupported() bool {
+	return true
+}
+
+func readTieringStub(name string) (tieringStub, error) {
+	var stub tieringStub
+	buf := make([]byte, 4096)
+	n, err := unix.Getxattr(name, tieringXattrName, buf)
+	if err != nil {
+		return stub, err
+	}
+	err = json.Unmarshal(buf[:n], &stub)
+	return stub, err
+}
+
+func writeTieringStub(name string, stub tieringStub) error {
+	data, err := json.Marshal(stub)
+	if err != nil {
+		return err
+	}
+	return unix.Setxattr(name, tieringXattrName, data, 0)
+}
+
+func removeTieringStub(name string) error {
+	return unix.Removexattr(name, tieringXattrName)
+}
+
+// copyTieringOwner sets the owner of the original file, errors are ignored:
+// this is possible only if SFTPGo runs as root
+func copyTieringOwner(name string, info os.FileInfo) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(name, int(stat.Uid), int(stat.Gid)) //nolint:errcheck
+	}
+}
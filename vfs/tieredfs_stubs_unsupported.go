@@ -0,0 +1,24 @@
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package vfs
+
+import "os"
+
+// storage tiering is not supported on this platform, extended attributes are not available
+func isTieringSupported() bool {
+	return false
+}
+
+func readTieringStub(name string) (tieringStub, error) {
+	return tieringStub{}, ErrVfsUnsupported
+}
+
+func writeTieringStub(name string, stub tieringStub) error {
+	return ErrVfsUnsupported
+}
+
+func removeTieringStub(name string) error {
+	return ErrVfsUnsupported
+}
+
+func copyTieringOwner(name string, info os.FileInfo) {}
@@ -0,0 +1,610 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// trashFsName is the name prefix for the Fs implementation that moves the
+	// deleted items to the trash
+	trashFsName = "trashfs"
+	// each item is named after the UTC time it was deleted, the names can
+	// be sorted lexicographically
+	trashItemIDFormat = "20060102T150405.000000000Z"
+	// default retention, in days
+	defaultTrashRetention = 30
+)
+
+// errors definitions for the trash
+var (
+	ErrInvalidTrashItemID = errors.New("invalid trash item identifier")
+	ErrTrashRestoreTarget = errors.New("the restore target already exists")
+)
+
+// trashPath is the directory used to store the deleted items. Each user has
+// its own trash directory, named after the username, inside this directory.
+// A file or directory deleted from "/dir/name" by the user "user" is stored as
+// "<trash path>/user/dir/name/<item id>"
+var trashPath string
+
+// InitializeTrash sets the directory used to store the deleted items. For the
+// local filesystem it is a local path, for the other storage backends it is a
+// path inside the same bucket, container or remote server used for the user's
+// files. The trash cannot be used if it is empty
+func InitializeTrash(dirPath string) error {
+	if dirPath != "" && !filepath.IsAbs(dirPath) && !path.IsAbs(dirPath) {
+		return fmt.Errorf("invalid trash path %#v, it must be an absolute path", dirPath)
+	}
+	trashPath = dirPath
+	return nil
+}
+
+// IsTrashAvailable returns true if the directory used to store the deleted
+// items is configured
+func IsTrashAvailable() bool {
+	return trashPath != ""
+}
+
+// TrashConfig defines the settings to move the deleted files and directories
+// to a per-user trash instead of removing them
+type TrashConfig struct {
+	// set to true to move the deleted items to the trash
+	Enabled bool `json:"enabled,omitempty"`
+	// items deleted more than the specified number of days ago are
+	// permanently removed, 0 means the default (30)
+	Retention int `json:"retention,omitempty"`
+	// maximum size, in bytes, for all the deleted items. The oldest items are
+	// permanently removed when this limit is exceeded. The deleted items are
+	// not included in the user quota, 0 means the same size as the user quota,
+	// no limit other than the retention if the user has no quota size
+	QuotaSize int64 `json:"quota_size,omitempty"`
+}
+
+// IsEnabled returns true if the trash is enabled
+func (c *TrashConfig) IsEnabled() bool {
+	return c.Enabled
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *TrashConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("invalid trash retention: %v", c.Retention)
+	}
+	if c.QuotaSize < 0 {
+		return fmt.Errorf("invalid trash quota size: %v", c.QuotaSize)
+	}
+	return nil
+}
+
+func (c *TrashConfig) getRetention() int {
+	if c.Retention == 0 {
+		return defaultTrashRetention
+	}
+	return c.Retention
+}
+
+// TrashItem describes a deleted file or directory stored inside the trash
+type TrashItem struct {
+	// item identifier
+	ID string `json:"id"`
+	// virtual path the item was deleted from
+	Path string `json:"path"`
+	// true if the deleted item is a directory
+	IsDir bool `json:"is_dir"`
+	// number of files inside the deleted item
+	Files int `json:"files"`
+	// size of the deleted item including, for directories, the contained files
+	Size int64 `json:"size"`
+	// deletion time as unix timestamp in milliseconds
+	DeletedAt int64 `json:"deleted_at"`
+	name      string
+}
+
+// GetDeletedAtAsString returns the deletion time formatted as YYYY-MM-DD HH:MM:SS
+func (i *TrashItem) GetDeletedAtAsString() string {
+	return utils.GetTimeFromMsecSinceEpoch(i.DeletedAt).Format("2006-01-02 15:04:05")
+}
+
+// GetSizeAsString returns the number of files and the size as human readable string
+func (i *TrashItem) GetSizeAsString() string {
+	if i.IsDir {
+		return fmt.Sprintf("Files: %v. Size: %v", i.Files, utils.ByteCountSI(i.Size))
+	}
+	return utils.ByteCountSI(i.Size)
+}
+
+// TrashFs is a Fs implementation that allows to move the deleted files and
+// directories to a trash directory outside the root directory, so they can
+// be restored later. The deleted items are not included in the user quota.
+// The files opened by the wrapped Fs are returned as is, so the protocol
+// handlers must handle them as they do for the wrapped Fs
+type TrashFs struct {
+	Fs
+	username string
+	config   TrashConfig
+	// true if the wrapped Fs uses local filesystem paths
+	isLocal bool
+}
+
+// NewTrashFs returns a Fs that allows to move the deleted items to a trash
+func NewTrashFs(fs Fs, username string, config TrashConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if !IsTrashAvailable() {
+		return nil, errors.New("the trash is not available, the trash path is not configured")
+	}
+	return &TrashFs{
+		Fs:       fs,
+		username: username,
+		config:   config,
+		isLocal:  usesOsPaths(fs),
+	}, nil
+}
+
+// GetTrashFs returns the TrashFs layer, if any, wrapped by fs
+func GetTrashFs(fs Fs) (*TrashFs, bool) {
+	layer, ok := findFsLayer(fs, func(l Fs) bool {
+		_, ok := l.(*TrashFs)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+	return layer.(*TrashFs), true
+}
+
+// Name returns the name for the Fs implementation
+func (fs *TrashFs) Name() string {
+	return fmt.Sprintf("%v %v", trashFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped filesystem
+func (fs *TrashFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+func (*TrashFs) isStorageLayer() {}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (fs *TrashFs) IsNotExist(err error) bool {
+	return fs.Fs.IsNotExist(err) || os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (fs *TrashFs) IsPermission(err error) bool {
+	return fs.Fs.IsPermission(err) || os.IsPermission(err)
+}
+
+// SetChecksums stores the checksums for the named file, if supported
+func (fs *TrashFs) SetChecksums(name string, size int64, checksums map[string]string) error {
+	return SetChecksums(fs.Fs, name, size, checksums)
+}
+
+// GetChecksum returns the checksum stored for the named file, if any
+func (fs *TrashFs) GetChecksum(name, algo string) (string, int64, bool) {
+	return GetStoredChecksum(fs.Fs, name, algo)
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *TrashFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(fs.Fs, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func (fs *TrashFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(fs.Fs, name)
+}
+
+// GetTrashUsage returns the number of files inside the trash and their size
+func (fs *TrashFs) GetTrashUsage() (int, int64, error) {
+	items, err := fs.ListTrash()
+	if err != nil {
+		return 0, 0, err
+	}
+	var numFiles int
+	var size int64
+	for _, item := range items {
+		numFiles += item.Files
+		size += item.Size
+	}
+	return numFiles, size, nil
+}
+
+// MoveToTrash moves the named file or directory to the trash
+func (fs *TrashFs) MoveToTrash(name string) (TrashItem, error) {
+	relPath := fs.Fs.GetRelativePath(name)
+	if relPath == "/" {
+		return TrashItem{}, &os.PathError{Op: "trash", Path: relPath, Err: os.ErrPermission}
+	}
+	deletedAt := time.Now().UTC()
+	item := TrashItem{
+		ID:        deletedAt.Format(trashItemIDFormat),
+		Path:      relPath,
+		DeletedAt: utils.GetTimeAsMsSinceEpoch(deletedAt),
+	}
+	trashRoot, err := fs.getTrashRoot()
+	if err != nil {
+		return item, err
+	}
+	itemsDir := fs.Fs.Join(trashRoot, relPath)
+	itemPath := fs.Fs.Join(itemsDir, item.ID)
+	if err = createDirs(fs.Fs, itemsDir, fs.isLocal); err != nil {
+		return item, err
+	}
+	fsLog(fs, logger.LevelDebug, "moving %#v to the trash as %#v", name, itemPath)
+	if err = fs.Fs.Rename(name, itemPath); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to move %#v to the trash: %v", name, err)
+		removeEmptyDirs(fs.Fs, trashRoot, itemsDir, fs.isLocal)
+		return item, err
+	}
+	item.name = itemPath
+	return item, nil
+}
+
+// ListTrash returns the items inside the trash, the most recently deleted first
+func (fs *TrashFs) ListTrash() ([]TrashItem, error) {
+	trashRoot, err := fs.getTrashRoot()
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	items := make(map[string]*TrashItem)
+	err = fs.Fs.Walk(trashRoot, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath := fs.getTrashRelativePath(trashRoot, walkedPath)
+		itemPath, itemID, ok := getTrashItemFromPath(relPath)
+		if !ok {
+			return nil
+		}
+		key := path.Join(itemPath, itemID)
+		item, ok := items[key]
+		if !ok {
+			deletedAt, _ := time.Parse(trashItemIDFormat, itemID)
+			item = &TrashItem{
+				ID:        itemID,
+				Path:      itemPath,
+				DeletedAt: utils.GetTimeAsMsSinceEpoch(deletedAt),
+				name:      fs.Fs.Join(trashRoot, key),
+			}
+			items[key] = item
+		}
+		if relPath != key || info.IsDir() {
+			item.IsDir = true
+		}
+		if info.Mode().IsRegular() {
+			item.Files++
+			item.Size += GetQuotaSize(info)
+		}
+		return nil
+	})
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	result := make([]TrashItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID == result[j].ID {
+			return result[i].Path < result[j].Path
+		}
+		return result[i].ID > result[j].ID
+	})
+	return result, nil
+}
+
+// RestoreTrashItem moves the trash item with the specified identifier, deleted
+// from the given virtual path, back to its original location
+func (fs *TrashFs) RestoreTrashItem(virtualPath, itemID string) (TrashItem, error) {
+	item, err := fs.getTrashItem(virtualPath, itemID)
+	if err != nil {
+		return item, err
+	}
+	fsPath, err := fs.ResolvePath(item.Path)
+	if err != nil {
+		return item, err
+	}
+	if _, err = fs.Fs.Lstat(fsPath); err == nil {
+		return item, ErrTrashRestoreTarget
+	} else if !fs.IsNotExist(err) {
+		return item, err
+	}
+	if err = createMissingDirs(fs.Fs, path.Dir(item.Path)); err != nil {
+		return item, err
+	}
+	fsLog(fs, logger.LevelDebug, "restoring trash item %#v to %#v", item.name, fsPath)
+	if err = fs.Fs.Rename(item.name, fsPath); err != nil {
+		return item, err
+	}
+	fs.removeItemDirs(item)
+	return item, nil
+}
+
+// PurgeTrash permanently removes the trash item with the specified identifier
+// deleted from the given virtual path. If itemID is empty all the items deleted
+// from the given virtual path are removed and if virtualPath is empty too the
+// trash is emptied. It returns the removed items
+func (fs *TrashFs) PurgeTrash(virtualPath, itemID string) ([]TrashItem, error) {
+	if itemID != "" {
+		item, err := fs.getTrashItem(virtualPath, itemID)
+		if err != nil {
+			return nil, err
+		}
+		if err = fs.purgeItem(item); err != nil {
+			return nil, err
+		}
+		return []TrashItem{item}, nil
+	}
+	items, err := fs.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	cleanedPath := ""
+	if virtualPath != "" {
+		cleanedPath = path.Clean("/" + virtualPath)
+	}
+	var removed []TrashItem
+	for _, item := range items {
+		if cleanedPath != "" && item.Path != cleanedPath {
+			continue
+		}
+		if err = fs.purgeItem(item); err != nil {
+			return removed, err
+		}
+		removed = append(removed, item)
+	}
+	return removed, nil
+}
+
+// ExpireTrash permanently removes the items deleted before the configured
+// retention period and returns them
+func (fs *TrashFs) ExpireTrash() ([]TrashItem, error) {
+	items, err := fs.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	minDeletionTime := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-24 * time.Hour * time.Duration(fs.config.getRetention())))
+	var removed []TrashItem
+	for _, item := range items {
+		if item.DeletedAt >= minDeletionTime {
+			continue
+		}
+		fsLog(fs, logger.LevelDebug, "removing expired trash item %#v", item.name)
+		if err = fs.purgeItem(item); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to remove expired trash item %#v: %v", item.name, err)
+			return removed, err
+		}
+		removed = append(removed, item)
+	}
+	return removed, nil
+}
+
+// ApplyQuota permanently removes the oldest items until the size of the trash
+// is within the configured quota size and returns them
+func (fs *TrashFs) ApplyQuota() ([]TrashItem, error) {
+	if fs.config.QuotaSize <= 0 {
+		return nil, nil
+	}
+	items, err := fs.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, item := range items {
+		size += item.Size
+	}
+	var removed []TrashItem
+	// the items are sorted, the most recently deleted first
+	for idx := len(items) - 1; idx >= 0 && size > fs.config.QuotaSize; idx-- {
+		item := items[idx]
+		fsLog(fs, logger.LevelDebug, "removing trash item %#v to apply the trash quota", item.name)
+		if err = fs.purgeItem(item); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to remove trash item %#v: %v", item.name, err)
+			return removed, err
+		}
+		removed = append(removed, item)
+		size -= item.Size
+	}
+	return removed, nil
+}
+
+// getTrashItem returns the trash item with the specified identifier deleted
+// from the given virtual path
+func (fs *TrashFs) getTrashItem(virtualPath, itemID string) (TrashItem, error) {
+	deletedAt, err := time.Parse(trashItemIDFormat, itemID)
+	if err != nil {
+		return TrashItem{}, ErrInvalidTrashItemID
+	}
+	cleanedPath := path.Clean("/" + virtualPath)
+	if cleanedPath == "/" {
+		return TrashItem{}, &os.PathError{Op: "trash", Path: virtualPath, Err: os.ErrPermission}
+	}
+	item := TrashItem{
+		ID:        itemID,
+		Path:      cleanedPath,
+		DeletedAt: utils.GetTimeAsMsSinceEpoch(deletedAt),
+	}
+	trashRoot, err := fs.getTrashRoot()
+	if err != nil {
+		return item, err
+	}
+	item.name = fs.Fs.Join(trashRoot, cleanedPath, itemID)
+	info, err := fs.Fs.Lstat(item.name)
+	if err != nil {
+		return item, err
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			item.Files = 1
+			item.Size = GetQuotaSize(info)
+		}
+		return item, nil
+	}
+	// the size is computed walking the item, the wrapped filesystems handle the
+	// paths outside the root directory as the root directory itself
+	item.IsDir = true
+	err = fs.Fs.Walk(item.name, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			item.Files++
+			item.Size += GetQuotaSize(info)
+		}
+		return nil
+	})
+	return item, err
+}
+
+// purgeItem permanently removes the specified trash item
+func (fs *TrashFs) purgeItem(item TrashItem) error {
+	if item.IsDir {
+		if err := removeTree(fs.Fs, item.name); err != nil {
+			return err
+		}
+	} else if err := fs.Fs.Remove(item.name, false); err != nil {
+		return err
+	}
+	fs.removeItemDirs(item)
+	return nil
+}
+
+// RemoveUserTrash removes the trash directory stored on the given filesystem
+// for the specified user. The trash directory is named after the username, so
+// it must be removed when the user is deleted, otherwise the deleted items
+// would be available to a new user with the same name
+func RemoveUserTrash(fs Fs, username string) error {
+	if !IsTrashAvailable() {
+		return nil
+	}
+	trashFs := &TrashFs{
+		Fs:       fs,
+		username: username,
+		isLocal:  usesOsPaths(fs),
+	}
+	trashRoot, err := trashFs.getTrashRoot()
+	if err != nil {
+		return err
+	}
+	return removeUserDir(fs, trashRoot)
+}
+
+// getTrashRoot returns the filesystem path for the trash directory of this
+// user. The trash directory must be outside the root directory
+func (fs *TrashFs) getTrashRoot() (string, error) {
+	if !IsTrashAvailable() {
+		return "", errors.New("the trash path is not configured")
+	}
+	trashRoot := fs.Fs.Join(trashPath, fs.username)
+	rootDir, err := fs.Fs.ResolvePath("/")
+	if err != nil {
+		return "", err
+	}
+	if fs.Fs.GetRelativePath(trashRoot) != "/" || isSameOrSubPath(rootDir, trashRoot, fs.isLocal) {
+		return "", fmt.Errorf("the trash directory %#v must be outside the root directory %#v", trashRoot, rootDir)
+	}
+	return trashRoot, nil
+}
+
+// getTrashRelativePath returns the path, relative to the trash root
+// directory, for the specified filesystem path
+func (fs *TrashFs) getTrashRelativePath(trashRoot, name string) string {
+	relPath := strings.TrimPrefix(name, trashRoot)
+	if fs.isLocal {
+		relPath = filepath.ToSlash(relPath)
+	}
+	return path.Clean("/" + relPath)
+}
+
+// removeItemDirs removes the trash directory containing the specified item
+// and its parents if they are empty
+func (fs *TrashFs) removeItemDirs(item TrashItem) {
+	trashRoot, err := fs.getTrashRoot()
+	if err != nil {
+		return
+	}
+	removeEmptyDirs(fs.Fs, trashRoot, fs.Fs.Join(trashRoot, item.Path), fs.isLocal)
+}
+
+// removeTree removes the named directory and all its contents
+func removeTree(fs Fs, name string) error {
+	var dirs []string
+	err := fs.Walk(name, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, walkedPath)
+			return nil
+		}
+		return fs.Remove(walkedPath, false)
+	})
+	if err != nil {
+		return err
+	}
+	// the nested directories are always walked after their parents
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		if err = fs.Remove(dirs[idx], true); err != nil && !fs.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUserDir removes the named per-user directory, if it exists
+func removeUserDir(fs Fs, name string) error {
+	if err := removeTree(fs, name); err != nil && !fs.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getTrashItemFromPath returns the original virtual path and the identifier for
+// the trash item that contains the specified path, relative to the trash
+// directory. The first path component that is a valid item identifier
+// identifies the trash item
+func getTrashItemFromPath(relPath string) (string, string, bool) {
+	components := strings.Split(strings.Trim(relPath, "/"), "/")
+	for idx, component := range components {
+		if idx == 0 {
+			continue
+		}
+		if _, err := time.Parse(trashItemIDFormat, component); err == nil {
+			return "/" + path.Join(components[:idx]...), component, true
+		}
+	}
+	return "", "", false
+}
+
+// usesOsPaths returns true if the specified Fs uses local filesystem paths
+func usesOsPaths(fs Fs) bool {
+	switch UnwrapFs(fs).(type) {
+	case *OsFs, *CryptFs:
+		return true
+	default:
+		return false
+	}
+}
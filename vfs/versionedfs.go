@@ -0,0 +1,718 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// versionedFsName is the name prefix for the Fs implementation that
+	// preserves the previous versions of the files
+	versionedFsName = "versionedfs"
+	// each version is named after the UTC time it was created, the names can
+	// be sorted lexicographically
+	versionIDFormat = "20060102T150405.000000000Z"
+	// default retention settings
+	defaultMaxVersions = 10
+	defaultMaxAge      = 30
+)
+
+// ErrInvalidVersionID defines the error for a malformed version identifier
+var ErrInvalidVersionID = errors.New("invalid version identifier")
+
+// versionsPath is the directory used to store the previous versions of the
+// files. The versions of each user are stored inside a sub directory, named
+// as the username, so they are outside the user's root directory. The versions
+// of the file "/dir/file" for the user "user" are stored inside the directory
+// "<versions path>/user/dir/file"
+var versionsPath string
+
+// InitializeVersioning sets the directory used to store the previous versions
+// of the files. For the local filesystem it is a local path, for the other
+// storage backends it is a path inside the same bucket, container or remote
+// server used for the user's files. Versioning cannot be used if it is empty
+func InitializeVersioning(dirPath string) error {
+	if dirPath != "" && !filepath.IsAbs(dirPath) && !path.IsAbs(dirPath) {
+		return fmt.Errorf("invalid versions path %#v, it must be an absolute path", dirPath)
+	}
+	versionsPath = dirPath
+	return nil
+}
+
+// IsVersioningAvailable returns true if the directory used to store the
+// previous versions of the files is configured
+func IsVersioningAvailable() bool {
+	return versionsPath != ""
+}
+
+// VersioningConfig defines the settings to preserve the previous versions of
+// the files that are overwritten, truncated or removed
+type VersioningConfig struct {
+	// set to true to preserve the previous versions of the files
+	Enabled bool `json:"enabled,omitempty"`
+	// maximum number of versions to keep for each file, 0 means the default (10)
+	MaxVersions int `json:"max_versions,omitempty"`
+	// versions older than the specified number of days are removed,
+	// 0 means the default (30)
+	MaxAge int `json:"max_age,omitempty"`
+	// maximum size, in bytes, for all the stored versions. The oldest versions
+	// are removed when this limit is exceeded. The versions are not included in
+	// the user quota, 0 means the same size as the user quota, no limit other
+	// than the retention settings if the user has no quota size
+	QuotaSize int64 `json:"quota_size,omitempty"`
+	// the versions are preserved only for the files inside these virtual
+	// directories. Empty means the whole home directory
+	Paths []string `json:"paths,omitempty"`
+}
+
+// IsEnabled returns true if versioning is enabled
+func (c *VersioningConfig) IsEnabled() bool {
+	return c.Enabled
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *VersioningConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.MaxVersions < 0 {
+		return fmt.Errorf("invalid max versions: %v", c.MaxVersions)
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid max age: %v", c.MaxAge)
+	}
+	if c.QuotaSize < 0 {
+		return fmt.Errorf("invalid versions quota size: %v", c.QuotaSize)
+	}
+	paths, err := cleanVirtualPaths(c.Paths, "versioning")
+	if err != nil {
+		return err
+	}
+	c.Paths = paths
+	return nil
+}
+
+func (c *VersioningConfig) getMaxVersions() int {
+	if c.MaxVersions > 0 {
+		return c.MaxVersions
+	}
+	return defaultMaxVersions
+}
+
+func (c *VersioningConfig) getMaxAge() int {
+	if c.MaxAge > 0 {
+		return c.MaxAge
+	}
+	return defaultMaxAge
+}
+
+// FileVersion describes a preserved version of a file
+type FileVersion struct {
+	// version identifier
+	ID string `json:"id"`
+	// size of the stored version
+	Size int64 `json:"size"`
+	// creation time for the version as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// last modification time for the stored version as unix timestamp in milliseconds
+	LastModified int64 `json:"last_modified"`
+	name         string
+}
+
+// VersionedFs is a Fs implementation that preserves the previous versions of
+// the files stored on the wrapped filesystem. Files are moved to the versions
+// directory, outside the root directory, before they are overwritten or removed
+// and copied there before they are truncated or modified in place.
+// The files opened by the wrapped Fs are returned as is, so the protocol
+// handlers must handle them as they do for the wrapped Fs
+type VersionedFs struct {
+	Fs
+	username string
+	config   VersioningConfig
+	// true if the wrapped Fs uses local filesystem paths
+	isLocal bool
+	// the temporary paths for the atomic uploads in progress and their targets
+	mu            sync.Mutex
+	atomicUploads map[string]string
+}
+
+// NewVersionedFs returns a Fs that preserves the previous versions of the
+// files stored on the given filesystem
+func NewVersionedFs(fs Fs, username string, config VersioningConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if !IsVersioningAvailable() {
+		return nil, errors.New("versioning is not available, the versions path is not configured")
+	}
+	return &VersionedFs{
+		Fs:            fs,
+		username:      username,
+		config:        config,
+		isLocal:       usesOsPaths(fs),
+		atomicUploads: make(map[string]string),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *VersionedFs) Name() string {
+	return fmt.Sprintf("%v %v", versionedFsName, fs.Fs.Name())
+}
+
+// Unwrap returns the wrapped filesystem
+func (fs *VersionedFs) Unwrap() Fs {
+	return fs.Fs
+}
+
+func (*VersionedFs) isStorageLayer() {}
+
+// Create creates or opens the named file for writing.
+// An existing file is preserved as a new version if it is truncated, it is
+// copied to the versions directory if it is opened to append or to modify it
+// in place
+func (fs *VersionedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	// the atomic uploads are versioned when the existing file is moved to the
+	// temporary path or when the temporary file is renamed
+	if !fs.isAtomicUpload(name) {
+		if flag == 0 || flag&os.O_TRUNC != 0 {
+			if _, err := fs.addVersion(name); err != nil {
+				return nil, nil, nil, err
+			}
+		} else if err := fs.copyVersion(name); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return fs.Fs.Create(name, flag)
+}
+
+// Rename renames (moves) source to target.
+// An existing target file is preserved as a new version. A file moved to
+// the temporary path of an atomic upload, to resume it, is copied to the
+// versions directory
+func (fs *VersionedFs) Rename(source, target string) error {
+	if source != target {
+		fs.mu.Lock()
+		uploadTarget, isUploadStart := fs.atomicUploads[target]
+		isUploadStart = isUploadStart && uploadTarget == source
+		_, isUploadEnd := fs.atomicUploads[source]
+		delete(fs.atomicUploads, source)
+		fs.mu.Unlock()
+
+		if isUploadStart {
+			if err := fs.copyVersion(source); err != nil {
+				return err
+			}
+		} else if _, err := fs.addVersion(target); err != nil {
+			if isUploadEnd {
+				fs.setAtomicUpload(source, target)
+			}
+			return err
+		}
+	}
+	return fs.Fs.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory.
+// Files are moved to the versions directory
+func (fs *VersionedFs) Remove(name string, isDir bool) error {
+	if fs.isAtomicUpload(name) {
+		fs.mu.Lock()
+		delete(fs.atomicUploads, name)
+		fs.mu.Unlock()
+
+		return fs.Fs.Remove(name, isDir)
+	}
+	if !isDir {
+		moved, err := fs.addVersion(name)
+		if err != nil || moved {
+			return err
+		}
+	}
+	return fs.Fs.Remove(name, isDir)
+}
+
+// Truncate changes the size of the named file.
+// The file is copied to the versions directory if some contents are removed
+func (fs *VersionedFs) Truncate(name string, size int64) error {
+	if fs.isVersioningEnabledFor(name) {
+		info, err := fs.Fs.Lstat(name)
+		if err == nil && info.Size() > size && fs.canVersion(name, info) {
+			if err = fs.copyToVersions(name, info); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Fs.Truncate(name, size)
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// The path is tracked so the existing file is versioned when the upload
+// completes
+func (fs *VersionedFs) GetAtomicUploadPath(name string) string {
+	uploadPath := fs.Fs.GetAtomicUploadPath(name)
+	fs.setAtomicUpload(uploadPath, name)
+	return uploadPath
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (fs *VersionedFs) IsNotExist(err error) bool {
+	return fs.Fs.IsNotExist(err) || os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (fs *VersionedFs) IsPermission(err error) bool {
+	return fs.Fs.IsPermission(err) || os.IsPermission(err)
+}
+
+// HasPartialUpload returns true if name is an interrupted upload that can be resumed
+func (fs *VersionedFs) HasPartialUpload(name string) bool {
+	return HasPartialUpload(fs.Fs, name)
+}
+
+// AbortPartialUpload aborts the interrupted upload for the given name, if any
+func (fs *VersionedFs) AbortPartialUpload(name string) error {
+	return AbortPartialUpload(fs.Fs, name)
+}
+
+// GetVersionsUsage returns the number of stored versions and their size
+func (fs *VersionedFs) GetVersionsUsage() (int, int64, error) {
+	versionsRoot, err := fs.getVersionsRoot()
+	if err == nil {
+		var numFiles int
+		var size int64
+		numFiles, size, err = fs.Fs.GetDirSize(versionsRoot)
+		if err == nil {
+			return numFiles, size, nil
+		}
+	}
+	if fs.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	return 0, 0, err
+}
+
+// ListVersions returns the stored versions for the specified virtual path,
+// the most recent first. The versions not allowed by the retention settings
+// are removed
+func (fs *VersionedFs) ListVersions(virtualPath string) ([]FileVersion, error) {
+	versionsDir, err := fs.getVersionsDir(virtualPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fs.applyRetention(versionsDir)
+}
+
+// RestoreVersion restores the specified version of the given virtual path.
+// The current file, if any, is preserved as a new version
+func (fs *VersionedFs) RestoreVersion(virtualPath, versionID string) error {
+	if _, err := time.Parse(versionIDFormat, versionID); err != nil {
+		return ErrInvalidVersionID
+	}
+	fsPath, err := fs.ResolvePath(virtualPath)
+	if err != nil {
+		return err
+	}
+	versionsDir, err := fs.getVersionsDir(virtualPath)
+	if err != nil {
+		return err
+	}
+	versionPath := fs.Fs.Join(versionsDir, versionID)
+	if _, err = fs.Fs.Lstat(versionPath); err != nil {
+		return err
+	}
+	info, err := fs.Fs.Lstat(fsPath)
+	if err == nil {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("unable to restore %#v, it is not a regular file", virtualPath)
+		}
+		if _, err = fs.saveVersion(fsPath, info); err != nil {
+			return err
+		}
+	} else if !fs.IsNotExist(err) {
+		return err
+	}
+	if err = createMissingDirs(fs.Fs, path.Dir(path.Clean("/"+virtualPath))); err != nil {
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "restoring version %#v for file %#v", versionID, virtualPath)
+	return fs.moveFile(versionPath, fsPath)
+}
+
+// PurgeVersions removes the specified version of the given virtual path or all
+// its versions if versionID is empty. It returns the number of removed versions
+func (fs *VersionedFs) PurgeVersions(virtualPath, versionID string) (int, error) {
+	if versionID != "" {
+		if _, err := time.Parse(versionIDFormat, versionID); err != nil {
+			return 0, ErrInvalidVersionID
+		}
+	}
+	versionsDir, err := fs.getVersionsDir(virtualPath)
+	if err != nil {
+		return 0, err
+	}
+	if versionID != "" {
+		if err = fs.Fs.Remove(fs.Fs.Join(versionsDir, versionID), false); err != nil {
+			return 0, err
+		}
+		fs.removeEmptyDir(versionsDir)
+		return 1, nil
+	}
+	versions, err := fs.getVersions(versionsDir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, v := range versions {
+		if err = fs.Fs.Remove(v.name, false); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	fs.removeEmptyDir(versionsDir)
+	return removed, nil
+}
+
+// RemoveUserVersions removes all the versions stored on the given filesystem
+// for the specified user. The versions directory is named after the username,
+// so the versions must be removed when the user is deleted, otherwise they
+// would be available to a new user with the same name
+func RemoveUserVersions(fs Fs, username string) error {
+	if !IsVersioningAvailable() {
+		return nil
+	}
+	versionedFs := &VersionedFs{
+		Fs:       fs,
+		username: username,
+		isLocal:  usesOsPaths(fs),
+	}
+	versionsRoot, err := versionedFs.getVersionsRoot()
+	if err != nil {
+		return err
+	}
+	return removeUserDir(fs, versionsRoot)
+}
+
+func (fs *VersionedFs) setAtomicUpload(uploadPath, target string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.atomicUploads[uploadPath] = target
+}
+
+func (fs *VersionedFs) isAtomicUpload(name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, ok := fs.atomicUploads[name]
+	return ok
+}
+
+func (fs *VersionedFs) isVersioningEnabledFor(name string) bool {
+	relPath := fs.Fs.GetRelativePath(name)
+	// the paths outside the root directory, for example the versions and the
+	// trash items, are reported as the root directory that is never versioned
+	return relPath != "/" && isVirtualPathIncluded(relPath, fs.config.Paths)
+}
+
+// addVersion moves the named file, if it exists and versioning is enabled for
+// its path, to the versions directory. It returns true if the file was moved
+func (fs *VersionedFs) addVersion(name string) (bool, error) {
+	if !fs.isVersioningEnabledFor(name) {
+		return false, nil
+	}
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		if fs.Fs.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fs.saveVersion(name, info)
+}
+
+// saveVersion moves the named file to the versions directory, directories,
+// symlinks and empty files are not versioned
+func (fs *VersionedFs) saveVersion(name string, info os.FileInfo) (bool, error) {
+	if !fs.canVersion(name, info) {
+		return false, nil
+	}
+	versionPath, versionsDir, err := fs.getNewVersionPath(name)
+	if err != nil {
+		return false, err
+	}
+	fsLog(fs, logger.LevelDebug, "moving file %#v to version %#v", name, versionPath)
+	if err = fs.moveFile(name, versionPath); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to add a version for file %#v: %v", name, err)
+		return false, err
+	}
+	fs.applyRetention(versionsDir) //nolint:errcheck // errors are logged inside applyRetention
+	fs.applyQuota()
+	return true, nil
+}
+
+// copyVersion copies the named file, if it exists and versioning is enabled
+// for its path, to the versions directory
+func (fs *VersionedFs) copyVersion(name string) error {
+	if !fs.isVersioningEnabledFor(name) {
+		return nil
+	}
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		if fs.Fs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !fs.canVersion(name, info) {
+		return nil
+	}
+	return fs.copyToVersions(name, info)
+}
+
+// canVersion returns true if the named file can be preserved as a version.
+// Directories, symlinks, empty files and files bigger than the versions
+// quota are not versioned
+func (fs *VersionedFs) canVersion(name string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return false
+	}
+	if fs.config.QuotaSize > 0 && GetQuotaSize(info) > fs.config.QuotaSize {
+		fsLog(fs, logger.LevelInfo, "file %#v exceeds the versions quota, size: %v, quota: %v", name,
+			GetQuotaSize(info), fs.config.QuotaSize)
+		return false
+	}
+	return true
+}
+
+// copyToVersions copies the named file to the versions directory
+func (fs *VersionedFs) copyToVersions(name string, info os.FileInfo) error {
+	versionPath, versionsDir, err := fs.getNewVersionPath(name)
+	if err != nil {
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "copying file %#v to version %#v", name, versionPath)
+	if err = fs.copyFile(name, versionPath, info); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to add a version for file %#v: %v", name, err)
+		return err
+	}
+	fs.applyRetention(versionsDir) //nolint:errcheck // errors are logged inside applyRetention
+	fs.applyQuota()
+	return nil
+}
+
+// moveFile renames source to target, if the rename fails, for example
+// because a virtual folder is on a different device, the file is copied
+func (fs *VersionedFs) moveFile(source, target string) error {
+	err := fs.Fs.Rename(source, target)
+	if err == nil {
+		return nil
+	}
+	info, errStat := fs.Fs.Lstat(source)
+	if errStat != nil {
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "unable to rename %#v -> %#v: %v, trying to copy", source, target, err)
+	if err = fs.copyFile(source, target, info); err != nil {
+		return err
+	}
+	return fs.Fs.Remove(source, false)
+}
+
+func (fs *VersionedFs) copyFile(source, target string, info os.FileInfo) error {
+	src, cancelFn, err := openInner(fs.Fs, source, 0)
+	if err != nil {
+		return err
+	}
+	err = writeToFs(fs.Fs, target, src)
+	closeInner(src, cancelFn)
+	if err != nil {
+		return err
+	}
+	// preserving the modification time is not supported by all the filesystems
+	if err = fs.Fs.Chtimes(target, info.ModTime(), info.ModTime()); err != nil && !fs.Fs.IsNotSupported(err) {
+		fsLog(fs, logger.LevelDebug, "unable to preserve times for version %#v: %v", target, err)
+	}
+	return nil
+}
+
+// getVersionsRoot returns the filesystem path for the directory that contains
+// the versions of this user. It must be outside the root directory and the
+// virtual folders, so the versions can never be accessed using the user's paths
+func (fs *VersionedFs) getVersionsRoot() (string, error) {
+	if !IsVersioningAvailable() {
+		return "", errors.New("the versions path is not configured")
+	}
+	versionsRoot := fs.Fs.Join(versionsPath, fs.username)
+	rootDir, err := fs.Fs.ResolvePath("/")
+	if err != nil {
+		return "", err
+	}
+	if fs.Fs.GetRelativePath(versionsRoot) != "/" || isSameOrSubPath(rootDir, versionsRoot, fs.isLocal) {
+		return "", fmt.Errorf("the versions directory %#v must be outside the root directory %#v", versionsRoot, rootDir)
+	}
+	return versionsRoot, nil
+}
+
+// getVersionsDir returns the filesystem path for the directory that contains the
+// versions for the specified virtual path
+func (fs *VersionedFs) getVersionsDir(virtualPath string) (string, error) {
+	versionsRoot, err := fs.getVersionsRoot()
+	if err != nil {
+		return "", err
+	}
+	return fs.Fs.Join(versionsRoot, path.Clean("/"+virtualPath)), nil
+}
+
+// getNewVersionPath returns the filesystem path for a new version of the named
+// file and the directory that contains it. The missing directories are created
+func (fs *VersionedFs) getNewVersionPath(name string) (string, string, error) {
+	versionsDir, err := fs.getVersionsDir(fs.Fs.GetRelativePath(name))
+	if err != nil {
+		return "", "", err
+	}
+	if err = createDirs(fs.Fs, versionsDir, fs.isLocal); err != nil {
+		return "", "", err
+	}
+	versionID := time.Now().UTC().Format(versionIDFormat)
+	return fs.Fs.Join(versionsDir, versionID), versionsDir, nil
+}
+
+// getVersions returns the versions stored inside the specified directory,
+// the most recent first
+func (fs *VersionedFs) getVersions(versionsDir string) ([]FileVersion, error) {
+	contents, err := fs.Fs.ReadDir(versionsDir)
+	if err != nil {
+		if fs.Fs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var versions []FileVersion
+	for _, info := range contents {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		createdAt, err := time.Parse(versionIDFormat, info.Name())
+		if err != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{
+			ID:           info.Name(),
+			Size:         GetQuotaSize(info),
+			CreatedAt:    utils.GetTimeAsMsSinceEpoch(createdAt),
+			LastModified: utils.GetTimeAsMsSinceEpoch(info.ModTime()),
+			name:         fs.Fs.Join(versionsDir, info.Name()),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+	return versions, nil
+}
+
+// applyRetention removes the versions, inside the specified directory, not
+// allowed by the retention settings and returns the remaining ones
+func (fs *VersionedFs) applyRetention(versionsDir string) ([]FileVersion, error) {
+	versions, err := fs.getVersions(versionsDir)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to get the versions inside %#v: %v", versionsDir, err)
+		return nil, err
+	}
+	maxVersions := fs.config.getMaxVersions()
+	minCreationTime := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-24 * time.Hour * time.Duration(fs.config.getMaxAge())))
+	result := make([]FileVersion, 0, len(versions))
+	for idx, v := range versions {
+		if idx >= maxVersions || v.CreatedAt < minCreationTime {
+			fsLog(fs, logger.LevelDebug, "removing expired version %#v", v.name)
+			if err := fs.Fs.Remove(v.name, false); err != nil {
+				fsLog(fs, logger.LevelWarn, "unable to remove expired version %#v: %v", v.name, err)
+				return nil, err
+			}
+			continue
+		}
+		result = append(result, v)
+	}
+	if len(result) == 0 {
+		fs.removeEmptyDir(versionsDir)
+	}
+	return result, nil
+}
+
+// applyQuota removes the oldest versions, of any file, until the size of the
+// stored versions is within the versions quota
+func (fs *VersionedFs) applyQuota() {
+	if fs.config.QuotaSize <= 0 {
+		return
+	}
+	versionsRoot, err := fs.getVersionsRoot()
+	if err != nil {
+		return
+	}
+	var versions []FileVersion
+	var size int64
+	err = fs.Fs.Walk(versionsRoot, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, errParse := time.Parse(versionIDFormat, info.Name()); errParse != nil {
+			return nil
+		}
+		versions = append(versions, FileVersion{
+			ID:   info.Name(),
+			Size: GetQuotaSize(info),
+			name: walkedPath,
+		})
+		size += GetQuotaSize(info)
+		return nil
+	})
+	if err != nil {
+		if !fs.IsNotExist(err) {
+			fsLog(fs, logger.LevelWarn, "unable to get the versions to apply the quota: %v", err)
+		}
+		return
+	}
+	if size <= fs.config.QuotaSize {
+		return
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	})
+	for _, v := range versions {
+		if size <= fs.config.QuotaSize {
+			return
+		}
+		fsLog(fs, logger.LevelDebug, "removing version %#v to apply the versions quota", v.name)
+		if err := fs.Fs.Remove(v.name, false); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to remove version %#v: %v", v.name, err)
+			return
+		}
+		size -= v.Size
+	}
+}
+
+// removeEmptyDir removes the specified directory inside the versions directory,
+// and its parents, if they are empty
+func (fs *VersionedFs) removeEmptyDir(versionsDir string) {
+	versionsRoot, err := fs.getVersionsRoot()
+	if err != nil {
+		return
+	}
+	removeEmptyDirs(fs.Fs, versionsRoot, versionsDir, fs.isLocal)
+}
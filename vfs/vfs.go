@@ -2,6 +2,7 @@
 package vfs
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eikenb/pipeat"
@@ -22,8 +24,36 @@ import (
 
 const dirMimeType = "inode/directory"
 
+// providers for the storage targets used by the tiering and the replication
+const (
+	storageTargetLocal = "local"
+	storageTargetS3    = "s3"
+)
+
+// Supported S3 server-side encryption types
+const (
+	// S3SSETypeS3 defines server-side encryption with Amazon S3 managed keys
+	S3SSETypeS3 = "sse-s3"
+	// S3SSETypeKMS defines server-side encryption with keys stored in AWS KMS
+	S3SSETypeKMS = "sse-kms"
+	// S3SSETypeCustomer defines server-side encryption with customer provided keys
+	S3SSETypeCustomer = "sse-c"
+)
+
+// Supported S3 object lock modes
+const (
+	// S3ObjectLockModeGovernance defines the governance retention mode, users
+	// with special permissions can override the retention
+	S3ObjectLockModeGovernance = "GOVERNANCE"
+	// S3ObjectLockModeCompliance defines the compliance retention mode, the
+	// retention cannot be overridden by any user
+	S3ObjectLockModeCompliance = "COMPLIANCE"
+)
+
 var (
-	validAzAccessTier         = []string{"", "Archive", "Hot", "Cool"}
+	validAzAccessTier = []string{"", "Archive", "Hot", "Cool"}
+	s3CannedACLs      = []string{"private", "public-read", "public-read-write", "authenticated-read",
+		"aws-exec-read", "bucket-owner-read", "bucket-owner-full-control"}
 	errStorageSizeUnavailable = errors.New("unable to get available size for this storage backend")
 )
 
@@ -44,6 +74,7 @@ type Fs interface {
 	Chtimes(name string, atime, mtime time.Time) error
 	Truncate(name string, size int64) error
 	ReadDir(dirname string) ([]os.FileInfo, error)
+	OpenDir(dirname string) (DirLister, error)
 	Readlink(name string) (string, error)
 	IsUploadResumeSupported() bool
 	IsAtomicUploadSupported() bool
@@ -132,6 +163,105 @@ type S3FsConfig struct {
 	UploadPartSize int64 `json:"upload_part_size,omitempty"`
 	// How many parts are uploaded in parallel
 	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// Server-side encryption type, empty means no server-side encryption.
+	// Supported values: "sse-s3", "sse-kms", "sse-c"
+	SSEType string `json:"sse_type,omitempty"`
+	// The KMS key to use for "sse-kms", if empty the AWS managed key is used
+	SSEKMSKeyID string `json:"sse_kms_key_id,omitempty"`
+	// The customer provided key for "sse-c". The key must be 32 bytes long,
+	// base64 encoded keys are accepted too.
+	// It is stored encrypted based on the kms configuration
+	SSECustomerKey *kms.Secret `json:"sse_customer_key,omitempty"`
+	// Canned ACL to apply to the uploaded objects, for example
+	// "bucket-owner-full-control". Empty means the bucket default
+	ACL string `json:"acl,omitempty"`
+	// Set to true to use path-style addressing, i.e. http://s3.amazonaws.com/BUCKET/KEY,
+	// instead of virtual-hosted-style addressing, i.e. http://BUCKET.s3.amazonaws.com/KEY.
+	// Required by most of the on-premise S3 compatible object storages
+	ForcePathStyle bool `json:"force_path_style,omitempty"`
+	// S3 does not return the user metadata when listing objects, set to true
+	// to read the modification time and the other attributes set by the
+	// clients, and stored as object metadata, for each listed file too.
+	// An additional HEAD request is required for each file, so listing big
+	// directories is slower
+	ListMetadata bool `json:"list_metadata,omitempty"`
+	// Set to true to emulate symlinks using small marker objects that
+	// store the link target as metadata
+	EmulateSymlinks bool `json:"emulate_symlinks,omitempty"`
+	// S3 object lock mode to use for the files uploaded inside the directories
+	// with a retention filter, empty means no native object lock.
+	// Supported values: "GOVERNANCE", "COMPLIANCE".
+	// The bucket must be created with object lock enabled
+	ObjectLockMode string `json:"object_lock_mode,omitempty"`
+	// the username that owns the interrupted uploads to resume, it is not persisted
+	Owner string `json:"-"`
+}
+
+// IsSSECustomerKeyRequired returns true if the objects are encrypted using a
+// customer provided key and so the key is required to access them
+func (c *S3FsConfig) IsSSECustomerKeyRequired() bool {
+	return c.SSEType == S3SSETypeCustomer
+}
+
+func (c *S3FsConfig) checkServerSideEncryption() error {
+	switch c.SSEType {
+	case "", S3SSETypeS3:
+		c.SSEKMSKeyID = ""
+		c.SSECustomerKey = kms.NewEmptySecret()
+	case S3SSETypeKMS:
+		c.SSECustomerKey = kms.NewEmptySecret()
+	case S3SSETypeCustomer:
+		c.SSEKMSKeyID = ""
+		if c.SSECustomerKey.IsEmpty() {
+			return errors.New("sse_customer_key cannot be empty with sse_type sse-c")
+		}
+		if c.SSECustomerKey.IsEncrypted() && !c.SSECustomerKey.IsValid() {
+			return errors.New("invalid encrypted sse_customer_key")
+		}
+		if !c.SSECustomerKey.IsValidInput() {
+			return errors.New("invalid sse_customer_key")
+		}
+		if c.SSECustomerKey.IsPlain() {
+			if _, err := GetS3SSECustomerKey(c.SSECustomerKey.GetPayload()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid sse_type %#v", c.SSEType)
+	}
+	return nil
+}
+
+func (c *S3FsConfig) checkACL() error {
+	if c.ACL == "" {
+		return nil
+	}
+	if !utils.IsStringInSlice(c.ACL, s3CannedACLs) {
+		return fmt.Errorf("invalid acl %#v", c.ACL)
+	}
+	return nil
+}
+
+func (c *S3FsConfig) checkObjectLockMode() error {
+	switch c.ObjectLockMode {
+	case "", S3ObjectLockModeGovernance, S3ObjectLockModeCompliance:
+		return nil
+	default:
+		return fmt.Errorf("invalid object_lock_mode %#v", c.ObjectLockMode)
+	}
+}
+
+// GetS3SSECustomerKey returns the 32 bytes key to use for SSE-C from the
+// configured key, it can be a raw or a base64 encoded key
+func GetS3SSECustomerKey(key string) (string, error) {
+	if len(key) == 32 {
+		return key, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err == nil && len(decoded) == 32 {
+		return string(decoded), nil
+	}
+	return "", errors.New("sse_customer_key must be a 32 bytes key, raw or base64 encoded")
 }
 
 func (c *S3FsConfig) checkCredentials() error {
@@ -150,7 +280,7 @@ func (c *S3FsConfig) checkCredentials() error {
 	return nil
 }
 
-// EncryptCredentials encrypts access secret if it is in plain text
+// EncryptCredentials encrypts access secret and SSE-C key if they are in plain text
 func (c *S3FsConfig) EncryptCredentials(additionalData string) error {
 	if c.AccessSecret.IsPlain() {
 		c.AccessSecret.SetAdditionalData(additionalData)
@@ -159,6 +289,12 @@ func (c *S3FsConfig) EncryptCredentials(additionalData string) error {
 			return err
 		}
 	}
+	if c.SSECustomerKey.IsPlain() {
+		c.SSECustomerKey.SetAdditionalData(additionalData)
+		if err := c.SSECustomerKey.Encrypt(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -167,6 +303,9 @@ func (c *S3FsConfig) Validate() error {
 	if c.AccessSecret == nil {
 		c.AccessSecret = kms.NewEmptySecret()
 	}
+	if c.SSECustomerKey == nil {
+		c.SSECustomerKey = kms.NewEmptySecret()
+	}
 	if c.Bucket == "" {
 		return errors.New("bucket cannot be empty")
 	}
@@ -191,7 +330,13 @@ func (c *S3FsConfig) Validate() error {
 	if c.UploadConcurrency < 0 || c.UploadConcurrency > 64 {
 		return fmt.Errorf("invalid upload concurrency: %v", c.UploadConcurrency)
 	}
-	return nil
+	if err := c.checkServerSideEncryption(); err != nil {
+		return err
+	}
+	if err := c.checkObjectLockMode(); err != nil {
+		return err
+	}
+	return c.checkACL()
 }
 
 // GCSFsConfig defines the configuration for Google Cloud Storage based filesystem
@@ -209,6 +354,9 @@ type GCSFsConfig struct {
 	// 0 explicit, 1 automatic
 	AutomaticCredentials int    `json:"automatic_credentials,omitempty"`
 	StorageClass         string `json:"storage_class,omitempty"`
+	// Set to true to emulate symlinks using small marker objects that
+	// store the link target as metadata
+	EmulateSymlinks bool `json:"emulate_symlinks,omitempty"`
 }
 
 // Validate returns an error if the configuration is not valid
@@ -278,6 +426,11 @@ type AzBlobFsConfig struct {
 	UseEmulator bool `json:"use_emulator,omitempty"`
 	// Blob Access Tier
 	AccessTier string `json:"access_tier,omitempty"`
+	// Set to true to emulate symlinks using small marker blobs that
+	// store the link target as metadata
+	EmulateSymlinks bool `json:"emulate_symlinks,omitempty"`
+	// the username that owns the interrupted uploads to resume, it is not persisted
+	Owner string `json:"-"`
 }
 
 // EncryptCredentials encrypts access secret if it is in plain text
@@ -353,6 +506,12 @@ func (c *CryptFsConfig) EncryptCredentials(additionalData string) error {
 	return nil
 }
 
+// IsEnabled returns true if a passphrase is configured. For remote
+// filesystems this enables the client-side encryption
+func (c *CryptFsConfig) IsEnabled() bool {
+	return c.Passphrase != nil && !c.Passphrase.IsEmpty()
+}
+
 // Validate returns an error if the configuration is not valid
 func (c *CryptFsConfig) Validate() error {
 	if c.Passphrase == nil || c.Passphrase.IsEmpty() {
@@ -372,6 +531,9 @@ type PipeWriter struct {
 	writer *pipeat.PipeWriterAt
 	err    error
 	done   chan bool
+	// offset is the position, within the destination file, of the
+	// first byte written to the pipe. It is not 0 for resumed uploads
+	offset int64
 }
 
 // NewPipeWriter initializes a new PipeWriter
@@ -399,7 +561,10 @@ func (p *PipeWriter) Done(err error) {
 
 // WriteAt is a wrapper for pipeat WriteAt
 func (p *PipeWriter) WriteAt(data []byte, off int64) (int, error) {
-	return p.writer.WriteAt(data, off)
+	if off < p.offset {
+		return 0, fmt.Errorf("invalid write offset: %v minimum valid value: %v", off, p.offset)
+	}
+	return p.writer.WriteAt(data, off-p.offset)
 }
 
 // Write is a wrapper for pipeat Write
@@ -416,24 +581,182 @@ func IsDirectory(fs Fs, path string) (bool, error) {
 	return fileInfo.IsDir(), err
 }
 
-// IsLocalOsFs returns true if fs is a local filesystem implementation
+// bucketChecker is implemented by the object storage filesystems
+type bucketChecker interface {
+	checkIfBucketExists() error
+}
+
+// CheckStorageReachability verifies that the storage for the given filesystem
+// can be reached: the bucket or container must exist for object storage, the
+// root directory must be accessible for the other backends
+func CheckStorageReachability(fs Fs) error {
+	if checker, ok := fs.(bucketChecker); ok {
+		return checker.checkIfBucketExists()
+	}
+	rootPath, err := fs.ResolvePath("/")
+	if err != nil {
+		return err
+	}
+	_, err = fs.Stat(rootPath)
+	return err
+}
+
+// fsLayer is implemented by the Fs implementations that add a feature, such
+// as the encryption or the trash, on top of another Fs
+type fsLayer interface {
+	// Unwrap returns the Fs below this layer
+	Unwrap() Fs
+}
+
+// storageLayer is implemented by the layers that don't change how the files
+// are stored and return the files opened by the Fs below them as is, the
+// protocol handlers must handle these files as they do for the wrapped Fs
+type storageLayer interface {
+	fsLayer
+	isStorageLayer()
+}
+
+// transparentLayer is implemented by the storage layers that don't need to
+// handle every operation, so the files can be accessed bypassing them, for
+// example using the SSH system commands
+type transparentLayer interface {
+	storageLayer
+	isTransparentLayer()
+}
+
+// UnwrapFs returns the Fs implementation below all the layers
+func UnwrapFs(fs Fs) Fs {
+	for {
+		l, ok := fs.(fsLayer)
+		if !ok {
+			return fs
+		}
+		fs = l.Unwrap()
+	}
+}
+
+// getStorageFs returns the Fs below the storage layers
+func getStorageFs(fs Fs) Fs {
+	for {
+		l, ok := fs.(storageLayer)
+		if !ok {
+			return fs
+		}
+		fs = l.Unwrap()
+	}
+}
+
+// findFsLayer returns the first Fs, starting from fs and going down through
+// the layers, for which the match function returns true
+func findFsLayer(fs Fs, match func(Fs) bool) (Fs, bool) {
+	for {
+		if match(fs) {
+			return fs, true
+		}
+		l, ok := fs.(fsLayer)
+		if !ok {
+			return nil, false
+		}
+		fs = l.Unwrap()
+	}
+}
+
+// IsLocalOsFs returns true if fs is a local filesystem implementation and the
+// files can be accessed directly: there are no layers, such as the versioning
+// or the trash, that must handle the operations
 func IsLocalOsFs(fs Fs) bool {
-	return fs.Name() == osFsName
+	for {
+		l, ok := fs.(transparentLayer)
+		if !ok {
+			break
+		}
+		fs = l.Unwrap()
+	}
+	_, ok := fs.(*OsFs)
+	return ok
+}
+
+// IsLocalStorage returns true if the files are stored on the local
+// filesystem without changing them, the storage layers are inspected
+func IsLocalStorage(fs Fs) bool {
+	_, ok := getStorageFs(fs).(*OsFs)
+	return ok
 }
 
-// IsCryptOsFs returns true if fs is an encrypted local filesystem implementation
+// IsCryptOsFs returns true if fs is an encrypted local filesystem implementation.
+// The storage layers are inspected
 func IsCryptOsFs(fs Fs) bool {
-	return fs.Name() == cryptFsName
+	_, ok := getStorageFs(fs).(*CryptFs)
+	return ok
 }
 
-// IsSFTPFs returns true if fs is a SFTP filesystem
+// IsSFTPFs returns true if fs is a SFTP filesystem.
+// The storage layers are inspected
 func IsSFTPFs(fs Fs) bool {
-	return strings.HasPrefix(fs.Name(), sftpFsName)
+	_, ok := getStorageFs(fs).(*SFTPFs)
+	return ok
+}
+
+// IsMemoryFs returns true if fs is an in memory filesystem.
+// The storage layers are inspected
+func IsMemoryFs(fs Fs) bool {
+	_, ok := getStorageFs(fs).(*MemoryFs)
+	return ok
 }
 
-// IsLocalOrSFTPFs returns true if fs is local or SFTP
+// IsLocalOrSFTPFs returns true if fs is local or SFTP.
+// The in memory and the tiered filesystems are handled as the local one
 func IsLocalOrSFTPFs(fs Fs) bool {
-	return IsLocalOsFs(fs) || IsSFTPFs(fs)
+	return IsLocalStorage(fs) || IsMemoryFs(fs) || IsTieredFs(fs) || IsSFTPFs(fs)
+}
+
+// hardlinker is implemented by the filesystems that support hard links
+type hardlinker interface {
+	Link(oldname, newname string) error
+}
+
+// IsHardlinkSupported returns true if fs can create hard links
+func IsHardlinkSupported(fs Fs) bool {
+	_, ok := fs.(hardlinker)
+	return ok
+}
+
+// Link creates newname as a hard link to the oldname file
+func Link(fs Fs, oldname, newname string) error {
+	if l, ok := fs.(hardlinker); ok {
+		return l.Link(oldname, newname)
+	}
+	return ErrVfsUnsupported
+}
+
+// quotaSizer is implemented by the FileInfo returned by the filesystems that
+// track the quota usage using a size different from the reported one
+type quotaSizer interface {
+	QuotaSize() int64
+}
+
+// GetQuotaSize returns the size to use to track the quota usage for the
+// given file
+func GetQuotaSize(info os.FileInfo) int64 {
+	if q, ok := info.(quotaSizer); ok {
+		return q.QuotaSize()
+	}
+	return info.Size()
+}
+
+// IsRandomAccessFs returns true if fs supports random access writes for the
+// opened files
+func IsRandomAccessFs(fs Fs) bool {
+	return IsLocalOrSFTPFs(fs) || IsCryptOsFs(fs)
+}
+
+// IsOverlayLowerFile returns true if fs is an overlay filesystem and name is a
+// file that exists only inside its read-only lower layer
+func IsOverlayLowerFile(fs Fs, name string) bool {
+	if overlayFs, ok := fs.(*OverlayFs); ok {
+		return overlayFs.IsLowerOnlyFile(name)
+	}
+	return false
 }
 
 // SetPathPermissions calls fs.Chown.
@@ -442,7 +765,7 @@ func SetPathPermissions(fs Fs, path string, uid int, gid int) {
 	if uid == -1 && gid == -1 {
 		return
 	}
-	if IsLocalOsFs(fs) {
+	if IsLocalStorage(fs) {
 		if runtime.GOOS == "windows" {
 			return
 		}
@@ -452,6 +775,247 @@ func SetPathPermissions(fs Fs, path string, uid int, gid int) {
 	}
 }
 
+// copied from rclone
+func readFill(r io.Reader, buf []byte) (n int, err error) {
+	var nn int
+	for n < len(buf) && err == nil {
+		nn, err = r.Read(buf[n:])
+		n += nn
+	}
+	return n, err
+}
+
+type bufferAllocator struct {
+	sync.Mutex
+	available  [][]byte
+	bufferSize int
+	finalized  bool
+}
+
+func newBufferAllocator(size int) *bufferAllocator {
+	return &bufferAllocator{
+		bufferSize: size,
+		finalized:  false,
+	}
+}
+
+func (b *bufferAllocator) getBuffer() []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.available) > 0 {
+		var result []byte
+
+		truncLength := len(b.available) - 1
+		result = b.available[truncLength]
+
+		b.available[truncLength] = nil
+		b.available = b.available[:truncLength]
+
+		return result
+	}
+
+	return make([]byte, b.bufferSize)
+}
+
+func (b *bufferAllocator) releaseBuffer(buf []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.finalized || len(buf) != b.bufferSize {
+		return
+	}
+
+	b.available = append(b.available, buf)
+}
+
+func (b *bufferAllocator) free() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.available = nil
+	b.finalized = true
+}
+
+// cleanVirtualPaths returns the cleaned and deduplicated paths or an error if
+// a path is not an absolute virtual path
+func cleanVirtualPaths(paths []string, desc string) ([]string, error) {
+	var result []string
+	for _, p := range paths {
+		cleanedPath := path.Clean(strings.TrimSpace(p))
+		if !path.IsAbs(cleanedPath) {
+			return nil, fmt.Errorf("invalid %v path %#v, it must be an absolute virtual path", desc, p)
+		}
+		if !utils.IsStringInSlice(cleanedPath, result) {
+			result = append(result, cleanedPath)
+		}
+	}
+	return result, nil
+}
+
+// isVirtualPathIncluded returns true if virtualPath is one of the given paths
+// or it is inside one of them. Empty paths include everything
+func isVirtualPathIncluded(virtualPath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if p == "/" || virtualPath == p || strings.HasPrefix(virtualPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeToFs creates or truncates the named file on the given filesystem and
+// writes the contents read from r
+func writeToFs(fs Fs, name string, r io.Reader) error {
+	f, w, cancelFn, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		_, err = io.Copy(f, r)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if errClose := w.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// createMissingDirs creates the directory for the specified relative path
+// and its missing parents. Directories are not created for filesystems that
+// emulate them
+func createMissingDirs(fs Fs, relPath string) error {
+	if relPath == "/" || relPath == "." || relPath == "" || fs.HasVirtualFolders() {
+		return nil
+	}
+	dirPath, err := fs.ResolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Stat(dirPath)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("unable to create directory %#v: a file with the same name exists", relPath)
+		}
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	if err = createMissingDirs(fs, path.Dir(relPath)); err != nil {
+		return err
+	}
+	return fs.Mkdir(dirPath)
+}
+
+// createDirs creates the directory for the specified filesystem path and its
+// missing parents. Directories are not created for filesystems that emulate them
+func createDirs(fs Fs, dirPath string, isLocal bool) error {
+	if fs.HasVirtualFolders() {
+		return nil
+	}
+	var missingDirs []string
+	for {
+		info, err := fs.Stat(dirPath)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("unable to create directory %#v: a file with the same name exists", dirPath)
+			}
+			break
+		}
+		if !fs.IsNotExist(err) {
+			return err
+		}
+		missingDirs = append(missingDirs, dirPath)
+		parentDir := getFsDir(dirPath, isLocal)
+		if parentDir == dirPath {
+			break
+		}
+		dirPath = parentDir
+	}
+	for idx := len(missingDirs) - 1; idx >= 0; idx-- {
+		if err := fs.Mkdir(missingDirs[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the directory for the specified filesystem path, and
+// its parents up to rootDir excluded, if they are empty
+func removeEmptyDirs(fs Fs, rootDir, dirPath string, isLocal bool) {
+	if fs.HasVirtualFolders() {
+		return
+	}
+	for dirPath != rootDir && isSameOrSubPath(dirPath, rootDir, isLocal) {
+		contents, err := fs.ReadDir(dirPath)
+		if err != nil || len(contents) > 0 {
+			return
+		}
+		if err = fs.Remove(dirPath, true); err != nil {
+			return
+		}
+		dirPath = getFsDir(dirPath, isLocal)
+	}
+}
+
+// isSameOrSubPath returns true if the filesystem path name is equal to dirPath
+// or it is inside it
+func isSameOrSubPath(name, dirPath string, isLocal bool) bool {
+	separator := "/"
+	if isLocal {
+		name = filepath.Clean(name)
+		dirPath = filepath.Clean(dirPath)
+		separator = string(os.PathSeparator)
+	} else {
+		name = path.Clean(name)
+		dirPath = path.Clean(dirPath)
+	}
+	return name == dirPath || strings.HasPrefix(name, strings.TrimSuffix(dirPath, separator)+separator)
+}
+
+func getFsDir(name string, isLocal bool) string {
+	if isLocal {
+		return filepath.Dir(name)
+	}
+	return path.Dir(name)
+}
+
+// newStorageTarget returns the filesystem for a storage target, a local
+// directory or a S3 bucket. The local directory is created if missing
+func newStorageTarget(provider, localPath string, s3Config S3FsConfig, s3Secret *kms.Secret) (Fs, error) {
+	switch provider {
+	case storageTargetLocal:
+		if !filepath.IsAbs(localPath) {
+			return nil, fmt.Errorf("invalid local path %#v, it must be an absolute path", localPath)
+		}
+		localPath = filepath.Clean(localPath)
+		if err := os.MkdirAll(localPath, 0700); err != nil {
+			return nil, fmt.Errorf("unable to create directory %#v: %v", localPath, err)
+		}
+		return NewOsFs("", localPath, nil), nil
+	case storageTargetS3:
+		if s3Secret != nil && !s3Secret.IsEmpty() {
+			// the secret is parsed with the configuration, before the KMS
+			// initialization, clone it to use the configured KMS
+			s3Config.AccessSecret = s3Secret.Clone()
+		}
+		return NewS3Fs("", "", s3Config)
+	default:
+		return nil, fmt.Errorf("invalid provider %#v", provider)
+	}
+}
+
 func fsLog(fs Fs, level logger.LogLevel, format string, v ...interface{}) {
 	logger.Log(level, fs.Name(), fs.ConnectionID(), format, v...)
 }
@@ -0,0 +1,728 @@
+package vfs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/version"
+)
+
+const (
+	// webDAVFsName is the name for the WebDAV Fs implementation
+	webDAVFsName = "webdavfs"
+	// body for PROPFIND requests, we only ask for the properties we need
+	webDAVPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+)
+
+// WebDAVFsConfig defines the configuration for WebDAV based filesystem
+type WebDAVFsConfig struct {
+	// Endpoint is the URL for the remote WebDAV server, for example
+	// https://dav.example.com/remote.php/dav/files/user
+	Endpoint string      `json:"endpoint,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Password *kms.Secret `json:"password,omitempty"`
+	// SkipTLSVerify disables the verification of the server certificate.
+	// This is insecure and should be used for testing only
+	SkipTLSVerify bool `json:"skip_tls_verify,omitempty"`
+	// CACertificate is an optional PEM encoded certificate authority used,
+	// in addition to the system ones, to verify the server certificate
+	CACertificate string `json:"ca_certificate,omitempty"`
+	// Prefix is the path prefix to strip from WebDAV resource paths.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (c *WebDAVFsConfig) setEmptyCredentialsIfNil() {
+	if c.Password == nil {
+		c.Password = kms.NewEmptySecret()
+	}
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *WebDAVFsConfig) Validate() error {
+	c.setEmptyCredentialsIfNil()
+	if c.Endpoint == "" {
+		return errors.New("endpoint cannot be empty")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint scheme %#v, only http and https are supported", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("invalid endpoint, the host cannot be empty")
+	}
+	if c.Username == "" && !c.Password.IsEmpty() {
+		return errors.New("username cannot be empty if a password is provided")
+	}
+	if c.Password.IsEncrypted() && !c.Password.IsValid() {
+		return errors.New("invalid encrypted password")
+	}
+	if !c.Password.IsEmpty() && !c.Password.IsValidInput() {
+		return errors.New("invalid password")
+	}
+	if c.CACertificate != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CACertificate)) {
+			return errors.New("invalid CA certificate")
+		}
+	}
+	if c.Prefix != "" {
+		c.Prefix = utils.CleanPath(c.Prefix)
+	} else {
+		c.Prefix = "/"
+	}
+	return nil
+}
+
+// EncryptCredentials encrypts the password if it is in plain text
+func (c *WebDAVFsConfig) EncryptCredentials(additionalData string) error {
+	if c.Password.IsPlain() {
+		c.Password.SetAdditionalData(additionalData)
+		if err := c.Password.Encrypt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webDAVMultiStatus struct {
+	Responses []webDAVResponse `xml:"DAV: response"`
+}
+
+type webDAVResponse struct {
+	Href     string           `xml:"DAV: href"`
+	Propstat []webDAVPropstat `xml:"DAV: propstat"`
+}
+
+type webDAVPropstat struct {
+	Status string     `xml:"DAV: status"`
+	Prop   webDAVProp `xml:"DAV: prop"`
+}
+
+type webDAVProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+}
+
+// WebDAVFs is a Fs implementation for WebDAV backends
+type WebDAVFs struct {
+	connectionID string
+	// if any, this is the local directory used for temporary files
+	localTempDir string
+	config       *WebDAVFsConfig
+	endpoint     *url.URL
+	client       *http.Client
+	ctxTimeout   time.Duration
+}
+
+// NewWebDAVFs returns a WebDAVFs object that allows to interact with a remote WebDAV server
+func NewWebDAVFs(connectionID, localTempDir string, config WebDAVFsConfig) (Fs, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if !config.Password.IsEmpty() && config.Password.IsEncrypted() {
+		if err := config.Password.Decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.SkipTLSVerify, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CACertificate != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCAs.AppendCertsFromPEM([]byte(config.CACertificate))
+		tlsConfig.RootCAs = rootCAs
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &WebDAVFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       &config,
+		endpoint:     endpoint,
+		client:       &http.Client{Transport: transport},
+		ctxTimeout:   30 * time.Second,
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *WebDAVFs) Name() string {
+	return fmt.Sprintf("%v %#v", webDAVFsName, fs.config.Endpoint)
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *WebDAVFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *WebDAVFs) Stat(name string) (os.FileInfo, error) {
+	responses, err := fs.propfind(name, "0")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range responses {
+		if info, ok := fs.getFileInfo(r, name); ok {
+			return info, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// Lstat returns a FileInfo describing the named file.
+// WebDAV has no symlinks so this is the same as Stat
+func (fs *WebDAVFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading
+func (fs *WebDAVFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+		n, err := fs.download(ctx, name, offset, w)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs *WebDAVFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+		err := fs.upload(ctx, name, r)
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v",
+			name, r.GetReadedBytes(), err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// Directories are moved server side including their contents
+func (fs *WebDAVFs) Rename(source, target string) error {
+	if source == target {
+		return nil
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, "MOVE", source, nil, map[string]string{
+		"Destination": fs.getURL(target),
+		"Overwrite":   "T",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return nil
+	default:
+		return fs.getStatusError("rename", source, resp.StatusCode)
+	}
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *WebDAVFs) Remove(name string, isDir bool) error {
+	if isDir {
+		contents, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 {
+			return fmt.Errorf("Cannot remove non empty directory: %#v", name)
+		}
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK, http.StatusAccepted:
+		return nil
+	default:
+		return fs.getStatusError("remove", name, resp.StatusCode)
+	}
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *WebDAVFs) Mkdir(name string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, "MKCOL", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusMethodNotAllowed:
+		// MKCOL on an existing resource
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	default:
+		return fs.getStatusError("mkdir", name, resp.StatusCode)
+	}
+}
+
+// Symlink creates source as a symbolic link to target.
+func (*WebDAVFs) Symlink(source, target string) error {
+	return ErrVfsUnsupported
+}
+
+// Readlink returns the destination of the named symbolic link
+func (*WebDAVFs) Readlink(name string) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (*WebDAVFs) Chown(name string, uid int, gid int) error {
+	return ErrVfsUnsupported
+}
+
+// Chmod changes the mode of the named file to mode.
+func (*WebDAVFs) Chmod(name string, mode os.FileMode) error {
+	return ErrVfsUnsupported
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (*WebDAVFs) Chtimes(name string, atime, mtime time.Time) error {
+	return ErrVfsUnsupported
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported, while truncating an opened
+// file is handled inside base transfer
+func (*WebDAVFs) Truncate(name string, size int64) error {
+	return ErrVfsUnsupported
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *WebDAVFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	responses, err := fs.propfind(dirname, "1")
+	if err != nil {
+		return nil, err
+	}
+	dirPath := path.Clean(fs.getURLPath(dirname))
+	result := make([]os.FileInfo, 0, len(responses))
+	for _, r := range responses {
+		hrefPath, err := getWebDAVHrefPath(r.Href)
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to parse href %#v: %v", r.Href, err)
+			continue
+		}
+		if path.Clean(hrefPath) == dirPath {
+			continue
+		}
+		if info, ok := fs.getFileInfo(r, hrefPath); ok {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// OpenDir returns a DirLister for the directory named by dirname,
+// a PROPFIND request returns the whole directory, the entries are returned page by page from memory
+func (fs *WebDAVFs) OpenDir(dirname string) (DirLister, error) {
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return newSliceDirLister(files), nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Upload resume is not supported on WebDAV
+func (*WebDAVFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Uploads are streamed to the remote server, atomicity depends on
+// the server implementation
+func (*WebDAVFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*WebDAVFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*WebDAVFs) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*WebDAVFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported
+}
+
+// CheckRootPath creates the local directory used for temporary files and
+// the remote prefix if they don't exist
+func (fs *WebDAVFs) CheckRootPath(username string, uid int, gid int) bool {
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	if !osFs.CheckRootPath(username, uid, gid) {
+		return false
+	}
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	_, err := fs.Stat(fs.config.Prefix)
+	if err == nil {
+		return true
+	}
+	if !fs.IsNotExist(err) {
+		fsLog(fs, logger.LevelWarn, "unable to check root path %#v: %v", fs.config.Prefix, err)
+		return false
+	}
+	dir := "/"
+	for _, elem := range strings.Split(strings.TrimPrefix(fs.config.Prefix, "/"), "/") {
+		dir = path.Join(dir, elem)
+		if err = fs.Mkdir(dir); err != nil && !os.IsExist(err) {
+			fsLog(fs, logger.LevelWarn, "error creating root path %#v: %v", dir, err)
+			return false
+		}
+	}
+	return true
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size
+func (fs *WebDAVFs) ScanRootDirContents() (int, int64, error) {
+	return fs.GetDirSize(fs.config.Prefix)
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload
+func (*WebDAVFs) GetAtomicUploadPath(name string) string {
+	dir := path.Dir(name)
+	guid := xid.New().String()
+	return path.Join(dir, ".sftpgo-upload."+guid+"."+path.Base(name))
+}
+
+// GetRelativePath returns the path for a file relative to the WebDAV prefix if any.
+// This is the path as seen by SFTPGo users
+func (fs *WebDAVFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		return "/" + rel
+	}
+	if fs.config.Prefix != "/" {
+		if !strings.HasPrefix(rel, fs.config.Prefix) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
+	}
+	return rel
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *WebDAVFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return fs.walk(root, info, walkFn)
+}
+
+func (fs *WebDAVFs) walk(name string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(name, info, nil)
+	}
+	contents, err := fs.ReadDir(name)
+	if err := walkFn(name, info, err); err != nil || contents == nil {
+		return err
+	}
+	for _, fi := range contents {
+		err = fs.walk(path.Join(name, fi.Name()), fi, walkFn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins any number of path elements into a single path
+func (*WebDAVFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*WebDAVFs) HasVirtualFolders() bool {
+	return false
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual path
+func (fs *WebDAVFs) ResolvePath(virtualPath string) (string, error) {
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return fs.Join(fs.config.Prefix, virtualPath), nil
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *WebDAVFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, dirname)
+	if err == nil && isDir {
+		err = fs.Walk(dirname, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				size += info.Size()
+				numFiles++
+			}
+			return nil
+		})
+	}
+	return numFiles, size, err
+}
+
+// GetMimeType returns the content type
+func (fs *WebDAVFs) GetMimeType(name string) (string, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, http.MethodGet, name, nil, map[string]string{
+		"Range": "bytes=0-511",
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fs.getStatusError("open", name, resp.StatusCode)
+	}
+	var buf [512]byte
+	n, err := io.ReadFull(resp.Body, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Close closes the fs
+func (fs *WebDAVFs) Close() error {
+	fs.client.CloseIdleConnections()
+	return nil
+}
+
+// GetAvailableDiskSize return the available size for the specified path
+func (*WebDAVFs) GetAvailableDiskSize(dirName string) (int64, error) {
+	return 0, errStorageSizeUnavailable
+}
+
+func (fs *WebDAVFs) download(ctx context.Context, name string, offset int64, w io.Writer) (int64, error) {
+	var headers map[string]string
+	if offset > 0 {
+		headers = map[string]string{
+			"Range": fmt.Sprintf("bytes=%v-", offset),
+		}
+	}
+	resp, err := fs.doRequest(ctx, http.MethodGet, name, nil, headers)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if offset > 0 {
+			// the server does not support range requests
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				return 0, err
+			}
+		}
+	default:
+		return 0, fs.getStatusError("open", name, resp.StatusCode)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+func (fs *WebDAVFs) upload(ctx context.Context, name string, r io.Reader) error {
+	// the transport must not close the pipe reader, we close it ourself
+	resp, err := fs.doRequest(ctx, http.MethodPut, name, ioutil.NopCloser(r), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return fs.getStatusError("create", name, resp.StatusCode)
+	}
+}
+
+func (fs *WebDAVFs) propfind(name, depth string) ([]webDAVResponse, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, "PROPFIND", name, strings.NewReader(webDAVPropfindBody), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fs.getStatusError("stat", name, resp.StatusCode)
+	}
+	var ms webDAVMultiStatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("unable to decode PROPFIND response: %v", err)
+	}
+	return ms.Responses, nil
+}
+
+func (fs *WebDAVFs) doRequest(ctx context.Context, method, name string, body io.Reader,
+	headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, fs.getURL(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if fs.config.Username != "" {
+		req.SetBasicAuth(fs.config.Username, fs.config.Password.GetPayload())
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("SFTPGo/%v", version.Get().Version))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return fs.client.Do(req)
+}
+
+// getURLPath returns the unescaped URL path for the specified fs path
+func (fs *WebDAVFs) getURLPath(name string) string {
+	return path.Join("/", fs.endpoint.Path, name)
+}
+
+func (fs *WebDAVFs) getURL(name string) string {
+	u := *fs.endpoint
+	u.Path = fs.getURLPath(name)
+	u.RawPath = ""
+	return u.String()
+}
+
+// getWebDAVHrefPath returns the unescaped path for an href returned by the server,
+// href can be an absolute URL or an absolute path
+func getWebDAVHrefPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+func (*WebDAVFs) getFileInfo(r webDAVResponse, name string) (os.FileInfo, bool) {
+	for _, ps := range r.Propstat {
+		if !strings.Contains(ps.Status, " 200") {
+			continue
+		}
+		isDir := ps.Prop.ResourceType.Collection != nil
+		var size int64
+		if !isDir {
+			size, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64)
+		}
+		modTime, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified))
+		if err != nil {
+			modTime = time.Unix(0, 0)
+		}
+		name = strings.TrimSuffix(name, "/")
+		if name == "" {
+			name = "/"
+		}
+		return NewFileInfo(name, isDir, size, modTime, false), true
+	}
+	return nil, false
+}
+
+func (fs *WebDAVFs) getStatusError(op, name string, statusCode int) error {
+	var err error
+	switch statusCode {
+	case http.StatusNotFound, http.StatusConflict:
+		// 409 is returned if an intermediate collection does not exist
+		err = os.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		err = os.ErrPermission
+	default:
+		err = fmt.Errorf("unexpected status code: %v", statusCode)
+	}
+	fsLog(fs, logger.LevelDebug, "%v failed for path %#v, status code: %v", op, name, statusCode)
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
@@ -29,6 +29,7 @@ type webDavFile struct {
 	startOffset int64
 	isFinished  bool
 	readTryed   int32
+	lister      *common.DirListerAt
 }
 
 func newWebDavFile(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter, pipeReader *pipeat.PipeReaderAt) *webDavFile {
@@ -79,12 +80,33 @@ func (fi *webDavFileInfo) ContentType(ctx context.Context) (string, error) {
 	return "", webdav.ErrNotImplemented
 }
 
-// Readdir reads directory entries from the handle
+// Readdir reads directory entries from the handle. If count > 0 up to count
+// entries are returned and the next call continues from where the previous
+// one stopped, io.EOF is returned at the end of the directory.
+// If count <= 0 all the remaining entries are returned
 func (f *webDavFile) Readdir(count int) ([]os.FileInfo, error) {
 	if !f.Connection.User.HasPerm(dataprovider.PermListItems, f.GetVirtualPath()) {
 		return nil, f.Connection.GetPermissionDeniedError()
 	}
-	fileInfos, err := f.Connection.ListDir(f.GetFsPath(), f.GetVirtualPath())
+	if f.lister == nil {
+		lister, err := f.Connection.ListDir(f.GetFsPath(), f.GetVirtualPath())
+		if err != nil {
+			return nil, err
+		}
+		f.lister = lister
+	}
+	var fileInfos []os.FileInfo
+	var err error
+	if count > 0 {
+		for len(fileInfos) == 0 && err == nil {
+			fileInfos, err = f.lister.Next(count)
+		}
+		if err == io.EOF && len(fileInfos) > 0 {
+			err = nil
+		}
+	} else {
+		fileInfos, err = vfs.ReadAllDir(f.lister)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -122,7 +144,7 @@ func (f *webDavFile) Stat() (os.FileInfo, error) {
 		return nil, err
 	}
 	if vfs.IsCryptOsFs(f.Fs) {
-		info = f.Fs.(*vfs.CryptFs).ConvertFileInfo(info)
+		info = vfs.ConvertCryptFileInfo(info)
 	}
 	fi := &webDavFileInfo{
 		FileInfo:    info,
@@ -193,6 +215,7 @@ func (f *webDavFile) Write(p []byte) (n int, err error) {
 	f.Connection.UpdateLastActivity()
 
 	n, err = f.writer.Write(p)
+	f.SniffContent(p[:n], atomic.LoadInt64(&f.BytesReceived))
 	atomic.AddInt64(&f.BytesReceived, int64(n))
 
 	if f.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&f.BytesReceived) > f.MaxWriteSize {
@@ -215,7 +238,7 @@ func (f *webDavFile) updateStatInfo() error {
 		return err
 	}
 	if vfs.IsCryptOsFs(f.Fs) {
-		info = f.Fs.(*vfs.CryptFs).ConvertFileInfo(info)
+		info = vfs.ConvertCryptFileInfo(info)
 	}
 	f.info = info
 	return nil
@@ -304,6 +327,9 @@ func (f *webDavFile) Close() error {
 
 func (f *webDavFile) closeIO() error {
 	var err error
+	if f.lister != nil {
+		f.lister.Close()
+	}
 	if f.File != nil {
 		err = f.File.Close()
 	} else if f.writer != nil {
@@ -158,8 +158,9 @@ func (c *Connection) getFile(fsPath, virtualPath string) (webdav.File, error) {
 	var cancelFn func()
 
 	// for cloud fs we open the file when we receive the first read to avoid to download the first part of
-	// the file if it was opened only to do a stat or a readdir and so it is not a real download
-	if vfs.IsLocalOrSFTPFs(c.Fs) {
+	// the file if it was opened only to do a stat or a readdir and so it is not a real download.
+	// The same applies to the files moved to the tiering target
+	if vfs.IsLocalOrSFTPFs(c.Fs) && !vfs.IsTieredFile(c.Fs, fsPath) {
 		file, r, cancelFn, err = c.Fs.Open(fsPath, 0)
 		if err != nil {
 			c.Log(logger.LevelWarn, "could not open file %#v for reading: %+v", fsPath, err)
@@ -207,7 +208,16 @@ func (c *Connection) putFile(fsPath, virtualPath string) (webdav.File, error) {
 		return nil, c.GetPermissionDeniedError()
 	}
 
-	return c.handleUploadToExistingFile(fsPath, filePath, stat.Size(), virtualPath)
+	if err := c.CheckRetentionLock(fsPath, virtualPath, stat); err != nil {
+		return nil, err
+	}
+
+	if vfs.IsOverlayLowerFile(c.Fs, fsPath) {
+		// read-only lower layer files are not included in the quota
+		return c.handleUploadToNewFile(fsPath, filePath, virtualPath)
+	}
+
+	return c.handleUploadToExistingFile(fsPath, filePath, vfs.GetQuotaSize(stat), virtualPath)
 }
 
 func (c *Connection) handleUploadToNewFile(resolvedPath, filePath, requestPath string) (webdav.File, error) {
@@ -359,7 +369,7 @@ func (c *Connection) orderDirsToRemove(dirsToRemove []objectMapping) []objectMap
 	removedDirs := make([]string, 0, len(dirsToRemove))
 
 	pathSeparator := "/"
-	if vfs.IsLocalOsFs(c.Fs) {
+	if vfs.IsLocalStorage(c.Fs) {
 		pathSeparator = string(os.PathSeparator)
 	}
 
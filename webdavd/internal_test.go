@@ -19,6 +19,7 @@ import (
 
 	"github.com/eikenb/pipeat"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/webdav"
 
 	"github.com/drakkan/sftpgo/common"
@@ -698,6 +699,58 @@ func TestContentType(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestReaddirPages(t *testing.T) {
+	user := dataprovider.User{
+		HomeDir: filepath.Join(os.TempDir(), "readdir_pages"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	err := os.MkdirAll(user.HomeDir, os.ModePerm)
+	assert.NoError(t, err)
+	numFiles := 7
+	for i := 0; i < numFiles; i++ {
+		err = ioutil.WriteFile(filepath.Join(user.HomeDir, fmt.Sprintf("file%v", i)), []byte("data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	fs := vfs.NewOsFs("connID", user.HomeDir, nil)
+	connection := &Connection{
+		BaseConnection: common.NewBaseConnection(fs.ConnectionID(), common.ProtocolWebDAV, user, fs),
+	}
+	baseTransfer := common.NewBaseTransfer(nil, connection.BaseConnection, nil, user.HomeDir, "/",
+		common.TransferDownload, 0, 0, 0, false, fs)
+	davFile := newWebDavFile(baseTransfer, nil, nil)
+	var names []string
+	for {
+		files, err := davFile.Readdir(3)
+		if err == io.EOF {
+			assert.Len(t, files, 0)
+			break
+		}
+		require.NoError(t, err)
+		assert.NotEmpty(t, files)
+		assert.LessOrEqual(t, len(files), 3)
+		for _, info := range files {
+			names = append(names, info.Name())
+		}
+	}
+	assert.Len(t, names, numFiles)
+	err = davFile.Close()
+	assert.NoError(t, err)
+
+	davFile = newWebDavFile(baseTransfer, nil, nil)
+	files, err := davFile.Readdir(2)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	files, err = davFile.Readdir(0)
+	assert.NoError(t, err)
+	assert.Len(t, files, numFiles-2)
+	err = davFile.Close()
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(user.HomeDir)
+	assert.NoError(t, err)
+}
+
 func TestTransferReadWriteErrors(t *testing.T) {
 	user := dataprovider.User{
 		HomeDir: filepath.Clean(os.TempDir()),
@@ -294,7 +294,11 @@ func TestBasicHandling(t *testing.T) {
 	u.QuotaSize = 6553600
 	sftpUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	for _, user := range []dataprovider.User{localUser, sftpUser} {
+	u = getTestWebDAVFsUser()
+	u.QuotaSize = 6553600
+	webDAVFsUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	for _, user := range []dataprovider.User{localUser, sftpUser, webDAVFsUser} {
 		client := getWebDavClient(user)
 		assert.NoError(t, checkBasicFunc(client))
 		testFilePath := filepath.Join(homeBasePath, testFileName)
@@ -366,6 +370,10 @@ func TestBasicHandling(t *testing.T) {
 	}
 	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
 	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(webDAVFsUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(webDAVFsUser.GetHomeDir())
+	assert.NoError(t, err)
 	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.RemoveAll(localUser.GetHomeDir())
@@ -1650,6 +1658,17 @@ func getTestSFTPUser() dataprovider.User {
 	return u
 }
 
+func getTestWebDAVFsUser() dataprovider.User {
+	u := getTestUser()
+	u.Username = u.Username + "_webdavfs"
+	u.FsConfig.Provider = dataprovider.WebDAVFilesystemProvider
+	u.FsConfig.WebDAVConfig.Endpoint = fmt.Sprintf("http://%v/%v", webDavServerAddr, defaultUsername)
+	u.FsConfig.WebDAVConfig.Username = defaultUsername
+	u.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret(defaultPassword)
+	u.FsConfig.WebDAVConfig.Prefix = "/webdavfs"
+	return u
+}
+
 func getTestUserWithCryptFs() dataprovider.User {
 	user := getTestUser()
 	user.FsConfig.Provider = dataprovider.CryptedFilesystemProvider